@@ -94,6 +94,7 @@ const (
 	SyncPrefix = "_sync:"
 
 	AttPrefix              = SyncPrefix + "att:"
+	AttUploadPrefix        = SyncPrefix + "attupload:"
 	BackfillCompletePrefix = SyncPrefix + "backfill:complete:"
 	BackfillPendingPrefix  = SyncPrefix + "backfill:pending:"
 	DCPCheckpointPrefix    = SyncPrefix + "dcp_ck:"
@@ -85,6 +85,7 @@ const (
 	StatKeyChannelCacheCompactCount            = "chan_cache_compact_count"
 	StatKeyChannelCacheCompactTime             = "chan_cache_compact_time"
 	StatKeyChannelCacheBypassCount             = "chan_cache_bypass_count"
+	StatKeyChannelCacheStaleQueries            = "chan_cache_stale_queries"
 	StatKeyActiveChannels                      = "num_active_channels"
 	StatKeyNumSkippedSeqs                      = "num_skipped_seqs"
 	StatKeyAbandonedSeqs                       = "abandoned_seqs"
@@ -120,6 +121,22 @@ const (
 	StatKeyDcpCachingTime          = "dcp_caching_time"
 	StatKeyCachingDcpStats         = "cache_feed"
 	StatKeyImportDcpStats          = "import_feed"
+	StatKeyAdmissionThrottled      = "admission_throttled"
+	StatKeyAdmissionRejectCount    = "admission_reject_count"
+	StatKeyMaxLifetimeCloseCount   = "max_lifetime_close_count"
+	StatKeyAttGCCandidates         = "attachment_gc_candidates"
+	StatKeyAttGCDeletedCount       = "attachment_gc_deleted_count"
+	StatKeyReconcileCount          = "reconcile_count"
+	StatKeyReconcileDiscrepancies  = "reconcile_discrepancies"
+	StatKeyAttAccessDenied         = "attachment_access_denied_count"
+	StatKeyPurgeBatchDocs          = "purge_batch_docs_count"
+	StatKeySecurityRejected        = "security_rejected_count"
+	StatKeyMultiplexedConnections  = "multiplexed_connections"
+	StatKeyMultiplexedMessages     = "multiplexed_messages_count"
+	StatKeyReplicationLoops        = "replication_loops_suppressed"
+	StatKeyBlipRequestCount        = "blip_request_count"
+	StatKeyBlipRequestErrors       = "blip_request_error_count"
+	StatKeyBlipInFlight            = "blip_requests_in_flight"
 
 	// StatsDeltaSync
 	StatKeyDeltasRequested           = "deltas_requested"
@@ -128,6 +145,16 @@ const (
 	StatKeyDeltaCacheHits            = "delta_cache_hit"
 	StatKeyDeltaCacheMisses          = "delta_cache_miss"
 	StatKeyDeltaPushDocCount         = "delta_push_doc_count"
+	StatKeyTemplateDeltasSent        = "template_deltas_sent"
+	StatKeyTemplateDeltaFallbacks    = "template_delta_fallbacks"
+	StatKeyJSONPatchDeltasSent       = "json_patch_deltas_sent"
+	StatKeyJSONPatchDeltaPushCount   = "json_patch_delta_push_doc_count"
+	StatKeyDeltasDisabledConns       = "delta_disabled_connections"
+	StatKeyAmbiguousDeltaFallbacks   = "delta_ambiguous_number_fallbacks"
+	StatKeyAmbiguousDeltaRejected    = "delta_ambiguous_number_rejected"
+	StatKeyDeltaLRUCacheHits         = "delta_lru_cache_hit"
+	StatKeyDeltaLRUCacheMisses       = "delta_lru_cache_miss"
+	StatKeyDeltasWastedFallback      = "deltas_wasted_fallback"
 
 	// StatsSharedBucketImport
 	StatKeyImportCount          = "import_count"
@@ -142,11 +169,34 @@ const (
 	StatKeyWriteProcessingTime = "write_processing_time"
 	StatKeySyncFunctionTime    = "sync_function_time"
 	StatKeySyncFunctionCount   = "sync_function_count"
+	StatKeySyncFnTimeHistogram = "sync_function_time_histogram"
+	StatKeySyncFnTimeoutCount  = "sync_function_timeout_count"
 	StatKeyProposeChangeTime   = "propose_change_time"
 	StatKeyProposeChangeCount  = "propose_change_count"
 	StatKeyAttachmentPushCount = "attachment_push_count"
 	StatKeyAttachmentPushBytes = "attachment_push_bytes"
 	StatKeyConflictWriteCount  = "conflict_write_count"
+	StatKeyAncestorsTruncated  = "possible_ancestors_truncated"
+	StatKeyRevQueueDepth       = "rev_queue_depth"
+	StatKeyRevReplayCount      = "idempotent_rev_replay_count"
+	StatKeyOrphanRevsBuffered  = "orphan_revs_buffered"
+	StatKeyOrphanRevsTimedOut  = "orphan_revs_timed_out"
+	StatKeyRevGenRejected      = "max_rev_generation_rejected_count"
+	StatKeyProofBatchCount     = "attachment_proof_batch_count"
+	StatKeyAttCompressedPush   = "attachment_compressed_push_count"
+	StatKeyAttUploadBytesSaved = "attachment_compressed_push_bytes_saved"
+	StatKeyRevChannelMismatch  = "rev_channel_mismatch_count"
+	StatKeyAttDownloadRetries  = "attachment_download_retry_count"
+	StatKeyAttDigestMismatch   = "attachment_mapped_digest_mismatch_count"
+	StatKeyConflictRejectCount = "propose_conflict_reject_count"
+	StatKeyConflictServerWins  = "propose_conflict_server_wins_count"
+	StatKeyConflictClientWins  = "propose_conflict_client_wins_count"
+	StatKeyProposeStreamCount  = "propose_change_streamed_count"
+	StatKeyRevDepthRejected    = "max_json_depth_rejected_count"
+	StatKeyReservedRejected    = "reserved_field_rejected_count"
+	StatKeyReservedStripped    = "reserved_field_stripped_count"
+	StatKeyPushDocsTracked     = "push_distinct_docs"
+	StatKeyPushDocsRejected    = "push_doc_limit_rejected_count"
 
 	// StatsCBLReplicationPull
 	StatKeyPullReplicationsActiveOneShot    = "num_pull_repl_active_one_shot"
@@ -163,6 +213,43 @@ const (
 	StatKeyMaxPending                       = "max_pending"
 	StatKeyAttachmentPullCount              = "attachment_pull_count"
 	StatKeyAttachmentPullBytes              = "attachment_pull_bytes"
+	StatKeyDeniedChannelChangesSuppressed   = "denied_channel_changes_suppressed"
+	StatKeyRevResendCount                   = "rev_resend_count"
+	StatKeyRevResendAbandonedCount          = "rev_resend_abandoned_count"
+	StatKeyRevChecksumMismatchCount         = "rev_checksum_mismatch_count"
+	StatKeyRecoverableTombstoneCount        = "recoverable_tombstone_count"
+	StatKeyCheckpointMismatchCount          = "checkpoint_mismatch_count"
+	StatKeyDependencyCycleCount             = "dependency_order_cycle_count"
+	StatKeyAttCoalescedPullCount            = "attachment_coalesced_pull_count"
+	StatKeyAttCoalescedBytesSaved           = "attachment_coalesced_pull_bytes_saved"
+	StatKeyAttCompressedPull                = "attachment_compressed_pull_count"
+	StatKeyAttPullBytesSaved                = "attachment_compressed_pull_bytes_saved"
+	StatKeyNoAttachmentsSkipped             = "changes_without_attachments_skipped"
+	StatKeyCaughtUpConnections              = "caught_up_connections"
+	StatKeyKeepaliveSentCount               = "keepalive_sent_count"
+	StatKeyHeartbeatSentCount               = "heartbeat_sent_count"
+	StatKeyChangesPacingDelay               = "changes_pacing_delay_time"
+	StatKeyRevChunkedCount                  = "rev_chunked_count"
+	StatKeyRevChunksSent                    = "rev_chunks_sent"
+	StatKeyChangesFlushCount                = "changes_flush_count"
+	StatKeyRevSummariesSent                 = "rev_summaries_sent"
+	StatKeyRevSummaryCacheHits              = "rev_summary_cache_hits"
+	StatKeyAttRepeatCount                   = "attachment_repeat_count"
+	StatKeyAttRepeatRejected                = "attachment_repeat_rejected_count"
+	StatKeyAttRepeatCacheHits               = "attachment_repeat_cache_hits"
+	StatKeyAttRepeatCacheMisses             = "attachment_repeat_cache_misses"
+	StatKeyProgressMilestones               = "progress_milestones_count"
+	StatKeyTombstonesCollapsed              = "tombstones_first_collapsed_count"
+	StatKeyDocSizeSkipped                   = "doc_size_filter_skipped"
+	StatKeySequenceBarrierWaits             = "sequence_barrier_wait_count"
+	StatKeySequenceBarrierTimeouts          = "sequence_barrier_timeout_count"
+	StatKeyDeliveryLogSkipped               = "delivery_log_skipped_count"
+	StatKeySubscriptionsExpired             = "subscription_ttl_expired_count"
+	StatKeyRevokedDocsSent                  = "revoked_docs_sent"
+	StatKeyExcludedChannelChanges           = "excluded_channel_changes_skipped"
+	StatKeyNamedFilterUses                  = "named_filter_uses"
+	StatKeyPullChannelDocsSent              = "channel_docs_sent"
+	StatKeyChangesBatchesInFlight           = "changes_batches_in_flight"
 
 	// StatsSecurity
 	StatKeyNumDocsRejected  = "num_docs_rejected"
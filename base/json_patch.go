@@ -0,0 +1,325 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON Patch (RFC 6902) operations
+const (
+	JSONPatchAdd     = "add"
+	JSONPatchRemove  = "remove"
+	JSONPatchReplace = "replace"
+	JSONPatchMove    = "move"
+	JSONPatchCopy    = "copy"
+	JSONPatchTest    = "test"
+)
+
+// JSONPatchDiff returns an RFC 6902 JSON Patch that transforms old into new.  Objects are diffed property by
+// property, while any other changed value (including an array) is replaced as a whole, so only add, remove and
+// replace operations are generated.
+func JSONPatchDiff(old, new map[string]interface{}) (patch []byte, err error) {
+	ops := diffJSONObjects("", old, new, make([]map[string]interface{}, 0))
+	return JSONMarshal(ops)
+}
+
+func diffJSONObjects(path string, old, new map[string]interface{}, ops []map[string]interface{}) []map[string]interface{} {
+	for _, key := range sortedJSONKeys(old) {
+		if _, ok := new[key]; !ok {
+			ops = append(ops, map[string]interface{}{"op": JSONPatchRemove, "path": path + "/" + escapeJSONPointerToken(key)})
+		}
+	}
+	for _, key := range sortedJSONKeys(new) {
+		keyPath := path + "/" + escapeJSONPointerToken(key)
+		oldValue, ok := old[key]
+		if !ok {
+			ops = append(ops, map[string]interface{}{"op": JSONPatchAdd, "path": keyPath, "value": new[key]})
+			continue
+		}
+		oldObject, oldIsObject := oldValue.(map[string]interface{})
+		newObject, newIsObject := new[key].(map[string]interface{})
+		if oldIsObject && newIsObject {
+			ops = diffJSONObjects(keyPath, oldObject, newObject, ops)
+		} else if !jsonValuesEqual(oldValue, new[key]) {
+			ops = append(ops, map[string]interface{}{"op": JSONPatchReplace, "path": keyPath, "value": new[key]})
+		}
+	}
+	return ops
+}
+
+func sortedJSONKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonValuesEqual compares values by their canonical JSON, so that e.g. a json.Number and a float64 holding the same
+// number are equal.
+func jsonValuesEqual(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	aBytes, aErr := JSONMarshalCanonical(a)
+	bBytes, bErr := JSONMarshalCanonical(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
+
+// JSONPatchApply applies an RFC 6902 JSON Patch to doc, which may be modified in place, and returns the result.  All
+// six operations are supported.  The result must be a JSON object.
+func JSONPatchApply(doc map[string]interface{}, patch []byte) (map[string]interface{}, error) {
+	var ops []map[string]interface{}
+	if err := JSONUnmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %v", err)
+	}
+	var root interface{} = doc
+	for i, op := range ops {
+		var err error
+		if root, err = applyJSONPatchOp(root, op); err != nil {
+			return nil, fmt.Errorf("JSON patch operation %d: %v", i, err)
+		}
+	}
+	result, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("JSON patch result isn't an object")
+	}
+	return result, nil
+}
+
+func applyJSONPatchOp(root interface{}, op map[string]interface{}) (interface{}, error) {
+	opName, _ := op["op"].(string)
+	path, ok := op["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing path")
+	}
+	tokens, err := parseJSONPointer(path)
+	if err != nil {
+		return nil, err
+	}
+	value, hasValue := op["value"]
+
+	switch opName {
+	case JSONPatchAdd, JSONPatchReplace:
+		if !hasValue {
+			return nil, fmt.Errorf("missing value for %s", opName)
+		}
+		return setJSONPointer(root, tokens, value, opName == JSONPatchAdd)
+	case JSONPatchRemove:
+		root, _, err = removeJSONPointer(root, tokens)
+		return root, err
+	case JSONPatchMove, JSONPatchCopy:
+		from, ok := op["from"].(string)
+		if !ok {
+			return nil, fmt.Errorf("missing from for %s", opName)
+		}
+		fromTokens, err := parseJSONPointer(from)
+		if err != nil {
+			return nil, err
+		}
+		if opName == JSONPatchMove {
+			if strings.HasPrefix(path+"/", from+"/") && path != from {
+				return nil, fmt.Errorf("can't move %q into its own child", from)
+			}
+			if root, value, err = removeJSONPointer(root, fromTokens); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = getJSONPointer(root, fromTokens); err != nil {
+				return nil, err
+			}
+			value = deepCopyJSONValue(value)
+		}
+		return setJSONPointer(root, tokens, value, true)
+	case JSONPatchTest:
+		if !hasValue {
+			return nil, fmt.Errorf("missing value for test")
+		}
+		actual, err := getJSONPointer(root, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonValuesEqual(actual, value) {
+			return nil, fmt.Errorf("test failed for %q", path)
+		}
+		return root, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", opName)
+	}
+}
+
+// parseJSONPointer parses an RFC 6901 JSON Pointer into its reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func escapeJSONPointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// jsonArrayIndex parses an array index token.  When insert is true the index may equal the array length, and "-"
+// refers to the end of the array.
+func jsonArrayIndex(token string, length int, insert bool) (int, error) {
+	if insert && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || strconv.Itoa(index) != token {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (index == length && !insert) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func getJSONPointer(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("property %q not found", token)
+			}
+			node = value
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("can't index into a scalar with %q", token)
+		}
+	}
+	return node, nil
+}
+
+// modifyJSONPointer calls modify with the container holding the value the tokens refer to and the last token, and
+// returns node with the container replaced by modify's result.
+func modifyJSONPointer(node interface{}, tokens []string, modify func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return modify(node, tokens[0])
+	}
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, ok := container[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("property %q not found", tokens[0])
+		}
+		child, err := modifyJSONPointer(child, tokens[1:], modify)
+		if err != nil {
+			return nil, err
+		}
+		container[tokens[0]] = child
+		return container, nil
+	case []interface{}:
+		index, err := jsonArrayIndex(tokens[0], len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := modifyJSONPointer(container[index], tokens[1:], modify)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+	default:
+		return nil, fmt.Errorf("can't index into a scalar with %q", tokens[0])
+	}
+}
+
+// setJSONPointer adds (when insert is true) or replaces the value the tokens refer to.
+func setJSONPointer(root interface{}, tokens []string, value interface{}, insert bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyJSONPointer(root, tokens, func(node interface{}, token string) (interface{}, error) {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok && !insert {
+				return nil, fmt.Errorf("property %q not found", token)
+			}
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container), insert)
+			if err != nil {
+				return nil, err
+			}
+			if !insert {
+				container[index] = value
+				return container, nil
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("can't index into a scalar with %q", token)
+		}
+	})
+}
+
+// removeJSONPointer removes the value the tokens refer to, returning it.
+func removeJSONPointer(root interface{}, tokens []string) (newRoot interface{}, removed interface{}, err error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the root")
+	}
+	newRoot, err = modifyJSONPointer(root, tokens, func(node interface{}, token string) (interface{}, error) {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("property %q not found", token)
+			}
+			removed = value
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = container[index]
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("can't index into a scalar with %q", token)
+		}
+	})
+	return newRoot, removed, err
+}
+
+func deepCopyJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = deepCopyJSONValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = deepCopyJSONValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
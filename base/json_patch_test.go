@@ -0,0 +1,85 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJSONPatchRoundTrip verifies that a generated patch transforms the old body into the new one.
+func TestJSONPatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"unchanged", `{"a": 1}`, `{"a": 1}`},
+		{"add, remove and replace", `{"a": 1, "b": "x"}`, `{"a": 2, "c": null}`},
+		{"nested objects", `{"a": {"b": {"c": 1, "d": 2}}}`, `{"a": {"b": {"c": 1, "e": [1, 2]}}}`},
+		{"object replaced by scalar", `{"a": {"b": 1}}`, `{"a": "b"}`},
+		{"arrays", `{"a": [1, 2, 3]}`, `{"a": [1, 3]}`},
+		{"escaped keys", `{"a/b": 1, "c~d": 2}`, `{"a/b": 3, "e~/f": 4}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var oldBody, newBody, expected map[string]interface{}
+			require.NoError(t, JSONUnmarshal([]byte(tt.old), &oldBody))
+			require.NoError(t, JSONUnmarshal([]byte(tt.new), &newBody))
+			require.NoError(t, JSONUnmarshal([]byte(tt.new), &expected))
+
+			patch, err := JSONPatchDiff(oldBody, newBody)
+			require.NoError(t, err)
+			if tt.old == tt.new {
+				assert.Equal(t, "[]", string(patch))
+			}
+
+			patched, err := JSONPatchApply(oldBody, patch)
+			require.NoError(t, err)
+			assert.Equal(t, expected, patched)
+		})
+	}
+}
+
+// TestJSONPatchApply verifies each RFC 6902 operation, and that invalid operations are rejected.
+func TestJSONPatchApply(t *testing.T) {
+	doc := func() map[string]interface{} {
+		var body map[string]interface{}
+		require.NoError(t, JSONUnmarshal([]byte(`{"a": {"b": 1}, "list": ["x", "y"]}`), &body))
+		return body
+	}
+	tests := []struct {
+		name     string
+		patch    string
+		expected string // Empty if the patch should fail
+	}{
+		{"add to object", `[{"op": "add", "path": "/c", "value": 2}]`, `{"a": {"b": 1}, "c": 2, "list": ["x", "y"]}`},
+		{"insert into array", `[{"op": "add", "path": "/list/1", "value": "z"}]`, `{"a": {"b": 1}, "list": ["x", "z", "y"]}`},
+		{"append to array", `[{"op": "add", "path": "/list/-", "value": "z"}]`, `{"a": {"b": 1}, "list": ["x", "y", "z"]}`},
+		{"remove", `[{"op": "remove", "path": "/list/0"}]`, `{"a": {"b": 1}, "list": ["y"]}`},
+		{"replace", `[{"op": "replace", "path": "/a/b", "value": null}]`, `{"a": {"b": null}, "list": ["x", "y"]}`},
+		{"move", `[{"op": "move", "from": "/a/b", "path": "/b"}]`, `{"a": {}, "b": 1, "list": ["x", "y"]}`},
+		{"copy", `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/d", "value": 2}]`, `{"a": {"b": 1}, "c": {"b": 1, "d": 2}, "list": ["x", "y"]}`},
+		{"test passes", `[{"op": "test", "path": "/a/b", "value": 1}]`, `{"a": {"b": 1}, "list": ["x", "y"]}`},
+		{"test fails", `[{"op": "test", "path": "/a/b", "value": 2}]`, ""},
+		{"replace missing", `[{"op": "replace", "path": "/c", "value": 2}]`, ""},
+		{"remove missing", `[{"op": "remove", "path": "/a/c"}]`, ""},
+		{"array index out of range", `[{"op": "add", "path": "/list/3", "value": "z"}]`, ""},
+		{"move into own child", `[{"op": "move", "from": "/a", "path": "/a/c"}]`, ""},
+		{"unknown op", `[{"op": "merge", "path": "/a"}]`, ""},
+		{"root replaced by non-object", `[{"op": "replace", "path": "", "value": 1}]`, ""},
+		{"not a patch", `{"op": "add"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := JSONPatchApply(doc(), []byte(tt.patch))
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var expected map[string]interface{}
+			require.NoError(t, JSONUnmarshal([]byte(tt.expected), &expected))
+			assert.Equal(t, expected, patched)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package base
+
+import (
+	"context"
+	"net/http"
+)
+
+// Span attribute keys
+const (
+	SpanAttrCorrelationID = "sg.correlation_id"
+	SpanAttrSerialNumber  = "sg.serial_number"
+	SpanAttrDocID         = "sg.doc_id"
+	SpanAttrDigest        = "sg.attachment_digest"
+)
+
+// Tracer starts spans for distributed tracing.  It's implemented by an adapter over an OpenTelemetry tracer and
+// propagator, so that spans can be exported to whatever backend the deployment uses.
+type Tracer interface {
+	// Extract returns ctx carrying the trace context propagated in the given headers (e.g. a W3C traceparent), if any.
+	Extract(ctx context.Context, headers http.Header) context.Context
+
+	// Start starts a span with the given name, as a child of the span or propagated trace context in ctx.
+	Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span)
+}
+
+// Span is a traced operation started by a Tracer.
+type Span interface {
+	// SetError marks the span as failed with the given error.
+	SetError(err error)
+
+	// End completes the span.
+	End()
+}
+
+// StartSpan starts a span using the given tracer, or returns a span that does nothing if tracer is nil.
+func StartSpan(tracer Tracer, ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name, attributes)
+}
+
+// EndSpan ends span, first marking it as failed if err is non-nil.
+func EndSpan(span Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// noopSpan is the Span returned when no Tracer is configured.
+type noopSpan struct{}
+
+func (noopSpan) SetError(err error) {}
+func (noopSpan) End()               {}
@@ -518,6 +518,25 @@ func WriteHistogram(expvarMap *expvar.Map, since time.Time, prefix string) {
 	WriteHistogramForDuration(expvarMap, time.Since(since), prefix)
 }
 
+// DurationHistogramBounds are the upper bounds of the buckets counted by AddToDurationHistogram.
+var DurationHistogramBounds = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// AddToDurationHistogram counts a duration in the first bucket whose upper bound it doesn't exceed, keyed by the
+// bound (e.g. "le_10ms"), or in "gt_5s" when it exceeds them all.  Unlike WriteHistogramForDuration, the histogram is
+// maintained regardless of log level.
+func AddToDurationHistogram(expvarMap *expvar.Map, duration time.Duration) {
+	for _, bound := range DurationHistogramBounds {
+		if duration <= bound {
+			expvarMap.Add("le_"+bound.String(), 1)
+			return
+		}
+	}
+	expvarMap.Add("gt_"+DurationHistogramBounds[len(DurationHistogramBounds)-1].String(), 1)
+}
+
 func WriteHistogramForDuration(expvarMap *expvar.Map, duration time.Duration, prefix string) {
 
 	if LogDebugEnabled(KeyAll) {
@@ -960,6 +979,62 @@ func Crc32cHashString(input []byte) string {
 	return fmt.Sprintf("0x%x", Crc32cHash(input))
 }
 
+// JSONDepthExceeds returns true if the JSON objects and arrays in data are nested more than maxDepth deep, found in
+// a single scan of the bytes without parsing them.  Malformed JSON is left for the parser to reject.
+func JSONDepthExceeds(data []byte, maxDepth int) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			if c == '\\' {
+				i++ // Skip the escaped character
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// ValueDepthExceeds returns true if the maps and slices in an unmarshalled JSON value are nested more than maxDepth
+// deep.  Nesting beyond maxDepth isn't visited.
+func ValueDepthExceeds(value interface{}, maxDepth int) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if maxDepth < 1 {
+			return true
+		}
+		for _, item := range v {
+			if ValueDepthExceeds(item, maxDepth-1) {
+				return true
+			}
+		}
+	case []interface{}:
+		if maxDepth < 1 {
+			return true
+		}
+		for _, item := range v {
+			if ValueDepthExceeds(item, maxDepth-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func SplitHostPort(hostport string) (string, string, error) {
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
@@ -1259,6 +1334,115 @@ func injectJSONPropertyFromBytes(b []byte, bIsEmpty bool, kvPairs []KVPairBytes)
 	return newJSON
 }
 
+// StripJSONProperties takes the given JSON object byte slice, and returns it without the given top-level properties,
+// along with the raw values of those that were present, without unmarshalling it or modifying the given byte slice.
+//
+// Keys are compared as they appear in b, so a key written with escape sequences isn't matched.
+func StripJSONProperties(b []byte, keys ...string) (stripped []byte, removed map[string][]byte, err error) {
+	b = bytes.TrimSpace(b)
+
+	bIsJSONObject, _ := isJSONObject(b)
+	if !bIsJSONObject {
+		return nil, nil, errors.New("b is not a JSON object")
+	}
+
+	removed = make(map[string][]byte, len(keys))
+	stripped = make([]byte, 1, len(b))
+	stripped[0] = '{'
+
+	end := len(b) - 1
+	pos := skipJSONWhitespace(b, 1)
+	for pos < end {
+		memberStart := pos
+		keyEnd, err := skipJSONValue(b, pos)
+		if err != nil || b[pos] != '"' {
+			return nil, nil, errors.New("invalid JSON object key")
+		}
+		key := string(b[pos+1 : keyEnd-1])
+
+		pos = skipJSONWhitespace(b, keyEnd)
+		if pos >= end || b[pos] != ':' {
+			return nil, nil, errors.New("missing ':' after JSON object key")
+		}
+		valueStart := skipJSONWhitespace(b, pos+1)
+		valueEnd, err := skipJSONValue(b, valueStart)
+		if err != nil || valueEnd == valueStart || valueEnd > end {
+			return nil, nil, errors.New("invalid JSON object value")
+		}
+
+		pos = skipJSONWhitespace(b, valueEnd)
+		if pos < end {
+			if b[pos] != ',' {
+				return nil, nil, errors.New("missing ',' between JSON object members")
+			}
+			pos = skipJSONWhitespace(b, pos+1)
+		}
+
+		if StringSliceContains(keys, key) {
+			removed[key] = b[valueStart:valueEnd]
+			continue
+		}
+		if len(stripped) > 1 {
+			stripped = append(stripped, ',')
+		}
+		stripped = append(stripped, b[memberStart:valueEnd]...)
+	}
+
+	return append(stripped, '}'), removed, nil
+}
+
+// skipJSONWhitespace returns the position of the first non-whitespace byte in b at or after pos.
+func skipJSONWhitespace(b []byte, pos int) int {
+	for pos < len(b) && (b[pos] == ' ' || b[pos] == '\t' || b[pos] == '\n' || b[pos] == '\r') {
+		pos++
+	}
+	return pos
+}
+
+// skipJSONValue returns the position just after the JSON value starting at pos in b.  Values are only checked as far
+// as is needed to find where they end.
+func skipJSONValue(b []byte, pos int) (int, error) {
+	if pos >= len(b) {
+		return 0, errors.New("unexpected end of JSON")
+	}
+	depth := 0
+	for ; pos < len(b); pos++ {
+		switch b[pos] {
+		case '"':
+			for pos++; pos < len(b) && b[pos] != '"'; pos++ {
+				if b[pos] == '\\' {
+					pos++
+				}
+			}
+			if pos >= len(b) {
+				return 0, errors.New("unterminated JSON string")
+			}
+		case '{', '[':
+			depth++
+			continue
+		case '}', ']':
+			depth--
+			if depth < 0 {
+				return pos, nil
+			}
+		case ',', ' ', '\t', '\n', '\r', ':':
+			if depth == 0 {
+				return pos, nil
+			}
+			continue
+		default:
+			continue
+		}
+		if depth == 0 {
+			return pos + 1, nil
+		}
+	}
+	if depth > 0 {
+		return 0, errors.New("unterminated JSON object or array")
+	}
+	return pos, nil
+}
+
 // WrapJSONUnknownFieldErr wraps JSON unknown field errors with ErrUnknownField for later checking via errors.Cause
 func WrapJSONUnknownFieldErr(err error) error {
 	if err != nil && strings.Contains(err.Error(), "unknown field") {
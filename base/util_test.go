@@ -10,6 +10,7 @@
 package base
 
 import (
+	"expvar"
 	"fmt"
 	"log"
 	"math"
@@ -748,6 +749,63 @@ func TestInjectJSONProperties(t *testing.T) {
 	}
 }
 
+func TestStripJSONProperties(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedErr    string
+	}{
+		{
+			input:       `null`,
+			expectedErr: `not a JSON object`,
+		},
+		{
+			input:       `{"_rev":}`,
+			expectedErr: `invalid JSON object value`,
+		},
+		{
+			input:       `{"_rev" "1-a"}`,
+			expectedErr: `missing ':'`,
+		},
+		{
+			input:          "{}",
+			expectedOutput: `{}`,
+		},
+		{
+			input:          `{"_rev":"0-1"}`,
+			expectedOutput: `{}`,
+		},
+		{
+			input:          `{"key":"val","_rev":"0-1","_id":"doc"}`,
+			expectedOutput: `{"key":"val"}`,
+		},
+		{
+			input:          ` { "_rev" : "0-1" , "key" : [1, {"_rev": "}"}] , "other":"a\"b}" } `,
+			expectedOutput: `{"key" : [1, {"_rev": "}"}],"other":"a\"b}"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(tt *testing.T) {
+			output, removed, err := StripJSONProperties([]byte(test.input), "_rev", "_id")
+			if test.expectedErr != "" {
+				require.Error(tt, err)
+				assert.Contains(tt, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(tt, err, "unexpected error")
+			assert.Equal(tt, test.expectedOutput, string(output))
+			if rev, ok := removed["_rev"]; ok {
+				assert.Equal(tt, `"0-1"`, string(rev))
+			}
+
+			var m map[string]interface{}
+			err = JSONUnmarshal(output, &m)
+			assert.NoError(tt, err, "produced invalid JSON")
+		})
+	}
+}
+
 func TestInjectJSONPropertiesDiffTypes(t *testing.T) {
 
 	tests := []struct {
@@ -1311,3 +1369,31 @@ func TestGetRestrictedIntQuery(t *testing.T) {
 	)
 	assert.Equal(t, minValue, restricted)
 }
+
+func TestJSONDepthExceeds(t *testing.T) {
+	assert.False(t, JSONDepthExceeds([]byte(`{"a": [1, {"b": 2}]}`), 3))
+	assert.True(t, JSONDepthExceeds([]byte(`{"a": [1, {"b": [2]}]}`), 3))
+	assert.False(t, JSONDepthExceeds([]byte(`[{}, {}, [], {"a": {}}]`), 3))
+	// Brackets and escaped quotes within strings aren't nesting
+	assert.False(t, JSONDepthExceeds([]byte(`{"a": "[[[{{{\"]]]", "b": "\\"}`), 1))
+	assert.False(t, JSONDepthExceeds([]byte(`"[[["`), 0))
+}
+
+func TestValueDepthExceeds(t *testing.T) {
+	var value interface{}
+	require.NoError(t, JSONUnmarshal([]byte(`{"a": [1, {"b": [2]}], "c": {}}`), &value))
+	assert.False(t, ValueDepthExceeds(value, 4))
+	assert.True(t, ValueDepthExceeds(value, 3))
+	assert.False(t, ValueDepthExceeds("scalar", 0))
+}
+
+func TestAddToDurationHistogram(t *testing.T) {
+	histogram := new(expvar.Map)
+	AddToDurationHistogram(histogram, 500*time.Microsecond)
+	AddToDurationHistogram(histogram, time.Millisecond)
+	AddToDurationHistogram(histogram, 20*time.Millisecond)
+	AddToDurationHistogram(histogram, time.Minute)
+	assert.Equal(t, int64(2), ExpvarVar2Int(histogram.Get("le_1ms")))
+	assert.Equal(t, int64(1), ExpvarVar2Int(histogram.Get("le_50ms")))
+	assert.Equal(t, int64(1), ExpvarVar2Int(histogram.Get("gt_5s")))
+}
@@ -12,6 +12,8 @@ package channels
 import (
 	"encoding/json"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -28,7 +30,8 @@ type ChannelMapperOutput struct {
 }
 
 type ChannelMapper struct {
-	*sgbucket.JSServer // "Superclass"
+	*sgbucket.JSServer        // "Superclass"
+	timeout            *int64 // Nanoseconds each call may run for, shared with the SyncRunners.  Atomic access
 }
 
 // Maps user names (or role names prefixed with "role:") to arrays of channel or role names
@@ -39,14 +42,27 @@ type AccessMap map[string]base.Set
 const kTaskCacheSize = 16
 
 func NewChannelMapper(fnSource string) *ChannelMapper {
+	timeout := new(int64)
 	return &ChannelMapper{
 		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return NewSyncRunner(fnSource)
+				runner, err := NewSyncRunner(fnSource)
+				if err != nil {
+					return nil, err
+				}
+				runner.timeout = timeout
+				return runner, nil
 			}),
+		timeout: timeout,
 	}
 }
 
+// SetTimeout sets how long the sync function may run for on each call before it's interrupted, and the call returns
+// ErrSyncFnTimeout.  Zero, the default, is unlimited.
+func (mapper *ChannelMapper) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(mapper.timeout, int64(timeout))
+}
+
 func NewDefaultChannelMapper() *ChannelMapper {
 	return NewChannelMapper(`function(doc){channel(doc.channels);}`)
 }
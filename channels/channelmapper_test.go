@@ -11,6 +11,7 @@ package channels
 
 import (
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	goassert "github.com/couchbaselabs/go.assert"
@@ -502,6 +503,18 @@ func TestExpiryFunctionMultipleInvocation(t *testing.T) {
 	goassert.True(t, res7.Expiry == nil)
 }
 
+// Verify a sync function that runs longer than the timeout is interrupted, and that the mapper remains usable.
+func TestSyncFunctionTimeout(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {if (doc.loop) {while (true) {}} channel("foo")}`)
+	mapper.SetTimeout(100 * time.Millisecond)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"loop": true}`), `{}`, noUser)
+	assert.Equal(t, ErrSyncFnTimeout, err)
+
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed after timeout")
+	goassert.DeepEquals(t, res.Channels, SetOf(t, "foo"))
+}
+
 func TestChangedUsers(t *testing.T) {
 	a := AccessMap{"alice": SetOf(t, "x", "y"), "bita": SetOf(t, "z"), "claire": SetOf(t, "w")}
 	b := AccessMap{"alice": SetOf(t, "x", "z"), "bita": SetOf(t, "z"), "diana": SetOf(t, "w")}
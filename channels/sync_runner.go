@@ -10,8 +10,11 @@
 package channels
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -22,6 +25,12 @@ import (
 // Prefix used to identify roles in access grants
 const RoleAccessPrefix = "role:"
 
+// ErrSyncFnTimeout is returned when the sync function is interrupted for running longer than its timeout.
+var ErrSyncFnTimeout = errors.New("Sync function exceeded its time limit")
+
+// errSyncFnInterrupted is the panic raised within the JS runtime to interrupt a sync function that's timed out.
+var errSyncFnInterrupted = errors.New("sync function interrupted")
+
 const funcWrapper = `
 	function() {
 
@@ -83,6 +92,7 @@ const funcWrapper = `
 		}
 
 		return function (newDoc, oldDoc, _realUserCtx) {
+			_startTimeout();
 			realUserCtx = _realUserCtx;
 
 			if (oldDoc) {
@@ -113,18 +123,37 @@ type SyncRunner struct {
 	access            map[string][]string // channels granted to users via access() callback
 	roles             map[string][]string // roles granted to users via role() callback
 	expiry            *uint32             // document expiry (in seconds) specified via expiry() callback
+	funcSource        string              // The unwrapped sync function, to re-create the JS runtime from after an interrupt
+	timeout           *int64              // Nanoseconds a call may run for before it's interrupted, shared with the ChannelMapper.  Nil or zero is unlimited.  Atomic access
+	timeoutTimer      *time.Timer         // Interrupts the running call once its timeout elapses
+	interrupted       bool                // Whether a call was interrupted, leaving the JS runtime unusable
 }
 
 func NewSyncRunner(funcSource string) (*SyncRunner, error) {
-	funcSource = wrappedFuncSource(funcSource)
 	runner := &SyncRunner{}
-	err := runner.InitWithLogging(funcSource,
+	if err := runner.init(funcSource); err != nil {
+		return nil, err
+	}
+	return runner, nil
+}
+
+// init creates the runner's JS runtime for the given sync function, and defines the callbacks it can make.
+func (runner *SyncRunner) init(funcSource string) error {
+	runner.funcSource = funcSource
+	runner.interrupted = false
+	err := runner.InitWithLogging(wrappedFuncSource(funcSource),
 		func(s string) { base.Errorf(base.KeyJavascript.String()+": Sync %s", base.UD(s)) },
 		func(s string) { base.Infof(base.KeyJavascript, "Sync %s", base.UD(s)) })
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	// Called by the wrapper as the sync function starts, to interrupt it if it runs for too long
+	runner.DefineNativeFunction("_startTimeout", func(call otto.FunctionCall) otto.Value {
+		runner.startTimeout(call.Otto)
+		return otto.UndefinedValue()
+	})
+
 	// Implementation of the 'channel()' callback:
 	runner.DefineNativeFunction("channel", func(call otto.FunctionCall) otto.Value {
 		for _, arg := range call.ArgumentList {
@@ -208,12 +237,64 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		}
 		return output, err
 	}
-	return runner, nil
+	return nil
 }
 
 func (runner *SyncRunner) SetFunction(funcSource string) (bool, error) {
-	funcSource = wrappedFuncSource(funcSource)
-	return runner.JSRunner.SetFunction(funcSource)
+	runner.funcSource = funcSource
+	return runner.JSRunner.SetFunction(wrappedFuncSource(funcSource))
+}
+
+// Call runs the sync function, returning ErrSyncFnTimeout if it's interrupted for running longer than the timeout.
+// An interrupted call may leave the JS runtime in an inconsistent state, so it's re-created before the next call.
+func (runner *SyncRunner) Call(inputs ...interface{}) (result interface{}, err error) {
+	if runner.interrupted {
+		if err := runner.init(runner.funcSource); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		runner.stopTimeout()
+		if caught := recover(); caught != nil {
+			if caught != errSyncFnInterrupted {
+				panic(caught)
+			}
+			runner.interrupted = true
+			runner.output = nil
+			result, err = nil, ErrSyncFnTimeout
+		}
+	}()
+	return runner.JSRunner.Call(inputs...)
+}
+
+// startTimeout arms a timer that interrupts the running call once the timeout elapses.  Each call gets its own
+// interrupt channel, so that a timer firing as a call completes can't interrupt the next one.
+func (runner *SyncRunner) startTimeout(vm *otto.Otto) {
+	if runner.timeoutTimer != nil {
+		return // Already armed for this call
+	}
+	vm.Interrupt = nil
+	var timeout time.Duration
+	if runner.timeout != nil {
+		timeout = time.Duration(atomic.LoadInt64(runner.timeout))
+	}
+	if timeout <= 0 {
+		return
+	}
+	interrupt := make(chan func(), 1)
+	vm.Interrupt = interrupt
+	runner.timeoutTimer = time.AfterFunc(timeout, func() {
+		interrupt <- func() {
+			panic(errSyncFnInterrupted)
+		}
+	})
+}
+
+func (runner *SyncRunner) stopTimeout() {
+	if runner.timeoutTimer != nil {
+		runner.timeoutTimer.Stop()
+		runner.timeoutTimer = nil
+	}
 }
 
 // Common implementation of 'access()' and 'role()' callbacks
@@ -73,8 +73,9 @@ func (bar *ActiveReplicator) Close() error {
 	return nil
 }
 
-// blipSync opens a connection to the target, and returns a blip.Sender to send messages over.
-func blipSync(target url.URL, blipContext *blip.Context) (*blip.Sender, error) {
+// blipSync opens a connection to the target, and returns a blip.Sender to send messages over.  A non-empty nodeID is
+// announced to the target as the replication node ID of the database replicating.
+func blipSync(target url.URL, blipContext *blip.Context, nodeID string) (*blip.Sender, error) {
 	// GET target database endpoint to see if reachable for exit-early/clearer error message
 	resp, err := http.Get(target.String())
 	if err != nil {
@@ -105,6 +106,9 @@ func blipSync(target url.URL, blipContext *blip.Context) (*blip.Sender, error) {
 	if target.User != nil {
 		config.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(target.User.String())))
 	}
+	if nodeID != "" {
+		config.Header.Set(BlipReplicationNodeHeader, nodeID)
+	}
 
 	return blipContext.DialConfig(config)
 }
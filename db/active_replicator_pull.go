@@ -78,7 +78,11 @@ func (apr *ActivePullReplicator) connect() (err error) {
 	bsc := NewBlipSyncContext(blipContext, apr.config.ActiveDB, blipContext.ID)
 	apr.blipSyncContext = bsc
 
-	apr.blipSender, err = blipSync(*apr.config.PassiveDBURL, apr.blipSyncContext.blipContext)
+	// Announce the database's replication node ID, if it has one, so that the passive peer can detect loops
+	nodeID := apr.config.ActiveDB.Options.BlipSyncOptions.ReplicationNodeID
+	bsc.loopDetection = nodeID != ""
+
+	apr.blipSender, err = blipSync(*apr.config.PassiveDBURL, apr.blipSyncContext.blipContext, nodeID)
 	if err != nil {
 		return err
 	}
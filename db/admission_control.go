@@ -0,0 +1,120 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// admissionSampleInterval is how often bucket operation latency is re-evaluated
+	admissionSampleInterval = time.Second
+
+	// DefaultAdmissionRetryAfter is the Retry-After hint given to clients rejected while throttled
+	DefaultAdmissionRetryAfter = 5 * time.Second
+)
+
+// ErrAdmissionRejected is returned when new replication work is rejected because bucket operations are too slow.
+type ErrAdmissionRejected struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrAdmissionRejected) Error() string {
+	return fmt.Sprintf("Server is overloaded, retry after %v", e.RetryAfter)
+}
+
+// Cause allows ErrAdmissionRejected to be reported as a 503 Service Unavailable.
+func (e *ErrAdmissionRejected) Cause() error {
+	return base.HTTPErrorf(http.StatusServiceUnavailable, "%s", e.Error())
+}
+
+// admissionController rejects new subChanges and rev requests while recent bucket operation latency is above a
+// threshold, so that an overloaded bucket isn't given yet more work.  Latency is derived from the existing push
+// write and pull rev send stats, averaged over the operations completed since the previous sample.  As the write
+// processing time also covers REST writes and rejected revs, this is an approximation that errs on the high side.
+// Throttling stops once latency falls below half the threshold, to avoid flapping around it.  When no operations
+// complete during a sample interval the latency is unknown and requests are admitted again, which lets new work
+// probe whether the bucket has recovered.
+type admissionController struct {
+	threshold  time.Duration
+	retryAfter time.Duration
+	dbStats    *DatabaseStats
+
+	lock       sync.Mutex
+	lastSample time.Time
+	lastTime   int64 // Cumulative operation time (ns) at the last sample
+	lastCount  int64 // Cumulative operation count at the last sample
+	throttled  bool
+}
+
+// newAdmissionController returns an admission controller, or nil when the threshold is zero (disabled).
+func newAdmissionController(threshold, retryAfter time.Duration, dbStats *DatabaseStats) *admissionController {
+	if threshold <= 0 {
+		return nil
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultAdmissionRetryAfter
+	}
+	ac := &admissionController{
+		threshold:  threshold,
+		retryAfter: retryAfter,
+		dbStats:    dbStats,
+		lastSample: time.Now(),
+	}
+	ac.lastTime, ac.lastCount = bucketOpLatency(dbStats)
+	return ac
+}
+
+// admit returns ErrAdmissionRejected if new work should be rejected.  Safe to call on a nil controller.
+func (ac *admissionController) admit() error {
+	if ac == nil {
+		return nil
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if now := time.Now(); now.Sub(ac.lastSample) >= admissionSampleInterval {
+		totalTime, totalCount := bucketOpLatency(ac.dbStats)
+		ac.update(totalTime-ac.lastTime, totalCount-ac.lastCount)
+		ac.lastSample, ac.lastTime, ac.lastCount = now, totalTime, totalCount
+	}
+
+	if ac.throttled {
+		ac.dbStats.StatsDatabase().Add(base.StatKeyAdmissionRejectCount, 1)
+		return &ErrAdmissionRejected{RetryAfter: ac.retryAfter}
+	}
+	return nil
+}
+
+// update sets the throttled state from the operations completed over the last sample interval.
+func (ac *admissionController) update(opTime, opCount int64) {
+	wasThrottled := ac.throttled
+	if opCount <= 0 {
+		ac.throttled = false
+	} else if latency := time.Duration(opTime / opCount); ac.throttled {
+		ac.throttled = latency >= ac.threshold/2
+	} else {
+		ac.throttled = latency >= ac.threshold
+	}
+
+	if ac.throttled != wasThrottled {
+		throttledVal := 0
+		if ac.throttled {
+			throttledVal = 1
+		}
+		ac.dbStats.StatsDatabase().Set(base.StatKeyAdmissionThrottled, base.ExpvarIntVal(throttledVal))
+		base.Infof(base.KeySync, "Admission control throttling=%t", ac.throttled)
+	}
+}
+
+// bucketOpLatency returns the total time spent and number of operations for bucket-bound replication work.
+func bucketOpLatency(dbStats *DatabaseStats) (totalTime, totalCount int64) {
+	push := dbStats.CblReplicationPush()
+	pull := dbStats.StatsCblReplicationPull()
+	totalTime = base.ExpvarVar2Int(push.Get(base.StatKeyWriteProcessingTime)) + base.ExpvarVar2Int(pull.Get(base.StatKeyRevSendLatency))
+	totalCount = base.ExpvarVar2Int(push.Get(base.StatKeyDocPushCount)) + base.ExpvarVar2Int(pull.Get(base.StatKeyRevSendCount))
+	return totalTime, totalCount
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAdmissionControllerThrottling verifies throttling starts above the latency threshold and only stops once
+// latency falls below half of it.
+func TestAdmissionControllerThrottling(t *testing.T) {
+	assert.Nil(t, newAdmissionController(0, 0, NewDatabaseStats()))
+	assert.NoError(t, (*admissionController)(nil).admit())
+
+	dbStats := NewDatabaseStats()
+	ac := newAdmissionController(100*time.Millisecond, 0, dbStats)
+	assert.Equal(t, DefaultAdmissionRetryAfter, ac.retryAfter)
+	assert.NoError(t, ac.admit())
+
+	throttledStat := func() int64 {
+		return base.ExpvarVar2Int(dbStats.StatsDatabase().Get(base.StatKeyAdmissionThrottled))
+	}
+
+	// Average latency of 150ms
+	ac.update(int64(300*time.Millisecond), 2)
+	assert.True(t, ac.throttled)
+	assert.Equal(t, int64(1), throttledStat())
+	err := ac.admit()
+	assert.Equal(t, &ErrAdmissionRejected{RetryAfter: DefaultAdmissionRetryAfter}, err)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(dbStats.StatsDatabase().Get(base.StatKeyAdmissionRejectCount)))
+
+	// Still throttled while latency is above half the threshold
+	ac.update(int64(60*time.Millisecond), 1)
+	assert.True(t, ac.throttled)
+
+	ac.update(int64(40*time.Millisecond), 1)
+	assert.False(t, ac.throttled)
+	assert.Equal(t, int64(0), throttledStat())
+	assert.NoError(t, ac.admit())
+
+	// No completed operations means latency is unknown, and requests are admitted
+	ac.update(int64(300*time.Millisecond), 2)
+	assert.True(t, ac.throttled)
+	ac.update(0, 0)
+	assert.False(t, ac.throttled)
+}
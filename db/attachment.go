@@ -10,10 +10,20 @@
 package db
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
 
+	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
 )
 
@@ -52,33 +62,21 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 			return nil, base.HTTPErrorf(400, "Invalid _attachments")
 		}
 		data := meta["data"]
-		if data != nil {
+		if streamed, ok := data.(streamedAttachment); ok {
+			// Attachment was stored as it was received, and verified against its digest, so only its metadata remains
+			claimedDigest, _ := meta["digest"].(string)
+			atts[name] = storedAttachmentMeta(meta, AttachmentKey(claimedDigest), int(streamed), generation)
+		} else if data != nil {
 			// Attachment contains data, so store it in the db:
 			attachment, err := DecodeAttachment(data)
 			if err != nil {
 				return nil, err
 			}
-			key := AttachmentKey(Sha1DigestKey(attachment))
+			// An attachment pushed with a sha256 digest is stored under one, otherwise under its sha1 digest
+			claimedDigest, _ := meta["digest"].(string)
+			key := AttachmentKey(DigestKeyLike(claimedDigest, attachment))
 			newAttachmentData[key] = attachment
-
-			newMeta := map[string]interface{}{
-				"stub":   true,
-				"digest": string(key),
-				"revpos": generation,
-			}
-			if contentType, ok := meta["content_type"].(string); ok {
-				newMeta["content_type"] = contentType
-			}
-			if encoding := meta["encoding"]; encoding != nil {
-				newMeta["encoding"] = encoding
-				newMeta["encoded_length"] = len(attachment)
-				if length, ok := meta["length"].(float64); ok {
-					newMeta["length"] = length
-				}
-			} else {
-				newMeta["length"] = len(attachment)
-			}
-			atts[name] = newMeta
+			atts[name] = storedAttachmentMeta(meta, key, len(attachment), generation)
 
 		} else {
 			// Attachment must be a stub that repeats a parent attachment
@@ -105,6 +103,29 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 	return newAttachmentData, nil
 }
 
+// storedAttachmentMeta returns the metadata a doc stores for an attachment stored under the given key, replacing the
+// metadata it was given with.
+func storedAttachmentMeta(meta map[string]interface{}, key AttachmentKey, size int, generation int) map[string]interface{} {
+	newMeta := map[string]interface{}{
+		"stub":   true,
+		"digest": string(key),
+		"revpos": generation,
+	}
+	if contentType, ok := meta["content_type"].(string); ok {
+		newMeta["content_type"] = contentType
+	}
+	if encoding := meta["encoding"]; encoding != nil {
+		newMeta["encoding"] = encoding
+		newMeta["encoded_length"] = size
+		if length, ok := meta["length"].(float64); ok {
+			newMeta["length"] = length
+		}
+	} else {
+		newMeta["length"] = size
+	}
+	return newMeta
+}
+
 // Attempts to retrieve ancestor attachments for a document. First attempts to find and use a non-pruned ancestor.
 // If no non-pruned ancestor is available, checks whether the currently active doc has a common ancestor with the new revision.
 // If it does, can use the attachments on the active revision with revpos earlier than that common ancestor.
@@ -241,22 +262,34 @@ func (db *Database) ForEachStubAttachment(body Body, minRevpos int, callback Att
 
 // GenerateProofOfAttachment returns a nonce and proof for an attachment body.
 func GenerateProofOfAttachment(attachmentData []byte) (nonce []byte, proof string) {
+	return GenerateProofOfAttachmentWithAlgorithm(DigestAlgorithmSHA1, attachmentData)
+}
+
+// GenerateProofOfAttachmentWithAlgorithm returns a nonce and proof for an attachment body, hashed with the given
+// digest algorithm, as for an attachment whose digest uses it.
+func GenerateProofOfAttachmentWithAlgorithm(algorithm string, attachmentData []byte) (nonce []byte, proof string) {
 	nonce = make([]byte, 20)
 	if _, err := rand.Read(nonce); err != nil {
 		base.Panicf("Failed to generate random data: %s", err)
 	}
-	proof = ProveAttachment(attachmentData, nonce)
+	proof = ProveAttachmentWithAlgorithm(algorithm, attachmentData, nonce)
 	base.Tracef(base.KeyCRUD, "Generated nonce %v and proof %q for attachment: %v", nonce, proof, attachmentData)
 	return nonce, proof
 }
 
 // ProveAttachment returns the proof for an attachment body and nonce pair.
 func ProveAttachment(attachmentData, nonce []byte) (proof string) {
-	d := sha1.New()
+	return ProveAttachmentWithAlgorithm(DigestAlgorithmSHA1, attachmentData, nonce)
+}
+
+// ProveAttachmentWithAlgorithm returns the proof for an attachment body and nonce pair, hashed with the given digest
+// algorithm.
+func ProveAttachmentWithAlgorithm(algorithm string, attachmentData, nonce []byte) (proof string) {
+	d := newDigester(algorithm)
 	d.Write([]byte{byte(len(nonce))})
 	d.Write(nonce)
 	d.Write(attachmentData)
-	proof = "sha1-" + base64.StdEncoding.EncodeToString(d.Sum(nil))
+	proof = algorithm + "-" + base64.StdEncoding.EncodeToString(d.Sum(nil))
 	base.Tracef(base.KeyCRUD, "Generated proof %q using nonce %v for attachment: %v", proof, nonce, attachmentData)
 	return proof
 }
@@ -305,8 +338,254 @@ func DecodeAttachment(att interface{}) ([]byte, error) {
 	}
 }
 
+// ReadVerifiedAttachment reads an attachment body of the given length from r, computing its digest as it's read, and
+// returns it only if both the length and digest match.  At most length+1 bytes are read, so an oversized body is
+// rejected without reading the remainder.  The length is only trusted once it's been read, so the buffer grows with
+// the data rather than being sized up front.
+func ReadVerifiedAttachment(r io.Reader, length int64, digest string) ([]byte, error) {
+	if length < 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid length for attachment with digest: %s", digest)
+	}
+	algorithm := DigestAlgorithm(digest)
+	digester := newDigester(algorithm)
+	data := bytes.NewBuffer(make([]byte, 0, attachmentBufferSize(length)))
+	n, err := io.Copy(io.MultiWriter(data, digester), io.LimitReader(r, length+1))
+	if err != nil {
+		return nil, err
+	}
+	if n != length || algorithm+"-"+base64.StdEncoding.EncodeToString(digester.Sum(nil)) != digest {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
+	}
+	return data.Bytes(), nil
+}
+
+// attachmentStreamChunkSize is the most attachment data buffered at once while streaming an attachment to the bucket.
+const attachmentStreamChunkSize = 256 * 1024
+
+// attachmentBufferSize returns the size of buffer to start reading an attachment of the given declared length into.
+// The declared length comes from the client, so the buffer is never sized beyond a chunk from it.
+func attachmentBufferSize(length int64) int {
+	if length < attachmentStreamChunkSize {
+		return int(length)
+	}
+	return attachmentStreamChunkSize
+}
+
+// streamedAttachment is the data of an attachment's metadata once StoreVerifiedAttachment has stored it, in place of
+// the attachment body: the attachment's length.  It can't be given in a JSON body, so a client can't claim to have
+// stored an attachment it hasn't sent.
+type streamedAttachment int64
+
+// attachmentUploadTTL is how long the data of an attachment being streamed to the bucket is kept under its upload key,
+// so that an upload interrupted by a crash is discarded.
+const attachmentUploadTTL = time.Hour
+
+// maxAttachmentAddAttempts is the most times addVerifiedAttachment retries when the stored attachment changes
+// concurrently.
+const maxAttachmentAddAttempts = 3
+
+// newAttachment is an attachment StoreVerifiedAttachment stored, rather than finding it already stored.
+type newAttachment struct {
+	digest string
+	cas    uint64 // CAS the attachment was stored with
+}
+
+// StoreVerifiedAttachment streams an attachment body of the given length from r to the bucket, a chunk at a time while
+// computing the digest, so that no more than a chunk of unverified data is held in memory.  The body is streamed to a
+// key of its own, and only stored under its digest once its length and digest have been checked, so that a partial
+// or incorrect body is never stored under the digest.  No more than limit bytes are read, where limit must exceed
+// length, and the number read is returned, so that a caller can tell how far an oversized body overran.
+//
+// The CAS the attachment was stored with is returned, or zero if it was already stored.  Until a rev referencing the
+// new digest is written no doc refers to it, so a caller whose rev isn't written should remove it again with
+// removeNewAttachments.
+func (db *Database) StoreVerifiedAttachment(r io.Reader, length, limit int64, digest string) (n int64, cas uint64, err error) {
+	if length < 0 || limit <= length {
+		return 0, 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid length for attachment with digest: %s", digest)
+	}
+	uploadKey := base.AttUploadPrefix + base.GenerateRandomID()
+	algorithm := DigestAlgorithm(digest)
+	digester := newDigester(algorithm)
+	chunk := make([]byte, attachmentBufferSize(limit))
+	r = io.LimitReader(r, limit)
+
+	// The first chunk adds the upload, and later chunks are appended to it
+	started := false
+	store := func(data []byte) error {
+		if !started {
+			started = true
+			_, err := db.Bucket.AddRaw(uploadKey, base.DurationToCbsExpiry(attachmentUploadTTL), data)
+			return err
+		}
+		return db.Bucket.Append(uploadKey, data)
+	}
+	defer func() {
+		if started {
+			if deleteErr := db.Bucket.Delete(uploadKey); deleteErr != nil && !base.IsKeyNotFoundError(db.Bucket, deleteErr) {
+				base.WarnfCtx(db.Ctx, "Unable to remove upload of attachment with digest %s: %v", digest, deleteErr)
+			}
+		}
+	}()
+
+	for {
+		read, readErr := io.ReadFull(r, chunk)
+		_, _ = digester.Write(chunk[:read])
+		n += int64(read)
+		// Data beyond the declared length is only counted, as the attachment will be rejected
+		if n <= length && (read > 0 || !started) {
+			if err := store(chunk[:read]); err != nil {
+				return n, 0, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return n, 0, readErr
+		}
+	}
+	if n != length || algorithm+"-"+base64.StdEncoding.EncodeToString(digester.Sum(nil)) != digest {
+		return n, 0, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
+	}
+
+	data, _, err := db.Bucket.GetRaw(uploadKey)
+	if err != nil {
+		return n, 0, err
+	}
+	cas, err = db.addVerifiedAttachment(digest, data)
+	if err != nil {
+		return n, 0, err
+	}
+	if cas != 0 {
+		base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(digest))
+		db.DbStats.CblReplicationPush().Add(base.StatKeyAttachmentPushCount, 1)
+		db.DbStats.CblReplicationPush().Add(base.StatKeyAttachmentPushBytes, n)
+	}
+	return n, cas, nil
+}
+
+// addVerifiedAttachment stores verified attachment data under its digest, and returns the CAS it was stored with, or
+// zero if the same data was already stored.  Stored data is compared with the verified data before it's trusted, and
+// replaced if it differs, as a partial upload may have left it.  Data that's already stored is rewritten unchanged, so
+// that the request that stored it can't remove it again now that another rev may reference it.
+func (db *Database) addVerifiedAttachment(digest string, data []byte) (cas uint64, err error) {
+	key := attachmentKeyToString(AttachmentKey(digest))
+	for attempt := 0; attempt < maxAttachmentAddAttempts; attempt++ {
+		cas, err = db.Bucket.WriteCas(key, 0, 0, 0, data, sgbucket.Raw)
+		if err == nil {
+			return cas, nil
+		} else if !base.IsCasMismatch(err) {
+			return 0, err
+		}
+
+		stored, storedCas, err := db.Bucket.GetRaw(key)
+		if base.IsKeyNotFoundError(db.Bucket, err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		cas, err = db.Bucket.WriteCas(key, 0, 0, storedCas, data, sgbucket.Raw)
+		if err == nil {
+			if bytes.Equal(stored, data) {
+				return 0, nil
+			}
+			base.WarnfCtx(db.Ctx, "Replaced stored attachment with digest %s that didn't match its digest", digest)
+			return cas, nil
+		} else if !base.IsCasMismatch(err) && !base.IsKeyNotFoundError(db.Bucket, err) {
+			return 0, err
+		}
+	}
+	return 0, base.HTTPErrorf(http.StatusServiceUnavailable, "Attachment with digest %s is being stored concurrently", digest)
+}
+
+// removeNewAttachments removes attachments StoreVerifiedAttachment stored for a rev that wasn't written.  An attachment
+// another request has found stored since has been rewritten with a new CAS, and is kept for that request's rev.
+func (db *Database) removeNewAttachments(attachments []newAttachment) {
+	for _, attachment := range attachments {
+		_, err := db.Bucket.Remove(attachmentKeyToString(AttachmentKey(attachment.digest)), attachment.cas)
+		if err != nil && !base.IsCasMismatch(err) && !base.IsKeyNotFoundError(db.Bucket, err) {
+			base.WarnfCtx(db.Ctx, "Unable to remove attachment with digest %s stored for a rev that wasn't written: %v", attachment.digest, err)
+		}
+	}
+}
+
+// DigestMapper maps the digest of an attachment to the digest it's stored under.
+type DigestMapper func(digest string) string
+
+// Encodings an attachment may be compressed with in response to getAttachment, by the client or the server
+const (
+	AttachmentEncodingGzip    = "gzip"
+	AttachmentEncodingDeflate = "deflate" // zlib format, as for HTTP's deflate content coding
+)
+
+// SupportedAttachmentEncodings lists the attachment encodings advertised to clients, in order of preference.
+var SupportedAttachmentEncodings = []string{AttachmentEncodingGzip, AttachmentEncodingDeflate}
+
+// NewAttachmentDecoder returns a reader decompressing attachment data sent with the given encoding.  The decompressed
+// data should be read via StoreVerifiedAttachment or ReadVerifiedAttachment, which stop reading past the attachment's
+// expected length.
+func NewAttachmentDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case AttachmentEncodingGzip:
+		return gzip.NewReader(r)
+	case AttachmentEncodingDeflate:
+		return zlib.NewReader(r)
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unsupported attachment encoding %q", encoding)
+	}
+}
+
+// NewAttachmentEncoder returns a writer compressing attachment data with the given encoding, for sending in response
+// to getAttachment.  The writer must be closed to flush the compressed data.
+func NewAttachmentEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case AttachmentEncodingGzip:
+		return gzip.NewWriter(w), nil
+	case AttachmentEncodingDeflate:
+		return zlib.NewWriter(w), nil
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unsupported attachment encoding %q", encoding)
+	}
+}
+
 func Sha1DigestKey(data []byte) string {
-	digester := sha1.New()
+	return digestKey(DigestAlgorithmSHA1, data)
+}
+
+// Sha256DigestKey returns the sha256 digest of an attachment, for connections that negotiated sha256 digests.
+func Sha256DigestKey(data []byte) string {
+	return digestKey(DigestAlgorithmSHA256, data)
+}
+
+// Algorithms attachment digests are computed with, as the prefix of the digest
+const (
+	DigestAlgorithmSHA1   = "sha1"
+	DigestAlgorithmSHA256 = "sha256"
+)
+
+// DigestAlgorithm returns the algorithm an attachment digest was computed with.  Digests without a sha256 prefix are
+// treated as sha1, as every digest was before sha256 digests were supported, so that they're verified as before.
+func DigestAlgorithm(digest string) string {
+	if strings.HasPrefix(digest, DigestAlgorithmSHA256+"-") {
+		return DigestAlgorithmSHA256
+	}
+	return DigestAlgorithmSHA1
+}
+
+// DigestKeyLike returns the digest of an attachment computed with the same algorithm as the given digest.
+func DigestKeyLike(digest string, data []byte) string {
+	return digestKey(DigestAlgorithm(digest), data)
+}
+
+func digestKey(algorithm string, data []byte) string {
+	digester := newDigester(algorithm)
 	digester.Write(data)
-	return "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
+}
+
+// newDigester returns a hash for the given digest algorithm.
+func newDigester(algorithm string) hash.Hash {
+	if algorithm == DigestAlgorithmSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
 }
@@ -10,6 +10,8 @@
 package db
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -526,6 +528,177 @@ func TestGenerateProofOfAttachment(t *testing.T) {
 	assert.Equal(t, proof1, proof2, "GenerateProofOfAttachment and ProveAttachment produced different proofs.")
 }
 
+func TestReadVerifiedAttachment(t *testing.T) {
+	attData := []byte(`hello world`)
+	digest := Sha1DigestKey(attData)
+
+	data, err := ReadVerifiedAttachment(strings.NewReader(string(attData)), int64(len(attData)), digest)
+	assert.NoError(t, err)
+	assert.Equal(t, attData, data)
+
+	// Length mismatches, in either direction
+	_, err = ReadVerifiedAttachment(strings.NewReader(string(attData)+"!"), int64(len(attData)), digest)
+	assert.Error(t, err)
+	_, err = ReadVerifiedAttachment(strings.NewReader(string(attData)), int64(len(attData)+1), digest)
+	assert.Error(t, err)
+
+	// Digest mismatch
+	_, err = ReadVerifiedAttachment(strings.NewReader("hello World"), int64(len(attData)), digest)
+	assert.Error(t, err)
+
+	// A sha256 digest is verified with sha256
+	sha256Digest := Sha256DigestKey(attData)
+	data, err = ReadVerifiedAttachment(strings.NewReader(string(attData)), int64(len(attData)), sha256Digest)
+	assert.NoError(t, err)
+	assert.Equal(t, attData, data)
+	_, err = ReadVerifiedAttachment(strings.NewReader("hello World"), int64(len(attData)), sha256Digest)
+	assert.Error(t, err)
+}
+
+// TestStoreVerifiedAttachment verifies attachment data streamed in chunks is stored under its digest once verified, and
+// not when it doesn't match its metadata.
+func TestStoreVerifiedAttachment(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	attData := bytes.Repeat([]byte("0123456789"), attachmentStreamChunkSize/4)
+	digest := Sha1DigestKey(attData)
+	length := int64(len(attData))
+
+	n, cas, err := db.StoreVerifiedAttachment(bytes.NewReader(attData), length, length+1, digest)
+	require.NoError(t, err)
+	assert.Equal(t, length, n)
+	assert.NotZero(t, cas)
+	stored, err := db.GetAttachment(AttachmentKey(digest))
+	require.NoError(t, err)
+	assert.Equal(t, attData, stored)
+
+	// An attachment that's already stored is only verified
+	_, cas, err = db.StoreVerifiedAttachment(bytes.NewReader(attData), length, length+1, digest)
+	assert.NoError(t, err)
+	assert.Zero(t, cas)
+	_, _, err = db.StoreVerifiedAttachment(bytes.NewReader(append([]byte("!"), attData[1:]...)), length, length+1, digest)
+	assert.Error(t, err)
+	stored, err = db.GetAttachment(AttachmentKey(digest))
+	require.NoError(t, err)
+	assert.Equal(t, attData, stored)
+
+	// A digest mismatch found once several chunks are read stores nothing
+	otherData := append(append([]byte(nil), attData[:len(attData)-1]...), '!')
+	otherDigest := Sha256DigestKey(otherData)
+	_, _, err = db.StoreVerifiedAttachment(bytes.NewReader(attData), length, length+1, otherDigest)
+	assert.Error(t, err)
+	_, err = db.GetAttachment(AttachmentKey(otherDigest))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Nor does a body that's shorter or longer than declared, whose length is read up to the limit
+	_, _, err = db.StoreVerifiedAttachment(bytes.NewReader(otherData[:len(otherData)-1]), length, length+1, otherDigest)
+	assert.Error(t, err)
+	n, _, err = db.StoreVerifiedAttachment(bytes.NewReader(append(otherData, "overrun"...)), length, length+5, otherDigest)
+	assert.Error(t, err)
+	assert.Equal(t, length+5, n)
+	_, err = db.GetAttachment(AttachmentKey(otherDigest))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Empty attachments are stored too
+	_, _, err = db.StoreVerifiedAttachment(bytes.NewReader(nil), 0, 1, Sha1DigestKey(nil))
+	require.NoError(t, err)
+	stored, err = db.GetAttachment(AttachmentKey(Sha1DigestKey(nil)))
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+// TestStoreVerifiedAttachmentReplacesPartial verifies stored data that doesn't match its digest, as a partial upload
+// may have left, isn't trusted but replaced.
+func TestStoreVerifiedAttachmentReplacesPartial(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	attData := []byte("hello world")
+	digest := Sha1DigestKey(attData)
+	_, err := db.Bucket.AddRaw(attachmentKeyToString(AttachmentKey(digest)), 0, attData[:5])
+	require.NoError(t, err)
+
+	_, cas, err := db.StoreVerifiedAttachment(bytes.NewReader(attData), int64(len(attData)), int64(len(attData))+1, digest)
+	require.NoError(t, err)
+	assert.NotZero(t, cas)
+	stored, err := db.GetAttachment(AttachmentKey(digest))
+	require.NoError(t, err)
+	assert.Equal(t, attData, stored)
+}
+
+// TestRemoveNewAttachments verifies an attachment stored for a rev that isn't written is removed, unless another
+// request has found it stored since.
+func TestRemoveNewAttachments(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	store := func(data []byte) newAttachment {
+		digest := Sha1DigestKey(data)
+		_, cas, err := db.StoreVerifiedAttachment(bytes.NewReader(data), int64(len(data)), int64(len(data))+1, digest)
+		require.NoError(t, err)
+		return newAttachment{digest: digest, cas: cas}
+	}
+
+	rejected := store([]byte("rejected"))
+	require.NotZero(t, rejected.cas)
+	db.removeNewAttachments([]newAttachment{rejected})
+	_, err := db.GetAttachment(AttachmentKey(rejected.digest))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	shared := store([]byte("shared"))
+	require.NotZero(t, shared.cas)
+	assert.Zero(t, store([]byte("shared")).cas)
+	db.removeNewAttachments([]newAttachment{shared})
+	stored, err := db.GetAttachment(AttachmentKey(shared.digest))
+	require.NoError(t, err, "An attachment another request found stored should be kept")
+	assert.Equal(t, []byte("shared"), stored)
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	attData := []byte(`hello world`)
+	assert.Equal(t, "sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=", Sha1DigestKey(attData))
+	assert.Equal(t, "sha256-uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=", Sha256DigestKey(attData))
+
+	assert.Equal(t, DigestAlgorithmSHA1, DigestAlgorithm(Sha1DigestKey(attData)))
+	assert.Equal(t, DigestAlgorithmSHA256, DigestAlgorithm(Sha256DigestKey(attData)))
+	assert.Equal(t, DigestAlgorithmSHA1, DigestAlgorithm("md5-abc"))
+	assert.Equal(t, Sha256DigestKey(attData), DigestKeyLike("sha256-other", attData))
+	assert.Equal(t, Sha1DigestKey(attData), DigestKeyLike("sha1-other", attData))
+
+	nonce := []byte("nonce")
+	assert.Equal(t, ProveAttachment(attData, nonce), ProveAttachmentWithAlgorithm(DigestAlgorithmSHA1, attData, nonce))
+	assert.True(t, strings.HasPrefix(ProveAttachmentWithAlgorithm(DigestAlgorithmSHA256, attData, nonce), "sha256-"))
+}
+
+func TestNewAttachmentDecoder(t *testing.T) {
+	attData := []byte(`hello world`)
+	digest := Sha1DigestKey(attData)
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, err := zw.Write(attData)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	decoder, err := NewAttachmentDecoder(AttachmentEncodingDeflate, &compressed)
+	require.NoError(t, err)
+	data, err := ReadVerifiedAttachment(decoder, int64(len(attData)), digest)
+	assert.NoError(t, err)
+	assert.Equal(t, attData, data)
+
+	// Data that isn't in the claimed encoding
+	_, err = NewAttachmentDecoder(AttachmentEncodingGzip, strings.NewReader(string(attData)))
+	assert.Error(t, err)
+
+	_, err = NewAttachmentDecoder("br", strings.NewReader(string(attData)))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), strconv.Itoa(http.StatusBadRequest))
+}
+
 func TestDecodeAttachmentError(t *testing.T) {
 	attr, err := DecodeAttachment(make([]int, 1))
 	assert.Nil(t, attr, "Attachment of data (type []int) should not get decoded.")
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// AccessChangedBody is the body of an accessChanged message, sent to a client that set the subChanges
+// 'accessChanges' property when a refresh of the user finds that its channel access or roles have changed.  Channels
+// are the user's effective channels, including those inherited from roles.  Channels in the BLIP channel denylist
+// are never listed, as they can't be replicated regardless of access.  The message is a notification only - the
+// changes feed reflects the new access independently of it.
+type AccessChangedBody struct {
+	GrantedChannels []string `json:"grantedChannels,omitempty"`
+	RevokedChannels []string `json:"revokedChannels,omitempty"`
+	GrantedRoles    []string `json:"grantedRoles,omitempty"`
+	RevokedRoles    []string `json:"revokedRoles,omitempty"`
+}
+
+// newAccessChangedBody returns the differences in access between the old and new versions of a user, or nil if
+// there are none.
+func newAccessChangedBody(oldUser, newUser auth.User, deniedChannels base.Set) *AccessChangedBody {
+	body := &AccessChangedBody{}
+	body.GrantedChannels, body.RevokedChannels = compareAccess(oldUser.InheritedChannels(), newUser.InheritedChannels(), deniedChannels)
+	body.GrantedRoles, body.RevokedRoles = compareAccess(oldUser.RoleNames(), newUser.RoleNames(), nil)
+	if len(body.GrantedChannels) == 0 && len(body.RevokedChannels) == 0 && len(body.GrantedRoles) == 0 && len(body.RevokedRoles) == 0 {
+		return nil
+	}
+	return body
+}
+
+// compareAccess returns the sorted names added to and removed from a set, excluding any in the given exclusions.
+func compareAccess(oldSet, newSet channels.TimedSet, excluded base.Set) (granted, revoked []string) {
+	for name, isGranted := range newSet.CompareKeys(oldSet) {
+		if excluded.Contains(name) {
+			continue
+		}
+		if isGranted {
+			granted = append(granted, name)
+		} else {
+			revoked = append(revoked, name)
+		}
+	}
+	sort.Strings(granted)
+	sort.Strings(revoked)
+	return granted, revoked
+}
+
+// sendAccessChanged notifies the client of a change to the user's access.  It's sent without waiting for a reply.
+func (bsc *BlipSyncContext) sendAccessChanged(sender *blip.Sender, body *AccessChangedBody) {
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageAccessChanged)
+	outrq.SetNoReply(true)
+	if err := outrq.SetJSONBody(body); err != nil {
+		base.WarnfCtx(bsc.blipContextDb.Ctx, "Error setting accessChanged body: %v", err)
+		return
+	}
+	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Sending accessChanged for user %s: granted channels %v, revoked channels %v, granted roles %v, revoked roles %v",
+		base.UD(bsc.userName), base.UD(body.GrantedChannels), base.UD(body.RevokedChannels), base.UD(body.GrantedRoles), base.UD(body.RevokedRoles))
+	if !bsc.sendBLIPMessage(sender, outrq) {
+		base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Unable to send accessChanged for user %s - connection closed", base.UD(bsc.userName))
+	}
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAccessChangedBody verifies granted and revoked channels are reported, excluding denied channels.
+func TestAccessChangedBody(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	authenticator := db.Authenticator()
+	oldUser, err := authenticator.NewUser("naomi", "letmein", channels.SetOf(t, "ABC", "NBC"))
+	require.NoError(t, err)
+	newUser, err := authenticator.NewUser("naomi", "letmein", channels.SetOf(t, "ABC", "PBS", "TBS"))
+	require.NoError(t, err)
+
+	body := newAccessChangedBody(oldUser, newUser, base.SetOf("TBS"))
+	require.NotNil(t, body)
+	assert.Equal(t, []string{"PBS"}, body.GrantedChannels)
+	assert.Equal(t, []string{"NBC"}, body.RevokedChannels)
+	assert.Empty(t, body.GrantedRoles)
+	assert.Empty(t, body.RevokedRoles)
+
+	// No notification when the only change is to a denied channel
+	assert.Nil(t, newAccessChangedBody(oldUser, oldUser, nil))
+	deniedOnly, err := authenticator.NewUser("naomi", "letmein", channels.SetOf(t, "ABC", "NBC", "TBS"))
+	require.NoError(t, err)
+	assert.Nil(t, newAccessChangedBody(oldUser, deniedOnly, base.SetOf("TBS")))
+
+	granted, revoked := compareAccess(channels.AtSequence(base.SetOf("role1", "role2"), 1), channels.AtSequence(base.SetOf("role2", "role3"), 1), nil)
+	assert.Equal(t, []string{"role3"}, granted)
+	assert.Equal(t, []string{"role1"}, revoked)
+}
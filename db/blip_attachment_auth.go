@@ -0,0 +1,40 @@
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// AttAuthorizer decides whether a user may fetch an attachment of a doc they can access, or learn that the server has
+// it.  It's given the doc's ID and the attachment's digest, and returns false to deny the attachment, e.g. to keep an
+// encrypted original from clients that are only meant to sync its thumbnail.  It's never consulted for admins.
+type AttAuthorizer func(user auth.User, docID, digest string) bool
+
+// authorizeAttachment returns true when BlipSyncOptions.AttachmentAuthorizer allows the user the attachment as an
+// attachment of any of the given docs, or there's no authorizer.  Denials are counted.
+func (bh *blipHandler) authorizeAttachment(docIDs []string, digest string) bool {
+	authorizer := bh.db.Options.BlipSyncOptions.AttachmentAuthorizer
+	user := bh.db.User()
+	if authorizer == nil || user == nil {
+		return true
+	}
+	for _, docID := range docIDs {
+		if authorizer(user, docID, digest) {
+			return true
+		}
+	}
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Attachment %s of doc(s) %v denied to user %s", digest, base.UD(docIDs), base.UD(user.Name()))
+	bh.dbStats.StatsDatabase().Add(base.StatKeyAttAccessDenied, 1)
+	return false
+}
+
+// allowedAttachmentDocIDs returns the docs whose revs being sent currently allow the client to fetch the attachment.
+func (bsc *BlipSyncContext) allowedAttachmentDocIDs(digest string) []string {
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	docIDs := make([]string, 0, len(bsc.allowedAttachmentDocs[digest]))
+	for docID := range bsc.allowedAttachmentDocs[digest] {
+		docIDs = append(docIDs, docID)
+	}
+	return docIDs
+}
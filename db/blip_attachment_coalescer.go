@@ -0,0 +1,71 @@
+package db
+
+import "sync"
+
+// DefaultCoalescedAttachments is the default maximum number of distinct attachment loads shared between
+// concurrent getAttachment requests at once.
+const DefaultCoalescedAttachments = 100
+
+// attachmentLoad is an in-flight attachment load, whose result is shared by every request waiting on it.
+type attachmentLoad struct {
+	done    chan struct{} // Closed once data and err are set
+	data    []byte
+	err     error
+	waiters int // Requests waiting on the load, besides the one performing it.  Guarded by attachmentCoalescer.lock
+}
+
+// attachmentCoalescer shares a single store read between concurrent requests for the same attachment, so that many
+// clients fetching a shared attachment at once don't each load it.  Loaded data is only held while the load is in
+// flight, and is released once every waiter has it.  Memory is bounded by limiting the number of distinct loads
+// tracked at once; beyond that, loads aren't shared.
+type attachmentCoalescer struct {
+	lock     sync.Mutex
+	loads    map[string]*attachmentLoad
+	maxLoads int
+}
+
+// newAttachmentCoalescer returns a coalescer sharing up to maxLoads loads at once, or nil (which loads every
+// request independently) if maxLoads isn't positive.
+func newAttachmentCoalescer(maxLoads int) *attachmentCoalescer {
+	if maxLoads <= 0 {
+		return nil
+	}
+	return &attachmentCoalescer{
+		loads:    make(map[string]*attachmentLoad),
+		maxLoads: maxLoads,
+	}
+}
+
+// load returns the result of loadFn for the attachment with the given digest, sharing the result of a load already
+// in flight for the same digest.  coalesced is true when the result came from another request's load.
+func (c *attachmentCoalescer) load(digest string, loadFn func() ([]byte, error)) (data []byte, coalesced bool, err error) {
+	if c == nil {
+		data, err = loadFn()
+		return data, false, err
+	}
+
+	c.lock.Lock()
+	if inFlight, ok := c.loads[digest]; ok {
+		inFlight.waiters++
+		c.lock.Unlock()
+		<-inFlight.done
+		return inFlight.data, true, inFlight.err
+	}
+	if len(c.loads) >= c.maxLoads {
+		c.lock.Unlock()
+		data, err = loadFn()
+		return data, false, err
+	}
+	newLoad := &attachmentLoad{done: make(chan struct{})}
+	c.loads[digest] = newLoad
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.loads, digest)
+		c.lock.Unlock()
+		close(newLoad.done)
+	}()
+	newLoad.data, newLoad.err = loadFn()
+	return newLoad.data, false, newLoad.err
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAttachmentCoalescer verifies concurrent loads of the same attachment share a single load, and that loads
+// beyond the limit aren't shared.
+func TestAttachmentCoalescer(t *testing.T) {
+	coalescer := newAttachmentCoalescer(1)
+
+	var loadCount int32
+	release := make(chan struct{})
+	blockingLoad := func() ([]byte, error) {
+		atomic.AddInt32(&loadCount, 1)
+		<-release
+		return []byte("data"), nil
+	}
+
+	var wg sync.WaitGroup
+	var coalescedCount int32
+	load := func() {
+		defer wg.Done()
+		data, coalesced, err := coalescer.load("sha1-a", blockingLoad)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("data"), data)
+		if coalesced {
+			atomic.AddInt32(&coalescedCount, 1)
+		}
+	}
+	waiters := func() int {
+		coalescer.lock.Lock()
+		defer coalescer.lock.Unlock()
+		if inFlight, ok := coalescer.loads["sha1-a"]; ok {
+			return inFlight.waiters
+		}
+		return -1
+	}
+
+	// Start one load, then three more that wait on it
+	wg.Add(4)
+	go load()
+	for waiters() != 0 {
+		runtime.Gosched()
+	}
+	for i := 0; i < 3; i++ {
+		go load()
+	}
+	for waiters() != 3 {
+		runtime.Gosched()
+	}
+
+	// A different attachment beyond the limit is loaded independently
+	data, coalesced, err := coalescer.load("sha1-b", func() ([]byte, error) { return []byte("other"), nil })
+	assert.NoError(t, err)
+	assert.False(t, coalesced)
+	assert.Equal(t, []byte("other"), data)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loadCount))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&coalescedCount))
+	assert.Len(t, coalescer.loads, 0)
+
+	// A nil coalescer loads every request independently
+	var nilCoalescer *attachmentCoalescer
+	_, coalesced, err = nilCoalescer.load("sha1-a", blockingLoad)
+	assert.NoError(t, err)
+	assert.False(t, coalesced)
+	assert.Nil(t, newAttachmentCoalescer(0))
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// BlipAttachmentDigestsHeader is the header of the WebSocket upgrade request in which a client lists the attachment
+// digest algorithms it supports, e.g. "sha256,sha1".
+const BlipAttachmentDigestsHeader = "X-Attachment-Digests"
+
+// Attachments are identified by digests of their content, which have always been sha1.  When a database enables
+// BlipSyncOptions.SHA256Attachments, it advertises sha256 alongside sha1 in its capabilities, and a client that also
+// lists sha256 in its handshake's X-Attachment-Digests header may push attachments with sha256 digests, which are
+// verified and stored under those digests, and is sent them as they're stored.  Proofs of attachments with sha256
+// digests are hashed with sha256 too.  Connections that didn't negotiate sha256 keep working as before: a rev they
+// push with a sha256 digest is rejected, and revs they're sent announce sha256 attachments under their sha1 digests,
+// which they may then fetch with getAttachment, so a document may hold attachments of either kind.
+
+// NegotiateAttachmentDigests sets whether the connection uses sha256 attachment digests, when both the database and
+// the client, in the headers of its handshake request, support them.  Must be called before the connection handles
+// any requests.
+func (bsc *BlipSyncContext) NegotiateAttachmentDigests(headers http.Header) {
+	if !bsc.blipContextDb.Options.BlipSyncOptions.SHA256Attachments {
+		return
+	}
+	for _, algorithm := range strings.Split(headers.Get(BlipAttachmentDigestsHeader), ",") {
+		if strings.TrimSpace(algorithm) == DigestAlgorithmSHA256 {
+			bsc.sha256Digests = true
+		}
+	}
+}
+
+// supportedDigestAlgorithms returns the attachment digest algorithms the database advertises to clients.
+func supportedDigestAlgorithms(options BlipSyncOptions) []string {
+	if options.SHA256Attachments {
+		return []string{DigestAlgorithmSHA256, DigestAlgorithmSHA1}
+	}
+	return []string{DigestAlgorithmSHA1}
+}
+
+// checkAttachmentDigest rejects an attachment digest in a pushed rev that the connection didn't negotiate.
+func (bsc *BlipSyncContext) checkAttachmentDigest(digest string) error {
+	if DigestAlgorithm(digest) == DigestAlgorithmSHA256 && !bsc.sha256Digests {
+		return base.HTTPErrorf(http.StatusBadRequest, "Attachment digest %s uses sha256, which wasn't negotiated", digest)
+	}
+	return nil
+}
+
+// deliveredAttachments returns the attachments of a rev being sent to the client, with any sha256 digests replaced by
+// sha1 digests when the connection didn't negotiate sha256.  The given attachments are returned when there's nothing
+// to replace, and are never modified, as they may be shared with the revision cache.
+func (bsc *BlipSyncContext) deliveredAttachments(attachments AttachmentsMeta) (AttachmentsMeta, error) {
+	if bsc.sha256Digests || !bsc.hasUndeliverableDigests(AttachmentDigests(attachments)) {
+		return attachments, nil
+	}
+	delivered := make(AttachmentsMeta, len(attachments))
+	for name, value := range attachments {
+		meta, ok := value.(map[string]interface{})
+		digest, _ := meta["digest"].(string)
+		if !ok || DigestAlgorithm(digest) != DigestAlgorithmSHA256 {
+			delivered[name] = value
+			continue
+		}
+		sha1Digest, err := bsc.sha1DigestAlias(digest)
+		if err != nil {
+			return nil, err
+		}
+		deliveredMeta := make(map[string]interface{}, len(meta))
+		for key, metaValue := range meta {
+			deliveredMeta[key] = metaValue
+		}
+		deliveredMeta["digest"] = sha1Digest
+		delivered[name] = deliveredMeta
+	}
+	return delivered, nil
+}
+
+// hasUndeliverableDigests returns true if any of the digests uses sha256, and the connection didn't negotiate it.
+func (bsc *BlipSyncContext) hasUndeliverableDigests(digests []string) bool {
+	if bsc.sha256Digests {
+		return false
+	}
+	for _, digest := range digests {
+		if DigestAlgorithm(digest) == DigestAlgorithmSHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// sha1DigestAlias returns the sha1 digest of the attachment stored under a sha256 digest, remembering it so that the
+// client can fetch the attachment by its sha1 digest.
+func (bsc *BlipSyncContext) sha1DigestAlias(sha256Digest string) (string, error) {
+	bsc.lock.Lock()
+	sha1Digest, found := bsc.sha1DigestAliases[sha256Digest]
+	bsc.lock.Unlock()
+	if found {
+		return sha1Digest, nil
+	}
+	data, err := bsc.blipContextDb.GetAttachment(AttachmentKey(sha256Digest))
+	if err != nil {
+		return "", err
+	}
+	sha1Digest = Sha1DigestKey(data)
+
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	if bsc.sha1DigestAliases == nil {
+		bsc.sha1DigestAliases = make(map[string]string)
+		bsc.sha256DigestAliases = make(map[string]string)
+	}
+	bsc.sha1DigestAliases[sha256Digest] = sha1Digest
+	bsc.sha256DigestAliases[sha1Digest] = sha256Digest
+	return sha1Digest, nil
+}
+
+// aliasedAttachmentDigest returns the sha256 digest an attachment announced to the client under the given sha1 digest
+// is stored under, if it was.
+func (bsc *BlipSyncContext) aliasedAttachmentDigest(sha1Digest string) (string, bool) {
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	sha256Digest, found := bsc.sha256DigestAliases[sha1Digest]
+	return sha256Digest, found
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateAttachmentDigests(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	negotiate := func(header string) bool {
+		bsc := &BlipSyncContext{blipContextDb: db}
+		headers := http.Header{}
+		if header != "" {
+			headers.Set(BlipAttachmentDigestsHeader, header)
+		}
+		bsc.NegotiateAttachmentDigests(headers)
+		return bsc.sha256Digests
+	}
+	assert.False(t, negotiate("sha256,sha1"), "sha256 shouldn't be used unless the database supports it")
+
+	db.Options.BlipSyncOptions.SHA256Attachments = true
+	assert.True(t, negotiate("sha256, sha1"))
+	assert.False(t, negotiate("sha1"))
+	assert.False(t, negotiate(""))
+}
+
+// TestDeliveredAttachmentsMixedDigests verifies a connection that didn't negotiate sha256 is sent a doc's sha256
+// attachments under their sha1 digests, and can fetch them by those digests, while its sha1 attachments are unchanged.
+func TestDeliveredAttachmentsMixedDigests(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	sha1Data, sha256Data := []byte("sha1 attachment"), []byte("sha256 attachment")
+	sha256Digest := Sha256DigestKey(sha256Data)
+	require.NoError(t, db.setAttachments(AttachmentData{
+		AttachmentKey(Sha1DigestKey(sha1Data)): sha1Data,
+		AttachmentKey(sha256Digest):            sha256Data,
+	}))
+	attachments := AttachmentsMeta{
+		"old": map[string]interface{}{"stub": true, "digest": Sha1DigestKey(sha1Data), "revpos": 1},
+		"new": map[string]interface{}{"stub": true, "digest": sha256Digest, "revpos": 2},
+	}
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	delivered, err := bh.deliveredAttachments(attachments)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{Sha1DigestKey(sha1Data), Sha1DigestKey(sha256Data)}, AttachmentDigests(delivered))
+	assert.Equal(t, sha256Digest, attachments["new"].(map[string]interface{})["digest"], "The rev's attachments shouldn't be modified")
+	assert.True(t, bh.hasUndeliverableDigests(AttachmentDigests(attachments)))
+
+	data, err := bh.getMappedAttachment(Sha1DigestKey(sha256Data))
+	require.NoError(t, err)
+	assert.Equal(t, sha256Data, data)
+
+	status, _ := base.ErrorAsHTTPStatus(bh.checkAttachmentDigest(sha256Digest))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NoError(t, bh.checkAttachmentDigest(Sha1DigestKey(sha1Data)))
+
+	// A connection that negotiated sha256 is sent the attachments as they're stored
+	bh.sha256Digests = true
+	delivered, err = bh.deliveredAttachments(attachments)
+	require.NoError(t, err)
+	assert.Equal(t, attachments, delivered)
+	assert.NoError(t, bh.checkAttachmentDigest(sha256Digest))
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// maxAttachmentGCCandidates is the most attachments tracked as garbage collection candidates at once.  Attachments
+// dropped while the limit is reached aren't tracked.
+const maxAttachmentGCCandidates = 10000
+
+// attachmentRefTracker maintains hints, gathered from replication, about which attachments may no longer be
+// referenced.  An attachment becomes a candidate for collection when a pushed rev drops it from its parent's
+// attachments, and stops being one when it's next seen referenced: by a pushed rev, or by a rev sent to a client.
+// Candidates are only hints - collect verifies each against every document before deleting it.
+type attachmentRefTracker struct {
+	lock          sync.Mutex
+	candidates    map[string]time.Time // Digest to when it was dropped
+	inFlight      map[string]int       // Digests of attachments clients are allowed to fetch, across all connections
+	candidateStat *expvar.Int
+	deletedStat   *expvar.Int
+
+	postScanCallback func() // Invoked once collect has scanned every document, for testing
+}
+
+// newAttachmentRefTracker returns a tracker, or nil (which tracks nothing) when disabled.
+func newAttachmentRefTracker(enabled bool, candidateStat, deletedStat *expvar.Int) *attachmentRefTracker {
+	if !enabled {
+		return nil
+	}
+	return &attachmentRefTracker{
+		candidates:    make(map[string]time.Time),
+		inFlight:      make(map[string]int),
+		candidateStat: candidateStat,
+		deletedStat:   deletedStat,
+	}
+}
+
+// dropped records attachments a pushed rev no longer references as candidates for collection.
+func (t *attachmentRefTracker) dropped(digests []string) {
+	if t == nil || len(digests) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for _, digest := range digests {
+		if len(t.candidates) >= maxAttachmentGCCandidates {
+			break
+		}
+		t.candidates[digest] = now
+	}
+	t.candidateStat.Set(int64(len(t.candidates)))
+}
+
+// referenced records that attachments are still referenced, so they're no longer candidates for collection.
+func (t *attachmentRefTracker) referenced(digests []string) {
+	if t == nil || len(digests) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t._referenced(digests)
+}
+
+func (t *attachmentRefTracker) _referenced(digests []string) {
+	for _, digest := range digests {
+		delete(t.candidates, digest)
+	}
+	t.candidateStat.Set(int64(len(t.candidates)))
+}
+
+// acquire records attachments a connection has allowed its client to fetch.  They're referenced by the rev being
+// sent, and are never collected until released.
+func (t *attachmentRefTracker) acquire(digests []string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, digest := range digests {
+		t.inFlight[digest]++
+	}
+	t._referenced(digests)
+}
+
+// release records attachments a connection no longer allows its client to fetch.
+func (t *attachmentRefTracker) release(digests []string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, digest := range digests {
+		if n := t.inFlight[digest]; n > 1 {
+			t.inFlight[digest] = n - 1
+		} else {
+			delete(t.inFlight, digest)
+		}
+	}
+}
+
+// collect deletes the candidates that no document references, returning the number deleted.  Candidates dropped
+// within the old revision expiry are left for a later run, as old revision bodies kept for delta sync may still
+// reference them.  Every document is read to find the attachments its current revision and any conflicting
+// revisions reference, so this is as expensive as a full scan of the database.
+//
+// Only pushed revs handled by this node are tracked, so writes through the REST API, other nodes or import may
+// reference a candidate once the scan has passed their doc.  Once the scan's done, the docs changed since it started
+// are read again, after the change cache has received the latest writes.
+func (t *attachmentRefTracker) collect(db *Database) (deleted int, err error) {
+	if t == nil {
+		return 0, nil
+	}
+	droppedBefore := time.Now().Add(-time.Duration(db.Options.OldRevExpirySeconds) * time.Second)
+	startSeq, err := db.LastSequence()
+	if err != nil {
+		return 0, err
+	}
+	t.lock.Lock()
+	eligible := make(map[string]bool)
+	for digest, droppedAt := range t.candidates {
+		if droppedAt.Before(droppedBefore) {
+			eligible[digest] = true
+		}
+	}
+	t.lock.Unlock()
+	if len(eligible) == 0 {
+		return 0, nil
+	}
+
+	var live []string
+	markLive := func(attachments AttachmentsMeta) {
+		for _, digest := range AttachmentDigests(attachments) {
+			if eligible[digest] {
+				live = append(live, digest)
+				delete(eligible, digest)
+			}
+		}
+	}
+	markDocLive := func(docID string) error {
+		doc, err := db.GetDocument(docID, DocUnmarshalAll)
+		if base.IsDocNotFoundError(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		markLive(doc.SyncData.Attachments)
+		for _, leafRevID := range doc.History.GetLeaves() {
+			if leafRevID != doc.CurrentRev {
+				leafAttachments, _ := db.getAvailableRevAttachments(doc, leafRevID)
+				markLive(leafAttachments)
+			}
+		}
+		return nil
+	}
+	err = db.ForEachDocID(func(id IDRevAndSequence, _ []string) (bool, error) {
+		return true, markDocLive(id.DocID)
+	}, ForEachDocIDOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if t.postScanCallback != nil {
+		t.postScanCallback()
+	}
+	if err := t.markChangedDocsLive(db, startSeq, markDocLive); err != nil {
+		return 0, err
+	}
+	t.referenced(live)
+
+	// The tracker's lock is held while each candidate is deleted, so that an attachment seen referenced during the
+	// scan is never deleted, and one that's being sent to a client is never deleted.  A candidate dropped again since
+	// the scan started may be referenced by an old revision body, so is left for a later run.
+	for digest := range eligible {
+		t.lock.Lock()
+		if droppedAt, isCandidate := t.candidates[digest]; isCandidate && droppedAt.Before(droppedBefore) && t.inFlight[digest] == 0 {
+			if err := db.Bucket.Delete(attachmentKeyToString(AttachmentKey(digest))); err == nil {
+				deleted++
+			} else if !base.IsDocNotFoundError(err) {
+				base.WarnfCtx(db.Ctx, "Unable to delete unreferenced attachment %s: %v", digest, err)
+				t.lock.Unlock()
+				continue
+			}
+			delete(t.candidates, digest)
+		}
+		t.lock.Unlock()
+	}
+	t.lock.Lock()
+	t.candidateStat.Set(int64(len(t.candidates)))
+	t.lock.Unlock()
+	t.deletedStat.Add(int64(deleted))
+	return deleted, nil
+}
+
+// markChangedDocsLive calls markDocLive for each doc changed since the given sequence, once the change cache has
+// received the latest writes.
+func (t *attachmentRefTracker) markChangedDocsLive(db *Database, since uint64, markDocLive func(docID string) error) error {
+	if err := db.WaitForPendingChanges(db.Ctx); err != nil {
+		return err
+	}
+	terminator := make(chan bool)
+	defer close(terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf(channels.AllChannelWildcard), ChangesOptions{
+		Since:      SequenceID{Seq: since},
+		Terminator: terminator,
+		Ctx:        db.Ctx,
+	})
+	if err != nil {
+		return err
+	}
+	for entry := range feed {
+		if entry.Err != nil {
+			return entry.Err
+		}
+		if entry.ID == "" {
+			continue
+		}
+		if err := markDocLive(entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// droppedAttachmentDigests returns the digests of attachments in before that aren't in after.
+func droppedAttachmentDigests(before, after AttachmentsMeta) (dropped []string) {
+	kept := base.SetFromArray(AttachmentDigests(after))
+	for _, digest := range AttachmentDigests(before) {
+		if !kept.Contains(digest) {
+			dropped = append(dropped, digest)
+		}
+	}
+	return dropped
+}
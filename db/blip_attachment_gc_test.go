@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAttachmentRefTracker verifies attachments become candidates when dropped, stop being candidates when seen
+// referenced, and that in-flight attachments are never candidates while acquired.
+func TestAttachmentRefTracker(t *testing.T) {
+	candidateStat, deletedStat := new(expvar.Int), new(expvar.Int)
+	tracker := newAttachmentRefTracker(true, candidateStat, deletedStat)
+
+	tracker.dropped([]string{"sha1-a", "sha1-b", "sha1-c"})
+	assert.Len(t, tracker.candidates, 3)
+	assert.Equal(t, int64(3), candidateStat.Value())
+
+	tracker.referenced([]string{"sha1-a"})
+	assert.NotContains(t, tracker.candidates, "sha1-a")
+	assert.Equal(t, int64(2), candidateStat.Value())
+
+	// Acquired twice, by two connections: only in flight until both have released it
+	tracker.acquire([]string{"sha1-b"})
+	tracker.acquire([]string{"sha1-b"})
+	assert.NotContains(t, tracker.candidates, "sha1-b")
+	assert.Equal(t, 2, tracker.inFlight["sha1-b"])
+	tracker.release([]string{"sha1-b"})
+	assert.Equal(t, 1, tracker.inFlight["sha1-b"])
+	tracker.release([]string{"sha1-b"})
+	assert.NotContains(t, tracker.inFlight, "sha1-b")
+}
+
+// TestAttachmentRefTrackerDisabled verifies a nil tracker tracks nothing.
+func TestAttachmentRefTrackerDisabled(t *testing.T) {
+	tracker := newAttachmentRefTracker(false, new(expvar.Int), new(expvar.Int))
+	assert.Nil(t, tracker)
+	tracker.dropped([]string{"sha1-a"})
+	tracker.acquire([]string{"sha1-a"})
+	tracker.release([]string{"sha1-a"})
+	deleted, err := tracker.collect(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestDroppedAttachmentDigests(t *testing.T) {
+	before := AttachmentsMeta{
+		"a.txt": map[string]interface{}{"digest": "sha1-a"},
+		"b.txt": map[string]interface{}{"digest": "sha1-b"},
+	}
+	after := AttachmentsMeta{
+		"a.txt": map[string]interface{}{"digest": "sha1-a"},
+		"c.txt": map[string]interface{}{"digest": "sha1-c"},
+	}
+	assert.Equal(t, []string{"sha1-b"}, droppedAttachmentDigests(before, after))
+	assert.Empty(t, droppedAttachmentDigests(nil, after))
+}
+
+// TestAttachmentRefTrackerCollect verifies collect only deletes candidates no document references, including
+// documents written after the scan passed them, and leaves candidates dropped again during the scan.
+func TestAttachmentRefTrackerCollect(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.OldRevExpirySeconds = 0
+
+	putWithAttachment := func(docID string, data []byte) string {
+		_, _, err := db.Put(docID, Body{BodyAttachments: map[string]interface{}{"att.txt": map[string]interface{}{"data": data}}})
+		require.NoError(t, err)
+		return Sha1DigestKey(data)
+	}
+	storeUnreferenced := func(data []byte) string {
+		digest := Sha1DigestKey(data)
+		_, err := db.Bucket.AddRaw(attachmentKeyToString(AttachmentKey(digest)), 0, data)
+		require.NoError(t, err)
+		return digest
+	}
+	referenced := putWithAttachment("referenced", []byte("referenced"))
+	unreferenced := storeUnreferenced([]byte("unreferenced"))
+	writtenDuringScan := storeUnreferenced([]byte("written during scan"))
+	droppedDuringScan := storeUnreferenced([]byte("dropped during scan"))
+	require.NoError(t, db.WaitForPendingChanges(context.Background()))
+
+	candidateStat, deletedStat := new(expvar.Int), new(expvar.Int)
+	tracker := newAttachmentRefTracker(true, candidateStat, deletedStat)
+	for _, digest := range []string{referenced, unreferenced, writtenDuringScan, droppedDuringScan} {
+		tracker.candidates[digest] = time.Now().Add(-time.Minute)
+	}
+	tracker.postScanCallback = func() {
+		putWithAttachment("writtenDuringScan", []byte("written during scan"))
+		tracker.dropped([]string{droppedDuringScan})
+	}
+
+	deleted, err := tracker.collect(db)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, int64(1), deletedStat.Value())
+	_, err = db.GetAttachment(AttachmentKey(unreferenced))
+	assert.True(t, base.IsDocNotFoundError(err))
+	for _, digest := range []string{referenced, writtenDuringScan, droppedDuringScan} {
+		_, err = db.GetAttachment(AttachmentKey(digest))
+		assert.NoError(t, err, "Attachment %s shouldn't have been deleted", digest)
+	}
+	assert.Equal(t, map[string]bool{droppedDuringScan: true}, candidateDigests(tracker))
+}
+
+func candidateDigests(tracker *attachmentRefTracker) map[string]bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	digests := make(map[string]bool, len(tracker.candidates))
+	for digest := range tracker.candidates {
+		digests[digest] = true
+	}
+	return digests
+}
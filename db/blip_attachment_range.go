@@ -0,0 +1,94 @@
+package db
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// minEncodedAttachmentSize is the smallest attachment, or range of one, that's compressed in response to
+// getAttachment.  Compressing less, such as the tail of a resumed download, rarely saves enough to be worth the
+// client decompressing it.
+const minEncodedAttachmentSize = 512
+
+// setAttachmentResponseBody sets the body of a getAttachment response to the range of the attachment the client asked
+// for, compressed with the first of the client's accepted encodings the server supports, if compression is worthwhile.
+//
+// A range given by 'start' and 'end' must be within the attachment, and is rejected with a 400 otherwise, whereas
+// one given by 'offset' and 'length' is cut short at the end of the attachment.
+//
+// A ranged response's 'offset' and 'length' properties give the range of the attachment sent, before any compression,
+// and 'totalLength' the length of the whole attachment.  When the response has an 'encoding' property, the client
+// decompresses the body with that encoding to get the range's data; either way, it writes the data at the range's
+// offset, and has the whole attachment once it has every range up to totalLength.  A range is sent uncompressed
+// when the attachment's content looks already compressed, when the range is too small, or when compressing it
+// doesn't make it smaller, so clients must handle either in response to any request.
+func (bh *blipHandler) setAttachmentResponseBody(response *blip.Message, params *getAttachmentParams, attachment []byte) (int, error) {
+	offset, length, ranged, err := params.byteRange()
+	if err != nil {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "%s", err)
+	}
+	data := attachment
+	if ranged {
+		if params.hasStartEndRange() && offset+length > len(attachment) {
+			return 0, base.HTTPErrorf(http.StatusBadRequest, "Range is outside the attachment's length of %d", len(attachment))
+		}
+		if offset > len(attachment) {
+			return 0, base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset %d is beyond the attachment's length of %d", offset, len(attachment))
+		}
+		end := len(attachment)
+		if length > 0 && length < end-offset {
+			end = offset + length
+		}
+		data = attachment[offset:end]
+		response.Properties[GetAttachmentRangeOffset] = strconv.Itoa(offset)
+		response.Properties[GetAttachmentRangeLength] = strconv.Itoa(len(data))
+		response.Properties[GetAttachmentTotalLength] = strconv.Itoa(len(attachment))
+	}
+
+	if encoding := attachmentResponseEncoding(params.acceptEncodings()); encoding != "" && len(data) >= minEncodedAttachmentSize &&
+		isCompressible("", map[string]interface{}{"content_type": http.DetectContentType(attachment)}) {
+		if encoded := encodeAttachment(encoding, data); encoded != nil {
+			response.SetBody(encoded)
+			response.Properties[GetAttachmentEncoding] = encoding
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttCompressedPull, 1)
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttPullBytesSaved, int64(len(data)-len(encoded)))
+			return len(data), nil
+		}
+	}
+	response.SetBody(data)
+	response.SetCompressed(params.rq.Properties[BlipCompress] == "true")
+	return len(data), nil
+}
+
+// attachmentResponseEncoding returns the first of the client's accepted attachment encodings that the server
+// supports, or an empty string if there's none.
+func attachmentResponseEncoding(accepted []string) string {
+	for _, encoding := range accepted {
+		for _, supported := range SupportedAttachmentEncodings {
+			if encoding == supported {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
+
+// encodeAttachment returns data compressed with the given encoding, or nil if compressing it didn't make it smaller.
+func encodeAttachment(encoding string, data []byte) []byte {
+	var encoded bytes.Buffer
+	encoder, err := NewAttachmentEncoder(encoding, &encoded)
+	if err != nil {
+		return nil
+	}
+	if _, err := encoder.Write(data); err != nil {
+		return nil
+	}
+	if err := encoder.Close(); err != nil || encoded.Len() >= len(data) {
+		return nil
+	}
+	return encoded.Bytes()
+}
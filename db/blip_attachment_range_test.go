@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/go-blip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachmentResponseEncoding(t *testing.T) {
+	assert.Equal(t, "", attachmentResponseEncoding(nil))
+	assert.Equal(t, "", attachmentResponseEncoding([]string{"br"}))
+	assert.Equal(t, AttachmentEncodingDeflate, attachmentResponseEncoding([]string{"br", AttachmentEncodingDeflate, AttachmentEncodingGzip}))
+}
+
+func TestEncodeAttachment(t *testing.T) {
+	data := []byte(strings.Repeat("compressible ", 100))
+	for _, encoding := range SupportedAttachmentEncodings {
+		encoded := encodeAttachment(encoding, data)
+		require.NotNil(t, encoded, encoding)
+		assert.Less(t, len(encoded), len(data))
+		decoder, err := NewAttachmentDecoder(encoding, bytes.NewReader(encoded))
+		require.NoError(t, err)
+		decoded, err := ioutil.ReadAll(decoder)
+		require.NoError(t, err)
+		assert.Equal(t, data, decoded)
+	}
+
+	// Data that doesn't get smaller isn't encoded
+	assert.Nil(t, encodeAttachment(AttachmentEncodingGzip, []byte("x")))
+	assert.Nil(t, encodeAttachment("br", data))
+}
+
+// TestGetAttachmentByteRange verifies the range a getAttachment request asks for is parsed, and malformed ranges are
+// rejected.
+func TestGetAttachmentByteRange(t *testing.T) {
+	byteRange := func(properties map[string]string) (offset, length int, ranged bool, err error) {
+		rq := blip.NewRequest()
+		rq.SetProfile(MessageGetAttachment)
+		for name, value := range properties {
+			rq.Properties[name] = value
+		}
+		return newGetAttachmentParams(rq).byteRange()
+	}
+
+	_, _, ranged, err := byteRange(nil)
+	require.NoError(t, err)
+	assert.False(t, ranged)
+
+	offset, length, ranged, err := byteRange(map[string]string{GetAttachmentOffset: "100"})
+	require.NoError(t, err)
+	assert.True(t, ranged)
+	assert.Equal(t, 100, offset)
+	assert.Equal(t, 0, length)
+
+	offset, length, ranged, err = byteRange(map[string]string{GetAttachmentLength: "50"})
+	require.NoError(t, err)
+	assert.True(t, ranged)
+	assert.Equal(t, 0, offset)
+	assert.Equal(t, 50, length)
+
+	for _, properties := range []map[string]string{
+		{GetAttachmentOffset: "-1"},
+		{GetAttachmentOffset: "abc"},
+		{GetAttachmentLength: "0"},
+		{GetAttachmentOffset: "10", GetAttachmentLength: "-5"},
+		{GetAttachmentStart: "-1"},
+		{GetAttachmentEnd: "abc"},
+		{GetAttachmentStart: "10", GetAttachmentEnd: "10"},
+		{GetAttachmentStart: "10", GetAttachmentLength: "5"},
+	} {
+		_, _, _, err := byteRange(properties)
+		assert.Error(t, err, "%v", properties)
+	}
+
+	// start and end are an alternative to offset and length, with an exclusive end
+	offset, length, ranged, err = byteRange(map[string]string{GetAttachmentStart: "10", GetAttachmentEnd: "15"})
+	require.NoError(t, err)
+	assert.True(t, ranged)
+	assert.Equal(t, 10, offset)
+	assert.Equal(t, 5, length)
+
+	offset, length, ranged, err = byteRange(map[string]string{GetAttachmentStart: "10"})
+	require.NoError(t, err)
+	assert.True(t, ranged)
+	assert.Equal(t, 10, offset)
+	assert.Equal(t, 0, length)
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Policies for a connection requesting the same attachment repeatedly, set with BlipSyncOptions.AttachmentRepeatPolicy.
+// A request for a digest the connection was already served within the window counts as a repeat.  By default repeats
+// are loaded and served like any other request.  Either way, every request passes its own access checks first.
+const (
+	AttachmentRepeatCache = "cache" // Serves repeats from a small per-connection cache of recently served attachments
+	AttachmentRepeatLimit = "limit" // Rejects repeats beyond the limit with a 429 until the window has elapsed
+)
+
+const (
+	// DefaultAttachmentRepeatWindow is how long a served attachment is remembered when no window is configured.
+	DefaultAttachmentRepeatWindow = time.Minute
+
+	// DefaultAttachmentRepeatLimit is the number of times the limit policy serves an attachment per window, when no
+	// limit is configured.
+	DefaultAttachmentRepeatLimit = 3
+
+	// DefaultAttachmentRepeatCacheBytes is the most attachment data the cache policy keeps per connection, when no
+	// size is configured.
+	DefaultAttachmentRepeatCacheBytes = 4 * 1024 * 1024
+)
+
+// ParseAttachmentRepeatPolicy validates a repeated attachment policy, where an empty string is the default policy.
+func ParseAttachmentRepeatPolicy(policy string) (string, error) {
+	switch policy {
+	case "", AttachmentRepeatCache, AttachmentRepeatLimit:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown attachment repeat policy %q, must be %q or %q", policy, AttachmentRepeatCache, AttachmentRepeatLimit)
+}
+
+// ErrAttachmentRepeatLimit is returned when a connection requests an attachment more times within the window than the
+// limit policy allows.
+type ErrAttachmentRepeatLimit struct {
+	Digest     string
+	RetryAfter time.Duration
+}
+
+func (e *ErrAttachmentRepeatLimit) Error() string {
+	return fmt.Sprintf("Attachment with digest %s requested too many times, retry after %v", e.Digest, e.RetryAfter)
+}
+
+// Cause allows ErrAttachmentRepeatLimit to be reported as a 429 Too Many Requests.
+func (e *ErrAttachmentRepeatLimit) Cause() error {
+	return base.HTTPErrorf(http.StatusTooManyRequests, "%s", e.Error())
+}
+
+// attachmentRepeatTracker tracks the attachments recently served on a connection, applying the repeated attachment
+// policy to requests for them.
+type attachmentRepeatTracker struct {
+	policy      string
+	window      time.Duration
+	limit       int // Serves per window, for the limit policy
+	maxBytes    int // Most data cached, for the cache policy
+	lock        sync.Mutex
+	entries     map[string]*servedAttachment // Keyed by digest
+	cachedBytes int
+}
+
+type servedAttachment struct {
+	firstServed time.Time
+	count       int
+	data        []byte // Cached data, for the cache policy
+}
+
+// newAttachmentRepeatTracker returns a tracker for a connection, or nil when there's no policy.
+func newAttachmentRepeatTracker(options BlipSyncOptions) *attachmentRepeatTracker {
+	if options.AttachmentRepeatPolicy == "" {
+		return nil
+	}
+	t := &attachmentRepeatTracker{
+		policy:   options.AttachmentRepeatPolicy,
+		window:   options.AttachmentRepeatWindow,
+		limit:    options.AttachmentRepeatLimit,
+		maxBytes: options.AttachmentRepeatCacheBytes,
+		entries:  make(map[string]*servedAttachment),
+	}
+	if t.window <= 0 {
+		t.window = DefaultAttachmentRepeatWindow
+	}
+	if t.limit <= 0 {
+		t.limit = DefaultAttachmentRepeatLimit
+	}
+	if t.maxBytes <= 0 {
+		t.maxBytes = DefaultAttachmentRepeatCacheBytes
+	}
+	return t
+}
+
+// check applies the policy to a request for an attachment, returning its data when it can be served from the cache,
+// or ErrAttachmentRepeatLimit when it's been served too many times.  Otherwise the attachment should be loaded, and
+// then passed to served.  repeat is whether the request is a repeat.
+func (t *attachmentRepeatTracker) check(digest string) (data []byte, repeat bool, err error) {
+	if t == nil {
+		return nil, false, nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	entry := t._entry(digest, now)
+	if entry == nil {
+		return nil, false, nil
+	}
+	if t.policy == AttachmentRepeatLimit && entry.count >= t.limit {
+		return nil, true, &ErrAttachmentRepeatLimit{Digest: digest, RetryAfter: entry.firstServed.Add(t.window).Sub(now)}
+	}
+	if t.policy == AttachmentRepeatCache && entry.data != nil {
+		entry.count++
+		return entry.data, true, nil
+	}
+	return nil, true, nil
+}
+
+// served records that an attachment was loaded and served, caching its data for the cache policy when there's room.
+func (t *attachmentRepeatTracker) served(digest string, data []byte) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	entry := t._entry(digest, now)
+	if entry == nil {
+		t._pruneExpired(now)
+		entry = &servedAttachment{firstServed: now}
+		t.entries[digest] = entry
+	}
+	entry.count++
+	if t.policy == AttachmentRepeatCache && entry.data == nil && t.cachedBytes+len(data) <= t.maxBytes {
+		entry.data = data
+		t.cachedBytes += len(data)
+	}
+}
+
+// _entry returns the unexpired entry for a digest, or nil if it wasn't served within the window.
+func (t *attachmentRepeatTracker) _entry(digest string, now time.Time) *servedAttachment {
+	entry, found := t.entries[digest]
+	if !found {
+		return nil
+	}
+	if now.Sub(entry.firstServed) >= t.window {
+		t._remove(digest, entry)
+		return nil
+	}
+	return entry
+}
+
+func (t *attachmentRepeatTracker) _pruneExpired(now time.Time) {
+	for digest, entry := range t.entries {
+		if now.Sub(entry.firstServed) >= t.window {
+			t._remove(digest, entry)
+		}
+	}
+}
+
+func (t *attachmentRepeatTracker) _remove(digest string, entry *servedAttachment) {
+	t.cachedBytes -= len(entry.data)
+	delete(t.entries, digest)
+}
+
+// checkAttachmentRepeat applies the repeated attachment policy to a getAttachment request that's passed its access
+// checks, returning the attachment's data when it's served from the cache.
+func (bh *blipHandler) checkAttachmentRepeat(digest string) ([]byte, error) {
+	if bh.attachmentRepeats == nil {
+		return nil, nil
+	}
+	data, repeat, err := bh.attachmentRepeats.check(digest)
+	if repeat {
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttRepeatCount, 1)
+	}
+	if err != nil {
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttRepeatRejected, 1)
+		return nil, err
+	}
+	if bh.attachmentRepeats.policy == AttachmentRepeatCache {
+		if data != nil {
+			base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Serving repeated request for attachment with digest=%q from the connection's cache", digest)
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttRepeatCacheHits, 1)
+		} else {
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttRepeatCacheMisses, 1)
+		}
+	}
+	return data, nil
+}
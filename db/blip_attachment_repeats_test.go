@@ -0,0 +1,61 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachmentRepeatTracker(t *testing.T) {
+	assert.Nil(t, newAttachmentRepeatTracker(BlipSyncOptions{}))
+
+	t.Run("cache", func(t *testing.T) {
+		tracker := newAttachmentRepeatTracker(BlipSyncOptions{AttachmentRepeatPolicy: AttachmentRepeatCache, AttachmentRepeatCacheBytes: 5})
+		data, repeat, err := tracker.check("sha1-a")
+		require.NoError(t, err)
+		assert.False(t, repeat)
+		assert.Nil(t, data)
+		tracker.served("sha1-a", []byte("abc"))
+
+		data, repeat, err = tracker.check("sha1-a")
+		require.NoError(t, err)
+		assert.True(t, repeat)
+		assert.Equal(t, []byte("abc"), data)
+
+		// An attachment that doesn't fit in the cache is loaded each time
+		tracker.served("sha1-b", []byte("defg"))
+		data, repeat, err = tracker.check("sha1-b")
+		require.NoError(t, err)
+		assert.True(t, repeat)
+		assert.Nil(t, data)
+
+		// Expired attachments are forgotten, freeing their space
+		tracker.entries["sha1-a"].firstServed = time.Now().Add(-DefaultAttachmentRepeatWindow)
+		data, repeat, err = tracker.check("sha1-a")
+		require.NoError(t, err)
+		assert.False(t, repeat)
+		assert.Nil(t, data)
+		assert.Equal(t, 0, tracker.cachedBytes)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		tracker := newAttachmentRepeatTracker(BlipSyncOptions{AttachmentRepeatPolicy: AttachmentRepeatLimit, AttachmentRepeatLimit: 2})
+		for i := 0; i < 2; i++ {
+			_, _, err := tracker.check("sha1-a")
+			require.NoError(t, err)
+			tracker.served("sha1-a", []byte("abc"))
+		}
+		_, repeat, err := tracker.check("sha1-a")
+		assert.True(t, repeat)
+		require.IsType(t, &ErrAttachmentRepeatLimit{}, err)
+		assert.InDelta(t, float64(DefaultAttachmentRepeatWindow), float64(err.(*ErrAttachmentRepeatLimit).RetryAfter), float64(time.Second))
+		assertHTTPError(t, err.(*ErrAttachmentRepeatLimit).Cause(), 429)
+
+		tracker.entries["sha1-a"].firstServed = time.Now().Add(-DefaultAttachmentRepeatWindow)
+		_, repeat, err = tracker.check("sha1-a")
+		assert.NoError(t, err)
+		assert.False(t, repeat)
+	})
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// BlipCaughtUpDebounce is the minimum interval between repeated caught-up signals on a continuous subChanges feed.
+const BlipCaughtUpDebounce = time.Second
+
+// caughtUpSignaller re-sends the caught-up signal (an empty changes batch) each time a continuous feed drains after
+// sending changes, for clients that set the subChanges 'repeatCaughtUp' property.  Signals are debounced: when the
+// feed drains within BlipCaughtUpDebounce of the previous signal, the signal is deferred until the interval has
+// elapsed, and dropped if more changes are sent in the meantime.  The signal is never sent while changes sent since
+// the feed last drained are outstanding, but it doesn't wait for the client to finish fetching their revs.
+type caughtUpSignaller struct {
+	lock       sync.Mutex
+	debounce   time.Duration
+	send       func() error
+	lastSignal time.Time
+	pending    bool   // Whether changes have been sent since the last signal
+	generation uint64 // Incremented whenever changes are sent, so that a deferred signal can tell it's been superseded
+	timer      *time.Timer
+}
+
+func newCaughtUpSignaller(debounce time.Duration, send func() error) *caughtUpSignaller {
+	return &caughtUpSignaller{
+		debounce:   debounce,
+		send:       send,
+		lastSignal: time.Now(),
+	}
+}
+
+// changesSent must be called before a batch of changes is sent after the initial caught-up signal.
+func (s *caughtUpSignaller) changesSent() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = true
+	s.generation++
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// drained is called when the feed has no more changes to send.
+func (s *caughtUpSignaller) drained() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.pending {
+		return nil
+	}
+	wait := s.debounce - time.Since(s.lastSignal)
+	if wait <= 0 {
+		return s.signal()
+	}
+	if s.timer == nil {
+		generation := s.generation
+		s.timer = time.AfterFunc(wait, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.generation == generation && s.pending {
+				s.timer = nil
+				_ = s.signal()
+			}
+		})
+	}
+	return nil
+}
+
+// stop cancels any deferred signal, once the feed has ended.
+func (s *caughtUpSignaller) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.pending = false
+}
+
+// signal sends the caught-up signal.  Requires lock.
+func (s *caughtUpSignaller) signal() error {
+	s.pending = false
+	s.lastSignal = time.Now()
+	return s.send()
+}
+
+// notifyCaughtUp records that the connection's feed has first caught up at seq: the connection is counted in the
+// caught-up connections stat until the feed ends, an event is raised for any replication caught-up event handlers, and
+// postCaughtUpCallback is called if set.  Called once per subscription, when the initial caught-up signal is sent, so
+// repeated signals don't raise events.
+func (bh *blipHandler) notifyCaughtUp(seq SequenceID, session string) {
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyCaughtUpConnections, 1)
+	if bh.postCaughtUpCallback != nil {
+		bh.postCaughtUpCallback(seq)
+	}
+	username := ""
+	if user := bh.db.User(); user != nil {
+		username = user.Name()
+	}
+	if err := bh.db.EventMgr.RaiseReplicationCaughtUpEvent(bh.db.Name, bh.blipContext.ID, username, session, seq); err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to raise replication caught up event: %v", err)
+	}
+}
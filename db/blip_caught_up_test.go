@@ -0,0 +1,60 @@
+package db
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCaughtUpSignallerDebounce verifies repeated caught-up signals are only sent after changes, and are deferred
+// rather than dropped when the feed drains within the debounce interval.
+func TestCaughtUpSignallerDebounce(t *testing.T) {
+	var signals int32
+	s := newCaughtUpSignaller(200*time.Millisecond, func() error {
+		atomic.AddInt32(&signals, 1)
+		return nil
+	})
+	defer s.stop()
+
+	// Draining without having sent changes doesn't signal
+	assert.NoError(t, s.drained())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&signals))
+
+	// Drained within the debounce interval - signal is deferred
+	s.changesSent()
+	assert.NoError(t, s.drained())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&signals))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&signals))
+
+	// A deferred signal is dropped if more changes are sent before it fires
+	s.changesSent()
+	assert.NoError(t, s.drained())
+	s.changesSent()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&signals))
+
+	// Once outside the debounce interval, draining signals immediately
+	assert.NoError(t, s.drained())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&signals))
+}
+
+// TestPostCaughtUpCallback verifies the caught-up callback is given the last sequence sent.
+func TestPostCaughtUpCallback(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContext: blip.NewContext(), blipContextDb: db, dbStats: db.DbStats}, db: db}
+	bh.notifyCaughtUp(SequenceID{Seq: 10}, "")
+
+	var caughtUpSeqs []SequenceID
+	bh.postCaughtUpCallback = func(lastSeq SequenceID) {
+		caughtUpSeqs = append(caughtUpSeqs, lastSeq)
+	}
+	bh.notifyCaughtUp(SequenceID{Seq: 42}, "session")
+	assert.Equal(t, []SequenceID{{Seq: 42}}, caughtUpSeqs)
+}
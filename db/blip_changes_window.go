@@ -0,0 +1,52 @@
+package db
+
+import (
+	"expvar"
+)
+
+// changesWindow caps the changes batches a subscription has sent that await the client's response.  Each batch sent
+// with a reply expected holds a slot until its response has been handled, and sendChanges waits for a free slot
+// before sending the next batch, so that a slow client can't leave an unbounded number of goroutines, each holding a
+// database copy, awaiting its responses.  Batches in flight are counted in the changes_batches_in_flight stat
+// whether or not a window is configured.
+type changesWindow struct {
+	slots    chan struct{} // Holds a value for each batch in flight.  Nil when the window is unlimited
+	inFlight *expvar.Int
+}
+
+// newChangesWindow returns a window of the given size.  A size that isn't positive doesn't limit the batches in
+// flight.
+func newChangesWindow(size int, inFlight *expvar.Int) *changesWindow {
+	window := &changesWindow{inFlight: inFlight}
+	if size > 0 {
+		window.slots = make(chan struct{}, size)
+	}
+	return window
+}
+
+// acquire waits for a free slot for a batch.  Returns ErrClosedBLIPSender if the terminator is closed while waiting.
+func (w *changesWindow) acquire(terminator chan bool) error {
+	if w == nil {
+		return nil
+	}
+	if w.slots != nil {
+		select {
+		case w.slots <- struct{}{}:
+		case <-terminator:
+			return ErrClosedBLIPSender
+		}
+	}
+	w.inFlight.Add(1)
+	return nil
+}
+
+// release frees the slot of a batch whose response has been handled.
+func (w *changesWindow) release() {
+	if w == nil {
+		return
+	}
+	w.inFlight.Add(-1)
+	if w.slots != nil {
+		<-w.slots
+	}
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesWindow(t *testing.T) {
+	inFlight := expvar.Int{}
+	window := newChangesWindow(2, &inFlight)
+	terminator := make(chan bool)
+
+	require.NoError(t, window.acquire(terminator))
+	require.NoError(t, window.acquire(terminator))
+	assert.Equal(t, int64(2), inFlight.Value())
+
+	// A third batch waits for a slot to be released
+	acquired := make(chan error)
+	go func() {
+		acquired <- window.acquire(terminator)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Batch acquired a slot while the window was full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	window.release()
+	require.NoError(t, <-acquired)
+	assert.Equal(t, int64(2), inFlight.Value())
+
+	// Waiting stops when the connection closes
+	go func() {
+		acquired <- window.acquire(terminator)
+	}()
+	close(terminator)
+	assert.Equal(t, ErrClosedBLIPSender, <-acquired)
+	assert.Equal(t, int64(2), inFlight.Value())
+
+	// An unlimited window only counts batches in flight
+	unlimited := newChangesWindow(0, &inFlight)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, unlimited.acquire(nil))
+	}
+	assert.Equal(t, int64(12), inFlight.Value())
+	for i := 0; i < 10; i++ {
+		unlimited.release()
+	}
+	assert.Equal(t, int64(2), inFlight.Value())
+}
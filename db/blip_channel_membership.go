@@ -0,0 +1,61 @@
+package db
+
+import (
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// addChannelMembership adds the channels a revision's doc entered and left, relative to the revision's parent, to the
+// properties of the rev message sending it, for a client that asked for channel membership changes.  Only channels
+// the user can see are listed.  Each is taken from the channels the sync function assigned the revisions, as
+// recorded in the doc's revision tree, so computing them costs an extra read of the doc's sync metadata for every rev
+// sent.  Nothing is added when the parent's channels are unknown, because it's been pruned from the revision tree.
+func (bsc *BlipSyncContext) addChannelMembership(docID, revID string, properties blip.Properties) {
+	syncData, err := bsc.blipContextDb.GetDocSyncData(docID)
+	if err != nil {
+		base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Unable to read sync metadata for channel membership of %s/%s: %v", base.UD(docID), revID, err)
+		return
+	}
+	revInfo, found := syncData.History[revID]
+	if !found {
+		return
+	}
+	var parentChannels base.Set
+	if revInfo.Parent != "" {
+		parentInfo, found := syncData.History[revInfo.Parent]
+		if !found {
+			return
+		}
+		parentChannels = parentInfo.Channels
+	}
+
+	bsc.dbUserLock.RLock()
+	user := bsc.blipContextDb.User()
+	bsc.dbUserLock.RUnlock()
+	entered, left := channelMembershipDiff(parentChannels, revInfo.Channels, func(channel string) bool {
+		return user == nil || user.CanSeeChannel(channel)
+	})
+	if len(entered) > 0 {
+		properties[RevMessageEntered] = joinChannels(entered)
+	}
+	if len(left) > 0 {
+		properties[RevMessageLeft] = joinChannels(left)
+	}
+}
+
+// channelMembershipDiff returns the visible channels in current that aren't in previous, and in previous that aren't
+// in current.
+func channelMembershipDiff(previous, current base.Set, visible func(channel string) bool) (entered, left base.Set) {
+	entered, left = base.Set{}, base.Set{}
+	for channel := range current {
+		if !previous.Contains(channel) && visible(channel) {
+			entered.Add(channel)
+		}
+	}
+	for channel := range previous {
+		if !current.Contains(channel) && visible(channel) {
+			left.Add(channel)
+		}
+	}
+	return entered, left
+}
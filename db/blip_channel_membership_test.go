@@ -0,0 +1,25 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelMembershipDiff(t *testing.T) {
+	visible := func(channel string) bool { return channel != "hidden" }
+
+	entered, left := channelMembershipDiff(base.SetOf("a", "b", "hidden"), base.SetOf("b", "c"), visible)
+	assert.Equal(t, base.SetOf("c"), entered)
+	assert.Equal(t, base.SetOf("a"), left)
+
+	// A first revision enters all of its channels
+	entered, left = channelMembershipDiff(nil, base.SetOf("a", "hidden"), visible)
+	assert.Equal(t, base.SetOf("a"), entered)
+	assert.Empty(t, left)
+
+	entered, left = channelMembershipDiff(base.SetOf("a"), base.SetOf("a"), visible)
+	assert.Empty(t, entered)
+	assert.Empty(t, left)
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A sync_gateway/bychannel subscription may give glob patterns, e.g. 'device-*', in the subChanges 'channelPatterns'
+// property, in place of or as well as a 'channels' list, for clients whose channels follow a naming scheme.  '*' is the
+// only wildcard, matching any run of characters.  The patterns are expanded against the channels the user has been
+// granted, directly or through roles, when the subscription starts, and re-expanded whenever the user's grants change,
+// so that the feed picks up a matching channel granted mid-replication and stops sending from one that's revoked.
+// Since patterns are only ever expanded against the user's grants, they can't be used by an admin or by a user who
+// can see every channel, and a subscription whose patterns match a channel in the BLIP denylist is rejected, as a
+// channel list including it would be.
+
+// channelPatterns is a subscription's channel patterns, along with any channels it listed explicitly.
+type channelPatterns struct {
+	patterns []string
+	literals base.Set // Channels listed in the 'channels' property, which are always included
+}
+
+// matches returns true if the channel matches one of the patterns.
+func (p *channelPatterns) matches(channel string) bool {
+	if p == nil {
+		return false
+	}
+	for _, pattern := range p.patterns {
+		if matchChannelPattern(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the user's channels that match the patterns, along with the channels listed explicitly.
+func (p *channelPatterns) expand(user auth.User) base.Set {
+	expanded := make(base.Set, len(p.literals))
+	for channel := range p.literals {
+		expanded[channel] = struct{}{}
+	}
+	for channel := range user.InheritedChannels() {
+		if p.matches(channel) {
+			expanded[channel] = struct{}{}
+		}
+	}
+	return expanded
+}
+
+// matchChannelPattern returns true if the channel matches the glob pattern, in which '*' matches any run of
+// characters.
+func matchChannelPattern(pattern, channel string) bool {
+	parts := strings.Split(pattern, channels.AllChannelWildcard)
+	if len(parts) == 1 {
+		return pattern == channel
+	}
+	if !strings.HasPrefix(channel, parts[0]) {
+		return false
+	}
+	remaining := channel[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(remaining, part)
+		if index < 0 {
+			return false
+		}
+		remaining = remaining[index+len(part):]
+	}
+	return strings.HasSuffix(remaining, parts[len(parts)-1])
+}
+
+// subscribeChannelPatterns expands the subscription's channel patterns against the user's grants.  The feed then
+// runs over all the user's channels, so that it includes channels granted later, and changeRows skips changes outside
+// the current expansion.
+func (bh *blipHandler) subscribeChannelPatterns(patterns []string) error {
+	user := bh.db.User()
+	if user == nil || user.CanSeeChannel(channels.AllChannelWildcard) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Channel patterns can only be used by a user granted specific channels")
+	}
+	subscription := &channelPatterns{patterns: patterns, literals: bh.channels}
+	expanded := subscription.expand(user)
+	if denied := bh.deniedChannels(expanded.ToArray()); len(denied) > 0 {
+		return base.HTTPErrorf(http.StatusForbidden, "Channel patterns match channel(s) that can't be replicated: %s", base.UD(denied))
+	}
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Channel patterns %s expanded to %s", base.UD(patterns), base.UD(expanded))
+
+	// Called by handleSubChanges, which holds bh.lock
+	bh.channelPatterns, bh.patternChannels = subscription, expanded
+	bh.channels = nil
+	return nil
+}
+
+// reexpandChannelPatterns re-expands the subscription's channel patterns against a refreshed user's grants.
+func (bsc *BlipSyncContext) reexpandChannelPatterns(user auth.User) {
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	if bsc.channelPatterns == nil || user == nil {
+		return
+	}
+	bsc.patternChannels = bsc.channelPatterns.expand(user)
+}
+
+// inPatternChannels returns true if the subscription has no channel patterns, or the change was found in a channel
+// they currently expand to.
+func (bsc *BlipSyncContext) inPatternChannels(change *ChangeEntry) bool {
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	if bsc.channelPatterns == nil || bsc.patternChannels.Contains(channels.AllChannelWildcard) {
+		return true
+	}
+	for _, channel := range change.channels {
+		if bsc.patternChannels.Contains(channel) {
+			return true
+		}
+	}
+	return false
+}
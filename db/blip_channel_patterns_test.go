@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchChannelPattern(t *testing.T) {
+	tests := []struct {
+		pattern, channel string
+		matches          bool
+	}{
+		{"device-*", "device-1", true},
+		{"device-*", "device-", true},
+		{"device-*", "devices", false},
+		{"*-log", "device-log", true},
+		{"*-log", "device-logs", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"ab*ba", "aba", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.matches, matchChannelPattern(test.pattern, test.channel), "%s against %s", test.pattern, test.channel)
+	}
+}
+
+// TestChannelPatternsChangeRows verifies changes are only sent from channels the patterns currently expand to.
+func TestChannelPatternsChangeRows(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	change := func(channel string) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: 5}, ID: "doc1", Changes: []ChangeRev{{"rev": "1-a"}}, channels: []string{channel}}
+	}
+	assert.Len(t, bh.changeRows(change("device-1")), 1)
+
+	bh.channelPatterns = &channelPatterns{patterns: []string{"device-*"}}
+	bh.patternChannels = base.SetOf("device-1")
+	assert.Len(t, bh.changeRows(change("device-1")), 1)
+	assert.Empty(t, bh.changeRows(change("device-2")), "Matching channels the user hasn't been granted aren't sent")
+	assert.Empty(t, bh.changeRows(change("other")))
+
+	assert.True(t, bh.channelPatterns.matches("device-2"))
+	assert.False(t, bh.channelPatterns.matches("other"))
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"math"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// maxChannelDocsSentTracked is the most channels whose sent docs are counted, when per-channel pull stats are enabled.
+const maxChannelDocsSentTracked = 100
+
+// channelDocsSent counts the docs sent to pulls from each channel, to help find the channel responsible for a runaway
+// feed, and is published as the StatKeyPullChannelDocsSent stat.  Only the heaviest channels are tracked, so that a
+// database with a huge number of channels doesn't have a huge stat: once the limit is reached, a doc sent from an
+// untracked channel replaces the least-counted channel, inheriting its count.  That way a channel with enough volume to
+// be among the heaviest is always tracked, with its count overstated by no more than the count it inherited.
+type channelDocsSent struct {
+	lock        sync.Mutex
+	counts      map[string]int64
+	maxChannels int
+}
+
+// newChannelDocsSent returns a counter tracking at most maxChannels channels, or nil when disabled.
+func newChannelDocsSent(enabled bool, maxChannels int) *channelDocsSent {
+	if !enabled {
+		return nil
+	}
+	return &channelDocsSent{
+		counts:      make(map[string]int64, maxChannels),
+		maxChannels: maxChannels,
+	}
+}
+
+// add counts a doc sent from each of the given channels.
+func (c *channelDocsSent) add(channels []string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, channel := range channels {
+		if _, tracked := c.counts[channel]; !tracked && len(c.counts) >= c.maxChannels {
+			minChannel, minCount := "", int64(math.MaxInt64)
+			for trackedChannel, count := range c.counts {
+				if count < minCount {
+					minChannel, minCount = trackedChannel, count
+				}
+			}
+			delete(c.counts, minChannel)
+			c.counts[channel] = minCount
+		}
+		c.counts[channel]++
+	}
+}
+
+// String returns the counts as a JSON object keyed by channel, to satisfy expvar.Var.
+func (c *channelDocsSent) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	countsJSON, err := base.JSONMarshal(c.counts)
+	if err != nil {
+		return "{}"
+	}
+	return string(countsJSON)
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelDocsSent(t *testing.T) {
+	assert.Nil(t, newChannelDocsSent(false, 2))
+
+	counter := newChannelDocsSent(true, 2)
+	for i := 0; i < 5; i++ {
+		counter.add([]string{"heavy"})
+	}
+	counter.add([]string{"light", "other"})
+	counter.add([]string{"other"})
+
+	// "other" replaced "light", inheriting its count
+	var counts map[string]int64
+	require.NoError(t, base.JSONUnmarshal([]byte(counter.String()), &counts))
+	assert.Equal(t, map[string]int64{"heavy": 5, "other": 3}, counts)
+}
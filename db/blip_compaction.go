@@ -0,0 +1,161 @@
+package db
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	compactionStatusMaxTombstones = 100000 // Tombstones counted per getCompactionStatus request, beyond which counts are capped
+	compactionSizeSampleCount     = 20     // Purgeable tombstones read to estimate their average size
+)
+
+// Compaction job states
+const (
+	compactionStateRunning   = "running"
+	compactionStateCompleted = "completed"
+	compactionStateFailed    = "failed"
+)
+
+// CompactionStatus is the response body of a getCompactionStatus request.  Tombstone counts are capped at
+// compactionStatusMaxTombstones, with Capped set when the cap was reached.  The reclaimable space is an estimate from
+// the size of a sample of purgeable tombstones, and doesn't include old revision backups, which expire on their own.
+type CompactionStatus struct {
+	Tombstones          int                  `json:"tombstones"`
+	PurgeableTombstones int                  `json:"purgeableTombstones"`
+	ReclaimableBytes    int64                `json:"estimatedReclaimableBytes"`
+	Capped              bool                 `json:"capped,omitempty"`
+	Job                 *compactionJobStatus `json:"job,omitempty"`
+}
+
+type compactionJobStatus struct {
+	JobID     string     `json:"jobId"`
+	State     string     `json:"state"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	Purged    int        `json:"purgedTombstones"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// compactionTracker records the most recent compaction started by a startCompaction request, so that later
+// getCompactionStatus requests (on any connection) can report its progress.
+type compactionTracker struct {
+	lock sync.Mutex
+	job  *compactionJobStatus
+}
+
+// start runs a compaction in the background and returns its job ID.  The compaction isn't tied to the connection
+// that started it, so it continues if the client disconnects.
+func (t *compactionTracker) start(db *Database) (jobID string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if db.IsCompactRunning() || (t.job != nil && t.job.State == compactionStateRunning) {
+		return "", base.HTTPErrorf(http.StatusServiceUnavailable, "Compaction already running")
+	}
+
+	job := &compactionJobStatus{
+		JobID:     base.GenerateRandomID(),
+		State:     compactionStateRunning,
+		StartTime: time.Now(),
+	}
+	t.job = job
+
+	go func() {
+		_, err := db.compact(func(count int) {
+			t.lock.Lock()
+			job.Purged += count
+			t.lock.Unlock()
+		})
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		endTime := time.Now()
+		job.EndTime = &endTime
+		if err != nil {
+			job.State = compactionStateFailed
+			job.Error = err.Error()
+		} else {
+			job.State = compactionStateCompleted
+		}
+	}()
+	return job.JobID, nil
+}
+
+// status returns a copy of the most recent job's status, or nil if no compaction has been started.
+func (t *compactionTracker) status() *compactionJobStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.job == nil {
+		return nil
+	}
+	job := *t.job
+	return &job
+}
+
+// compactionStatus counts tombstones, and those old enough to be purged by compaction, and estimates the space
+// compaction would reclaim.
+func (db *Database) compactionStatus() (*CompactionStatus, error) {
+	status := &CompactionStatus{}
+
+	tombstones, _, err := db.countTombstones(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	purgeOlderThan := time.Now().Add(time.Duration(-db.PurgeInterval) * time.Hour)
+	purgeable, sample, err := db.countTombstones(purgeOlderThan)
+	if err != nil {
+		return nil, err
+	}
+	status.Tombstones = tombstones
+	status.PurgeableTombstones = purgeable
+	status.Capped = tombstones >= compactionStatusMaxTombstones
+
+	var sampledBytes, sampled int64
+	for _, docID := range sample {
+		if size, ok := db.tombstoneSize(docID); ok {
+			sampledBytes += size
+			sampled++
+		}
+	}
+	if sampled > 0 {
+		status.ReclaimableBytes = sampledBytes / sampled * int64(purgeable)
+	}
+	status.Job = db.compactionJobs.status()
+	return status, nil
+}
+
+// countTombstones returns the number of tombstones older than the given time, up to compactionStatusMaxTombstones,
+// along with the IDs of the first few for size sampling.
+func (db *Database) countTombstones(olderThan time.Time) (count int, sample []string, err error) {
+	results, err := db.QueryTombstones(olderThan, compactionStatusMaxTombstones)
+	if err != nil {
+		return 0, nil, err
+	}
+	var row QueryIdRow
+	for results.Next(&row) {
+		if len(sample) < compactionSizeSampleCount {
+			sample = append(sample, row.Id)
+		}
+		count++
+	}
+	return count, sample, results.Close()
+}
+
+// tombstoneSize returns the size of a tombstone in the bucket, including its sync metadata.
+func (db *Database) tombstoneSize(docID string) (int64, bool) {
+	if db.UseXattrs() {
+		var body, xattr []byte
+		if _, err := db.Bucket.GetWithXattr(docID, base.SyncXattrName, &body, &xattr); err != nil {
+			return 0, false
+		}
+		return int64(len(docID) + len(body) + len(xattr)), true
+	}
+	raw, _, err := db.Bucket.GetRaw(docID)
+	if err != nil {
+		return 0, false
+	}
+	return int64(len(docID) + len(raw)), true
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompactionTracker verifies a started compaction is reported as running and then completed, and that a second
+// compaction can't be started while one is running.
+func TestCompactionTracker(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+
+	context, err := NewDatabaseContext("db", testBucket.Bucket, false, DatabaseContextOptions{EnableXattr: base.TestUseXattrs()})
+	require.NoError(t, err)
+	defer context.Close()
+	db, err := CreateDatabase(context)
+	require.NoError(t, err)
+
+	var tracker compactionTracker
+	assert.Nil(t, tracker.status())
+
+	// Simulate a compaction already running, e.g. started via the REST API
+	db.CompactState = DBCompactRunning
+	_, err = tracker.start(db)
+	assert.Error(t, err)
+	db.CompactState = DBCompactNotRunning
+
+	jobID, err := tracker.start(db)
+	require.NoError(t, err)
+	assert.NotEmpty(t, jobID)
+
+	var status *compactionJobStatus
+	for i := 0; i < 100; i++ {
+		status = tracker.status()
+		if status.State != compactionStateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobID, status.JobID)
+	assert.Equal(t, compactionStateCompleted, status.State)
+	assert.NotNil(t, status.EndTime)
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// blipConnectionDrainTimeout is how long a connection that's reached its maximum lifetime waits for in-flight
+	// requests to complete before it's closed regardless.
+	blipConnectionDrainTimeout = 30 * time.Second
+
+	// blipClosingAckTimeout is how long the client is given to acknowledge a closing message.
+	blipClosingAckTimeout = 5 * time.Second
+)
+
+// ErrConnectionClosing is returned for requests received once a connection has begun closing.
+var ErrConnectionClosing = base.HTTPErrorf(http.StatusServiceUnavailable, "Connection is closing")
+
+// EnforceMaxLifetime closes conn once the connection has been open for BlipSyncOptions.MaxConnectionLifetime, so that
+// the client has to reconnect and re-authenticate.  Does nothing when no maximum lifetime is configured.
+func (bsc *BlipSyncContext) EnforceMaxLifetime(conn io.Closer) {
+	lifetime := bsc.blipContextDb.Options.BlipSyncOptions.MaxConnectionLifetime
+	if lifetime <= 0 {
+		return
+	}
+	bsc.lock.Lock()
+	bsc.lifetimeTimer = time.AfterFunc(lifetime, func() {
+		bsc.closeForMaxLifetime(conn, blipConnectionDrainTimeout)
+	})
+	bsc.lock.Unlock()
+}
+
+// closeForMaxLifetime gracefully closes a connection that's reached its maximum lifetime.  New requests are
+// rejected, the terminator is signalled so that changes feeds stop, and in-flight requests are given up to
+// drainTimeout to complete.  The client is then sent a closing message with the reason, so that it reconnects
+// rather than treating the close as an error, and given a short time to acknowledge it.
+func (bsc *BlipSyncContext) closeForMaxLifetime(conn io.Closer, drainTimeout time.Duration) {
+	bsc.lock.Lock()
+	bsc.closing = true
+	sender := bsc.sender
+	bsc.lock.Unlock()
+
+	base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "Connection reached its maximum lifetime of %v - closing", bsc.blipContextDb.Options.BlipSyncOptions.MaxConnectionLifetime)
+	bsc.dbStats.StatsDatabase().Add(base.StatKeyMaxLifetimeCloseCount, 1)
+	bsc.terminatorOnce.Do(func() {
+		close(bsc.terminator)
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		bsc.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "In-flight requests didn't complete within %v - closing anyway", drainTimeout)
+	}
+
+	if sender != nil {
+		closingRq := blip.NewRequest()
+		closingRq.SetProfile(MessageClosing)
+		closingRq.Properties[ClosingReason] = ClosingReasonMaxLifetime
+		if sender.Send(closingRq) {
+			// Wait for the client's reply, so that the message isn't lost when the connection is closed.  Clients
+			// that don't handle closing messages still reply with an error.
+			acked := make(chan struct{})
+			go func() {
+				closingRq.Response()
+				close(acked)
+			}()
+			select {
+			case <-acked:
+			case <-time.After(blipClosingAckTimeout):
+			}
+		}
+	}
+	_ = conn.Close()
+}
+
+// startRequest registers a request as in-flight, returning false if the connection is closing.  The request's
+// sender is retained for sending the closing message.  Each successful call must be matched by inFlight.Done().
+func (bsc *BlipSyncContext) startRequest(rq *blip.Message) bool {
+	bsc.lock.Lock()
+	defer bsc.lock.Unlock()
+	if bsc.closing {
+		return false
+	}
+	bsc.inFlight.Add(1)
+	if bsc.sender == nil {
+		bsc.sender = rq.Sender
+	}
+	return true
+}
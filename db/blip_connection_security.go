@@ -0,0 +1,122 @@
+package db
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// ConnectionSecurity describes how a replication connection is secured, as checked against the database's connection
+// security policy before the connection may replicate documents.
+type ConnectionSecurity struct {
+	TLSVersion  uint16 // Negotiated TLS version, or 0 when the connection isn't TLS
+	CipherSuite uint16 // Negotiated cipher suite, when TLS
+	ClientCert  bool   // Whether the client presented a verified certificate
+}
+
+// ConnInspector returns the security of the connection a replication's WebSocket upgrade request arrived on.  The
+// default inspects the request's own TLS state, which is empty when TLS is terminated before Sync Gateway, so
+// deployments behind a TLS-terminating proxy provide an inspector that trusts what the proxy forwards instead.
+type ConnInspector func(rq *http.Request) ConnectionSecurity
+
+// InspectConnectionSecurity returns the security of the TLS connection a request arrived on.
+func InspectConnectionSecurity(rq *http.Request) ConnectionSecurity {
+	var security ConnectionSecurity
+	if state := rq.TLS; state != nil {
+		security.TLSVersion = state.Version
+		security.CipherSuite = state.CipherSuite
+		security.ClientCert = len(state.VerifiedChains) > 0
+	}
+	return security
+}
+
+// ParseCipherSuites returns the IDs of the named TLS cipher suites, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, found := suites[name]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// insecureProfiles are the messages still handled on connections below the database's security policy: checkpoints
+// and getCapabilities, so a client can learn why it can't replicate.  Every other message, including any profile
+// added later, is refused on such connections.
+var insecureProfiles = base.SetOf(MessageCapabilities, MessageGetCheckpoint, MessageSetCheckpoint, MessageGetCheckpoints,
+	MessageDelCheckpoint, MessageVerifyCheckpt)
+
+// SetConnectionSecurity records the security of the connection, using BlipSyncOptions.ConnectionInspector when set,
+// and checks it against the database's policy.  Must be called before the connection handles any requests.
+func (bsc *BlipSyncContext) SetConnectionSecurity(rq *http.Request) {
+	inspect := InspectConnectionSecurity
+	if inspector := bsc.blipContextDb.Options.BlipSyncOptions.ConnectionInspector; inspector != nil {
+		inspect = inspector
+	}
+	bsc.connectionSecurity = inspect(rq)
+	bsc.securityViolation = checkConnectionSecurity(bsc.connectionSecurity, bsc.blipContextDb.Options.BlipSyncOptions)
+	if bsc.securityViolation != nil {
+		base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "Connection doesn't meet the security policy, and may not replicate: %v", bsc.securityViolation)
+	}
+}
+
+// checkConnectionSecurity returns a 403 error describing how a connection falls short of the options' policy, or nil
+// if it meets it.
+func checkConnectionSecurity(security ConnectionSecurity, options BlipSyncOptions) error {
+	if options.MinTLSVersion != 0 && security.TLSVersion < options.MinTLSVersion {
+		if security.TLSVersion == 0 {
+			return base.HTTPErrorf(http.StatusForbidden, "Connection security below policy: TLS is required")
+		}
+		return base.HTTPErrorf(http.StatusForbidden, "Connection security below policy: TLS version %s is below the minimum of %s",
+			tlsVersionName(security.TLSVersion), tlsVersionName(options.MinTLSVersion))
+	}
+	if len(options.AllowedCipherSuites) > 0 && security.TLSVersion != 0 {
+		allowed := false
+		for _, suite := range options.AllowedCipherSuites {
+			allowed = allowed || suite == security.CipherSuite
+		}
+		if !allowed {
+			return base.HTTPErrorf(http.StatusForbidden, "Connection security below policy: cipher suite %s isn't allowed",
+				tls.CipherSuiteName(security.CipherSuite))
+		}
+	}
+	if options.RequireClientCert && !security.ClientCert {
+		return base.HTTPErrorf(http.StatusForbidden, "Connection security below policy: a client certificate is required")
+	}
+	return nil
+}
+
+// checkSecurity returns the connection's security policy violation when the given message may not be handled on it.
+// The first message refused counts the connection as rejected.
+func (bsc *BlipSyncContext) checkSecurity(profile string) error {
+	if bsc.securityViolation == nil || insecureProfiles.Contains(profile) {
+		return nil
+	}
+	if bsc.securityRejected.CompareAndSwap(false, true) {
+		bsc.dbStats.StatsDatabase().Add(base.StatKeySecurityRejected, 1)
+	}
+	return bsc.securityViolation
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "tlsv1"
+	case tls.VersionTLS11:
+		return "tlsv1.1"
+	case tls.VersionTLS12:
+		return "tlsv1.2"
+	case tls.VersionTLS13:
+		return "tlsv1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
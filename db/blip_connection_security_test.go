@@ -0,0 +1,71 @@
+package db
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConnectionSecurity(t *testing.T) {
+	plaintext := ConnectionSecurity{}
+	tls12 := ConnectionSecurity{TLSVersion: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	tls13 := ConnectionSecurity{TLSVersion: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ClientCert: true}
+
+	// No policy allows any connection
+	assert.NoError(t, checkConnectionSecurity(plaintext, BlipSyncOptions{}))
+
+	options := BlipSyncOptions{MinTLSVersion: tls.VersionTLS12}
+	assertHTTPError(t, checkConnectionSecurity(plaintext, options), http.StatusForbidden)
+	assertHTTPError(t, checkConnectionSecurity(ConnectionSecurity{TLSVersion: tls.VersionTLS11}, options), http.StatusForbidden)
+	assert.NoError(t, checkConnectionSecurity(tls12, options))
+
+	options.AllowedCipherSuites = []uint16{tls.TLS_AES_128_GCM_SHA256}
+	err := checkConnectionSecurity(tls12, options)
+	assertHTTPError(t, err, http.StatusForbidden)
+	assert.Contains(t, err.Error(), "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	assert.NoError(t, checkConnectionSecurity(tls13, options))
+
+	options.RequireClientCert = true
+	assert.NoError(t, checkConnectionSecurity(tls13, options))
+	tls13.ClientCert = false
+	assertHTTPError(t, checkConnectionSecurity(tls13, options), http.StatusForbidden)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_RC4_128_SHA}, suites)
+
+	_, err = ParseCipherSuites([]string{"TLS_MADE_UP"})
+	assert.Error(t, err)
+}
+
+// TestCheckSecurityProfiles verifies every handled message other than checkpoints and getCapabilities is refused on a
+// connection below the security policy, so that a newly added profile is secured by default.
+func TestCheckSecurityProfiles(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bsc := &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}
+	for profile := range kHandlersByProfile {
+		assert.NoError(t, bsc.checkSecurity(profile), "Profile %s refused on a connection meeting the policy", profile)
+	}
+
+	bsc.securityViolation = base.HTTPErrorf(http.StatusForbidden, "Connection security below policy: TLS is required")
+	for profile := range kHandlersByProfile {
+		if insecureProfiles.Contains(profile) {
+			assert.NoError(t, bsc.checkSecurity(profile), "Profile %s should be handled below the policy", profile)
+		} else {
+			assertHTTPError(t, bsc.checkSecurity(profile), http.StatusForbidden)
+		}
+	}
+	for _, profile := range []string{MessageRev, MessageSubChanges, MessageReconcile, MessagePurgeBatch, MessageGetAccess, MessageGetRev} {
+		assert.Error(t, bsc.checkSecurity(profile), "Profile %s should be refused below the policy", profile)
+	}
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(db.DbStats.StatsDatabase().Get(base.StatKeySecurityRejected)))
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Cursor tokens are opaque, signed resume points sent in changes rows to a client that set the subChanges
+// 'cursorTokens' property, which the client can pass back as 'since' instead of a raw sequence.  A token has the form
+//
+//	<version>.<payload>.<signature>
+//
+// where the payload is the base64url-encoded JSON of a cursorToken, and the signature is the base64url-encoded
+// HMAC-SHA256 of "<version>.<payload>" keyed with the database's cursor token secret.  The version is bumped whenever
+// the payload's meaning changes incompatibly, and tokens of other versions are rejected, so clients must fall back to
+// a full resync (or a raw sequence) after a version change.  Changing the secret invalidates all outstanding tokens.
+const cursorTokenVersion = "ct1"
+
+var errInvalidCursorToken = base.HTTPErrorf(http.StatusBadRequest, "Invalid cursor token")
+
+// cursorToken is the payload of a cursor token.
+type cursorToken struct {
+	Seq          string            `json:"seq"`                    // Sequence of the change the token was sent with
+	ChannelSince map[string]uint64 `json:"channelSince,omitempty"` // Per-channel checkpoints later than Seq
+}
+
+// isCursorToken returns true if the given since value looks like a cursor token rather than a sequence.
+func isCursorToken(since string) bool {
+	return strings.HasPrefix(since, cursorTokenVersion+".")
+}
+
+// newCursorToken returns a signed token for resuming changes after the given sequence.  Only the per-channel
+// checkpoints later than the sequence are kept, as the changes feed is in sequence order, so every other channel has
+// been caught up to it.
+func (dbc *DatabaseContext) newCursorToken(seq SequenceID, channelSince map[string]uint64) (string, error) {
+	payload := cursorToken{Seq: seq.String()}
+	for channel, channelSeq := range channelSince {
+		if channelSeq > seq.Seq {
+			if payload.ChannelSince == nil {
+				payload.ChannelSince = make(map[string]uint64)
+			}
+			payload.ChannelSince[channel] = channelSeq
+		}
+	}
+	payloadBytes, err := base.JSONMarshal(payload)
+	if err != nil {
+		return "", err
+	}
+	signed := cursorTokenVersion + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(dbc.signCursorToken(signed)), nil
+}
+
+// parseCursorToken validates a token's version and signature, returning its sequence and per-channel checkpoints.
+func (dbc *DatabaseContext) parseCursorToken(token string) (seq SequenceID, channelSince map[string]uint64, err error) {
+	if dbc.Options.BlipSyncOptions.CursorTokenSecret == "" {
+		return seq, nil, base.HTTPErrorf(http.StatusBadRequest, "Cursor tokens aren't enabled")
+	}
+	separator := strings.LastIndex(token, ".")
+	if !isCursorToken(token) || separator <= len(cursorTokenVersion) {
+		return seq, nil, errInvalidCursorToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[separator+1:])
+	if err != nil || !hmac.Equal(signature, dbc.signCursorToken(token[:separator])) {
+		return seq, nil, errInvalidCursorToken
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(token[len(cursorTokenVersion)+1 : separator])
+	if err != nil {
+		return seq, nil, errInvalidCursorToken
+	}
+	var payload cursorToken
+	if err := base.JSONUnmarshal(payloadBytes, &payload); err != nil {
+		return seq, nil, errInvalidCursorToken
+	}
+	if seq, err = dbc.ParseSequenceID(payload.Seq); err != nil {
+		return seq, nil, errInvalidCursorToken
+	}
+	return seq, payload.ChannelSince, nil
+}
+
+func (dbc *DatabaseContext) signCursorToken(signed string) []byte {
+	mac := hmac.New(sha256.New, []byte(dbc.Options.BlipSyncOptions.CursorTokenSecret))
+	_, _ = mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// cursorTokenForChange returns the cursor token to send with a change, or an empty string if it can't be generated.
+func (bh *blipHandler) cursorTokenForChange(change *ChangeEntry) string {
+	token, err := bh.db.newCursorToken(change.Seq, bh.cursorChannelSince)
+	if err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to generate cursor token for seq %s: %v", change.Seq, err)
+		return ""
+	}
+	return token
+}
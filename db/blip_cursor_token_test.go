@@ -0,0 +1,43 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCursorToken verifies cursor tokens round trip, keep only the per-channel checkpoints ahead of their sequence,
+// and are rejected when tampered with or signed with another secret.
+func TestCursorToken(t *testing.T) {
+	dbc := &DatabaseContext{Options: DatabaseContextOptions{BlipSyncOptions: BlipSyncOptions{CursorTokenSecret: "secret"}}}
+
+	token, err := dbc.newCursorToken(SequenceID{Seq: 100}, map[string]uint64{"a": 50, "b": 150})
+	require.NoError(t, err)
+	assert.True(t, isCursorToken(token))
+	assert.False(t, isCursorToken("100"))
+
+	seq, channelSince, err := dbc.parseCursorToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, SequenceID{Seq: 100}, seq)
+	assert.Equal(t, map[string]uint64{"b": 150}, channelSince)
+
+	// Tampered payload
+	tampered := []byte(token)
+	tampered[len(cursorTokenVersion)+2] ^= 1
+	_, _, err = dbc.parseCursorToken(string(tampered))
+	assert.Equal(t, errInvalidCursorToken, err)
+
+	// Different secret
+	otherDbc := &DatabaseContext{Options: DatabaseContextOptions{BlipSyncOptions: BlipSyncOptions{CursorTokenSecret: "other"}}}
+	_, _, err = otherDbc.parseCursorToken(token)
+	assert.Equal(t, errInvalidCursorToken, err)
+
+	// Cursor tokens disabled
+	_, _, err = (&DatabaseContext{}).parseCursorToken(token)
+	assert.Error(t, err)
+
+	// Unknown version
+	_, _, err = dbc.parseCursorToken("ct0" + token[len(cursorTokenVersion):])
+	assert.Equal(t, errInvalidCursorToken, err)
+}
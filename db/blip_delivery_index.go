@@ -0,0 +1,25 @@
+package db
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/couchbase/go-blip"
+)
+
+// deliveryCounter numbers the rev and norev messages sent on a subscription whose client asked, with subChanges'
+// 'deliveryIndex' property, for a delivery index.  Indexes start at 1 for each subscription and increase by one with
+// every message, including re-sent revs, so a client handling revs concurrently can restore the order they were sent
+// in, and tell from a gap that it's still waiting for one.  They're assigned as messages are sent, so they reflect
+// send order rather than sequence order.
+type deliveryCounter struct {
+	last uint64 // Index of the last message sent.  Atomic access
+}
+
+// setDeliveryIndex sets the next delivery index on an outgoing rev or norev message's properties, when the
+// subscription asked for them.
+func (bsc *BlipSyncContext) setDeliveryIndex(properties blip.Properties) {
+	if counter := bsc.deliveryCounter; counter != nil {
+		properties[RevMessageDelivery] = strconv.FormatUint(atomic.AddUint64(&counter.last, 1), 10)
+	}
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/go-blip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDeliveryIndex(t *testing.T) {
+	bsc := &BlipSyncContext{}
+	properties := blip.Properties{}
+	bsc.setDeliveryIndex(properties)
+	assert.NotContains(t, properties, RevMessageDelivery)
+
+	bsc.deliveryCounter = &deliveryCounter{}
+	for _, expected := range []string{"1", "2", "3"} {
+		bsc.setDeliveryIndex(properties)
+		assert.Equal(t, expected, properties[RevMessageDelivery])
+	}
+
+	// A new subscription starts counting again
+	bsc.deliveryCounter = &deliveryCounter{}
+	bsc.setDeliveryIndex(properties)
+	assert.Equal(t, "1", properties[RevMessageDelivery])
+}
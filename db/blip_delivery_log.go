@@ -0,0 +1,144 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// DefaultDeliveryLogSize is the number of docs whose delivered revs are remembered per client, when no size is
+	// configured.
+	DefaultDeliveryLogSize = 1000
+
+	// deliveryLogStoreMaxClients is the number of clients' delivery logs held before expired logs are purged.
+	deliveryLogStoreMaxClients = 10000
+)
+
+// A client that reconnects frequently is re-sent the changes it was sent between its last persisted checkpoint and
+// the disconnect.  When BlipSyncOptions.DeliveryLogRetention is set, subscriptions that identify the client with the
+// subChanges 'session' property record the revs the client acknowledged in a delivery log, kept per user and session.
+// Revs on such a subscription require a reply, so that only revs the client is known to have received are recorded.
+// A subscription that resumes within the retention window of the client's last delivery doesn't announce the revs
+// in its log again, unless they reappear in the feed at a later sequence (e.g. for a metadata change).  Each log
+// holds the revs of the BlipSyncOptions.DeliveryLogSize docs most recently delivered.  Outside the window, or for
+// docs beyond that bound, delivery falls back to the client's checkpoint as before.  Logs are in-memory and per node,
+// so a client reconnecting to a different Sync Gateway node or after a restart is sent those changes again.
+
+// deliveryLogStore holds the delivery logs of clients that have recently been sent revs, keyed by user and session.
+type deliveryLogStore struct {
+	retention time.Duration
+	size      int
+	lock      sync.Mutex
+	logs      map[string]*deliveryLog
+}
+
+// deliveryLog records the revs recently delivered to a client.
+type deliveryLog struct {
+	store     *deliveryLogStore
+	lock      sync.Mutex
+	revs      map[string]*list.Element // Doc ID to element of order, whose value is a *deliveredRev
+	order     *list.List               // Docs from least to most recently delivered
+	expiresAt time.Time
+}
+
+type deliveredRev struct {
+	docID string
+	revID string
+	seq   uint64 // Sequence the rev was sent at
+}
+
+// newDeliveryLogStore returns a delivery log store retaining each client's log for the given duration after its last
+// delivery, or nil when the retention is zero (disabled).
+func newDeliveryLogStore(retention time.Duration, size int) *deliveryLogStore {
+	if retention <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = DefaultDeliveryLogSize
+	}
+	return &deliveryLogStore{
+		retention: retention,
+		size:      size,
+		logs:      make(map[string]*deliveryLog),
+	}
+}
+
+// get returns the delivery log for key, starting a new one when there isn't one or its retention window has elapsed.
+func (s *deliveryLogStore) get(key string) *deliveryLog {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if log, ok := s.logs[key]; ok && now.Before(log.expiry()) {
+		return log
+	}
+	if len(s.logs) >= deliveryLogStoreMaxClients {
+		for k, log := range s.logs {
+			if !now.Before(log.expiry()) {
+				delete(s.logs, k)
+			}
+		}
+	}
+	log := &deliveryLog{
+		store:     s,
+		revs:      make(map[string]*list.Element),
+		order:     list.New(),
+		expiresAt: now.Add(s.retention),
+	}
+	s.logs[key] = log
+	return log
+}
+
+func (l *deliveryLog) expiry() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.expiresAt
+}
+
+// delivered records that the client acknowledged the rev sent at the given sequence, and extends the log's retention.
+func (l *deliveryLog) delivered(docID, revID string, seq uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.expiresAt = time.Now().Add(l.store.retention)
+	if element, ok := l.revs[docID]; ok {
+		element.Value = &deliveredRev{docID: docID, revID: revID, seq: seq}
+		l.order.MoveToBack(element)
+		return
+	}
+	l.revs[docID] = l.order.PushBack(&deliveredRev{docID: docID, revID: revID, seq: seq})
+	if l.order.Len() > l.store.size {
+		oldest := l.order.Front()
+		delete(l.revs, oldest.Value.(*deliveredRev).docID)
+		l.order.Remove(oldest)
+	}
+}
+
+// alreadyDelivered returns true if the client has already acknowledged the rev, sent at the given sequence or later.
+func (l *deliveryLog) alreadyDelivered(docID, revID string, seq uint64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	element, ok := l.revs[docID]
+	if !ok {
+		return false
+	}
+	rev := element.Value.(*deliveredRev)
+	return rev.revID == revID && seq <= rev.seq
+}
+
+// recordDelivery records a rev the client acknowledged in the subscription's delivery log.
+func (bsc *BlipSyncContext) recordDelivery(log *deliveryLog, docID, revID, seqStr string) {
+	seq, err := bsc.blipContextDb.ParseSequenceID(seqStr)
+	if err != nil {
+		base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Not recording delivery of %s/%s with invalid sequence %q: %v", base.UD(docID), revID, seqStr, err)
+		return
+	}
+	log.delivered(docID, revID, seq.Seq)
+}
+
+// deliveryLogKey scopes a client-supplied session identifier to the user, so that one user's deliveries don't affect
+// what's sent to another.
+func deliveryLogKey(userName, session string) string {
+	return userName + "/" + session
+}
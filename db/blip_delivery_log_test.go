@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryLogStore(t *testing.T) {
+	assert.Nil(t, newDeliveryLogStore(0, 10))
+
+	store := newDeliveryLogStore(50*time.Millisecond, 2)
+	log := store.get(deliveryLogKey("alice", "s1"))
+	assert.True(t, log == store.get(deliveryLogKey("alice", "s1")))
+	assert.False(t, log == store.get(deliveryLogKey("bob", "s1")))
+
+	log.delivered("doc1", "1-a", 10)
+	assert.True(t, log.alreadyDelivered("doc1", "1-a", 10))
+	assert.True(t, log.alreadyDelivered("doc1", "1-a", 5))
+	assert.False(t, log.alreadyDelivered("doc1", "1-a", 11), "A rev reappearing at a later sequence should be sent")
+	assert.False(t, log.alreadyDelivered("doc1", "2-b", 10))
+
+	// Bounded to the most recently delivered docs
+	log.delivered("doc2", "1-a", 11)
+	log.delivered("doc1", "2-b", 12)
+	log.delivered("doc3", "1-a", 13)
+	assert.False(t, log.alreadyDelivered("doc2", "1-a", 11))
+	assert.True(t, log.alreadyDelivered("doc1", "2-b", 12))
+	assert.True(t, log.alreadyDelivered("doc3", "1-a", 13))
+
+	// Discarded once the retention window after the last delivery has elapsed
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, log == store.get(deliveryLogKey("alice", "s1")))
+}
+
+// TestDeliveryLogChangeRows verifies changes for revs in the client's delivery log aren't announced again.
+func TestDeliveryLogChangeRows(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	bh.deliveryLog = newDeliveryLogStore(time.Minute, 0).get(deliveryLogKey("", "session"))
+	bh.recordDelivery(bh.deliveryLog, "delivered", "1-a", "5")
+
+	change := func(docID string, seq uint64) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: seq}, ID: docID, Changes: []ChangeRev{{"rev": "1-a"}}}
+	}
+	assert.Empty(t, bh.changeRows(change("delivered", 5)))
+	require.Len(t, bh.changeRows(change("delivered", 6)), 1)
+	require.Len(t, bh.changeRows(change("other", 5)), 1)
+	assert.True(t, bh.revsRequireReply())
+
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(db.DbStats.StatsCblReplicationPull().Get(base.StatKeyDeliveryLogSkipped)))
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultDeltaFailureCooldown is how long delta acceptance stays disabled for a connection once a document's delta
+// failures reach the threshold, when the threshold is set.
+const DefaultDeltaFailureCooldown = 5 * time.Minute
+
+// deltaFailureMaxDocs is the number of documents whose consecutive delta failures are tracked per connection.  Beyond
+// this the counts are reset, so a client failing across many documents only delays the threshold being reached.
+const deltaFailureMaxDocs = 1000
+
+// deltaFailureTracker counts consecutive failures to apply deltas pushed on a connection, per document.  A delta
+// fails when its source revision isn't available or it can't be patched onto the source.  Once a document reaches
+// the threshold, pushed deltas are rejected for the whole connection until the cooldown has elapsed, so that a
+// broken client has to send full bodies instead of repeatedly exercising the delta library.  A successful delta
+// resets the document's count.
+type deltaFailureTracker struct {
+	threshold     int
+	cooldown      time.Duration
+	disabledStat  *expvar.Int // Connections with deltas currently disabled
+	lock          sync.Mutex
+	failures      map[string]int // Consecutive failures by doc ID
+	disabledUntil time.Time      // Zero when deltas are enabled
+}
+
+// newDeltaFailureTracker returns a tracker for a connection, or nil when the threshold is zero (disabled).
+func newDeltaFailureTracker(threshold int, cooldown time.Duration, disabledStat *expvar.Int) *deltaFailureTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultDeltaFailureCooldown
+	}
+	return &deltaFailureTracker{
+		threshold:    threshold,
+		cooldown:     cooldown,
+		disabledStat: disabledStat,
+		failures:     make(map[string]int),
+	}
+}
+
+// deltasDisabled returns true while deltas are disabled for the connection, re-enabling them once the cooldown has
+// elapsed.
+func (t *deltaFailureTracker) deltasDisabled() bool {
+	if t == nil {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.disabledUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(t.disabledUntil) {
+		return true
+	}
+	t._enable()
+	return false
+}
+
+// failed records a delta failure for the document, returning true if it disabled deltas for the connection.
+func (t *deltaFailureTracker) failed(docID string) (disabled bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.failures) >= deltaFailureMaxDocs {
+		t.failures = make(map[string]int)
+	}
+	t.failures[docID]++
+	if t.failures[docID] < t.threshold || !t.disabledUntil.IsZero() {
+		return false
+	}
+	t.failures = make(map[string]int)
+	t.disabledUntil = time.Now().Add(t.cooldown)
+	t.disabledStat.Add(1)
+	return true
+}
+
+// succeeded resets the document's failure count after a delta was applied.
+func (t *deltaFailureTracker) succeeded(docID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	delete(t.failures, docID)
+	t.lock.Unlock()
+}
+
+// close re-enables deltas, so that the stat no longer counts the connection once it's closed.
+func (t *deltaFailureTracker) close() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.disabledUntil.IsZero() {
+		t._enable()
+	}
+}
+
+// deltaFailed records a failure to apply a pushed delta, warning when it disables deltas for the connection.
+func (bh *blipHandler) deltaFailed(docID, deltaSrcRevID string) {
+	if bh.deltaFailures == nil || !bh.deltaFailures.failed(docID) {
+		return
+	}
+	base.WarnfCtx(bh.blipContextDb.Ctx, "Disabling pushed deltas for user %s for %v after %d consecutive failures to apply deltas for key %s (last deltaSrc=%s) - full bodies are required until then",
+		base.UD(bh.userName), bh.deltaFailures.cooldown, bh.deltaFailures.threshold, base.UD(docID), deltaSrcRevID)
+}
+
+// Requires lock
+func (t *deltaFailureTracker) _enable() {
+	t.disabledUntil = time.Time{}
+	t.disabledStat.Add(-1)
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeltaFailureTracker verifies deltas are disabled after consecutive failures for a doc, and re-enabled after the
+// cooldown.
+func TestDeltaFailureTracker(t *testing.T) {
+	assert.Nil(t, newDeltaFailureTracker(0, time.Minute, nil))
+
+	disabledStat := &expvar.Int{}
+	tracker := newDeltaFailureTracker(2, time.Minute, disabledStat)
+
+	// Failures are counted per doc, and reset by a success
+	assert.False(t, tracker.failed("doc1"))
+	assert.False(t, tracker.failed("doc2"))
+	tracker.succeeded("doc1")
+	assert.False(t, tracker.failed("doc1"))
+	assert.False(t, tracker.deltasDisabled())
+
+	assert.True(t, tracker.failed("doc1"))
+	assert.True(t, tracker.deltasDisabled())
+	assert.Equal(t, int64(1), disabledStat.Value())
+
+	// Once the cooldown has elapsed deltas are accepted again
+	tracker.disabledUntil = time.Now().Add(-time.Second)
+	assert.False(t, tracker.deltasDisabled())
+	assert.Equal(t, int64(0), disabledStat.Value())
+
+	// Closing a disabled connection decrements the stat
+	assert.False(t, tracker.failed("doc2"))
+	assert.True(t, tracker.failed("doc2"))
+	tracker.close()
+	assert.Equal(t, int64(0), disabledStat.Value())
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// BlipStrictNumbersHeader is the header of the WebSocket upgrade request in which a client asks for strict number
+// handling in deltas, when it can't rely on integers beyond a float64's precision surviving its JSON handling.
+const BlipStrictNumbersHeader = "X-Strict-Numbers"
+
+// maxSafeInteger is the largest integer a float64 represents exactly without it also representing a neighbour.  An
+// integer beyond it may be silently rounded by clients decoding numbers as float64s.
+const maxSafeInteger = 1<<53 - 1
+
+// Clients differ in how they handle JSON numbers: some decode every number as a float64, some tell integers and
+// floats apart by whether the number has a fraction or exponent.  A delta that sets a field to 1.0 may then apply as
+// an integer on one client and a float on another, and one holding an integer beyond 2^53-1 loses precision on
+// clients decoding it as a float64.  Deltas the server generates are diffed between bodies with canonical numbers, so that an
+// integral number written with a fraction or exponent is sent as the integer it is.  A client that asks for strict
+// numbers, with the X-Strict-Numbers handshake header, is never sent a delta holding an integer beyond 2^53-1 (it's
+// sent the full body instead, which it parses whole), and has deltas it pushes holding such integers rejected, rather
+// than applied differently on different platforms.
+
+// NegotiateStrictNumbers sets whether the client asked for strict number handling in deltas, in the headers of its
+// handshake request.  Must be called before the connection handles any requests.
+func (bsc *BlipSyncContext) NegotiateStrictNumbers(headers http.Header) {
+	bsc.strictNumbers, _ = strconv.ParseBool(headers.Get(BlipStrictNumbersHeader))
+}
+
+// integralLiteral returns true if the JSON number literal has an integral value, i.e. has no nonzero digits after
+// the decimal point once its exponent is applied.
+func integralLiteral(literal string) bool {
+	mantissa, exponent := literal, 0
+	if i := strings.IndexAny(literal, "eE"); i >= 0 {
+		var err error
+		if exponent, err = strconv.Atoi(literal[i+1:]); err != nil {
+			return false
+		}
+		mantissa = literal[:i]
+	}
+	mantissa = strings.TrimPrefix(mantissa, "-")
+	point := len(mantissa)
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		point = i
+		mantissa = mantissa[:i] + mantissa[i+1:]
+	}
+	point += exponent
+	if point < 0 {
+		point = 0
+	}
+	for i := point; i < len(mantissa); i++ {
+		if mantissa[i] != '0' {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalNumber returns the canonical form of a JSON number: an integral number that fits in an int64 is written
+// as an integer, e.g. 1.0 and 1e3 as 1 and 1000, and -0 as 0.  Other numbers are kept as written, so that no
+// precision is lost.
+func canonicalNumber(number json.Number) json.Number {
+	literal := string(number)
+	if i, err := strconv.ParseInt(literal, 10, 64); err == nil {
+		return json.Number(strconv.FormatInt(i, 10))
+	}
+	// Rounding to a float64 is monotonic, so an integral literal parsing within the safe range is parsed exactly
+	if f, err := strconv.ParseFloat(literal, 64); err == nil && math.Abs(f) <= maxSafeInteger && integralLiteral(literal) {
+		return json.Number(strconv.FormatInt(int64(f), 10))
+	}
+	return number
+}
+
+// ambiguousNumber returns true if the JSON number is an integer that a client decoding numbers as float64s can't
+// represent exactly.
+func ambiguousNumber(number json.Number) bool {
+	literal := string(number)
+	if i, err := strconv.ParseInt(literal, 10, 64); err == nil {
+		return i > maxSafeInteger || i < -maxSafeInteger
+	}
+	f, err := strconv.ParseFloat(literal, 64)
+	return (err != nil || math.Abs(f) > maxSafeInteger) && integralLiteral(literal)
+}
+
+// canonicalizeNumbers replaces the numbers in an unmarshalled JSON value with their canonical forms, returning the
+// value.  Maps and slices are updated in place.
+func canonicalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		return canonicalNumber(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = canonicalizeNumbers(item)
+		}
+	case Body:
+		canonicalizeNumbers(map[string]interface{}(v))
+	case []interface{}:
+		for i, item := range v {
+			v[i] = canonicalizeNumbers(item)
+		}
+	}
+	return value
+}
+
+// firstAmbiguousNumber returns the first integer in the JSON data that a client decoding numbers as float64s can't
+// represent exactly, or an empty string if there's none, or the data isn't valid JSON.
+func firstAmbiguousNumber(data []byte) string {
+	decoder := base.JSONDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return ""
+	}
+	return string(findAmbiguousNumber(value))
+}
+
+func findAmbiguousNumber(value interface{}) json.Number {
+	switch v := value.(type) {
+	case json.Number:
+		if ambiguousNumber(v) {
+			return v
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if number := findAmbiguousNumber(item); number != "" {
+				return number
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if number := findAmbiguousNumber(item); number != "" {
+				return number
+			}
+		}
+	}
+	return ""
+}
+
+// checkStrictNumbers rejects a delta pushed by a client that asked for strict numbers when it holds an integer that
+// clients decoding numbers as float64s can't represent exactly.
+func (bh *blipHandler) checkStrictNumbers(delta []byte) error {
+	if !bh.strictNumbers {
+		return nil
+	}
+	if number := firstAmbiguousNumber(delta); number != "" {
+		bh.dbStats.StatsDeltaSync().Add(base.StatKeyAmbiguousDeltaRejected, 1)
+		return base.HTTPErrorf(http.StatusBadRequest, "Delta holds the integer %s, beyond the 2^53-1 every client can represent exactly - send the full body", number)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCanonicalNumber verifies integral numbers are written as integers, without losing precision of any number.
+func TestCanonicalNumber(t *testing.T) {
+	testCases := map[string]string{
+		"1":                    "1",
+		"-0":                   "0",
+		"1.0":                  "1",
+		"1e3":                  "1000",
+		"1.50E1":               "15",
+		"-2.000":               "-2",
+		"1.5":                  "1.5",
+		"1e-3":                 "1e-3",
+		"9007199254740993":     "9007199254740993",
+		"9.007199254740991e15": "9007199254740991",
+		"9.007199254740993e15": "9.007199254740993e15",
+		"1e300":                "1e300",
+		"12345678901234567890": "12345678901234567890",
+	}
+	for number, expected := range testCases {
+		assert.Equal(t, json.Number(expected), canonicalNumber(json.Number(number)), "canonical form of %s", number)
+	}
+}
+
+// TestAmbiguousNumbers verifies integers beyond 2^53-1 are found in deltas, however they're written.
+func TestAmbiguousNumbers(t *testing.T) {
+	for _, number := range []string{"9007199254740991", "-9007199254740991", "9.007199254740991e15", "1.5", "1e-3", "1e-300"} {
+		assert.False(t, ambiguousNumber(json.Number(number)), "%s is unambiguous", number)
+	}
+	for _, number := range []string{"9007199254740992", "-9007199254740993", "12345678901234567890", "1e300", "9.007199254740993e15"} {
+		assert.True(t, ambiguousNumber(json.Number(number)), "%s is ambiguous", number)
+	}
+
+	assert.Equal(t, "", firstAmbiguousNumber([]byte(`{"a":1,"b":[2.5,{"c":9007199254740991}]}`)))
+	assert.Equal(t, "9007199254740993", firstAmbiguousNumber([]byte(`{"a":1,"b":[2.5,{"c":9007199254740993}]}`)))
+	assert.Equal(t, "", firstAmbiguousNumber([]byte(`not json`)))
+
+	// Canonicalizing a body leaves large integers exactly as they were written
+	var body Body
+	assert.NoError(t, body.Unmarshal([]byte(`{"a":1.0,"b":[2e1,{"c":12345678901234567890}]}`)))
+	canonicalizeNumbers(body)
+	bodyBytes, err := json.Marshal(body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1,"b":[20,{"c":12345678901234567890}]}`, string(bodyBytes))
+}
+
+// TestCheckStrictNumbers verifies pushed deltas holding integers beyond 2^53-1 are only rejected for strict clients.
+func TestCheckStrictNumbers(t *testing.T) {
+	delta := []byte(`{"id":12345678901234567890}`)
+	bh := blipHandler{BlipSyncContext: &BlipSyncContext{dbStats: NewDatabaseStats()}}
+	assert.NoError(t, bh.checkStrictNumbers(delta))
+
+	bh.strictNumbers = true
+	assert.NoError(t, bh.checkStrictNumbers([]byte(`{"id":1}`)))
+	assertHTTPError(t, bh.checkStrictNumbers(delta), http.StatusBadRequest)
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(bh.dbStats.StatsDeltaSync().Get(base.StatKeyAmbiguousDeltaRejected)))
+}
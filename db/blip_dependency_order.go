@@ -0,0 +1,114 @@
+package db
+
+import (
+	"container/heap"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// maxDependencyRefsPerDoc is the most references followed from a single document when ordering by dependency.
+// Further references are ignored, so a document with more may be delivered before some of the documents it references.
+const maxDependencyRefsPerDoc = 100
+
+// collectDependencyOrderedChanges buffers every change matching a one-shot subChanges request, ordered so that each
+// document is delivered after the documents it references in the database's configured reference field (a doc ID,
+// or an array of doc IDs).  Ordering is best effort:
+//   - Only references to other documents in the same pull are followed.  Referenced documents the client already has,
+//     or can't access, don't affect the order.
+//   - If the references form a cycle, the changes are sent in sequence order instead.
+//
+// As with sortBy, the whole result set is held in memory along with each document's references, and one body read
+// is needed per change, so the number of changes is capped by BlipSyncOptions.MaxSortedChanges.
+func (bh *blipHandler) collectDependencyOrderedChanges(params *SubChangesParams) ([][]interface{}, error) {
+	referenceField := bh.db.Options.BlipSyncOptions.ReferenceField
+	if referenceField == "" {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "%s is not enabled", SubChangesDepOrder)
+	}
+	changeRows, err := bh.collectChangeRows(params, SubChangesDepOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	references := make(map[string][]string, len(changeRows))
+	for _, changeRow := range changeRows {
+		docID, revID := changeRow[1].(string), changeRow[2].(string)
+		references[docID] = bh.docReferences(docID, revID, referenceField)
+	}
+	if ordered, ok := dependencyOrder(changeRows, references); ok {
+		return ordered, nil
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "References in %q form a cycle - sending %d changes in sequence order", base.UD(referenceField), len(changeRows))
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyDependencyCycleCount, 1)
+	return changeRows, nil
+}
+
+// docReferences returns the doc IDs a revision references in the given top-level property.
+func (bh *blipHandler) docReferences(docID, revID, referenceField string) (refs []string) {
+	switch value := bh.sortValue(docID, revID, referenceField).(type) {
+	case string:
+		refs = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			if ref, ok := item.(string); ok && len(refs) < maxDependencyRefsPerDoc {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// dependencyOrder orders changes rows so that each doc comes after the docs it references, keeping sequence order
+// wherever the references allow.  Returns false if the references form a cycle.
+func dependencyOrder(changeRows [][]interface{}, references map[string][]string) ([][]interface{}, bool) {
+	indexes := make(map[string]int, len(changeRows))
+	for i, changeRow := range changeRows {
+		indexes[changeRow[1].(string)] = i
+	}
+
+	// Count each row's unsent dependencies, and which rows are waiting on each
+	pendingDeps := make([]int, len(changeRows))
+	dependents := make([][]int, len(changeRows))
+	for i, changeRow := range changeRows {
+		seen := make(map[int]bool)
+		for _, ref := range references[changeRow[1].(string)] {
+			if j, ok := indexes[ref]; ok && j != i && !seen[j] {
+				seen[j] = true
+				pendingDeps[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	ready := &rowIndexHeap{}
+	for i := range changeRows {
+		if pendingDeps[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+	ordered := make([][]interface{}, 0, len(changeRows))
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		ordered = append(ordered, changeRows[i])
+		for _, dependent := range dependents[i] {
+			if pendingDeps[dependent]--; pendingDeps[dependent] == 0 {
+				heap.Push(ready, dependent)
+			}
+		}
+	}
+	return ordered, len(ordered) == len(changeRows)
+}
+
+// rowIndexHeap is a min-heap of changes row indexes, so that ready rows are sent in sequence order.
+type rowIndexHeap []int
+
+func (h rowIndexHeap) Len() int            { return len(h) }
+func (h rowIndexHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h rowIndexHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rowIndexHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *rowIndexHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDependencyOrder verifies referenced docs are ordered first, keeping sequence order otherwise, and that cycles
+// are detected.
+func TestDependencyOrder(t *testing.T) {
+	changeRows := [][]interface{}{
+		{SequenceID{Seq: 1}, "order", "1-a"},
+		{SequenceID{Seq: 2}, "unrelated", "1-a"},
+		{SequenceID{Seq: 3}, "customer", "1-a"},
+		{SequenceID{Seq: 4}, "product", "1-a"},
+	}
+	docIDs := func(rows [][]interface{}) (ids []string) {
+		for _, row := range rows {
+			ids = append(ids, row[1].(string))
+		}
+		return ids
+	}
+
+	// References to docs outside the pull, and to the doc itself, are ignored
+	ordered, ok := dependencyOrder(changeRows, map[string][]string{
+		"order":    {"customer", "product", "missing"},
+		"customer": {"customer"},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"unrelated", "customer", "product", "order"}, docIDs(ordered))
+
+	_, ok = dependencyOrder(changeRows, map[string][]string{
+		"order":    {"customer"},
+		"customer": {"product"},
+		"product":  {"order"},
+	})
+	assert.False(t, ok)
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// For multi-tenant isolation or namespace migration, a database may replicate docs under different IDs than it
+// stores them under, with BlipSyncOptions.DocIDMapper, so that clients see namespace-relative IDs while storage uses
+// fully-qualified ones.  Stored IDs are mapped to delivered IDs in the changes, rev, norev, revChunk and revoked
+// messages sent to clients, in the responses to reconcile and purgeBatch, and in the rev send log, and docs the mapper
+// doesn't deliver aren't announced at all.  Delivered IDs are mapped back to stored IDs in the rev, changes,
+// proposeChanges, selectChanges, reconcile, purgeBatch and releaseRevs messages clients send, and in the subChanges
+// docIDs filter.  Nothing else is mapped: checkpoint client IDs aren't doc IDs, and attachments are referenced by
+// digest, so neither is affected.  Without a mapper, docs are replicated under the IDs they're stored under.
+
+// DocIDMapper maps doc IDs between the IDs docs are stored under and the IDs a user replicates them as.  Mapping a
+// stored ID to its delivered ID and back must return the stored ID.  The stored IDs of the docs a user replicates must
+// form a contiguous range, in the same order as their delivered IDs, so that a reconcile can scan a range of delivered
+// IDs by their stored IDs.
+type DocIDMapper interface {
+	// DeliveredID returns the ID the stored doc is replicated to the user as, or false if the doc is outside the
+	// user's namespace and isn't replicated to them.
+	DeliveredID(userName, storedID string) (deliveredID string, ok bool)
+
+	// StoredID returns the ID the doc the user replicates as deliveredID is stored under, or an error if the user
+	// can't replicate a doc with that ID.
+	StoredID(userName, deliveredID string) (storedID string, err error)
+}
+
+// PrefixDocIDMapper replicates the docs whose stored IDs start with a prefix under the rest of their IDs, and stores
+// the docs clients push with the prefix added.  Docs without the prefix aren't replicated.
+type PrefixDocIDMapper struct {
+	Prefix string
+}
+
+// DeliveredID strips the prefix, for stored IDs that have it.
+func (m PrefixDocIDMapper) DeliveredID(userName, storedID string) (string, bool) {
+	if !strings.HasPrefix(storedID, m.Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(storedID, m.Prefix), true
+}
+
+// StoredID adds the prefix.
+func (m PrefixDocIDMapper) StoredID(userName, deliveredID string) (string, error) {
+	if deliveredID == "" {
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Missing docID")
+	}
+	return m.Prefix + deliveredID, nil
+}
+
+// deliveredDocID returns the ID a stored doc is replicated to the client as.
+func (bsc *BlipSyncContext) deliveredDocID(storedID string) string {
+	mapper := bsc.blipContextDb.Options.BlipSyncOptions.DocIDMapper
+	if mapper == nil {
+		return storedID
+	}
+	deliveredID, _ := mapper.DeliveredID(bsc.userName, storedID)
+	return deliveredID
+}
+
+// isDelivered returns true if a stored doc is replicated to the client.
+func (bsc *BlipSyncContext) isDelivered(storedID string) bool {
+	mapper := bsc.blipContextDb.Options.BlipSyncOptions.DocIDMapper
+	if mapper == nil {
+		return true
+	}
+	_, ok := mapper.DeliveredID(bsc.userName, storedID)
+	return ok
+}
+
+// storedDocID returns the ID a doc the client replicates is stored under.
+func (bsc *BlipSyncContext) storedDocID(deliveredID string) (string, error) {
+	mapper := bsc.blipContextDb.Options.BlipSyncOptions.DocIDMapper
+	if mapper == nil {
+		return deliveredID, nil
+	}
+	return mapper.StoredID(bsc.userName, deliveredID)
+}
+
+// storedDocIDs maps the delivered doc IDs the client lists to stored IDs, in place.
+func (bsc *BlipSyncContext) storedDocIDs(docIDs []string) error {
+	for i, docID := range docIDs {
+		storedID, err := bsc.storedDocID(docID)
+		if err != nil {
+			return err
+		}
+		docIDs[i] = storedID
+	}
+	return nil
+}
+
+// storedDocIDRange maps the bounds of a range of delivered doc IDs, either of which may be empty to leave the range
+// open at that end, to stored IDs.
+func (bsc *BlipSyncContext) storedDocIDRange(after, through string) (storedAfter, storedThrough string, err error) {
+	if after != "" {
+		if storedAfter, err = bsc.storedDocID(after); err != nil {
+			return "", "", err
+		}
+	}
+	if through != "" {
+		if storedThrough, err = bsc.storedDocID(through); err != nil {
+			return "", "", err
+		}
+	}
+	return storedAfter, storedThrough, nil
+}
+
+// storedChangeIDs maps the delivered doc IDs at the given index of each of the client's changes to stored IDs, in
+// place.
+func (bsc *BlipSyncContext) storedChangeIDs(changeList [][]interface{}, index int) error {
+	if bsc.blipContextDb.Options.BlipSyncOptions.DocIDMapper == nil {
+		return nil
+	}
+	for _, change := range changeList {
+		if len(change) <= index {
+			continue
+		}
+		if deliveredID, ok := change[index].(string); ok {
+			storedID, err := bsc.storedDocID(deliveredID)
+			if err != nil {
+				return err
+			}
+			change[index] = storedID
+		}
+	}
+	return nil
+}
+
+// deliveredChangeRows returns the rows of a changes message with their stored doc IDs mapped to delivered IDs,
+// leaving the given rows, which the changes response is handled with, as they are.
+func (bsc *BlipSyncContext) deliveredChangeRows(changeArray [][]interface{}) [][]interface{} {
+	if bsc.blipContextDb.Options.BlipSyncOptions.DocIDMapper == nil {
+		return changeArray
+	}
+	delivered := make([][]interface{}, len(changeArray))
+	for i, changeRow := range changeArray {
+		delivered[i] = append([]interface{}(nil), changeRow...)
+		if storedID, ok := changeRow[1].(string); ok {
+			delivered[i][1] = bsc.deliveredDocID(storedID)
+		}
+	}
+	return delivered
+}
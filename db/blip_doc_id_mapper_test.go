@@ -0,0 +1,60 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixDocIDMapperRoundTrip(t *testing.T) {
+	mapper := PrefixDocIDMapper{Prefix: "tenant::"}
+
+	for _, deliveredID := range []string{"doc1", "tenant::doc1", "a::b", "_design"} {
+		storedID, err := mapper.StoredID("alice", deliveredID)
+		require.NoError(t, err)
+		roundTripped, ok := mapper.DeliveredID("alice", storedID)
+		assert.True(t, ok)
+		assert.Equal(t, deliveredID, roundTripped)
+	}
+
+	_, ok := mapper.DeliveredID("alice", "other::doc1")
+	assert.False(t, ok)
+
+	_, err := mapper.StoredID("alice", "")
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+// TestDocIDMapperChangeRows verifies changes are announced under delivered IDs, and client changes are mapped back.
+func TestDocIDMapperChangeRows(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	change := func(docID string) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: 5}, ID: docID, Changes: []ChangeRev{{"rev": "1-a"}}}
+	}
+
+	// Identity by default
+	rows := bh.changeRows(change("other::doc1"))
+	require.Len(t, rows, 1)
+	assert.Equal(t, rows, bh.deliveredChangeRows(rows))
+
+	db.Options.BlipSyncOptions.DocIDMapper = PrefixDocIDMapper{Prefix: "tenant::"}
+	assert.Empty(t, bh.changeRows(change("other::doc1")))
+
+	rows = bh.changeRows(change("tenant::doc1"))
+	require.Len(t, rows, 1)
+	delivered := bh.deliveredChangeRows(rows)
+	assert.Equal(t, "doc1", delivered[0][1])
+	assert.Equal(t, "tenant::doc1", rows[0][1], "Rows the changes response is handled with shouldn't be mapped")
+
+	clientChanges := [][]interface{}{{"doc1", "1-a"}, {"doc2", "1-b"}}
+	require.NoError(t, bh.storedChangeIDs(clientChanges, 0))
+	assert.Equal(t, "tenant::doc1", clientChanges[0][0])
+	assert.Equal(t, "tenant::doc2", clientChanges[1][0])
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// DefaultDocSummaryCacheSize is the number of summaries cached when DocSummaries.CacheSize isn't set.
+	DefaultDocSummaryCacheSize = 1000
+
+	// DocSummaryAnyType keys the summary fields of docs whose type has no fields of its own.
+	DocSummaryAnyType = "*"
+
+	// BodySummary is the property of a summary body holding its computed metadata.  Being reserved, it also stops a
+	// summary a client mistakenly pushes back from being written, unless reserved fields are stripped.
+	BodySummary = "_summary"
+)
+
+// DocSummaries configures the summaries sent in place of full bodies to clients that pull with subChanges' 'summaries'
+// property, e.g. list or search clients that only display a few fields of each doc.  A summary holds the top-level
+// fields configured for the doc's type, as identified by TypeProperty, along with computed metadata under _summary:
+// the length of the full body and its number of attachments.  Docs of a type without fields of its own use those of
+// DocSummaryAnyType, or are summarised by their metadata alone.
+type DocSummaries struct {
+	TypeProperty string              `json:"type_property,omitempty"` // Top-level body property identifying a doc's type (defaults to "type")
+	Fields       map[string][]string `json:"fields,omitempty"`        // Top-level fields included in the summaries of each type of doc, keyed by type
+	CacheSize    int                 `json:"cache_size,omitempty"`    // Number of summaries cached (defaults to DefaultDocSummaryCacheSize)
+}
+
+// SummaryMetadata is the metadata computed for a doc summary.
+type SummaryMetadata struct {
+	BodyLength      int `json:"bodyLength"`
+	AttachmentCount int `json:"attachmentCount"`
+}
+
+// docSummarizer computes doc summaries, caching them by doc and rev so that a rev pulled by many clients at once is
+// only summarised once.  Summaries are only ever computed from revs the requesting client has been allowed to read.
+type docSummarizer struct {
+	typeProperty string
+	fields       map[string][]string
+	lock         sync.Mutex // base.LRUCache doesn't synchronise Put with Get
+	cache        *base.LRUCache
+}
+
+// newDocSummarizer returns the summarizer for the database's summary configuration, or nil if summaries aren't
+// configured.
+func newDocSummarizer(summaries *DocSummaries) (*docSummarizer, error) {
+	if summaries == nil {
+		return nil, nil
+	}
+	for docType, fields := range summaries.Fields {
+		for _, field := range fields {
+			if field == "" || field[0] == '_' {
+				return nil, fmt.Errorf("invalid summary field %q for type %q: fields must be non-empty and not start with an underscore", field, docType)
+			}
+		}
+	}
+	typeProperty := summaries.TypeProperty
+	if typeProperty == "" {
+		typeProperty = DefaultDeltaTemplateProperty
+	}
+	cacheSize := summaries.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultDocSummaryCacheSize
+	}
+	cache, err := base.NewLRUCache(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &docSummarizer{
+		typeProperty: typeProperty,
+		fields:       summaries.Fields,
+		cache:        cache,
+	}, nil
+}
+
+// summary returns the summary of a rev, and whether it was cached.
+func (s *docSummarizer) summary(rev DocumentRevision) (summary []byte, cached bool, err error) {
+	// Rev IDs never contain a slash, so the key is unambiguous whatever the doc ID
+	key := rev.RevID + "/" + rev.DocID
+	s.lock.Lock()
+	value, found := s.cache.Get(key)
+	s.lock.Unlock()
+	if found {
+		return value.([]byte), true, nil
+	}
+
+	var body map[string]interface{}
+	if err := base.JSONUnmarshal(rev.BodyBytes, &body); err != nil {
+		return nil, false, err
+	}
+	fields := s.fields[DocSummaryAnyType]
+	if docType, isString := body[s.typeProperty].(string); isString {
+		if typeFields, found := s.fields[docType]; found {
+			fields = typeFields
+		}
+	}
+	result := make(map[string]interface{}, len(fields)+1)
+	for _, field := range fields {
+		if value, found := body[field]; found {
+			result[field] = value
+		}
+	}
+	result[BodySummary] = SummaryMetadata{
+		BodyLength:      len(rev.BodyBytes),
+		AttachmentCount: len(rev.Attachments),
+	}
+	if summary, err = base.JSONMarshalCanonical(result); err != nil {
+		return nil, false, err
+	}
+
+	s.lock.Lock()
+	s.cache.Put(key, summary)
+	s.lock.Unlock()
+	return summary, false, nil
+}
+
+// sendRevSummary sends a rev the client has been allowed to read with the summary of its body in place of the full
+// body, flagged with the 'summary' property so that the client knows not to push it back.  Summaries are never sent
+// as deltas, and carry no attachments for the client to fetch.
+func (bsc *BlipSyncContext) sendRevSummary(sender *blip.Sender, rev DocumentRevision, seq SequenceID, knownRevs map[string]bool, maxHistory int, handleChangesResponseDb *Database) error {
+	summary, cached, err := handleChangesResponseDb.docSummaries.summary(rev)
+	if err != nil {
+		return bsc.sendNoRev(sender, rev.DocID, rev.RevID, err)
+	}
+	if cached {
+		bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevSummaryCacheHits, 1)
+	}
+	bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevSummariesSent, 1)
+
+	properties := blipRevMessageProperties(toHistory(rev.History, knownRevs, maxHistory), rev.Deleted, seq)
+	properties[RevMessageSummary] = "true"
+	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Sending summary of rev %q %s based on %d known", base.UD(rev.DocID), rev.RevID, len(knownRevs))
+	return bsc.sendRevisionWithProperties(sender, rev.DocID, rev.RevID, summary, nil, properties)
+}
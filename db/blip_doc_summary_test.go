@@ -0,0 +1,44 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocSummarizer(t *testing.T) {
+	summarizer, err := newDocSummarizer(nil)
+	require.NoError(t, err)
+	assert.Nil(t, summarizer)
+
+	_, err = newDocSummarizer(&DocSummaries{Fields: map[string][]string{"task": {"_rev"}}})
+	assert.Error(t, err)
+
+	summarizer, err = newDocSummarizer(&DocSummaries{
+		TypeProperty: "kind",
+		Fields:       map[string][]string{"task": {"title", "due"}, DocSummaryAnyType: {"name"}},
+	})
+	require.NoError(t, err)
+
+	task := DocumentRevision{DocID: "task1", RevID: "1-a", BodyBytes: []byte(`{"kind":"task","title":"Buy milk","notes":"Semi-skimmed"}`),
+		Attachments: AttachmentsMeta{"receipt": map[string]interface{}{}}}
+	summary, cached, err := summarizer.summary(task)
+	require.NoError(t, err)
+	assert.False(t, cached)
+	assert.Equal(t, `{"_summary":{"bodyLength":57,"attachmentCount":1},"title":"Buy milk"}`, string(summary))
+
+	// The same rev is summarised once
+	summary, cached, err = summarizer.summary(task)
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, `{"_summary":{"bodyLength":57,"attachmentCount":1},"title":"Buy milk"}`, string(summary))
+
+	// Docs of other types, or without a type, use the fields for any type
+	summary, _, err = summarizer.summary(DocumentRevision{DocID: "contact1", RevID: "1-a", BodyBytes: []byte(`{"kind":"contact","name":"Alice"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, `{"_summary":{"bodyLength":33,"attachmentCount":0},"name":"Alice"}`, string(summary))
+	summary, _, err = summarizer.summary(DocumentRevision{DocID: "note1", RevID: "1-a", BodyBytes: []byte(`{"text":"Hello"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, `{"_summary":{"bodyLength":16,"attachmentCount":0}}`, string(summary))
+}
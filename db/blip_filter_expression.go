@@ -0,0 +1,344 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// Budget for sync_gateway/byexpression filters.  Expressions have no loops or function calls, so evaluation cost
+	// per change is bounded by the number of nodes.
+	maxFilterExpressionLength = 1024
+	maxFilterExpressionNodes  = 64
+	maxFilterExpressionDepth  = 16
+)
+
+// filterExpression is a parsed sync_gateway/byexpression filter.  The language is deliberately minimal: 'doc.'
+// property paths into the revision body, string, number, boolean and null literals, the comparison operators
+// == != < <= > >=, the logical operators && || !, and parentheses.  For example:
+//
+//	doc.priority > 5 && doc.region == 'us'
+//
+// A change is sent if the expression evaluates to true.  The expression only reads the body of revisions the user
+// can already access, so it can't reveal anything the user couldn't read anyway: tombstones and the removals of docs
+// from the user's channels are always sent without being evaluated.
+type filterExpression struct {
+	root exprNode
+}
+
+type exprNode interface {
+	eval(body Body) interface{}
+}
+
+type exprLiteral struct{ value interface{} }
+
+type exprPath struct{ path []string }
+
+type exprNot struct{ operand exprNode }
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n exprLiteral) eval(body Body) interface{} { return n.value }
+
+func (n exprPath) eval(body Body) interface{} {
+	var value interface{} = map[string]interface{}(body)
+	for _, property := range n.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[property]
+	}
+	if number, ok := value.(json.Number); ok {
+		if f, err := number.Float64(); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+func (n exprNot) eval(body Body) interface{} { return n.operand.eval(body) != true }
+
+func (n exprBinary) eval(body Body) interface{} {
+	switch n.op {
+	case "&&":
+		return n.left.eval(body) == true && n.right.eval(body) == true
+	case "||":
+		return n.left.eval(body) == true || n.right.eval(body) == true
+	}
+
+	left, right := n.left.eval(body), n.right.eval(body)
+	switch n.op {
+	case "==":
+		return isComparableScalar(left) && isComparableScalar(right) && left == right
+	case "!=":
+		return !(isComparableScalar(left) && isComparableScalar(right) && left == right)
+	}
+
+	// Ordering is only defined between two numbers or two strings
+	rank := sortValueRank(left)
+	if rank != sortValueRank(right) || (rank != 2 && rank != 3) {
+		return false
+	}
+	cmp := compareSortValues(left, right)
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// isComparableScalar returns true for values that can be compared with ==, i.e. not arrays or objects.
+func isComparableScalar(value interface{}) bool {
+	return sortValueRank(value) < 4
+}
+
+// matches returns true if the expression evaluates to true for the given revision body.
+func (e *filterExpression) matches(body Body) bool {
+	return e.root.eval(body) == true
+}
+
+// parseFilterExpression parses a sync_gateway/byexpression filter, rejecting it if it exceeds the complexity budget.
+func parseFilterExpression(src string) (*filterExpression, error) {
+	if len(src) > maxFilterExpressionLength {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Filter expression exceeds %d characters", maxFilterExpressionLength)
+	}
+	tokens, err := tokenizeFilterExpression(src)
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid filter expression: %v", err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid filter expression: %v", err)
+	}
+	return &filterExpression{root: root}, nil
+}
+
+type exprTokenKind int
+
+const (
+	exprTokenOperator exprTokenKind = iota
+	exprTokenIdentifier
+	exprTokenNumber
+	exprTokenString
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenizeFilterExpression(src string) (tokens []exprToken, err error) {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: sb.String()})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i + 1
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenNumber, text: src[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenIdentifier, text: src[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{kind: exprTokenOperator, text: op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser for filter expressions, which counts nodes and nesting depth so that
+// expressions over budget are rejected.
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	nodes  int
+}
+
+func (p *exprParser) peekOperator(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != exprTokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) node(n exprNode) (exprNode, error) {
+	p.nodes++
+	if p.nodes > maxFilterExpressionNodes {
+		return nil, fmt.Errorf("more than %d terms", maxFilterExpressionNodes)
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseBinary(depth int, ops []string, parseOperand func(int) (exprNode, error)) (exprNode, error) {
+	left, err := parseOperand(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOperator(ops...)
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := parseOperand(depth)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(exprBinary{op: op, left: left, right: right}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseOr(depth int) (exprNode, error) {
+	if depth > maxFilterExpressionDepth {
+		return nil, fmt.Errorf("nested more than %d levels", maxFilterExpressionDepth)
+	}
+	return p.parseBinary(depth, []string{"||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd(depth int) (exprNode, error) {
+	return p.parseBinary(depth, []string{"&&"}, p.parseNot)
+}
+
+func (p *exprParser) parseNot(depth int) (exprNode, error) {
+	if depth > maxFilterExpressionDepth {
+		return nil, fmt.Errorf("nested more than %d levels", maxFilterExpressionDepth)
+	}
+	if _, ok := p.peekOperator("!"); ok {
+		p.pos++
+		operand, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(exprNot{operand: operand})
+	}
+	return p.parseComparison(depth)
+}
+
+func (p *exprParser) parseComparison(depth int) (exprNode, error) {
+	left, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOperator("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	return p.node(exprBinary{op: op, left: left, right: right})
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	if depth > maxFilterExpressionDepth {
+		return nil, fmt.Errorf("nested more than %d levels", maxFilterExpressionDepth)
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case exprTokenString:
+		return p.node(exprLiteral{value: token.text})
+	case exprTokenNumber:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		return p.node(exprLiteral{value: value})
+	case exprTokenIdentifier:
+		switch token.text {
+		case "true":
+			return p.node(exprLiteral{value: true})
+		case "false":
+			return p.node(exprLiteral{value: false})
+		case "null":
+			return p.node(exprLiteral{value: nil})
+		}
+		path := strings.Split(token.text, ".")
+		if len(path) < 2 || path[0] != "doc" {
+			return nil, fmt.Errorf("unknown identifier %q - properties must be referenced as doc.<property>", token.text)
+		}
+		for _, property := range path[1:] {
+			if property == "" {
+				return nil, fmt.Errorf("invalid property path %q", token.text)
+			}
+		}
+		return p.node(exprPath{path: path[1:]})
+	}
+	if token.text == "(" {
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOperator(")"); !ok {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFilterExpressionMatches verifies evaluation of sync_gateway/byexpression filters against revision bodies.
+func TestFilterExpressionMatches(t *testing.T) {
+	body := unjson(`{"priority": 7, "region": "us", "active": true, "address": {"city": "Paris"}, "tags": ["a"]}`)
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{`doc.priority > 5 && doc.region == 'us'`, true},
+		{`doc.priority > 7`, false},
+		{`doc.priority >= 7 && doc.priority <= 7.0`, true},
+		{`doc.region == "eu" || doc.address.city == 'Paris'`, true},
+		{`!(doc.region == 'us')`, false},
+		{`doc.active`, true},
+		{`!doc.missing`, true},
+		{`doc.missing == null`, true},
+		{`doc.missing.nested == null`, true},
+		{`doc.region < 5`, false},
+		{`doc.tags == doc.tags`, false},
+		{`doc.tags != 'a'`, true},
+		{`doc.priority > -1 && (doc.region != 'eu' && (doc.active == true))`, true},
+		{`'it\'s' == "it's"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			expression, err := parseFilterExpression(tt.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, expression.matches(body))
+		})
+	}
+}
+
+// TestFilterExpressionRejected verifies invalid expressions, and expressions over the complexity budget, are rejected.
+func TestFilterExpressionRejected(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`doc.priority >`,
+		`priority > 5`,
+		`doc.region == 'us`,
+		`(doc.active`,
+		`doc.active)`,
+		`doc.a = 1`,
+		`doc..a == 1`,
+		`doc.a == 1 doc.b == 2`,
+		strings.Repeat("(", maxFilterExpressionDepth+1) + "doc.a" + strings.Repeat(")", maxFilterExpressionDepth+1),
+		strings.Repeat("!", maxFilterExpressionDepth+1) + "doc.a",
+		strings.Repeat("doc.a || ", maxFilterExpressionNodes) + "doc.a",
+		`doc.a == '` + strings.Repeat("x", maxFilterExpressionLength) + `'`,
+	} {
+		_, err := parseFilterExpression(expression)
+		assert.Error(t, err, "Expected %q to be rejected", expression)
+	}
+}
+
+// TestFilterExpressionSkipsRemovals verifies removals are sent without evaluating filters on the body of the doc the
+// user has lost access to.
+func TestFilterExpressionSkipsRemovals(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	revID, _, err := db.Put("doc1", Body{"priority": 1})
+	require.NoError(t, err)
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	bh.filterExpression, err = parseFilterExpression(`doc.priority > 5`)
+	require.NoError(t, err)
+	change := func(removal bool) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: 5}, ID: "doc1", Changes: []ChangeRev{{"rev": revID}}, allRemoved: removal}
+	}
+	assert.Empty(t, bh.changeRows(change(false)))
+	assert.Len(t, bh.changeRows(change(true)), 1)
+
+	// Likewise for the doc size range
+	bh.filterExpression = nil
+	bh.minDocSize = 1000
+	assert.Empty(t, bh.changeRows(change(false)))
+	assert.Len(t, bh.changeRows(change(true)), 1)
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Received a "flushChanges" request, i.e. a client that wants changes the running subscription has buffered for its
+// next changes message sent straight away, rather than once the batch fills, e.g. to prioritize freshness after
+// reconnecting.  It's only a hint: the feed flushes when it next handles changes read from the feed, and a caught-up
+// feed has nothing buffered, as it sends each change as it arrives.  The response's 'active' property is true when a
+// subscription was running to take the request.
+func (bh *blipHandler) handleFlushChanges(rq *blip.Message) error {
+	bh.logEndpointEntry(rq.Profile(), "")
+	active := bh.activeSubChanges.IsTrue()
+	if active {
+		// A request already waiting for the feed covers this one too
+		select {
+		case bh.flushRequests <- struct{}{}:
+		default:
+		}
+	}
+	rq.Response().Properties[FlushChangesActive] = strconv.FormatBool(active)
+	return nil
+}
+
+// takeFlushRequest returns true, once, when the client has asked for the subscription's buffered changes to be
+// flushed since the last call.  Each request taken is counted as a forced flush.
+func (bh *blipHandler) takeFlushRequest() bool {
+	select {
+	case <-bh.flushRequests:
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyChangesFlushCount, 1)
+		return true
+	default:
+		return false
+	}
+}
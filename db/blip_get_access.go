@@ -0,0 +1,71 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// AccessBody is the response body of a getAccess request: a user's current channels and roles.  As in accessChanged
+// messages, channels are the user's effective channels, including those inherited from roles, less any in the BLIP
+// channel denylist, which can't be replicated regardless of access.
+type AccessBody struct {
+	Name     string   `json:"name"`
+	Channels []string `json:"channels"`
+	Roles    []string `json:"roles"`
+}
+
+// newAccessBody returns a user's current access, excluding the given denied channels.
+func newAccessBody(user auth.User, deniedChannels base.Set) *AccessBody {
+	return &AccessBody{
+		Name:     user.Name(),
+		Channels: sortedAccessNames(user.InheritedChannels(), deniedChannels),
+		Roles:    sortedAccessNames(user.RoleNames(), nil),
+	}
+}
+
+// sortedAccessNames returns the sorted names in a set, excluding any in the given exclusions.
+func sortedAccessNames(set channels.TimedSet, excluded base.Set) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		if !excluded.Contains(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Received a "getAccess" request, i.e. a client checking the channels and roles its user currently has, e.g. to
+// validate its access state after reconnecting.  Like other user requests, it's handled after refreshing the user if
+// its access has changed, so it reflects the same access as the changes feed.  A user may only query its own access:
+// a 'user' property naming another user is refused.  Admin connections, which have no access of their own, must name
+// the user to query on behalf of.
+func (bh *blipHandler) handleGetAccess(rq *blip.Message) error {
+	name, named := rq.Properties[GetAccessUser]
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("User:%s", base.UD(name).Redact()))
+
+	user := bh.db.User()
+	if user != nil {
+		if named && name != user.Name() {
+			return base.HTTPErrorf(http.StatusForbidden, "Users may only query their own access")
+		}
+	} else {
+		if !named || name == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Admin connections must name the user to query with '%s'", GetAccessUser)
+		}
+		var err error
+		if user, err = bh.db.Authenticator().GetUser(name); err != nil {
+			return err
+		} else if user == nil {
+			return base.HTTPErrorf(http.StatusNotFound, "No such user")
+		}
+	}
+
+	return rq.Response().SetJSONBody(newAccessBody(user, bh.db.Options.BlipSyncOptions.DeniedChannels))
+}
@@ -2,10 +2,15 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -16,22 +21,51 @@ import (
 	"github.com/couchbase/sync_gateway/channels"
 )
 
+const (
+	checkpointOwner     = "_sgOwner" // Checkpoint property holding the name of the user that set it
+	checkpointRemoteSeq = "remote"   // Checkpoint property holding the client's position in the server's changes feed
+	checkpointOpaque    = "_sgBody"  // Checkpoint property holding the body of an opaque checkpoint, base64 encoded
+
+	// maxBatchedCheckpoints is the most checkpoints a getCheckpoints request may fetch
+	maxBatchedCheckpoints = 1000
+
+	// maxReleasedRevs is the most revisions a releaseRevs request may release
+	maxReleasedRevs = 1000
+)
+
 // kHandlersByProfile defines the routes for each message profile (verb) of an incoming request to the function that handles it.
 var kHandlersByProfile = map[string]blipHandlerFunc{
 	MessageGetCheckpoint:  (*blipHandler).handleGetCheckpoint,
 	MessageSetCheckpoint:  (*blipHandler).handleSetCheckpoint,
+	MessageGetCheckpoints: (*blipHandler).handleGetCheckpoints,
+	MessageDelCheckpoint:  (*blipHandler).handleDeleteCheckpoint,
 	MessageSubChanges:     userBlipHandler((*blipHandler).handleSubChanges),
 	MessageChanges:        userBlipHandler((*blipHandler).handleChanges),
 	MessageRev:            userBlipHandler((*blipHandler).handleRev),
 	MessageNoRev:          (*blipHandler).handleNoRev,
 	MessageGetAttachment:  userBlipHandler((*blipHandler).handleGetAttachment),
 	MessageProposeChanges: (*blipHandler).handleProposeChanges,
+	MessageReleaseRevs:    (*blipHandler).handleReleaseRevs,
+	MessageSelectChanges:  (*blipHandler).handleSelectChanges,
+	MessageGetRevSendLog:  (*blipHandler).handleGetRevSendLog,
+	MessageCompactStatus:  (*blipHandler).handleGetCompactionStatus,
+	MessageStartCompact:   (*blipHandler).handleStartCompaction,
+	MessageCapabilities:   (*blipHandler).handleGetCapabilities,
+	MessageVerifyCheckpt:  (*blipHandler).handleVerifyCheckpoint,
+	MessageCollectAtts:    (*blipHandler).handleCollectAttachments,
+	MessageReconcile:      userBlipHandler((*blipHandler).handleReconcile),
+	MessagePurgeBatch:     userBlipHandler((*blipHandler).handlePurgeBatch),
+	MessageGetAccess:      userBlipHandler((*blipHandler).handleGetAccess),
+	MessageFlushChanges:   (*blipHandler).handleFlushChanges,
+	MessageGetRev:         userBlipHandler((*blipHandler).handleGetRev),
 }
 
 type blipHandler struct {
 	*BlipSyncContext
-	db           *Database // Handler-specific copy of the BlipSyncContext's blipContextDb
-	serialNumber uint64    // This blip handler's serial number to differentiate logs w/ other handlers
+	db           *Database       // Handler-specific copy of the BlipSyncContext's blipContextDb
+	serialNumber uint64          // This blip handler's serial number to differentiate logs w/ other handlers
+	ctx          context.Context // Request context, cancelled when a client-supplied deadline elapses
+	traceCtx     context.Context // Context carrying the handler's span, the parent of any spans it starts
 }
 
 type blipHandlerFunc func(*blipHandler, *blip.Message) error
@@ -62,6 +96,9 @@ func (bh *blipHandler) refreshUser() error {
 		userChanged := bc.userChangeWaiter.RefreshUserCount()
 
 		// If changed, refresh the user and db while holding the lock
+		var accessChanged *AccessChangedBody
+		var revokedChannels []string
+		accessChangedSender, revocationSender := bc.accessChangedSender, bc.revocationSender
 		if userChanged {
 			// Refresh the BlipSyncContext database
 			newUser, err := bc.blipContextDb.Authenticator().GetUser(bc.userName)
@@ -69,13 +106,27 @@ func (bh *blipHandler) refreshUser() error {
 				bc.dbUserLock.Unlock()
 				return err
 			}
+			if oldUser := bc.blipContextDb.User(); accessChangedSender != nil && oldUser != nil && newUser != nil {
+				accessChanged = newAccessChangedBody(oldUser, newUser, bc.blipContextDb.Options.BlipSyncOptions.DeniedChannels)
+			}
+			if oldUser := bc.blipContextDb.User(); revocationSender != nil && oldUser != nil && newUser != nil {
+				revokedChannels = bc.revokedChannels(oldUser, newUser)
+			}
 			bc.userChangeWaiter.RefreshUserKeys(newUser)
 			bc.blipContextDb.SetUser(newUser)
+			bc.reexpandChannelPatterns(newUser)
 
 			// refresh the handler's database with the new BlipSyncContext database
 			bh.db = bh._copyContextDatabase()
 		}
 		bc.dbUserLock.Unlock()
+
+		if accessChanged != nil {
+			bc.sendAccessChanged(accessChangedSender, accessChanged)
+		}
+		if len(revokedChannels) > 0 {
+			bh.sendRevocations(revocationSender, revokedChannels)
+		}
 	}
 	return nil
 }
@@ -88,28 +139,100 @@ func (bh *blipHandler) handleGetCheckpoint(rq *blip.Message) error {
 	client := rq.Properties[BlipClient]
 	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Client:%s", client))
 
-	docID := fmt.Sprintf("checkpoint/%s", client)
 	response := rq.Response()
 	if response == nil {
 		return nil
 	}
 
-	value, err := bh.db.GetSpecial("local", docID)
+	checkpoint, err := bh.loadCheckpoint(client)
 	if err != nil {
 		return err
 	}
-	if value == nil {
-		return base.HTTPErrorf(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	response.Properties[GetCheckpointResponseRev] = checkpoint.Rev
+
+	if rq.Properties[GetCheckpointOpaque] == "true" {
+		response.Properties[GetCheckpointOpaque] = "true"
+		if checkpoint.Opaque == nil {
+			// A checkpoint set as JSON is returned as its JSON bytes, so clients can migrate to opaque checkpoints
+			setJSONBodyBytes(response, checkpoint.Body)
+			return nil
+		}
+		response.SetBody(checkpoint.Opaque)
+		return nil
+	} else if checkpoint.Opaque != nil {
+		return base.HTTPErrorf(http.StatusNotAcceptable, "Checkpoint is opaque, and must be requested with '%s'", GetCheckpointOpaque)
 	}
-	response.Properties[GetCheckpointResponseRev] = value[BodyRev].(string)
-	delete(value, BodyRev)
-	delete(value, BodyId)
-	// TODO: Marshaling here when we could use raw bytes all the way from the bucket
-	_ = response.SetJSONBody(value)
+
+	setJSONBodyBytes(response, checkpoint.Body)
 	return nil
 }
 
-// Received a "setCheckpoint" request
+// Received a "getCheckpoints" request, i.e. a client restarting several replications fetching their checkpoints at
+// once.  The body is a JSON array of client IDs, and the response body an array of their checkpoints in the same
+// order, without the clients that have no checkpoint.
+func (bh *blipHandler) handleGetCheckpoints(rq *blip.Message) error {
+	var clients []string
+	if err := rq.ReadJSONBody(&clients); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "getCheckpoints body must be an array of client IDs: %v", err)
+	}
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Clients:%d", len(clients)))
+	if len(clients) > maxBatchedCheckpoints {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "getCheckpoints may fetch at most %d checkpoints", maxBatchedCheckpoints)
+	}
+
+	response := rq.Response()
+	if response == nil {
+		return nil
+	}
+	checkpoints := make([]BatchedCheckpoint, 0, len(clients))
+	for _, client := range clients {
+		checkpoint, err := bh.loadCheckpoint(client)
+		if err != nil {
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+		checkpoints = append(checkpoints, *checkpoint)
+	}
+	return response.SetJSONBody(checkpoints)
+}
+
+// loadCheckpoint returns a client's checkpoint without its special properties, straight from the bucket's bytes rather
+// than round-tripping it through a Body.  A client without a checkpoint is a not found error.
+func (bh *blipHandler) loadCheckpoint(client string) (*BatchedCheckpoint, error) {
+	rawBody, rev, err := bh.db.GetSpecialBytes("local", fmt.Sprintf("checkpoint/%s", client))
+	if err != nil {
+		return nil, err
+	}
+	body, properties, err := base.StripJSONProperties(rawBody, BodyId, checkpointOwner, checkpointOpaque)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &BatchedCheckpoint{Client: client, Rev: rev}
+	if rawOpaqueBody, isOpaque := properties[checkpointOpaque]; isOpaque {
+		var opaqueBody string
+		if err := base.JSONUnmarshal(rawOpaqueBody, &opaqueBody); err != nil {
+			return nil, err
+		}
+		if checkpoint.Opaque, err = base64.StdEncoding.DecodeString(opaqueBody); err != nil {
+			return nil, err
+		}
+	} else {
+		checkpoint.Body = body
+	}
+	return checkpoint, nil
+}
+
+// setJSONBodyBytes sets a message's body to bytes that are already JSON, as SetJSONBody does for a value.
+func setJSONBodyBytes(msg *blip.Message, body []byte) {
+	msg.SetBody(body)
+	msg.Properties["Content-Type"] = "application/json"
+}
+
+// Received a "setCheckpoint" request.  The rev must be the checkpoint's current rev, so that replicators sharing a
+// client ID can't silently overwrite each other's checkpoints: a stale rev is rejected with a 409, whose
+// 'existingRev' property is the current rev for the client to re-read.
 func (bh *blipHandler) handleSetCheckpoint(rq *blip.Message) error {
 
 	checkpointMessage := SetCheckpointMessage{rq}
@@ -118,13 +241,26 @@ func (bh *blipHandler) handleSetCheckpoint(rq *blip.Message) error {
 	docID := fmt.Sprintf("checkpoint/%s", checkpointMessage.client())
 
 	var checkpoint Body
-	if err := checkpointMessage.ReadJSONBody(&checkpoint); err != nil {
-		return err
-	}
-	if revID := checkpointMessage.rev(); revID != "" {
-		checkpoint[BodyRev] = revID
+	matchRev := checkpointMessage.rev()
+	if checkpointMessage.opaque() {
+		// Opaque checkpoints are stored without being parsed, so can't be verified with verifyCheckpoint
+		opaqueBody, err := checkpointMessage.Body()
+		if err != nil {
+			return err
+		}
+		checkpoint = Body{checkpointOpaque: opaqueBody}
+	} else {
+		if err := checkpointMessage.ReadJSONBody(&checkpoint); err != nil {
+			return err
+		}
+		if matchRev == "" {
+			matchRev, _ = checkpoint[BodyRev].(string)
+		}
+		checkpoint, _ = stripAllSpecialProperties(checkpoint)
 	}
-	revID, err := bh.db.PutSpecial("local", docID, checkpoint)
+	// Record the user that set the checkpoint, so that only that user can verify it
+	checkpoint[checkpointOwner] = bh.userName
+	revID, err := bh.db.putSpecial("local", docID, matchRev, checkpoint)
 	if err != nil {
 		return err
 	}
@@ -135,53 +271,340 @@ func (bh *blipHandler) handleSetCheckpoint(rq *blip.Message) error {
 	return nil
 }
 
+// Received a "deleteCheckpoint" request, i.e. a client cleaning up the checkpoint of a finished one-shot replication.
+// As with setCheckpoint, the rev must be the checkpoint's current rev, or the request is rejected with a 409 whose
+// 'existingRev' property is the current rev.  A client may only delete a checkpoint set by its own user.
+func (bh *blipHandler) handleDeleteCheckpoint(rq *blip.Message) error {
+	client := rq.Properties[DeleteCheckpointClient]
+	rev := rq.Properties[DeleteCheckpointRev]
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Client:%s Rev:%s", client, rev))
+	if client == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing '%s'", DeleteCheckpointClient)
+	}
+
+	docID := fmt.Sprintf("checkpoint/%s", client)
+	value, err := bh.db.GetSpecial("local", docID)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return base.HTTPErrorf(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+	if owner, ok := value[checkpointOwner].(string); bh.db.User() != nil && (!ok || owner != bh.userName) {
+		return base.HTTPErrorf(http.StatusForbidden, "Checkpoint wasn't set by this user")
+	}
+
+	// The rev is checked again as the checkpoint is deleted, in case it was set since
+	return bh.db.DeleteSpecial("local", docID, rev)
+}
+
+// Received a "verifyCheckpoint" request, i.e. a reconnecting client checking that the server's stored checkpoint has
+// the remote sequence it expects before it resumes with subChanges.  The response's 'match' property is "true" if
+// it does, and otherwise the stored sequence is returned in the 'sequence' property.  A client may only verify a
+// checkpoint set by its own user, so checkpoints set before owners were recorded can only be verified by an admin
+// until they're next set.
+func (bh *blipHandler) handleVerifyCheckpoint(rq *blip.Message) error {
+	client := rq.Properties[VerifyCheckpointClient]
+	expectedSeq := base.ConvertJSONString(rq.Properties[VerifyCheckpointSeq])
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Client:%s Sequence:%s", client, expectedSeq))
+	if client == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing '%s'", VerifyCheckpointClient)
+	}
+
+	value, err := bh.db.GetSpecial("local", fmt.Sprintf("checkpoint/%s", client))
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return base.HTTPErrorf(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+	if owner, ok := value[checkpointOwner].(string); bh.db.User() != nil && (!ok || owner != bh.userName) {
+		return base.HTTPErrorf(http.StatusForbidden, "Checkpoint wasn't set by this user")
+	}
+
+	var storedSeq string
+	if remote, ok := value[checkpointRemoteSeq]; ok {
+		remoteJSON, err := base.JSONMarshal(remote)
+		if err != nil {
+			return err
+		}
+		storedSeq = base.ConvertJSONString(string(remoteJSON))
+	}
+	response := rq.Response()
+	if storedSeq == expectedSeq {
+		response.Properties[VerifyCheckpointMatch] = "true"
+		return nil
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Checkpoint for client %s is at sequence %s, not the client's expected %s", base.UD(client), storedSeq, expectedSeq)
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyCheckpointMismatchCount, 1)
+	response.Properties[VerifyCheckpointMatch] = "false"
+	response.Properties[VerifyCheckpointSeq] = storedSeq
+	return nil
+}
+
 //////// CHANGES
 
 // Received a "subChanges" subscription request
 func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 
+	if err := bh.db.admission.admit(); err != nil {
+		return err
+	}
+
+	// Hold the subscription back until the change cache has the client's recent writes, when it asks, before taking
+	// the lock so that the connection's other requests aren't held up meanwhile
+	if err := bh.waitForSequenceBarrier(rq); err != nil {
+		return err
+	}
+
 	bh.lock.Lock()
-	defer bh.lock.Unlock()
+	locked := true
+	defer func() {
+		if locked {
+			bh.lock.Unlock()
+		}
+	}()
 
 	bh.gotSubChanges = true
 
 	logCtx := bh.BlipSyncContext.blipContextDb.Ctx
-	subChangesParams, err := NewSubChangesParams(logCtx, rq, bh.db.CreateZeroSinceValue(), bh.db.ParseSequenceID)
-	if err != nil {
+	// A since value may be a cursor token, which can also carry per-channel checkpoints
+	var cursorChannelSince map[string]uint64
+	var cursorErr error
+	parseSince := func(since string) (seq SequenceID, err error) {
+		if !isCursorToken(since) {
+			return bh.db.ParseSequenceID(since)
+		}
+		seq, cursorChannelSince, cursorErr = bh.db.parseCursorToken(since)
+		return seq, cursorErr
+	}
+	subChangesParams, err := NewSubChangesParams(logCtx, rq, bh.db.CreateZeroSinceValue(), parseSince)
+	if cursorErr != nil {
+		return cursorErr
+	} else if err != nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid subChanges parameters")
 	}
+	if cursorChannelSince != nil && subChangesParams._channelSince == nil {
+		subChangesParams._channelSince = cursorChannelSince
+	}
+	if subChangesParams.cursorTokens() && bh.db.Options.BlipSyncOptions.CursorTokenSecret == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Cursor tokens aren't enabled")
+	}
+
+	// Exclusions apply for the subscription's lifetime, so an access grant that later adds an excluded channel (e.g. via
+	// a new role) doesn't bring its changes back, nor backfill it.  Only accessible channels may be excluded, so that a
+	// client can't use the exclusion to probe which channels exist.
+	excludedChannels, err := subChangesParams.excludeChannels()
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s", err)
+	}
+	if user := bh.db.User(); user != nil {
+		for channel := range excludedChannels {
+			if !user.CanSeeChannel(channel) {
+				return base.HTTPErrorf(http.StatusBadRequest, "Excluded channel %s isn't accessible", base.UD(channel))
+			}
+		}
+	}
+
+	// An unknown named filter is rejected before the subscription is opened, so that the client can retry with another
+	// filter on the same connection.
+	named, err := bh.namedFilter(subChangesParams.filter())
+	if err != nil {
+		return err
+	}
+
+	if subChangesParams.summaries() && bh.db.docSummaries == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Document summaries aren't configured")
+	}
+
+	minDocSize, maxDocSize := subChangesParams.minDocSize(), subChangesParams.maxDocSize()
+	if maxDocSize > 0 && minDocSize > maxDocSize {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s can't exceed %s", SubChangesMinSize, SubChangesMaxSize)
+	}
+
+	if subChangesParams.subscriptionTTL() > 0 && !subChangesParams.continuous() {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s is only supported for continuous subChanges", SubChangesTTL)
+	}
+
+	if subChangesParams.heartbeatInterval() > 0 && !subChangesParams.continuous() {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s is only supported for continuous subChanges", SubChangesHeartbeat)
+	}
+
+	if subChangesParams.sortBy() != "" && subChangesParams.continuous() {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s not supported for continuous subChanges", SubChangesSortBy)
+	}
+
+	if subChangesParams.tombstonesFirst() && subChangesParams.continuous() {
+		return base.HTTPErrorf(http.StatusBadRequest, "%s not supported for continuous subChanges", SubChangesTombstones)
+	}
+
+	if subChangesParams.dependencyOrder() {
+		if subChangesParams.continuous() {
+			return base.HTTPErrorf(http.StatusBadRequest, "%s not supported for continuous subChanges", SubChangesDepOrder)
+		} else if subChangesParams.sortBy() != "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "%s can't be combined with %s", SubChangesDepOrder, SubChangesSortBy)
+		}
+	}
+
+	deltaFormat, err := subChangesParams.deltaFormat()
+	if err != nil {
+		return err
+	}
+
+	// The docIDs filter lists the IDs the client replicates docs as
+	if err := bh.storedDocIDs(subChangesParams._docIDs); err != nil {
+		return err
+	}
+
+	var expression *filterExpression
+	if subChangesParams.filter() == "sync_gateway/byexpression" {
+		if expression, err = parseFilterExpression(subChangesParams.expression()); err != nil {
+			return err
+		}
+	}
 
 	// Ensure that only _one_ subChanges subscription can be open on this blip connection at any given time.  SG #3222.
 	if !bh.activeSubChanges.CompareAndSwap(false, true) {
 		return fmt.Errorf("blipHandler already has an outstanding continous subChanges.  Cannot open another one.")
 	}
-
-	if len(subChangesParams.docIDs()) > 0 && subChangesParams.continuous() {
-		return base.HTTPErrorf(http.StatusBadRequest, "DocIDs filter not supported for continuous subChanges")
-	}
+	// Release the subscription again if it fails to start, so that the client can retry on this connection
+	started := false
+	defer func() {
+		if !started {
+			bh.activeSubChanges.Set(false)
+		}
+	}()
 
 	bh.logEndpointEntry(rq.Profile(), subChangesParams.String())
 
 	// TODO: Do we need to store the changes-specific parameters on the blip sync context?  Seems like they only need to be passed in to sendChanges
-	bh.batchSize = subChangesParams.batchSize()
+	bh.batchSize = bh.clampBatchSize(subChangesParams.batchSize())
 	bh.continuous = subChangesParams.continuous()
 	bh.activeOnly = subChangesParams.activeOnly()
+	bh.stagedSync = subChangesParams.stagedSync()
+	bh.revRetry = subChangesParams.revRetry()
+	bh.bodyChecksum = subChangesParams.bodyChecksum()
+	bh.recoverableTombstones = subChangesParams.recoverableTombstones()
+	bh.templateDeltas = subChangesParams.templateDeltas()
+	bh.channelCheckpoints = subChangesParams.channelSince() != nil
+	bh.channelMembership = subChangesParams.channelMembership()
+	bh.deliveryCounter = nil
+	if subChangesParams.deliveryIndex() {
+		bh.deliveryCounter = &deliveryCounter{}
+	}
+	bh.summaries = subChangesParams.summaries()
+	bh.tombstonesFirst = subChangesParams.tombstonesFirst()
+	if bh.tombstonesFirst {
+		bh.tombstoneWindowEnd = bh.db.GetChangeCache().LastSequence()
+	}
+	bh.deliveryLog = nil
+	if session := subChangesParams.session(); session != "" && bh.db.deliveryLogs != nil {
+		bh.deliveryLog = bh.db.deliveryLogs.get(deliveryLogKey(bh.userName, session))
+	}
+	bh.cursorTokens = subChangesParams.cursorTokens()
+	bh.cursorChannelSince = subChangesParams.channelSince()
+	bh.deltaFormat = deltaFormat
+	bh.dbUserLock.Lock()
+	bh.accessChangedSender = nil
+	if subChangesParams.accessChanges() {
+		bh.accessChangedSender = rq.Sender
+	}
+	bh.revocationSender = nil
+	if subChangesParams.revocations() && bh.db.Options.BlipSyncOptions.MaxRevocations > 0 {
+		bh.revocationSender = rq.Sender
+	}
+	bh.dbUserLock.Unlock()
+	bh.metadataChanges = subChangesParams.metadataChanges()
+	bh.announcedRevs = nil
+	bh.sortBy = subChangesParams.sortBy()
+	bh.dependencyOrder = subChangesParams.dependencyOrder()
+	bh.attachmentsOnly = subChangesParams.withAttachmentsOnly()
+	bh.minDocSize, bh.maxDocSize = minDocSize, maxDocSize
+	bh.excludedChannels = excludedChannels
+	bh.channelPatterns, bh.patternChannels = nil, nil
+	bh.changesPacer = newChangesPacer(subChangesParams.maxChangesPerSecond())
+	// Paced batches are kept to a second's worth of changes, so that they're spread evenly rather than sent in bursts
+	if bh.changesPacer != nil && subChangesParams.maxChangesPerSecond() < bh.batchSize {
+		bh.batchSize = subChangesParams.maxChangesPerSecond()
+	}
+	bh.revChunkSize = subChangesParams.revChunkSize()
+	bh.maxStaleness = subChangesParams.maxStaleness()
+	if bh.maxStaleness > bh.db.Options.BlipSyncOptions.MaxStaleness {
+		bh.maxStaleness = bh.db.Options.BlipSyncOptions.MaxStaleness
+	}
+	bh.filterExpression = nil
+	if bh.stagedSync {
+		bh.stagedSelection = make(chan []string, 1)
+	}
+
+	// Track initial sync progress server-side when requested, so that an interrupted initial pull can resume near
+	// where it left off even if the client hasn't yet persisted a checkpoint.
+	bh.initialSyncTracker = nil
+	// Sorted and dependency-ordered pulls aren't tracked, as their batches aren't sent in sequence order.
+	if session := subChangesParams.session(); session != "" && bh.db.initialSyncStore != nil && subChangesParams.Since().Seq == 0 && !bh.orderedPull() {
+		bh.initialSyncTracker = newInitialSyncProgressTracker(bh.db.initialSyncStore, initialSyncProgressKey(bh.userName, session))
+	}
 
 	if filter := subChangesParams.filter(); filter == "sync_gateway/bychannel" {
 		var err error
 
-		bh.channels, err = subChangesParams.channelsExpandedSet()
+		patterns, err := subChangesParams.channelPatterns()
 		if err != nil {
 			return base.HTTPErrorf(http.StatusBadRequest, "%s", err)
-		} else if len(bh.channels) == 0 {
-			return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
+		}
+		// The channel list may be omitted when patterns are given
+		if _, found := subChangesParams.channels(); found || patterns == nil {
+			bh.channels, err = subChangesParams.channelsExpandedSet()
+			if err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "%s", err)
+			} else if len(bh.channels) == 0 && patterns == nil && !(bh.continuous && bh.db.Options.BlipSyncOptions.AllowEmptyChannelSubscription) {
+				return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
 
+			}
+		}
+		if denied := bh.deniedChannels(bh.channels.ToArray()); len(denied) > 0 {
+			return base.HTTPErrorf(http.StatusForbidden, "Subscription includes channel(s) that can't be replicated: %s", base.UD(denied))
+		}
+		if patterns != nil {
+			if err := bh.subscribeChannelPatterns(patterns); err != nil {
+				return err
+			}
 		}
+	} else if filter == "sync_gateway/byexpression" {
+		bh.filterExpression = expression
+	} else if named != nil {
+		bh.applyNamedFilter(strings.TrimPrefix(filter, NamedFilterPrefix), named)
 	} else if filter != "" {
-		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel")
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel, sync_gateway/byexpression or named/<name>")
+	}
+
+	// The subscription's settings are in place, so the connection's other requests needn't wait for the scan for
+	// sorted changes, which also checks changes against state the lock guards
+	bh.lock.Unlock()
+	locked = false
+
+	// Sorted changes are collected before responding, so that a result set too large to sort can be rejected
+	var sortedChanges [][]interface{}
+	if bh.sortBy != "" {
+		var err error
+		sortedChanges, err = bh.collectSortedChanges(subChangesParams, bh.sortBy)
+		if err != nil {
+			return err
+		}
+	} else if bh.dependencyOrder {
+		var err error
+		sortedChanges, err = bh.collectDependencyOrderedChanges(subChangesParams)
+		if err != nil {
+			return err
+		}
 	}
 
+	// The TTL runs from when the subscription starts, and is stopped once the feed ends
+	expiry := newSubscriptionExpiry(subChangesParams.subscriptionTTL(), bh.terminator)
+	bh.subscriptionExpiry = expiry
+
 	// Start asynchronous changes goroutine
+	started = true
 	go func() {
 		// Pull replication stats by type - Active stats decremented in Close()
 		if bh.continuous {
@@ -193,11 +616,23 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 		}
 
 		defer func() {
+			if expiry.stop() {
+				bh.endExpiredSubscription(rq.Sender)
+				return
+			}
 			bh.activeSubChanges.Set(false)
 		}()
-		// sendChanges runs until blip context closes, or fails due to error
+		// sendChanges runs until blip context closes, its TTL elapses, or fails due to error
 		startTime := time.Now()
-		bh.sendChanges(rq.Sender, subChangesParams)
+		// Spans started while the feed runs are children of its span
+		var span base.Span
+		bh.traceCtx, span = bh.startFeedSpan("sendChanges")
+		if bh.orderedPull() {
+			bh.sendSortedChanges(rq.Sender, sortedChanges)
+		} else {
+			bh.sendChanges(rq.Sender, subChangesParams)
+		}
+		span.End()
 		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Type:%s   --> Time:%v", bh.serialNumber, rq.Profile(), time.Since(startTime))
 	}()
 
@@ -212,24 +647,74 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *SubChangesParams
 		}
 	}()
 
-	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Sending changes since %v", params.Since())
+	since := params.Since()
+	if bh.initialSyncTracker != nil {
+		if resumeSeq, found := bh.initialSyncTracker.store.get(bh.initialSyncTracker.key); found {
+			base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Resuming initial sync from server-side progress at %v", resumeSeq)
+			since = resumeSeq
+		}
+	}
+
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Sending changes since %v", since)
+	bh.progressMilestones = newProgressMilestones(bh.db.Options.BlipSyncOptions.ProgressMilestoneDocs, bh.db.Options.BlipSyncOptions.ProgressMilestonePercent,
+		since.Seq, bh.db.GetChangeCache().LastSequence())
 
 	options := ChangesOptions{
-		Since:        params.Since(),
+		Since:        since,
 		Conflicts:    false, // CBL 2.0/BLIP don't support branched rev trees (LiteCore #437)
 		Continuous:   bh.continuous,
 		ActiveOnly:   bh.activeOnly,
-		Terminator:   bh.BlipSyncContext.terminator,
+		Terminator:   bh.feedTerminator(),
 		Ctx:          bh.db.Ctx,
 		ClientIsCBL2: true,
+		ChannelSince: params.channelSince(),
+		MaxStaleness: bh.maxStaleness,
+	}
+
+	// Report the feed's progress to the client while it runs, if it asked
+	var heartbeats *heartbeatSender
+	if bh.continuous {
+		heartbeats = startHeartbeats(params.heartbeatInterval(), since, options.Terminator, func(lastSentSeq SequenceID) error {
+			return bh.sendHeartbeat(sender, lastSentSeq)
+		})
+		defer heartbeats.stop()
 	}
 
 	channelSet := bh.channels
 	if channelSet == nil {
 		channelSet = base.SetOf(channels.AllChannelWildcard)
+	} else if len(channelSet) == 0 {
+		// An empty channel subscription (when permitted) has nothing to send until the user is granted channels they
+		// didn't have when it started, after which it follows those channels
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Empty channel list for continuous subChanges - no changes will be sent until access is granted")
+		if err := bh.sendBatchOfChanges(sender, nil); err != nil {
+			return
+		}
+		if channelSet = bh.waitForGrantedChannels(options.Terminator); channelSet == nil {
+			return
+		}
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Empty channel subscription following granted channels %s", base.UD(channelSet))
+		bh.lock.Lock()
+		bh.channels = channelSet
+		bh.lock.Unlock()
 	}
 
 	caughtUp := false
+	lastSentSeq := since
+	var keepalives *keepaliveSender
+	defer func() {
+		if caughtUp {
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyCaughtUpConnections, -1)
+		}
+		keepalives.stop()
+	}()
+	var caughtUpSignals *caughtUpSignaller
+	if bh.continuous && params.repeatCaughtUp() {
+		caughtUpSignals = newCaughtUpSignaller(BlipCaughtUpDebounce, func() error {
+			return bh.sendBatchOfChanges(sender, nil)
+		})
+		defer caughtUpSignals.stop()
+	}
 	pendingChanges := make([][]interface{}, 0, bh.batchSize)
 	sendPendingChangesAt := func(minChanges int) error {
 		if len(pendingChanges) >= minChanges {
@@ -244,23 +729,41 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *SubChangesParams
 	// Create a distinct database instance for changes, to avoid races between reloadUser invocation in changes.go
 	// and BlipSyncContext user access.
 	changesDb := bh.copyContextDatabase()
+	patterned := bh.channelPatterns != nil
 	_, forceClose := generateBlipSyncChanges(changesDb, channelSet, options, params.docIDs(), func(changes []*ChangeEntry) error {
 		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "    Sending %d changes", len(changes))
+		// Pick up grant changes before filtering by channel pattern, as the client may not send anything that would
+		// otherwise refresh the user while it only pulls
+		if patterned {
+			if err := bh.refreshUser(); err != nil {
+				base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to refresh user to re-expand channel patterns: %v", err)
+			}
+		}
+		if caughtUp && caughtUpSignals != nil && len(changes) > 0 {
+			caughtUpSignals.changesSent()
+		}
+		if len(changes) > 0 {
+			keepalives.activity()
+		}
 		for _, change := range changes {
-
-			if !strings.HasPrefix(change.ID, "_") {
-				for _, item := range change.Changes {
-					changeRow := []interface{}{change.Seq, change.ID, item["rev"], change.Deleted}
-					if !change.Deleted {
-						changeRow = changeRow[0:3]
-					}
-					pendingChanges = append(pendingChanges, changeRow)
-					if err := sendPendingChangesAt(bh.batchSize); err != nil {
-						return err
-					}
+			lastSentSeq = change.Seq
+			changeRows := bh.changeRows(change)
+			if len(changeRows) > 0 {
+				bh.db.channelDocsSent.add(change.channels)
+			}
+			for _, changeRow := range changeRows {
+				pendingChanges = append(pendingChanges, changeRow)
+				if err := sendPendingChangesAt(bh.batchSize); err != nil {
+					return err
 				}
 			}
 		}
+		heartbeats.sent(lastSentSeq)
+		if bh.takeFlushRequest() {
+			if err := sendPendingChangesAt(1); err != nil {
+				return err
+			}
+		}
 		if caughtUp || len(changes) == 0 {
 			if err := sendPendingChangesAt(1); err != nil {
 				return err
@@ -271,8 +774,21 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *SubChangesParams
 				if err := bh.sendBatchOfChanges(sender, nil); err != nil {
 					return err
 				}
+				bh.notifyCaughtUp(lastSentSeq, params.session())
+				// Keep the connection from looking idle to intermediaries while the feed waits for changes
+				if bh.continuous {
+					keepalives = startKeepalives(bh.keepaliveInterval, func() error {
+						return bh.sendKeepalive(sender)
+					})
+				}
+			} else if caughtUpSignals != nil && len(changes) == 0 {
+				// Signal again that it's caught up, now the feed has drained after sending more changes
+				if err := caughtUpSignals.drained(); err != nil {
+					return err
+				}
 			}
 		}
+		bh.emitProgressMilestones(lastSentSeq, caughtUp, params.session())
 		return nil
 	})
 
@@ -283,29 +799,341 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *SubChangesParams
 
 }
 
+// waitForGrantedChannels waits for the user to be granted channels they didn't have when called, returning those that
+// can be replicated, or nil once the terminator is closed.  A connection that isn't authenticated as a user is never
+// granted anything, so just waits to be terminated.
+func (bh *blipHandler) waitForGrantedChannels(terminator chan bool) base.Set {
+	user := bh.db.User()
+	if user == nil {
+		<-terminator
+		return nil
+	}
+	initialChannels := user.InheritedChannels()
+
+	// Wake the waiter once the feed is terminated
+	waiter := bh.db.NewUserWaiter()
+	waiting := make(chan struct{})
+	defer close(waiting)
+	go func() {
+		select {
+		case <-terminator:
+			bh.db.DatabaseContext.NotifyTerminatedChanges(user.Name())
+		case <-waiting:
+		}
+	}()
+
+	for {
+		if waiter.Wait() == WaiterClosed {
+			return nil
+		}
+		select {
+		case <-terminator:
+			return nil
+		default:
+		}
+		if err := bh.refreshUser(); err != nil {
+			base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to refresh user to check for granted channels: %v", err)
+			continue
+		}
+		granted := base.Set{}
+		if newUser := bh.db.User(); newUser != nil {
+			// Roles granted to the user may grant channels later
+			waiter.RefreshUserKeys(newUser)
+			waiter.UpdateChannels(nil)
+			for channel := range newUser.InheritedChannels() {
+				if _, found := initialChannels[channel]; !found {
+					granted.Add(channel)
+				}
+			}
+		}
+		for _, channel := range bh.deniedChannels(granted.ToArray()) {
+			delete(granted, channel)
+		}
+		if len(granted) > 0 {
+			return granted
+		}
+	}
+}
+
+// changeRows returns the rows to send to the client in a changes message for the given change entry.
+func (bh *blipHandler) changeRows(change *ChangeEntry) (changeRows [][]interface{}) {
+	if strings.HasPrefix(change.ID, "_") || !bh.isDelivered(change.ID) {
+		return nil
+	}
+
+	// Send a doc deleted within the catch-up window as its tombstone, or not at all for an active-only subscription
+	if tombstone := bh.netDeletion(change); tombstone != nil {
+		if bh.activeOnly {
+			return nil
+		}
+		change = tombstone
+	}
+
+	// Defensive check that nothing in a denied channel is sent, e.g. to an unfiltered subscription.  The doc's own
+	// channels are checked, as a doc found in an allowed channel may also be in a denied one.  Unlike exclusions, a doc
+	// whose channels can't be read isn't sent.
+	if len(bh.blipContextDb.Options.BlipSyncOptions.DeniedChannels) > 0 {
+		docChannels, err := bh.docChannels(change.ID)
+		if err != nil {
+			base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Not sending change for doc %s whose channels can't be read: %v", base.UD(change.ID), err)
+			return nil
+		}
+		if denied := bh.deniedChannels(docChannels); len(denied) > 0 {
+			base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Not sending change for doc %s in denied channel(s) %s", base.UD(change.ID), base.UD(denied))
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyDeniedChannelChangesSuppressed, 1)
+			return nil
+		}
+	}
+
+	// Skip docs outside the channels the subscription's patterns currently expand to
+	if !bh.inPatternChannels(change) {
+		return nil
+	}
+
+	// Skip docs only in channels the client excluded from its subscription
+	if len(bh.excludedChannels) > 0 && bh.inExcludedChannelsOnly(change) {
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyExcludedChannelChanges, 1)
+		return nil
+	}
+
+	// Skip docs without attachments when asked to, except tombstones so that clients can remove docs they were previously sent
+	if bh.attachmentsOnly && !change.Deleted && !bh.hasAttachments(change.ID) {
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyNoAttachmentsSkipped, 1)
+		return nil
+	}
+
+	// Likewise skip docs outside the size range the client asked for, except tombstones and removals, whose body the
+	// user may no longer be able to read
+	if (bh.minDocSize > 0 || bh.maxDocSize > 0) && !change.Deleted && !change.allRemoved && len(change.Changes) > 0 && !bh.withinDocSizeRange(change.ID, change.Changes[0]["rev"]) {
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyDocSizeSkipped, 1)
+		return nil
+	}
+
+	for _, item := range change.Changes {
+		// Tombstones and removals aren't filtered by expression, so that clients can remove docs they were previously
+		// sent.  A removal's body is one the user has just lost access to, so it mustn't be evaluated either.
+		if bh.filterExpression != nil && !change.Deleted && !change.allRemoved && !bh.matchesFilterExpression(change.ID, item["rev"]) {
+			continue
+		}
+		// Don't announce a rev the client acknowledged before it reconnected
+		if bh.deliveryLog != nil && bh.deliveryLog.alreadyDelivered(change.ID, item["rev"], change.Seq.Seq) {
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyDeliveryLogSkipped, 1)
+			continue
+		}
+		// Don't announce a rev to the Sync Gateway it was replicated from
+		if bh.peerNode != "" && bh.loopsBackToPeer(change.ID, item["rev"]) {
+			continue
+		}
+		changeRow := []interface{}{change.Seq, change.ID, item["rev"], change.Deleted}
+		if !change.Deleted {
+			changeRow = changeRow[0:3]
+		}
+		// A revision that's already been announced reappears in the feed at a later sequence when only its
+		// metadata has changed (e.g. a channel reassignment or expiry update on import), so notify the
+		// client without prompting it to fetch the body again.
+		if bh.metadataChanges && bh.announceRev(change.ID, item["rev"]) {
+			changeRow = bh.metadataOnlyChangeRow(change, item["rev"])
+		} else if meta := bh.changeRowMeta(change, item["rev"]); len(meta) > 0 {
+			changeRow = []interface{}{change.Seq, change.ID, item["rev"], change.Deleted, meta}
+		}
+		changeRows = append(changeRows, changeRow)
+	}
+	return changeRows
+}
+
+// changeRowMeta returns the optional metadata for a changes row that the client has asked for, if any: the channels
+// the change was found in, for per-channel checkpoints, a cursor token to resume after it, and whether a tombstone is
+// recoverable.
+func (bh *blipHandler) changeRowMeta(change *ChangeEntry, revID string) map[string]interface{} {
+	var meta map[string]interface{}
+	if bh.channelCheckpoints && len(change.channels) > 0 {
+		meta = map[string]interface{}{ChangesRowChannels: change.channels}
+	}
+	if bh.cursorTokens {
+		if token := bh.cursorTokenForChange(change); token != "" {
+			if meta == nil {
+				meta = make(map[string]interface{}, 1)
+			}
+			meta[ChangesRowCursor] = token
+		}
+	}
+	if change.Deleted && bh.recoverableTombstones {
+		if lastRevID, ok := bh.recoverableTombstone(change.ID, revID); ok {
+			if meta == nil {
+				meta = make(map[string]interface{}, 2)
+			}
+			meta[ChangesRowRecoverable] = true
+			meta[ChangesRowLastRev] = lastRevID
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyRecoverableTombstoneCount, 1)
+		}
+	}
+	return meta
+}
+
+// matchesFilterExpression returns true if the given revision's body matches the subscription's filter expression.
+// Revisions that can't be read don't match.
+func (bh *blipHandler) matchesFilterExpression(docID, revID string) bool {
+	rev, err := bh.db.revisionCache.Get(docID, revID, RevCacheIncludeBody, RevCacheOmitDelta)
+	if err != nil {
+		return false
+	}
+	body, err := rev.MutableBody()
+	if err != nil {
+		return false
+	}
+	return bh.filterExpression.matches(body)
+}
+
+// changeChannels returns the channels the change was found in.  For a change found on the all-channels feed, as it is
+// for admins and users granted the star channel, the doc's current channels are read from its metadata instead.
+func (bh *blipHandler) changeChannels(change *ChangeEntry) ([]string, error) {
+	if len(change.channels) > 0 && !base.StringSliceContains(change.channels, channels.AllChannelWildcard) {
+		return change.channels, nil
+	}
+	return bh.docChannels(change.ID)
+}
+
+// docChannels returns the doc's current channels, read from its metadata.
+func (bh *blipHandler) docChannels(docID string) ([]string, error) {
+	syncData, err := bh.db.GetDocSyncData(docID)
+	if err != nil {
+		return nil, err
+	}
+	docChannels := make([]string, 0, len(syncData.Channels))
+	for channel, removal := range syncData.Channels {
+		if removal == nil {
+			docChannels = append(docChannels, channel)
+		}
+	}
+	return docChannels, nil
+}
+
+// inExcludedChannelsOnly returns true if every channel the change was found in is excluded.  Docs whose metadata
+// can't be read aren't excluded.
+func (bh *blipHandler) inExcludedChannelsOnly(change *ChangeEntry) bool {
+	changeChannels, err := bh.changeChannels(change)
+	if err != nil {
+		return false
+	}
+	for _, channel := range changeChannels {
+		if !bh.excludedChannels.Contains(channel) {
+			return false
+		}
+	}
+	return len(changeChannels) > 0
+}
+
+// hasAttachments returns true if the current revision of the doc has attachments, according to the doc's metadata.
+// Docs whose metadata can't be read are treated as having attachments, so that the client isn't denied them.
+func (bh *blipHandler) hasAttachments(docID string) bool {
+	syncData, err := bh.db.GetDocSyncData(docID)
+	if err != nil {
+		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Unable to read metadata of doc %s to check for attachments: %v", base.UD(docID), err)
+		return true
+	}
+	return len(syncData.Attachments) > 0
+}
+
+// withinDocSizeRange returns true if the body of the given revision is within the size range the client asked for.
+// The range is a post-filter on the feed, so every candidate change costs a size lookup: from the rev cache when the
+// rev is cached, otherwise from the doc's metadata when it's stored in an xattr (which still reads the doc, but
+// doesn't unmarshal its body), and otherwise by loading the rev.  Revs whose size can't be read are sent, so that the
+// client isn't denied them.
+func (bh *blipHandler) withinDocSizeRange(docID, revID string) bool {
+	size, err := bh.docBodySize(docID, revID)
+	if err != nil {
+		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Unable to read body size of doc %s rev %s to check its size: %v", base.UD(docID), revID, err)
+		return true
+	}
+	return size >= bh.minDocSize && (bh.maxDocSize == 0 || size <= bh.maxDocSize)
+}
+
+// docBodySize returns the size of the body of the given revision, loading it only when its size isn't otherwise known.
+func (bh *blipHandler) docBodySize(docID, revID string) (int, error) {
+	if rev, found := bh.db.revisionCache.Peek(docID, revID); found && rev.BodyBytes != nil {
+		return len(rev.BodyBytes), nil
+	}
+	currentRevID, size, found, err := bh.db.getCurrentRevBodySize(docID)
+	if err != nil {
+		return 0, err
+	} else if found && currentRevID == revID {
+		return size, nil
+	}
+	rev, err := bh.db.revisionCache.Get(docID, revID, RevCacheIncludeBody, RevCacheOmitDelta)
+	if err != nil {
+		return 0, err
+	}
+	return len(rev.BodyBytes), nil
+}
+
 func (bh *blipHandler) sendBatchOfChanges(sender *blip.Sender, changeArray [][]interface{}) error {
+	if err := bh.paceChanges(len(changeArray)); err != nil {
+		return err
+	}
+
 	outrq := blip.NewRequest()
 	outrq.SetProfile("changes")
-	err := outrq.SetJSONBody(changeArray)
+	err := outrq.SetJSONBody(bh.deliveredChangeRows(changeArray))
 	if err != nil {
 		base.InfofCtx(bh.blipContextDb.Ctx, base.KeyAll, "Error setting changes: %v", err)
 	}
 
 	if len(changeArray) > 0 {
+		// Wait for the client to respond to earlier batches, if the window of batches in flight is full.  The batch
+		// holds its slot until its response has been handled.
+		if err := bh.changesWindow.acquire(bh.terminator); err != nil {
+			return err
+		}
+		releaseSlot := true
+		defer func() {
+			if releaseSlot {
+				bh.changesWindow.release()
+			}
+		}()
+
 		// Check for user updates before creating the db copy for handleChangesResponse
 		if err := bh.refreshUser(); err != nil {
 			return err
 		}
 		handleChangesResponseDb := bh.copyContextDatabase()
 
+		progressTracker := bh.initialSyncTracker
+		var progressBatch uint64
+		if progressTracker != nil {
+			progressBatch = progressTracker.batchSent(changeArray[len(changeArray)-1][0].(SequenceID))
+		}
+
+		// A staged batch is awaiting selection as soon as it's sent, as the client may select before responding
+		if bh.stagedSync {
+			bh.awaitingSelection.Set(true)
+		}
+
 		sendTime := time.Now()
 		if !bh.sendBLIPMessage(sender, outrq) {
 			return ErrClosedBLIPSender
 		}
 
-		// Spawn a goroutine to await the client's response:
+		if bh.stagedSync || bh.orderedPull() {
+			// Staged batches are handled one at a time, as the client's selection applies to the batch awaiting it.
+			// Sorted batches are handled one at a time so that revs are sent in sorted order.
+			var selectedDocIDs base.Set
+			if bh.stagedSync {
+				var err error
+				if selectedDocIDs, err = bh.waitForSelection(); err != nil {
+					return err
+				}
+			}
+			if err := bh.handleChangesResponse(sender, outrq.Response(), changeArray, sendTime, handleChangesResponseDb, selectedDocIDs, progressTracker, progressBatch); err != nil {
+				base.ErrorfCtx(bh.blipContextDb.Ctx, "Error from bh.handleChangesResponse: %v", err)
+			}
+			return nil
+		}
+
+		// Spawn a goroutine to await the client's response, which releases the batch's slot once it's handled:
+		releaseSlot = false
 		go func(bh *blipHandler, sender *blip.Sender, response *blip.Message, changeArray [][]interface{}, sendTime time.Time, database *Database) {
-			if err := bh.handleChangesResponse(sender, response, changeArray, sendTime, database); err != nil {
+			defer bh.changesWindow.release()
+			if err := bh.handleChangesResponse(sender, response, changeArray, sendTime, database, nil, progressTracker, progressBatch); err != nil {
 				base.ErrorfCtx(bh.blipContextDb.Ctx, "Error from bh.handleChangesResponse: %v", err)
 			}
 		}(bh, sender, outrq.Response(), changeArray, sendTime, handleChangesResponseDb)
@@ -326,6 +1154,182 @@ func (bh *blipHandler) sendBatchOfChanges(sender *blip.Sender, changeArray [][]i
 	return nil
 }
 
+// waitForSelection blocks until the client selects which docs from the staged changes batch it wants bodies for,
+// or the replication is closed.
+func (bh *blipHandler) waitForSelection() (base.Set, error) {
+	defer bh.awaitingSelection.Set(false)
+	select {
+	case docIDs := <-bh.stagedSelection:
+		return base.SetFromArray(docIDs), nil
+	case <-bh.feedTerminator():
+		return nil, ErrClosedBLIPSender
+	}
+}
+
+// Received a "selectChanges" request, i.e. a staged sync client listing the docIDs from the most recent changes
+// batch that it wants to receive bodies for.
+func (bh *blipHandler) handleSelectChanges(rq *blip.Message) error {
+	if !bh.stagedSync {
+		return base.HTTPErrorf(http.StatusBadRequest, "selectChanges requires a subChanges subscription with stagedSync")
+	}
+
+	var docIDs []string
+	if err := rq.ReadJSONBody(&docIDs); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid selectChanges body: %v", err)
+	}
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("#DocIDs:%d", len(docIDs)))
+
+	// A selection can't reference more docs than were sent in a single batch
+	if len(docIDs) > bh.batchSize {
+		return base.HTTPErrorf(http.StatusBadRequest, "selectChanges lists %d docs, more than the batch size of %d", len(docIDs), bh.batchSize)
+	}
+
+	if err := bh.storedDocIDs(docIDs); err != nil {
+		return err
+	}
+
+	if !bh.awaitingSelection.CompareAndSwap(true, false) {
+		return base.HTTPErrorf(http.StatusConflict, "No changes batch is awaiting selection")
+	}
+	bh.stagedSelection <- docIDs
+	return nil
+}
+
+// Received a "getRev" request, i.e. a client fetching a revision of a doc it isn't being sent, such as the last body
+// of a recoverable tombstone given by its changes row's lastRev.  The response body is the revision's body, as in a rev
+// message, and its 'deleted' property is set for a tombstone.  Revisions the user can't access are rejected with 403,
+// and those whose body is no longer available with 404.
+func (bh *blipHandler) handleGetRev(rq *blip.Message) error {
+	docID, revID := rq.Properties[GetRevMessageId], rq.Properties[GetRevMessageRev]
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Doc:%s Rev:%s", base.UD(docID), revID))
+	if docID == "" || revID == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "getRev requires '%s' and '%s'", GetRevMessageId, GetRevMessageRev)
+	}
+	storedID, err := bh.storedDocID(docID)
+	if err != nil {
+		return err
+	}
+
+	rev, err := bh.db.revisionCache.Get(storedID, revID, RevCacheIncludeBody, RevCacheOmitDelta)
+	if err != nil {
+		return err
+	}
+	if rev.BodyBytes == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	if authorized, _ := bh.db.authorizeUserForChannels(storedID, revID, rev.Channels, rev.Deleted, nil); !authorized {
+		return ErrForbidden
+	}
+
+	bodyBytes := rev.BodyBytes
+	attachments, err := bh.deliveredAttachments(rev.Attachments)
+	if err != nil {
+		return err
+	}
+	if len(attachments) > 0 {
+		if bodyBytes, err = base.InjectJSONProperties(bodyBytes, base.KVPair{Key: BodyAttachments, Val: attachments}); err != nil {
+			return err
+		}
+	}
+	response := rq.Response()
+	if rev.Deleted {
+		response.Properties[GetRevMessageDeleted] = "true"
+	}
+	response.SetBody(bodyBytes)
+	return nil
+}
+
+// Received a "getRevSendLog" request, i.e. a diagnostic request for the recent rev send decisions on this connection
+func (bh *blipHandler) handleGetRevSendLog(rq *blip.Message) error {
+	if bh.revSendLog == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Rev send log is not enabled")
+	}
+	entries := bh.revSendLog.snapshot()
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("#Entries:%d", len(entries)))
+	return rq.Response().SetJSONBody(entries)
+}
+
+// Received a "getCapabilities" request, i.e. the client is asking which limits the server enforces
+func (bh *blipHandler) handleGetCapabilities(rq *blip.Message) error {
+	bh.logEndpointEntry(rq.Profile(), "")
+	options := bh.db.Options.BlipSyncOptions
+	return rq.Response().SetJSONBody(CapabilitiesBody{
+		MaxRevGeneration:     options.MaxRevGeneration,
+		MaxChangesPerMessage: options.MaxChangesPerMessage,
+		AttachmentEncodings:  SupportedAttachmentEncodings,
+		RevChannelAssignment: options.RevChannelAssignment,
+		StreamedProposals:    true,
+		KeepaliveInterval:    int(bh.keepaliveInterval / time.Second),
+		Revocations:          options.MaxRevocations > 0,
+		ChannelMembership:    true,
+		MinRevChunkSize:      MinRevChunkSize,
+		DeliveryIndex:        true,
+		Summaries:            bh.db.docSummaries != nil,
+		StrictNumbers:        true,
+		Databases:            bh.MultiplexedDatabases(),
+		CheckpointBatches:    true,
+		AttachmentDigests:    supportedDigestAlgorithms(options),
+	})
+}
+
+// Received a "getCompactionStatus" request, i.e. an admin request for tombstone counts and the progress of the most
+// recent startCompaction
+func (bh *blipHandler) handleGetCompactionStatus(rq *blip.Message) error {
+	if err := bh.requireAdmin(); err != nil {
+		return err
+	}
+	bh.logEndpointEntry(rq.Profile(), "")
+	status, err := bh.db.compactionStatus()
+	if err != nil {
+		return err
+	}
+	return rq.Response().SetJSONBody(status)
+}
+
+// Received a "startCompaction" request, i.e. an admin request to start tombstone compaction in the background.  The
+// response is sent as soon as the compaction has started, so replication on the connection isn't held up.
+func (bh *blipHandler) handleStartCompaction(rq *blip.Message) error {
+	if err := bh.requireAdmin(); err != nil {
+		return err
+	}
+	bh.logEndpointEntry(rq.Profile(), "")
+	compactDb := &Database{DatabaseContext: bh.db.DatabaseContext, Ctx: bh.db.Ctx}
+	jobID, err := bh.db.compactionJobs.start(compactDb)
+	if err != nil {
+		return err
+	}
+	rq.Response().Properties[StartCompactionJobID] = jobID
+	return nil
+}
+
+// Received a "collectAttachments" request, i.e. an admin request to delete the attachments replication has seen
+// dropped by pushed revs, and that no document references.  Responds once collection has finished, with the number
+// deleted.
+func (bh *blipHandler) handleCollectAttachments(rq *blip.Message) error {
+	if err := bh.requireAdmin(); err != nil {
+		return err
+	}
+	bh.logEndpointEntry(rq.Profile(), "")
+	if bh.db.attachmentRefs == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Attachment garbage collection isn't enabled")
+	}
+	deleted, err := bh.db.attachmentRefs.collect(bh.db)
+	if err != nil {
+		return err
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Deleted %d unreferenced attachments", deleted)
+	rq.Response().Properties[CollectAttachmentsDeleted] = strconv.Itoa(deleted)
+	return nil
+}
+
+// requireAdmin returns a 403 error unless the connection is authenticated as admin, i.e. was made to the admin port.
+func (bh *blipHandler) requireAdmin() error {
+	if bh.db.User() != nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Admin access required")
+	}
+	return nil
+}
+
 // Handles a "changes" request, i.e. a set of changes pushed by the client
 func (bh *blipHandler) handleChanges(rq *blip.Message) error {
 	if !bh.db.AllowConflicts() {
@@ -341,7 +1345,13 @@ func (bh *blipHandler) handleChanges(rq *blip.Message) error {
 	if len(changeList) == 0 {
 		return nil
 	}
-	output := bytes.NewBuffer(make([]byte, 0, 100*len(changeList)))
+	if err := bh.checkChangesCount(len(changeList)); err != nil {
+		return err
+	}
+	if err := bh.storedChangeIDs(changeList, 1); err != nil {
+		return err
+	}
+	output := newChangesResponseBuffer(len(changeList), 100)
 	output.Write([]byte("["))
 	jsonOutput := base.JSONEncoder(output)
 	nWritten := 0
@@ -355,10 +1365,18 @@ func (bh *blipHandler) handleChanges(rq *blip.Message) error {
 
 	expectedSeqs := make([]string, 0)
 
-	for _, change := range changeList {
-		docID := change[1].(string)
-		revID := change[2].(string)
-		missing, possible := bh.db.RevDiff(docID, []string{revID})
+	changes := make([]IDAndRev, len(changeList))
+	for i, change := range changeList {
+		changes[i] = IDAndRev{DocID: change[1].(string), RevID: change[2].(string)}
+	}
+	revDiffs := bh.db.RevDiffMany(changes)
+
+	for i, change := range changeList {
+		missing, possible := revDiffs[i].Missing, revDiffs[i].Possible
+		if maxAncestors := bh.db.Options.BlipSyncOptions.MaxPossibleAncestors; maxAncestors > 0 && len(possible) > maxAncestors {
+			possible = mostRecentRevIDs(possible, maxAncestors)
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyAncestorsTruncated, 1)
+		}
 		if nWritten > 0 {
 			output.Write([]byte(","))
 		}
@@ -402,6 +1420,105 @@ func (bh *blipHandler) handleChanges(rq *blip.Message) error {
 	return nil
 }
 
+// checkChangesCount rejects a changes or proposeChanges message listing more changes than the configured maximum.
+func (bh *blipHandler) checkChangesCount(count int) error {
+	if maxChanges := bh.db.Options.BlipSyncOptions.MaxChangesPerMessage; maxChanges > 0 && count > maxChanges {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Message lists %d changes, more than the maximum of %d", count, maxChanges)
+	}
+	return nil
+}
+
+// newChangesResponseBuffer returns a buffer for the response to a changes or proposeChanges message, sized for the
+// expected bytes per change up to blipMaxChangesResponsePrealloc.  Responses are mostly short (a "0" for each rev
+// that isn't needed), so a large message grows its buffer as needed instead of allocating for the worst case.
+func newChangesResponseBuffer(changeCount, bytesPerChange int) *bytes.Buffer {
+	size := changeCount * bytesPerChange
+	if size > blipMaxChangesResponsePrealloc {
+		size = blipMaxChangesResponsePrealloc
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+// announceRev records that revID has been announced to the client for docID, returning true if it had already
+// been announced, i.e. the change is metadata-only.  Only called from the sendChanges goroutine.
+func (bh *blipHandler) announceRev(docID, revID string) (alreadyAnnounced bool) {
+	if bh.announcedRevs == nil || len(bh.announcedRevs) >= BlipMaxAnnouncedRevs {
+		bh.announcedRevs = make(map[string]string)
+	}
+	alreadyAnnounced = bh.announcedRevs[docID] == revID
+	bh.announcedRevs[docID] = revID
+	return alreadyAnnounced
+}
+
+// metadataOnlyChangeRow returns a changes row for a revision that's already been announced to the client, flagged
+// so that the client doesn't expect a new body.  The row carries the revision's current metadata: the channels
+// visible to the user and the expiry.
+func (bh *blipHandler) metadataOnlyChangeRow(change *ChangeEntry, revID string) []interface{} {
+	meta := map[string]interface{}{ChangesRowMetaOnly: true}
+	if rev, err := bh.db.revisionCache.Get(change.ID, revID, RevCacheOmitBody, RevCacheOmitDelta); err == nil {
+		visibleChannels := make([]string, 0, len(rev.Channels))
+		for channel := range rev.Channels {
+			if bh.db.user == nil || bh.db.user.CanSeeChannel(channel) {
+				visibleChannels = append(visibleChannels, channel)
+			}
+		}
+		meta[ChangesRowChannels] = visibleChannels
+		if rev.Expiry != nil {
+			meta[ChangesRowExpiry] = rev.Expiry
+		}
+	}
+	return []interface{}{change.Seq, change.ID, revID, change.Deleted, meta}
+}
+
+// isMetadataOnlyChangeRow returns true if the changes row was built by metadataOnlyChangeRow.
+func isMetadataOnlyChangeRow(changeRow []interface{}) bool {
+	if len(changeRow) <= 4 {
+		return false
+	}
+	meta, _ := changeRow[4].(map[string]interface{})
+	return meta[ChangesRowMetaOnly] == true
+}
+
+// recoverableTombstone returns the ID of the revision holding a deleted document's last body, if the given tombstone
+// is the document's current revision, was saved within the database's tombstone retention window, and the body is
+// still available.  Tombstones outside the window, or whose body has been purged, aren't recoverable.
+func (bh *blipHandler) recoverableTombstone(docID, revID string) (lastRevID string, ok bool) {
+	retention := bh.db.Options.TombstoneRetentionSecs
+	if retention == 0 {
+		return "", false
+	}
+	doc, err := bh.db.GetDocument(docID, DocUnmarshalSync)
+	if err != nil || doc.CurrentRev != revID || time.Since(doc.TimeSaved) > time.Duration(retention)*time.Second {
+		return "", false
+	}
+	lastRevID = doc.History.getParent(revID)
+	if lastRevID == "" {
+		return "", false
+	}
+	// The last body is only announced if the user could go on to read it
+	lastRev, err := bh.db.revisionCache.Get(docID, lastRevID, RevCacheOmitBody, RevCacheOmitDelta)
+	if err != nil || lastRev.BodyBytes == nil {
+		return "", false
+	}
+	if authorized, _ := bh.db.authorizeUserForChannels(docID, lastRevID, lastRev.Channels, false, nil); !authorized {
+		return "", false
+	}
+	return lastRevID, true
+}
+
+// mostRecentRevIDs returns the n most recent of the given revIDs, most recent first.
+func mostRecentRevIDs(revIDs []string, n int) []string {
+	sorted := make([]string, len(revIDs))
+	copy(sorted, revIDs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareRevIDs(sorted[i], sorted[j]) > 0
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
 // Handles a "proposeChanges" request, similar to "changes" but in no-conflicts mode
 func (bh *blipHandler) handleProposeChanges(rq *blip.Message) error {
 	var changeList [][]interface{}
@@ -412,10 +1529,16 @@ func (bh *blipHandler) handleProposeChanges(rq *blip.Message) error {
 	if len(changeList) == 0 {
 		return nil
 	}
-	output := bytes.NewBuffer(make([]byte, 0, 5*len(changeList)))
-	output.Write([]byte("["))
-	nWritten := 0
-
+	if err := bh.checkChangesCount(len(changeList)); err != nil {
+		return err
+	}
+	if err := bh.storedChangeIDs(changeList, 0); err != nil {
+		return err
+	}
+	conflictPolicy, err := bh.proposeChangesConflictPolicy(rq.Properties[ProposeChangesConflictPolicy])
+	if err != nil {
+		return err
+	}
 	// proposeChanges stats
 	startTime := time.Now()
 	bh.dbStats.CblReplicationPush().Add(base.StatKeyProposeChangeCount, int64(len(changeList)))
@@ -423,44 +1546,98 @@ func (bh *blipHandler) handleProposeChanges(rq *blip.Message) error {
 		bh.dbStats.CblReplicationPush().Add(base.StatKeyProposeChangeTime, time.Since(startTime).Nanoseconds())
 	}()
 
+	response := rq.Response()
+	if bh.sgCanUseDeltas && !bh.deltaFailures.deltasDisabled() {
+		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeyAll, "Setting deltas=true property on proposeChanges response")
+		response.Properties[ChangesResponseDeltas] = "true"
+	}
+	if rq.Properties[ProposeChangesStream] == "true" && len(changeList) >= proposeChangesStreamThreshold {
+		return bh.streamProposedRevStatuses(rq.Sender, response, changeList, conflictPolicy)
+	}
+
+	output := newProposedStatusWriter(len(changeList))
+	for _, status := range bh.proposedRevStatuses(changeList, conflictPolicy) {
+		output.add(status)
+	}
+	response.SetCompressed(true)
+	response.SetBody(output.close())
+	return nil
+}
+
+// proposedRevStatuses returns the statuses of the changes in a proposeChanges message, under the given conflict
+// policy.
+func (bh *blipHandler) proposedRevStatuses(changeList [][]interface{}, conflictPolicy string) []ProposedRevStatus {
+	proposals := make([]ProposedRev, len(changeList))
 	for i, change := range changeList {
-		docID := change[0].(string)
-		revID := change[1].(string)
-		parentRevID := ""
+		proposals[i] = ProposedRev{DocID: change[0].(string), RevID: change[1].(string)}
 		if len(change) > 2 {
-			parentRevID = change[2].(string)
+			proposals[i].ParentRevID = change[2].(string)
 		}
-		status := bh.db.CheckProposedRev(docID, revID, parentRevID)
-		if status != 0 {
-			// Skip writing trailing zeroes; but if we write a number afterwards we have to catch up
-			if nWritten > 0 {
-				output.Write([]byte(","))
-			}
-			for ; nWritten < i; nWritten++ {
-				output.Write([]byte("0,"))
-			}
-			output.Write([]byte(strconv.FormatInt(int64(status), 10)))
-			nWritten++
+	}
+	statuses := bh.db.CheckProposedRevs(proposals)
+	for i, status := range statuses {
+		if status == ProposedRev_Conflict {
+			statuses[i] = bh.resolveProposedConflict(conflictPolicy)
 		}
 	}
-	output.Write([]byte("]"))
-	response := rq.Response()
-	if bh.sgCanUseDeltas {
-		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeyAll, "Setting deltas=true property on proposeChanges response")
-		response.Properties[ChangesResponseDeltas] = "true"
+	return statuses
+}
+
+// proposeChangesConflictPolicy validates the conflictPolicy of a proposeChanges message, returning the default
+// policy if none is given.
+func (bh *blipHandler) proposeChangesConflictPolicy(policy string) (string, error) {
+	switch policy {
+	case "", ConflictPolicyReject:
+		return ConflictPolicyReject, nil
+	case ConflictPolicyServerWins:
+		return policy, nil
+	case ConflictPolicyClientWins:
+		if !bh.db.AllowConflicts() {
+			return "", base.HTTPErrorf(http.StatusBadRequest, "%s %q is only permitted when the database allows conflicts", ProposeChangesConflictPolicy, policy)
+		}
+		return policy, nil
+	default:
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Unknown %s %q - try %s, %s or %s", ProposeChangesConflictPolicy, policy, ConflictPolicyReject, ConflictPolicyServerWins, ConflictPolicyClientWins)
+	}
+}
+
+// resolveProposedConflict returns the status of a proposed rev that conflicts with the current revision, under the
+// given conflict policy.
+func (bh *blipHandler) resolveProposedConflict(conflictPolicy string) ProposedRevStatus {
+	switch conflictPolicy {
+	case ConflictPolicyServerWins:
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyConflictServerWins, 1)
+		return ProposedRev_Exists
+	case ConflictPolicyClientWins:
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyConflictClientWins, 1)
+		return ProposedRev_OK
+	default:
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyConflictRejectCount, 1)
+		return ProposedRev_Conflict
 	}
-	response.SetCompressed(true)
-	response.SetBody(output.Bytes())
-	return nil
 }
 
 //////// DOCUMENTS:
 
+// isDeltaWasted returns true if a delta saves too little over the full body of its target rev to be worth the cost of
+// applying it, per DeltaSyncOptions.MaxDeltaRatio.  Deltas to tombstones are always worth sending.
+func (bsc *BlipSyncContext) isDeltaWasted(revDelta *RevisionDelta) bool {
+	maxDeltaRatio := bsc.blipContextDb.Options.DeltaSyncOptions.MaxDeltaRatio
+	if maxDeltaRatio <= 0 || revDelta.ToDeleted {
+		return false
+	}
+	return float64(len(revDelta.DeltaBytes)) >= maxDeltaRatio*float64(revDelta.ToBodySize)
+}
+
+// sendRevAsDelta sends a rev as a delta from a rev the client already has, falling back to the full body when a
+// delta can't be generated or isn't worth sending.  Either rev may be a tombstone: a delta to a tombstone is just the
+// deletion marker, with an empty body, and a delta from a tombstone to the rev resurrecting the doc is diffed against
+// the tombstone's body, like any other rev's.  Deletions made by the app, by setting a property, are ordinary revs.
 func (bsc *BlipSyncContext) sendRevAsDelta(sender *blip.Sender, docID, revID, deltaSrcRevID string, seq SequenceID, knownRevs map[string]bool, maxHistory int, handleChangesResponseDb *Database) error {
 
 	bsc.dbStats.StatsDeltaSync().Add(base.StatKeyDeltasRequested, 1)
 
-	revDelta, redactedRev, err := handleChangesResponseDb.GetDelta(docID, deltaSrcRevID, revID)
+	revDelta, redactedRev, err := handleChangesResponseDb.GetDeltaInFormat(docID, deltaSrcRevID, revID, bsc.deltaFormat)
 	if err == ErrForbidden {
 		return err
 	} else if base.IsDeltaError(err) {
@@ -483,12 +1660,34 @@ func (bsc *BlipSyncContext) sendRevAsDelta(sender *blip.Sender, docID, revID, de
 		return bsc.sendRevision(sender, docID, revID, seq, knownRevs, maxHistory, handleChangesResponseDb)
 	}
 
+	if bsc.hasUndeliverableDigests(revDelta.AttachmentDigests) {
+		base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Falling back to full body replication. Rev %s for key %s has attachments with sha256 digests the client didn't negotiate", revID, base.UD(docID))
+		return bsc.sendRevision(sender, docID, revID, seq, knownRevs, maxHistory, handleChangesResponseDb)
+	}
+
+	if bsc.strictNumbers {
+		if number := firstAmbiguousNumber(revDelta.DeltaBytes); number != "" {
+			base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Falling back to full body replication. Delta from %s to %s for key %s holds the integer %s, beyond the client's strict numbers", deltaSrcRevID, revID, base.UD(docID), number)
+			bsc.dbStats.StatsDeltaSync().Add(base.StatKeyAmbiguousDeltaFallbacks, 1)
+			return bsc.sendRevision(sender, docID, revID, seq, knownRevs, maxHistory, handleChangesResponseDb)
+		}
+	}
+
+	if bsc.isDeltaWasted(revDelta) {
+		base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Falling back to full body replication. Delta from %s to %s for key %s is %d bytes, too close to the body's %d bytes", deltaSrcRevID, revID, base.UD(docID), len(revDelta.DeltaBytes), revDelta.ToBodySize)
+		bsc.dbStats.StatsDeltaSync().Add(base.StatKeyDeltasWastedFallback, 1)
+		return bsc.sendRevision(sender, docID, revID, seq, knownRevs, maxHistory, handleChangesResponseDb)
+	}
+
 	base.TracefCtx(bsc.blipContextDb.Ctx, base.KeySync, "docID: %s - delta: %v", base.UD(docID), base.UD(string(revDelta.DeltaBytes)))
 	if err := bsc.sendDelta(sender, docID, deltaSrcRevID, revDelta, seq); err != nil {
 		return err
 	}
 
 	bsc.dbStats.StatsDeltaSync().Add(base.StatKeyDeltasSent, 1)
+	if bsc.deltaFormat == DeltaFormatJSONPatch {
+		bsc.dbStats.StatsDeltaSync().Add(base.StatKeyJSONPatchDeltasSent, 1)
+	}
 
 	return nil
 }
@@ -507,8 +1706,57 @@ func (bh *blipHandler) handleNoRev(rq *blip.Message) error {
 	return nil
 }
 
+// Received a "releaseRevs" request, i.e. client has persisted the listed revisions and no longer needs them
+// to be retained by the server.  This is only a memory optimization: the revisions other than each doc's current
+// revision are dropped from the in-memory rev cache, and are reloaded from the bucket if subsequently requested.
+func (bh *blipHandler) handleReleaseRevs(rq *blip.Message) error {
+	var revs [][]string
+	if err := rq.ReadJSONBody(&revs); err != nil {
+		return err
+	}
+	if len(revs) > maxReleasedRevs {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "releaseRevs may release at most %d revisions", maxReleasedRevs)
+	}
+	for _, rev := range revs {
+		if len(rev) < 2 || rev[0] == "" || rev[1] == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid releaseRevs entry - expected [docID, revID]")
+		}
+		storedID, err := bh.storedDocID(rev[0])
+		if err != nil {
+			return err
+		}
+		rev[0] = storedID
+	}
+
+	released := 0
+	for _, rev := range revs {
+		docID, revID := rev[0], rev[1]
+		cachedRev, found := bh.db.revisionCache.Peek(docID, revID)
+		if !found {
+			continue
+		}
+		// Don't allow a user to evict revisions they can't access
+		if bh.db.user != nil && bh.db.user.AuthorizeAnyChannel(cachedRev.Channels) != nil {
+			continue
+		}
+		// The doc's current rev is kept, as it's the one other clients are most likely to pull next
+		if syncData, err := bh.db.GetDocSyncData(docID); err != nil || syncData.CurrentRev == revID {
+			continue
+		}
+		bh.db.revisionCache.Remove(docID, revID)
+		released++
+	}
+
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Released %d of %d revision(s) from the rev cache", bh.serialNumber, released, len(revs))
+	return nil
+}
+
 // Received a "rev" request, i.e. client is pushing a revision body
-func (bh *blipHandler) handleRev(rq *blip.Message) error {
+func (bh *blipHandler) handleRev(rq *blip.Message) (err error) {
+	if err := bh.db.admission.admit(); err != nil {
+		return err
+	}
+
 	startTime := time.Now()
 	defer func() {
 		bh.dbStats.CblReplicationPush().Add(base.StatKeyWriteProcessingTime, time.Since(startTime).Nanoseconds())
@@ -519,6 +1767,27 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 
 	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Type:%s %s", bh.serialNumber, rq.Profile(), revMessage.String())
 
+	// A retried push with an idempotency key that's already been seen gets the original result, without re-writing
+	if key := revMessage.IdempotencyKey(); key != "" && bh.db.idempotencyStore != nil {
+		entry, found := bh.db.idempotencyStore.begin(idempotencyKey(bh.userName, key))
+		if found {
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyRevReplayCount, 1)
+			return entry.wait(bh.terminator)
+		}
+		defer func() {
+			bh.db.idempotencyStore.finish(entry, err)
+		}()
+	}
+
+	priority, err := revMessage.Priority()
+	if err != nil {
+		return err
+	}
+	ifMatch, hasIfMatch := revMessage.IfMatch()
+	if hasIfMatch && revMessage.IfAbsent() {
+		return base.HTTPErrorf(http.StatusBadRequest, "A rev can't be both ifAbsent and ifMatch")
+	}
+
 	bodyBytes, err := rq.Body()
 	if err != nil {
 		return err
@@ -534,6 +1803,32 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 	if !found || !rfound {
 		return base.HTTPErrorf(http.StatusBadRequest, "Missing docID or revID")
 	}
+	if docID, err = bh.storedDocID(docID); err != nil {
+		return err
+	}
+
+	// Reject revs from clients editing a doc in a runaway loop
+	if maxGeneration := bh.db.Options.BlipSyncOptions.MaxRevGeneration; maxGeneration > 0 {
+		if generation, _ := ParseRevID(revID); generation > maxGeneration {
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyRevGenRejected, 1)
+			return base.HTTPErrorf(http.StatusBadRequest, "Revision generation %d exceeds the maximum of %d", generation, maxGeneration)
+		}
+	}
+
+	// Reject revs for new docs once the push session has touched as many distinct docs as it may
+	if err := bh.pushDocs.admit(docID); err != nil {
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyPushDocsRejected, 1)
+		return err
+	}
+
+	// Reject bodies nested deeply enough to make parsing and the sync function expensive, before parsing them.  A
+	// delta's nesting differs from the body it patches to, so that's checked once patched.
+	maxDepth := bh.db.Options.BlipSyncOptions.MaxJSONDepth
+	deltaSrcRevID, isDelta := revMessage.DeltaSrc()
+	if maxDepth > 0 && !isDelta && base.JSONDepthExceeds(bodyBytes, maxDepth) {
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyRevDepthRejected, 1)
+		return base.HTTPErrorf(http.StatusBadRequest, "Document body is nested deeper than the maximum of %d", maxDepth)
+	}
 
 	newDoc := &Document{
 		ID:    docID,
@@ -541,11 +1836,34 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 	}
 	newDoc.UpdateBodyBytes(bodyBytes)
 
+	// On a link between Sync Gateways, a rev that's looped back to this one is acknowledged without being written
+	if bh.loopDetection {
+		path, looped := bh.receivedReplicationPath(revMessage)
+		if looped {
+			base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Not writing rev %s/%s replicated back to this Sync Gateway", base.UD(docID), revID)
+			if bh.postHandleRevCallback != nil {
+				bh.postHandleRevCallback(rq.Properties[RevMessageSequence])
+			}
+			return nil
+		}
+		newDoc.nodePath = path
+	}
+
 	injectedAttachmentsForDelta := false
-	if deltaSrcRevID, isDelta := revMessage.DeltaSrc(); isDelta {
+	if isDelta {
 		if !bh.sgCanUseDeltas {
 			return base.HTTPErrorf(http.StatusBadRequest, "Deltas are disabled for this peer")
 		}
+		if bh.deltaFailures.deltasDisabled() {
+			return base.HTTPErrorf(http.StatusBadRequest, "Deltas are temporarily disabled for this peer after repeated delta failures - send the full body")
+		}
+		deltaFormat, err := revMessage.DeltaFormat()
+		if err != nil {
+			return err
+		}
+		if err = bh.checkStrictNumbers(bodyBytes); err != nil {
+			return err
+		}
 
 		//  TODO: Doing a GetRevCopy here duplicates some rev cache retrieval effort, since deltaRevSrc is always
 		//        going to be the current rev (no conflicts), and PutExistingRev will need to retrieve the
@@ -559,12 +1877,14 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 		//       revisions to malicious actors (in the scenario where that user has write but not read access).
 		deltaSrcRev, err := bh.db.GetRev(docID, deltaSrcRevID, false, nil)
 		if err != nil {
+			bh.deltaFailed(docID, deltaSrcRevID)
 			return base.HTTPErrorf(http.StatusNotFound, "Can't fetch doc for deltaSrc=%s %v", deltaSrcRevID, err)
 		}
 
-		// Receiving a delta to be applied on top of a tombstone is not valid.
+		// A delta applied on top of a tombstone resurrects the doc.  The delta is applied to the tombstone's body, which
+		// is usually empty, but may hold properties kept when the doc was deleted.
 		if deltaSrcRev.Deleted {
-			return base.HTTPErrorf(http.StatusNotFound, "Can't use delta. Found tombstone for deltaSrc=%s", deltaSrcRevID)
+			base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Applying delta for rev %s of key %s on top of tombstone deltaSrc=%s", revID, base.UD(docID), deltaSrcRevID)
 		}
 
 		deltaSrcBody, err := deltaSrcRev.DeepMutableBody()
@@ -572,25 +1892,46 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 			return base.HTTPErrorf(http.StatusInternalServerError, "Unable to unmarshal mutable body for deltaSrc=%s %v", deltaSrcRevID, err)
 		}
 
-		// Stamp attachments so we can patch them
+		// Stamp attachments so we can patch them.  Patches modify the body in place, so they're given a copy of the
+		// rev cache's attachments.
 		if len(deltaSrcRev.Attachments) > 0 {
-			deltaSrcBody[BodyAttachments] = map[string]interface{}(deltaSrcRev.Attachments)
+			deltaSrcBody[BodyAttachments] = map[string]interface{}(deltaSrcRev.Attachments.ShallowCopy())
 			injectedAttachmentsForDelta = true
 		}
 
 		deltaSrcMap := map[string]interface{}(deltaSrcBody)
-		err = base.Patch(&deltaSrcMap, newDoc.Body())
-		if err != nil {
-			// Something went wrong in the diffing library. We want to know about this!
-			base.WarnfCtx(bh.blipContextDb.Ctx, "Error patching deltaSrc %s with %s for key %s with delta - err: %v", deltaSrcRevID, revID, base.UD(docID), err)
-			return base.HTTPErrorf(http.StatusInternalServerError, "Error patching deltaSrc with delta: %s", err)
+		if deltaFormat == DeltaFormatJSONPatch {
+			// A JSON patch comes from the client's own encoder, so a patch that can't be applied is the client's error
+			deltaSrcMap, err = base.JSONPatchApply(deltaSrcMap, bodyBytes)
+			if err != nil {
+				bh.deltaFailed(docID, deltaSrcRevID)
+				return base.HTTPErrorf(http.StatusBadRequest, "Error patching deltaSrc with JSON patch: %s", err)
+			}
+			bh.dbStats.StatsDeltaSync().Add(base.StatKeyJSONPatchDeltaPushCount, 1)
+		} else {
+			err = base.Patch(&deltaSrcMap, newDoc.Body())
+			if err != nil {
+				// Something went wrong in the diffing library. We want to know about this!
+				base.WarnfCtx(bh.blipContextDb.Ctx, "Error patching deltaSrc %s with %s for key %s with delta - err: %v", deltaSrcRevID, revID, base.UD(docID), err)
+				bh.deltaFailed(docID, deltaSrcRevID)
+				return base.HTTPErrorf(http.StatusInternalServerError, "Error patching deltaSrc with delta: %s", err)
+			}
 		}
 
+		bh.deltaFailures.succeeded(docID)
+		if maxDepth > 0 && base.ValueDepthExceeds(deltaSrcMap, maxDepth) {
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyRevDepthRejected, 1)
+			return base.HTTPErrorf(http.StatusBadRequest, "Document body is nested deeper than the maximum of %d", maxDepth)
+		}
 		newDoc.UpdateBody(deltaSrcMap)
 		base.TracefCtx(bh.blipContextDb.Ctx, base.KeySync, "docID: %s - body after patching: %v", base.UD(docID), base.UD(deltaSrcMap))
 		bh.dbStats.StatsDeltaSync().Add(base.StatKeyDeltaPushDocCount, 1)
 	}
 
+	if err := bh.applyReservedFieldsPolicy(newDoc, bodyBytes, isDelta); err != nil {
+		return err
+	}
+
 	// Handle and pull out expiry
 	if bytes.Contains(bodyBytes, []byte(BodyExpiry)) {
 		body := newDoc.Body()
@@ -627,12 +1968,33 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 		minRevpos++
 	}
 
+	// Reject the rev unless the sync function assigns it the channels the client expects, when it declares them
+	if expectedChannels, ok := revMessage.ExpectedChannels(); ok {
+		if !bh.db.Options.BlipSyncOptions.RevChannelAssignment {
+			return base.HTTPErrorf(http.StatusBadRequest, "Expected channels aren't supported by this server")
+		}
+		newDoc.expectChannels = expectedChannels
+	}
+
 	// Pull out attachments
 	if injectedAttachmentsForDelta || bytes.Contains(bodyBytes, []byte(BodyAttachments)) {
 		body := newDoc.Body()
 
-		// Check for any attachments I don't have yet, and request them:
-		if err := bh.downloadOrVerifyAttachments(rq.Sender, body, minRevpos, docID); err != nil {
+		// Attachments the rev references are no longer garbage collection candidates, before they're verified to exist
+		bh.db.attachmentRefs.referenced(AttachmentDigests(GetBodyAttachments(body)))
+
+		// Check for any attachments I don't have yet, and request them.  Those stored for the rev are removed again if
+		// it isn't written, as no doc would reference them.
+		var newAttachments []newAttachment
+		newAttachments, err = bh.downloadOrVerifyAttachments(rq.Sender, body, minRevpos, docID, revMessage.BatchProofs())
+		if len(newAttachments) > 0 {
+			defer func() {
+				if err != nil {
+					bh.db.removeNewAttachments(newAttachments)
+				}
+			}()
+		}
+		if err != nil {
 			base.ErrorfCtx(bh.blipContextDb.Ctx, "Error during downloadOrVerifyAttachments for doc %s/%s: %v", base.UD(docID), revID, err)
 			return err
 		}
@@ -642,13 +2004,62 @@ func (bh *blipHandler) handleRev(rq *blip.Message) error {
 		newDoc.UpdateBody(body)
 	}
 
-	// Finally, save the revision (with the new attachments inline)
-	bh.dbStats.CblReplicationPush().Add(base.StatKeyDocPushCount, 1)
+	// Don't start the write if the client has already given up on the request
+	if bh.ctx.Err() != nil {
+		return ErrBLIPDeadlineExceeded
+	}
+
+	// Attachments the parent revision referenced that this rev drops become garbage collection candidates, once written
+	var parentAttachments AttachmentsMeta
+	if bh.db.attachmentRefs != nil && len(history) > 1 {
+		if syncData, err := bh.db.GetDocSyncData(docID); err == nil && syncData.CurrentRev == history[1] {
+			parentAttachments = syncData.Attachments
+		}
+	}
+
+	// Finally, save the revision (with the new attachments inline).  When the rev queue is enabled, the write waits
+	// for its turn behind any higher-priority revs pushed on this connection.
+	var writtenDoc *Document
+	write := func() error {
+		return bh.revQueue.run(priority, func() (err error) {
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyDocPushCount, 1)
+			if revMessage.IfAbsent() {
+				writtenDoc, _, err = bh.db.PutExistingRevIfAbsent(newDoc, history, noConflicts, bh.db.Options.BlipSyncOptions.IfAbsentRejectsTombstones)
+				return err
+			}
+			if hasIfMatch {
+				writtenDoc, _, err = bh.db.PutExistingRevIfMatch(newDoc, history, noConflicts, ifMatch)
+				return err
+			}
+			writtenDoc, _, err = bh.db.PutExistingRev(newDoc, history, noConflicts)
+			return err
+		})
+	}
+	err = write()
 
-	_, _, err = bh.db.PutExistingRev(newDoc, history, noConflicts)
+	// A rev pushed ahead of its parent is held until the parent is written, when the orphan rev buffer is enabled
+	if err != nil && bh.db.orphanRevs != nil && bh.isOrphanRev(docID, history, err) {
+		err = bh.writeOrphanRev(docID, history, write, err)
+	}
+	if _, ok := err.(*ErrChannelsMismatch); ok {
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyRevChannelMismatch, 1)
+	}
 	if err != nil {
 		return err
 	}
+	bh.db.attachmentRefs.dropped(droppedAttachmentDigests(parentAttachments, newDoc.DocAttachments))
+
+	// Tell the client the sequence the rev was written at, which it can ask a later subChanges to wait for
+	if response := rq.Response(); response != nil && writtenDoc != nil {
+		response.Properties[RevResponseSequence] = strconv.FormatUint(writtenDoc.Sequence, 10)
+	}
+
+	// Let the client reconcile its local view with the channels the sync function assigned the revision
+	if revMessage.ReturnChannels() && bh.db.Options.BlipSyncOptions.RevChannelAssignment && writtenDoc != nil {
+		if revInfo, ok := writtenDoc.History[revID]; ok {
+			rq.Response().Properties[RevResponseChannels] = joinChannels(revInfo.Channels)
+		}
+	}
 
 	if bh.postHandleRevCallback != nil {
 		bh.postHandleRevCallback(rq.Properties[RevMessageSequence])
@@ -672,98 +2083,401 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 	if !bh.isAttachmentAllowed(digest) {
 		return base.HTTPErrorf(http.StatusForbidden, "Attachment's doc not being synced")
 	}
-	attachment, err := bh.db.GetAttachment(AttachmentKey(digest))
+	if !bh.authorizeAttachment(bh.allowedAttachmentDocIDs(digest), digest) {
+		return base.HTTPErrorf(http.StatusForbidden, "Attachment not authorized")
+	}
+	// Repeated requests for an attachment recently served on this connection are handled by the configured policy,
+	// after each has passed its own access check
+	attachment, err := bh.checkAttachmentRepeat(digest)
 	if err != nil {
 		return err
-
+	}
+	if attachment == nil {
+		// Concurrent requests for the same attachment share a single load, after each has passed its own access check
+		var coalesced bool
+		err = bh.runWithDeadline(func() (err error) {
+			attachment, coalesced, err = bh.db.attachmentLoads.load(digest, func() ([]byte, error) {
+				return bh.getMappedAttachment(digest)
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if coalesced {
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttCoalescedPullCount, 1)
+			bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttCoalescedBytesSaved, int64(len(attachment)))
+		}
+		bh.attachmentRepeats.served(digest, attachment)
+	}
+	if err := bh.checkAttachmentSize(digest, int64(len(attachment))); err != nil {
+		return err
 	}
 	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Sending attachment with digest=%q (%dkb)", digest, len(attachment)/1024)
-	response := rq.Response()
-	response.SetBody(attachment)
-	response.SetCompressed(rq.Properties[BlipCompress] == "true")
+	sentLength, err := bh.setAttachmentResponseBody(rq.Response(), getAttachmentParams, attachment)
+	if err != nil {
+		return err
+	}
 	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullCount, 1)
-	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullBytes, int64(len(attachment)))
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullBytes, int64(sentLength))
 
 	return nil
 }
 
+// getMappedAttachment loads the attachment with the given digest, from the key the configured AttachmentDigestMapper
+// maps the digest to, if any.  A remapped attachment is only returned if its content matches the digest, so that a
+// faulty mapping can't serve or prove the wrong data.
+func (bh *blipHandler) getMappedAttachment(digest string) ([]byte, error) {
+	// An attachment stored under a sha256 digest is fetched by the sha1 digest it was announced under, when the
+	// connection didn't negotiate sha256
+	if sha256Digest, aliased := bh.aliasedAttachmentDigest(digest); aliased {
+		return bh.db.GetAttachment(AttachmentKey(sha256Digest))
+	}
+	mapper := bh.db.Options.BlipSyncOptions.AttachmentDigestMapper
+	if mapper == nil {
+		return bh.db.GetAttachment(AttachmentKey(digest))
+	}
+	storedDigest := mapper(digest)
+	data, err := bh.db.GetAttachment(AttachmentKey(storedDigest))
+	if err != nil || storedDigest == digest {
+		return data, err
+	}
+	if DigestKeyLike(digest, data) != digest {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Attachment stored under digest %s, mapped from %s, doesn't match that digest - ignoring it", storedDigest, digest)
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyAttDigestMismatch, 1)
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return data, nil
+}
+
 // For each attachment in the revision, makes sure it's in the database, asking the client to
-// upload it if necessary. This method blocks until all the attachments have been processed.
-func (bh *blipHandler) downloadOrVerifyAttachments(sender *blip.Sender, body Body, minRevpos int, docID string) error {
-	return bh.db.ForEachStubAttachment(body, minRevpos,
+// upload it if necessary. This method blocks until all the attachments have been processed.  When batchProofs is
+// set, the client is asked to prove it has all the attachments the server already has in a single round trip.
+// Returns the attachments that were stored for the rev, even on error, for the caller to remove if the rev isn't
+// written.
+func (bh *blipHandler) downloadOrVerifyAttachments(sender *blip.Sender, body Body, minRevpos int, docID string, batchProofs bool) (newAttachments []newAttachment, err error) {
+	var knownAttachments map[string][]byte // Digest to data, for attachments to prove in a batch
+	err = bh.db.ForEachStubAttachment(body, minRevpos,
 		func(name string, digest string, knownData []byte, meta map[string]interface{}) ([]byte, error) {
+			if err := bh.checkAttachmentDigest(digest); err != nil {
+				return nil, err
+			}
+			// An attachment stored under a different digest is looked up by its mapped digest instead
+			if bh.db.Options.BlipSyncOptions.AttachmentDigestMapper != nil {
+				var err error
+				if knownData, err = bh.getMappedAttachment(digest); err != nil && !base.IsDocNotFoundError(err) {
+					return nil, err
+				}
+			}
+			// An attachment the user isn't authorized for is requested as if the server didn't have it, so that
+			// asking for a proof doesn't reveal that it exists
+			if knownData != nil && !bh.authorizeAttachment([]string{docID}, digest) {
+				knownData = nil
+			}
 			if knownData != nil {
 				// If I have the attachment already I don't need the client to send it, but for
 				// security purposes I do need the client to _prove_ it has the data, otherwise if
 				// it knew the digest it could acquire the data by uploading a document with the
 				// claimed attachment, then downloading it.
 				base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "    Verifying attachment %q for doc %s (digest %s)", base.UD(name), base.UD(docID), digest)
-				nonce, proof := GenerateProofOfAttachment(knownData)
-				outrq := blip.NewRequest()
-				outrq.Properties = map[string]string{BlipProfile: MessageProveAttachment, ProveAttachmentDigest: digest}
-				outrq.SetBody(nonce)
-				if !bh.sendBLIPMessage(sender, outrq) {
-					return nil, ErrClosedBLIPSender
+				if batchProofs {
+					if knownAttachments == nil {
+						knownAttachments = make(map[string][]byte)
+					}
+					knownAttachments[digest] = knownData
+					return nil, nil
 				}
-				if body, err := outrq.Response().Body(); err != nil {
-					base.WarnfCtx(bh.blipContextDb.Ctx, "Error returned for proveAttachment message for doc %s (digest %s).  Error: %v", base.UD(docID), digest, err)
+				return nil, bh.proveAttachment(sender, docID, digest, knownData)
+			} else {
+				// If I don't have the attachment, I will request it from the client, unless it's too large to accept:
+				if err := bh.checkDeclaredAttachmentSize(name, meta); err != nil {
 					return nil, err
-				} else if string(body) != proof {
-					base.WarnfCtx(bh.blipContextDb.Ctx, "Incorrect proof for attachment %s : I sent nonce %x, expected proof %q, got %q", digest, base.MD(nonce), base.MD(proof), base.MD(string(body)))
-					return nil, base.HTTPErrorf(http.StatusForbidden, "Incorrect proof for attachment %s", digest)
-				} else {
-					base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "proveAttachment successful for doc %s (digest %s)", base.UD(docID), digest)
 				}
-				return nil, nil
-			} else {
-				// If I don't have the attachment, I will request it from the client:
 				base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "    Asking for attachment %q for doc %s (digest %s)", base.UD(name), base.UD(docID), digest)
-				outrq := blip.NewRequest()
-				outrq.Properties = map[string]string{BlipProfile: MessageGetAttachment, GetAttachmentDigest: digest}
-				if isCompressible(name, meta) {
-					outrq.Properties[BlipCompress] = "true"
+				length, cas, err := bh.downloadAttachment(sender, name, digest, meta)
+				if cas != 0 {
+					newAttachments = append(newAttachments, newAttachment{digest: digest, cas: cas})
 				}
-				if !bh.sendBLIPMessage(sender, outrq) {
-					return nil, ErrClosedBLIPSender
-				}
-				attBody, err := outrq.Response().Body()
 				if err != nil {
 					return nil, err
 				}
+				// The attachment's already stored, so the rev only needs to record it
+				meta["data"] = streamedAttachment(length)
+				delete(meta, "stub")
+				delete(meta, "follows")
+				return nil, nil
+			}
+		})
+	if err != nil {
+		return newAttachments, err
+	}
 
-				lNum, metaLengthOK := meta["length"].(json.Number)
-				metaLength, err := lNum.Int64()
-				if err != nil {
-					return nil, err
-				}
+	// A single proof doesn't save a round trip, so it's sent the same way as for clients that can't batch
+	if len(knownAttachments) == 1 {
+		for digest, knownData := range knownAttachments {
+			return newAttachments, bh.proveAttachment(sender, docID, digest, knownData)
+		}
+	} else if len(knownAttachments) > 1 {
+		return newAttachments, bh.proveAttachments(sender, docID, knownAttachments)
+	}
+	return newAttachments, nil
+}
 
-				// Verify that the attachment we received matches the metadata stored in the document
-				if !metaLengthOK || len(attBody) != int(metaLength) || Sha1DigestKey(attBody) != digest {
-					return nil, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
-				}
+// checkDeclaredAttachmentSize rejects an attachment whose metadata declares a length beyond the maximum attachment
+// size, before it's requested from the client.  An attachment without a valid length is rejected once it's requested.
+func (bh *blipHandler) checkDeclaredAttachmentSize(name string, meta map[string]interface{}) error {
+	maxSize := bh.db.Options.BlipSyncOptions.MaxAttachmentSize
+	if maxSize <= 0 {
+		return nil
+	}
+	lengthNumber, ok := meta["length"].(json.Number)
+	if !ok {
+		return nil
+	}
+	if length, err := lengthNumber.Int64(); err == nil && length > maxSize {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Attachment %q is %d bytes, more than the maximum of %d", base.UD(name), length, maxSize)
+	}
+	return nil
+}
 
-				return attBody, nil
-			}
-		})
+// checkAttachmentSize rejects attachment data beyond the maximum attachment size.
+func (bh *blipHandler) checkAttachmentSize(digest string, size int64) error {
+	if maxSize := bh.db.Options.BlipSyncOptions.MaxAttachmentSize; maxSize > 0 && size > maxSize {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Attachment with digest %s is %d bytes, more than the maximum of %d", digest, size, maxSize)
+	}
+	return nil
+}
+
+// downloadAttachment requests an attachment from the client and stores it, returning its length, and the CAS it was
+// stored with as for StoreVerifiedAttachment.  When attachment download retries are enabled, a request the client fails
+// with a 5xx error is retried with a doubling backoff, so that a transient failure fetching one of a rev's attachments
+// doesn't fail the whole rev.
+func (bh *blipHandler) downloadAttachment(sender *blip.Sender, name, digest string, meta map[string]interface{}) (length int64, cas uint64, err error) {
+	options := bh.db.Options.BlipSyncOptions
+	backoff := options.AttachmentRetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultAttachmentRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		length, cas, err = bh.requestAttachment(sender, name, digest, meta)
+		if err == nil || cas != 0 || attempt >= options.AttachmentRetries || !isTransientAttachmentError(err) {
+			return length, cas, err
+		}
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Retrying getAttachment for digest %s in %v after error: %v", digest, backoff, err)
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyAttDownloadRetries, 1)
+		if err := bh.sleepUnlessClosed(backoff); err != nil {
+			return 0, 0, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleepUnlessClosed waits for the given duration, returning early with an error if the connection is closed or the
+// request's deadline elapses.
+func (bh *blipHandler) sleepUnlessClosed(duration time.Duration) error {
+	var deadline <-chan struct{}
+	if bh.ctx != nil {
+		deadline = bh.ctx.Done()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-bh.terminator:
+		return ErrClosedBLIPSender
+	case <-deadline:
+		return ErrBLIPDeadlineExceeded
+	}
+}
+
+// requestAttachment sends a getAttachment request for an attachment, and streams the data the client responds with to
+// the bucket, verifying it as it's stored.  Returns the attachment's length, and the CAS it was stored with as for
+// StoreVerifiedAttachment.
+func (bh *blipHandler) requestAttachment(sender *blip.Sender, name, digest string, meta map[string]interface{}) (int64, uint64, error) {
+	lengthNumber, ok := meta["length"].(json.Number)
+	if !ok {
+		return 0, 0, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
+	}
+	length, err := lengthNumber.Int64()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	outrq := blip.NewRequest()
+	outrq.Properties = map[string]string{
+		BlipProfile:         MessageGetAttachment,
+		GetAttachmentDigest: digest,
+		GetAttachmentAccept: strings.Join(SupportedAttachmentEncodings, ","),
+	}
+	if isCompressible(name, meta) {
+		outrq.Properties[BlipCompress] = "true"
+	}
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return 0, 0, ErrClosedBLIPSender
+	}
+	response, err := bh.waitForResponse(outrq)
+	if err != nil {
+		return 0, 0, err
+	}
+	if response.Type() == blip.ErrorType {
+		status, _ := strconv.Atoi(response.Properties["Error-Code"])
+		return 0, 0, &ErrAttachmentDownload{Digest: digest, Status: status}
+	}
+	body, err := response.BodyReader()
+	if err == io.EOF {
+		// The reader of an empty body is an EOF, but an empty attachment is still verified and stored
+		body, err = bytes.NewReader(nil), nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if encoding := response.Properties[GetAttachmentEncoding]; encoding != "" {
+		return bh.storeEncodedAttachment(body, encoding, length, digest)
+	}
+	return bh.storeAttachment(body, length, digest)
+}
+
+// storeAttachment streams attachment data to the bucket, verifying it against the attachment's metadata as it's stored.
+// The client may send more than the attachment's declared length, so the data received is checked against the
+// maximum attachment size too.
+func (bh *blipHandler) storeAttachment(r io.Reader, length int64, digest string) (int64, uint64, error) {
+	limit := length + 1
+	maxSize := bh.db.Options.BlipSyncOptions.MaxAttachmentSize
+	if maxSize >= length && maxSize+1 > limit {
+		limit = maxSize + 1
+	}
+	n, cas, err := bh.db.StoreVerifiedAttachment(r, length, limit, digest)
+	if sizeErr := bh.checkAttachmentSize(digest, n); sizeErr != nil {
+		return 0, cas, sizeErr
+	}
+	return n, cas, err
+}
+
+// storeEncodedAttachment decompresses an attachment the client compressed with the given encoding as it's stored,
+// verifying the decompressed data against the attachment's metadata.
+func (bh *blipHandler) storeEncodedAttachment(r io.Reader, encoding string, length int64, digest string) (int64, uint64, error) {
+	encoded := &countingReader{r: r}
+	decoder, err := NewAttachmentDecoder(encoding, encoded)
+	if err != nil {
+		if _, ok := err.(*base.HTTPError); ok {
+			return 0, 0, err
+		}
+		return 0, 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid %s data sent for attachment with digest: %s", encoding, digest)
+	}
+	n, cas, err := bh.storeAttachment(decoder, length, digest)
+	if err != nil {
+		if _, ok := err.(*base.HTTPError); ok {
+			return 0, cas, err
+		}
+		return 0, cas, base.HTTPErrorf(http.StatusBadRequest, "Invalid %s data sent for attachment with digest: %s", encoding, digest)
+	}
+	// Count any of the encoded data the decoder didn't need to read
+	if _, err := io.Copy(ioutil.Discard, encoded); err != nil {
+		return 0, cas, err
+	}
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyAttCompressedPush, 1)
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyAttUploadBytesSaved, length-encoded.n)
+	return n, cas, nil
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// proveAttachment asks the client to prove it has an attachment the server already has, with a proveAttachment
+// request.
+func (bh *blipHandler) proveAttachment(sender *blip.Sender, docID, digest string, knownData []byte) error {
+	nonce, proof := GenerateProofOfAttachmentWithAlgorithm(DigestAlgorithm(digest), knownData)
+	outrq := blip.NewRequest()
+	outrq.Properties = map[string]string{BlipProfile: MessageProveAttachment, ProveAttachmentDigest: digest}
+	outrq.SetBody(nonce)
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return ErrClosedBLIPSender
+	}
+	response, err := bh.waitForResponse(outrq)
+	if err != nil {
+		return err
+	}
+	if body, err := response.Body(); err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Error returned for proveAttachment message for doc %s (digest %s).  Error: %v", base.UD(docID), digest, err)
+		return err
+	} else if string(body) != proof {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Incorrect proof for attachment %s : I sent nonce %x, expected proof %q, got %q", digest, base.MD(nonce), base.MD(proof), base.MD(string(body)))
+		return base.HTTPErrorf(http.StatusForbidden, "Incorrect proof for attachment %s", digest)
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "proveAttachment successful for doc %s (digest %s)", base.UD(docID), digest)
+	return nil
+}
+
+// proveAttachments asks the client to prove it has several attachments the server already has, with a single
+// proveAttachments request.  The request body maps each digest to a base64-encoded nonce, and the client responds
+// with a map of each digest to its proof.  Every proof must be present and correct.
+func (bh *blipHandler) proveAttachments(sender *blip.Sender, docID string, knownAttachments map[string][]byte) error {
+	nonces := make(map[string][]byte, len(knownAttachments)) // Marshalled as base64
+	proofs := make(map[string]string, len(knownAttachments))
+	for digest, knownData := range knownAttachments {
+		nonces[digest], proofs[digest] = GenerateProofOfAttachmentWithAlgorithm(DigestAlgorithm(digest), knownData)
+	}
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageProveBatch)
+	if err := outrq.SetJSONBody(nonces); err != nil {
+		return err
+	}
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return ErrClosedBLIPSender
+	}
+	response, err := bh.waitForResponse(outrq)
+	if err != nil {
+		return err
+	}
+	var receivedProofs map[string]string
+	if err := response.ReadJSONBody(&receivedProofs); err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Error returned for proveAttachments message for doc %s.  Error: %v", base.UD(docID), err)
+		return err
+	}
+	for digest, proof := range proofs {
+		if receivedProofs[digest] != proof {
+			base.WarnfCtx(bh.blipContextDb.Ctx, "Incorrect proof for attachment %s : I sent nonce %x, expected proof %q, got %q", digest, base.MD(nonces[digest]), base.MD(proof), base.MD(receivedProofs[digest]))
+			return base.HTTPErrorf(http.StatusForbidden, "Incorrect proof for attachment %s", digest)
+		}
+	}
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyProofBatchCount, 1)
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "proveAttachments successful for doc %s (%d digests)", base.UD(docID), len(proofs))
+	return nil
 }
 
 func (bsc *BlipSyncContext) incrementSerialNumber() uint64 {
 	return atomic.AddUint64(&bsc.handlerSerialNumber, 1)
 }
 
-func (bsc *BlipSyncContext) addAllowedAttachments(attDigests []string) {
+func (bsc *BlipSyncContext) addAllowedAttachments(docID string, attDigests []string) {
 	bsc.lock.Lock()
 	defer bsc.lock.Unlock()
 	if bsc.allowedAttachments == nil {
 		bsc.allowedAttachments = make(map[string]int, 100)
+		bsc.allowedAttachmentDocs = make(map[string]map[string]int, 100)
 	}
 	for _, digest := range attDigests {
 		bsc.allowedAttachments[digest] = bsc.allowedAttachments[digest] + 1
+		if bsc.allowedAttachmentDocs[digest] == nil {
+			bsc.allowedAttachmentDocs[digest] = make(map[string]int, 1)
+		}
+		bsc.allowedAttachmentDocs[digest][docID]++
 	}
+	bsc.blipContextDb.attachmentRefs.acquire(attDigests)
 	base.TracefCtx(bsc.blipContextDb.Ctx, base.KeySync, "addAllowedAttachments, added: %v current set: %v", attDigests, bsc.allowedAttachments)
 }
 
-func (bsc *BlipSyncContext) removeAllowedAttachments(attDigests []string) {
+func (bsc *BlipSyncContext) removeAllowedAttachments(docID string, attDigests []string) {
 	bsc.lock.Lock()
 	defer bsc.lock.Unlock()
 	for _, digest := range attDigests {
@@ -772,11 +2486,76 @@ func (bsc *BlipSyncContext) removeAllowedAttachments(attDigests []string) {
 		} else {
 			delete(bsc.allowedAttachments, digest)
 		}
+		if n := bsc.allowedAttachmentDocs[digest][docID]; n > 1 {
+			bsc.allowedAttachmentDocs[digest][docID] = n - 1
+		} else {
+			delete(bsc.allowedAttachmentDocs[digest], docID)
+			if len(bsc.allowedAttachmentDocs[digest]) == 0 {
+				delete(bsc.allowedAttachmentDocs, digest)
+			}
+		}
 	}
+	bsc.blipContextDb.attachmentRefs.release(attDigests)
 
 	base.TracefCtx(bsc.blipContextDb.Ctx, base.KeySync, "removeAllowedAttachments, removed: %v current set: %v", attDigests, bsc.allowedAttachments)
 }
 
+// deniedChannels returns the subset of the given channels that are in the configured BLIP channel denylist.
+func (bsc *BlipSyncContext) deniedChannels(chans []string) (denied []string) {
+	deniedChannels := bsc.blipContextDb.Options.BlipSyncOptions.DeniedChannels
+	if len(deniedChannels) == 0 {
+		return nil
+	}
+	for _, channel := range chans {
+		if deniedChannels.Contains(channel) {
+			denied = append(denied, channel)
+		}
+	}
+	return denied
+}
+
+// clampBatchSize returns the subChanges batch size the client asked for, clamped to the configured maximum so that a
+// misbehaving client can't have huge batches of changes buffered before they're sent.
+func (bsc *BlipSyncContext) clampBatchSize(requested int) int {
+	maxBatchSize := bsc.blipContextDb.Options.BlipSyncOptions.MaxChangesBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultMaxChangesBatchSize
+	}
+	if requested <= maxBatchSize {
+		return requested
+	}
+	base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "Requested subChanges batch size %d exceeds the maximum - using %d", requested, maxBatchSize)
+	return maxBatchSize
+}
+
+// runWithDeadline runs fn, returning ErrBLIPDeadlineExceeded if the request's deadline elapses first.  fn isn't
+// interrupted when the deadline elapses, so should only be used for operations that are safe to abandon.
+func (bh *blipHandler) runWithDeadline(fn func() error) error {
+	if bh.ctx == nil || bh.ctx.Done() == nil {
+		return fn()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-bh.ctx.Done():
+		return ErrBLIPDeadlineExceeded
+	}
+}
+
+// waitForResponse waits for the response to an outgoing request.  Returns ErrClosedBLIPSender if the connection is
+// closed first, or ErrBLIPDeadlineExceeded if the request's deadline elapses first.
+func (bh *blipHandler) waitForResponse(outrq *blip.Message) (response *blip.Message, err error) {
+	var deadline <-chan struct{}
+	if bh.ctx != nil {
+		deadline = bh.ctx.Done()
+	}
+	return bh.awaitResponse(outrq, deadline)
+}
+
 func (bh *blipHandler) logEndpointEntry(profile, endpoint string) {
 	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Type:%s %s", bh.serialNumber, profile, endpoint)
 }
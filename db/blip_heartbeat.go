@@ -0,0 +1,97 @@
+package db
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A continuous pull only signals the client that it's caught up once, so during a long pull the client has no view of
+// where the server's feed has got to.  A client may ask for heartbeats with the subChanges 'heartbeatInterval'
+// property, in seconds, in which case the feed sends a "heartbeat" message at that interval carrying the last
+// sequence it sent, the database's current high sequence and the time.  Heartbeats need no reply and are sent
+// alongside changes batches rather than in them, so they neither hold a batch up nor count towards the batches the
+// client has to respond to.  They stop once the feed ends.
+
+// heartbeatSender sends heartbeats on a continuous feed at a fixed interval.
+type heartbeatSender struct {
+	send        func(lastSentSeq SequenceID) error
+	lastSentSeq SequenceID
+	lock        sync.Mutex    // Guards lastSentSeq
+	stopped     chan struct{} // Closed to stop sending heartbeats
+	done        chan struct{} // Closed once heartbeats have stopped
+}
+
+// startHeartbeats starts sending heartbeats at the given interval until stopped or the terminator is closed, returning
+// nil (which sends none) when interval isn't positive.
+func startHeartbeats(interval time.Duration, since SequenceID, terminator chan bool, send func(lastSentSeq SequenceID) error) *heartbeatSender {
+	if interval <= 0 {
+		return nil
+	}
+	h := &heartbeatSender{
+		send:        send,
+		lastSentSeq: since,
+		stopped:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go h.run(interval, terminator)
+	return h
+}
+
+// sent records the last sequence the feed has sent, for the next heartbeat to report.
+func (h *heartbeatSender) sent(seq SequenceID) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	h.lastSentSeq = seq
+	h.lock.Unlock()
+}
+
+// stop stops sending heartbeats once the feed has ended, waiting for any heartbeat being sent.
+func (h *heartbeatSender) stop() {
+	if h == nil {
+		return
+	}
+	close(h.stopped)
+	<-h.done
+}
+
+func (h *heartbeatSender) run(interval time.Duration, terminator chan bool) {
+	defer close(h.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopped:
+			return
+		case <-terminator:
+			return
+		case <-ticker.C:
+		}
+		h.lock.Lock()
+		lastSentSeq := h.lastSentSeq
+		h.lock.Unlock()
+		if err := h.send(lastSentSeq); err != nil {
+			return
+		}
+	}
+}
+
+// sendHeartbeat sends the client a heartbeat reporting the last sequence the feed sent it.
+func (bh *blipHandler) sendHeartbeat(sender *blip.Sender, lastSentSeq SequenceID) error {
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageHeartbeat)
+	outrq.SetNoReply(true)
+	outrq.Properties[HeartbeatSequence] = lastSentSeq.String()
+	outrq.Properties[HeartbeatHighSeq] = strconv.FormatUint(bh.db.GetChangeCache().LastSequence(), 10)
+	outrq.Properties[HeartbeatTimestamp] = time.Now().UTC().Format(time.RFC3339Nano)
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return ErrClosedBLIPSender
+	}
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyHeartbeatSentCount, 1)
+	return nil
+}
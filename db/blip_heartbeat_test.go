@@ -0,0 +1,54 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHeartbeatSender verifies heartbeats are sent at the interval with no feed activity, report the last sequence
+// sent, and stop when the terminator is closed.
+func TestHeartbeatSender(t *testing.T) {
+	assert.Nil(t, startHeartbeats(0, SequenceID{}, nil, nil))
+
+	var lock sync.Mutex
+	var sentAt []time.Time
+	var sentSeqs []SequenceID
+	terminator := make(chan bool)
+	start := time.Now()
+	heartbeats := startHeartbeats(50*time.Millisecond, SequenceID{Seq: 5}, terminator, func(lastSentSeq SequenceID) error {
+		lock.Lock()
+		defer lock.Unlock()
+		sentAt = append(sentAt, time.Now())
+		sentSeqs = append(sentSeqs, lastSentSeq)
+		return nil
+	})
+
+	time.Sleep(120 * time.Millisecond)
+	heartbeats.sent(SequenceID{Seq: 8})
+	time.Sleep(110 * time.Millisecond)
+	close(terminator)
+	<-heartbeats.done
+	heartbeats.stop()
+
+	sent := func() []time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]time.Time(nil), sentAt...)
+	}
+	if assert.True(t, len(sent()) >= 3, "Expected at least 3 heartbeats, got %d", len(sent())) {
+		assert.True(t, sent()[0].Sub(start) >= 50*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, SequenceID{Seq: 5}, sentSeqs[0])
+		assert.Equal(t, SequenceID{Seq: 8}, sentSeqs[len(sentSeqs)-1])
+		lock.Unlock()
+	}
+	assert.True(t, len(sent()) <= 5, "Expected at most 5 heartbeats, got %d", len(sent()))
+
+	// Nothing more is sent once stopped
+	count := len(sent())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, count, len(sent()))
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// idempotencyStoreMaxEntries is the number of idempotency keys retained before the oldest are evicted, regardless of TTL.
+const idempotencyStoreMaxEntries = 100000
+
+// idempotencyStore remembers the outcome of recently pushed revs that carried a client-supplied idempotency key, so
+// that a retried push with the same key returns the original result instead of being written again.  Keys are
+// retained for the TTL, or until idempotencyStoreMaxEntries newer keys have been recorded, whichever is sooner.
+// Beyond that window a retry is processed as a new push.  The store is in-memory and per node: a retry that reaches
+// a different Sync Gateway node, or follows a restart, isn't recognised.
+type idempotencyStore struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*list.Element // Key to element of order, whose value is an *idempotencyEntry
+	order   *list.List               // Entries from oldest to newest.  As the TTL is fixed, this is also expiry order
+}
+
+type idempotencyEntry struct {
+	key       string
+	expiresAt time.Time
+	done      chan struct{} // Closed once the result is known
+	result    error
+}
+
+// newIdempotencyStore returns an idempotency key store with the given TTL, or nil when the TTL is zero (disabled).
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// begin registers a push with the given key.  If the key has already been seen, the existing entry is returned with
+// found=true, and the caller should wait for and return its result.  Otherwise the caller must call finish with the
+// result of the push.
+func (s *idempotencyStore) begin(key string) (entry *idempotencyEntry, found bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for front := s.order.Front(); front != nil; front = s.order.Front() {
+		oldest := front.Value.(*idempotencyEntry)
+		if len(s.entries) < idempotencyStoreMaxEntries && now.Before(oldest.expiresAt) {
+			break
+		}
+		s.removeElement(front)
+	}
+
+	if element, ok := s.entries[key]; ok {
+		return element.Value.(*idempotencyEntry), true
+	}
+
+	entry = &idempotencyEntry{
+		key:       key,
+		expiresAt: now.Add(s.ttl),
+		done:      make(chan struct{}),
+	}
+	s.entries[key] = s.order.PushBack(entry)
+	return entry, false
+}
+
+// finish records the result of the push registered by begin.  Only definitive results are retained: successful
+// writes, and rejections the client can't fix by retrying (4xx statuses).  Otherwise the key is forgotten so that a
+// retry is processed as a new push, and anyone already waiting on the entry gets the same error.
+func (s *idempotencyStore) finish(entry *idempotencyEntry, result error) {
+	entry.result = result
+	if result != nil {
+		if status, _ := base.ErrorAsHTTPStatus(result); status < 400 || status >= 500 {
+			s.lock.Lock()
+			if element, ok := s.entries[entry.key]; ok && element.Value == entry {
+				s.removeElement(element)
+			}
+			s.lock.Unlock()
+		}
+	}
+	close(entry.done)
+}
+
+// wait blocks until the result of the entry's push is known, and returns it.
+func (entry *idempotencyEntry) wait(terminator chan bool) error {
+	select {
+	case <-entry.done:
+		return entry.result
+	case <-terminator:
+		return ErrClosedBLIPSender
+	}
+}
+
+func (s *idempotencyStore) removeElement(element *list.Element) {
+	delete(s.entries, element.Value.(*idempotencyEntry).key)
+	s.order.Remove(element)
+}
+
+// idempotencyKey scopes a client-supplied idempotency key to the user, so that one user can't observe the result of
+// another user's push.
+func idempotencyKey(userName, key string) string {
+	return userName + "/" + key
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIdempotencyStore verifies definitive results are replayed for a repeated key, while transient failures and
+// expired keys allow the push to be retried.
+func TestIdempotencyStore(t *testing.T) {
+	assert.Nil(t, newIdempotencyStore(0))
+
+	store := newIdempotencyStore(time.Minute)
+	terminator := make(chan bool)
+
+	// Successful push is replayed
+	entry, found := store.begin(idempotencyKey("alice", "key1"))
+	assert.False(t, found)
+	store.finish(entry, nil)
+	entry, found = store.begin(idempotencyKey("alice", "key1"))
+	assert.True(t, found)
+	assert.NoError(t, entry.wait(terminator))
+
+	// The same key from another user is a different push
+	_, found = store.begin(idempotencyKey("bob", "key1"))
+	assert.False(t, found)
+
+	// Client errors are replayed
+	conflictErr := base.HTTPErrorf(http.StatusConflict, "conflict")
+	entry, _ = store.begin(idempotencyKey("alice", "key2"))
+	store.finish(entry, conflictErr)
+	entry, found = store.begin(idempotencyKey("alice", "key2"))
+	assert.True(t, found)
+	assert.Equal(t, conflictErr, entry.wait(terminator))
+
+	// Transient errors aren't retained
+	entry, _ = store.begin(idempotencyKey("alice", "key3"))
+	store.finish(entry, base.HTTPErrorf(http.StatusServiceUnavailable, "unavailable"))
+	_, found = store.begin(idempotencyKey("alice", "key3"))
+	assert.False(t, found)
+
+	// Keys expire after the TTL
+	store = newIdempotencyStore(time.Millisecond)
+	entry, _ = store.begin(idempotencyKey("alice", "key1"))
+	store.finish(entry, nil)
+	time.Sleep(5 * time.Millisecond)
+	_, found = store.begin(idempotencyKey("alice", "key1"))
+	assert.False(t, found)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// BlipKeepaliveHeader is the header of the WebSocket upgrade request in which a client asks for keepalives, as the
+// interval in seconds it wants them at.
+const BlipKeepaliveHeader = "X-Keepalive-Interval"
+
+// NegotiateKeepalive sets the interval keepalives are sent to the client at, from the interval it asked for in the
+// headers of its handshake request.  Keepalives are only sent to clients that ask for them, when the database enables
+// them, and never more often than BlipSyncOptions.MinKeepaliveInterval.  Must be called before the connection handles
+// any requests.
+func (bsc *BlipSyncContext) NegotiateKeepalive(headers http.Header) {
+	bsc.keepaliveInterval = negotiateKeepaliveInterval(headers.Get(BlipKeepaliveHeader), bsc.blipContextDb.Options.BlipSyncOptions.MinKeepaliveInterval)
+}
+
+// negotiateKeepaliveInterval returns the keepalive interval for a client asking for the given number of seconds, or
+// zero when it didn't ask or keepalives are disabled.
+func negotiateKeepaliveInterval(requested string, minInterval time.Duration) time.Duration {
+	if requested == "" || minInterval <= 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseUint(requested, 10, 32)
+	if err != nil || seconds == 0 {
+		return 0
+	}
+	interval := time.Duration(seconds) * time.Second
+	if interval < minInterval {
+		interval = minInterval
+	}
+	return interval
+}
+
+// keepaliveSender sends keepalive messages on a continuous feed that's caught up, whenever it's been idle for the
+// negotiated interval, so that proxies and load balancers don't close the connection for inactivity.  Keepalives are
+// sent as "keepalive" requests that need no reply, so clients can tell them apart from changes and needn't treat
+// them as replication activity.
+type keepaliveSender struct {
+	interval     time.Duration
+	send         func() error
+	lastActivity int64 // UnixNano when the feed last sent a message.  Atomic access
+	stopped      chan struct{}
+}
+
+// startKeepalives starts sending keepalives at the given interval, returning nil (which sends none) when interval
+// isn't positive.
+func startKeepalives(interval time.Duration, send func() error) *keepaliveSender {
+	if interval <= 0 {
+		return nil
+	}
+	k := &keepaliveSender{
+		interval:     interval,
+		send:         send,
+		lastActivity: time.Now().UnixNano(),
+		stopped:      make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+// activity records that the feed has sent the client a message, postponing the next keepalive.
+func (k *keepaliveSender) activity() {
+	if k == nil {
+		return
+	}
+	atomic.StoreInt64(&k.lastActivity, time.Now().UnixNano())
+}
+
+// stop stops sending keepalives, once the feed has ended.
+func (k *keepaliveSender) stop() {
+	if k == nil {
+		return
+	}
+	close(k.stopped)
+}
+
+func (k *keepaliveSender) run() {
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.stopped:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&k.lastActivity)))
+		if idle >= k.interval {
+			if err := k.send(); err != nil {
+				return
+			}
+			k.activity()
+			idle = 0
+		}
+		timer.Reset(k.interval - idle)
+	}
+}
+
+// sendKeepalive sends the client a keepalive message.
+func (bh *blipHandler) sendKeepalive(sender *blip.Sender) error {
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageKeepalive)
+	outrq.SetNoReply(true)
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return ErrClosedBLIPSender
+	}
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyKeepaliveSentCount, 1)
+	return nil
+}
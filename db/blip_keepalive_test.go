@@ -0,0 +1,49 @@
+package db
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateKeepaliveInterval(t *testing.T) {
+	for _, test := range []struct {
+		requested   string
+		minInterval time.Duration
+		expected    time.Duration
+	}{
+		{"", 10 * time.Second, 0}, // Client didn't ask
+		{"30", 0, 0},              // Keepalives disabled
+		{"30", 10 * time.Second, 30 * time.Second},
+		{"5", 10 * time.Second, 10 * time.Second}, // Raised to the minimum
+		{"0", 10 * time.Second, 0},
+		{"abc", 10 * time.Second, 0},
+	} {
+		assert.Equal(t, test.expected, negotiateKeepaliveInterval(test.requested, test.minInterval), "requested %q", test.requested)
+	}
+}
+
+// TestKeepaliveSender verifies keepalives are sent while the feed is idle, and postponed by activity.
+func TestKeepaliveSender(t *testing.T) {
+	assert.Nil(t, startKeepalives(0, nil))
+
+	var sent int32
+	keepalives := startKeepalives(50*time.Millisecond, func() error {
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+
+	// Activity more often than the interval postpones keepalives
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		keepalives.activity()
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&sent))
+
+	// Once idle, keepalives are sent
+	time.Sleep(175 * time.Millisecond)
+	keepalives.stop()
+	assert.True(t, atomic.LoadInt32(&sent) >= 2, "Expected at least 2 keepalives, got %d", atomic.LoadInt32(&sent))
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// BlipMultiplexHeader is the header of the WebSocket upgrade request in which a client lists, comma-separated, the
+	// databases besides the one it connected to that it wants to replicate over the same connection.
+	BlipMultiplexHeader = "X-Multiplex-Databases"
+
+	// BlipDatabase is the message property naming the database a message is for, on a connection multiplexing several
+	// databases.  Messages without it are for the database the client connected to, as on any other connection.
+	BlipDatabase = "database"
+)
+
+// A gateway aggregating many user databases would otherwise need a connection per database.  When the database
+// connected to enables it with BlipSyncOptions.MaxMultiplexedDatabases, a client may list other databases in the
+// X-Multiplex-Databases handshake header, each of which it must be able to authenticate to as it did to the first.
+// Each is attached with its own BlipSyncContext, so that it has its own subscription, handler state, options and
+// stats, just as on a connection of its own.  Requests carrying the 'database' property are routed to that database's
+// context, and messages a multiplexed database sends carry it too, so that the client can route them in turn.  Clients
+// learn which databases were attached from getCapabilities.  Without the header, or when the connected database
+// doesn't enable multiplexing, the connection is a single database's as before.
+
+// ParseMultiplexDatabases returns the distinct database names listed in the value of a X-Multiplex-Databases header,
+// excluding the database connected to.
+func ParseMultiplexDatabases(header string, connectedDb string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(header, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == connectedDb || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// AttachMultiplexedDatabase attaches another database to the connection, as the given user's database instance,
+// returning its context so that the handshake can be negotiated for it too.  Must be called before the connection
+// handles any requests.
+func (bsc *BlipSyncContext) AttachMultiplexedDatabase(database *Database) *BlipSyncContext {
+	multiplexed := newBlipSyncContext(bsc.blipContext, database)
+	multiplexed.multiplexName = database.Name
+	multiplexed.multiplexHandlers = make(map[string]blip.Handler, len(kHandlersByProfile))
+	for profile, handlerFn := range kHandlersByProfile {
+		multiplexed.register(profile, handlerFn)
+	}
+	bsc.multiplexed = append(bsc.multiplexed, multiplexed)
+	database.DbStats.StatsDatabase().Add(base.StatKeyMultiplexedConnections, 1)
+	return multiplexed
+}
+
+// MultiplexedDatabases returns the names of the databases attached to the connection, sorted.
+func (bsc *BlipSyncContext) MultiplexedDatabases() []string {
+	names := make([]string, 0, len(bsc.multiplexed))
+	for _, multiplexed := range bsc.multiplexed {
+		names = append(names, multiplexed.multiplexName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// routeMultiplexed hands a request carrying the 'database' property to the handler of the attached database it names,
+// returning false when it's for this context's own database.  Requests for databases that aren't attached are
+// rejected with a 404.
+func (bsc *BlipSyncContext) routeMultiplexed(profile string, rq *blip.Message) bool {
+	name, found := rq.Properties[BlipDatabase]
+	if !found || bsc.multiplexName != "" || name == bsc.blipContextDb.Name {
+		return false
+	}
+	for _, multiplexed := range bsc.multiplexed {
+		if multiplexed.multiplexName != name {
+			continue
+		}
+		multiplexed.dbStats.StatsDatabase().Add(base.StatKeyMultiplexedMessages, 1)
+		if handler, found := multiplexed.multiplexHandlers[profile]; found {
+			handler(rq)
+		} else {
+			multiplexed.NotFoundHandler(rq)
+		}
+		return true
+	}
+	status, msg := base.ErrorAsHTTPStatus(base.HTTPErrorf(http.StatusNotFound, "Database %s isn't multiplexed on this connection", base.UD(name)))
+	if response := rq.Response(); response != nil {
+		response.SetError("HTTP", status, msg)
+	}
+	base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Type:%s   --> %d %s", profile, status, msg)
+	return true
+}
+
+// closeMultiplexed closes the contexts of the databases attached to the connection.
+func (bsc *BlipSyncContext) closeMultiplexed() {
+	for _, multiplexed := range bsc.multiplexed {
+		multiplexed.Close()
+		multiplexed.dbStats.StatsDatabase().Add(base.StatKeyMultiplexedConnections, -1)
+	}
+}
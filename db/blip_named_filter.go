@@ -0,0 +1,90 @@
+package db
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// NamedFilterPrefix prefixes the name of a named filter in a subChanges 'filter' property, e.g. "named/urgent".
+const NamedFilterPrefix = "named/"
+
+// NamedFilter is a change filter defined in the database's configuration, that clients subscribe to by name rather
+// than by sending its parameters.  It's a predicate rather than code: a change passes when its doc is in any of
+// Channels (any channel the user can see, when empty), and its body matches Expression, in the syntax of a
+// sync_gateway/byexpression filter (any body, when empty).
+type NamedFilter struct {
+	Channels   []string `json:"channels,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+}
+
+// NamedFilters are named change filters, keyed by name.
+type NamedFilters map[string]NamedFilter
+
+// namedFilter is a NamedFilter parsed when the database is created.
+type namedFilter struct {
+	channels   base.Set          // Nil for all the user's channels
+	expression *filterExpression // Nil for any body
+}
+
+// newNamedFilters parses the database's named filters, failing on any that's invalid so that a misconfigured filter
+// is found when the database is created, rather than when a client first subscribes to it.
+func newNamedFilters(filters NamedFilters) (map[string]*namedFilter, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]*namedFilter, len(filters))
+	for name, filter := range filters {
+		if name == "" {
+			return nil, fmt.Errorf("named filter has an empty name")
+		}
+		f := &namedFilter{}
+		if len(filter.Channels) > 0 {
+			var err error
+			if f.channels, err = channels.SetFromArray(filter.Channels, channels.ExpandStar); err != nil {
+				return nil, fmt.Errorf("invalid channels for named filter %q: %v", name, err)
+			}
+		}
+		if filter.Expression != "" {
+			var err error
+			if f.expression, err = parseFilterExpression(filter.Expression); err != nil {
+				return nil, fmt.Errorf("invalid expression for named filter %q: %v", name, err)
+			}
+		}
+		parsed[name] = f
+	}
+	return parsed, nil
+}
+
+// namedFilter returns the named filter a subChanges 'filter' property of named/<name> subscribes to, or nil for any
+// other filter.
+func (bh *blipHandler) namedFilter(filter string) (*namedFilter, error) {
+	if !strings.HasPrefix(filter, NamedFilterPrefix) {
+		return nil, nil
+	}
+	name := strings.TrimPrefix(filter, NamedFilterPrefix)
+	named, found := bh.db.namedFilters[name]
+	if !found {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unknown named filter %q", name)
+	}
+	if named.channels != nil {
+		if denied := bh.deniedChannels(named.channels.ToArray()); len(denied) > 0 {
+			return nil, base.HTTPErrorf(http.StatusForbidden, "Named filter includes channel(s) that can't be replicated: %s", base.UD(denied))
+		}
+	}
+	return named, nil
+}
+
+// applyNamedFilter sets the subscription's channels and filter expression from the named filter, which sendChanges
+// then applies to every change it sends.
+func (bh *blipHandler) applyNamedFilter(name string, filter *namedFilter) {
+	if filter.channels != nil {
+		bh.channels = filter.channels
+	}
+	bh.filterExpression = filter.expression
+	bh.dbStats.StatsCblReplicationPull().Get(base.StatKeyNamedFilterUses).(*expvar.Map).Add(name, 1)
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNamedFilters(t *testing.T) {
+	filters, err := newNamedFilters(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, filters)
+
+	filters, err = newNamedFilters(NamedFilters{
+		"urgent":   {Channels: []string{"a", "b"}, Expression: "doc.priority > 5"},
+		"channels": {Channels: []string{"a"}},
+		"all":      {},
+	})
+	require.NoError(t, err)
+	require.Len(t, filters, 3)
+	assert.Equal(t, 2, len(filters["urgent"].channels))
+	assert.NotNil(t, filters["urgent"].expression)
+	assert.Nil(t, filters["channels"].expression)
+	assert.Nil(t, filters["all"].channels)
+	assert.Nil(t, filters["all"].expression)
+
+	_, err = newNamedFilters(NamedFilters{"bad": {Expression: "doc.priority >"}})
+	assert.Error(t, err)
+	_, err = newNamedFilters(NamedFilters{"": {Channels: []string{"a"}}})
+	assert.Error(t, err)
+}
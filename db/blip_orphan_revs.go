@@ -0,0 +1,152 @@
+package db
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultOrphanRevBufferSize is the max number of orphan revs held at once, when the orphan rev timeout is set.
+const DefaultOrphanRevBufferSize = 1000
+
+// orphanRevBuffer holds pushed revs whose parent hasn't been written yet, so that revs of the same document pushed
+// out of history order (e.g. by a client pipelining pushes, which truncates each rev's history at the previous rev)
+// are applied in order instead of being rejected as conflicts.  An orphan rev's handler waits until another rev of
+// the document is written and then retries the write, until the write succeeds or fails for some other reason, or the
+// timeout expires.  At most maxSize orphans are held at once; beyond that, orphans are rejected immediately.
+type orphanRevBuffer struct {
+	timeout time.Duration
+	maxSize int
+	lock    sync.Mutex
+	size    int                          // Number of orphans currently held
+	waiters map[string]*orphanDocWaiters // Orphans waiting for a write, keyed by doc ID
+}
+
+type orphanDocWaiters struct {
+	written chan struct{} // Closed when a rev of the document is written
+	count   int
+}
+
+// newOrphanRevBuffer returns an orphan rev buffer, or nil when the timeout is zero (disabled).
+func newOrphanRevBuffer(timeout time.Duration, maxSize int) *orphanRevBuffer {
+	if timeout <= 0 {
+		return nil
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultOrphanRevBufferSize
+	}
+	return &orphanRevBuffer{
+		timeout: timeout,
+		maxSize: maxSize,
+		waiters: make(map[string]*orphanDocWaiters),
+	}
+}
+
+// hold reserves space for an orphan rev, returning false if the buffer is full.  Each successful hold must be
+// followed by a call to release.
+func (b *orphanRevBuffer) hold() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.size >= b.maxSize {
+		return false
+	}
+	b.size++
+	return true
+}
+
+func (b *orphanRevBuffer) release() {
+	b.lock.Lock()
+	b.size--
+	b.lock.Unlock()
+}
+
+// nextWrite returns a channel that's closed when a rev of the document is next written.  It must be obtained before
+// retrying the orphan's write, so that a parent written in between isn't missed, and passed to stopWaiting afterwards.
+func (b *orphanRevBuffer) nextWrite(docID string) <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	waiters, ok := b.waiters[docID]
+	if !ok {
+		waiters = &orphanDocWaiters{written: make(chan struct{})}
+		b.waiters[docID] = waiters
+	}
+	waiters.count++
+	return waiters.written
+}
+
+func (b *orphanRevBuffer) stopWaiting(docID string, written <-chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	waiters, ok := b.waiters[docID]
+	if !ok || waiters.written != written {
+		return // Already woken by a write
+	}
+	waiters.count--
+	if waiters.count == 0 {
+		delete(b.waiters, docID)
+	}
+}
+
+// revWritten wakes any orphans of the document, so that they can retry their writes.
+func (b *orphanRevBuffer) revWritten(docID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if waiters, ok := b.waiters[docID]; ok {
+		close(waiters.written)
+		delete(b.waiters, docID)
+	}
+}
+
+// isOrphanRev returns true if a pushed rev was rejected as a conflict because the document exists, but none of the
+// rev's history has been written yet.  A rev without history can't be an orphan, as it has no parent to wait for.
+func (bh *blipHandler) isOrphanRev(docID string, history []string, err error) bool {
+	if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusConflict || len(history) < 2 {
+		return false
+	}
+	doc, getErr := bh.db.GetDocument(docID, DocUnmarshalSync)
+	if getErr != nil {
+		return false
+	}
+	for _, revID := range history {
+		if doc.History.contains(revID) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeOrphanRev retries the write of an orphan rev each time another rev of the document is written, until it's
+// no longer an orphan.  Returns the original error if the buffer is full or the parent doesn't arrive in time.
+func (bh *blipHandler) writeOrphanRev(docID string, history []string, write func() error, orphanErr error) error {
+	orphans := bh.db.orphanRevs
+	if !orphans.hold() {
+		return orphanErr
+	}
+	defer orphans.release()
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyOrphanRevsBuffered, 1)
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Holding rev %s of doc %s until its parent %s is written", bh.serialNumber, history[0], base.UD(docID), history[1])
+
+	timeout := time.NewTimer(orphans.timeout)
+	defer timeout.Stop()
+	for {
+		written := orphans.nextWrite(docID)
+		err := write()
+		if err == nil || !bh.isOrphanRev(docID, history, err) {
+			orphans.stopWaiting(docID, written)
+			return err
+		}
+		select {
+		case <-written:
+		case <-timeout.C:
+			orphans.stopWaiting(docID, written)
+			bh.dbStats.CblReplicationPush().Add(base.StatKeyOrphanRevsTimedOut, 1)
+			base.InfofCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Rejecting rev %s of doc %s - parent %s wasn't written within %v", bh.serialNumber, history[0], base.UD(docID), history[1], orphans.timeout)
+			return err
+		case <-bh.terminator:
+			orphans.stopWaiting(docID, written)
+			return ErrClosedBLIPSender
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOrphanRevBuffer verifies orphans are woken by writes to their document only, and that the buffer is bounded.
+func TestOrphanRevBuffer(t *testing.T) {
+	assert.Nil(t, newOrphanRevBuffer(0, 10))
+
+	orphans := newOrphanRevBuffer(time.Minute, 2)
+	assert.True(t, orphans.hold())
+	assert.True(t, orphans.hold())
+	assert.False(t, orphans.hold())
+	orphans.release()
+	assert.True(t, orphans.hold())
+
+	doc1Written := orphans.nextWrite("doc1")
+	doc2Written := orphans.nextWrite("doc2")
+	orphans.revWritten("doc1")
+	assertClosed(t, doc1Written)
+	assertOpen(t, doc2Written)
+
+	// Waiters that stop waiting are cleaned up
+	orphans.stopWaiting("doc2", doc2Written)
+	assert.Len(t, orphans.waiters, 0)
+
+	// A waiter registered after a write waits for the next one
+	doc1Written = orphans.nextWrite("doc1")
+	assertOpen(t, doc1Written)
+	orphans.revWritten("doc1")
+	assertClosed(t, doc1Written)
+	orphans.stopWaiting("doc1", doc1Written)
+	assert.Len(t, orphans.waiters, 0)
+}
+
+func assertClosed(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		assert.Fail(t, "Expected channel to be closed")
+	}
+}
+
+func assertOpen(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+		assert.Fail(t, "Expected channel to be open")
+	default:
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// changesPacer spreads the changes sent on a subscription at no more than the rate the client asked for with
+// maxChangesPerSecond, by waiting between batches.  Each batch is budgeted time in proportion to the changes in it,
+// and the next batch is held back until that time has passed.  Budget unused while the feed is idle isn't saved up,
+// so a continuous feed sends a change that arrives after an idle period straight away, but never bursts beyond a
+// batch at a time.
+type changesPacer struct {
+	interval time.Duration // Time budgeted for each change
+	next     time.Time     // Earliest time the next batch may be sent
+}
+
+// newChangesPacer returns a pacer for the given rate, or nil (which never waits) when the rate isn't positive.
+func newChangesPacer(changesPerSecond int) *changesPacer {
+	if changesPerSecond <= 0 {
+		return nil
+	}
+	return &changesPacer{interval: time.Second / time.Duration(changesPerSecond)}
+}
+
+// delay returns how long to wait before sending a batch of the given number of changes, and budgets the batch's time.
+func (p *changesPacer) delay(numChanges int) time.Duration {
+	if p == nil || numChanges == 0 {
+		return 0
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(numChanges) * p.interval)
+	return delay
+}
+
+// paceChanges waits until a batch of the given number of changes may be sent at the subscription's requested rate.
+// Returns ErrClosedBLIPSender if the connection is closed while waiting.
+func (bh *blipHandler) paceChanges(numChanges int) error {
+	delay := bh.changesPacer.delay(numChanges)
+	if delay <= 0 {
+		return nil
+	}
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyChangesPacingDelay, delay.Nanoseconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-bh.terminator:
+		return ErrClosedBLIPSender
+	}
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangesPacer(t *testing.T) {
+	assert.Nil(t, newChangesPacer(0))
+	var disabled *changesPacer
+	assert.Equal(t, time.Duration(0), disabled.delay(100))
+
+	pacer := newChangesPacer(4)
+	assert.Equal(t, time.Duration(0), pacer.delay(2))
+	// The first batch of 2 is budgeted half a second at 4 changes per second
+	assert.InDelta(t, float64(500*time.Millisecond), float64(pacer.delay(2)), float64(50*time.Millisecond))
+	assert.InDelta(t, float64(time.Second), float64(pacer.delay(0)+pacer.delay(1)), float64(50*time.Millisecond))
+
+	// Budget isn't saved up while idle, so a batch after an idle period is sent straight away
+	pacer.next = time.Now().Add(-time.Minute)
+	assert.Equal(t, time.Duration(0), pacer.delay(2))
+	assert.InDelta(t, float64(500*time.Millisecond), float64(pacer.delay(1)), float64(50*time.Millisecond))
+}
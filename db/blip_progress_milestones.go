@@ -0,0 +1,121 @@
+package db
+
+import (
+	"sync/atomic"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Reasons a progress milestone is reached.
+const (
+	MilestoneReasonDocs    = "docs"    // Every BlipSyncOptions.ProgressMilestoneDocs docs sent
+	MilestoneReasonPercent = "percent" // Every BlipSyncOptions.ProgressMilestonePercent percent of the initial pull
+)
+
+// ReplicationMilestone is a progress milestone reached by a pull, as published in a replication progress event.
+type ReplicationMilestone struct {
+	Reason    string
+	DocsSent  int64      // Revs sent to the client since the subscription started
+	BytesSent int64      // Rev body bytes sent to the client since the subscription started
+	Seq       SequenceID // Sequence of the last change the feed has sent
+	Percent   int        // Estimated percentage of the initial pull completed, or -1 when there's no estimate
+}
+
+// progressMilestones tracks a pull's progress for the milestones emitted for observability of large migrations.  Docs
+// milestones are reached every docsInterval docs sent.  Percent milestones are reached every percentInterval percent of
+// the initial pull, estimated from how far the feed has got through the sequences up to the database's last sequence
+// when the subscription started, and stop once the feed has caught up.  Milestones are checked as the feed goes
+// through changes, so sending revs only costs counting them.
+type progressMilestones struct {
+	docsSent        int64 // Atomic, as revs are sent on changes response goroutines.  Kept first for 64-bit alignment
+	bytesSent       int64 // Atomic
+	docsInterval    int64
+	percentInterval int
+	startSeq        uint64 // Sequence the subscription started from
+	endSeq          uint64 // Last sequence of the initial pull, for percentages.  Zero when there's nothing to estimate
+	nextDocs        int64  // Only accessed by the feed
+	nextPercent     int    // Only accessed by the feed.  Beyond 100 once percent milestones are done
+}
+
+// newProgressMilestones returns the milestones for a subscription starting from since, while the database's last
+// sequence is lastSeq, or nil when milestones aren't configured.
+func newProgressMilestones(docsInterval, percentInterval int, since, lastSeq uint64) *progressMilestones {
+	if docsInterval <= 0 && percentInterval <= 0 {
+		return nil
+	}
+	p := &progressMilestones{
+		docsInterval:    int64(docsInterval),
+		percentInterval: percentInterval,
+		startSeq:        since,
+		nextDocs:        int64(docsInterval),
+		nextPercent:     101,
+	}
+	if percentInterval > 0 && lastSeq > since {
+		p.endSeq = lastSeq
+		p.nextPercent = percentInterval
+	}
+	return p
+}
+
+// revSent counts a rev sent to the client.
+func (p *progressMilestones) revSent(bodyBytes int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.docsSent, 1)
+	atomic.AddInt64(&p.bytesSent, int64(bodyBytes))
+}
+
+// reached returns the milestones reached now the feed has sent the change at seq, or has caught up.  Milestones
+// passed at once are reported as one milestone of each reason.  Must only be called by the feed.
+func (p *progressMilestones) reached(seq SequenceID, caughtUp bool) (milestones []ReplicationMilestone) {
+	if p == nil {
+		return nil
+	}
+	docsSent, bytesSent := atomic.LoadInt64(&p.docsSent), atomic.LoadInt64(&p.bytesSent)
+	percent := -1
+	if p.endSeq > 0 && p.nextPercent <= 100 {
+		percent = 100
+		if !caughtUp && seq.Seq < p.endSeq {
+			percent = int((seq.Seq - p.startSeq) * 100 / (p.endSeq - p.startSeq))
+		}
+	}
+	milestone := ReplicationMilestone{DocsSent: docsSent, BytesSent: bytesSent, Seq: seq, Percent: percent}
+
+	if p.docsInterval > 0 && docsSent >= p.nextDocs {
+		p.nextDocs = (docsSent/p.docsInterval + 1) * p.docsInterval
+		milestone.Reason = MilestoneReasonDocs
+		milestones = append(milestones, milestone)
+	}
+	if percent >= p.nextPercent {
+		p.nextPercent = (percent/p.percentInterval + 1) * p.percentInterval
+		if percent == 100 {
+			p.nextPercent = 101
+		} else if p.nextPercent > 100 {
+			p.nextPercent = 100
+		}
+		milestone.Reason = MilestoneReasonPercent
+		milestones = append(milestones, milestone)
+	}
+	return milestones
+}
+
+// emitProgressMilestones publishes the milestones the feed has reached, as replication progress events.
+func (bh *blipHandler) emitProgressMilestones(seq SequenceID, caughtUp bool, session string) {
+	milestones := bh.progressMilestones.reached(seq, caughtUp)
+	if len(milestones) == 0 {
+		return
+	}
+	username := ""
+	if user := bh.db.User(); user != nil {
+		username = user.Name()
+	}
+	for _, milestone := range milestones {
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Pull reached %s progress milestone: %d docs (%d bytes) sent, at seq %v",
+			milestone.Reason, milestone.DocsSent, milestone.BytesSent, milestone.Seq)
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyProgressMilestones, 1)
+		if err := bh.db.EventMgr.RaiseReplicationProgressEvent(bh.db.Name, bh.blipContext.ID, username, session, milestone); err != nil {
+			base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to raise replication progress event: %v", err)
+		}
+	}
+}
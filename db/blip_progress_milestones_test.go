@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressMilestones(t *testing.T) {
+	assert.Nil(t, newProgressMilestones(0, 0, 0, 100))
+	var disabled *progressMilestones
+	disabled.revSent(10)
+	assert.Nil(t, disabled.reached(SequenceID{Seq: 10}, false))
+
+	milestones := newProgressMilestones(2, 30, 100, 200)
+	milestones.revSent(10)
+	assert.Empty(t, milestones.reached(SequenceID{Seq: 110}, false))
+
+	// Milestones of both reasons can be reached at once, each reporting the progress so far
+	milestones.revSent(20)
+	assert.Equal(t, []ReplicationMilestone{
+		{Reason: MilestoneReasonDocs, DocsSent: 2, BytesSent: 30, Seq: SequenceID{Seq: 135}, Percent: 35},
+		{Reason: MilestoneReasonPercent, DocsSent: 2, BytesSent: 30, Seq: SequenceID{Seq: 135}, Percent: 35},
+	}, milestones.reached(SequenceID{Seq: 135}, false))
+
+	// Passing several milestones at once reports one
+	for i := 0; i < 5; i++ {
+		milestones.revSent(10)
+	}
+	reached := milestones.reached(SequenceID{Seq: 195}, false)
+	assert.Len(t, reached, 2)
+	assert.Equal(t, int64(7), reached[0].DocsSent)
+	assert.Equal(t, 95, reached[1].Percent)
+	assert.Empty(t, milestones.reached(SequenceID{Seq: 196}, false))
+
+	// The initial pull is complete once the feed has caught up, even if its estimate hasn't been reached, after
+	// which there's no estimate
+	milestones.revSent(10)
+	assert.Equal(t, []ReplicationMilestone{
+		{Reason: MilestoneReasonDocs, DocsSent: 8, BytesSent: 90, Seq: SequenceID{Seq: 198}, Percent: 100},
+		{Reason: MilestoneReasonPercent, DocsSent: 8, BytesSent: 90, Seq: SequenceID{Seq: 198}, Percent: 100},
+	}, milestones.reached(SequenceID{Seq: 198}, true))
+	milestones.revSent(10)
+	milestones.revSent(10)
+	assert.Equal(t, []ReplicationMilestone{
+		{Reason: MilestoneReasonDocs, DocsSent: 10, BytesSent: 110, Seq: SequenceID{Seq: 210}, Percent: -1},
+	}, milestones.reached(SequenceID{Seq: 210}, true))
+
+	// Without sequences to pull, there's no estimate
+	milestones = newProgressMilestones(0, 10, 100, 100)
+	assert.Empty(t, milestones.reached(SequenceID{Seq: 100}, true))
+}
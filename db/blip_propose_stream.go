@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// proposeChangesStreamThreshold is the fewest changes in a proposeChanges message whose statuses are streamed when
+	// the client asks for streaming.  Smaller messages always get the buffered response.
+	proposeChangesStreamThreshold = 1000
+
+	// proposeChangesStreamChunk is the number of changes whose statuses are sent in each proposeChangesStatus message.
+	proposeChangesStreamChunk = 1000
+
+	// proposeChangesStreamWindow is the most proposeChangesStatus messages awaiting the client's reply at once.  Once
+	// reached, no more statuses are computed until the client replies, so a slow client can't cause unbounded
+	// buffering.
+	proposeChangesStreamWindow = 4
+)
+
+// proposedStatusWriter writes the JSON array of statuses in a proposeChanges response.  Zero statuses after the last
+// non-zero status are omitted, so the common case of every change being wanted is an empty array.
+type proposedStatusWriter struct {
+	output   *bytes.Buffer
+	count    int // Statuses added
+	nWritten int // Statuses written to output, which lags count while zeroes are pending
+}
+
+func newProposedStatusWriter(changeCount int) *proposedStatusWriter {
+	output := newChangesResponseBuffer(changeCount, 5)
+	output.Write([]byte("["))
+	return &proposedStatusWriter{output: output}
+}
+
+// add adds the status of the next change.
+func (w *proposedStatusWriter) add(status ProposedRevStatus) {
+	if status != 0 {
+		// Skip writing trailing zeroes; but if we write a number afterwards we have to catch up
+		if w.nWritten > 0 {
+			w.output.Write([]byte(","))
+		}
+		for ; w.nWritten < w.count; w.nWritten++ {
+			w.output.Write([]byte("0,"))
+		}
+		w.output.Write([]byte(strconv.FormatInt(int64(status), 10)))
+		w.nWritten++
+	}
+	w.count++
+}
+
+// close returns the complete JSON array.
+func (w *proposedStatusWriter) close() []byte {
+	w.output.Write([]byte("]"))
+	return w.output.Bytes()
+}
+
+// streamProposedRevStatuses sends the statuses of a large proposeChanges message to the client as they're computed,
+// rather than buffering them all for the response.  Statuses are sent in proposeChangesStatus messages, each
+// covering up to proposeChangesStreamChunk changes starting at the index in its 'offset' property, with the same
+// trailing-zero compaction as the buffered response.  Chunks whose statuses are all zero aren't sent.  Each message
+// must be replied to, and no more than proposeChangesStreamWindow may await a reply at once.  The response to the
+// proposeChanges message is sent once every status message has been replied to, with 'streamed' set and an empty
+// body.
+func (bh *blipHandler) streamProposedRevStatuses(sender *blip.Sender, response *blip.Message, changeList [][]interface{}, conflictPolicy string) error {
+	awaitingReply := make([]*blip.Message, 0, proposeChangesStreamWindow)
+	waitForOldest := func() error {
+		reply, err := bh.waitForResponse(awaitingReply[0])
+		if err != nil {
+			return err
+		}
+		if reply.Type() == blip.ErrorType {
+			return base.HTTPErrorf(http.StatusBadRequest, "Client returned error to %s: %s", MessageProposeStatus, reply.Properties["Error-Code"])
+		}
+		awaitingReply = awaitingReply[1:]
+		return nil
+	}
+
+	chunks := 0
+	for offset := 0; offset < len(changeList); offset += proposeChangesStreamChunk {
+		end := offset + proposeChangesStreamChunk
+		if end > len(changeList) {
+			end = len(changeList)
+		}
+		output := newProposedStatusWriter(end - offset)
+		for _, status := range bh.proposedRevStatuses(changeList[offset:end], conflictPolicy) {
+			output.add(status)
+		}
+		if output.nWritten == 0 {
+			continue
+		}
+
+		if len(awaitingReply) == proposeChangesStreamWindow {
+			if err := waitForOldest(); err != nil {
+				return err
+			}
+		}
+		outrq := blip.NewRequest()
+		outrq.SetProfile(MessageProposeStatus)
+		outrq.Properties[ProposeStatusOffset] = strconv.Itoa(offset)
+		outrq.SetCompressed(true)
+		outrq.SetBody(output.close())
+		if !bh.sendBLIPMessage(sender, outrq) {
+			return ErrClosedBLIPSender
+		}
+		awaitingReply = append(awaitingReply, outrq)
+		chunks++
+	}
+	for len(awaitingReply) > 0 {
+		if err := waitForOldest(); err != nil {
+			return err
+		}
+	}
+
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "Streamed statuses of %d proposed changes in %d messages", len(changeList), chunks)
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyProposeStreamCount, 1)
+	response.Properties[ProposeChangesResponseStream] = "true"
+	response.SetBody([]byte("[]"))
+	return nil
+}
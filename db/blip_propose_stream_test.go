@@ -0,0 +1,27 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProposedStatusWriter verifies zero statuses are only written when followed by a non-zero status.
+func TestProposedStatusWriter(t *testing.T) {
+	tests := []struct {
+		statuses []ProposedRevStatus
+		expected string
+	}{
+		{nil, "[]"},
+		{[]ProposedRevStatus{0, 0, 0}, "[]"},
+		{[]ProposedRevStatus{409}, "[409]"},
+		{[]ProposedRevStatus{0, 0, 304, 0, 409, 0, 0}, "[0,0,304,0,409]"},
+	}
+	for _, test := range tests {
+		writer := newProposedStatusWriter(len(test.statuses))
+		for _, status := range test.statuses {
+			writer.add(status)
+		}
+		assert.Equal(t, test.expected, string(writer.close()))
+	}
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// maxPurgeJobDocs is the most docIDs a purgeBatch job may be started with.
+	maxPurgeJobDocs = 1000
+
+	// purgeBatchStep is the most docs purged by a single purgeBatch request, after which the client sends the job's
+	// token to continue.
+	purgeBatchStep = 100
+
+	// purgeJobTTL is how long a purgeBatch job is retained after its last request, for the client to resume it.
+	purgeJobTTL = time.Hour
+
+	// maxPurgeJobs is the most purgeBatch jobs retained at once, beyond which new jobs are rejected until some expire.
+	maxPurgeJobs = 1000
+)
+
+// purgeJob is the progress of a purgeBatch job: the docs to purge, and the status of each purged so far.
+type purgeJob struct {
+	owner     string   // Name of the user who started the job, empty for admin
+	docIDs    []string // Docs to purge, in order
+	statuses  []int    // Status of each doc processed so far, so the cursor is len(statuses)
+	expiresAt time.Time
+	busy      bool // Set while a request is processing the job
+}
+
+// purgeJobStore retains purgeBatch jobs in memory, keyed by token, until they expire.  Like the idempotency store
+// it's per node, so a purge interrupted by a restart, or resumed on another node, must be started again; purging is
+// idempotent, so docs already purged are reported as not found.
+type purgeJobStore struct {
+	lock sync.Mutex
+	jobs map[string]*purgeJob
+}
+
+// start creates a job purging the given docs on behalf of the given user, returning its token.
+func (s *purgeJobStore) start(owner string, docIDs []string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s._expire()
+	if len(s.jobs) >= maxPurgeJobs {
+		return "", base.HTTPErrorf(http.StatusServiceUnavailable, "Too many purge jobs in progress")
+	}
+	if s.jobs == nil {
+		s.jobs = make(map[string]*purgeJob)
+	}
+	token := base.GenerateRandomID()
+	s.jobs[token] = &purgeJob{owner: owner, docIDs: docIDs, expiresAt: time.Now().Add(purgeJobTTL)}
+	return token, nil
+}
+
+// acquire returns the job with the given token for a request to process, which must then release it.  A job belonging
+// to another user is reported as not found, so that tokens can't be probed.
+func (s *purgeJobStore) acquire(token, owner string) (*purgeJob, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s._expire()
+	job, found := s.jobs[token]
+	if !found || job.owner != owner {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Unknown or expired purge job")
+	}
+	if job.busy {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Purge job is already being processed")
+	}
+	job.busy = true
+	return job, nil
+}
+
+// release ends a request's processing of a job.  Finished jobs are retained until they expire too, so that a client
+// that missed the last response can fetch its statuses again.
+func (s *purgeJobStore) release(job *purgeJob) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job.busy = false
+	job.expiresAt = time.Now().Add(purgeJobTTL)
+}
+
+func (s *purgeJobStore) _expire() {
+	now := time.Now()
+	for token, job := range s.jobs {
+		if !job.busy && now.After(job.expiresAt) {
+			delete(s.jobs, token)
+		}
+	}
+}
+
+// Received a "purgeBatch" request, i.e. a client purging a set of docs, such as all of a user's data.  A job is
+// started with a body holding a JSON array of up to maxPurgeJobDocs docIDs.  Each request purges up to purgeBatchStep
+// of the job's docs, and its response carries the job's 'token', the 'cursor' (the number of docs processed so far),
+// and 'done' once every doc has been processed.  The client continues the job by sending requests with just the
+// token until it's done, and resumes an interrupted job the same way, on any connection as the same user, with a
+// 'since' property giving the number of statuses it already has.  The response body is a JSON array of
+// [docID, status] rows for the docs from since (by default, the docs processed by the request) up to the cursor.
+//
+// Purging is destructive, so it's authorized strictly: admins may purge any doc, but users only when
+// BlipSyncOptions.AllowUserPurge is set, and only docs in at least one channel, all of which the user can access.
+// Other docs get a 403 status.  Docs that don't exist get a 404.
+func (bh *blipHandler) handlePurgeBatch(rq *blip.Message) error {
+	token := rq.Properties[PurgeBatchToken]
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("Token:%s Since:%s", token, rq.Properties[PurgeBatchSince]))
+
+	var owner string
+	if user := bh.db.User(); user != nil {
+		if !bh.db.Options.BlipSyncOptions.AllowUserPurge {
+			return base.HTTPErrorf(http.StatusForbidden, "Purging isn't enabled for users")
+		}
+		owner = user.Name()
+	}
+
+	if token == "" {
+		var docIDs []string
+		if err := rq.ReadJSONBody(&docIDs); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid purgeBatch body: %v", err)
+		}
+		if len(docIDs) == 0 || len(docIDs) > maxPurgeJobDocs {
+			return base.HTTPErrorf(http.StatusBadRequest, "A purge job must have between 1 and %d docs", maxPurgeJobDocs)
+		}
+		// Jobs hold stored IDs, so that they can be resumed on any of the user's connections
+		if err := bh.storedDocIDs(docIDs); err != nil {
+			return err
+		}
+		var err error
+		if token, err = bh.db.purgeJobs.start(owner, docIDs); err != nil {
+			return err
+		}
+	}
+
+	job, err := bh.db.purgeJobs.acquire(token, owner)
+	if err != nil {
+		return err
+	}
+	since := len(job.statuses)
+	if sinceProperty, found := rq.Properties[PurgeBatchSince]; found {
+		if since, err = strconv.Atoi(sinceProperty); err != nil || since < 0 || since > len(job.statuses) {
+			bh.db.purgeJobs.release(job)
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid '%s' %q", PurgeBatchSince, sinceProperty)
+		}
+	}
+
+	startTime := time.Now()
+	var purged []string
+	for step := 0; step < purgeBatchStep && len(job.statuses) < len(job.docIDs); step++ {
+		docID := job.docIDs[len(job.statuses)]
+		status := bh.purgeDoc(docID)
+		if status == http.StatusOK {
+			purged = append(purged, docID)
+		}
+		job.statuses = append(job.statuses, status)
+	}
+	if len(purged) > 0 {
+		count := bh.db.GetChangeCache().Remove(purged, startTime)
+		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeyCache, "Purged %d items from caches", count)
+		bh.dbStats.StatsDatabase().Add(base.StatKeyPurgeBatchDocs, int64(len(purged)))
+	}
+
+	cursor := len(job.statuses)
+	done := cursor == len(job.docIDs)
+	rows := make([][]interface{}, 0, cursor-since)
+	for i := since; i < cursor; i++ {
+		rows = append(rows, []interface{}{bh.deliveredDocID(job.docIDs[i]), job.statuses[i]})
+	}
+	bh.db.purgeJobs.release(job)
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeyCRUD, "purgeBatch purged %d docs, %d of %d processed", len(purged), cursor, len(job.docIDs))
+
+	response := rq.Response()
+	response.Properties[PurgeBatchToken] = token
+	response.Properties[PurgeBatchCursor] = strconv.Itoa(cursor)
+	if done {
+		response.Properties[PurgeBatchDone] = "true"
+	}
+	return response.SetJSONBody(rows)
+}
+
+// purgeDoc purges a doc if the connection is authorized to, returning the doc's status.
+func (bh *blipHandler) purgeDoc(docID string) int {
+	syncData, err := bh.db.GetDocSyncData(docID)
+	if base.IsDocNotFoundError(err) {
+		return http.StatusNotFound
+	} else if err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to read %s to purge it: %v", base.UD(docID), err)
+		return http.StatusInternalServerError
+	}
+	if user := bh.db.User(); user != nil {
+		current := 0
+		for channel, removal := range syncData.Channels {
+			if removal != nil {
+				continue
+			}
+			current++
+			if !user.CanSeeChannel(channel) {
+				return http.StatusForbidden
+			}
+		}
+		if current == 0 {
+			return http.StatusForbidden
+		}
+	}
+	if err := bh.db.Purge(docID); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return http.StatusNotFound
+		}
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to purge %s: %v", base.UD(docID), err)
+		return http.StatusInternalServerError
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeyCRUD, "Purged document %s via purgeBatch", base.UD(docID))
+	return http.StatusOK
+}
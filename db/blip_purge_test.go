@@ -0,0 +1,44 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeJobStore(t *testing.T) {
+	var store purgeJobStore
+	token, err := store.start("naomi", []string{"doc1", "doc2"})
+	require.NoError(t, err)
+
+	// Another user's job can't be told apart from an unknown one
+	_, err = store.acquire(token, "alice")
+	assertHTTPError(t, err, http.StatusNotFound)
+	_, err = store.acquire("unknown", "naomi")
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	job, err := store.acquire(token, "naomi")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc1", "doc2"}, job.docIDs)
+	_, err = store.acquire(token, "naomi")
+	assertHTTPError(t, err, http.StatusConflict)
+	store.release(job)
+
+	// Jobs expire once they've been idle for the TTL
+	job, err = store.acquire(token, "naomi")
+	require.NoError(t, err)
+	store.release(job)
+	job.expiresAt = time.Now().Add(-time.Second)
+	_, err = store.acquire(token, "naomi")
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	for i := 0; i < maxPurgeJobs; i++ {
+		_, err = store.start("", []string{"doc"})
+		require.NoError(t, err)
+	}
+	_, err = store.start("", []string{"doc"})
+	assertHTTPError(t, err, http.StatusServiceUnavailable)
+}
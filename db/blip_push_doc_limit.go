@@ -0,0 +1,108 @@
+package db
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultPushDocWindow is how long a push session lasts when the distinct document limit is set, before the
+// documents it's pushed revs for are forgotten and the client may push revs for new ones again.
+const DefaultPushDocWindow = time.Hour
+
+// ErrPushDocLimit is returned when a client pushes a rev for a new document after reaching the push session's limit
+// on distinct documents.  RetryAfter is how long until the session resets, or zero when sessions last for the
+// connection's lifetime, and the client must reconnect.
+type ErrPushDocLimit struct {
+	MaxDocs    int
+	RetryAfter time.Duration
+}
+
+func (e *ErrPushDocLimit) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Pushed revs for the maximum of %d distinct documents, retry after %v", e.MaxDocs, e.RetryAfter)
+	}
+	return fmt.Sprintf("Pushed revs for the maximum of %d distinct documents on this connection", e.MaxDocs)
+}
+
+// Cause allows ErrPushDocLimit to be reported as a 429 Too Many Requests.
+func (e *ErrPushDocLimit) Cause() error {
+	return base.HTTPErrorf(http.StatusTooManyRequests, "%s", e.Error())
+}
+
+// pushDocTracker caps the distinct documents a connection may push revs for in a push session, protecting the server
+// from the per-document state (rev cache entries, conflict checks) a client touching endless documents builds up.
+// Revs for documents already pushed in the session are always accepted.  A session starts with the first rev pushed
+// and lasts for the window, after which the documents are forgotten.  Documents are tracked exactly, which is bounded
+// by the cap.
+type pushDocTracker struct {
+	maxDocs      int
+	window       time.Duration // Zero for sessions lasting the connection's lifetime
+	trackedStat  *expvar.Int   // Distinct documents tracked across all connections
+	lock         sync.Mutex
+	docs         map[string]struct{}
+	sessionStart time.Time
+}
+
+// newPushDocTracker returns a tracker for a connection, or nil when maxDocs is zero (disabled).
+func newPushDocTracker(maxDocs int, window time.Duration, trackedStat *expvar.Int) *pushDocTracker {
+	if maxDocs <= 0 {
+		return nil
+	}
+	return &pushDocTracker{
+		maxDocs:     maxDocs,
+		window:      window,
+		trackedStat: trackedStat,
+		docs:        make(map[string]struct{}),
+	}
+}
+
+// admit records a rev pushed for the document, returning ErrPushDocLimit if it's a new document and the session has
+// reached the limit.
+func (t *pushDocTracker) admit(docID string) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if t.window > 0 && !t.sessionStart.IsZero() && now.Sub(t.sessionStart) >= t.window {
+		t._reset()
+	}
+	if t.sessionStart.IsZero() {
+		t.sessionStart = now
+	}
+	if _, found := t.docs[docID]; found {
+		return nil
+	}
+	if len(t.docs) >= t.maxDocs {
+		err := &ErrPushDocLimit{MaxDocs: t.maxDocs}
+		if t.window > 0 {
+			err.RetryAfter = t.sessionStart.Add(t.window).Sub(now)
+		}
+		return err
+	}
+	t.docs[docID] = struct{}{}
+	t.trackedStat.Add(1)
+	return nil
+}
+
+// close forgets the connection's documents when it's closed.
+func (t *pushDocTracker) close() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t._reset()
+}
+
+func (t *pushDocTracker) _reset() {
+	t.trackedStat.Add(-int64(len(t.docs)))
+	t.docs = make(map[string]struct{})
+	t.sessionStart = time.Time{}
+}
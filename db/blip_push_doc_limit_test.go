@@ -0,0 +1,41 @@
+package db
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushDocTracker(t *testing.T) {
+	assert.Nil(t, newPushDocTracker(0, time.Hour, new(expvar.Int)))
+	var disabled *pushDocTracker
+	assert.NoError(t, disabled.admit("doc1"))
+
+	tracked := new(expvar.Int)
+	tracker := newPushDocTracker(2, time.Hour, tracked)
+	assert.NoError(t, tracker.admit("doc1"))
+	assert.NoError(t, tracker.admit("doc2"))
+	assert.NoError(t, tracker.admit("doc1"))
+	err := tracker.admit("doc3")
+	require.IsType(t, &ErrPushDocLimit{}, err)
+	assert.InDelta(t, float64(time.Hour), float64(err.(*ErrPushDocLimit).RetryAfter), float64(time.Minute))
+	assert.Equal(t, int64(2), tracked.Value())
+
+	// Once the window has elapsed, the session's docs are forgotten
+	tracker.sessionStart = time.Now().Add(-time.Hour)
+	assert.NoError(t, tracker.admit("doc3"))
+	assert.Equal(t, int64(1), tracked.Value())
+
+	tracker.close()
+	assert.Equal(t, int64(0), tracked.Value())
+
+	// Sessions without a window last for the connection's lifetime
+	tracker = newPushDocTracker(1, 0, tracked)
+	assert.NoError(t, tracker.admit("doc1"))
+	err = tracker.admit("doc2")
+	require.IsType(t, &ErrPushDocLimit{}, err)
+	assert.Equal(t, time.Duration(0), err.(*ErrPushDocLimit).RetryAfter)
+}
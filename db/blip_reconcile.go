@@ -0,0 +1,231 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// maxReconcileEntries is the most manifest entries a reconcile message may hold.
+	maxReconcileEntries = 1000
+
+	// maxReconcileDiscrepancies is the most discrepancies reported in a reconcile response.  Once reached,
+	// reconciliation of the range stops, and the client resumes it from the response's resumeAfter.
+	maxReconcileDiscrepancies = 1000
+
+	// reconcileScanLimit is the most of the server's docs read for a reconcile message, beyond which reconciliation of
+	// the range stops, and the client resumes it from the response's resumeAfter.
+	reconcileScanLimit = 10000
+)
+
+// Kinds of discrepancy reported by reconcile
+const (
+	ReconcileServerOnly   = "serverOnly"   // The server has a doc the client can see that isn't in the manifest
+	ReconcileClientOnly   = "clientOnly"   // The manifest lists a doc the server doesn't have, or the client can't see
+	ReconcileRevMismatch  = "revMismatch"  // The doc's current revision on the server differs from the manifest's
+	ReconcileBodyMismatch = "bodyMismatch" // The revisions match, but the hash of the server's body differs
+)
+
+// ReconcileDiscrepancy is a difference between a client's manifest and the server's docs, as reported in a
+// reconcile response.
+type ReconcileDiscrepancy struct {
+	DocID     string `json:"id"`
+	Kind      string `json:"kind"`
+	ServerRev string `json:"serverRev,omitempty"`
+	ClientRev string `json:"clientRev,omitempty"`
+}
+
+// errReconcileScanDone stops the scan of the server's docs once past the docs the user replicates.
+var errReconcileScanDone = errors.New("reconcile scan done")
+
+// reconcileEntry is a doc listed in a client's manifest, by stored ID.
+type reconcileEntry struct {
+	docID    string
+	revID    string
+	bodyHash string // Optional
+}
+
+// Received a "reconcile" request, i.e. a client auditing its local database against the server's.  The client sends
+// its manifest one docID range at a time, in the range given by the 'after' (exclusive) and 'through' (inclusive)
+// properties, either of which may be omitted to leave the range open at that end.  The body is a JSON array of
+// [docID, revID] or [docID, revID, bodyHash] entries for every doc the client has in the range, where bodyHash is a
+// CRC-32C checksum, in hex, of the revision's body marshalled as canonical JSON without _attachments.  The response
+// body is a JSON array of the range's discrepancies, in docID order.  When a response has a 'resumeAfter' property,
+// only the range through that docID was reconciled, and the client should send the rest of the range again.
+//
+// Every doc the server has in the range is read from the all docs index, and those with a body hash in the manifest
+// are loaded to compute the hash, so reconciliation is expensive, and should be used sparingly.  Only docs in the
+// user's channels are reported as being on the server.  With a DocIDMapper, the manifest and range are in delivered
+// IDs, and the range is scanned by the stored IDs they map to, skipping docs the mapper doesn't deliver.
+func (bh *blipHandler) handleReconcile(rq *blip.Message) error {
+	after, through := rq.Properties[ReconcileAfter], rq.Properties[ReconcileThrough]
+	bh.logEndpointEntry(rq.Profile(), fmt.Sprintf("After:%s Through:%s", base.UD(after), base.UD(through)))
+
+	var entries [][]string
+	if err := rq.ReadJSONBody(&entries); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid reconcile manifest: %v", err)
+	}
+	if len(entries) > maxReconcileEntries {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Reconcile manifest has %d entries, more than the maximum of %d", len(entries), maxReconcileEntries)
+	}
+	manifest := make([]reconcileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry) < 2 || len(entry) > 3 {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid reconcile manifest entry %v", base.UD(entry))
+		}
+		if docID := entry[0]; (after != "" && docID <= after) || (through != "" && docID > through) {
+			return base.HTTPErrorf(http.StatusBadRequest, "Reconcile manifest entry %s is outside the range", base.UD(docID))
+		}
+		storedID, err := bh.storedDocID(entry[0])
+		if err != nil {
+			return err
+		}
+		manifestEntry := reconcileEntry{docID: storedID, revID: entry[1]}
+		if len(entry) == 3 {
+			manifestEntry.bodyHash = entry[2]
+		}
+		manifest = append(manifest, manifestEntry)
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].docID < manifest[j].docID })
+
+	storedAfter, storedThrough, err := bh.storedDocIDRange(after, through)
+	if err != nil {
+		return err
+	}
+	r := &reconciler{bh: bh, manifest: manifest}
+	err = bh.db.ForEachDocID(func(id IDRevAndSequence, channels []string) (bool, error) {
+		if !bh.isDelivered(id.DocID) {
+			// The docs the user replicates are contiguous, so once past them there are no more to reconcile
+			if r.scanned > 0 {
+				return false, errReconcileScanDone
+			}
+			return false, nil
+		}
+		if id.DocID != storedAfter {
+			r.serverDoc(id.DocID, id.RevID, channels)
+		}
+		return true, nil
+	}, ForEachDocIDOptions{Startkey: storedAfter, Endkey: storedThrough, Limit: reconcileScanLimit})
+	if err != nil && err != errReconcileScanDone {
+		return err
+	}
+	r.finish()
+
+	bh.dbStats.StatsDatabase().Add(base.StatKeyReconcileCount, 1)
+	bh.dbStats.StatsDatabase().Add(base.StatKeyReconcileDiscrepancies, int64(len(r.discrepancies)))
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Reconciled %d manifest entries against %d docs, found %d discrepancies", len(manifest), r.scanned, len(r.discrepancies))
+
+	response := rq.Response()
+	if r.resumeAfter != "" {
+		response.Properties[ReconcileResumeAfter] = r.resumeAfter
+	}
+	if r.discrepancies == nil {
+		r.discrepancies = []ReconcileDiscrepancy{}
+	}
+	return response.SetJSONBody(r.discrepancies)
+}
+
+// reconciler merges the server's docs, in docID order, with a client's sorted manifest.
+type reconciler struct {
+	bh            *blipHandler
+	manifest      []reconcileEntry
+	next          int // Index of the first manifest entry not yet reconciled
+	discrepancies []ReconcileDiscrepancy
+	scanned       int    // Number of the server's docs read
+	lastScanned   string // Stored docID of the last of the server's docs read
+	resumeAfter   string // Set once reconciliation stops early, to the last delivered docID reconciled
+}
+
+// serverDoc reconciles a doc the server has, and any manifest entries before it that the server doesn't have.
+func (r *reconciler) serverDoc(docID, revID string, channels []string) {
+	r.scanned++
+	r.lastScanned = docID
+	if r.resumeAfter != "" {
+		return
+	}
+	for r.next < len(r.manifest) && r.manifest[r.next].docID < docID {
+		r.add(r.manifest[r.next].docID, ReconcileClientOnly, "", r.manifest[r.next].revID)
+		r.next++
+		if r.full() {
+			return
+		}
+	}
+
+	var entry *reconcileEntry
+	if r.next < len(r.manifest) && r.manifest[r.next].docID == docID {
+		entry = &r.manifest[r.next]
+		r.next++
+	}
+	visible := r.canSee(channels)
+	switch {
+	case entry == nil && visible:
+		r.add(docID, ReconcileServerOnly, revID, "")
+	case entry == nil:
+	case !visible:
+		r.add(docID, ReconcileClientOnly, "", entry.revID)
+	case entry.revID != revID:
+		r.add(docID, ReconcileRevMismatch, revID, entry.revID)
+	case entry.bodyHash != "" && entry.bodyHash != r.bodyHash(docID, revID):
+		r.add(docID, ReconcileBodyMismatch, revID, entry.revID)
+	}
+	r.full()
+}
+
+// finish reconciles the manifest entries after the last doc the server has, unless reconciliation stopped early.
+func (r *reconciler) finish() {
+	if r.resumeAfter != "" {
+		return
+	}
+	if r.scanned >= reconcileScanLimit {
+		// There may be more of the server's docs in the range
+		r.resumeAfter = r.bh.deliveredDocID(r.lastScanned)
+		return
+	}
+	for r.next < len(r.manifest) && !r.full() {
+		r.add(r.manifest[r.next].docID, ReconcileClientOnly, "", r.manifest[r.next].revID)
+		r.next++
+	}
+}
+
+// add reports a discrepancy for a doc, by the ID the client replicates it as.
+func (r *reconciler) add(docID, kind, serverRev, clientRev string) {
+	r.discrepancies = append(r.discrepancies, ReconcileDiscrepancy{DocID: r.bh.deliveredDocID(docID), Kind: kind, ServerRev: serverRev, ClientRev: clientRev})
+}
+
+// full returns true, and stops reconciliation at the last discrepancy, once the response can hold no more.
+func (r *reconciler) full() bool {
+	if len(r.discrepancies) < maxReconcileDiscrepancies {
+		return false
+	}
+	r.resumeAfter = r.discrepancies[len(r.discrepancies)-1].DocID
+	return true
+}
+
+// canSee returns true when the user has access to any of the given channels.
+func (r *reconciler) canSee(channels []string) bool {
+	user := r.bh.db.User()
+	return user == nil || user.AuthorizeAnyChannel(base.SetFromArray(channels)) == nil
+}
+
+// bodyHash returns the hash of the body of the doc's current revision, or an empty string if it can't be loaded.
+func (r *reconciler) bodyHash(docID, revID string) string {
+	rev, err := r.bh.db.GetRev(docID, revID, false, nil)
+	if err != nil {
+		base.DebugfCtx(r.bh.blipContextDb.Ctx, base.KeySync, "Unable to load %s/%s to reconcile its body: %v", base.UD(docID), revID, err)
+		return ""
+	}
+	body, err := rev.MutableBody()
+	if err != nil {
+		return ""
+	}
+	bodyBytes, err := base.JSONMarshalCanonical(body)
+	if err != nil {
+		return ""
+	}
+	return base.Crc32cHashString(bodyBytes)
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// BlipReplicationNodeHeader is the header of the WebSocket upgrade request in which a Sync Gateway replicating
+	// with another announces its replication node ID, to detect replication loops between them.
+	BlipReplicationNodeHeader = "X-Replication-Node"
+
+	// maxReplicationPath is the most replication node IDs recorded for a rev.  Loops through more Sync Gateways than
+	// this go undetected, and are only stopped by revID matching as before.
+	maxReplicationPath = 16
+)
+
+// In topologies where several Sync Gateways replicate bidirectionally, a rev one of them receives would otherwise be
+// announced back to the Sync Gateways it came from, costing changes and proposeChanges round trips even though
+// revID matching stops it being written again.  When a database has a BlipSyncOptions.ReplicationNodeID, its active
+// replicators announce it in the X-Replication-Node handshake header, and revs exchanged over the link carry the
+// node IDs of the Sync Gateways they've been through in the replicationPath property.  Each Sync Gateway records the
+// path of the current rev it receives in the doc's sync metadata, and appends its own node ID when sending it on.  A
+// change isn't sent to a Sync Gateway already in its rev's path, and a rev received with the receiver's own node ID
+// in its path isn't written.  Either is counted in the replication_loops_suppressed stat.  As a client announcing a
+// node could have changes withheld from that node's replications, or its own revs dropped, the header, and with it the
+// replicationPath property, is only accepted from admin connections and users with the
+// BlipSyncOptions.ReplicationNodeRole role.
+
+// ReplicationPath records the replication node IDs of the Sync Gateways a rev was replicated through before it was
+// written to this one, oldest first.
+type ReplicationPath struct {
+	Rev   string   `json:"rev"`
+	Nodes []string `json:"nodes"`
+}
+
+// NegotiateLoopDetection sets the replication node ID of the Sync Gateway at the other end of the connection, when it
+// announced one in the headers of its handshake request, is allowed to, and this database has one too.  Must be
+// called before the connection handles any requests.
+func (bsc *BlipSyncContext) NegotiateLoopDetection(headers http.Header) {
+	peerNode := headers.Get(BlipReplicationNodeHeader)
+	nodeID := bsc.blipContextDb.Options.BlipSyncOptions.ReplicationNodeID
+	if peerNode == "" || nodeID == "" || peerNode == nodeID {
+		return
+	}
+	if !bsc.mayAnnounceReplicationNode() {
+		base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "Ignoring %s header from user %s without the replication node role", BlipReplicationNodeHeader, base.UD(bsc.userName))
+		return
+	}
+	bsc.peerNode = peerNode
+	bsc.loopDetection = true
+}
+
+// mayAnnounceReplicationNode returns true if the connection is trusted to be another Sync Gateway: an admin
+// connection, or a user with the configured replication node role.
+func (bsc *BlipSyncContext) mayAnnounceReplicationNode() bool {
+	user := bsc.blipContextDb.User()
+	if user == nil {
+		return true
+	}
+	role := bsc.blipContextDb.Options.BlipSyncOptions.ReplicationNodeRole
+	if role == "" {
+		return false
+	}
+	_, found := user.RoleNames()[role]
+	return found
+}
+
+// appendReplicationPath returns a copy of the path with the node appended, dropping the oldest nodes beyond
+// maxReplicationPath.
+func appendReplicationPath(path []string, node string) []string {
+	if len(path) >= maxReplicationPath {
+		path = path[len(path)-maxReplicationPath+1:]
+	}
+	return append(append(make([]string, 0, len(path)+1), path...), node)
+}
+
+// replicationPathContains returns true if the node is in the path.
+func replicationPathContains(path []string, node string) bool {
+	for _, pathNode := range path {
+		if pathNode == node {
+			return true
+		}
+	}
+	return false
+}
+
+// replicationPath returns the nodes a rev was replicated through before it was written here, or nil when it was
+// written here first, or its path is no longer recorded because the doc has since been updated.
+func (bsc *BlipSyncContext) replicationPath(docID, revID string) []string {
+	syncData, err := bsc.blipContextDb.GetDocSyncData(docID)
+	if err != nil {
+		base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Unable to read sync metadata for replication path of %s/%s: %v", base.UD(docID), revID, err)
+		return nil
+	}
+	if syncData.ReplicationPath == nil || syncData.ReplicationPath.Rev != revID {
+		return nil
+	}
+	return syncData.ReplicationPath.Nodes
+}
+
+// addReplicationPath adds the nodes a rev has been through, ending with this one, to the properties of the rev
+// message sending it to another Sync Gateway.
+func (bsc *BlipSyncContext) addReplicationPath(docID, revID string, properties blip.Properties) {
+	path := appendReplicationPath(bsc.replicationPath(docID, revID), bsc.blipContextDb.Options.BlipSyncOptions.ReplicationNodeID)
+	properties[RevMessagePath] = strings.Join(path, ",")
+}
+
+// loopsBackToPeer returns true if the Sync Gateway at the other end of the connection is in the path of the rev, so
+// that announcing the rev to it would send it back where it came from.
+func (bh *blipHandler) loopsBackToPeer(docID, revID string) bool {
+	if !replicationPathContains(bh.replicationPath(docID, revID), bh.peerNode) {
+		return false
+	}
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Not sending change for %s/%s back to the Sync Gateway it was replicated from", base.UD(docID), revID)
+	bh.dbStats.StatsDatabase().Add(base.StatKeyReplicationLoops, 1)
+	return true
+}
+
+// receivedReplicationPath returns the nodes a rev received from another Sync Gateway has been through, bounded to
+// maxReplicationPath, and whether this one is among them, in which case the rev has looped back and isn't written.
+func (bh *blipHandler) receivedReplicationPath(revMessage RevMessage) (path []string, looped bool) {
+	pathStr := revMessage.Properties[RevMessagePath]
+	if pathStr == "" {
+		return nil, false
+	}
+	path = strings.Split(pathStr, ",")
+	if replicationPathContains(path, bh.blipContextDb.Options.BlipSyncOptions.ReplicationNodeID) {
+		bh.dbStats.StatsDatabase().Add(base.StatKeyReplicationLoops, 1)
+		return nil, true
+	}
+	if len(path) > maxReplicationPath {
+		path = path[len(path)-maxReplicationPath:]
+	}
+	return path, false
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendReplicationPath(t *testing.T) {
+	assert.Equal(t, []string{"a"}, appendReplicationPath(nil, "a"))
+
+	path := []string{"a", "b"}
+	assert.Equal(t, []string{"a", "b", "c"}, appendReplicationPath(path, "c"))
+	assert.Equal(t, []string{"a", "b"}, path)
+
+	var longPath []string
+	for i := 0; i < maxReplicationPath; i++ {
+		longPath = append(longPath, fmt.Sprintf("node%d", i))
+	}
+	bounded := appendReplicationPath(longPath, "last")
+	require.Len(t, bounded, maxReplicationPath)
+	assert.Equal(t, "node1", bounded[0])
+	assert.Equal(t, "last", bounded[maxReplicationPath-1])
+}
+
+// TestReplicationLoops verifies the path of a replicated rev is recorded, that the rev isn't announced to a Sync
+// Gateway in its path, and that a rev arriving with this Sync Gateway in its path is detected as a loop.
+func TestReplicationLoops(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.BlipSyncOptions.ReplicationNodeID = "local"
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	bh.NegotiateLoopDetection(http.Header{})
+	assert.False(t, bh.loopDetection)
+	bh.NegotiateLoopDetection(http.Header{BlipReplicationNodeHeader: {"local"}})
+	assert.False(t, bh.loopDetection)
+	bh.NegotiateLoopDetection(http.Header{BlipReplicationNodeHeader: {"peer"}})
+	assert.True(t, bh.loopDetection)
+	assert.Equal(t, "peer", bh.peerNode)
+
+	// Written here first
+	_, _, err := db.Put("local", Body{"key": "value"})
+	require.NoError(t, err)
+
+	// Replicated from the peer
+	replicated := &Document{ID: "replicated", nodePath: []string{"origin", "peer"}}
+	replicated.UpdateBody(Body{"key": "value"})
+	_, _, err = db.PutExistingRev(replicated, []string{"1-abc"}, false)
+	require.NoError(t, err)
+	syncData, err := db.GetDocSyncData("replicated")
+	require.NoError(t, err)
+	require.NotNil(t, syncData.ReplicationPath)
+	assert.Equal(t, ReplicationPath{Rev: "1-abc", Nodes: []string{"origin", "peer"}}, *syncData.ReplicationPath)
+
+	assert.False(t, bh.loopsBackToPeer("local", "1-abc"))
+	assert.True(t, bh.loopsBackToPeer("replicated", "1-abc"))
+
+	properties := blip.Properties{}
+	bh.addReplicationPath("replicated", "1-abc", properties)
+	assert.Equal(t, "origin,peer,local", properties[RevMessagePath])
+
+	// A later local update isn't attributed to the path
+	_, _, err = db.Put("replicated", Body{"key": "updated", BodyRev: "1-abc"})
+	require.NoError(t, err)
+	syncData, err = db.GetDocSyncData("replicated")
+	require.NoError(t, err)
+	assert.False(t, bh.loopsBackToPeer("replicated", syncData.CurrentRev))
+
+	revMessage := RevMessage{Message: blip.NewRequest()}
+	path, looped := bh.receivedReplicationPath(revMessage)
+	assert.Nil(t, path)
+	assert.False(t, looped)
+	revMessage.Properties[RevMessagePath] = "origin,peer"
+	path, looped = bh.receivedReplicationPath(revMessage)
+	assert.Equal(t, []string{"origin", "peer"}, path)
+	assert.False(t, looped)
+	revMessage.Properties[RevMessagePath] = "local,peer"
+	_, looped = bh.receivedReplicationPath(revMessage)
+	assert.True(t, looped)
+
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(db.DbStats.StatsDatabase().Get(base.StatKeyReplicationLoops)))
+}
+
+// TestReplicationNodeRole verifies only admin connections and users with the replication node role may announce a
+// replication node, as a client could otherwise have changes withheld, or revs dropped.
+func TestReplicationNodeRole(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.BlipSyncOptions.ReplicationNodeID = "local"
+
+	user, err := db.Authenticator().NewUser("alice", "letmein", nil)
+	require.NoError(t, err)
+	user.SetExplicitRoles(channels.AtSequence(base.SetOf("replicator"), 1))
+	require.NoError(t, db.Authenticator().Save(user))
+	user, err = db.Authenticator().GetUser("alice")
+	require.NoError(t, err)
+	userDb := &Database{DatabaseContext: db.DatabaseContext, Ctx: db.Ctx}
+	userDb.SetUser(user)
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: userDb, dbStats: db.DbStats, userName: "alice"}, db: userDb}
+	bh.NegotiateLoopDetection(http.Header{BlipReplicationNodeHeader: {"peer"}})
+	assert.False(t, bh.loopDetection)
+	db.Options.BlipSyncOptions.ReplicationNodeRole = "other"
+	bh.NegotiateLoopDetection(http.Header{BlipReplicationNodeHeader: {"peer"}})
+	assert.False(t, bh.loopDetection)
+	db.Options.BlipSyncOptions.ReplicationNodeRole = "replicator"
+	bh.NegotiateLoopDetection(http.Header{BlipReplicationNodeHeader: {"peer"}})
+	assert.True(t, bh.loopDetection)
+}
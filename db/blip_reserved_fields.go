@@ -0,0 +1,69 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Policies for reserved properties in the body of a pushed rev, set with BlipSyncOptions.ReservedFields.  Reserved
+// properties are top-level properties prefixed with an underscore, such as forged _sync, _rev or _revisions metadata,
+// other than the few a pushed body may legitimately carry: _attachments, _deleted and _exp.  By default they're left
+// to the write's own validation, which rejects most of them only once the rev's attachments have been fetched.
+const (
+	ReservedFieldsReject = "reject" // Rejects the rev with a 400 before any further processing
+	ReservedFieldsStrip  = "strip"  // Removes the properties, and writes the rev without them
+)
+
+// ParseReservedFieldsPolicy validates a reserved fields policy, where an empty string is the default policy.
+func ParseReservedFieldsPolicy(policy string) (string, error) {
+	switch policy {
+	case "", ReservedFieldsReject, ReservedFieldsStrip:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown reserved fields policy %q, must be %q or %q", policy, ReservedFieldsReject, ReservedFieldsStrip)
+}
+
+// pushedBodyProperties are the underscore-prefixed properties a pushed rev's body may carry, which handleRev consumes.
+var pushedBodyProperties = base.SetOf(BodyAttachments, BodyDeleted, BodyExpiry)
+
+// reservedProperties returns the sorted reserved properties in a pushed body.
+func reservedProperties(body Body) []string {
+	var reserved []string
+	for key := range body {
+		if key != "" && key[0] == '_' && !pushedBodyProperties.Contains(key) {
+			reserved = append(reserved, key)
+		}
+	}
+	sort.Strings(reserved)
+	return reserved
+}
+
+// applyReservedFieldsPolicy rejects or strips the reserved properties of a pushed rev's body, as configured.  A body
+// pushed whole is only parsed when its bytes contain a property that could be reserved; a delta has already been
+// applied, so its patched body is checked, covering reserved properties the delta adds.
+func (bh *blipHandler) applyReservedFieldsPolicy(newDoc *Document, bodyBytes []byte, isDelta bool) error {
+	policy := bh.db.Options.BlipSyncOptions.ReservedFields
+	if policy == "" || (!isDelta && !bytes.Contains(bodyBytes, []byte(`"_`))) {
+		return nil
+	}
+	body := newDoc.Body()
+	reserved := reservedProperties(body)
+	if len(reserved) == 0 {
+		return nil
+	}
+	if policy == ReservedFieldsReject {
+		bh.dbStats.CblReplicationPush().Add(base.StatKeyReservedRejected, 1)
+		return base.HTTPErrorf(http.StatusBadRequest, "Document body contains reserved properties %v", reserved)
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Stripping reserved properties %v from pushed doc %s / %s", base.UD(reserved), base.UD(newDoc.ID), newDoc.RevID)
+	for _, key := range reserved {
+		delete(body, key)
+	}
+	newDoc.UpdateBody(body)
+	bh.dbStats.CblReplicationPush().Add(base.StatKeyReservedStripped, 1)
+	return nil
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservedProperties(t *testing.T) {
+	body := Body{
+		"value":               1,
+		BodyAttachments:       map[string]interface{}{},
+		BodyDeleted:           true,
+		BodyExpiry:            100,
+		BodyRev:               "9-forged",
+		BodyRevisions:         map[string]interface{}{},
+		base.SyncPropertyName: map[string]interface{}{"rev": "9-forged"},
+	}
+	assert.Equal(t, []string{BodyRev, BodyRevisions, base.SyncPropertyName}, reservedProperties(body))
+	assert.Empty(t, reservedProperties(Body{"value": 1, BodyExpiry: 100}))
+}
+
+func TestParseReservedFieldsPolicy(t *testing.T) {
+	for _, policy := range []string{"", ReservedFieldsReject, ReservedFieldsStrip} {
+		parsed, err := ParseReservedFieldsPolicy(policy)
+		assert.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseReservedFieldsPolicy("ignore")
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// MinRevChunkSize is the smallest chunk size a client may ask rev bodies to be split into, so that a large body can't
+// be sent as an excessive number of messages.  Smaller sizes are raised to it.
+const MinRevChunkSize = 4096
+
+// A client with limited memory for buffering messages can ask, with subChanges' 'revChunkSize' property, for rev
+// bodies larger than that size to be split into chunks.  The rev message carries the first chunk as its body, along
+// with 'chunks', the number of chunks including its own, and 'bodyLength', the length of the whole body.  Each
+// further chunk follows in a "revChunk" message needing no reply, with the rev's 'id' and 'rev' and the chunk's
+// index in 'chunk'.  The last revChunk message also carries 'checksum', a CRC-32C hex string of the whole body, for
+// the client to verify once it's reassembled the chunks in index order.  A delta body is chunked the same way.  The
+// client replies to the rev message, if it needs a reply, once it's handled the reassembled body.
+
+// revBodyChunks splits a rev body into chunks of at most the given size.
+func revBodyChunks(body []byte, size int) [][]byte {
+	chunks := make([][]byte, 0, (len(body)+size-1)/size)
+	for len(body) > size {
+		chunks = append(chunks, body[:size])
+		body = body[size:]
+	}
+	return append(chunks, body)
+}
+
+// sendRevChunks sends the chunks of a chunked rev's body that follow the first, which the rev message carries.
+// Returns false if the connection is closed.
+func (bsc *BlipSyncContext) sendRevChunks(sender *blip.Sender, docID, revID string, body []byte, chunks [][]byte) bool {
+	if len(chunks) == 0 {
+		return true
+	}
+	for i := 1; i < len(chunks); i++ {
+		outrq := blip.NewRequest()
+		outrq.SetProfile(MessageRevChunk)
+		outrq.Properties[RevChunkId] = bsc.deliveredDocID(docID)
+		outrq.Properties[RevChunkRev] = revID
+		outrq.Properties[RevChunkIndex] = strconv.Itoa(i)
+		if i == len(chunks)-1 {
+			outrq.Properties[RevChunkChecksum] = base.Crc32cHashString(body)
+		}
+		outrq.SetNoReply(true)
+		outrq.SetBody(chunks[i])
+		if !bsc.sendBLIPMessage(sender, outrq) {
+			return false
+		}
+	}
+	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Sent body of %q / %q in %d chunks", base.UD(docID), revID, len(chunks))
+	bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevChunkedCount, 1)
+	bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevChunksSent, int64(len(chunks)))
+	return true
+}
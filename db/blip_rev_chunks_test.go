@@ -0,0 +1,20 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevBodyChunks(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+
+	chunks := revBodyChunks(body, 30)
+	assert.Len(t, chunks, 4)
+	assert.Len(t, chunks[3], 10)
+	assert.Equal(t, body, bytes.Join(chunks, nil))
+
+	assert.Len(t, revBodyChunks(body, 50), 2)
+	assert.Equal(t, [][]byte{body}, revBodyChunks(body, 100))
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"container/heap"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// BlipMaxRevPriority is the highest priority a client can give a pushed rev.  The default priority is 0.
+	BlipMaxRevPriority = 9
+
+	// BlipRevQueueWorkers is the number of pushed revs written concurrently per connection when the rev queue is enabled
+	BlipRevQueueWorkers = 4
+
+	// revPriorityAgingInterval is how long a queued rev waits to gain the equivalent of one priority level, so that
+	// low-priority revs are never starved by a steady stream of higher-priority ones.
+	revPriorityAgingInterval = time.Second
+)
+
+var (
+	ErrRevQueueFull   = base.HTTPErrorf(http.StatusServiceUnavailable, "Too many revs queued for writing")
+	ErrRevQueueClosed = errors.New("rev queue closed")
+)
+
+// revQueue is a bounded per-connection queue of pushed rev writes, executed by a fixed pool of workers in priority
+// order.  Aging is applied by ordering on a virtual start time: the time the write was queued, brought forward by
+// revPriorityAgingInterval per priority level.  A rev queued at priority 0 therefore runs ahead of any rev queued
+// more than BlipMaxRevPriority aging intervals after it, regardless of the later rev's priority.
+type revQueue struct {
+	lock       sync.Mutex
+	items      revQueueHeap
+	maxSize    int
+	ready      chan struct{} // Holds one token for each queued item
+	terminator chan bool     // Closed when the connection is closed, to stop the workers
+	depthStats *expvar.Map   // Queue depth by priority, shared by all connections to the database
+}
+
+type revQueueItem struct {
+	priority     int
+	virtualStart time.Time
+	write        func() error
+	done         chan error
+}
+
+// newRevQueue returns a rev queue holding up to maxSize writes, and starts its workers.  Returns nil when maxSize
+// is zero (disabled), in which case revs are written as soon as they're received.
+func newRevQueue(maxSize int, terminator chan bool, depthStats *expvar.Map) *revQueue {
+	if maxSize <= 0 {
+		return nil
+	}
+	q := &revQueue{
+		maxSize:    maxSize,
+		ready:      make(chan struct{}, maxSize),
+		terminator: terminator,
+		depthStats: depthStats,
+	}
+	for i := 0; i < BlipRevQueueWorkers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// run queues write at the given priority and blocks until it's been executed, returning its error.  Returns
+// ErrRevQueueFull without queueing when the queue is at capacity.  A nil queue executes write immediately.
+func (q *revQueue) run(priority int, write func() error) error {
+	if q == nil {
+		return write()
+	}
+
+	item := &revQueueItem{
+		priority:     priority,
+		virtualStart: time.Now().Add(-time.Duration(priority) * revPriorityAgingInterval),
+		write:        write,
+		done:         make(chan error, 1),
+	}
+
+	q.lock.Lock()
+	if len(q.items) >= q.maxSize {
+		q.lock.Unlock()
+		return ErrRevQueueFull
+	}
+	heap.Push(&q.items, item)
+	q.lock.Unlock()
+	q.depthStats.Add(strconv.Itoa(priority), 1)
+
+	select {
+	case q.ready <- struct{}{}:
+	case <-q.terminator:
+		q.remove(item)
+		return ErrRevQueueClosed
+	}
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-q.terminator:
+		q.remove(item)
+		return ErrRevQueueClosed
+	}
+}
+
+// remove discards item if it's still waiting to be executed.
+func (q *revQueue) remove(item *revQueueItem) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, queued := range q.items {
+		if queued == item {
+			heap.Remove(&q.items, i)
+			q.depthStats.Add(strconv.Itoa(item.priority), -1)
+			return
+		}
+	}
+}
+
+// work executes queued writes, highest effective priority first, until the queue is terminated.
+func (q *revQueue) work() {
+	for {
+		select {
+		case <-q.terminator:
+			return
+		case <-q.ready:
+			q.lock.Lock()
+			if len(q.items) == 0 {
+				// Only once the item has been removed by a terminated run
+				q.lock.Unlock()
+				continue
+			}
+			item := heap.Pop(&q.items).(*revQueueItem)
+			q.lock.Unlock()
+			q.depthStats.Add(strconv.Itoa(item.priority), -1)
+			item.done <- item.write()
+		}
+	}
+}
+
+// revQueueHeap implements heap.Interface, ordered by virtual start time.
+type revQueueHeap []*revQueueItem
+
+func (h revQueueHeap) Len() int           { return len(h) }
+func (h revQueueHeap) Less(i, j int) bool { return h[i].virtualStart.Before(h[j].virtualStart) }
+func (h revQueueHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *revQueueHeap) Push(x interface{}) {
+	*h = append(*h, x.(*revQueueItem))
+}
+
+func (h *revQueueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"container/heap"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRevQueueHeapOrder verifies queued writes are ordered highest priority first, and that aging lets an older
+// low-priority write run ahead of a much newer high-priority one.
+func TestRevQueueHeapOrder(t *testing.T) {
+	now := time.Now()
+	newItem := func(priority int, enqueuedAgo time.Duration) *revQueueItem {
+		return &revQueueItem{
+			priority:     priority,
+			virtualStart: now.Add(-enqueuedAgo - time.Duration(priority)*revPriorityAgingInterval),
+		}
+	}
+	low := newItem(0, 0)
+	high := newItem(5, 0)
+	mid := newItem(2, 0)
+	aged := newItem(0, 20*revPriorityAgingInterval)
+
+	var h revQueueHeap
+	for _, item := range []*revQueueItem{low, high, aged, mid} {
+		heap.Push(&h, item)
+	}
+
+	var order []*revQueueItem
+	for h.Len() > 0 {
+		order = append(order, heap.Pop(&h).(*revQueueItem))
+	}
+	assert.Equal(t, []*revQueueItem{aged, high, mid, low}, order)
+}
+
+// TestRevQueueRun verifies writes are executed through the queue, and that depth stats return to zero afterwards.
+func TestRevQueueRun(t *testing.T) {
+	assert.Nil(t, newRevQueue(0, nil, nil))
+
+	// A nil queue writes immediately
+	var q *revQueue
+	assert.NoError(t, q.run(0, func() error { return nil }))
+
+	terminator := make(chan bool)
+	defer close(terminator)
+	depthStats := new(expvar.Map).Init()
+	q = newRevQueue(10, terminator, depthStats)
+
+	written := false
+	assert.NoError(t, q.run(3, func() error {
+		written = true
+		return nil
+	}))
+	assert.True(t, written)
+	assert.Equal(t, int64(0), base.ExpvarVar2Int(depthStats.Get("3")))
+}
+
+// TestRevQueueFull verifies a write is rejected without being executed once the queue holds as many writes waiting
+// for a worker as its capacity, and that the queued writes still run once the workers are free.
+func TestRevQueueFull(t *testing.T) {
+	terminator := make(chan bool)
+	defer close(terminator)
+	depthStats := new(expvar.Map).Init()
+	const maxSize = 2
+	q := newRevQueue(maxSize, terminator, depthStats)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, BlipRevQueueWorkers)
+	var wg sync.WaitGroup
+	runAsync := func(write func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, q.run(1, write))
+		}()
+	}
+
+	// Occupy every worker, so that later writes stay queued
+	for i := 0; i < BlipRevQueueWorkers; i++ {
+		runAsync(func() error {
+			started <- struct{}{}
+			<-release
+			return nil
+		})
+	}
+	for i := 0; i < BlipRevQueueWorkers; i++ {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for workers to start writes")
+		}
+	}
+
+	var queuedWrites int32
+	for i := 0; i < maxSize; i++ {
+		runAsync(func() error {
+			atomic.AddInt32(&queuedWrites, 1)
+			return nil
+		})
+	}
+	err, _ := base.RetryLoop("waitForQueuedWrites", func() (bool, error, interface{}) {
+		return base.ExpvarVar2Int(depthStats.Get("1")) != maxSize, nil, nil
+	}, base.CreateSleeperFunc(200, 50))
+	require.NoError(t, err, "Writes weren't queued")
+
+	rejectedWritten := false
+	assert.Equal(t, ErrRevQueueFull, q.run(0, func() error {
+		rejectedWritten = true
+		return nil
+	}))
+	assert.False(t, rejectedWritten)
+	assert.Equal(t, int64(0), base.ExpvarVar2Int(depthStats.Get("0")))
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(maxSize), atomic.LoadInt32(&queuedWrites))
+	assert.Equal(t, int64(0), base.ExpvarVar2Int(depthStats.Get("1")))
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxRevSendLogSize is the upper bound on the number of entries retained in a connection's rev send log.
+const MaxRevSendLogSize = 10000
+
+// Rev send log entry statuses
+const (
+	RevSendStatusSent        = "sent"         // Sent without requesting a reply, so no ack is expected
+	RevSendStatusAwaitingAck = "awaiting_ack" // Sent, waiting for the client's reply
+	RevSendStatusAcked       = "acked"        // Client replied successfully
+	RevSendStatusError       = "error"        // Client replied with an error
+	RevSendStatusNoRev       = "norev"        // Revision couldn't be sent, and a norev was sent instead
+)
+
+// RevSendLogEntry records the server's decision when sending a single revision to a client.  Document bodies are
+// never retained.
+type RevSendLogEntry struct {
+	DocID    string    `json:"id"`
+	RevID    string    `json:"rev"`
+	Seq      string    `json:"seq,omitempty"`
+	DeltaSrc string    `json:"deltaSrc,omitempty"` // Set when the revision was sent as a delta from this revision
+	Bytes    int       `json:"bytes"`              // Size of the revision (or delta) body sent
+	Status   string    `json:"status"`
+	Time     time.Time `json:"time"`
+	serial   uint64
+}
+
+// revSendLog is an opt-in, fixed size ring buffer of the most recent rev send decisions on a BLIP connection, used
+// to debug replications where a client reports that it didn't receive a document.
+type revSendLog struct {
+	lock       sync.Mutex
+	entries    []RevSendLogEntry
+	nextSerial uint64 // Serial number of the next entry, entries[nextSerial % len(entries)] is the oldest entry
+}
+
+// newRevSendLog returns a rev send log holding up to size entries (capped to MaxRevSendLogSize), or nil when
+// size is zero.
+func newRevSendLog(size int) *revSendLog {
+	if size <= 0 {
+		return nil
+	}
+	if size > MaxRevSendLogSize {
+		size = MaxRevSendLogSize
+	}
+	return &revSendLog{
+		entries: make([]RevSendLogEntry, 0, size),
+	}
+}
+
+// add records entry, overwriting the oldest entry when the log is full, and returns the entry's serial number
+// for use with setStatus.
+func (l *revSendLog) add(entry RevSendLogEntry) uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry.serial = l.nextSerial
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[entry.serial%uint64(len(l.entries))] = entry
+	}
+	l.nextSerial++
+	return entry.serial
+}
+
+// setStatus updates the status of the entry with the given serial number, if it hasn't since been overwritten.
+func (l *revSendLog) setStatus(serial uint64, status string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) == 0 {
+		return
+	}
+	entry := &l.entries[serial%uint64(len(l.entries))]
+	if entry.serial == serial {
+		entry.Status = status
+	}
+}
+
+// snapshot returns a copy of the log's entries, oldest first.
+func (l *revSendLog) snapshot() []RevSendLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	result := make([]RevSendLogEntry, 0, len(l.entries))
+	if len(l.entries) < cap(l.entries) {
+		return append(result, l.entries...)
+	}
+	oldest := int(l.nextSerial % uint64(len(l.entries)))
+	result = append(result, l.entries[oldest:]...)
+	return append(result, l.entries[:oldest]...)
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRevSendLogWraparound ensures the log is bounded, returns entries oldest first, and only updates the status
+// of entries that haven't been overwritten.
+func TestRevSendLogWraparound(t *testing.T) {
+	assert.Nil(t, newRevSendLog(0))
+
+	log := newRevSendLog(3)
+	serials := make([]uint64, 0, 5)
+	for i := 0; i < 5; i++ {
+		serials = append(serials, log.add(RevSendLogEntry{DocID: "doc" + strconv.Itoa(i), RevID: "1-abc", Status: RevSendStatusAwaitingAck}))
+	}
+
+	// doc0 has been overwritten, so its update must not affect the entry now in its slot
+	log.setStatus(serials[0], RevSendStatusError)
+	log.setStatus(serials[3], RevSendStatusAcked)
+
+	entries := log.snapshot()
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "doc2", entries[0].DocID)
+	assert.Equal(t, RevSendStatusAwaitingAck, entries[0].Status)
+	assert.Equal(t, "doc3", entries[1].DocID)
+	assert.Equal(t, RevSendStatusAcked, entries[1].Status)
+	assert.Equal(t, "doc4", entries[2].DocID)
+	assert.Equal(t, RevSendStatusAwaitingAck, entries[2].Status)
+}
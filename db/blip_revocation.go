@@ -0,0 +1,109 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// revocationScanLimit is the most entries read from each revoked channel when finding the docs a user has lost access
+// to.  Docs beyond it aren't listed, and the revoked message is marked truncated.
+const revocationScanLimit = 10000
+
+// revokedChannels returns the channels a refreshed user has lost access to that the subscription could have sent
+// docs from.
+func (bsc *BlipSyncContext) revokedChannels(oldUser, newUser auth.User) []string {
+	_, revoked := compareAccess(oldUser.InheritedChannels(), newUser.InheritedChannels(), bsc.blipContextDb.Options.BlipSyncOptions.DeniedChannels)
+	bsc.lock.Lock()
+	patterns := bsc.channelPatterns
+	bsc.lock.Unlock()
+	if bsc.channels == nil && patterns == nil {
+		return revoked
+	}
+	subscribed := revoked[:0]
+	for _, channel := range revoked {
+		if bsc.channels.Contains(channel) || patterns.matches(channel) {
+			subscribed = append(subscribed, channel)
+		}
+	}
+	return subscribed
+}
+
+// sendRevocations notifies the client of the docs in channels the user has lost access to that it can no longer see
+// through any other channel, so that it can purge them.  They're sent in a revoked message, whose body is a JSON array
+// of [docID, revID] rows giving each doc's current revision, without waiting for a reply.  No more than
+// BlipSyncOptions.MaxRevocations docs are listed for a single change to the user's access; when there are more, or
+// a revoked channel has too many entries to scan, the message's 'truncated' property is set, and the client should
+// reconcile its database to find the rest.  Unlike a deletion, a revocation leaves the doc in place on the server.
+func (bh *blipHandler) sendRevocations(sender *blip.Sender, revokedChannels []string) {
+	maxRevocations := bh.db.Options.BlipSyncOptions.MaxRevocations
+	user := bh.db.User()
+	if len(revokedChannels) == 0 || maxRevocations <= 0 || user == nil {
+		return
+	}
+
+	revocations := make([][]interface{}, 0)
+	seen := make(map[string]bool)
+	truncated := false
+	for _, channel := range revokedChannels {
+		entries, err := bh.db.changeCache.GetChanges(channel, ChangesOptions{Limit: revocationScanLimit, Terminator: bh.terminator, Ctx: bh.db.Ctx})
+		if err != nil {
+			base.WarnfCtx(bh.blipContextDb.Ctx, "Unable to find docs in revoked channel %s: %v", base.UD(channel), err)
+			truncated = true
+			continue
+		}
+		if len(entries) >= revocationScanLimit {
+			truncated = true
+		}
+		for _, entry := range entries {
+			if seen[entry.DocID] || entry.IsPrincipal || strings.HasPrefix(entry.DocID, "_") || !bh.isDelivered(entry.DocID) {
+				continue
+			}
+			seen[entry.DocID] = true
+			syncData, err := bh.db.GetDocSyncData(entry.DocID)
+			if err != nil {
+				continue
+			}
+			current := base.Set{}
+			for docChannel, removal := range syncData.Channels {
+				if removal == nil {
+					current.Add(docChannel)
+				}
+			}
+			if len(current) > 0 && user.AuthorizeAnyChannel(current) == nil {
+				continue
+			}
+			if len(revocations) == maxRevocations {
+				truncated = true
+				break
+			}
+			revocations = append(revocations, []interface{}{bh.deliveredDocID(entry.DocID), syncData.CurrentRev})
+		}
+		if len(revocations) == maxRevocations && truncated {
+			break
+		}
+	}
+	if len(revocations) == 0 && !truncated {
+		return
+	}
+
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageRevoked)
+	outrq.SetNoReply(true)
+	if truncated {
+		outrq.Properties[RevokedTruncated] = "true"
+	}
+	if err := outrq.SetJSONBody(revocations); err != nil {
+		base.WarnfCtx(bh.blipContextDb.Ctx, "Error setting revoked body: %v", err)
+		return
+	}
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "Sending revocation of %d docs in channels %v for user %s (truncated: %t)",
+		len(revocations), base.UD(revokedChannels), base.UD(bh.userName), truncated)
+	if !bh.sendBLIPMessage(sender, outrq) {
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "Unable to send revoked for user %s - connection closed", base.UD(bh.userName))
+		return
+	}
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevokedDocsSent, int64(len(revocations)))
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultSequenceBarrierTimeout is how long a subChanges request waits for the change cache to reach the sequence it
+// asked for, when no timeout is configured.
+const DefaultSequenceBarrierTimeout = 10 * time.Second
+
+// A client that pushes a rev and then subscribes to changes expects to see its write in the feed, but the change
+// cache may not have received it yet.  The response to a pushed rev carries the sequence it was written at, and a
+// subChanges request may ask, with the waitForSequence property, for the feed not to start until the change cache has
+// received that sequence, for up to BlipSyncOptions.SequenceBarrierTimeout.  The wait happens before the subscription
+// is opened, so that a client whose request times out can retry it.
+
+// waitForSequenceBarrier blocks until the change cache has received the sequence the subChanges request asked it to
+// wait for, if any, returning a 504 if it doesn't within the configured timeout.
+func (bh *blipHandler) waitForSequenceBarrier(rq *blip.Message) error {
+	seqStr := rq.Properties[SubChangesWaitSeq]
+	if seqStr == "" {
+		return nil
+	}
+	sequence, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid %s: %s", SubChangesWaitSeq, seqStr)
+	}
+
+	timeout := bh.db.Options.BlipSyncOptions.SequenceBarrierTimeout
+	if timeout <= 0 {
+		timeout = DefaultSequenceBarrierTimeout
+	}
+	ctx := bh.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeySequenceBarrierWaits, 1)
+	startTime := time.Now()
+	if err := bh.db.changeCache.waitForSequenceNotSkipped(ctx, sequence, timeout); err != nil {
+		if ctx.Err() != nil && time.Since(startTime) < timeout {
+			return ErrBLIPDeadlineExceeded
+		}
+		bh.dbStats.StatsCblReplicationPull().Add(base.StatKeySequenceBarrierTimeouts, 1)
+		return base.HTTPErrorf(http.StatusGatewayTimeout, "Timed out waiting for the change cache to reach sequence %d", sequence)
+	}
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Waited %v for the change cache to reach sequence %d", time.Since(startTime), sequence)
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForSequenceBarrier(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.BlipSyncOptions.SequenceBarrierTimeout = 100 * time.Millisecond
+
+	_, doc, err := db.Put("doc1", Body{"key": "value"})
+	require.NoError(t, err)
+	require.NoError(t, db.WaitForPendingChanges(context.TODO()))
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	subChanges := func(waitForSequence string) *blip.Message {
+		rq := blip.NewRequest()
+		rq.SetProfile(MessageSubChanges)
+		if waitForSequence != "" {
+			rq.Properties[SubChangesWaitSeq] = waitForSequence
+		}
+		return rq
+	}
+
+	assert.NoError(t, bh.waitForSequenceBarrier(subChanges("")))
+	assert.NoError(t, bh.waitForSequenceBarrier(subChanges(strconv.FormatUint(doc.Sequence, 10))))
+
+	status, _ := base.ErrorAsHTTPStatus(bh.waitForSequenceBarrier(subChanges("abc")))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = base.ErrorAsHTTPStatus(bh.waitForSequenceBarrier(subChanges(strconv.FormatUint(doc.Sequence+100, 10))))
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+
+	pullStats := db.DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(pullStats.Get(base.StatKeySequenceBarrierWaits)))
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeySequenceBarrierTimeouts)))
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// DefaultMaxSortedChanges is the default maximum number of changes buffered for a sorted one-shot pull.
+const DefaultMaxSortedChanges = 10000
+
+var errTooManySortedChanges = errors.New("too many changes to sort")
+
+// collectSortedChanges buffers every change matching a one-shot subChanges request, ordered by the value of the
+// top-level sortBy property of each revision's body.  Unlike a regular pull, the whole result set is held in memory
+// until it's been sent, along with one body read per change to find its sort value, so the number of changes is
+// capped by BlipSyncOptions.MaxSortedChanges and the request is rejected if the cap is exceeded.
+func (bh *blipHandler) collectSortedChanges(params *SubChangesParams, sortBy string) ([][]interface{}, error) {
+	changeRows, err := bh.collectChangeRows(params, SubChangesSortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	sortValues := make(map[string]interface{}, len(changeRows))
+	for _, changeRow := range changeRows {
+		docID, revID := changeRow[1].(string), changeRow[2].(string)
+		sortValues[docID] = bh.sortValue(docID, revID, sortBy)
+	}
+	sortChangeRows(changeRows, sortValues)
+	return changeRows, nil
+}
+
+// collectChangeRows buffers the changes rows for a one-shot subChanges request that the given ordering option needs
+// to reorder, rejecting the request if there are more than BlipSyncOptions.MaxSortedChanges.
+func (bh *blipHandler) collectChangeRows(params *SubChangesParams, ordering string) ([][]interface{}, error) {
+	maxChanges := bh.db.Options.BlipSyncOptions.MaxSortedChanges
+	if maxChanges <= 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "%s is not enabled", ordering)
+	}
+
+	options := ChangesOptions{
+		Since:        params.Since(),
+		Conflicts:    false,
+		Continuous:   false,
+		ActiveOnly:   bh.activeOnly,
+		Terminator:   bh.BlipSyncContext.terminator,
+		Ctx:          bh.db.Ctx,
+		ClientIsCBL2: true,
+	}
+
+	channelSet := bh.channels
+	if channelSet == nil {
+		channelSet = base.SetOf(channels.AllChannelWildcard)
+	}
+
+	var changeRows [][]interface{}
+	tooManyChanges := false
+	changesDb := bh.copyContextDatabase()
+	err, _ := generateBlipSyncChanges(changesDb, channelSet, options, params.docIDs(), func(changes []*ChangeEntry) error {
+		for _, change := range changes {
+			changeRows = append(changeRows, bh.changeRows(change)...)
+		}
+		if len(changeRows) > maxChanges {
+			tooManyChanges = true
+			return errTooManySortedChanges
+		}
+		return nil
+	})
+	if tooManyChanges {
+		return nil, base.HTTPErrorf(http.StatusRequestEntityTooLarge, "More than %d changes to order by %s - use a narrower filter or an unordered pull", maxChanges, ordering)
+	} else if err != nil {
+		return nil, err
+	}
+	return changeRows, nil
+}
+
+// sortValue returns the value of the given top-level property of a revision's body, or nil if the revision can't
+// be read or doesn't have the property.
+func (bh *blipHandler) sortValue(docID, revID, sortBy string) interface{} {
+	rev, err := bh.db.revisionCache.Get(docID, revID, RevCacheIncludeBody, RevCacheOmitDelta)
+	if err != nil || rev.Deleted {
+		return nil
+	}
+	body, err := rev.MutableBody()
+	if err != nil {
+		return nil
+	}
+	// Bodies are unmarshalled with json.Number to preserve large numbers, but sort values are compared as float64
+	if number, ok := body[sortBy].(json.Number); ok {
+		if value, err := number.Float64(); err == nil {
+			return value
+		}
+	}
+	return body[sortBy]
+}
+
+// sortChangeRows sorts changes rows by their doc's sort value, using doc ID to break ties so that the order is stable.
+func sortChangeRows(changeRows [][]interface{}, sortValues map[string]interface{}) {
+	sort.SliceStable(changeRows, func(i, j int) bool {
+		docI, docJ := changeRows[i][1].(string), changeRows[j][1].(string)
+		if cmp := compareSortValues(sortValues[docI], sortValues[docJ]); cmp != 0 {
+			return cmp < 0
+		}
+		return docI < docJ
+	})
+}
+
+// compareSortValues orders JSON values as: missing or null, booleans (false first), numbers, strings, then arrays and
+// objects, which aren't compared with each other.
+func compareSortValues(a, b interface{}) int {
+	rankA, rankB := sortValueRank(a), sortValueRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		if b := b.(float64); a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case string:
+		if b := b.(string); a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	}
+	return 0
+}
+
+func sortValueRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// sendSortedChanges sends previously collected changes in order, followed by the empty batch signalling the client
+// is caught up.  Batches are sent one at a time, so that revs are also delivered in order.
+func (bh *blipHandler) sendSortedChanges(sender *blip.Sender, changeRows [][]interface{}) {
+	for len(changeRows) > 0 {
+		batchSize := bh.batchSize
+		if batchSize > len(changeRows) {
+			batchSize = len(changeRows)
+		}
+		if err := bh.sendBatchOfChanges(sender, changeRows[:batchSize]); err != nil {
+			return
+		}
+		changeRows = changeRows[batchSize:]
+	}
+	_ = bh.sendBatchOfChanges(sender, nil)
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSortChangeRows verifies changes rows are ordered by sort value type, then value, then doc ID.
+func TestSortChangeRows(t *testing.T) {
+	sortValues := map[string]interface{}{
+		"doc1": 10.0,
+		"doc2": "b",
+		"doc3": nil,
+		"doc4": 2.5,
+		"doc5": true,
+		"doc6": "a",
+		"doc7": 10.0,
+		"doc8": map[string]interface{}{"nested": 1},
+		"doc9": false,
+	}
+	var changeRows [][]interface{}
+	for _, docID := range []string{"doc7", "doc1", "doc2", "doc3", "doc4", "doc5", "doc6", "doc8", "doc9"} {
+		changeRows = append(changeRows, []interface{}{SequenceID{Seq: 1}, docID, "1-a"})
+	}
+
+	sortChangeRows(changeRows, sortValues)
+
+	var docIDs []string
+	for _, changeRow := range changeRows {
+		docIDs = append(docIDs, changeRow[1].(string))
+	}
+	assert.Equal(t, []string{"doc3", "doc9", "doc5", "doc4", "doc1", "doc7", "doc6", "doc2", "doc8"}, docIDs)
+}
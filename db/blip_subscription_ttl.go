@@ -0,0 +1,82 @@
+package db
+
+import (
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A continuous subscription may be given a TTL with the subChanges 'subscriptionTTL' property, e.g. for a temporary
+// live view, so that the server doesn't keep feeding a client that's no longer interested.  Once the TTL elapses the
+// feed ends as if the connection had closed, but the connection stays open: the subscription is released, so that
+// another may be opened, and the client is sent a subChangesExpired message, after which it can renew the
+// subscription from its checkpoint if it wants.  The timer is stopped if the feed ends first, e.g. because the
+// connection closed.
+
+// subscriptionExpiry ends a subscription's changes feed once its TTL elapses.
+type subscriptionExpiry struct {
+	terminator chan bool     // Closed once the TTL elapses or the connection closes, ending the feed
+	done       chan struct{} // Closed once the feed has ended, stopping the timer
+	expired    bool          // Whether the TTL elapsed.  Only read once terminator is closed
+}
+
+// newSubscriptionExpiry starts the timer for a subscription with the given TTL, or returns nil for no TTL.
+func newSubscriptionExpiry(ttl time.Duration, connectionTerminator chan bool) *subscriptionExpiry {
+	if ttl <= 0 {
+		return nil
+	}
+	expiry := &subscriptionExpiry{
+		terminator: make(chan bool),
+		done:       make(chan struct{}),
+	}
+	go func() {
+		timer := time.NewTimer(ttl)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			expiry.expired = true
+		case <-connectionTerminator:
+		case <-expiry.done:
+		}
+		close(expiry.terminator)
+	}()
+	return expiry
+}
+
+// stop stops the timer once the feed has ended, returning true if the feed ended because the TTL elapsed.
+func (expiry *subscriptionExpiry) stop() bool {
+	if expiry == nil {
+		return false
+	}
+	close(expiry.done)
+	<-expiry.terminator
+	return expiry.expired
+}
+
+// feedTerminator returns the channel whose closing ends the subscription's changes feed.
+func (bh *blipHandler) feedTerminator() chan bool {
+	if bh.subscriptionExpiry != nil {
+		return bh.subscriptionExpiry.terminator
+	}
+	return bh.terminator
+}
+
+// endExpiredSubscription releases a continuous subscription whose TTL has elapsed, so that the client can renew it,
+// and tells the client it's expired.
+func (bh *blipHandler) endExpiredSubscription(sender *blip.Sender) {
+	base.InfofCtx(bh.blipContextDb.Ctx, base.KeySync, "Subscription TTL elapsed - ending changes feed")
+	bh.lock.Lock()
+	bh.gotSubChanges = false
+	bh.lock.Unlock()
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyPullReplicationsActiveContinuous, -1)
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeySubscriptionsExpired, 1)
+	bh.activeSubChanges.Set(false)
+
+	outrq := blip.NewRequest()
+	outrq.SetProfile(MessageSubExpired)
+	outrq.SetNoReply(true)
+	if !bh.sendBLIPMessage(sender, outrq) {
+		base.InfofCtx(bh.blipContextDb.Ctx, base.KeySyncMsg, "Unable to send %s - connection closed", MessageSubExpired)
+	}
+}
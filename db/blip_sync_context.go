@@ -1,8 +1,12 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"net/http"
 	"regexp"
 	"runtime/debug"
 	"strconv"
@@ -17,6 +21,21 @@ const (
 	// Blip default vals
 	BlipDefaultBatchSize = uint64(200)
 	BlipMinimumBatchSize = uint64(10) // Not in the replication spec - is this required?
+
+	// DefaultMaxChangesBatchSize is the largest subChanges batch size a client may ask for, when no maximum is configured
+	DefaultMaxChangesBatchSize = 10000
+
+	// BlipMaxRevResendAttempts is the number of times a rev is re-sent after the client reports a temporary failure
+	BlipMaxRevResendAttempts = 3
+
+	// BlipMaxAnnouncedRevs is the number of announced revisions tracked per connection to detect metadata-only changes
+	BlipMaxAnnouncedRevs = 10000
+
+	// blipMaxChangesResponsePrealloc is the most bytes preallocated for a changes or proposeChanges response
+	blipMaxChangesResponsePrealloc = 64 * 1024
+
+	// DefaultAttachmentRetryBackoff is the wait before the first retry of a failed attachment download
+	DefaultAttachmentRetryBackoff = 100 * time.Millisecond
 )
 
 var (
@@ -37,18 +56,34 @@ var (
 
 var ErrClosedBLIPSender = errors.New("use of closed BLIP sender")
 
+// ErrBLIPDeadlineExceeded is returned when a request's client-supplied deadline elapses before it's been handled
+var ErrBLIPDeadlineExceeded = base.HTTPErrorf(http.StatusGatewayTimeout, "Request deadline exceeded")
+
+// ErrAttachmentDownload is returned when the client responds to a getAttachment request with an error.
+type ErrAttachmentDownload struct {
+	Digest string
+	Status int // HTTP status of the client's error, or 0 if it isn't an HTTP error
+}
+
+func (e *ErrAttachmentDownload) Error() string {
+	return fmt.Sprintf("Client returned error %d for attachment with digest: %s", e.Status, e.Digest)
+}
+
+// Cause allows ErrAttachmentDownload to be reported as a 400 Bad Request, as the client failed to send data its rev
+// references.
+func (e *ErrAttachmentDownload) Cause() error {
+	return base.HTTPErrorf(http.StatusBadRequest, "%s", e.Error())
+}
+
+// isTransientAttachmentError returns true if an attachment download failed with a 5xx error from the client, which
+// may succeed if retried.
+func isTransientAttachmentError(err error) bool {
+	downloadErr, ok := err.(*ErrAttachmentDownload)
+	return ok && downloadErr.Status >= http.StatusInternalServerError
+}
+
 func NewBlipSyncContext(bc *blip.Context, db *Database, contextID string) *BlipSyncContext {
-	bsc := &BlipSyncContext{
-		blipContext:      bc,
-		blipContextDb:    db,
-		terminator:       make(chan bool),
-		userChangeWaiter: db.NewUserWaiter(),
-		dbStats:          db.DatabaseContext.DbStats,
-		sgCanUseDeltas:   db.DeltaSyncEnabled(),
-	}
-	if u := db.User(); u != nil {
-		bsc.userName = u.Name()
-	}
+	bsc := newBlipSyncContext(bc, db)
 
 	// Register default handlers
 	bc.DefaultHandler = bsc.NotFoundHandler
@@ -64,6 +99,34 @@ func NewBlipSyncContext(bc *blip.Context, db *Database, contextID string) *BlipS
 	return bsc
 }
 
+// newBlipSyncContext returns the context for a database replicating over the connection, without registering its
+// handlers.
+func newBlipSyncContext(bc *blip.Context, db *Database) *BlipSyncContext {
+	bsc := &BlipSyncContext{
+		blipContext:      bc,
+		blipContextDb:    db,
+		terminator:       make(chan bool),
+		flushRequests:    make(chan struct{}, 1),
+		userChangeWaiter: db.NewUserWaiter(),
+		dbStats:          db.DatabaseContext.DbStats,
+		sgCanUseDeltas:   db.DeltaSyncEnabled(),
+		revSendLog:       newRevSendLog(db.Options.BlipSyncOptions.RevSendLogSize),
+		traceContext:     context.Background(),
+	}
+	bsc.deltaFailures = newDeltaFailureTracker(db.Options.BlipSyncOptions.DeltaFailureThreshold, db.Options.BlipSyncOptions.DeltaFailureCooldown,
+		bsc.dbStats.StatsDeltaSync().Get(base.StatKeyDeltasDisabledConns).(*expvar.Int))
+	bsc.pushDocs = newPushDocTracker(db.Options.BlipSyncOptions.MaxPushDocs, db.Options.BlipSyncOptions.PushDocWindow,
+		bsc.dbStats.CblReplicationPush().Get(base.StatKeyPushDocsTracked).(*expvar.Int))
+	bsc.attachmentRepeats = newAttachmentRepeatTracker(db.Options.BlipSyncOptions)
+	bsc.changesWindow = newChangesWindow(db.Options.BlipSyncOptions.MaxInFlightChangeBatches,
+		bsc.dbStats.StatsCblReplicationPull().Get(base.StatKeyChangesBatchesInFlight).(*expvar.Int))
+	bsc.revQueue = newRevQueue(db.Options.BlipSyncOptions.RevQueueSize, bsc.terminator, bsc.dbStats.CblReplicationPush().Get(base.StatKeyRevQueueDepth).(*expvar.Map))
+	if u := db.User(); u != nil {
+		bsc.userName = u.Name()
+	}
+	return bsc
+}
+
 // BlipSyncContext represents one BLIP connection (socket) opened by a client.
 // This connection remains open until the client closes it, and can receive any number of requests.
 type BlipSyncContext struct {
@@ -77,6 +140,7 @@ type BlipSyncContext struct {
 	channels                  base.Set
 	lock                      sync.Mutex
 	allowedAttachments        map[string]int
+	allowedAttachmentDocs     map[string]map[string]int   // Digest to the docs whose revs being sent allow the client to fetch it, with counts.  Guarded by lock
 	handlerSerialNumber       uint64                      // Each handler within a context gets a unique serial number for logging
 	terminatorOnce            sync.Once                   // Used to ensure the terminator channel below is only ever closed once.
 	terminator                chan bool                   // Closed during BlipSyncContext.close(). Ensures termination of async goroutines.
@@ -88,6 +152,75 @@ type BlipSyncContext struct {
 	dbStats                   *DatabaseStats              // Direct stats access to support reloading db while stats are being updated
 	postHandleRevCallback     func(remoteSeq string)      // postHandleRevCallback is called after successfully handling an incoming rev message
 	postHandleChangesCallback func(expectedSeqs []string) // postHandleChangesCallback is called after successfully handling an incoming changes message
+	postCaughtUpCallback      func(lastSeq SequenceID)    // postCaughtUpCallback is called once a subscription's feed first catches up, with the last sequence sent
+	initialSyncTracker        *initialSyncProgressTracker // Tracks acked changes batches for a subChanges request with a 'session', when enabled
+	stagedSync                bool                        // Whether rev bodies are only sent for docs the client selects via selectChanges
+	awaitingSelection         base.AtomicBool             // Set while a staged changes batch is awaiting the client's selection.  Atomic access
+	stagedSelection           chan []string               // Delivers the client's selectChanges docIDs to the staged changes batch awaiting them
+	revSendLog                *revSendLog                 // Recent rev send decisions for diagnostics, when enabled
+	revRetry                  bool                        // Whether revs are re-sent when the client reports a temporary failure to persist them
+	revResendAttempts         map[IDAndRev]int            // Number of times each rev awaiting a successful reply has been re-sent.  Guarded by lock
+	metadataChanges           bool                        // Whether the client is notified of metadata-only changes to revisions already announced
+	announcedRevs             map[string]string           // DocID to the revID last announced to the client, used to detect metadata-only changes
+	revQueue                  *revQueue                   // Orders pushed rev writes by priority, when enabled
+	changesWindow             *changesWindow              // Caps the changes batches awaiting the client's response
+	sortBy                    string                      // Body property a one-shot pull's changes are sorted by, when set
+	dependencyOrder           bool                        // Whether a one-shot pull's docs are sent after the docs they reference
+	attachmentsOnly           bool                        // Whether changes to docs without attachments are skipped
+	excludedChannels          base.Set                    // Channels whose changes are skipped, though the subscription includes them
+	channelPatterns           *channelPatterns            // Glob patterns the subscription's channels are expanded from, when it gave any
+	patternChannels           base.Set                    // The user's channels channelPatterns currently expands to.  Guarded by lock
+	maxStaleness              time.Duration               // How stale the index reads backfilling the feed may be, clamped to BlipSyncOptions.MaxStaleness
+	changesPacer              *changesPacer               // Limits the rate changes are sent at, when the client asked for pacing
+	revChunkSize              int                         // Size of the chunks rev bodies larger than it are sent in, as the client asked.  0 sends bodies whole
+	deliveryCounter           *deliveryCounter            // Numbers the revs sent on the subscription, when the client asked for delivery indexes
+	summaries                 bool                        // Whether revs are sent with summaries of their bodies in place of the full bodies
+	tombstonesFirst           bool                        // Whether changes for docs deleted within the catch-up window are sent as their tombstones
+	tombstoneWindowEnd        uint64                      // Last sequence of the catch-up window for tombstonesFirst, when the subscription started
+	subscriptionExpiry        *subscriptionExpiry         // Ends the subscription's feed once its TTL elapses, when the client gave it one
+	deliveryLog               *deliveryLog                // Revs the client has acknowledged, skipped on reconnect, when it subscribed with a session and the log is enabled
+	minDocSize                int                         // Smallest body size of the docs whose changes are sent, or 0 for no minimum
+	maxDocSize                int                         // Largest body size of the docs whose changes are sent, or 0 for no maximum
+	flushRequests             chan struct{}               // Signals the running subscription to flush its buffered changes, at most one at a time
+	pushDocs                  *pushDocTracker             // Caps the distinct docs pushed in a push session, when enabled
+	attachmentRepeats         *attachmentRepeatTracker    // Applies the policy for repeated attachment requests, when one is configured
+	progressMilestones        *progressMilestones         // Tracks the subscription's progress towards its next milestones, when configured
+	filterExpression          *filterExpression           // Post-filter for changes, for the sync_gateway/byexpression filter
+	bodyChecksum              bool                        // Whether revs are sent with a checksum of their body, which the client verifies
+	recoverableTombstones     bool                        // Whether tombstones within the retention window are flagged as recoverable
+	templateDeltas            bool                        // Whether a doc's first rev may be sent as a delta against its type's template
+	channelCheckpoints        bool                        // Whether changes rows list their channels, for a client keeping per-channel checkpoints
+	channelMembership         bool                        // Whether revs list the channels their doc entered and left relative to the parent revision
+	accessChangedSender       *blip.Sender                // Sender for accessChanged notifications, when the client asked for them.  Guarded by dbUserLock
+	revocationSender          *blip.Sender                // Sender for revoked notifications, when the client asked for them.  Guarded by dbUserLock
+	deltaFormat               string                      // Format of deltas sent to the client
+	deltaFailures             *deltaFailureTracker        // Disables pushed deltas after repeated failures to apply them, when enabled
+	cursorTokens              bool                        // Whether changes rows carry a cursor token for the client to resume from
+	cursorChannelSince        map[string]uint64           // The subscription's per-channel checkpoints, encoded in cursor tokens
+	inFlight                  sync.WaitGroup              // Requests currently being handled, drained before closing for max lifetime
+	sender                    *blip.Sender                // Sender of the connection's first request, used for the closing message.  Guarded by lock
+	closing                   bool                        // Set once the connection has begun closing, after which requests are rejected.  Guarded by lock
+	lifetimeTimer             *time.Timer                 // Closes the connection when it reaches its maximum lifetime, when enabled.  Guarded by lock
+	traceContext              context.Context             // Trace context propagated by the client when it connected, the parent of handler spans
+	keepaliveInterval         time.Duration               // Interval keepalives are sent at on an idle continuous feed, as negotiated at handshake.  0 disables
+	connectionSecurity        ConnectionSecurity          // How the connection is secured, as inspected at handshake, for handlers to consult
+	securityViolation         error                       // How the connection falls short of the security policy, if it does, refusing replication
+	securityRejected          base.AtomicBool             // Set once a message has been refused for the security policy.  Atomic access
+	strictNumbers             bool                        // Whether deltas exchanged hold no integers beyond 2^53-1, as negotiated at handshake
+	sha256Digests             bool                        // Whether attachments are identified by sha256 digests, as negotiated at handshake
+	sha1DigestAliases         map[string]string           // The sha1 digests attachments stored under sha256 digests were announced under.  Guarded by lock
+	sha256DigestAliases       map[string]string           // The reverse of sha1DigestAliases.  Guarded by lock
+	multiplexed               []*BlipSyncContext          // Contexts of the other databases multiplexed on the connection, attached at handshake
+	multiplexName             string                      // Name of the database, tagged on the messages it sends, when multiplexed on another's connection
+	multiplexHandlers         map[string]blip.Handler     // Handlers requests routed to the database are passed to, when multiplexed on another's connection
+	loopDetection             bool                        // Whether revs exchanged carry the Sync Gateways they've been replicated through, on a link between Sync Gateways
+	peerNode                  string                      // Replication node ID of the Sync Gateway at the other end, when it announced one at handshake
+}
+
+// orderedPull returns true when a one-shot pull's changes are collected and reordered before they're sent, rather
+// than sent in sequence order.
+func (bsc *BlipSyncContext) orderedPull() bool {
+	return bsc.sortBy != "" || bsc.dependencyOrder
 }
 
 // Registers a BLIP handler including the outer-level work of logging & error handling.
@@ -97,6 +230,25 @@ func (bsc *BlipSyncContext) register(profile string, handlerFn func(*blipHandler
 	// Wrap the handler function with a function that adds handling needed by all handlers
 	handlerFnWrapper := func(rq *blip.Message) {
 
+		if !bsc.startRequest(rq) {
+			status, msg := base.ErrorAsHTTPStatus(ErrConnectionClosing)
+			if response := rq.Response(); response != nil {
+				response.SetError("HTTP", status, msg)
+			}
+			base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Type:%s   --> %d %s", profile, status, msg)
+			return
+		}
+		defer bsc.inFlight.Done()
+
+		if bsc.routeMultiplexed(profile, rq) {
+			return
+		}
+
+		// Track in-flight and failed requests for the replication health
+		dbStats := bsc.blipContextDb.DbStats.StatsDatabase()
+		dbStats.Add(base.StatKeyBlipInFlight, 1)
+		defer dbStats.Add(base.StatKeyBlipInFlight, -1)
+
 		startTime := time.Now()
 		handler := blipHandler{
 			BlipSyncContext: bsc,
@@ -104,16 +256,58 @@ func (bsc *BlipSyncContext) register(profile string, handlerFn func(*blipHandler
 			serialNumber:    bsc.incrementSerialNumber(),
 		}
 
+		var span base.Span
+		handler.traceCtx, span = bsc.startHandlerSpan(profile, handler.serialNumber, rq)
+
 		// Trace log the full message body and properties
 		if base.LogTraceEnabled(base.KeySyncMsg) {
 			rqBody, _ := rq.Body()
 			base.TracefCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Recv Req %s: Body: '%s' Properties: %v", rq, base.UD(rqBody), base.UD(rq.Properties))
 		}
 
-		if err := handlerFn(&handler, rq); err != nil {
+		ctx, cancel, err := bsc.requestContext(rq)
+		if err == nil {
+			handler.ctx = ctx
+			if err = bsc.checkSecurity(profile); err == nil {
+				err = handlerFn(&handler, rq)
+			}
+			cancel()
+		}
+
+		base.EndSpan(span, err)
+
+		dbStats.Add(base.StatKeyBlipRequestCount, 1)
+		if err != nil {
 			status, msg := base.ErrorAsHTTPStatus(err)
+			if status >= http.StatusInternalServerError {
+				dbStats.Add(base.StatKeyBlipRequestErrors, 1)
+			}
 			if response := rq.Response(); response != nil {
 				response.SetError("HTTP", status, msg)
+				// Let the client know the current revision when an ifAbsent rev is rejected
+				if existsErr, ok := err.(*ErrDocumentExists); ok {
+					response.Properties[RevResponseExistingRev] = existsErr.CurrentRevID
+				}
+				// ...and when an ifMatch rev is rejected
+				if mismatchErr, ok := err.(*ErrRevisionMismatch); ok {
+					response.Properties[RevResponseExistingRev] = mismatchErr.CurrentRevID
+				}
+				// Tell the client which channels a rev rejected for not matching its expected channels was assigned
+				if mismatchErr, ok := err.(*ErrChannelsMismatch); ok {
+					response.Properties[RevResponseChannels] = joinChannels(mismatchErr.Channels)
+				}
+				// Tell clients rejected by admission control when to try again
+				if admissionErr, ok := err.(*ErrAdmissionRejected); ok {
+					response.Properties[ErrorRetryAfter] = strconv.Itoa(int(admissionErr.RetryAfter / time.Second))
+				}
+				// ...and clients that reached the push session's distinct document limit, when the session resets
+				if limitErr, ok := err.(*ErrPushDocLimit); ok && limitErr.RetryAfter > 0 {
+					response.Properties[ErrorRetryAfter] = strconv.Itoa(int(limitErr.RetryAfter / time.Second))
+				}
+				// ...and clients that requested an attachment too many times, when it may be requested again
+				if repeatErr, ok := err.(*ErrAttachmentRepeatLimit); ok {
+					response.Properties[ErrorRetryAfter] = strconv.Itoa(int(repeatErr.RetryAfter / time.Second))
+				}
 			}
 			base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "#%d: Type:%s   --> %d %s Time:%v", handler.serialNumber, profile, status, msg, time.Since(startTime))
 		} else {
@@ -134,10 +328,37 @@ func (bsc *BlipSyncContext) register(profile string, handlerFn func(*blipHandler
 		}
 	}
 
+	if bsc.multiplexHandlers != nil {
+		bsc.multiplexHandlers[profile] = handlerFnWrapper
+		return
+	}
 	bsc.blipContext.HandlerForProfile[profile] = handlerFnWrapper
 
 }
 
+// requestContext returns the context used to handle rq.  When the client sets a 'deadline' property (a timeout in
+// milliseconds), the context is cancelled once it elapses.  Client deadlines are clamped to the configured maximum,
+// and ignored entirely when no maximum is configured.
+func (bsc *BlipSyncContext) requestContext(rq *blip.Message) (context.Context, context.CancelFunc, error) {
+	deadlineStr, ok := rq.Properties[BlipDeadline]
+	maxDeadline := bsc.blipContextDb.Options.BlipSyncOptions.MaxRequestDeadline
+	if !ok || maxDeadline <= 0 {
+		return context.Background(), func() {}, nil
+	}
+
+	deadlineMs, err := strconv.ParseUint(deadlineStr, 10, 64)
+	if err != nil || deadlineMs == 0 {
+		return nil, nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid value for %s: %q", BlipDeadline, deadlineStr)
+	}
+
+	timeout := maxDeadline
+	if deadlineMs < uint64(maxDeadline/time.Millisecond) {
+		timeout = time.Duration(deadlineMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return ctx, cancel, nil
+}
+
 func (bsc *BlipSyncContext) Close() {
 	if bsc.gotSubChanges {
 		stat := base.StatKeyPullReplicationsActiveOneShot
@@ -147,6 +368,16 @@ func (bsc *BlipSyncContext) Close() {
 		bsc.dbStats.StatsCblReplicationPull().Add(stat, -1)
 	}
 
+	bsc.deltaFailures.close()
+	bsc.pushDocs.close()
+	bsc.closeMultiplexed()
+
+	bsc.lock.Lock()
+	if bsc.lifetimeTimer != nil {
+		bsc.lifetimeTimer.Stop()
+	}
+	bsc.lock.Unlock()
+
 	bsc.terminatorOnce.Do(func() {
 		close(bsc.terminator)
 	})
@@ -173,7 +404,11 @@ func (bsc *BlipSyncContext) _copyContextDatabase() *Database {
 }
 
 // Handles the response to a pushed "changes" message, i.e. the list of revisions the client wants
-func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response *blip.Message, changeArray [][]interface{}, requestSent time.Time, handleChangesResponseDb *Database) error {
+// handleChangesResponse sends the revisions requested by the client in its response to a changes message.  When
+// selectedDocIDs is non-nil, only revisions of those docs are sent.  When the feed's initial sync progress is tracked,
+// the batch is marked as responded to once a valid response has been handled, and the revs sent are registered so
+// that progress waits for the client to acknowledge them.
+func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response *blip.Message, changeArray [][]interface{}, requestSent time.Time, handleChangesResponseDb *Database, selectedDocIDs base.Set, progressTracker *initialSyncProgressTracker, progressBatch uint64) error {
 	defer func() {
 		if panicked := recover(); panicked != nil {
 			base.Warnf("[%s] PANIC handling 'changes' response: %v\n%s", bsc.blipContext.ID, panicked, debug.Stack())
@@ -222,9 +457,16 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 	var revSendCount int64
 	for i, knownRevsArray := range answer {
 		if knownRevsArray, ok := knownRevsArray.([]interface{}); ok {
+			// Metadata-only changes have no revision body to send
+			if isMetadataOnlyChangeRow(changeArray[i]) {
+				continue
+			}
 			seq := changeArray[i][0].(SequenceID)
 			docID := changeArray[i][1].(string)
 			revID := changeArray[i][2].(string)
+			if selectedDocIDs != nil && !selectedDocIDs.Contains(docID) {
+				continue
+			}
 			deltaSrcRevID := ""
 			//deleted := changeArray[i][3].(bool)
 			knownRevs := knownRevsByDoc[docID]
@@ -234,7 +476,7 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 			}
 
 			// The first element of the knownRevsArray returned from CBL is the parent revision to use as deltaSrc
-			if bsc.useDeltas && len(knownRevsArray) > 0 {
+			if bsc.useDeltas && !bsc.summaries && len(knownRevsArray) > 0 {
 				if revID, ok := knownRevsArray[0].(string); ok {
 					deltaSrcRevID = revID
 				}
@@ -249,6 +491,7 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 				}
 			}
 
+			progressTracker.revRequested(progressBatch, docID, revID)
 			var err error
 			if deltaSrcRevID != "" {
 				err = bsc.sendRevAsDelta(sender, docID, revID, deltaSrcRevID, seq, knownRevs, maxHistory, handleChangesResponseDb)
@@ -270,6 +513,7 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 		bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevProcessingTime, time.Since(changesResponseReceived).Nanoseconds())
 	}
 
+	progressTracker.batchResponded(progressBatch)
 	return nil
 }
 
@@ -277,26 +521,74 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 func (bsc *BlipSyncContext) sendRevisionWithProperties(sender *blip.Sender, docID string, revID string, bodyBytes []byte, attDigests []string, properties blip.Properties) error {
 
 	outrq := NewRevMessage()
-	outrq.SetID(docID)
+	outrq.SetID(bsc.deliveredDocID(docID))
 	outrq.SetRev(revID)
 
 	// add additional properties passed through
 	outrq.SetProperties(properties)
+	if bsc.channelMembership {
+		bsc.addChannelMembership(docID, revID, outrq.Properties)
+	}
+	if bsc.loopDetection {
+		bsc.addReplicationPath(docID, revID, outrq.Properties)
+	}
+
+	// Bodies larger than the client's chunk size are split, with the first chunk sent as the rev's body
+	var chunks [][]byte
+	if bsc.revChunkSize > 0 && len(bodyBytes) > bsc.revChunkSize {
+		chunks = revBodyChunks(bodyBytes, bsc.revChunkSize)
+		outrq.Properties[RevMessageChunks] = strconv.Itoa(len(chunks))
+		outrq.Properties[RevMessageBodyLength] = strconv.Itoa(len(bodyBytes))
+		outrq.SetBody(chunks[0])
+	} else {
+		outrq.SetJSONBodyAsBytes(bodyBytes)
+	}
 
-	outrq.SetJSONBodyAsBytes(bodyBytes)
+	// The checksum covers the body exactly as sent (a delta, when one is sent, and reassembled when chunked), before compression
+	if bsc.bodyChecksum {
+		outrq.Properties[RevMessageChecksum] = base.Crc32cHashString(bodyBytes)
+	}
 
 	// Update read stats
-	if messageBody, err := outrq.Body(); err == nil {
+	if chunks != nil {
+		bsc.dbStats.StatsDatabase().Add(base.StatKeyDocReadsBytesBlip, int64(len(bodyBytes)))
+	} else if messageBody, err := outrq.Body(); err == nil {
 		bsc.dbStats.StatsDatabase().Add(base.StatKeyDocReadsBytesBlip, int64(len(messageBody)))
 	}
 	bsc.dbStats.StatsDatabase().Add(base.StatKeyNumDocReadsBlip, 1)
+	bsc.progressMilestones.revSent(len(bodyBytes))
 
 	base.Tracef(base.KeySync, "Sending revision %s/%s, body:%s, properties: %v, attDigests: %v", base.UD(docID), revID, base.UD(string(bodyBytes)), base.UD(properties), attDigests)
 
-	if len(attDigests) > 0 {
+	var revSendLogSerial uint64
+	if bsc.revSendLog != nil {
+		status := RevSendStatusSent
+		if len(attDigests) > 0 || bsc.revsRequireReply() {
+			status = RevSendStatusAwaitingAck
+		}
+		revSendLogSerial = bsc.revSendLog.add(RevSendLogEntry{
+			DocID:    bsc.deliveredDocID(docID),
+			RevID:    revID,
+			Seq:      properties[RevMessageSequence],
+			DeltaSrc: properties[RevMessageDeltaSrc],
+			Bytes:    len(bodyBytes),
+			Status:   status,
+			Time:     time.Now(),
+		})
+	}
+
+	bsc.setDeliveryIndex(outrq.Properties)
+	deliveryLog := bsc.deliveryLog
+	progressTracker := bsc.initialSyncTracker
+	if len(attDigests) > 0 || bsc.revsRequireReply() {
 		// Allow client to download attachments in 'atts', but only while pulling this rev
-		bsc.addAllowedAttachments(attDigests)
-		if !bsc.sendBLIPMessage(sender, outrq.Message) {
+		if len(attDigests) > 0 {
+			bsc.addAllowedAttachments(docID, attDigests)
+		}
+		if !bsc.sendBLIPMessage(sender, outrq.Message) || !bsc.sendRevChunks(sender, docID, revID, bodyBytes, chunks) {
+			if len(attDigests) > 0 {
+				bsc.removeAllowedAttachments(docID, attDigests)
+			}
 			return ErrClosedBLIPSender
 		}
 		go func() {
@@ -306,27 +598,108 @@ func (bsc *BlipSyncContext) sendRevisionWithProperties(sender *blip.Sender, docI
 					bsc.Close()
 				}
 			}()
-			defer bsc.removeAllowedAttachments(attDigests)
-			outrq.Response() // blocks till reply is received
+			if len(attDigests) > 0 {
+				defer bsc.removeAllowedAttachments(docID, attDigests)
+			}
+			response, err := bsc.awaitResponse(outrq.Message, nil) // blocks till reply is received or the connection closes
+			if err != nil {
+				return
+			}
 			base.Tracef(base.KeySync, "Received response for sendRevisionWithProperties rev message %s/%s", base.UD(docID), revID)
+			if bsc.revSendLog != nil {
+				status := RevSendStatusAcked
+				if response.Type() == blip.ErrorType {
+					status = RevSendStatusError
+				}
+				bsc.revSendLog.setStatus(revSendLogSerial, status)
+			}
+			if deliveryLog != nil && response.Type() != blip.ErrorType {
+				bsc.recordDelivery(deliveryLog, docID, revID, properties[RevMessageSequence])
+			}
+			if response.Type() != blip.ErrorType {
+				progressTracker.revAcked(docID, revID)
+			}
+			if bsc.revsRequireReply() {
+				bsc.resendRevOnTemporaryFailure(sender, response, docID, revID, properties[RevMessageSequence])
+			}
 		}()
 	} else {
 		outrq.SetNoReply(true)
-		if !bsc.sendBLIPMessage(sender, outrq.Message) {
+		if !bsc.sendBLIPMessage(sender, outrq.Message) || !bsc.sendRevChunks(sender, docID, revID, bodyBytes, chunks) {
 			return ErrClosedBLIPSender
 		}
 	}
 
-	if response := outrq.Response(); response != nil {
-		if response.Type() == blip.ErrorType {
-			errorBody, _ := response.Body()
-			base.WarnfCtx(bsc.blipContextDb.Ctx, "Client returned error in rev response for doc %q / %q: %s", base.UD(docID), revID, errorBody)
+	// Responses to revs sent only for revRetry or bodyChecksum are handled asynchronously above, so as not to hold up sending
+	if len(attDigests) > 0 {
+		if response := outrq.Response(); response != nil {
+			if response.Type() == blip.ErrorType {
+				errorBody, _ := response.Body()
+				base.WarnfCtx(bsc.blipContextDb.Ctx, "Client returned error in rev response for doc %q / %q: %s", base.UD(docID), revID, errorBody)
+			}
 		}
 	}
 
 	return nil
 }
 
+// revsRequireReply returns true when the client must reply to every rev, so that failed revs can be re-sent, or
+// delivered revs recorded, in the delivery log or the initial sync progress.
+func (bsc *BlipSyncContext) revsRequireReply() bool {
+	return bsc.revRetry || bsc.bodyChecksum || bsc.deliveryLog != nil || bsc.initialSyncTracker != nil
+}
+
+// resendRevOnTemporaryFailure re-sends a revision when the client's response reports a temporary failure to persist
+// it (a 503 error, when revRetry is enabled), or that the body didn't match its checksum (a 422 error, when
+// bodyChecksum is enabled).  Other errors are permanent rejections, and aren't retried.  Each revision is re-sent at
+// most BlipMaxRevResendAttempts times, so that a client that repeatedly fails can't cause an endless loop.
+func (bsc *BlipSyncContext) resendRevOnTemporaryFailure(sender *blip.Sender, response *blip.Message, docID, revID, seqStr string) {
+	key := IDAndRev{DocID: docID, RevID: revID}
+	errorCode := ""
+	if response.Type() == blip.ErrorType {
+		errorCode = response.Properties["Error-Code"]
+	}
+	checksumMismatch := bsc.bodyChecksum && errorCode == strconv.Itoa(http.StatusUnprocessableEntity)
+	if checksumMismatch {
+		base.InfofCtx(bsc.blipContextDb.Ctx, base.KeySync, "Client reported checksum mismatch for doc %q / %q", base.UD(docID), revID)
+		bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevChecksumMismatchCount, 1)
+	}
+	resend := checksumMismatch || (bsc.revRetry && errorCode == strconv.Itoa(http.StatusServiceUnavailable))
+
+	bsc.lock.Lock()
+	attempts := bsc.revResendAttempts[key]
+	if !resend || attempts >= BlipMaxRevResendAttempts {
+		delete(bsc.revResendAttempts, key)
+	} else {
+		if bsc.revResendAttempts == nil {
+			bsc.revResendAttempts = make(map[IDAndRev]int)
+		}
+		bsc.revResendAttempts[key] = attempts + 1
+	}
+	bsc.lock.Unlock()
+
+	if !resend {
+		return
+	}
+	if attempts >= BlipMaxRevResendAttempts {
+		base.WarnfCtx(bsc.blipContextDb.Ctx, "Client still unable to persist doc %q / %q after %d re-sends - abandoning", base.UD(docID), revID, attempts)
+		bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevResendAbandonedCount, 1)
+		return
+	}
+
+	seq, err := bsc.blipContextDb.ParseSequenceID(seqStr)
+	if err != nil {
+		base.WarnfCtx(bsc.blipContextDb.Ctx, "Unable to re-send doc %q / %q, invalid sequence %q: %v", base.UD(docID), revID, seqStr, err)
+		return
+	}
+
+	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Client reported temporary failure for doc %q / %q - re-sending (attempt %d)", base.UD(docID), revID, attempts+1)
+	bsc.dbStats.StatsCblReplicationPull().Add(base.StatKeyRevResendCount, 1)
+	if err := bsc.sendRevision(sender, docID, revID, seq, nil, 0, bsc.copyContextDatabase()); err != nil {
+		base.WarnfCtx(bsc.blipContextDb.Ctx, "Error re-sending doc %q / %q: %v", base.UD(docID), revID, err)
+	}
+}
+
 func (bsc *BlipSyncContext) isAttachmentAllowed(digest string) bool {
 	bsc.lock.Lock()
 	defer bsc.lock.Unlock()
@@ -374,6 +747,9 @@ func (bsc *BlipSyncContext) sendDelta(sender *blip.Sender, docID, deltaSrcRevID
 
 	properties := blipRevMessageProperties(revDelta.RevisionHistory, revDelta.ToDeleted, seq)
 	properties[RevMessageDeltaSrc] = deltaSrcRevID
+	if bsc.deltaFormat == DeltaFormatJSONPatch {
+		properties[RevMessageDeltaFormat] = DeltaFormatJSONPatch
+	}
 
 	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Sending rev %q %s as delta. DeltaSrc:%s", base.UD(docID), revDelta.ToRevID, deltaSrcRevID)
 	return bsc.sendRevisionWithProperties(sender, docID, revDelta.ToRevID, revDelta.DeltaBytes, revDelta.AttachmentDigests, properties)
@@ -381,6 +757,9 @@ func (bsc *BlipSyncContext) sendDelta(sender *blip.Sender, docID, deltaSrcRevID
 
 // sendBLIPMessage is a simple wrapper around all sent BLIP messages
 func (bsc *BlipSyncContext) sendBLIPMessage(sender *blip.Sender, msg *blip.Message) bool {
+	if bsc.multiplexName != "" {
+		msg.Properties[BlipDatabase] = bsc.multiplexName
+	}
 	if base.LogTraceEnabled(base.KeySyncMsg) {
 		rqBody, _ := msg.Body()
 		base.TracefCtx(bsc.blipContextDb.Ctx, base.KeySyncMsg, "Send Req %s: Body: '%s' Properties: %v", msg, base.UD(rqBody), base.UD(msg.Properties))
@@ -392,8 +771,12 @@ func (bsc *BlipSyncContext) sendNoRev(sender *blip.Sender, docID, revID string,
 
 	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Sending norev %q %s due to unavailable revision: %v", base.UD(docID), revID, err)
 
+	if bsc.revSendLog != nil {
+		bsc.revSendLog.add(RevSendLogEntry{DocID: bsc.deliveredDocID(docID), RevID: revID, Status: RevSendStatusNoRev, Time: time.Now()})
+	}
+
 	noRevRq := NewNoRevMessage()
-	noRevRq.SetId(docID)
+	noRevRq.SetId(bsc.deliveredDocID(docID))
 	noRevRq.SetRev(revID)
 
 	status, reason := base.ErrorAsHTTPStatus(err)
@@ -403,9 +786,12 @@ func (bsc *BlipSyncContext) sendNoRev(sender *blip.Sender, docID, revID string,
 	noRevRq.SetReason(reason)
 
 	noRevRq.SetNoReply(true)
+	bsc.setDeliveryIndex(noRevRq.Properties)
 	if !bsc.sendBLIPMessage(sender, noRevRq.Message) {
 		return ErrClosedBLIPSender
 	}
+	// There's nothing more to send the client for the rev, so initial sync progress needn't wait on it
+	bsc.initialSyncTracker.revAcked(docID, revID)
 
 	return nil
 }
@@ -416,13 +802,20 @@ func (bsc *BlipSyncContext) sendRevision(sender *blip.Sender, docID, revID strin
 	if err != nil {
 		return bsc.sendNoRev(sender, docID, revID, err)
 	}
+	if bsc.summaries && !rev.Deleted {
+		return bsc.sendRevSummary(sender, rev, seq, knownRevs, maxHistory, handleChangesResponseDb)
+	}
 
 	base.Tracef(base.KeySync, "sendRevision, rev attachments for %s/%s are %v", base.UD(docID), revID, base.UD(rev.Attachments))
+	attachments, err := bsc.deliveredAttachments(rev.Attachments)
+	if err != nil {
+		return bsc.sendNoRev(sender, docID, revID, err)
+	}
 	var bodyBytes []byte
 	if base.IsEnterpriseEdition() {
 		// Still need to stamp _attachments into BLIP messages
-		if len(rev.Attachments) > 0 {
-			bodyBytes, err = base.InjectJSONProperties(rev.BodyBytes, base.KVPair{Key: BodyAttachments, Val: rev.Attachments})
+		if len(attachments) > 0 {
+			bodyBytes, err = base.InjectJSONProperties(rev.BodyBytes, base.KVPair{Key: BodyAttachments, Val: attachments})
 			if err != nil {
 				return err
 			}
@@ -436,8 +829,8 @@ func (bsc *BlipSyncContext) sendRevision(sender *blip.Sender, docID, revID strin
 		}
 
 		// Still need to stamp _attachments into BLIP messages
-		if len(rev.Attachments) > 0 {
-			body[BodyAttachments] = rev.Attachments
+		if len(attachments) > 0 {
+			body[BodyAttachments] = attachments
 		}
 
 		bodyBytes, err = base.JSONMarshalCanonical(body)
@@ -446,13 +839,51 @@ func (bsc *BlipSyncContext) sendRevision(sender *blip.Sender, docID, revID strin
 		}
 	}
 
+	// A doc the client has no revision of may be sent as a delta against its type's template
+	useTemplate := bsc.templateDeltas && bsc.useDeltas && len(knownRevs) == 0 && !rev.Deleted && handleChangesResponseDb.deltaTemplates != nil
+
 	history := toHistory(rev.History, knownRevs, maxHistory)
 	properties := blipRevMessageProperties(history, rev.Deleted, seq)
-	attDigests := AttachmentDigests(rev.Attachments)
+	if useTemplate {
+		delta, templateID, err := handleChangesResponseDb.deltaTemplates.delta(bodyBytes, bsc.deltaFormat)
+		if err != nil {
+			base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Falling back to full body replication. Couldn't get template delta for key %s - err: %v", base.UD(docID), err)
+		}
+		if delta != nil {
+			bodyBytes = delta
+			properties[RevMessageTemplate] = templateID
+			if bsc.deltaFormat == DeltaFormatJSONPatch {
+				properties[RevMessageDeltaFormat] = DeltaFormatJSONPatch
+			}
+			bsc.dbStats.StatsDeltaSync().Add(base.StatKeyTemplateDeltasSent, 1)
+		} else {
+			bsc.dbStats.StatsDeltaSync().Add(base.StatKeyTemplateDeltaFallbacks, 1)
+		}
+	}
+	attDigests := AttachmentDigests(attachments)
 	base.DebugfCtx(bsc.blipContextDb.Ctx, base.KeySync, "Sending rev %q %s based on %d known, digests: %v", base.UD(docID), revID, len(knownRevs), attDigests)
 	return bsc.sendRevisionWithProperties(sender, docID, revID, bodyBytes, attDigests, properties)
 }
 
+// awaitResponse waits for the response to an outgoing request.  Returns ErrClosedBLIPSender if the connection is
+// closed first, so that callers (and anything they hold, such as allowed attachments) aren't left waiting on a
+// response that will never arrive, or ErrBLIPDeadlineExceeded if the optional deadline channel is closed first.
+// The underlying wait on go-blip continues in the background, holding only the message.
+func (bsc *BlipSyncContext) awaitResponse(outrq *blip.Message, deadline <-chan struct{}) (*blip.Message, error) {
+	responses := make(chan *blip.Message, 1)
+	go func() {
+		responses <- outrq.Response()
+	}()
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-bsc.terminator:
+		return nil, ErrClosedBLIPSender
+	case <-deadline:
+		return nil, ErrBLIPDeadlineExceeded
+	}
+}
+
 func toHistory(revisions Revisions, knownRevs map[string]bool, maxHistory int) []string {
 	// Get the revision's history as a descending array of ancestor revIDs:
 	history := revisions.ParseRevisions()[1:]
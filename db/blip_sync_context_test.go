@@ -2,10 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestBlipSyncContextSetUseDeltas verifies all permutations of setUseDeltas()
@@ -90,3 +97,374 @@ func BenchmarkBlipSyncContextSetUseDeltas(b *testing.B) {
 		})
 	}
 }
+
+// TestBlipSyncContextDeniedChannels verifies that only channels in the configured denylist are reported as denied.
+func TestBlipSyncContextDeniedChannels(t *testing.T) {
+	ctx := &BlipSyncContext{
+		blipContextDb: &Database{Ctx: context.TODO(), DatabaseContext: &DatabaseContext{}},
+	}
+	assert.Nil(t, ctx.deniedChannels([]string{"ABC", "secret"}))
+
+	ctx.blipContextDb.Options.BlipSyncOptions.DeniedChannels = base.SetOf("secret", "private")
+	assert.Nil(t, ctx.deniedChannels([]string{"ABC", "DEF"}))
+	assert.Equal(t, []string{"secret"}, ctx.deniedChannels([]string{"ABC", "secret"}))
+}
+
+// TestDeniedChannelsOnAllChannelsFeed verifies changes found on the all-channels feed, as admins and users granted the
+// star channel see them, aren't sent when the doc is in a denied channel.
+func TestDeniedChannelsOnAllChannelsFeed(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.BlipSyncOptions.DeniedChannels = base.SetOf("secret")
+
+	secretRevID, _, err := db.Put("secretDoc", Body{"channels": []string{"public", "secret"}})
+	require.NoError(t, err)
+	publicRevID, _, err := db.Put("publicDoc", Body{"channels": []string{"public"}})
+	require.NoError(t, err)
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	change := func(docID, revID string) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: 5}, ID: docID, Changes: []ChangeRev{{"rev": revID}}, channels: []string{channels.AllChannelWildcard}}
+	}
+	assert.Empty(t, bh.changeRows(change("secretDoc", secretRevID)))
+	assert.Len(t, bh.changeRows(change("publicDoc", publicRevID)), 1)
+	assert.Empty(t, bh.changeRows(change("missingDoc", "1-a")), "A doc whose channels can't be read shouldn't be sent")
+}
+
+// TestDeniedChannelsOnChannelFeed ensures a change found in an allowed channel isn't sent when the doc is also in a
+// denied channel.
+func TestDeniedChannelsOnChannelFeed(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+	db.Options.BlipSyncOptions.DeniedChannels = base.SetOf("secret")
+
+	secretRevID, _, err := db.Put("secretDoc", Body{"channels": []string{"public", "secret"}})
+	require.NoError(t, err)
+	publicRevID, _, err := db.Put("publicDoc", Body{"channels": []string{"public"}})
+	require.NoError(t, err)
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	change := func(docID, revID string) *ChangeEntry {
+		return &ChangeEntry{Seq: SequenceID{Seq: 5}, ID: docID, Changes: []ChangeRev{{"rev": revID}}, channels: []string{"public"}}
+	}
+	assert.Empty(t, bh.changeRows(change("secretDoc", secretRevID)))
+	assert.Len(t, bh.changeRows(change("publicDoc", publicRevID)), 1)
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(db.DbStats.StatsCblReplicationPull().Get(base.StatKeyDeniedChannelChangesSuppressed)))
+}
+
+// TestBlipSyncContextClampBatchSize verifies a requested subChanges batch size is clamped to the configured maximum.
+func TestBlipSyncContextClampBatchSize(t *testing.T) {
+	ctx := &BlipSyncContext{
+		blipContextDb: &Database{Ctx: context.TODO(), DatabaseContext: &DatabaseContext{}},
+	}
+	rq := blip.NewRequest()
+	rq.SetProfile(MessageSubChanges)
+	rq.Properties["batch"] = "100000"
+	params, err := NewSubChangesParams(context.TODO(), rq, SequenceID{}, parseIntegerSequenceID)
+	require.NoError(t, err)
+	require.Equal(t, 100000, params.batchSize())
+
+	assert.Equal(t, DefaultMaxChangesBatchSize, ctx.clampBatchSize(params.batchSize()))
+
+	ctx.blipContextDb.Options.BlipSyncOptions.MaxChangesBatchSize = 500
+	assert.Equal(t, 500, ctx.clampBatchSize(params.batchSize()))
+	assert.Equal(t, 200, ctx.clampBatchSize(200))
+}
+
+func TestBlipSyncContextIsDeltaWasted(t *testing.T) {
+	ctx := &BlipSyncContext{
+		blipContextDb: &Database{Ctx: context.TODO(), DatabaseContext: &DatabaseContext{}},
+	}
+	delta := &RevisionDelta{DeltaBytes: make([]byte, 85), ToBodySize: 100}
+
+	// Any delta is sent when no ratio is configured
+	assert.False(t, ctx.isDeltaWasted(delta))
+
+	ctx.blipContextDb.Options.DeltaSyncOptions.MaxDeltaRatio = DefaultMaxDeltaRatio
+	assert.True(t, ctx.isDeltaWasted(delta))
+	assert.True(t, ctx.isDeltaWasted(&RevisionDelta{DeltaBytes: make([]byte, 80), ToBodySize: 100}))
+	assert.False(t, ctx.isDeltaWasted(&RevisionDelta{DeltaBytes: make([]byte, 79), ToBodySize: 100}))
+
+	// Deltas to tombstones are always sent
+	assert.False(t, ctx.isDeltaWasted(&RevisionDelta{DeltaBytes: []byte("{}"), ToDeleted: true}))
+}
+
+// TestBlipSyncContextRequestDeadline verifies client-supplied deadlines are validated and clamped to the configured maximum.
+func TestBlipSyncContextRequestDeadline(t *testing.T) {
+	ctx := &BlipSyncContext{
+		blipContextDb: &Database{Ctx: context.TODO(), DatabaseContext: &DatabaseContext{}},
+	}
+
+	tests := []struct {
+		name             string
+		maxDeadline      time.Duration
+		deadline         string
+		expectError      bool
+		expectedDeadline time.Duration // 0 if no deadline is expected
+	}{
+		{"no deadline set", time.Minute, "", false, 0},
+		{"deadlines disabled", 0, "5000", false, 0},
+		{"deadline within max", time.Minute, "5000", false, 5 * time.Second},
+		{"deadline clamped to max", time.Minute, "600000", false, time.Minute},
+		{"deadline overflow clamped to max", time.Minute, "18446744073709551615", false, time.Minute},
+		{"zero deadline", time.Minute, "0", true, 0},
+		{"invalid deadline", time.Minute, "soon", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx.blipContextDb.Options.BlipSyncOptions.MaxRequestDeadline = tt.maxDeadline
+			rq := blip.NewRequest()
+			if tt.deadline != "" {
+				rq.Properties[BlipDeadline] = tt.deadline
+			}
+
+			start := time.Now()
+			requestCtx, cancel, err := ctx.requestContext(rq)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer cancel()
+
+			deadline, ok := requestCtx.Deadline()
+			if tt.expectedDeadline == 0 {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			assert.WithinDuration(t, start.Add(tt.expectedDeadline), deadline, time.Second)
+		})
+	}
+}
+
+// TestMostRecentRevIDs verifies possible ancestor lists are truncated to the most recent revisions.
+func TestMostRecentRevIDs(t *testing.T) {
+	revIDs := []string{"3-a", "10-a", "5-b", "5-c", "1-a"}
+	assert.Equal(t, []string{"10-a", "5-c", "5-b"}, mostRecentRevIDs(revIDs, 3))
+	assert.Equal(t, []string{"10-a", "5-c", "5-b", "3-a", "1-a"}, mostRecentRevIDs(revIDs, 10))
+	// Input isn't modified
+	assert.Equal(t, []string{"3-a", "10-a", "5-b", "5-c", "1-a"}, revIDs)
+}
+
+// TestBlipHandlerAnnounceRev verifies a revision is only reported as already announced when the same revID was the
+// last one announced for the doc.
+func TestBlipHandlerAnnounceRev(t *testing.T) {
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{}}
+	assert.False(t, bh.announceRev("doc1", "1-a"))
+	assert.True(t, bh.announceRev("doc1", "1-a"))
+	assert.False(t, bh.announceRev("doc1", "2-b"))
+	assert.True(t, bh.announceRev("doc1", "2-b"))
+	assert.False(t, bh.announceRev("doc2", "2-b"))
+
+	assert.True(t, isMetadataOnlyChangeRow([]interface{}{SequenceID{Seq: 1}, "doc1", "1-a", false, map[string]interface{}{ChangesRowMetaOnly: true}}))
+	assert.False(t, isMetadataOnlyChangeRow([]interface{}{SequenceID{Seq: 1}, "doc1", "1-a", true}))
+	assert.False(t, isMetadataOnlyChangeRow([]interface{}{SequenceID{Seq: 1}, "doc1", "1-a", true, map[string]interface{}{ChangesRowRecoverable: true}}))
+}
+
+// TestRecoverableTombstone verifies a deleted doc's last body is retained for the tombstone retention window, and
+// that only the current tombstone is reported as recoverable.
+func TestRecoverableTombstone(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+
+	context, err := NewDatabaseContext("db", testBucket.Bucket, false, DatabaseContextOptions{
+		EnableXattr:            base.TestUseXattrs(),
+		OldRevExpirySeconds:    1,
+		TombstoneRetentionSecs: 3600,
+	})
+	require.NoError(t, err)
+	defer context.Close()
+	db, err := CreateDatabase(context)
+	require.NoError(t, err)
+
+	rev1ID, _, err := db.Put("doc1", Body{"trash": "me"})
+	require.NoError(t, err)
+	rev2ID, err := db.DeleteDoc("doc1", rev1ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(3600), db.oldRevExpiry(1, true))
+	assert.Equal(t, uint32(1), db.oldRevExpiry(1, false))
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{}, db: db}
+	lastRevID, ok := bh.recoverableTombstone("doc1", rev2ID)
+	assert.True(t, ok)
+	assert.Equal(t, rev1ID, lastRevID)
+
+	body, err := db.Get1xRevBody("doc1", lastRevID, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "me", body["trash"])
+
+	// Only the current revision of a deleted doc is recoverable
+	_, ok = bh.recoverableTombstone("doc1", rev1ID)
+	assert.False(t, ok)
+
+	// Outside the retention window (here, with retention disabled), tombstones behave as before
+	db.Options.TombstoneRetentionSecs = 0
+	_, ok = bh.recoverableTombstone("doc1", rev2ID)
+	assert.False(t, ok)
+}
+
+// TestGetMappedAttachment verifies attachments are loaded via the digest mapper, and that a remapped attachment is
+// only used if its content matches the digest it was requested by.
+func TestGetMappedAttachment(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	attData := []byte("migrated attachment")
+	digest := Sha1DigestKey(attData)
+	require.NoError(t, db.Bucket.SetRaw(attachmentKeyToString("legacy-good"), 0, attData))
+	require.NoError(t, db.Bucket.SetRaw(attachmentKeyToString("legacy-bad"), 0, []byte("other data")))
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+
+	// Identity by default
+	_, err := bh.getMappedAttachment(digest)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	db.Options.BlipSyncOptions.AttachmentDigestMapper = func(string) string { return "legacy-good" }
+	data, err := bh.getMappedAttachment(digest)
+	require.NoError(t, err)
+	assert.Equal(t, attData, data)
+
+	db.Options.BlipSyncOptions.AttachmentDigestMapper = func(string) string { return "legacy-bad" }
+	_, err = bh.getMappedAttachment(digest)
+	assert.True(t, base.IsDocNotFoundError(err))
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(db.DbStats.CblReplicationPush().Get(base.StatKeyAttDigestMismatch)))
+}
+
+// TestAuthorizeAttachment verifies the attachment authorizer is consulted for users, is allowed an attachment by any of
+// its docs, and that denials are counted.
+func TestAuthorizeAttachment(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+
+	// Admins, and everyone when there's no authorizer, are allowed every attachment
+	assert.True(t, bh.authorizeAttachment([]string{"doc1"}, "sha1-original"))
+	db.Options.BlipSyncOptions.AttachmentAuthorizer = func(user auth.User, docID, digest string) bool {
+		return digest != "sha1-original" || docID == "shared"
+	}
+	assert.True(t, bh.authorizeAttachment([]string{"doc1"}, "sha1-original"))
+
+	user, err := db.Authenticator().NewUser("naomi", "letmein", nil)
+	require.NoError(t, err)
+	db.user = user
+	assert.True(t, bh.authorizeAttachment([]string{"doc1"}, "sha1-thumbnail"))
+	assert.False(t, bh.authorizeAttachment([]string{"doc1"}, "sha1-original"))
+	assert.False(t, bh.authorizeAttachment(nil, "sha1-original"))
+	assert.True(t, bh.authorizeAttachment([]string{"doc1", "shared"}, "sha1-original"))
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(db.DbStats.StatsDatabase().Get(base.StatKeyAttAccessDenied)))
+}
+
+// BenchmarkChangesResponse100k measures the memory used building the response to a 100k-entry proposeChanges
+// message in which no revs are needed.
+func BenchmarkChangesResponse100k(b *testing.B) {
+	const changeCount = 100000
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		output := newChangesResponseBuffer(changeCount, 5)
+		output.Write([]byte("["))
+		for j := 0; j < changeCount; j++ {
+			if j > 0 {
+				output.Write([]byte(","))
+			}
+			output.Write([]byte("0"))
+		}
+		output.Write([]byte("]"))
+	}
+}
+
+type traceParentKey struct{}
+
+// recordingTracer is a base.Tracer recording the spans it starts, with the span or propagated traceparent in their
+// context as their parent.
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name       string
+	parent     interface{}
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (rt *recordingTracer) Extract(ctx context.Context, headers http.Header) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, headers.Get("traceparent"))
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, base.Span) {
+	span := &recordingSpan{name: name, parent: ctx.Value(traceParentKey{}), attributes: attributes}
+	rt.spans = append(rt.spans, span)
+	return context.WithValue(ctx, traceParentKey{}, span), span
+}
+
+func (s *recordingSpan) SetError(err error) { s.err = err }
+func (s *recordingSpan) End()               { s.ended = true }
+
+// TestBlipSyncContextHandlerSpan verifies handler spans are children of the client's propagated trace context, and
+// carry the request's attributes.
+func TestBlipSyncContextHandlerSpan(t *testing.T) {
+	logCtx := context.WithValue(context.TODO(), base.LogContextKey{}, base.LogContext{CorrelationID: "[abc]"})
+	ctx := &BlipSyncContext{
+		blipContextDb: &Database{Ctx: logCtx, DatabaseContext: &DatabaseContext{}},
+		traceContext:  context.Background(),
+	}
+
+	// Without a tracer, spans do nothing
+	_, span := ctx.startHandlerSpan(MessageRev, 1, blip.NewRequest())
+	base.EndSpan(span, errors.New("failed"))
+
+	tracer := &recordingTracer{}
+	ctx.blipContextDb.Options.BlipSyncOptions.Tracer = tracer
+	ctx.ExtractTraceContext(http.Header{"Traceparent": []string{"00-trace-span-01"}})
+
+	rq := blip.NewRequest()
+	rq.Properties[RevMessageId] = "doc1"
+	_, span = ctx.startHandlerSpan(MessageRev, 2, rq)
+	base.EndSpan(span, errors.New("failed"))
+
+	require.Len(t, tracer.spans, 1)
+	assert.Equal(t, MessageRev, tracer.spans[0].name)
+	assert.Equal(t, "00-trace-span-01", tracer.spans[0].parent)
+	assert.Equal(t, map[string]interface{}{
+		base.SpanAttrSerialNumber:  uint64(2),
+		base.SpanAttrCorrelationID: "[abc]",
+		base.SpanAttrDocID:         "doc1",
+	}, tracer.spans[0].attributes)
+	assert.EqualError(t, tracer.spans[0].err, "failed")
+	assert.True(t, tracer.spans[0].ended)
+}
+
+// TestBlipHandlerFeedSpan verifies a changes feed's span is a child of the client's propagated trace context rather
+// than of the subChanges handler's span, which ends before the feed does, and is the parent of spans the feed starts.
+func TestBlipHandlerFeedSpan(t *testing.T) {
+	tracer := &recordingTracer{}
+	bh := &blipHandler{
+		BlipSyncContext: &BlipSyncContext{blipContextDb: &Database{Ctx: context.TODO(), DatabaseContext: &DatabaseContext{}}},
+		serialNumber:    1,
+	}
+	bh.db = bh.blipContextDb
+	bh.blipContextDb.Options.BlipSyncOptions.Tracer = tracer
+	bh.ExtractTraceContext(http.Header{"Traceparent": []string{"00-trace-span-01"}})
+
+	var handlerSpan, feedSpan base.Span
+	bh.traceCtx, handlerSpan = bh.startHandlerSpan(MessageSubChanges, bh.serialNumber, blip.NewRequest())
+	handlerSpan.End()
+	bh.traceCtx, feedSpan = bh.startFeedSpan("sendChanges")
+	_, childSpan := bh.startSpan("child")
+	childSpan.End()
+	feedSpan.End()
+
+	require.Len(t, tracer.spans, 3)
+	assert.Equal(t, "00-trace-span-01", tracer.spans[1].parent)
+	assert.Equal(t, tracer.spans[1], tracer.spans[2].parent)
+}
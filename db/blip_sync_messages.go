@@ -3,9 +3,14 @@ package db
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbase/go-blip"
 	"github.com/couchbase/sync_gateway/base"
@@ -16,6 +21,8 @@ import (
 const (
 	MessageSetCheckpoint   = "setCheckpoint"
 	MessageGetCheckpoint   = "getCheckpoint"
+	MessageGetCheckpoints  = "getCheckpoints"
+	MessageDelCheckpoint   = "deleteCheckpoint"
 	MessageSubChanges      = "subChanges"
 	MessageChanges         = "changes"
 	MessageRev             = "rev"
@@ -23,6 +30,41 @@ const (
 	MessageGetAttachment   = "getAttachment"
 	MessageProposeChanges  = "proposeChanges"
 	MessageProveAttachment = "proveAttachment"
+	MessageProveBatch      = "proveAttachments"
+	MessageReleaseRevs     = "releaseRevs"
+	MessageSelectChanges   = "selectChanges"
+	MessageGetRevSendLog   = "getRevSendLog"
+	MessageCompactStatus   = "getCompactionStatus"
+	MessageStartCompact    = "startCompaction"
+	MessageAccessChanged   = "accessChanged"
+	MessageCapabilities    = "getCapabilities"
+	MessageVerifyCheckpt   = "verifyCheckpoint"
+	MessageClosing         = "closing"
+	MessageProposeStatus   = "proposeChangesStatus"
+	MessageCollectAtts     = "collectAttachments"
+	MessageKeepalive       = "keepalive"
+	MessageReconcile       = "reconcile"
+	MessageRevoked         = "revoked"
+	MessagePurgeBatch      = "purgeBatch"
+	MessageRevChunk        = "revChunk"
+	MessageGetAccess       = "getAccess"
+	MessageFlushChanges    = "flushChanges"
+	MessageSubExpired      = "subChangesExpired"
+	MessageHeartbeat       = "heartbeat"
+	MessageGetRev          = "getRev"
+)
+
+// Conflict policies a proposeChanges message may ask for, determining the status returned for a proposed rev that
+// conflicts with the server's current revision:
+//   - reject (the default) returns 409, so that the client resolves the conflict itself.  Permitted in any database.
+//   - server-wins returns 304, as if the client already had the rev, so that the server's revision stands and reaches
+//     the client on its next pull.  Permitted in any database.
+//   - client-wins returns 0, so that the client pushes its rev regardless.  Only permitted when the database allows
+//     conflicts, where the rev is added as a conflicting branch; in no-conflicts mode the rev would be rejected anyway.
+const (
+	ConflictPolicyReject     = "reject"
+	ConflictPolicyServerWins = "server-wins"
+	ConflictPolicyClientWins = "client-wins"
 )
 
 // Message properties
@@ -32,15 +74,34 @@ const (
 	BlipClient   = "client"
 	BlipCompress = "compress"
 	BlipProfile  = "Profile"
+	BlipDeadline = "deadline"
+
+	// Error response properties
+	ErrorRetryAfter = "Retry-After"
 
 	// setCheckpoint message properties
 	SetCheckpointRev         = "rev"
 	SetCheckpointClient      = "client"
 	SetCheckpointResponseRev = "rev"
+	SetCheckpointOpaque      = "opaque" // When "true", the body is opaque bytes rather than a JSON object
 
 	// getCheckpoint message properties
 	GetCheckpointResponseRev = "rev"
 	GetCheckpointClient      = "client"
+	GetCheckpointOpaque      = "opaque" // When "true", the checkpoint is returned as the opaque bytes it was set with
+
+	// deleteCheckpoint message properties
+	DeleteCheckpointClient = "client"
+	DeleteCheckpointRev    = "rev"
+
+	// verifyCheckpoint message properties
+	VerifyCheckpointClient = "client"
+	VerifyCheckpointSeq    = "sequence" // The sequence the client believes it's at, and the stored one on a mismatch
+	VerifyCheckpointMatch  = "match"
+
+	// closing message properties
+	ClosingReason            = "reason"
+	ClosingReasonMaxLifetime = "maxLifetime" // The connection reached its maximum lifetime, and the client should reconnect
 
 	// subChanges message properties
 	SubChangesActiveOnly = "activeOnly"
@@ -49,6 +110,36 @@ const (
 	SubChangesSince      = "since"
 	SubChangesContinuous = "continuous"
 	SubChangesBatch      = "batch"
+	SubChangesSession    = "session"
+	SubChangesStagedSync = "stagedSync"
+	SubChangesRevRetry   = "revRetry"
+	SubChangesMetadata   = "metadataChanges"
+	SubChangesSortBy     = "sortBy"
+	SubChangesExpression = "expression"
+	SubChangesChecksum   = "bodyChecksum"
+	SubChangesCaughtUp   = "repeatCaughtUp"
+	SubChangesRecovery   = "recoverableTombstones"
+	SubChangesTemplates  = "templateDeltas"
+	SubChangesAccess     = "accessChanges"
+	SubChangesDeltaFmt   = "deltaFormat"
+	SubChangesCursors    = "cursorTokens"
+	SubChangesDepOrder   = "dependencyOrder"
+	SubChangesAttOnly    = "withAttachmentsOnly"
+	SubChangesStaleness  = "maxStaleness"
+	SubChangesRevokes    = "revocations"
+	SubChangesExclude    = "excludeChannels"
+	SubChangesPatterns   = "channelPatterns"
+	SubChangesMembership = "channelMembership"
+	SubChangesPacing     = "maxChangesPerSecond"
+	SubChangesChunkSize  = "revChunkSize"
+	SubChangesDelivery   = "deliveryIndex"
+	SubChangesSummaries  = "summaries"
+	SubChangesTombstones = "tombstonesFirst"
+	SubChangesMinSize    = "minDocSize"
+	SubChangesMaxSize    = "maxDocSize"
+	SubChangesWaitSeq    = "waitForSequence"
+	SubChangesTTL        = "subscriptionTTL"
+	SubChangesHeartbeat  = "heartbeatInterval"
 
 	// rev message properties
 	RevMessageId          = "id"
@@ -58,6 +149,69 @@ const (
 	RevMessageHistory     = "history"
 	RevMessageNoConflicts = "noconflicts"
 	RevMessageDeltaSrc    = "deltaSrc"
+	RevMessageIfAbsent    = "ifAbsent"
+	RevMessageIfMatch     = "ifMatch"
+	RevMessagePriority    = "priority"
+	RevMessageIdemKey     = "idempotencyKey"
+	RevMessageChecksum    = "checksum"
+	RevMessageTemplate    = "deltaTemplate"
+	RevMessageDeltaFormat = "deltaFormat"
+	RevMessageBatchProofs = "batchProofs"
+	RevMessageRetChannels = "returnChannels"
+	RevMessageExpChannels = "expectedChannels"
+	RevMessageEntered     = "channelsEntered" // Sent revs only, for channelMembership subscriptions
+	RevMessageLeft        = "channelsLeft"    // Sent revs only, for channelMembership subscriptions
+	RevMessageChunks      = "chunks"          // Sent revs only, when the body is chunked: the number of chunks
+	RevMessageBodyLength  = "bodyLength"      // Sent revs only, when the body is chunked: the length of the whole body
+	RevMessageDelivery    = "deliveryIndex"   // Sent revs and norevs only, for deliveryIndex subscriptions
+	RevMessageSummary     = "summary"         // Sent revs only, when the body is a summary rather than the full body
+	RevMessagePath        = "replicationPath" // Between Sync Gateways detecting loops: the replication node IDs the rev has been through
+
+	// revChunk message properties
+	RevChunkId       = "id"
+	RevChunkRev      = "rev"
+	RevChunkIndex    = "chunk"    // Index of the chunk in the body, where the rev message carries chunk 0
+	RevChunkChecksum = "checksum" // CRC-32C of the whole body, on the last chunk only
+
+	// rev response properties
+	RevResponseExistingRev = "existingRev"
+	RevResponseChannels    = "channels"
+	RevResponseSequence    = "sequence"
+
+	// startCompaction response properties
+	StartCompactionJobID = "jobId"
+
+	// collectAttachments response properties
+	CollectAttachmentsDeleted = "deleted"
+
+	// reconcile message properties
+	ReconcileAfter   = "after"
+	ReconcileThrough = "through"
+
+	// reconcile response properties
+	ReconcileResumeAfter = "resumeAfter"
+
+	// purgeBatch message properties
+	PurgeBatchToken = "token" // Job to continue or resume; omitted to start a job with the docIDs in the body
+	PurgeBatchSince = "since" // Number of statuses the client already has, when resuming
+
+	// purgeBatch response properties
+	PurgeBatchCursor = "cursor" // Number of the job's docs processed so far
+	PurgeBatchDone   = "done"   // Set once every doc has been processed
+
+	// getAccess message properties
+	GetAccessUser = "user" // User to query on behalf of, for admin connections
+
+	// flushChanges response properties
+	FlushChangesActive = "active" // Whether a subscription was running to take the request
+
+	// heartbeat message properties
+	HeartbeatSequence  = "sequence"     // Last sequence the feed sent the client
+	HeartbeatHighSeq   = "highSequence" // Database's current high sequence
+	HeartbeatTimestamp = "timestamp"    // When the heartbeat was sent, in RFC 3339 format
+
+	// revoked message properties
+	RevokedTruncated = "truncated" // Set when more docs were revoked than are listed
 
 	// norev message properties
 	NorevMessageId     = "id"
@@ -65,15 +219,45 @@ const (
 	NorevMessageError  = "error"
 	NorevMessageReason = "reason"
 
+	// getRev message properties
+	GetRevMessageId      = "id"
+	GetRevMessageRev     = "rev"
+	GetRevMessageDeleted = "deleted" // Response only: set when the revision is a tombstone
+
+	// changes row metadata properties
+	ChangesRowMetaOnly    = "metaOnly"
+	ChangesRowChannels    = "channels"
+	ChangesRowExpiry      = "exp"
+	ChangesRowRecoverable = "recoverable"
+	ChangesRowLastRev     = "lastRev"
+	ChangesRowCursor      = "cursor"
+
 	// changes message properties
 	ChangesResponseMaxHistory = "maxHistory"
 	ChangesResponseDeltas     = "deltas"
 
 	// proposeChanges message properties
+	ProposeChangesConflictPolicy = "conflictPolicy"
+	ProposeChangesStream         = "stream" // Whether the client accepts statuses in proposeChangesStatus messages
 	ProposeChangesResponseDeltas = "deltas"
+	ProposeChangesResponseStream = "streamed" // Set when statuses were sent in proposeChangesStatus messages
+
+	// proposeChangesStatus message properties
+	ProposeStatusOffset = "offset" // Index in the proposeChanges message of the change the first status is for
 
 	// getAttachment message properties
 	GetAttachmentDigest = "digest"
+	GetAttachmentAccept = "acceptEncoding" // Comma-separated encodings the attachment may be compressed with
+	GetAttachmentOffset = "offset"         // First byte of the range of the attachment to send, when resuming a download
+	GetAttachmentLength = "length"         // Max bytes of the range to send; omitted for the rest of the attachment
+	GetAttachmentStart  = "start"          // Alternative to offset: first byte of a range that must be within the attachment
+	GetAttachmentEnd    = "end"            // Byte after the last of the range given by start; omitted for the rest of the attachment
+
+	// getAttachment response properties
+	GetAttachmentEncoding    = "encoding"    // Encoding the attachment, or range, was compressed with, if any
+	GetAttachmentRangeOffset = "offset"      // First byte of the range sent, for a ranged request
+	GetAttachmentRangeLength = "length"      // Bytes of the attachment in the range sent, before any compression
+	GetAttachmentTotalLength = "totalLength" // Length of the whole attachment, for a ranged request
 
 	// proveAttachment
 	ProveAttachmentDigest = "digest"
@@ -88,13 +272,26 @@ type SequenceIDParser func(since string) (SequenceID, error)
 
 // Helper for handling BLIP subChanges requests.  Supports Stringer() interface to log aspects of the request.
 type SubChangesParams struct {
-	rq      *blip.Message // The underlying BLIP message
-	_since  SequenceID    // Since value on the incoming request
-	_docIDs []string      // Document ID filter specified on the incoming request
+	rq            *blip.Message     // The underlying BLIP message
+	_since        SequenceID        // Since value on the incoming request
+	_docIDs       []string          // Document ID filter specified on the incoming request
+	_channelSince map[string]uint64 // Per-channel checkpoints specified on the incoming request
 }
 
+// SubChangesBody is the optional body of a subChanges request.
+//
+// ChannelSince holds per-channel checkpoints for a client subscribed to many channels, as a map of channel name to
+// the sequence number the client has seen that channel's changes up to, e.g. {"channelSince": {"a": 120, "b": 95}}.
+// Each channel's changes are resumed after its own sequence, so channels with no new activity since their checkpoint
+// contribute nothing to the feed.  The 'since' property is still required, and should be the lowest of the client's
+// checkpoints: it's used for channels missing from the map, and is the fallback for servers that don't support
+// per-channel checkpoints.  When ChannelSince is present, each changes row is sent with a fifth element holding the
+// channels the change was found in under "channels", so the client can advance those channels' checkpoints to the
+// row's sequence.  Only the numeric part of a compound sequence should be stored, and channel positions aren't
+// applied while the feed is resuming from a compound sequence.
 type SubChangesBody struct {
-	DocIDs []string `json:"docIDs"`
+	DocIDs       []string          `json:"docIDs"`
+	ChannelSince map[string]uint64 `json:"channelSince,omitempty"`
 }
 
 // Create a new subChanges helper
@@ -116,12 +313,13 @@ func NewSubChangesParams(logCtx context.Context, rq *blip.Message, zeroSeq Seque
 	params._since = sinceSequenceId
 
 	// rq.BodyReader() returns an EOF for a non-existent body, so using rq.Body() here
-	docIDs, err := readDocIDsFromRequest(rq)
+	body, err := readSubChangesBody(rq)
 	if err != nil {
 		base.InfofCtx(logCtx, base.KeySync, "%s: Error reading doc IDs on subChanges request: %s", rq, err)
 		return params, err
 	}
-	params._docIDs = docIDs
+	params._docIDs = body.DocIDs
+	params._channelSince = body.ChannelSince
 
 	return params, nil
 }
@@ -134,24 +332,26 @@ func (s *SubChangesParams) docIDs() []string {
 	return s._docIDs
 }
 
-func readDocIDsFromRequest(rq *blip.Message) (docIDs []string, err error) {
+// channelSince returns the client's per-channel checkpoints, or nil if the client didn't send any.
+func (s *SubChangesParams) channelSince() map[string]uint64 {
+	return s._channelSince
+}
+
+func readSubChangesBody(rq *blip.Message) (body SubChangesBody, err error) {
 	// Get Body from request.  Not using BodyReader(), to avoid EOF on empty body
 	rawBody, err := rq.Body()
 	if err != nil {
-		return nil, err
+		return body, err
 	}
 
-	// If there's a non-empty body, unmarshal to get the docIDs
+	// If there's a non-empty body, unmarshal to get the docIDs and per-channel checkpoints
 	if len(rawBody) > 0 {
-		var body SubChangesBody
 		unmarshalErr := base.JSONUnmarshal(rawBody, &body)
 		if unmarshalErr != nil {
-			return nil, err
-		} else {
-			docIDs = body.DocIDs
+			return SubChangesBody{}, err
 		}
 	}
-	return docIDs, err
+	return body, err
 
 }
 
@@ -171,6 +371,197 @@ func (s *SubChangesParams) activeOnly() bool {
 	return (s.rq.Properties[SubChangesActiveOnly] == "true")
 }
 
+// session returns the client-supplied session identifier used to track initial sync progress on the server.
+func (s *SubChangesParams) session() string {
+	return s.rq.Properties[SubChangesSession]
+}
+
+// stagedSync returns true when the client wants to select which docs it receives bodies for after each changes batch.
+func (s *SubChangesParams) stagedSync() bool {
+	return s.rq.Properties[SubChangesStagedSync] == "true"
+}
+
+// revRetry returns true when the client wants revs it temporarily failed to persist to be re-sent.
+func (s *SubChangesParams) revRetry() bool {
+	return s.rq.Properties[SubChangesRevRetry] == "true"
+}
+
+// metadataChanges returns true when the client wants to be notified of metadata-only changes to revisions it's
+// already been sent.
+func (s *SubChangesParams) metadataChanges() bool {
+	return s.rq.Properties[SubChangesMetadata] == "true"
+}
+
+// sortBy returns the top-level body property a one-shot pull's changes should be sorted by, if any.
+func (s *SubChangesParams) sortBy() string {
+	return s.rq.Properties[SubChangesSortBy]
+}
+
+// dependencyOrder returns true when a one-shot pull's docs should be sent after the docs they reference, in the
+// database's configured reference field.
+func (s *SubChangesParams) dependencyOrder() bool {
+	return s.rq.Properties[SubChangesDepOrder] == "true"
+}
+
+// withAttachmentsOnly returns true when the client only wants changes to docs that have attachments.  This is a
+// post-filter, applied to the changes matching the subscription's channel filter, and is based on the attachments of
+// each doc's current revision as recorded in its metadata.  Tombstones aren't filtered, so that clients can remove
+// docs they were previously sent.
+func (s *SubChangesParams) withAttachmentsOnly() bool {
+	return s.rq.Properties[SubChangesAttOnly] == "true"
+}
+
+// subscriptionTTL returns how long the client wants a continuous subscription to last before it's ended, or 0 for
+// no limit.
+func (s *SubChangesParams) subscriptionTTL() time.Duration {
+	seconds := base.GetRestrictedIntFromString(s.rq.Properties[SubChangesTTL], 0, 0, math.MaxInt32, true)
+	return time.Duration(seconds) * time.Second
+}
+
+// heartbeatInterval returns how often the client wants a continuous feed to send it heartbeats, or 0 for none.
+func (s *SubChangesParams) heartbeatInterval() time.Duration {
+	seconds := base.GetRestrictedIntFromString(s.rq.Properties[SubChangesHeartbeat], 0, 0, math.MaxInt32, true)
+	return time.Duration(seconds) * time.Second
+}
+
+// maxStaleness returns how stale, in the 'maxStaleness' property's seconds, the client will accept the index reads
+// made to backfill its feed from before the channel cache's contents.  Changes in the cache are never stale.  Zero,
+// the default, requires consistent reads.
+func (s *SubChangesParams) maxStaleness() time.Duration {
+	seconds := base.GetRestrictedIntFromString(s.rq.Properties[SubChangesStaleness], 0, 0, math.MaxInt32, true)
+	return time.Duration(seconds) * time.Second
+}
+
+// maxChangesPerSecond returns the most changes per second the client wants sent, spreading delivery rather than
+// sending changes as fast as it accepts them, or 0 for no limit.
+func (s *SubChangesParams) maxChangesPerSecond() int {
+	return int(base.GetRestrictedIntFromString(s.rq.Properties[SubChangesPacing], 0, 0, math.MaxInt32, true))
+}
+
+// revChunkSize returns the size of the chunks the client wants rev bodies larger than it split into, raised to
+// MinRevChunkSize, or 0 for bodies to be sent whole.
+func (s *SubChangesParams) revChunkSize() int {
+	size := int(base.GetRestrictedIntFromString(s.rq.Properties[SubChangesChunkSize], 0, 0, math.MaxInt32, true))
+	if size > 0 && size < MinRevChunkSize {
+		size = MinRevChunkSize
+	}
+	return size
+}
+
+// minDocSize returns the smallest body size, in bytes, of the docs whose changes the client wants sent, or 0 for no
+// minimum.
+func (s *SubChangesParams) minDocSize() int {
+	return int(base.GetRestrictedIntFromString(s.rq.Properties[SubChangesMinSize], 0, 0, math.MaxInt32, true))
+}
+
+// maxDocSize returns the largest body size, in bytes, of the docs whose changes the client wants sent, or 0 for no
+// maximum.
+func (s *SubChangesParams) maxDocSize() int {
+	return int(base.GetRestrictedIntFromString(s.rq.Properties[SubChangesMaxSize], 0, 0, math.MaxInt32, true))
+}
+
+// excludeChannels returns the channels in the comma-separated 'excludeChannels' property, whose changes aren't sent
+// even though the subscription includes them, or nil when there are none.
+func (s *SubChangesParams) excludeChannels() (base.Set, error) {
+	excludeParam := s.rq.Properties[SubChangesExclude]
+	if excludeParam == "" {
+		return nil, nil
+	}
+	return channels.SetFromArray(strings.Split(excludeParam, ","), channels.RemoveStar)
+}
+
+// channelPatterns returns the glob patterns in the comma-separated 'channelPatterns' property, or nil when there are
+// none.  A pattern of wildcards alone would match every channel, so isn't accepted.
+func (s *SubChangesParams) channelPatterns() ([]string, error) {
+	patternsParam := s.rq.Properties[SubChangesPatterns]
+	if patternsParam == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(patternsParam, ",")
+	for _, pattern := range patterns {
+		if strings.Trim(pattern, channels.AllChannelWildcard) == "" {
+			return nil, fmt.Errorf("Channel pattern %q matches every channel", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// bodyChecksum returns true when the client wants each rev sent with a CRC-32C checksum of its body, as a hex string
+// in the rev's 'checksum' property.  A client that finds a mismatch replies to the rev with a 422 error, and the rev
+// is re-sent with its full body.
+func (s *SubChangesParams) bodyChecksum() bool {
+	return s.rq.Properties[SubChangesChecksum] == "true"
+}
+
+// repeatCaughtUp returns true when a continuous feed should signal the client it's caught up each time the feed
+// drains after sending changes, rather than only the first time.
+func (s *SubChangesParams) repeatCaughtUp() bool {
+	return s.rq.Properties[SubChangesCaughtUp] == "true"
+}
+
+// recoverableTombstones returns true when the client wants tombstones still within the database's retention window
+// flagged as recoverable, along with the revision holding the document's last body, which it can fetch with getRev.
+func (s *SubChangesParams) recoverableTombstones() bool {
+	return s.rq.Properties[SubChangesRecovery] == "true"
+}
+
+// templateDeltas returns true when the client can apply a delta against a per-type template to a document it has no
+// revision of.  Template deltas are only sent while deltas are enabled for the replication.
+func (s *SubChangesParams) templateDeltas() bool {
+	return s.rq.Properties[SubChangesTemplates] == "true"
+}
+
+// revocations returns true when the client should be sent a revoked message listing the docs the user can no longer
+// access whenever it loses access to a channel.
+func (s *SubChangesParams) revocations() bool {
+	return s.rq.Properties[SubChangesRevokes] == "true"
+}
+
+// channelMembership returns true when each rev sent should list the channels its doc entered and left relative to its
+// parent revision.
+func (s *SubChangesParams) channelMembership() bool {
+	return s.rq.Properties[SubChangesMembership] == "true"
+}
+
+// deliveryIndex returns true when each rev and norev sent should carry its index in the order the subscription sent
+// them.
+func (s *SubChangesParams) deliveryIndex() bool {
+	return s.rq.Properties[SubChangesDelivery] == "true"
+}
+
+// summaries returns true when revs should be sent with the summary of their body in place of the full body.
+func (s *SubChangesParams) summaries() bool {
+	return s.rq.Properties[SubChangesSummaries] == "true"
+}
+
+// tombstonesFirst returns true when a one-shot catch-up should send docs deleted within it as their tombstones alone,
+// rather than their creation followed by their deletion.
+func (s *SubChangesParams) tombstonesFirst() bool {
+	return s.rq.Properties[SubChangesTombstones] == "true"
+}
+
+// accessChanges returns true when the client should be sent an accessChanged message whenever the user's channel
+// access or roles change.
+func (s *SubChangesParams) accessChanges() bool {
+	return s.rq.Properties[SubChangesAccess] == "true"
+}
+
+// cursorTokens returns true when each changes row should carry a cursor token, which the client can pass back as
+// 'since' to resume after that change.
+func (s *SubChangesParams) cursorTokens() bool {
+	return s.rq.Properties[SubChangesCursors] == "true"
+}
+
+// deltaFormat returns the format the client wants deltas sent in, which defaults to DeltaFormatFleece.
+func (s *SubChangesParams) deltaFormat() (string, error) {
+	return parseDeltaFormat(s.rq.Properties[SubChangesDeltaFmt])
+}
+
+// expression returns the filter expression for the sync_gateway/byexpression filter.
+func (s *SubChangesParams) expression() string {
+	return s.rq.Properties[SubChangesExpression]
+}
+
 func (s *SubChangesParams) filter() string {
 	return s.rq.Properties[SubChangesFilter]
 }
@@ -212,6 +603,9 @@ func (s *SubChangesParams) String() string {
 		if found {
 			buffer.WriteString(fmt.Sprintf("Channels:%v ", channels))
 		}
+		if patterns := s.rq.Properties[SubChangesPatterns]; patterns != "" {
+			buffer.WriteString(fmt.Sprintf("ChannelPatterns:%v ", patterns))
+		}
 	}
 
 	batchSize := s.batchSize()
@@ -222,10 +616,139 @@ func (s *SubChangesParams) String() string {
 	if len(s.docIDs()) > 0 {
 		buffer.WriteString(fmt.Sprintf("DocIDs:%v ", s.docIDs()))
 	}
+
+	if channelSince := s.channelSince(); channelSince != nil {
+		buffer.WriteString(fmt.Sprintf("#ChannelSince:%d ", len(channelSince)))
+	}
+
+	if session := s.session(); session != "" {
+		buffer.WriteString(fmt.Sprintf("Session:%v ", session))
+	}
+
+	if stagedSync := s.stagedSync(); stagedSync {
+		buffer.WriteString(fmt.Sprintf("StagedSync:%v ", stagedSync))
+	}
+
+	if revRetry := s.revRetry(); revRetry {
+		buffer.WriteString(fmt.Sprintf("RevRetry:%v ", revRetry))
+	}
+
+	if metadataChanges := s.metadataChanges(); metadataChanges {
+		buffer.WriteString(fmt.Sprintf("MetadataChanges:%v ", metadataChanges))
+	}
+
+	if bodyChecksum := s.bodyChecksum(); bodyChecksum {
+		buffer.WriteString(fmt.Sprintf("BodyChecksum:%v ", bodyChecksum))
+	}
+
+	if repeatCaughtUp := s.repeatCaughtUp(); repeatCaughtUp {
+		buffer.WriteString(fmt.Sprintf("RepeatCaughtUp:%v ", repeatCaughtUp))
+	}
+
+	if recoverableTombstones := s.recoverableTombstones(); recoverableTombstones {
+		buffer.WriteString(fmt.Sprintf("RecoverableTombstones:%v ", recoverableTombstones))
+	}
+
+	if templateDeltas := s.templateDeltas(); templateDeltas {
+		buffer.WriteString(fmt.Sprintf("TemplateDeltas:%v ", templateDeltas))
+	}
+
+	if accessChanges := s.accessChanges(); accessChanges {
+		buffer.WriteString(fmt.Sprintf("AccessChanges:%v ", accessChanges))
+	}
+
+	if channelMembership := s.channelMembership(); channelMembership {
+		buffer.WriteString(fmt.Sprintf("ChannelMembership:%v ", channelMembership))
+	}
+
+	if deliveryIndex := s.deliveryIndex(); deliveryIndex {
+		buffer.WriteString(fmt.Sprintf("DeliveryIndex:%v ", deliveryIndex))
+	}
+
+	if summaries := s.summaries(); summaries {
+		buffer.WriteString(fmt.Sprintf("Summaries:%v ", summaries))
+	}
+
+	if tombstonesFirst := s.tombstonesFirst(); tombstonesFirst {
+		buffer.WriteString(fmt.Sprintf("TombstonesFirst:%v ", tombstonesFirst))
+	}
+
+	if cursorTokens := s.cursorTokens(); cursorTokens {
+		buffer.WriteString(fmt.Sprintf("CursorTokens:%v ", cursorTokens))
+	}
+
+	if deltaFormat := s.rq.Properties[SubChangesDeltaFmt]; deltaFormat != "" {
+		buffer.WriteString(fmt.Sprintf("DeltaFormat:%s ", deltaFormat))
+	}
+
+	if expression := s.expression(); expression != "" {
+		buffer.WriteString(fmt.Sprintf("Expression:%s ", base.UD(expression)))
+	}
+
+	if sortBy := s.sortBy(); sortBy != "" {
+		buffer.WriteString(fmt.Sprintf("SortBy:%s ", base.UD(sortBy)))
+	}
+
+	if dependencyOrder := s.dependencyOrder(); dependencyOrder {
+		buffer.WriteString(fmt.Sprintf("DependencyOrder:%v ", dependencyOrder))
+	}
+
+	if withAttachmentsOnly := s.withAttachmentsOnly(); withAttachmentsOnly {
+		buffer.WriteString(fmt.Sprintf("WithAttachmentsOnly:%v ", withAttachmentsOnly))
+	}
+
+	if maxStaleness := s.maxStaleness(); maxStaleness > 0 {
+		buffer.WriteString(fmt.Sprintf("MaxStaleness:%v ", maxStaleness))
+	}
+
+	if minDocSize := s.minDocSize(); minDocSize > 0 {
+		buffer.WriteString(fmt.Sprintf("MinDocSize:%d ", minDocSize))
+	}
+
+	if maxDocSize := s.maxDocSize(); maxDocSize > 0 {
+		buffer.WriteString(fmt.Sprintf("MaxDocSize:%d ", maxDocSize))
+	}
+
+	if maxChangesPerSecond := s.maxChangesPerSecond(); maxChangesPerSecond > 0 {
+		buffer.WriteString(fmt.Sprintf("MaxChangesPerSecond:%d ", maxChangesPerSecond))
+	}
+
+	if revChunkSize := s.revChunkSize(); revChunkSize > 0 {
+		buffer.WriteString(fmt.Sprintf("RevChunkSize:%d ", revChunkSize))
+	}
 	return buffer.String()
 
 }
 
+// CapabilitiesBody is the response body of a getCapabilities request, advertising the limits the server enforces on
+// what clients send it and the optional encodings it accepts.  Limits that aren't configured are omitted.
+type CapabilitiesBody struct {
+	MaxRevGeneration     int      `json:"maxRevGeneration,omitempty"`
+	MaxChangesPerMessage int      `json:"maxChangesPerMessage,omitempty"`
+	AttachmentEncodings  []string `json:"attachmentEncodings,omitempty"`  // Encodings a client may compress attachments it sends with
+	RevChannelAssignment bool     `json:"revChannelAssignment,omitempty"` // Whether revs may ask for their assigned channels, or declare expected ones
+	StreamedProposals    bool     `json:"streamedProposals,omitempty"`    // Whether large proposeChanges messages' statuses may be streamed
+	KeepaliveInterval    int      `json:"keepaliveInterval,omitempty"`    // Seconds between keepalives sent on an idle feed, as negotiated at handshake
+	Revocations          bool     `json:"revocations,omitempty"`          // Whether subChanges may ask for revoked messages listing docs the user loses access to
+	ChannelMembership    bool     `json:"channelMembership,omitempty"`    // Whether subChanges may ask for revs to list the channels their doc entered and left
+	MinRevChunkSize      int      `json:"minRevChunkSize,omitempty"`      // Smallest chunk size subChanges may ask large rev bodies to be split into
+	DeliveryIndex        bool     `json:"deliveryIndex,omitempty"`        // Whether subChanges may ask for revs to carry their index in the order they were sent
+	Summaries            bool     `json:"summaries,omitempty"`            // Whether subChanges may ask for revs to be sent as summaries of their bodies
+	StrictNumbers        bool     `json:"strictNumbers,omitempty"`        // Whether the handshake may ask for strict number handling in deltas
+	Databases            []string `json:"databases,omitempty"`            // Databases multiplexed on the connection besides the one connected to, as negotiated at handshake
+	CheckpointBatches    bool     `json:"checkpointBatches,omitempty"`    // Whether getCheckpoints may fetch several clients' checkpoints in one message
+	AttachmentDigests    []string `json:"attachmentDigests,omitempty"`    // Attachment digest algorithms the server supports; sha256 is used if the handshake also asked for it
+}
+
+// BatchedCheckpoint is a client's checkpoint in a getCheckpoints response.  A JSON checkpoint is returned in Body, and
+// an opaque one in Opaque.
+type BatchedCheckpoint struct {
+	Client string          `json:"client"`
+	Rev    string          `json:"rev"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Opaque []byte          `json:"opaque,omitempty"` // Base64 encoded in JSON
+}
+
 // setCheckpoint message
 type SetCheckpointMessage struct {
 	*blip.Message
@@ -253,6 +776,14 @@ func (scm *SetCheckpointMessage) SetRev(rev string) {
 	scm.Properties[SetCheckpointRev] = rev
 }
 
+func (scm *SetCheckpointMessage) opaque() bool {
+	return scm.Properties[SetCheckpointOpaque] == "true"
+}
+
+func (scm *SetCheckpointMessage) SetOpaque(opaque bool) {
+	scm.Properties[SetCheckpointOpaque] = strconv.FormatBool(opaque)
+}
+
 func (scm *SetCheckpointMessage) String() string {
 
 	buffer := bytes.NewBufferString("")
@@ -264,6 +795,10 @@ func (scm *SetCheckpointMessage) String() string {
 		buffer.WriteString(fmt.Sprintf("Rev:%v ", rev))
 	}
 
+	if scm.opaque() {
+		buffer.WriteString("Opaque:true ")
+	}
+
 	return buffer.String()
 
 }
@@ -314,6 +849,75 @@ func (rm *RevMessage) DeltaSrc() (deltaSrc string, found bool) {
 	return deltaSrc, found
 }
 
+// DeltaFormat returns the format of a delta rev's body, which defaults to DeltaFormatFleece.
+func (rm *RevMessage) DeltaFormat() (string, error) {
+	return parseDeltaFormat(rm.Properties[RevMessageDeltaFormat])
+}
+
+// BatchProofs returns true when the client can prove it has several attachments with a single proveAttachments
+// request.
+func (rm *RevMessage) BatchProofs() bool {
+	return rm.Properties[RevMessageBatchProofs] == "true"
+}
+
+// ReturnChannels returns true when the client wants the rev response to list the channels the sync function assigned
+// the revision.
+func (rm *RevMessage) ReturnChannels() bool {
+	return rm.Properties[RevMessageRetChannels] == "true"
+}
+
+// ExpectedChannels returns the comma-separated channels the client expects the sync function to assign the revision,
+// and whether the client declared them.  An empty property declares that the revision is expected in no channels.
+func (rm *RevMessage) ExpectedChannels() (expected base.Set, found bool) {
+	property, found := rm.Properties[RevMessageExpChannels]
+	if !found {
+		return nil, false
+	}
+	expected = base.Set{}
+	for _, channel := range strings.Split(property, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			expected.Add(channel)
+		}
+	}
+	return expected, true
+}
+
+// joinChannels returns a sorted, comma-separated list of channels for a message property.
+func joinChannels(channels base.Set) string {
+	names := channels.ToArray()
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// IfAbsent returns true when the revision should only be written if the document doesn't already exist.
+func (rm *RevMessage) IfAbsent() bool {
+	return rm.Properties[RevMessageIfAbsent] == "true"
+}
+
+// IfMatch returns the revision the document's current revision must be for the revision to be written, if any.
+func (rm *RevMessage) IfMatch() (ifMatch string, found bool) {
+	ifMatch, found = rm.Properties[RevMessageIfMatch]
+	return ifMatch, found
+}
+
+// Priority returns the client-assigned write priority of the revision, from 0 (the default) to BlipMaxRevPriority.
+func (rm *RevMessage) Priority() (int, error) {
+	priorityStr, found := rm.Properties[RevMessagePriority]
+	if !found {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(priorityStr)
+	if err != nil || priority < 0 || priority > BlipMaxRevPriority {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid value for %s: %q", RevMessagePriority, priorityStr)
+	}
+	return priority, nil
+}
+
+// IdempotencyKey returns the client-supplied key identifying this push across retries, if any.
+func (rm *RevMessage) IdempotencyKey() string {
+	return rm.Properties[RevMessageIdemKey]
+}
+
 func (rm *RevMessage) HasDeletedProperty() bool {
 	_, found := rm.Properties[RevMessageDeleted]
 	return found
@@ -363,6 +967,14 @@ func (rm *RevMessage) String() string {
 		buffer.WriteString(fmt.Sprintf("Sequence:%v ", sequence))
 	}
 
+	if rm.IfAbsent() {
+		buffer.WriteString("IfAbsent:true ")
+	}
+
+	if ifMatch, found := rm.IfMatch(); found {
+		buffer.WriteString(fmt.Sprintf("IfMatch:%v ", ifMatch))
+	}
+
 	return buffer.String()
 
 }
@@ -407,12 +1019,81 @@ func (g *getAttachmentParams) digest() string {
 	return g.rq.Properties[GetAttachmentDigest]
 }
 
+// acceptEncodings returns the encodings the client accepts the attachment compressed with, if any.
+func (g *getAttachmentParams) acceptEncodings() []string {
+	accept := g.rq.Properties[GetAttachmentAccept]
+	if accept == "" {
+		return nil
+	}
+	return strings.Split(accept, ",")
+}
+
+// byteRange returns the offset and max length of the range of the attachment the client asked for, with a length of
+// zero for the rest of the attachment.  ranged is false when the client asked for the whole attachment.  A range may
+// be given by either offset and length, or start and end, but not a mix of the two.
+func (g *getAttachmentParams) byteRange() (offset, length int, ranged bool, err error) {
+	if g.hasStartEndRange() {
+		return g.startEndRange()
+	}
+	offsetProperty, hasOffset := g.rq.Properties[GetAttachmentOffset]
+	lengthProperty, hasLength := g.rq.Properties[GetAttachmentLength]
+	if hasOffset {
+		if offset, err = strconv.Atoi(offsetProperty); err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("Invalid '%s' %q", GetAttachmentOffset, offsetProperty)
+		}
+	}
+	if hasLength {
+		if length, err = strconv.Atoi(lengthProperty); err != nil || length <= 0 {
+			return 0, 0, false, fmt.Errorf("Invalid '%s' %q", GetAttachmentLength, lengthProperty)
+		}
+	}
+	return offset, length, hasOffset || hasLength, nil
+}
+
+// hasStartEndRange returns true if the client gave the range of the attachment it asked for by start and end, which
+// unlike offset and length must be within the attachment.
+func (g *getAttachmentParams) hasStartEndRange() bool {
+	_, hasStart := g.rq.Properties[GetAttachmentStart]
+	_, hasEnd := g.rq.Properties[GetAttachmentEnd]
+	return hasStart || hasEnd
+}
+
+// startEndRange returns the offset and max length of the range given by start and end.
+func (g *getAttachmentParams) startEndRange() (offset, length int, ranged bool, err error) {
+	_, hasOffset := g.rq.Properties[GetAttachmentOffset]
+	_, hasLength := g.rq.Properties[GetAttachmentLength]
+	if hasOffset || hasLength {
+		return 0, 0, false, fmt.Errorf("'%s' and '%s' can't be combined with '%s' and '%s'", GetAttachmentStart, GetAttachmentEnd, GetAttachmentOffset, GetAttachmentLength)
+	}
+	if startProperty, hasStart := g.rq.Properties[GetAttachmentStart]; hasStart {
+		if offset, err = strconv.Atoi(startProperty); err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("Invalid '%s' %q", GetAttachmentStart, startProperty)
+		}
+	}
+	if endProperty, hasEnd := g.rq.Properties[GetAttachmentEnd]; hasEnd {
+		end, err := strconv.Atoi(endProperty)
+		if err != nil || end <= offset {
+			return 0, 0, false, fmt.Errorf("Invalid '%s' %q", GetAttachmentEnd, endProperty)
+		}
+		length = end - offset
+	}
+	return offset, length, true, nil
+}
+
 func (g *getAttachmentParams) String() string {
 
 	buffer := bytes.NewBufferString("")
 
 	buffer.WriteString(fmt.Sprintf("Digest:%v ", g.digest()))
 
+	if offset, length, ranged, _ := g.byteRange(); ranged {
+		buffer.WriteString(fmt.Sprintf("Offset:%d Length:%d ", offset, length))
+	}
+
+	if accept := g.rq.Properties[GetAttachmentAccept]; accept != "" {
+		buffer.WriteString(fmt.Sprintf("AcceptEncoding:%s ", accept))
+	}
+
 	return buffer.String()
 
 }
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// initialSyncProgressMaxEntries is the number of progress records retained before the oldest are evicted, regardless
+// of TTL.
+const initialSyncProgressMaxEntries = 10000
+
+// initialSyncStore retains the sequence an initial pull had been acked up to, for clients that requested
+// server-side progress tracking via the subChanges 'session' property.  The store is in-memory and best-effort:
+// records are not shared between Sync Gateway nodes, are lost on restart, and are discarded once the TTL elapses or
+// initialSyncProgressMaxEntries more recently updated records are held.  A client that reconnects to a different
+// node, or after its record has been discarded, restarts from its own checkpoint.
+type initialSyncStore struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*list.Element // Key to element of order, whose value is an *initialSyncProgressEntry
+	order   *list.List               // Entries from least to most recently set.  As the TTL is fixed, this is also expiry order
+}
+
+type initialSyncProgressEntry struct {
+	key       string
+	seq       SequenceID
+	expiresAt time.Time
+}
+
+// newInitialSyncStore returns a progress store with the given TTL, or nil when the TTL is zero (disabled).
+func newInitialSyncStore(ttl time.Duration) *initialSyncStore {
+	if ttl <= 0 {
+		return nil
+	}
+	return &initialSyncStore{
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the last acked sequence recorded for key, if one exists and hasn't expired.
+func (s *initialSyncStore) get(key string) (seq SequenceID, found bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return SequenceID{}, false
+	}
+	entry := element.Value.(*initialSyncProgressEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.removeElement(element)
+		return SequenceID{}, false
+	}
+	return entry.seq, true
+}
+
+// set records seq as the last acked sequence for key, and resets its TTL.  Expired entries are purged, and the
+// entries closest to expiry are evicted to keep the store within initialSyncProgressMaxEntries.
+func (s *initialSyncStore) set(key string, seq SequenceID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*initialSyncProgressEntry)
+		entry.seq = seq
+		entry.expiresAt = now.Add(s.ttl)
+		s.order.MoveToBack(element)
+		return
+	}
+	for front := s.order.Front(); front != nil; front = s.order.Front() {
+		oldest := front.Value.(*initialSyncProgressEntry)
+		if len(s.entries) < initialSyncProgressMaxEntries && now.Before(oldest.expiresAt) {
+			break
+		}
+		s.removeElement(front)
+	}
+	s.entries[key] = s.order.PushBack(&initialSyncProgressEntry{key: key, seq: seq, expiresAt: now.Add(s.ttl)})
+}
+
+func (s *initialSyncStore) removeElement(element *list.Element) {
+	delete(s.entries, element.Value.(*initialSyncProgressEntry).key)
+	s.order.Remove(element)
+}
+
+// initialSyncProgressTracker tracks the changes batches sent on a single subChanges feed, and advances the
+// stored progress to the last sequence of the most recent batch for which it and all earlier batches have been acked.
+// A batch is acked once the client's response to it has been handled and the client has acknowledged every rev it
+// asked for in that response, as a changes response alone doesn't mean the revs arrived.  Batches can be acked out
+// of order, as each changes response is handled on its own goroutine.
+type initialSyncProgressTracker struct {
+	key          string
+	store        *initialSyncStore
+	lock         sync.Mutex
+	firstBatch   uint64              // Batch number of pending[0]
+	pending      []initialSyncBatch  // Batches sent but not yet recorded, in send order
+	awaitingRevs map[IDAndRev]uint64 // Batch number of each rev sent that the client hasn't yet acknowledged
+}
+
+type initialSyncBatch struct {
+	lastSeq      SequenceID
+	responded    bool // Whether the client's response to the changes message has been handled
+	awaitingRevs int  // Revs sent for the batch that the client hasn't yet acknowledged
+}
+
+func newInitialSyncProgressTracker(store *initialSyncStore, key string) *initialSyncProgressTracker {
+	return &initialSyncProgressTracker{
+		key:          key,
+		store:        store,
+		awaitingRevs: make(map[IDAndRev]uint64),
+	}
+}
+
+// batchSent registers a sent batch ending at lastSeq, and returns the batch number to pass to batchResponded.
+func (t *initialSyncProgressTracker) batchSent(lastSeq SequenceID) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, initialSyncBatch{lastSeq: lastSeq})
+	return t.firstBatch + uint64(len(t.pending)-1)
+}
+
+// revRequested registers a rev the client asked for in its response to the given batch, before it's sent, so that
+// the batch isn't acked until the client acknowledges it.
+func (t *initialSyncProgressTracker) revRequested(batch uint64, docID, revID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := IDAndRev{DocID: docID, RevID: revID}
+	if _, found := t.awaitingRevs[key]; found || !t._isPending(batch) {
+		return
+	}
+	t.pending[batch-t.firstBatch].awaitingRevs++
+	t.awaitingRevs[key] = batch
+}
+
+// revAcked records that the client has acknowledged a rev, or been sent a norev in place of it.  Revs the client
+// fails to store aren't acked, so that progress isn't recorded past them.
+func (t *initialSyncProgressTracker) revAcked(docID, revID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := IDAndRev{DocID: docID, RevID: revID}
+	batch, found := t.awaitingRevs[key]
+	if !found {
+		return
+	}
+	delete(t.awaitingRevs, key)
+	if t._isPending(batch) {
+		t.pending[batch-t.firstBatch].awaitingRevs--
+		t._advance()
+	}
+}
+
+// batchResponded marks the client's response to the given batch as handled, once every rev it asked for has been
+// sent.  Only a valid response is handled, so a batch the client rejected is never acked.
+func (t *initialSyncProgressTracker) batchResponded(batch uint64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t._isPending(batch) {
+		return
+	}
+	t.pending[batch-t.firstBatch].responded = true
+	t._advance()
+}
+
+// _isPending returns true if the batch has been sent but not yet recorded.  Requires the lock to be held.
+func (t *initialSyncProgressTracker) _isPending(batch uint64) bool {
+	return batch >= t.firstBatch && batch-t.firstBatch < uint64(len(t.pending))
+}
+
+// _advance records progress for any contiguous run of acked batches.  Requires the lock to be held.
+func (t *initialSyncProgressTracker) _advance() {
+	advanced := false
+	var lastSeq SequenceID
+	for len(t.pending) > 0 && t.pending[0].responded && t.pending[0].awaitingRevs == 0 {
+		lastSeq = t.pending[0].lastSeq
+		t.pending = t.pending[1:]
+		t.firstBatch++
+		advanced = true
+	}
+	if advanced {
+		t.store.set(t.key, lastSeq)
+	}
+}
+
+// initialSyncProgressKey scopes a client-supplied session identifier to the user, so that one user can't resume
+// from another user's progress.
+func initialSyncProgressKey(userName, session string) string {
+	return userName + "/" + session
+}
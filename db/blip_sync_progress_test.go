@@ -0,0 +1,114 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInitialSyncProgressTrackerOutOfOrderAcks ensures progress is only recorded up to the last batch for which
+// every earlier batch has also been acked.
+func TestInitialSyncProgressTrackerOutOfOrderAcks(t *testing.T) {
+	store := newInitialSyncStore(time.Minute)
+	tracker := newInitialSyncProgressTracker(store, initialSyncProgressKey("alice", "session1"))
+
+	batch1 := tracker.batchSent(SequenceID{Seq: 10})
+	batch2 := tracker.batchSent(SequenceID{Seq: 20})
+	batch3 := tracker.batchSent(SequenceID{Seq: 30})
+
+	tracker.batchResponded(batch2)
+	_, found := store.get(tracker.key)
+	assert.False(t, found, "Progress shouldn't be recorded while an earlier batch is unacked")
+
+	tracker.batchResponded(batch1)
+	seq, found := store.get(tracker.key)
+	assert.True(t, found)
+	assert.Equal(t, uint64(20), seq.Seq)
+
+	tracker.batchResponded(batch3)
+	seq, found = store.get(tracker.key)
+	assert.True(t, found)
+	assert.Equal(t, uint64(30), seq.Seq)
+
+	// Other users and sessions don't see this progress
+	_, found = store.get(initialSyncProgressKey("bob", "session1"))
+	assert.False(t, found)
+}
+
+// TestInitialSyncProgressTrackerAwaitsRevAcks ensures a batch isn't acked until the client has acknowledged every rev
+// it asked for, and that a batch the client never validly responded to holds back progress.
+func TestInitialSyncProgressTrackerAwaitsRevAcks(t *testing.T) {
+	store := newInitialSyncStore(time.Minute)
+	tracker := newInitialSyncProgressTracker(store, initialSyncProgressKey("alice", "session1"))
+
+	batch1 := tracker.batchSent(SequenceID{Seq: 10})
+	tracker.revRequested(batch1, "doc1", "1-a")
+	tracker.revRequested(batch1, "doc2", "1-b")
+	tracker.batchResponded(batch1)
+	_, found := store.get(tracker.key)
+	assert.False(t, found, "Progress shouldn't be recorded while revs are unacknowledged")
+
+	// Acks for revs that weren't requested are ignored
+	tracker.revAcked("doc3", "1-c")
+	tracker.revAcked("doc1", "1-a")
+	_, found = store.get(tracker.key)
+	assert.False(t, found, "Progress shouldn't be recorded while revs are unacknowledged")
+
+	tracker.revAcked("doc2", "1-b")
+	seq, found := store.get(tracker.key)
+	assert.True(t, found)
+	assert.Equal(t, uint64(10), seq.Seq)
+
+	// A batch the client rejected is never responded to, so later batches don't advance progress past it
+	_ = tracker.batchSent(SequenceID{Seq: 20})
+	batch3 := tracker.batchSent(SequenceID{Seq: 30})
+	tracker.batchResponded(batch3)
+	seq, found = store.get(tracker.key)
+	assert.True(t, found)
+	assert.Equal(t, uint64(10), seq.Seq)
+
+	// A nil tracker is safe to use when progress isn't tracked
+	var nilTracker *initialSyncProgressTracker
+	nilTracker.revRequested(1, "doc1", "1-a")
+	nilTracker.revAcked("doc1", "1-a")
+	nilTracker.batchResponded(1)
+}
+
+// TestInitialSyncStoreExpiry ensures progress records aren't returned once their TTL has elapsed.
+func TestInitialSyncStoreExpiry(t *testing.T) {
+	assert.Nil(t, newInitialSyncStore(0))
+
+	store := newInitialSyncStore(time.Millisecond)
+	store.set("key", SequenceID{Seq: 5})
+	time.Sleep(5 * time.Millisecond)
+	_, found := store.get("key")
+	assert.False(t, found)
+}
+
+// TestInitialSyncStoreMaxEntries ensures a store full of live records evicts the record closest to expiry rather than
+// growing, and that updating an existing record doesn't evict another.
+func TestInitialSyncStoreMaxEntries(t *testing.T) {
+	store := newInitialSyncStore(time.Hour)
+	for i := 0; i < initialSyncProgressMaxEntries; i++ {
+		store.set(strconv.Itoa(i), SequenceID{Seq: uint64(i)})
+	}
+	assert.Len(t, store.entries, initialSyncProgressMaxEntries)
+
+	// Resetting the first record's TTL makes the second the closest to expiry
+	store.set("0", SequenceID{Seq: 100})
+	assert.Len(t, store.entries, initialSyncProgressMaxEntries)
+
+	store.set("new", SequenceID{Seq: 200})
+	assert.Len(t, store.entries, initialSyncProgressMaxEntries)
+	assert.Equal(t, initialSyncProgressMaxEntries, store.order.Len())
+	_, found := store.get("1")
+	assert.False(t, found, "The record closest to expiry should have been evicted")
+	seq, found := store.get("0")
+	assert.True(t, found)
+	assert.Equal(t, uint64(100), seq.Seq)
+	seq, found = store.get("new")
+	assert.True(t, found)
+	assert.Equal(t, uint64(200), seq.Seq)
+}
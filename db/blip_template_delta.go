@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultDeltaTemplateProperty is the default top-level body property identifying a document's type, used to pick
+// its delta template.
+const DefaultDeltaTemplateProperty = "type"
+
+// deltaTemplates holds the per-type base documents used for template deltas.  When a client that negotiated
+// template deltas has no revision of a document, the document's first rev is sent as a delta against the template
+// for its type, which the client applies to its own copy of the same template.  Templates are identified by
+// '<type>/<CRC-32C of the template's canonical JSON>', so that a client whose copy of a template differs can detect
+// it.
+type deltaTemplates struct {
+	typeProperty string
+	byType       map[string]deltaTemplate
+}
+
+type deltaTemplate struct {
+	id   string
+	body []byte // Canonical JSON, unmarshalled afresh for each delta so that the template can't be modified by diffing
+}
+
+// newDeltaTemplates returns the delta templates for the given type property, or nil if there are no templates.
+func newDeltaTemplates(typeProperty string, templates map[string]Body) (*deltaTemplates, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	if typeProperty == "" {
+		typeProperty = DefaultDeltaTemplateProperty
+	}
+	t := &deltaTemplates{
+		typeProperty: typeProperty,
+		byType:       make(map[string]deltaTemplate, len(templates)),
+	}
+	for docType, template := range templates {
+		body, err := base.JSONMarshalCanonical(template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delta template for type %q: %v", docType, err)
+		}
+		t.byType[docType] = deltaTemplate{
+			id:   docType + "/" + base.Crc32cHashString(body),
+			body: body,
+		}
+	}
+	return t, nil
+}
+
+// delta returns a delta in the given format from the template for the body's type to the body, along with the
+// template's ID.  Returns a nil delta if there's no template for the body's type, or if the delta isn't smaller than
+// the body.
+func (t *deltaTemplates) delta(bodyBytes []byte, format string) (delta []byte, templateID string, err error) {
+	var body map[string]interface{}
+	if err := base.JSONUnmarshal(bodyBytes, &body); err != nil {
+		return nil, "", err
+	}
+	docType, ok := body[t.typeProperty].(string)
+	if !ok {
+		return nil, "", nil
+	}
+	template, ok := t.byType[docType]
+	if !ok {
+		return nil, "", nil
+	}
+
+	var templateBody map[string]interface{}
+	if err := base.JSONUnmarshal(template.body, &templateBody); err != nil {
+		return nil, "", err
+	}
+	if format == DeltaFormatJSONPatch {
+		delta, err = base.JSONPatchDiff(templateBody, body)
+	} else {
+		delta, err = base.Diff(templateBody, body)
+	}
+	if err != nil || len(delta) >= len(bodyBytes) {
+		return nil, "", err
+	}
+	return delta, template.id, nil
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeltaTemplates verifies bodies are only diffed against the template for their type, and that the delta can be
+// applied to the template to recreate the body.
+func TestDeltaTemplates(t *testing.T) {
+	templates, err := newDeltaTemplates("", nil)
+	require.NoError(t, err)
+	assert.Nil(t, templates)
+
+	template := Body{
+		"type":        "order",
+		"status":      "new",
+		"description": strings.Repeat("a long boilerplate description ", 10),
+	}
+	templates, err = newDeltaTemplates("", map[string]Body{"order": template})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(templates.byType["order"].id, "order/0x"))
+
+	// No type, or no template for the type
+	delta, _, err := templates.delta([]byte(`{"status": "new"}`), DeltaFormatFleece)
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+	delta, _, err = templates.delta([]byte(`{"type": "invoice", "status": "new"}`), DeltaFormatFleece)
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	body := Body{
+		"type":        "order",
+		"status":      "shipped",
+		"description": template["description"],
+	}
+	bodyBytes, err := base.JSONMarshal(body)
+	require.NoError(t, err)
+	delta, templateID, err := templates.delta(bodyBytes, DeltaFormatFleece)
+	if !base.IsEnterpriseEdition() {
+		// Deltas aren't supported in CE
+		assert.Error(t, err)
+		return
+	}
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.Equal(t, templates.byType["order"].id, templateID)
+	assert.True(t, len(delta) < len(bodyBytes))
+
+	var deltaBody map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(delta, &deltaBody))
+	patched := map[string]interface{}(template.ShallowCopy())
+	require.NoError(t, base.Patch(&patched, deltaBody))
+	assert.Equal(t, "shipped", patched["status"])
+	assert.Equal(t, template["description"], patched["description"])
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A client catching up after a long time offline would otherwise be sent docs created and then deleted while it was
+// away as their creation, whose body it fetches, followed by their deletion.  A one-shot subChanges with the
+// 'tombstonesFirst' property asks for the net effect instead: a change for a live rev of a doc that's since been
+// deleted within the catch-up window (up to the last sequence when the subscription started) is sent as the doc's
+// tombstone, so that the intermediate body is never fetched.  The row keeps the live change's sequence, so that a
+// client checkpointing it never skips changes between it and the deletion.  When the feed later reaches the deletion
+// itself, the client already has the tombstone and doesn't fetch it again, while its checkpoint still advances.
+// Deletions after the window, and docs deleted and then recreated, are sent as they are.
+
+// netDeletion returns the change to send in place of a live change when the tombstonesFirst mode applies, i.e. the
+// doc's current rev is a tombstone written within the catch-up window, or nil when the change should be sent as it is.
+func (bh *blipHandler) netDeletion(change *ChangeEntry) *ChangeEntry {
+	if !bh.tombstonesFirst || change.Deleted || len(change.Changes) == 0 {
+		return nil
+	}
+	syncData, err := bh.db.GetDocSyncData(change.ID)
+	if err != nil {
+		base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Unable to read metadata of doc %s to check for a net deletion: %v", base.UD(change.ID), err)
+		return nil
+	}
+	if syncData.Flags&channels.Deleted == 0 || syncData.Sequence <= change.Seq.Seq || syncData.Sequence > bh.tombstoneWindowEnd {
+		return nil
+	}
+	if syncData.CurrentRev == change.Changes[0]["rev"] {
+		return nil
+	}
+	tombstone := *change
+	tombstone.Deleted = true
+	tombstone.Changes = []ChangeRev{{"rev": syncData.CurrentRev}}
+	base.DebugfCtx(bh.blipContextDb.Ctx, base.KeySync, "Sending tombstone %s of doc %s deleted at seq %d in place of its change at seq %v",
+		syncData.CurrentRev, base.UD(change.ID), syncData.Sequence, change.Seq)
+	bh.dbStats.StatsCblReplicationPull().Add(base.StatKeyTombstonesCollapsed, 1)
+	return &tombstone
+}
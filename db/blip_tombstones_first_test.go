@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNetDeletion verifies a live change for a doc deleted within the catch-up window is sent as its tombstone, while
+// docs deleted after the window, recreated docs and tombstones themselves are sent as they are.
+func TestNetDeletion(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	liveChange := func(docID string, revID string) *ChangeEntry {
+		syncData, err := db.GetDocSyncData(docID)
+		require.NoError(t, err)
+		return &ChangeEntry{Seq: SequenceID{Seq: syncData.Sequence}, ID: docID, Changes: []ChangeRev{{"rev": revID}}}
+	}
+
+	// Created then deleted
+	rev1, _, err := db.Put("deleted", Body{"key": "value"})
+	require.NoError(t, err)
+	deletedChange := liveChange("deleted", rev1)
+	tombstoneRev, err := db.DeleteDoc("deleted", rev1)
+	require.NoError(t, err)
+	deletedSyncData, err := db.GetDocSyncData("deleted")
+	require.NoError(t, err)
+
+	// Created, deleted, then recreated
+	rev1, _, err = db.Put("recreated", Body{"key": "value"})
+	require.NoError(t, err)
+	recreatedChange := liveChange("recreated", rev1)
+	rev2, err := db.DeleteDoc("recreated", rev1)
+	require.NoError(t, err)
+	_, _, err = db.Put("recreated", Body{"key": "again", BodyRev: rev2})
+	require.NoError(t, err)
+
+	bh := &blipHandler{BlipSyncContext: &BlipSyncContext{blipContextDb: db, dbStats: db.DbStats}, db: db}
+	assert.Nil(t, bh.netDeletion(deletedChange))
+
+	bh.tombstonesFirst = true
+	bh.tombstoneWindowEnd = deletedSyncData.Sequence - 1
+	assert.Nil(t, bh.netDeletion(deletedChange))
+
+	bh.tombstoneWindowEnd = deletedSyncData.Sequence + 100
+	tombstone := bh.netDeletion(deletedChange)
+	require.NotNil(t, tombstone)
+	assert.True(t, tombstone.Deleted)
+	assert.Equal(t, deletedChange.Seq, tombstone.Seq)
+	assert.Equal(t, []ChangeRev{{"rev": tombstoneRev}}, tombstone.Changes)
+	assert.False(t, deletedChange.Deleted)
+
+	assert.Nil(t, bh.netDeletion(tombstone))
+	assert.Nil(t, bh.netDeletion(recreatedChange))
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(db.DbStats.StatsCblReplicationPull().Get(base.StatKeyTombstonesCollapsed)))
+
+	// Sent as the tombstone, or not at all for an active-only subscription
+	rows := bh.changeRows(deletedChange)
+	require.Len(t, rows, 1)
+	assert.Equal(t, []interface{}{deletedChange.Seq, "deleted", tombstoneRev, true}, rows[0])
+	bh.activeOnly = true
+	assert.Empty(t, bh.changeRows(deletedChange))
+}
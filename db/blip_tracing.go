@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// ExtractTraceContext records the trace context the client propagated in the headers of its handshake request, so
+// that handler spans are part of the client's trace.  Must be called before the connection handles any requests.
+func (bsc *BlipSyncContext) ExtractTraceContext(headers http.Header) {
+	if tracer := bsc.blipContextDb.Options.BlipSyncOptions.Tracer; tracer != nil {
+		bsc.traceContext = tracer.Extract(context.Background(), headers)
+	}
+}
+
+// startHandlerSpan starts the span for a handler invocation, named after the request's profile.  Spans do nothing
+// when no tracer is configured.
+func (bsc *BlipSyncContext) startHandlerSpan(profile string, serialNumber uint64, rq *blip.Message) (context.Context, base.Span) {
+	tracer := bsc.blipContextDb.Options.BlipSyncOptions.Tracer
+	var attributes map[string]interface{}
+	if tracer != nil {
+		attributes = bsc.spanAttributes(serialNumber)
+		if docID, ok := rq.Properties[RevMessageId]; ok && profile == MessageRev {
+			attributes[base.SpanAttrDocID] = docID
+		}
+		if digest, ok := rq.Properties[GetAttachmentDigest]; ok && profile == MessageGetAttachment {
+			attributes[base.SpanAttrDigest] = digest
+		}
+	}
+	return base.StartSpan(tracer, bsc.traceContext, profile, attributes)
+}
+
+// startSpan starts a span for work done on behalf of the handler, as a child of the handler's span.
+func (bh *blipHandler) startSpan(name string) (context.Context, base.Span) {
+	return base.StartSpan(bh.db.Options.BlipSyncOptions.Tracer, bh.traceCtx, name, bh.spanAttributes(bh.serialNumber))
+}
+
+// startFeedSpan starts the span for a changes feed, which outlives the span of the subChanges handler that started it,
+// so is a child of the client's propagated trace context instead.
+func (bh *blipHandler) startFeedSpan(name string) (context.Context, base.Span) {
+	return base.StartSpan(bh.db.Options.BlipSyncOptions.Tracer, bh.traceContext, name, bh.spanAttributes(bh.serialNumber))
+}
+
+// spanAttributes returns the attributes common to all of the connection's spans.
+func (bsc *BlipSyncContext) spanAttributes(serialNumber uint64) map[string]interface{} {
+	attributes := map[string]interface{}{base.SpanAttrSerialNumber: serialNumber}
+	if logCtx, ok := bsc.blipContextDb.Ctx.Value(base.LogContextKey{}).(base.LogContext); ok {
+		attributes[base.SpanAttrCorrelationID] = logCtx.CorrelationID
+	}
+	return attributes
+}
@@ -461,6 +461,9 @@ func (c *changeCache) DocChanged(event sgbucket.FeedEvent) {
 		return // DCP is sending us an old value from before I started up; ignore it
 	}
 
+	// Deltas to earlier revs of the doc, including those written by other nodes, are superseded
+	c.context.deltaCache.invalidate(docID, syncData.CurrentRev)
+
 	// Measure feed latency from timeSaved or the time we started working the feed, whichever is later
 	var feedLatency time.Duration
 	if !syncData.TimeSaved.IsZero() {
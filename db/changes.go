@@ -26,18 +26,20 @@ import (
 // Options for changes-feeds.  ChangesOptions must not contain any mutable pointer references, as
 // changes processing currently assumes a deep copy when doing chanOpts := changesOptions.
 type ChangesOptions struct {
-	Since        SequenceID      // sequence # to start _after_
-	Limit        int             // Max number of changes to return, if nonzero
-	Conflicts    bool            // Show all conflicting revision IDs, not just winning one?
-	IncludeDocs  bool            // Include doc body of each change?
-	Wait         bool            // Wait for results, instead of immediately returning empty result?
-	Continuous   bool            // Run continuously until terminated?
-	Terminator   chan bool       // Caller can close this channel to terminate the feed
-	HeartbeatMs  uint64          // How often to send a heartbeat to the client
-	TimeoutMs    uint64          // After this amount of time, close the longpoll connection
-	ActiveOnly   bool            // If true, only return information on non-deleted, non-removed revisions
-	ClientIsCBL2 bool            // If the replication is being started from a CBL 2.x client
-	Ctx          context.Context // Used for adding context to logs
+	Since        SequenceID        // sequence # to start _after_
+	Limit        int               // Max number of changes to return, if nonzero
+	Conflicts    bool              // Show all conflicting revision IDs, not just winning one?
+	IncludeDocs  bool              // Include doc body of each change?
+	Wait         bool              // Wait for results, instead of immediately returning empty result?
+	Continuous   bool              // Run continuously until terminated?
+	Terminator   chan bool         // Caller can close this channel to terminate the feed
+	HeartbeatMs  uint64            // How often to send a heartbeat to the client
+	TimeoutMs    uint64            // After this amount of time, close the longpoll connection
+	ActiveOnly   bool              // If true, only return information on non-deleted, non-removed revisions
+	ClientIsCBL2 bool              // If the replication is being started from a CBL 2.x client
+	Ctx          context.Context   // Used for adding context to logs
+	ChannelSince map[string]uint64 // Per-channel sequences to start after, when later than Since.  Read-only, so safe to share between copies
+	MaxStaleness time.Duration     // How stale an index read to backfill the channel cache may be, if nonzero.  See singleChannelCacheImpl.staleQueryAllowed
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -54,6 +56,7 @@ type ChangeEntry struct {
 	branched     bool
 	backfill     backfillFlag // Flag used to identify non-client entries used for backfill synchronization (di only)
 	principalDoc bool         // Used to indicate _user/_role docs
+	channels     []string     // Channel feeds this entry was found on
 }
 
 const (
@@ -263,6 +266,7 @@ func makeChangeEntry(logEntry *LogEntry, seqID SequenceID, channelName string) C
 		Changes:      []ChangeRev{{"rev": logEntry.RevID}},
 		branched:     (logEntry.Flags & channels.Branched) != 0,
 		principalDoc: logEntry.IsPrincipal,
+		channels:     []string{channelName},
 	}
 
 	if logEntry.Flags&channels.Removed != 0 {
@@ -573,6 +577,9 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					chanOpts.Since = SequenceID{Seq: 0, TriggeredBy: seqAddedAt}
 				} else if backfillInOtherChannel {
 					chanOpts.Since = SequenceID{Seq: options.Since.TriggeredBy}
+				} else if channelSince := options.ChannelSince[name]; channelSince > chanOpts.Since.Seq && chanOpts.Since.TriggeredBy == 0 && chanOpts.Since.LowSeq == 0 {
+					// The client has already seen this channel's changes up to a later sequence than the feed's since
+					chanOpts.Since = SequenceID{Seq: channelSince}
 				}
 
 				feed := db.changesFeed(singleChannelCache, chanOpts, to)
@@ -646,6 +653,9 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 								minEntry.Removed = minEntry.Removed.Union(cur.Removed)
 							}
 						}
+						if cur != minEntry {
+							minEntry.channels = append(minEntry.channels, cur.channels...)
+						}
 					}
 				}
 
@@ -1062,6 +1072,17 @@ func generateBlipSyncChanges(database *Database, inChannels base.Set, options Ch
 	return err, forceClose
 }
 
+// filterChangesByDocID returns the entries for the docs in docIDs, reusing the given slice.
+func filterChangesByDocID(entries []*ChangeEntry, docIDs base.Set) []*ChangeEntry {
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if docIDs.Contains(entry.ID) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
 type ChangesSendErr struct{ error }
 
 // Shell of the continuous changes feed -- calls out to a `send` function to deliver the change.
@@ -1100,6 +1121,14 @@ func GenerateChanges(cancelCtx context.Context, database *Database, inChannels b
 	// feedStarted identifies whether at least one MultiChangesFeed has been started.  Used to identify when a one-shot changes is done.
 	feedStarted := false
 
+	// A continuous feed filtered by doc ID catches up with the docs' current revisions, as a one-shot feed would, then
+	// continues from the sequence the cache was at when it started, with the changes for the docs in the set, so a
+	// doc changed during the catch-up may be sent twice.  The set is held for the life of the feed, costing memory in
+	// proportion to the number and length of the doc IDs.
+	var docIDSet base.Set
+	var docIDCatchUpSeq SequenceID
+	docIDCaughtUp := false
+
 loop:
 	for {
 		// If the feed has already been started once and closed, and this isn't a continuous
@@ -1113,12 +1142,23 @@ loop:
 			if lastSeq.IsNonZero() { // start after end of last feed
 				options.Since = lastSeq
 			}
+			if docIDSet != nil && !docIDCaughtUp { // continue from where the doc ID catch-up started
+				options.Since = docIDCatchUpSeq
+				docIDCaughtUp = true
+			}
 			if database.IsClosed() {
 				forceClose = true
 				break loop
 			}
 			var feedErr error
-			if len(docIDFilter) > 0 {
+			if len(docIDFilter) > 0 && !feedStarted {
+				if options.Continuous {
+					docIDSet = base.SetFromArray(docIDFilter)
+					docIDCatchUpSeq = options.Since
+					if cachedSeq := database.changeCache.getChannelCache().GetHighCacheSequence(); docIDCatchUpSeq.Seq < cachedSeq {
+						docIDCatchUpSeq = SequenceID{Seq: cachedSeq}
+					}
+				}
 				feed, feedErr = database.DocIDChangesFeed(inChannels, docIDFilter, options)
 			} else {
 				feed, feedErr = database.MultiChangesFeed(inChannels, options)
@@ -1168,14 +1208,19 @@ loop:
 						break collect
 					}
 				}
-				base.TracefCtx(database.Ctx, base.KeyChanges, "sending %d change(s)", len(entries))
-				sendErr = send(entries)
+				lastSeq = entries[len(entries)-1].Seq
+				if docIDSet != nil {
+					entries = filterChangesByDocID(entries, docIDSet)
+				}
+				if len(entries) > 0 {
+					base.TracefCtx(database.Ctx, base.KeyChanges, "sending %d change(s)", len(entries))
+					sendErr = send(entries)
+				}
 
 				if sendErr == nil && waiting {
 					sendErr = send(nil)
 				}
 
-				lastSeq = entries[len(entries)-1].Seq
 				if options.Limit > 0 {
 					if len(entries) >= options.Limit {
 						forceClose = true
@@ -433,3 +433,42 @@ func BenchmarkChangesFeedDocUnmarshalling(b *testing.B) {
 	}
 
 }
+
+// TestChangesChannelSince verifies each channel's changes resume from its own checkpoint when one is given, and from
+// Since otherwise.
+func TestChangesChannelSince(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	cacheWaiter := db.NewDCPCachingCountWaiter(t)
+
+	_, _, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+	_, _, err = db.Put("doc2", Body{"channels": []string{"B"}})
+	require.NoError(t, err)
+	_, _, err = db.Put("doc3", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+	_, _, err = db.Put("doc4", Body{"channels": []string{"C"}})
+	require.NoError(t, err)
+	cacheWaiter.AddAndWait(4)
+
+	// A has been seen up to doc3 (sequence 3), and B up to doc1 (sequence 1), but C has no checkpoint
+	options := getZeroSequence()
+	options.ChannelSince = map[string]uint64{"A": 3, "B": 1}
+	changes, err := db.GetChanges(base.SetOf("A", "B", "C"), options)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "doc2", changes[0].ID)
+	assert.Equal(t, []string{"B"}, changes[0].channels)
+	assert.Equal(t, "doc4", changes[1].ID)
+
+	// Checkpoints earlier than Since are ignored
+	options = ChangesOptions{Since: SequenceID{Seq: 2}, ChannelSince: map[string]uint64{"A": 1}}
+	changes, err = db.GetChanges(base.SetOf("A", "B", "C"), options)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "doc3", changes[0].ID)
+	assert.Equal(t, "doc4", changes[1].ID)
+}
@@ -76,6 +76,18 @@ func nextChannelQueryEntry(results sgbucket.QueryResultIterator) (*LogEntry, boo
 // Queries the 'channels' view to get a range of sequences of a single channel as LogEntries.
 func (dbc *DatabaseContext) getChangesInChannelFromQuery(
 	channelName string, startSeq, endSeq uint64, limit int, activeOnly bool) (LogEntries, error) {
+	return dbc.queryChangesInChannel(channelName, startSeq, endSeq, limit, activeOnly, false)
+}
+
+// getChangesInChannelFromStaleQuery is like getChangesInChannelFromQuery, but doesn't wait for the view or index to
+// catch up with recent mutations, so may miss changes to the channel made shortly before the query.
+func (dbc *DatabaseContext) getChangesInChannelFromStaleQuery(
+	channelName string, startSeq, endSeq uint64, limit int, activeOnly bool) (LogEntries, error) {
+	return dbc.queryChangesInChannel(channelName, startSeq, endSeq, limit, activeOnly, true)
+}
+
+func (dbc *DatabaseContext) queryChangesInChannel(
+	channelName string, startSeq, endSeq uint64, limit int, activeOnly bool, stale bool) (LogEntries, error) {
 	if dbc.Bucket == nil {
 		return nil, errors.New("No bucket available for channel query")
 	}
@@ -85,7 +97,7 @@ func (dbc *DatabaseContext) getChangesInChannelFromQuery(
 	entries := make(LogEntries, 0)
 	activeEntryCount := 0
 
-	base.Infof(base.KeyCache, "  Querying 'channels' for %q (start=#%d, end=#%d, limit=%d)", base.UD(channelName), startSeq, endSeq, limit)
+	base.Infof(base.KeyCache, "  Querying 'channels' for %q (start=#%d, end=#%d, limit=%d, stale=%t)", base.UD(channelName), startSeq, endSeq, limit, stale)
 
 	// Loop for active-only and limit handling.
 	// The set of changes we get back from the query applies the limit, but includes both active and non-active entries.  When retrieving changes w/ activeOnly=true and a limit,
@@ -93,7 +105,7 @@ func (dbc *DatabaseContext) getChangesInChannelFromQuery(
 	for {
 
 		// Query the view or index
-		queryResults, err := dbc.QueryChannels(channelName, startSeq, endSeq, limit, activeOnly)
+		queryResults, err := dbc.queryChannels(channelName, startSeq, endSeq, limit, activeOnly, stale)
 		if err != nil {
 			return nil, err
 		}
@@ -64,6 +64,12 @@ type ChannelQueryHandler interface {
 	getChangesInChannelFromQuery(channelName string, startSeq, endSeq uint64, limit int, activeOnly bool) (LogEntries, error)
 }
 
+// staleChannelQueryHandler is implemented by query handlers that can also query without waiting for the index to
+// catch up with recent mutations.
+type staleChannelQueryHandler interface {
+	getChangesInChannelFromStaleQuery(channelName string, startSeq, endSeq uint64, limit int, activeOnly bool) (LogEntries, error)
+}
+
 type StableSequenceCallbackFunc func() uint64
 
 type channelCacheImpl struct {
@@ -406,15 +406,25 @@ func (c *singleChannelCacheImpl) GetChanges(options ChangesOptions) ([]*LogEntry
 	// overlap, which helps confirm that we've got everything.
 	c.statsMap.Add(base.StatKeyChannelCacheMisses, 1)
 	endSeq := cacheValidFrom
-	resultFromQuery, err := c.queryHandler.getChangesInChannelFromQuery(c.channelName, startSeq, endSeq, options.Limit, options.ActiveOnly)
+	var resultFromQuery LogEntries
+	var err error
+	staleHandler, canQueryStale := c.queryHandler.(staleChannelQueryHandler)
+	staleQuery := canQueryStale && c.staleQueryAllowed(options, resultFromCache)
+	if staleQuery {
+		c.statsMap.Add(base.StatKeyChannelCacheStaleQueries, 1)
+		resultFromQuery, err = staleHandler.getChangesInChannelFromStaleQuery(c.channelName, startSeq, endSeq, options.Limit, options.ActiveOnly)
+	} else {
+		resultFromQuery, err = c.queryHandler.getChangesInChannelFromQuery(c.channelName, startSeq, endSeq, options.Limit, options.ActiveOnly)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Cache some of the query results, if there's room in the cache.  If query hit the limit,
 	// the query results are only valid for the range of sequences in the result set.
-	// Don't cache when active_only=true since query results aren't complete.
-	if options.ActiveOnly != true {
+	// Don't cache when active_only=true since query results aren't complete, or when the query was stale, since
+	// other feeds may not tolerate its staleness.
+	if options.ActiveOnly != true && !staleQuery {
 		resultValidTo := endSeq
 		numResults := len(resultFromQuery)
 		if options.Limit != 0 && numResults >= options.Limit {
@@ -443,6 +453,19 @@ func (c *singleChannelCacheImpl) GetChanges(options ChangesOptions) ([]*LogEntry
 	return result, nil
 }
 
+// staleQueryAllowed returns true when a feed tolerating options.MaxStaleness may backfill the cache with a query that
+// doesn't wait for the index to catch up.  The cache itself is fed by the mutation feed, so is never stale - only the
+// backfill of sequences older than the cache's validFrom is affected.  Every sequence being backfilled is older than
+// the earliest cached change, so when that change was cached more than MaxStaleness ago, an index that's no more than
+// MaxStaleness behind has already indexed everything being backfilled.  Otherwise, or when nothing's cached to tell,
+// the query is consistent.
+func (c *singleChannelCacheImpl) staleQueryAllowed(options ChangesOptions, resultFromCache []*LogEntry) bool {
+	if options.MaxStaleness <= 0 || len(resultFromCache) == 0 {
+		return false
+	}
+	return time.Since(resultFromCache[0].TimeReceived) >= options.MaxStaleness
+}
+
 //////// LOGENTRIES:
 
 func (c *singleChannelCacheImpl) _adjustFirstSeq(change *LogEntry) {
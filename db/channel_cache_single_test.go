@@ -627,6 +627,63 @@ func TestBypassSingleChannelCache(t *testing.T) {
 	require.Len(t, cachedEntries, 0)
 }
 
+// testStaleQueryHandler is a testQueryHandler that also supports stale queries, counting them.
+type testStaleQueryHandler struct {
+	testQueryHandler
+	staleQueryCount int
+}
+
+func (qh *testStaleQueryHandler) getChangesInChannelFromStaleQuery(channelName string, startSeq, endSeq uint64, limit int, activeOnly bool) (LogEntries, error) {
+	qh.staleQueryCount++
+	return qh.getChangesInChannelFromQuery(channelName, startSeq, endSeq, limit, activeOnly)
+}
+
+// Validates that a backfill query is only stale when the feed tolerates staleness, and the earliest cached change was
+// cached longer ago than it tolerates, and that stale query results aren't added to the cache.
+func TestSingleChannelCacheStaleQuery(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	queryHandler := &testStaleQueryHandler{}
+	for seq := 1; seq <= 10; seq++ {
+		queryHandler.seedEntries(LogEntries{testLogEntryForChannels(seq, []string{"chan"})})
+	}
+	testStats := &expvar.Map{}
+	cache := newSingleChannelCache(queryHandler, "chan", 10, testStats)
+	cachedEntry := testLogEntryForChannels(10, []string{"chan"})
+	cache.addToCache(cachedEntry, false)
+
+	// Without a tolerance, the query is consistent
+	entries, err := cache.GetChanges(ChangesOptions{Since: SequenceID{Seq: 5}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.Equal(t, 0, queryHandler.staleQueryCount)
+	assert.Equal(t, 1, queryHandler.queryCount)
+
+	// Reset the cache, which the consistent query backfilled
+	cache = newSingleChannelCache(queryHandler, "chan", 10, testStats)
+	cache.addToCache(cachedEntry, false)
+
+	// The earliest cached change was cached within the tolerance, so the query is consistent
+	_, err = cache.GetChanges(ChangesOptions{Since: SequenceID{Seq: 5}, MaxStaleness: time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, 0, queryHandler.staleQueryCount)
+	assert.Equal(t, 2, queryHandler.queryCount)
+
+	// The earliest cached change was cached longer ago than the tolerance, so the query is stale
+	cache = newSingleChannelCache(queryHandler, "chan", 10, testStats)
+	cachedEntry.TimeReceived = time.Now().Add(-time.Hour)
+	cache.addToCache(cachedEntry, false)
+	entries, err = cache.GetChanges(ChangesOptions{Since: SequenceID{Seq: 5}, MaxStaleness: time.Minute})
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.Equal(t, 1, queryHandler.staleQueryCount)
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(testStats.Get(base.StatKeyChannelCacheStaleQueries)))
+
+	// Stale results weren't added to the cache
+	validFrom, _ := cache.GetCachedChanges(ChangesOptions{Since: SequenceID{Seq: 5}})
+	assert.Equal(t, uint64(10), validFrom)
+}
+
 func BenchmarkChannelCacheUniqueDocs_Ordered(b *testing.B) {
 
 	defer base.DisableTestLogging()()
@@ -11,6 +11,7 @@ package db
 
 import (
 	"bytes"
+	"expvar"
 	"math"
 	"net/http"
 	"strings"
@@ -173,6 +174,34 @@ func (db *DatabaseContext) GetDocSyncData(docid string) (SyncData, error) {
 
 }
 
+// getCurrentRevBodySize returns a doc's current rev and the size of its body as stored, without unmarshalling the body
+// or most of the sync metadata.  Only possible when sync metadata is stored in an xattr, apart from the body, and the
+// doc was last written by Sync Gateway; found is false otherwise.
+func (db *DatabaseContext) getCurrentRevBodySize(docid string) (revID string, size int, found bool, err error) {
+	key := realDocID(docid)
+	if key == "" {
+		return "", 0, false, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+	if !db.UseXattrs() {
+		return "", 0, false, nil
+	}
+
+	var rawDoc, rawXattr []byte
+	cas, err := db.Bucket.GetWithXattr(key, base.SyncXattrName, &rawDoc, &rawXattr)
+	if err != nil {
+		return "", 0, false, err
+	}
+	doc, err := unmarshalDocumentWithXattr(docid, nil, rawXattr, cas, DocUnmarshalRev)
+	if err != nil {
+		return "", 0, false, err
+	}
+	// A doc written since by another client hasn't been imported yet, so its metadata doesn't describe its body
+	if doc.Cas != doc.SyncData.GetSyncCas() {
+		return "", 0, false, nil
+	}
+	return doc.CurrentRev, len(rawDoc), true, nil
+}
+
 // OnDemandImportForGet.  Attempts to import the doc based on the provided id, contents and cas.  ImportDocRaw does cas retry handling
 // if the document gets updated after the initial retrieval attempt that triggered this.
 func (db *DatabaseContext) OnDemandImportForGet(docid string, rawDoc []byte, rawXattr []byte, cas uint64) (docOut *Document, err error) {
@@ -289,6 +318,13 @@ func (db *Database) getRev(docid, revid string, maxHistory int, historyFrom []st
 // GetDelta attempts to return the delta between fromRevId and toRevId.  If the delta can't be generated,
 // returns nil.
 func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionDelta, redactedRev *DocumentRevision, err error) {
+	return db.GetDeltaInFormat(docID, fromRevID, toRevID, DeltaFormatFleece)
+}
+
+// GetDeltaInFormat is like GetDelta, but generates the delta in the given format.  Only deltas in the default
+// format are cached in the revision cache, so that a client using another format doesn't evict deltas cached for
+// Couchbase Lite clients.  Deltas in any format are shared between clients through the delta cache, when enabled.
+func (db *Database) GetDeltaInFormat(docID, fromRevID, toRevID string, format string) (delta *RevisionDelta, redactedRev *DocumentRevision, err error) {
 
 	if docID == "" || fromRevID == "" || toRevID == "" {
 		return nil, nil, nil
@@ -302,7 +338,7 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 	}
 
 	// If delta is found, check whether it is a delta for the toRevID we want
-	if fromRevision.Delta != nil {
+	if fromRevision.Delta != nil && format == DeltaFormatFleece {
 		if fromRevision.Delta.ToRevID == toRevID {
 
 			isAuthorized, redactedBody := db.authorizeUserForChannels(docID, toRevID, fromRevision.Delta.ToChannels, fromRevision.Delta.ToDeleted, encodeRevisions(fromRevision.Delta.RevisionHistory))
@@ -322,6 +358,15 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 	// Delta is unavailable, but the body is available.
 	if fromRevision.BodyBytes != nil {
 
+		// A delta computed for another client may be in the delta cache
+		if cachedDelta := db.deltaCache.get(docID, fromRevID, toRevID, format); cachedDelta != nil {
+			isAuthorized, redactedBody := db.authorizeUserForChannels(docID, toRevID, cachedDelta.ToChannels, cachedDelta.ToDeleted, encodeRevisions(cachedDelta.RevisionHistory))
+			if !isAuthorized {
+				return nil, &redactedBody, nil
+			}
+			return cachedDelta, nil, nil
+		}
+
 		db.DbStats.StatsDeltaSync().Add(base.StatKeyDeltaCacheMisses, 1)
 		toRevision, err := db.revisionCache.Get(docID, toRevID, RevCacheOmitBody, RevCacheIncludeDelta)
 		if err != nil {
@@ -336,8 +381,14 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 
 		// If the revision we're generating a delta to is a tombstone, mark it as such and don't bother generating a delta
 		if deleted {
+			if format == DeltaFormatJSONPatch {
+				revCacheDelta := newRevCacheDelta([]byte(emptyJSONPatch), fromRevID, toRevision, deleted)
+				db.deltaCache.put(docID, fromRevID, format, &revCacheDelta)
+				return &revCacheDelta, nil, nil
+			}
 			revCacheDelta := newRevCacheDelta([]byte(base.EmptyDocument), fromRevID, toRevision, deleted)
 			db.revisionCache.UpdateDelta(docID, fromRevID, revCacheDelta)
+			db.deltaCache.put(docID, fromRevID, format, &revCacheDelta)
 			return &revCacheDelta, nil, nil
 		}
 
@@ -353,6 +404,10 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 			return nil, nil, err
 		}
 
+		// Diff canonical numbers, so that the delta doesn't carry number formatting clients may apply differently
+		canonicalizeNumbers(fromBodyCopy)
+		canonicalizeNumbers(toBodyCopy)
+
 		// If attachments have changed between these revisions, we'll stamp the metadata into the bodies before diffing
 		// so that the resulting delta also contains attachment metadata changes
 		if fromRevision.Attachments != nil {
@@ -364,14 +419,25 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 			toBodyCopy[BodyAttachments] = map[string]interface{}(toRevision.Attachments)
 		}
 
+		if format == DeltaFormatJSONPatch {
+			deltaBytes, err := base.JSONPatchDiff(fromBodyCopy, toBodyCopy)
+			if err != nil {
+				return nil, nil, err
+			}
+			revCacheDelta := newRevCacheDelta(deltaBytes, fromRevID, toRevision, deleted)
+			db.deltaCache.put(docID, fromRevID, format, &revCacheDelta)
+			return &revCacheDelta, nil, nil
+		}
+
 		deltaBytes, err := base.Diff(fromBodyCopy, toBodyCopy)
 		if err != nil {
 			return nil, nil, err
 		}
 		revCacheDelta := newRevCacheDelta(deltaBytes, fromRevID, toRevision, deleted)
 
-		// Write the newly calculated delta back into the cache before returning
+		// Write the newly calculated delta back into the caches before returning
 		db.revisionCache.UpdateDelta(docID, fromRevID, revCacheDelta)
+		db.deltaCache.put(docID, fromRevID, format, &revCacheDelta)
 		return &revCacheDelta, nil, nil
 	}
 
@@ -712,7 +778,7 @@ func (db *Database) backupAncestorRevs(doc *Document, newDoc *Document) {
 	for {
 		if ancestorRevId = doc.History.getParent(ancestorRevId); ancestorRevId == "" {
 			// No ancestors with JSON found.  Check if we need to back up current rev for delta sync, then return
-			db.backupRevisionJSON(doc.ID, newDoc.RevID, "", newBodyBytes, nil, doc.Attachments)
+			db.backupRevisionJSON(doc.ID, newDoc.RevID, "", newBodyBytes, nil, doc.Attachments, newDoc.Deleted)
 			return
 		} else if json = doc.getRevisionBodyJSON(ancestorRevId, db.RevisionBodyLoader); json != nil {
 			break
@@ -720,7 +786,7 @@ func (db *Database) backupAncestorRevs(doc *Document, newDoc *Document) {
 	}
 
 	// Back up the revision JSON as a separate doc in the bucket:
-	db.backupRevisionJSON(doc.ID, newDoc.RevID, ancestorRevId, newBodyBytes, json, doc.Attachments)
+	db.backupRevisionJSON(doc.ID, newDoc.RevID, ancestorRevId, newBodyBytes, json, doc.Attachments, newDoc.Deleted)
 
 	// Nil out the ancestor rev's body in the document struct:
 	if ancestorRevId == doc.CurrentRev {
@@ -867,6 +933,10 @@ func (db *Database) Put(docid string, body Body) (newRevID string, doc *Document
 
 		// move _attachment metadata to syncdata of doc after rev-id generation
 		doc.SyncData.Attachments = newDoc.DocAttachments
+		doc.SyncData.ReplicationPath = nil
+		if len(newDoc.nodePath) > 0 {
+			doc.SyncData.ReplicationPath = &ReplicationPath{Rev: newRev, Nodes: newDoc.nodePath}
+		}
 		newDoc.RevID = newRev
 		newDoc.Deleted = deleted
 
@@ -878,6 +948,84 @@ func (db *Database) Put(docid string, body Body) (newRevID string, doc *Document
 
 // Adds an existing revision to a document along with its history (list of rev IDs.)
 func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConflicts bool) (doc *Document, newRevID string, err error) {
+	return db.putExistingRev(newDoc, docHistory, noConflicts, nil)
+}
+
+// ErrDocumentExists is returned by PutExistingRevIfAbsent when the document already exists.
+type ErrDocumentExists struct {
+	CurrentRevID string
+}
+
+func (e *ErrDocumentExists) Error() string {
+	return "Document already exists with revision " + e.CurrentRevID
+}
+
+// Cause allows ErrDocumentExists to be reported as a 409 Conflict.
+func (e *ErrDocumentExists) Cause() error {
+	return base.HTTPErrorf(http.StatusConflict, "%s", e.Error())
+}
+
+// ErrRevisionMismatch is returned by PutExistingRevIfMatch when the document's current revision isn't the expected one.
+type ErrRevisionMismatch struct {
+	ExpectedRevID string
+	CurrentRevID  string
+}
+
+func (e *ErrRevisionMismatch) Error() string {
+	if e.CurrentRevID == "" {
+		return "Document doesn't exist, expected revision " + e.ExpectedRevID
+	}
+	return "Document's current revision is " + e.CurrentRevID + ", expected " + e.ExpectedRevID
+}
+
+// Cause allows ErrRevisionMismatch to be reported as a 409 Conflict.
+func (e *ErrRevisionMismatch) Cause() error {
+	return base.HTTPErrorf(http.StatusConflict, "%s", e.Error())
+}
+
+// ErrChannelsMismatch is returned when the sync function assigns a new revision channels other than those the
+// writer expected it to be assigned.
+type ErrChannelsMismatch struct {
+	Channels base.Set // The channels the sync function assigned
+}
+
+func (e *ErrChannelsMismatch) Error() string {
+	return "Sync function assigned the revision to channels " + e.Channels.String() + ", not the expected channels"
+}
+
+// Cause allows ErrChannelsMismatch to be reported as a 412 Precondition Failed.
+func (e *ErrChannelsMismatch) Cause() error {
+	return base.HTTPErrorf(http.StatusPreconditionFailed, "%s", e.Error())
+}
+
+// PutExistingRevIfAbsent is like PutExistingRev, but only writes the revision if the document doesn't already
+// exist, returning ErrDocumentExists otherwise.  A tombstoned document is treated as absent unless
+// tombstoneExists is true.
+func (db *Database) PutExistingRevIfAbsent(newDoc *Document, docHistory []string, noConflicts bool, tombstoneExists bool) (doc *Document, newRevID string, err error) {
+	return db.putExistingRev(newDoc, docHistory, noConflicts, func(doc *Document) error {
+		if doc.CurrentRev == "" || (doc.IsDeleted() && !tombstoneExists) {
+			return nil
+		}
+		return &ErrDocumentExists{CurrentRevID: doc.CurrentRev}
+	})
+}
+
+// PutExistingRevIfMatch is like PutExistingRev, but only writes the revision if the document's current revision is
+// ifMatch, returning ErrRevisionMismatch otherwise.  The check is made against the document being updated, so it's
+// atomic with the write, and is made regardless of whether the revision's history would otherwise be accepted.  A
+// retried write finding the revision is already current succeeds, without writing anything.
+func (db *Database) PutExistingRevIfMatch(newDoc *Document, docHistory []string, noConflicts bool, ifMatch string) (doc *Document, newRevID string, err error) {
+	return db.putExistingRev(newDoc, docHistory, noConflicts, func(doc *Document) error {
+		if doc.CurrentRev != ifMatch && doc.CurrentRev != docHistory[0] {
+			return &ErrRevisionMismatch{ExpectedRevID: ifMatch, CurrentRevID: doc.CurrentRev}
+		}
+		return nil
+	})
+}
+
+// putExistingRev adds an existing revision to a document.  When non-nil, precondition is called with the
+// current document before it's updated, and the update is abandoned if it returns an error.
+func (db *Database) putExistingRev(newDoc *Document, docHistory []string, noConflicts bool, precondition func(doc *Document) error) (doc *Document, newRevID string, err error) {
 	newRev := docHistory[0]
 	generation, _ := ParseRevID(newRev)
 	if generation < 0 {
@@ -907,6 +1055,12 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 			}
 		}
 
+		if precondition != nil {
+			if err := precondition(doc); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
 		// Find the point where this doc's history branches from the current rev:
 		currentRevIndex := len(docHistory)
 		parent := ""
@@ -955,6 +1109,10 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 		return newDoc, newAttachments, nil, nil
 	})
 
+	if err == nil && db.orphanRevs != nil {
+		db.orphanRevs.revWritten(newDoc.ID)
+	}
+
 	return doc, newRev, err
 }
 
@@ -1305,6 +1463,11 @@ func (db *Database) documentUpdateFunc(docExists bool, doc *Document, allowImpor
 		return
 	}
 
+	if newDoc.expectChannels != nil && !newDoc.expectChannels.Equals(channelSet) {
+		err = &ErrChannelsMismatch{Channels: channelSet}
+		return
+	}
+
 	if len(channelSet) > 0 {
 		doc.History[newRevID].Channels = channelSet
 	}
@@ -1527,6 +1690,7 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 			_shallowCopyBody: storedDoc.Body(),
 		}
 		db.revisionCache.Put(documentRevision)
+		db.deltaCache.invalidate(docid, newRevID)
 		if db.EventMgr.HasHandlerForEvent(DocumentChange) {
 			webhookJSON, err := doc.BodyWithSpecialProperties()
 			if err != nil {
@@ -1694,7 +1858,9 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 		output, err = db.ChannelMapper.MapToChannelsAndAccess(body, oldJson,
 			makeUserCtx(db.user))
 
-		db.DbStats.CblReplicationPush().Add(base.StatKeySyncFunctionTime, time.Since(startTime).Nanoseconds())
+		syncFnTime := time.Since(startTime)
+		db.DbStats.CblReplicationPush().Add(base.StatKeySyncFunctionTime, syncFnTime.Nanoseconds())
+		base.AddToDurationHistogram(db.DbStats.CblReplicationPush().Get(base.StatKeySyncFnTimeHistogram).(*expvar.Map), syncFnTime)
 
 		if err == nil {
 			result = output.Channels
@@ -1713,6 +1879,10 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 				err = base.HTTPErrorf(500, "Error in JS sync function")
 			}
 
+		} else if err == channels.ErrSyncFnTimeout {
+			base.WarnfCtx(db.Ctx, "Sync fn exceeded its time limit of %v for doc %q / %q", db.Options.SyncFnTimeout, base.UD(doc.ID), base.UD(doc.NewestRev))
+			db.DbStats.CblReplicationPush().Add(base.StatKeySyncFnTimeoutCount, 1)
+			err = base.HTTPErrorf(http.StatusUnprocessableEntity, "Sync function exceeded its time limit")
 		} else {
 			base.WarnfCtx(db.Ctx, "Sync fn exception: %+v; doc = %s", err, base.UD(body))
 			err = base.HTTPErrorf(500, "Exception in JS sync function")
@@ -1861,8 +2031,55 @@ func (db *Database) RevDiff(docid string, revids []string) (missing, possible []
 		return // Users can't upload design docs, so ignore them
 	}
 
-	var history RevTree
+	history, found := db.getRevDiffHistory(docid)
+	if !found {
+		missing = revids
+		return
+	}
+	return revTreeDiff(history, revids)
+}
 
+// RevDiffResult is the result of RevDiff for one change of a RevDiffMany batch.
+type RevDiffResult struct {
+	Missing  []string // The change's rev, if it's not known
+	Possible []string // Known revisions that might be recent ancestors of a missing rev
+}
+
+// RevDiffMany is like RevDiff for a batch of changes, each a single revision of a document, returning a result for
+// each change in order.  The rev trees of the changes' documents are read in one pass, with a single bulk get when
+// the sync metadata isn't in xattrs, instead of one read per change.
+func (db *Database) RevDiffMany(changes []IDAndRev) []RevDiffResult {
+	docIDs := make([]string, 0, len(changes))
+	seenDocIDs := make(base.Set, len(changes))
+	for _, change := range changes {
+		if strings.HasPrefix(change.DocID, "_design/") && db.user != nil {
+			continue // Users can't upload design docs, so ignore them
+		}
+		if !seenDocIDs.Contains(change.DocID) {
+			seenDocIDs.Add(change.DocID)
+			docIDs = append(docIDs, change.DocID)
+		}
+	}
+	histories := db.getRevDiffHistories(docIDs)
+
+	results := make([]RevDiffResult, len(changes))
+	for i, change := range changes {
+		if !seenDocIDs.Contains(change.DocID) {
+			continue
+		}
+		revids := []string{change.RevID}
+		if history, found := histories[change.DocID]; found {
+			results[i].Missing, results[i].Possible = revTreeDiff(history, revids)
+		} else {
+			results[i].Missing = revids
+		}
+	}
+	return results
+}
+
+// getRevDiffHistory returns the rev tree of a document for RevDiff, or false if the document doesn't exist or
+// can't be read.
+func (db *Database) getRevDiffHistory(docid string) (history RevTree, found bool) {
 	if db.UseXattrs() {
 		var xattrValue []byte
 		cas, err := db.Bucket.GetXattr(docid, base.SyncXattrName, &xattrValue)
@@ -1871,29 +2088,74 @@ func (db *Database) RevDiff(docid string, revids []string) (missing, possible []
 			if !base.IsDocNotFoundError(err) {
 				base.WarnfCtx(db.Ctx, "RevDiff(%q) --> %T %v", base.UD(docid), err, err)
 			}
-			missing = revids
-			return
+			return nil, false
 		}
 		doc, err := unmarshalDocumentWithXattr(docid, nil, xattrValue, cas, DocUnmarshalSync)
 		if err != nil {
 			base.ErrorfCtx(db.Ctx, "RevDiff(%q) Doc Unmarshal Failed: %T %v", base.UD(docid), err, err)
 		}
-		history = doc.History
-	} else {
-		doc, err := db.GetDocument(docid, DocUnmarshalSync)
-		if err != nil {
-			if !base.IsDocNotFoundError(err) {
-				base.WarnfCtx(db.Ctx, "RevDiff(%q) --> %T %v", base.UD(docid), err, err)
-				// If something goes wrong getting the doc, treat it as though it's nonexistent.
+		return doc.History, true
+	}
+
+	doc, err := db.GetDocument(docid, DocUnmarshalSync)
+	if err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.WarnfCtx(db.Ctx, "RevDiff(%q) --> %T %v", base.UD(docid), err, err)
+			// If something goes wrong getting the doc, treat it as though it's nonexistent.
+		}
+		return nil, false
+	}
+	return doc.History, true
+}
+
+// getRevDiffHistories returns the rev trees of the documents that exist, keyed by doc ID.  There's no bulk get for
+// xattrs, so when the sync metadata is in xattrs, each document is read in turn.
+func (db *Database) getRevDiffHistories(docids []string) map[string]RevTree {
+	histories := make(map[string]RevTree, len(docids))
+	if db.UseXattrs() || len(docids) == 0 {
+		for _, docid := range docids {
+			if history, found := db.getRevDiffHistory(docid); found {
+				histories[docid] = history
 			}
-			missing = revids
-			return
 		}
-		history = doc.History
+		return histories
 	}
 
+	keys := make([]string, 0, len(docids))
+	for _, docid := range docids {
+		if key := realDocID(docid); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	rawDocs, err := db.Bucket.GetBulkRaw(keys)
+	if err != nil {
+		base.WarnfCtx(db.Ctx, "RevDiff bulk get of %d docs failed, reading them in turn: %v", len(keys), err)
+		rawDocs = nil
+	}
+	for _, docid := range docids {
+		rawDoc, found := rawDocs[docid]
+		if !found && rawDocs != nil {
+			continue
+		}
+		if found {
+			syncData, err := UnmarshalDocumentSyncData(rawDoc, true)
+			if err == nil && syncData != nil && syncData.HasValidSyncData() {
+				histories[docid] = syncData.History
+				continue
+			}
+		}
+		// Read the doc individually when the bulk get failed, or its sync data needs to be checked for an upgrade
+		if history, found := db.getRevDiffHistory(docid); found {
+			histories[docid] = history
+		}
+	}
+	return histories
+}
+
+// revTreeDiff returns which of the revisions aren't in the rev tree, and known revisions that might be their recent
+// ancestors.
+func revTreeDiff(revtree RevTree, revids []string) (missing, possible []string) {
 	// Check each revid to see if it's in the doc's rev tree:
-	revtree := history
 	revidsSet := base.SetFromArray(revids)
 	possibleSet := make(map[string]bool)
 	for _, revid := range revids {
@@ -1938,21 +2200,124 @@ const (
 // Given a docID/revID to be pushed by a client, check whether it can be added _without conflict_.
 // This is used by the BLIP replication code in "allow_conflicts=false" mode.
 func (db *Database) CheckProposedRev(docid string, revid string, parentRevID string) ProposedRevStatus {
+	syncData, err := db.getProposedRevSyncData(docid)
+	if err != nil {
+		return ProposedRev_Error
+	}
+	return proposedRevStatus(syncData, revid, parentRevID)
+}
+
+// ProposedRev is a revision a client proposes to push, for CheckProposedRevs.
+type ProposedRev struct {
+	DocID       string
+	RevID       string
+	ParentRevID string // The rev's parent, or "" if it's a first rev
+}
+
+// CheckProposedRevs is like CheckProposedRev for a batch of proposed revs, returning a status for each in order.  The
+// current state of the proposed revs' documents is read in one pass, with a single bulk get when the sync metadata
+// isn't in xattrs, instead of one read per proposed rev.
+func (db *Database) CheckProposedRevs(proposals []ProposedRev) []ProposedRevStatus {
+	docIDs := make([]string, 0, len(proposals))
+	seenDocIDs := make(base.Set, len(proposals))
+	for _, proposal := range proposals {
+		if !seenDocIDs.Contains(proposal.DocID) {
+			seenDocIDs.Add(proposal.DocID)
+			docIDs = append(docIDs, proposal.DocID)
+		}
+	}
+	syncData, failedDocIDs := db.getProposedRevsSyncData(docIDs)
+
+	statuses := make([]ProposedRevStatus, len(proposals))
+	for i, proposal := range proposals {
+		if failedDocIDs.Contains(proposal.DocID) {
+			statuses[i] = ProposedRev_Error
+			continue
+		}
+		statuses[i] = proposedRevStatus(syncData[proposal.DocID], proposal.RevID, proposal.ParentRevID)
+	}
+	return statuses
+}
+
+// getProposedRevSyncData returns the sync metadata of a proposed rev's document, or nil if the document doesn't
+// exist.
+func (db *Database) getProposedRevSyncData(docid string) (*SyncData, error) {
 	doc, err := db.GetDocument(docid, DocUnmarshalAll)
 	if err != nil {
 		if !base.IsDocNotFoundError(err) {
 			base.WarnfCtx(db.Ctx, "CheckProposedRev(%q) --> %T %v", base.UD(docid), err, err)
-			return ProposedRev_Error
+			return nil, err
+		}
+		return nil, nil
+	}
+	return &doc.SyncData, nil
+}
+
+// getProposedRevsSyncData returns the sync metadata of the proposed revs' documents that exist, keyed by doc ID,
+// along with the doc IDs of the documents that couldn't be read.  There's no bulk get for xattrs, so when the sync
+// metadata is in xattrs, each document is read in turn.
+func (db *Database) getProposedRevsSyncData(docids []string) (syncData map[string]*SyncData, failedDocIDs base.Set) {
+	syncData = make(map[string]*SyncData, len(docids))
+	failedDocIDs = base.Set{}
+	readDoc := func(docid string) {
+		docSyncData, err := db.getProposedRevSyncData(docid)
+		if err != nil {
+			failedDocIDs.Add(docid)
+		} else if docSyncData != nil {
+			syncData[docid] = docSyncData
 		}
+	}
+
+	if db.UseXattrs() || len(docids) == 0 {
+		for _, docid := range docids {
+			readDoc(docid)
+		}
+		return syncData, failedDocIDs
+	}
+
+	keys := make([]string, 0, len(docids))
+	for _, docid := range docids {
+		if key := realDocID(docid); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	rawDocs, err := db.Bucket.GetBulkRaw(keys)
+	if err != nil {
+		base.WarnfCtx(db.Ctx, "CheckProposedRevs bulk get of %d docs failed, reading them in turn: %v", len(keys), err)
+		rawDocs = nil
+	}
+	for _, docid := range docids {
+		rawDoc, found := rawDocs[docid]
+		if !found && rawDocs != nil && realDocID(docid) != "" {
+			continue // Doc doesn't exist
+		}
+		if found {
+			docSyncData, err := UnmarshalDocumentSyncData(rawDoc, true)
+			if err == nil && docSyncData != nil && docSyncData.HasValidSyncData() {
+				syncData[docid] = docSyncData
+				continue
+			}
+		}
+		// Read the doc individually when the bulk get failed, its ID is invalid, or its sync data needs to be checked
+		// for an upgrade
+		readDoc(docid)
+	}
+	return syncData, failedDocIDs
+}
+
+// proposedRevStatus returns whether a proposed rev can be added to a document with the given sync metadata, or nil
+// if the document doesn't exist, without conflict.
+func proposedRevStatus(syncData *SyncData, revid string, parentRevID string) ProposedRevStatus {
+	if syncData == nil {
 		// Doc doesn't exist locally; adding it is OK (even if it has a history)
 		return ProposedRev_OK
-	} else if doc.CurrentRev == revid {
+	} else if syncData.CurrentRev == revid {
 		// Proposed rev already exists here:
 		return ProposedRev_Exists
-	} else if doc.CurrentRev == parentRevID {
+	} else if syncData.CurrentRev == parentRevID {
 		// Proposed rev's parent is my current revision; OK to add:
 		return ProposedRev_OK
-	} else if parentRevID == "" && doc.History[doc.CurrentRev].Deleted {
+	} else if parentRevID == "" && syncData.History[syncData.CurrentRev].Deleted {
 		// Proposed rev has no parent and doc is currently deleted; OK to add:
 		return ProposedRev_OK
 	} else {
@@ -2,6 +2,7 @@ package db
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"testing"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/couchbase/sync_gateway/channels"
 	goassert "github.com/couchbaselabs/go.assert"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type treeDoc struct {
@@ -1348,3 +1350,194 @@ func TestMergeAttachments(t *testing.T) {
 		})
 	}
 }
+
+// TestGetDeltaInFormat verifies deltas in each format can be applied to the source revision to recreate the target.
+func TestGetDeltaInFormat(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev1ID, _, err := db.Put("doc1", Body{"greeting": "hello", "nested": map[string]interface{}{"a": 1.0, "b": 2.0}})
+	require.NoError(t, err)
+	rev2ID, _, err := db.Put("doc1", Body{BodyRev: rev1ID, "greeting": "hi", "nested": map[string]interface{}{"a": 1.0}})
+	require.NoError(t, err)
+
+	formats := []string{DeltaFormatJSONPatch}
+	if base.IsEnterpriseEdition() {
+		formats = append(formats, DeltaFormatFleece)
+	}
+	for _, format := range formats {
+		t.Run(format, func(t *testing.T) {
+			delta, redactedRev, err := db.GetDeltaInFormat("doc1", rev1ID, rev2ID, format)
+			require.NoError(t, err)
+			require.Nil(t, redactedRev)
+			require.NotNil(t, delta)
+			assert.Equal(t, rev2ID, delta.ToRevID)
+
+			patched := map[string]interface{}{"greeting": "hello", "nested": map[string]interface{}{"a": 1.0, "b": 2.0}}
+			if format == DeltaFormatJSONPatch {
+				patched, err = base.JSONPatchApply(patched, delta.DeltaBytes)
+				require.NoError(t, err)
+			} else {
+				var deltaBody map[string]interface{}
+				require.NoError(t, base.JSONUnmarshal(delta.DeltaBytes, &deltaBody))
+				require.NoError(t, base.Patch(&patched, deltaBody))
+			}
+			assert.Equal(t, map[string]interface{}{"greeting": "hi", "nested": map[string]interface{}{"a": 1.0}}, patched)
+		})
+	}
+}
+
+// TestGetDeltaTombstoneTransitions verifies deltas between live revs and tombstones: a soft delete made by the app is
+// an ordinary delta, a delta to a tombstone is just the deletion marker, and a delta from a tombstone resurrects the
+// doc.
+func TestGetDeltaTombstoneTransitions(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev1ID, _, err := db.Put("doc1", Body{"greeting": "hello"})
+	require.NoError(t, err)
+	rev2ID, _, err := db.Put("doc1", Body{BodyRev: rev1ID, "greeting": "hello", "softDeleted": true})
+	require.NoError(t, err)
+	rev3ID, err := db.DeleteDoc("doc1", rev2ID)
+	require.NoError(t, err)
+	rev4ID, _, err := db.Put("doc1", Body{BodyRev: rev3ID, "greeting": "hi"})
+	require.NoError(t, err)
+
+	delta, _, err := db.GetDeltaInFormat("doc1", rev1ID, rev2ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.False(t, delta.ToDeleted)
+	assert.Equal(t, `[{"op":"add","path":"/softDeleted","value":true}]`, string(delta.DeltaBytes))
+
+	delta, _, err = db.GetDeltaInFormat("doc1", rev2ID, rev3ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.True(t, delta.ToDeleted)
+	assert.Equal(t, emptyJSONPatch, string(delta.DeltaBytes))
+
+	delta, _, err = db.GetDeltaInFormat("doc1", rev3ID, rev4ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.False(t, delta.ToDeleted)
+	assert.Equal(t, []string{rev3ID}, delta.RevisionHistory)
+	patched, err := base.JSONPatchApply(map[string]interface{}{}, delta.DeltaBytes)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"greeting": "hi"}, patched)
+}
+
+// TestRevDiffMany verifies that a batch of changes gets the same results as RevDiff gives for each change.
+func TestRevDiffMany(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev1ID, _, err := db.Put("doc1", Body{"greeting": "hello"})
+	require.NoError(t, err)
+	rev2ID, _, err := db.Put("doc1", Body{BodyRev: rev1ID, "greeting": "hi"})
+	require.NoError(t, err)
+	otherRevID, _, err := db.Put("doc2", Body{"greeting": "hey"})
+	require.NoError(t, err)
+
+	changes := []IDAndRev{
+		{DocID: "doc1", RevID: rev2ID},
+		{DocID: "doc1", RevID: "3-abc"},
+		{DocID: "doc2", RevID: otherRevID},
+		{DocID: "doc2", RevID: "1-abc"},
+		{DocID: "nosuchdoc", RevID: "1-abc"},
+		{DocID: "_sync:doc", RevID: "1-abc"},
+	}
+	results := db.RevDiffMany(changes)
+	require.Len(t, results, len(changes))
+	for i, change := range changes {
+		missing, possible := db.RevDiff(change.DocID, []string{change.RevID})
+		assert.Equal(t, missing, results[i].Missing, "Unexpected missing revs for %v", change)
+		assert.Equal(t, possible, results[i].Possible, "Unexpected possible revs for %v", change)
+	}
+	assert.Nil(t, results[0].Missing)
+	assert.Equal(t, []string{"3-abc"}, results[1].Missing)
+	assert.Equal(t, []string{rev2ID}, results[1].Possible)
+	assert.Equal(t, []string{"1-abc"}, results[4].Missing)
+
+	// Users can't push design docs, so they're never missing
+	user, err := db.Authenticator().NewUser("alice", "letmein", nil)
+	require.NoError(t, err)
+	db.user = user
+	results = db.RevDiffMany([]IDAndRev{{DocID: "_design/foo", RevID: "1-abc"}})
+	assert.Equal(t, []RevDiffResult{{}}, results)
+}
+
+// BenchmarkRevDiffMany compares diffing the revs of a large changes message in one batch with diffing each in turn.
+func BenchmarkRevDiffMany(b *testing.B) {
+	defer base.DisableTestLogging()()
+
+	db, testBucket := setupTestDB(b)
+	defer testBucket.Close()
+	defer db.Close()
+
+	const numChanges = 10000
+	changes := make([]IDAndRev, numChanges)
+	for i := range changes {
+		docID := fmt.Sprintf("doc%d", i)
+		changes[i] = IDAndRev{DocID: docID, RevID: "2-abc"}
+		// Half the changes are to docs that exist
+		if i%2 == 0 {
+			if _, _, err := db.Put(docID, Body{"value": i}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("RevDiff", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, change := range changes {
+				_, _ = db.RevDiff(change.DocID, []string{change.RevID})
+			}
+		}
+	})
+	b.Run("RevDiffMany", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_ = db.RevDiffMany(changes)
+		}
+	})
+}
+
+// TestCheckProposedRevs verifies that a batch of proposed revs gets the same statuses as CheckProposedRev gives for
+// each proposed rev.
+func TestCheckProposedRevs(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev1ID, _, err := db.Put("doc1", Body{"greeting": "hello"})
+	require.NoError(t, err)
+	deletedRev1ID, _, err := db.Put("deleted", Body{"greeting": "hello"})
+	require.NoError(t, err)
+	_, err = db.DeleteDoc("deleted", deletedRev1ID)
+	require.NoError(t, err)
+
+	proposals := []ProposedRev{
+		{DocID: "doc1", RevID: rev1ID},
+		{DocID: "doc1", RevID: "2-abc", ParentRevID: rev1ID},
+		{DocID: "doc1", RevID: "2-abc", ParentRevID: "1-abc"},
+		{DocID: "doc1", RevID: "1-abc"},
+		{DocID: "deleted", RevID: "1-abc"},
+		{DocID: "nosuchdoc", RevID: "1-abc"},
+		{DocID: "_sync:doc", RevID: "1-abc"},
+	}
+	statuses := db.CheckProposedRevs(proposals)
+	require.Len(t, statuses, len(proposals))
+	for i, proposal := range proposals {
+		assert.Equal(t, db.CheckProposedRev(proposal.DocID, proposal.RevID, proposal.ParentRevID), statuses[i], "Unexpected status for %v", proposal)
+	}
+	assert.Equal(t, []ProposedRevStatus{
+		ProposedRev_Exists,
+		ProposedRev_OK,
+		ProposedRev_Conflict,
+		ProposedRev_Conflict,
+		ProposedRev_OK,
+		ProposedRev_OK,
+		ProposedRev_Error,
+	}, statuses)
+}
@@ -61,6 +61,36 @@ const (
 var (
 	DefaultDeltaSyncEnabled   = false
 	DefaultDeltaSyncRevMaxAge = uint32(60 * 60 * 24) // 24 hours in seconds
+	DefaultDeltaCacheSize     = 1000
+	DefaultMaxDeltaRatio      = 0.8 // A delta must save at least 20% of the body to be sent
+)
+
+// Delta formats.  Clients choose the format of deltas they're sent with the subChanges 'deltaFormat' property, and
+// mark the format of deltas they push with the rev 'deltaFormat' property.
+const (
+	DeltaFormatFleece    = "fleece"     // Couchbase Lite's delta format, the default
+	DeltaFormatJSONPatch = "json-patch" // RFC 6902 JSON Patch
+
+	emptyJSONPatch = "[]"
+)
+
+// parseDeltaFormat validates a client-supplied delta format, defaulting to DeltaFormatFleece.
+func parseDeltaFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return DeltaFormatFleece, nil
+	case DeltaFormatFleece, DeltaFormatJSONPatch:
+		return format, nil
+	default:
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Unknown delta format %q - try %s or %s", format, DeltaFormatFleece, DeltaFormatJSONPatch)
+	}
+}
+
+// Default values for BLIP sync
+var (
+	DefaultInitialSyncProgressTTL = 5 * time.Minute
+	DefaultMaxRequestDeadline     = 2 * time.Minute
+	DefaultIdempotencyKeyTTL      = 10 * time.Minute
 )
 
 var DefaultCompactInterval = uint32(60 * 60 * 24) // Default compact interval in seconds = 1 Day
@@ -103,12 +133,28 @@ type DatabaseContext struct {
 	CfgSG              *base.CfgSG              // Sync Gateway cluster shared config
 	SGReplicateMgr     *sgReplicateManager      // Manages interactions with sg-replicate replications
 	Heartbeater        base.Heartbeater         // Node heartbeater for SG cluster awareness
+	initialSyncStore   *initialSyncStore        // Best-effort progress of interrupted initial pulls, keyed by user and session
+	admission          *admissionController     // Rejects new replication work while bucket operations are slow, when enabled
+	idempotencyStore   *idempotencyStore        // Results of recently pushed revs with idempotency keys, keyed by user and key
+	orphanRevs         *orphanRevBuffer         // Pushed revs waiting for their parents to be written, when enabled
+	compactionJobs     compactionTracker        // The most recent compaction started over BLIP, for getCompactionStatus
+	deltaTemplates     *deltaTemplates          // Per-type templates for template deltas, when configured
+	attachmentLoads    *attachmentCoalescer     // Shares attachment loads between concurrent getAttachment requests, when enabled
+	attachmentRefs     *attachmentRefTracker    // Attachments replication has seen dropped, as garbage collection candidates, when enabled
+	namedFilters       map[string]*namedFilter  // Change filters clients may subscribe to by name, keyed by name
+	purgeJobs          purgeJobStore            // Purges clients are working through with purgeBatch requests, keyed by token
+	docSummaries       *docSummarizer           // Computes the summaries sent to clients that pull summaries, when configured
+	deliveryLogs       *deliveryLogStore        // Revs recently delivered to clients, keyed by user and session, when enabled
+	health             *healthMonitor           // Samples handler stats for the replication health
+	channelDocsSent    *channelDocsSent         // Counts the docs sent to pulls from the heaviest channels, when enabled
+	deltaCache         *deltaCache              // Computed deltas shared between pulls, when enabled
 }
 
 type DatabaseContextOptions struct {
 	CacheOptions              *CacheOptions
 	RevisionCacheOptions      *RevisionCacheOptions
 	OldRevExpirySeconds       uint32
+	TombstoneRetentionSecs    uint32 // How long a deleted doc's last body is kept, and its tombstone flagged as recoverable to BLIP clients that ask
 	AdminInterface            *string
 	UnsupportedOptions        UnsupportedOptions
 	OIDCOptions               *auth.OIDCOptions
@@ -125,6 +171,10 @@ type DatabaseContextOptions struct {
 	DeltaSyncOptions          DeltaSyncOptions // Delta Sync Options
 	CompactInterval           uint32           // Interval in seconds between compaction is automatically ran - 0 means don't run
 	SgReplicateEnabled        bool             // Whether this node can be assigned sg-replicate replications
+	BlipSyncOptions           BlipSyncOptions  // BLIP sync (Couchbase Lite replication) options
+	SyncFnTimeout             time.Duration    // How long the sync function may run for a write before it's interrupted and the write rejected.  0 is unlimited
+	NamedFilters              NamedFilters     // Change filters BLIP clients may subscribe to by name, with a named/<name> subChanges filter
+	DocSummaries              *DocSummaries    // Summaries BLIP clients may pull in place of full bodies.  Nil disables summaries
 }
 
 type OidcTestProviderOptions struct {
@@ -136,8 +186,78 @@ type UserViewsOptions struct {
 }
 
 type DeltaSyncOptions struct {
-	Enabled          bool   // Whether delta sync is enabled (EE only)
-	RevMaxAgeSeconds uint32 // The number of seconds deltas for old revs are available for
+	Enabled          bool            // Whether delta sync is enabled (EE only)
+	RevMaxAgeSeconds uint32          // The number of seconds deltas for old revs are available for
+	Templates        map[string]Body // Per-type base documents that first revs are sent as deltas against, keyed by type
+	TemplateProperty string          // Top-level body property identifying a doc's type for template deltas
+	CacheSize        int             // Max computed deltas shared between pulls in the delta cache.  0 disables
+	MaxDeltaRatio    float64         // Max size of a delta sent to a client, relative to the full body it replaces.  0 sends any delta
+}
+
+// BlipSyncOptions are the options that apply to BLIP sync connections (Couchbase Lite replication).  Zero values
+// retain the default replication behaviour.
+type BlipSyncOptions struct {
+	InitialSyncProgressTTL        time.Duration // How long server-side progress of an interrupted initial pull is retained.  0 disables progress tracking
+	DeniedChannels                base.Set      // Channels that are never replicated over BLIP, regardless of user access
+	MaxRequestDeadline            time.Duration // Upper bound for client-supplied request deadlines.  0 ignores client deadlines
+	AllowEmptyChannelSubscription bool          // Accept a continuous bychannel subChanges whose channel list is empty, instead of returning an error.  It follows the channels the user is later granted
+	RevSendLogSize                int           // Number of recent rev send decisions retained per connection for diagnostics.  0 disables
+	IfAbsentRejectsTombstones     bool          // Whether a tombstoned document counts as existing for an ifAbsent rev
+	MaxPossibleAncestors          int           // Max possible ancestors returned per change in a changes response.  0 is unlimited
+	AdmissionLatencyThreshold     time.Duration // Bucket operation latency above which new subChanges and rev requests are rejected.  0 disables
+	AdmissionRetryAfter           time.Duration // Retry-After hint given to requests rejected by admission control
+	RevQueueSize                  int           // Max pushed revs queued per connection for writing in priority order.  0 writes revs as they arrive
+	MaxSortedChanges              int           // Max changes buffered in memory for a sorted one-shot pull.  0 disables sortBy
+	IdempotencyKeyTTL             time.Duration // How long the result of a rev pushed with an idempotency key is retained.  0 disables
+	OrphanRevTimeout              time.Duration // How long a rev pushed ahead of its parent waits for the parent to be written.  0 rejects it immediately
+	OrphanRevBufferSize           int           // Max revs waiting for their parents at once.  0 uses DefaultOrphanRevBufferSize
+	MaxChangesPerMessage          int           // Max changes listed in a changes or proposeChanges message, beyond which it's rejected.  0 is unlimited
+	MaxRevGeneration              int           // Max generation of a pushed revision, beyond which it's rejected.  0 is unlimited
+	DeltaFailureThreshold         int           // Consecutive failures to apply a doc's pushed deltas before the connection's deltas are disabled.  0 disables
+	DeltaFailureCooldown          time.Duration // How long a connection's deltas stay disabled.  0 uses DefaultDeltaFailureCooldown
+	CursorTokenSecret             string        // Key used to sign cursor tokens sent in changes rows.  Empty disables cursor tokens
+	RevChannelAssignment          bool          // Whether pushed revs may ask for their assigned channels, and declare the channels they expect
+	AttachmentRetries             int           // Times a getAttachment request the client fails with a 5xx error is retried.  0 disables
+	AttachmentRetryBackoff        time.Duration // Wait before the first attachment download retry, doubled for each subsequent retry.  0 uses DefaultAttachmentRetryBackoff
+	AttachmentDigestMapper        DigestMapper  // Maps the digest of an attachment a client references to the digest it's stored under, e.g. during a store migration.  Nil for identity
+	ReferenceField                string        // Top-level body property holding the doc IDs a doc references, for dependencyOrder pulls.  Empty disables dependencyOrder
+	MaxConnectionLifetime         time.Duration // How long a connection may stay open before it's closed, forcing the client to reconnect and re-authenticate.  0 is unlimited
+	CoalescedAttachments          int           // Max distinct attachment loads shared between concurrent getAttachment requests at once.  0 disables
+	Tracer                        base.Tracer   // Starts spans around handler execution, for distributed tracing.  Nil disables
+	AttachmentGC                  bool          // Whether attachments dropped by pushed revs are tracked as candidates for collectAttachments
+	MaxStaleness                  time.Duration // Max staleness a subChanges request's maxStaleness may tolerate; larger values are clamped.  0 disables
+	MinKeepaliveInterval          time.Duration // Shortest interval a client may negotiate keepalives on its idle feed at.  0 disables keepalives
+	MaxRevocations                int           // Max docs listed in the revoked message sent when a user loses access to channels.  0 disables revocations
+	MaxJSONDepth                  int           // Max nesting depth of objects and arrays in a pushed rev's body, beyond which it's rejected.  0 is unlimited
+	AttachmentAuthorizer          AttAuthorizer // Denies users individual attachments of docs they can access.  Nil allows every attachment of an accessible doc
+	AllowUserPurge                bool          // Whether users may purge docs they can access with purgeBatch.  Admins always may
+	MinTLSVersion                 uint16        // Min TLS version of a connection that may replicate documents.  0 allows connections without TLS
+	AllowedCipherSuites           []uint16      // TLS cipher suites a connection that may replicate documents must use.  Empty allows any
+	RequireClientCert             bool          // Whether only connections with a verified client certificate may replicate documents
+	ConnectionInspector           ConnInspector // Returns the security of a connection, e.g. from headers set by a TLS-terminating proxy.  Nil inspects the connection's own TLS state
+	ReservedFields                string        // Policy for reserved properties in a pushed rev's body: ReservedFieldsReject, ReservedFieldsStrip, or empty for the write's own validation
+	MaxPushDocs                   int           // Max distinct docs a connection may push revs for in a push session, beyond which revs for new docs are rejected.  0 is unlimited
+	PushDocWindow                 time.Duration // How long a push session lasts before its docs are forgotten.  0 lasts the connection's lifetime
+	AttachmentRepeatPolicy        string        // Policy for a connection's repeated requests for an attachment: AttachmentRepeatCache, AttachmentRepeatLimit, or empty to serve them as usual
+	AttachmentRepeatWindow        time.Duration // How long an attachment served on a connection counts towards repeats.  0 uses DefaultAttachmentRepeatWindow
+	AttachmentRepeatLimit         int           // Times the limit policy serves an attachment per window.  0 uses DefaultAttachmentRepeatLimit
+	AttachmentRepeatCacheBytes    int           // Most attachment data the cache policy keeps per connection.  0 uses DefaultAttachmentRepeatCacheBytes
+	ProgressMilestoneDocs         int           // Docs sent to a pull between its progress milestones.  0 disables docs milestones
+	ProgressMilestonePercent      int           // Percentage of a pull's estimated initial sync between its progress milestones.  0 disables percent milestones
+	MaxMultiplexedDatabases       int           // Max other databases a connection to this database may multiplex over it.  0 disables multiplexing
+	ReplicationNodeID             string        // Identifies this database to other Sync Gateways it replicates with, for loop detection.  Empty disables loop detection
+	ReplicationNodeRole           string        // Role allowing a user to announce a replication node, as other Sync Gateways do.  Empty only allows admin connections
+	SequenceBarrierTimeout        time.Duration // Max time a subChanges request waits for the change cache to reach its waitForSequence.  0 uses DefaultSequenceBarrierTimeout
+	DeliveryLogRetention          time.Duration // How long the revs delivered to a client with a session are remembered after its last delivery, to skip on reconnect.  0 disables
+	DeliveryLogSize               int           // Docs whose delivered revs are remembered per client.  0 uses DefaultDeliveryLogSize
+	DocIDMapper                   DocIDMapper   // Maps stored doc IDs to the IDs clients replicate them as, and back.  nil replicates docs under their stored IDs
+	HealthMaxActiveFeeds          int           // Active pull feeds at which replication is reported unhealthy.  0 excludes active feeds from the health
+	HealthMaxInFlight             int           // In-flight BLIP requests at which replication is reported unhealthy.  0 excludes in-flight requests from the health
+	MaxChangesBatchSize           int           // Largest batch size a subChanges request may ask for; larger ones are clamped.  0 uses DefaultMaxChangesBatchSize
+	ChannelDocsSentStats          bool          // Whether the docs sent to pulls from the heaviest channels are counted, in the channel_docs_sent stat
+	SHA256Attachments             bool          // Whether connections that ask for sha256 attachment digests use them, rather than sha1
+	MaxAttachmentSize             int64         // Max size in bytes of an attachment pushed or fetched over BLIP, beyond which it's rejected with a 413.  0 is unlimited
+	MaxInFlightChangeBatches      int           // Max changes batches per subscription awaiting the client's response before sending pauses.  0 is unlimited
 }
 
 type APIEndpoints struct {
@@ -260,6 +380,37 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	dbContext.EventMgr = NewEventManager()
 
 	var err error
+	dbContext.deltaTemplates, err = newDeltaTemplates(options.DeltaSyncOptions.TemplateProperty, options.DeltaSyncOptions.Templates)
+	if err != nil {
+		return nil, err
+	}
+	dbContext.deltaCache = newDeltaCache(options.DeltaSyncOptions.CacheSize,
+		dbContext.DbStats.StatsDeltaSync().Get(base.StatKeyDeltaLRUCacheHits).(*expvar.Int),
+		dbContext.DbStats.StatsDeltaSync().Get(base.StatKeyDeltaLRUCacheMisses).(*expvar.Int))
+	dbContext.namedFilters, err = newNamedFilters(options.NamedFilters)
+	if err != nil {
+		return nil, err
+	}
+	dbContext.docSummaries, err = newDocSummarizer(options.DocSummaries)
+	if err != nil {
+		return nil, err
+	}
+
+	dbContext.initialSyncStore = newInitialSyncStore(options.BlipSyncOptions.InitialSyncProgressTTL)
+	dbContext.idempotencyStore = newIdempotencyStore(options.BlipSyncOptions.IdempotencyKeyTTL)
+	dbContext.deliveryLogs = newDeliveryLogStore(options.BlipSyncOptions.DeliveryLogRetention, options.BlipSyncOptions.DeliveryLogSize)
+	dbContext.orphanRevs = newOrphanRevBuffer(options.BlipSyncOptions.OrphanRevTimeout, options.BlipSyncOptions.OrphanRevBufferSize)
+	dbContext.attachmentLoads = newAttachmentCoalescer(options.BlipSyncOptions.CoalescedAttachments)
+	dbContext.attachmentRefs = newAttachmentRefTracker(options.BlipSyncOptions.AttachmentGC,
+		dbContext.DbStats.StatsDatabase().Get(base.StatKeyAttGCCandidates).(*expvar.Int),
+		dbContext.DbStats.StatsDatabase().Get(base.StatKeyAttGCDeletedCount).(*expvar.Int))
+	dbContext.admission = newAdmissionController(options.BlipSyncOptions.AdmissionLatencyThreshold, options.BlipSyncOptions.AdmissionRetryAfter, dbContext.DbStats)
+	dbContext.health = newHealthMonitor(options.BlipSyncOptions, dbContext.DbStats)
+	dbContext.channelDocsSent = newChannelDocsSent(options.BlipSyncOptions.ChannelDocsSentStats, maxChannelDocsSentTracked)
+	if dbContext.channelDocsSent != nil {
+		dbContext.DbStats.StatsCblReplicationPull().Set(base.StatKeyPullChannelDocsSent, dbContext.channelDocsSent)
+	}
+
 	dbContext.sequences, err = newSequenceAllocator(bucket, dbStats.StatsDatabase())
 	if err != nil {
 		return nil, err
@@ -837,6 +988,12 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 // removal of the document from the index.  In the event that the document has already been purged by server, we need to recreate and delete
 // the document to accomplish the same result.
 func (db *Database) Compact() (int, error) {
+	return db.compact(nil)
+}
+
+// compact purges tombstones as for Compact, calling onBatch (when non-nil) with the number of tombstones purged by
+// each batch so that progress can be reported.
+func (db *Database) compact(onBatch func(count int)) (int, error) {
 	if !atomic.CompareAndSwapUint32(&db.CompactState, DBCompactNotRunning, DBCompactRunning) {
 		return 0, base.HTTPErrorf(http.StatusServiceUnavailable, "Compaction already running")
 	}
@@ -897,6 +1054,9 @@ func (db *Database) Compact() (int, error) {
 		// Now purge them from all channel caches
 		count := len(purgedDocs)
 		purgedDocCount += count
+		if onBatch != nil {
+			onBatch(count)
+		}
 		if count > 0 {
 			db.changeCache.Remove(purgedDocs, startTime)
 			db.DbStats.StatsDatabase().Add(base.StatKeyNumTombstonesCompacted, int64(count))
@@ -931,6 +1091,7 @@ func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err
 		_, err = context.ChannelMapper.SetFunction(syncFun)
 	} else {
 		context.ChannelMapper = channels.NewChannelMapper(syncFun)
+		context.ChannelMapper.SetTimeout(context.Options.SyncFnTimeout)
 	}
 	if err != nil {
 		base.Warnf("Error setting sync function: %s", err)
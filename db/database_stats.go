@@ -141,6 +141,7 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyChannelCacheCompactCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyChannelCacheCompactTime, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyChannelCacheBypassCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChannelCacheStaleQueries, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyActiveChannels, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyNumSkippedSeqs, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyAbandonedSeqs, base.ExpvarIntVal(0))
@@ -174,6 +175,22 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyCachingDcpStats, new(expvar.Map).Init())
 		result.Set(base.StatKeyImportDcpStats, new(expvar.Map).Init())
 		result.Set(base.StatKeyHighSeqFeed, new(base.IntMax))
+		result.Set(base.StatKeyAdmissionThrottled, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAdmissionRejectCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyMaxLifetimeCloseCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttGCCandidates, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttGCDeletedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyReconcileCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyReconcileDiscrepancies, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttAccessDenied, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyPurgeBatchDocs, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySecurityRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyMultiplexedConnections, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyMultiplexedMessages, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyReplicationLoops, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyBlipRequestCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyBlipRequestErrors, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyBlipInFlight, base.ExpvarIntVal(0))
 		d.statsDatabaseMap = result
 	case base.StatsGroupKeyDeltaSync:
 		result.Set(base.StatKeyDeltasRequested, base.ExpvarIntVal(0))
@@ -182,6 +199,16 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyDeltaCacheHits, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyDeltaCacheMisses, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyDeltaPushDocCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyTemplateDeltasSent, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyTemplateDeltaFallbacks, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyJSONPatchDeltasSent, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyJSONPatchDeltaPushCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeltasDisabledConns, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAmbiguousDeltaFallbacks, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAmbiguousDeltaRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeltaLRUCacheHits, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeltaLRUCacheMisses, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeltasWastedFallback, base.ExpvarIntVal(0))
 		d.statsDeltaSyncMap = result
 	case base.StatsGroupKeySharedBucketImport:
 		result.Set(base.StatKeyImportCount, base.ExpvarIntVal(0))
@@ -196,11 +223,34 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyWriteProcessingTime, base.ExpvarIntVal(0))
 		result.Set(base.StatKeySyncFunctionCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeySyncFunctionTime, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySyncFnTimeHistogram, new(expvar.Map))
+		result.Set(base.StatKeySyncFnTimeoutCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyProposeChangeCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyProposeChangeTime, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyAttachmentPushCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyAttachmentPushBytes, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyConflictWriteCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAncestorsTruncated, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevQueueDepth, new(expvar.Map).Init())
+		result.Set(base.StatKeyRevReplayCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyOrphanRevsBuffered, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyOrphanRevsTimedOut, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevGenRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyProofBatchCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttCompressedPush, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttUploadBytesSaved, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevChannelMismatch, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttDownloadRetries, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttDigestMismatch, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictRejectCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictServerWins, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictClientWins, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyProposeStreamCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevDepthRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyReservedRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyReservedStripped, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyPushDocsTracked, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyPushDocsRejected, base.ExpvarIntVal(0))
 		d.cblReplicationPush = result
 	case base.StatsGroupKeyCblReplicationPull:
 		result.Set(base.StatKeyPullReplicationsActiveContinuous, base.ExpvarIntVal(0))
@@ -217,6 +267,42 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyMaxPending, new(base.IntMax))
 		result.Set(base.StatKeyAttachmentPullCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyAttachmentPullBytes, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeniedChannelChangesSuppressed, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevResendCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevResendAbandonedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevChecksumMismatchCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRecoverableTombstoneCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyCheckpointMismatchCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDependencyCycleCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttCoalescedPullCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttCoalescedBytesSaved, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttCompressedPull, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttPullBytesSaved, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyNoAttachmentsSkipped, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyCaughtUpConnections, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyKeepaliveSentCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyHeartbeatSentCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChangesPacingDelay, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChangesBatchesInFlight, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevChunkedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevChunksSent, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChangesFlushCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevSummariesSent, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevSummaryCacheHits, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttRepeatCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttRepeatRejected, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttRepeatCacheHits, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyAttRepeatCacheMisses, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyProgressMilestones, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyTombstonesCollapsed, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDocSizeSkipped, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceBarrierWaits, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceBarrierTimeouts, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyDeliveryLogSkipped, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySubscriptionsExpired, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyRevokedDocsSent, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyExcludedChannelChanges, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyNamedFilterUses, new(expvar.Map))
 		d.cblReplicationPull = result
 	case base.StatsGroupKeySecurity:
 		result.Set(base.StatKeyNumDocsRejected, base.ExpvarIntVal(0))
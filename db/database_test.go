@@ -15,6 +15,7 @@ import (
 	"expvar"
 	"fmt"
 	"log"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -230,6 +231,79 @@ func TestDatabase(t *testing.T) {
 
 }
 
+// Validates that PutExistingRevIfAbsent only writes when the document doesn't exist, optionally treating a
+// tombstone as absent.
+func TestPutExistingRevIfAbsent(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	newDoc := func(docID, revID string) *Document {
+		doc := &Document{ID: docID, RevID: revID}
+		doc.UpdateBody(Body{"key1": 1234})
+		return doc
+	}
+
+	// Absent doc is written
+	_, _, err := db.PutExistingRevIfAbsent(newDoc("doc1", "1-a"), []string{"1-a"}, true, false)
+	assert.NoError(t, err)
+
+	// Existing doc is rejected with a 409, reporting the current revision
+	_, _, err = db.PutExistingRevIfAbsent(newDoc("doc1", "2-b"), []string{"2-b", "1-a"}, true, false)
+	existsErr, ok := err.(*ErrDocumentExists)
+	require.True(t, ok, "Expected ErrDocumentExists, got %v", err)
+	assert.Equal(t, "1-a", existsErr.CurrentRevID)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusConflict, status)
+
+	// Tombstoned doc is only treated as absent when tombstones don't count as existing
+	rev2ID, err := db.DeleteDoc("doc1", "1-a")
+	assert.NoError(t, err)
+	_, _, err = db.PutExistingRevIfAbsent(newDoc("doc1", "3-c"), []string{"3-c", rev2ID}, true, true)
+	_, ok = err.(*ErrDocumentExists)
+	assert.True(t, ok, "Expected ErrDocumentExists, got %v", err)
+	_, _, err = db.PutExistingRevIfAbsent(newDoc("doc1", "3-c"), []string{"3-c", rev2ID}, true, false)
+	assert.NoError(t, err)
+}
+
+// Validates that PutExistingRevIfMatch only writes when the document's current revision is the expected one.
+func TestPutExistingRevIfMatch(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	newDoc := func(docID, revID string) *Document {
+		doc := &Document{ID: docID, RevID: revID}
+		doc.UpdateBody(Body{"key1": 1234})
+		return doc
+	}
+
+	// Absent doc doesn't match
+	_, _, err := db.PutExistingRevIfMatch(newDoc("doc1", "2-b"), []string{"2-b", "1-a"}, false, "1-a")
+	mismatchErr, ok := err.(*ErrRevisionMismatch)
+	require.True(t, ok, "Expected ErrRevisionMismatch, got %v", err)
+	assert.Equal(t, "", mismatchErr.CurrentRevID)
+
+	_, _, err = db.PutExistingRev(newDoc("doc1", "1-a"), []string{"1-a"}, false)
+	require.NoError(t, err)
+	_, _, err = db.PutExistingRevIfMatch(newDoc("doc1", "2-b"), []string{"2-b", "1-a"}, false, "1-a")
+	assert.NoError(t, err)
+
+	// A conflicting branch would be accepted by PutExistingRev, but the current revision doesn't match
+	_, _, err = db.PutExistingRevIfMatch(newDoc("doc1", "2-c"), []string{"2-c", "1-a"}, false, "1-a")
+	mismatchErr, ok = err.(*ErrRevisionMismatch)
+	require.True(t, ok, "Expected ErrRevisionMismatch, got %v", err)
+	assert.Equal(t, "2-b", mismatchErr.CurrentRevID)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusConflict, status)
+
+	// Retrying the write that made the revision current succeeds
+	_, _, err = db.PutExistingRevIfMatch(newDoc("doc1", "2-b"), []string{"2-b", "1-a"}, false, "1-a")
+	assert.NoError(t, err)
+}
+
 func TestGetDeleted(t *testing.T) {
 
 	db, testBucket := setupTestDB(t)
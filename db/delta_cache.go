@@ -0,0 +1,136 @@
+package db
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+// The revision cache holds a single delta per source revision, and only in the default format, so when many clients
+// pull the same update a delta is computed again for every client pulling it in another format, or from a source rev
+// whose cached delta is to another rev.  When DeltaSyncOptions.CacheSize is set, computed deltas are also kept in a
+// small LRU cache keyed by doc, source rev, target rev and format, so that they're diffed once and shared.  Cached
+// deltas carry their target rev's channels, so that a user is still authorized for each delta they're sent.  Deltas to
+// a rev are dropped once a later rev of the doc is written, as clients will be pulling that instead.
+
+// deltaCacheKey identifies a cached delta.
+type deltaCacheKey struct {
+	docID     string
+	fromRevID string
+	toRevID   string
+	format    string
+}
+
+// deltaCache is an LRU cache of computed deltas, shared by all the database's pulls.
+type deltaCache struct {
+	cache    map[deltaCacheKey]*list.Element // Fast lookup of list element by key
+	docKeys  map[string][]deltaCacheKey      // Keys of the cached deltas of each doc, for invalidation
+	lruList  *list.List                      // List ordered by most recent access (Front is newest)
+	capacity int                             // Max number of deltas to cache
+	hits     *expvar.Int
+	misses   *expvar.Int
+	lock     sync.Mutex
+}
+
+// deltaCacheEntry is the value of a deltaCache list element.
+type deltaCacheEntry struct {
+	key   deltaCacheKey
+	delta *RevisionDelta
+}
+
+// newDeltaCache returns a delta cache holding up to capacity deltas, or nil if capacity is zero.
+func newDeltaCache(capacity int, hits, misses *expvar.Int) *deltaCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &deltaCache{
+		cache:    make(map[deltaCacheKey]*list.Element),
+		docKeys:  make(map[string][]deltaCacheKey),
+		lruList:  list.New(),
+		capacity: capacity,
+		hits:     hits,
+		misses:   misses,
+	}
+}
+
+// get returns the cached delta between the revs in the given format, if there is one.  The returned delta is shared,
+// and mustn't be modified.
+func (c *deltaCache) get(docID, fromRevID, toRevID, format string) *RevisionDelta {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, found := c.cache[deltaCacheKey{docID: docID, fromRevID: fromRevID, toRevID: toRevID, format: format}]
+	if !found {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	c.lruList.MoveToFront(element)
+	return element.Value.(*deltaCacheEntry).delta
+}
+
+// put caches a computed delta between the revs in the given format, evicting the least recently used delta when the
+// cache is full.
+func (c *deltaCache) put(docID, fromRevID, format string, delta *RevisionDelta) {
+	if c == nil {
+		return
+	}
+	key := deltaCacheKey{docID: docID, fromRevID: fromRevID, toRevID: delta.ToRevID, format: format}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, found := c.cache[key]; found {
+		element.Value.(*deltaCacheEntry).delta = delta
+		c.lruList.MoveToFront(element)
+		return
+	}
+	c.cache[key] = c.lruList.PushFront(&deltaCacheEntry{key: key, delta: delta})
+	c.docKeys[docID] = append(c.docKeys[docID], key)
+	for c.lruList.Len() > c.capacity {
+		c._remove(c.lruList.Back())
+	}
+}
+
+// invalidate drops the doc's cached deltas to revs other than its current rev, which have been superseded.
+func (c *deltaCache) invalidate(docID, currentRevID string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Copy the keys, as removing a delta updates them
+	keys := append([]deltaCacheKey(nil), c.docKeys[docID]...)
+	for _, key := range keys {
+		if key.toRevID != currentRevID {
+			c._remove(c.cache[key])
+		}
+	}
+}
+
+// _remove removes a cached delta.  Requires the lock to be held.
+func (c *deltaCache) _remove(element *list.Element) {
+	key := element.Value.(*deltaCacheEntry).key
+	c.lruList.Remove(element)
+	delete(c.cache, key)
+
+	keys := c.docKeys[key.docID]
+	for i, docKey := range keys {
+		if docKey == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.docKeys, key.docID)
+	} else {
+		c.docKeys[key.docID] = keys
+	}
+}
+
+// len returns the number of cached deltas.
+func (c *deltaCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lruList.Len()
+}
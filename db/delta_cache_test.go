@@ -0,0 +1,141 @@
+package db
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaCacheEviction(t *testing.T) {
+	hits, misses := expvar.Int{}, expvar.Int{}
+	cache := newDeltaCache(2, &hits, &misses)
+
+	cache.put("doc1", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+	cache.put("doc2", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+	assert.NotNil(t, cache.get("doc1", "1-a", "2-a", DeltaFormatFleece))
+	assert.Nil(t, cache.get("doc1", "1-a", "2-a", DeltaFormatJSONPatch))
+
+	// doc1 was used more recently, so doc2's delta is evicted
+	cache.put("doc3", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+	assert.Equal(t, 2, cache.len())
+	assert.NotNil(t, cache.get("doc1", "1-a", "2-a", DeltaFormatFleece))
+	assert.Nil(t, cache.get("doc2", "1-a", "2-a", DeltaFormatFleece))
+	assert.NotNil(t, cache.get("doc3", "1-a", "2-a", DeltaFormatFleece))
+
+	assert.Equal(t, int64(3), hits.Value())
+	assert.Equal(t, int64(2), misses.Value())
+}
+
+func TestDeltaCacheInvalidate(t *testing.T) {
+	cache := newDeltaCache(10, &expvar.Int{}, &expvar.Int{})
+
+	cache.put("doc1", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+	cache.put("doc1", "1-a", DeltaFormatJSONPatch, &RevisionDelta{ToRevID: "2-a"})
+	cache.put("doc1", "2-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "3-a"})
+	cache.put("doc2", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+
+	// Deltas to doc1's superseded rev are dropped
+	cache.invalidate("doc1", "3-a")
+	assert.Equal(t, 2, cache.len())
+	assert.Nil(t, cache.get("doc1", "1-a", "2-a", DeltaFormatFleece))
+	assert.Nil(t, cache.get("doc1", "1-a", "2-a", DeltaFormatJSONPatch))
+	assert.NotNil(t, cache.get("doc1", "2-a", "3-a", DeltaFormatFleece))
+	assert.NotNil(t, cache.get("doc2", "1-a", "2-a", DeltaFormatFleece))
+
+	cache.invalidate("doc1", "4-a")
+	assert.Equal(t, 1, cache.len())
+	assert.Empty(t, cache.docKeys["doc1"])
+
+	// A disabled cache is nil, and caches nothing
+	var disabled *deltaCache
+	disabled.put("doc1", "1-a", DeltaFormatFleece, &RevisionDelta{ToRevID: "2-a"})
+	assert.Nil(t, disabled.get("doc1", "1-a", "2-a", DeltaFormatFleece))
+	disabled.invalidate("doc1", "2-a")
+}
+
+// TestGetDeltaFromDeltaCache verifies that a delta is computed once and shared between users, each of whom must be
+// authorized for it, and is dropped once its target rev is superseded.
+func TestGetDeltaFromDeltaCache(t *testing.T) {
+	db, testBucket := setupTestDBWithOptions(t, DatabaseContextOptions{DeltaSyncOptions: DeltaSyncOptions{CacheSize: 10}})
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev1ID, _, err := db.Put("doc1", Body{"greeting": "hello", "channels": []string{"A"}})
+	require.NoError(t, err)
+	rev2ID, _, err := db.Put("doc1", Body{BodyRev: rev1ID, "greeting": "hi", "channels": []string{"A"}})
+	require.NoError(t, err)
+
+	deltaSyncStats := db.DbStats.StatsDeltaSync()
+	diffs := func() int64 { return base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltaCacheMisses)) }
+
+	delta, _, err := db.GetDeltaInFormat("doc1", rev1ID, rev2ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.Equal(t, int64(1), diffs())
+
+	authorized, err := db.Authenticator().NewUser("alice", "letmein", channels.SetOf(t, "A"))
+	require.NoError(t, err)
+	db.user = authorized
+	cachedDelta, redactedRev, err := db.GetDeltaInFormat("doc1", rev1ID, rev2ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	assert.Nil(t, redactedRev)
+	assert.Equal(t, delta, cachedDelta)
+	assert.Equal(t, int64(1), diffs())
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltaLRUCacheHits)))
+
+	unauthorized, err := db.Authenticator().NewUser("bob", "letmein", channels.SetOf(t, "B"))
+	require.NoError(t, err)
+	db.user = unauthorized
+	cachedDelta, redactedRev, err = db.GetDeltaInFormat("doc1", rev1ID, rev2ID, DeltaFormatJSONPatch)
+	require.NoError(t, err)
+	assert.Nil(t, cachedDelta)
+	require.NotNil(t, redactedRev)
+	assert.Equal(t, RemovedRedactedDocument, string(redactedRev.BodyBytes))
+
+	db.user = nil
+	_, _, err = db.Put("doc1", Body{BodyRev: rev2ID, "greeting": "hey", "channels": []string{"A"}})
+	require.NoError(t, err)
+	assert.Equal(t, 0, db.deltaCache.len())
+}
+
+// BenchmarkDeltaFanOut measures the deltas diffed when many clients pull each update of a doc, with and without the
+// delta cache.  Deltas are requested in the JSON Patch format, which the revision cache doesn't hold.
+func BenchmarkDeltaFanOut(b *testing.B) {
+	defer base.DisableTestLogging()()
+
+	const numClients = 100
+	for _, cacheSize := range []int{0, DefaultDeltaCacheSize} {
+		b.Run(fmt.Sprintf("CacheSize=%d", cacheSize), func(b *testing.B) {
+			db, testBucket := setupTestDBWithOptions(b, DatabaseContextOptions{DeltaSyncOptions: DeltaSyncOptions{CacheSize: cacheSize}})
+			defer testBucket.Close()
+			defer db.Close()
+
+			revID, _, err := db.Put("doc1", Body{"counter": 0, "padding": string(make([]byte, 1000))})
+			require.NoError(b, err)
+			diffsStart := base.ExpvarVar2Int(db.DbStats.StatsDeltaSync().Get(base.StatKeyDeltaCacheMisses))
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				fromRevID := revID
+				revID, _, err = db.Put("doc1", Body{BodyRev: fromRevID, "counter": n + 1, "padding": string(make([]byte, 1000))})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for client := 0; client < numClients; client++ {
+					if _, _, err := db.GetDeltaInFormat("doc1", fromRevID, revID, DeltaFormatJSONPatch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+
+			diffs := base.ExpvarVar2Int(db.DbStats.StatsDeltaSync().Get(base.StatKeyDeltaCacheMisses)) - diffsStart
+			b.ReportMetric(float64(diffs)/float64(b.N), "diffs/op")
+		})
+	}
+}
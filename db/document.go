@@ -67,6 +67,7 @@ type SyncData struct {
 	Crc32c          string              `json:"value_crc32c"`            // String representation of crc32c hash of doc body, populated via macro expansion
 	TombstonedAt    int64               `json:"tombstoned_at,omitempty"` // Time the document was tombstoned.  Used for view compaction
 	Attachments     AttachmentsMeta     `json:"attachments,omitempty"`
+	ReplicationPath *ReplicationPath    `json:"replication_path,omitempty"` // Sync Gateways a replicated rev has been through, for loop detection
 
 	// Only used for performance metrics:
 	TimeSaved time.Time `json:"time_saved,omitempty"` // Timestamp of save.
@@ -98,6 +99,7 @@ func (sd *SyncData) HashRedact(salt string) SyncData {
 		Crc32c:          sd.Crc32c,
 		TombstonedAt:    sd.TombstonedAt,
 		Attachments:     AttachmentsMeta{},
+		ReplicationPath: sd.ReplicationPath,
 	}
 
 	// Populate and redact channels
@@ -161,6 +163,8 @@ type Document struct {
 	RevID          string
 	DocAttachments AttachmentsMeta
 	inlineSyncData bool
+	expectChannels base.Set // When non-nil, the update fails with ErrChannelsMismatch unless the sync function assigns exactly these channels
+	nodePath       []string // Replication node IDs the rev has been through, when it's been replicated from another Sync Gateway
 }
 
 type revOnlySyncData struct {
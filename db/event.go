@@ -17,6 +17,8 @@ const (
 	DocumentChange EventType = iota
 	DBStateChange
 	UserAdd
+	ReplicationCaughtUp
+	ReplicationProgress
 )
 
 // An event that can be raised during SG processing.
@@ -70,6 +72,39 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 	return DBStateChange
 }
 
+// ReplicationCaughtUpEvent is raised when a replication's pull feed first catches up, i.e. has sent the client every
+// change available when it was subscribed.  Event has the db name, the connection's ID, the user and the client's
+// session, the sequence the feed caught up at, and the local system time.
+type ReplicationCaughtUpEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (rce *ReplicationCaughtUpEvent) String() string {
+	return fmt.Sprintf("Replication caught up event for connection: %s", rce.Doc["connection"])
+}
+
+func (rce *ReplicationCaughtUpEvent) EventType() EventType {
+	return ReplicationCaughtUp
+}
+
+// ReplicationProgressEvent is raised when a replication's pull feed reaches a progress milestone.  Event has the db
+// name, the connection's ID, the user and the client's session, the milestone's reason, the docs and bytes sent, the
+// sequence the feed has reached, the estimated percentage of the initial pull completed when there's an estimate, and
+// the local system time.
+type ReplicationProgressEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (rpe *ReplicationProgressEvent) String() string {
+	return fmt.Sprintf("Replication progress event for connection: %s", rpe.Doc["connection"])
+}
+
+func (rpe *ReplicationProgressEvent) EventType() EventType {
+	return ReplicationProgress
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -150,6 +185,10 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 		result, err = ef.Call(sgbucket.JSONString(event.DocBytes), sgbucket.JSONString(event.OldDoc))
 	case *DBStateChangeEvent:
 		result, err = ef.Call(event.Doc)
+	case *ReplicationCaughtUpEvent:
+		result, err = ef.Call(event.Doc)
+	case *ReplicationProgressEvent:
+		result, err = ef.Call(event.Doc)
 	}
 
 	if err != nil {
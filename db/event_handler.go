@@ -104,6 +104,45 @@ func (wh *Webhook) HandleEvent(event Event) bool {
 		}
 		contentType = "application/json"
 		payload = bytes.NewBuffer(jsonOut)
+	case *ReplicationCaughtUpEvent:
+		// for ReplicationCaughtUpEvent, post JSON document with the following format
+		//{
+		//	"connection":"d4ffd8ab7c5b3f5b",
+		//	"dbname":"db",
+		//	"localtime":"2015-10-07T11:20:29.138+01:00",
+		//	"seq":"1234",
+		//	"session":"client-session",
+		//	"username":"alice"
+		//}
+		jsonOut, err := base.JSONMarshal(event.Doc)
+		if err != nil {
+			base.Warnf("Error marshalling doc for webhook post")
+			return false
+		}
+		contentType = "application/json"
+		payload = bytes.NewBuffer(jsonOut)
+	case *ReplicationProgressEvent:
+		// for ReplicationProgressEvent, post JSON document with the following format, where percent is omitted when
+		// there's no estimate
+		//{
+		//	"bytesSent":52428800,
+		//	"connection":"d4ffd8ab7c5b3f5b",
+		//	"dbname":"db",
+		//	"docsSent":100000,
+		//	"localtime":"2015-10-07T11:20:29.138+01:00",
+		//	"percent":40,
+		//	"reason":"docs",
+		//	"seq":"1234",
+		//	"session":"client-session",
+		//	"username":"alice"
+		//}
+		jsonOut, err := base.JSONMarshal(event.Doc)
+		if err != nil {
+			base.Warnf("Error marshalling doc for webhook post")
+			return false
+		}
+		contentType = "application/json"
+		payload = bytes.NewBuffer(jsonOut)
 	default:
 		base.Warnf("Webhook invoked for unsupported event type.")
 		return false
@@ -182,3 +182,55 @@ func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, rea
 
 	return em.raiseEvent(event)
 }
+
+// Raises a replication caught up event based on the db name, the connection's ID, user and session, and the sequence
+// the feed caught up at.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseReplicationCaughtUpEvent(dbName string, connectionID string, username string, session string, seq SequenceID) error {
+
+	if !em.activeEventTypes[ReplicationCaughtUp] {
+		return nil
+	}
+
+	body := make(Body, 6)
+	body["dbname"] = dbName
+	body["connection"] = connectionID
+	body["username"] = username
+	body["session"] = session
+	body["seq"] = seq.String()
+	body["localtime"] = time.Now().Format(base.ISO8601Format)
+
+	event := &ReplicationCaughtUpEvent{
+		Doc: body,
+	}
+
+	return em.raiseEvent(event)
+}
+
+// Raises a replication progress event based on the db name, the connection's ID, user and session, and the milestone
+// the feed reached.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseReplicationProgressEvent(dbName string, connectionID string, username string, session string, milestone ReplicationMilestone) error {
+
+	if !em.activeEventTypes[ReplicationProgress] {
+		return nil
+	}
+
+	body := make(Body, 10)
+	body["dbname"] = dbName
+	body["connection"] = connectionID
+	body["username"] = username
+	body["session"] = session
+	body["reason"] = milestone.Reason
+	body["docsSent"] = milestone.DocsSent
+	body["bytesSent"] = milestone.BytesSent
+	body["seq"] = milestone.Seq.String()
+	if milestone.Percent >= 0 {
+		body["percent"] = milestone.Percent
+	}
+	body["localtime"] = time.Now().Format(base.ISO8601Format)
+
+	event := &ReplicationProgressEvent{
+		Doc: body,
+	}
+
+	return em.raiseEvent(event)
+}
@@ -60,6 +60,10 @@ func (th *TestingHandler) HandleEvent(event Event) bool {
 
 		th.ResultChannel <- dsceEvent.Doc
 	}
+
+	if rceEvent, ok := event.(*ReplicationCaughtUpEvent); ok {
+		th.ResultChannel <- rceEvent.Doc
+	}
 	return true
 }
 
@@ -148,6 +152,30 @@ func TestDBStateChangeEvent(t *testing.T) {
 
 }
 
+func TestReplicationCaughtUpEvent(t *testing.T) {
+
+	em := NewEventManager()
+	em.Start(0, -1)
+
+	resultChannel := make(chan interface{}, 10)
+	testHandler := &TestingHandler{HandledEvent: ReplicationCaughtUp, t: t}
+	testHandler.SetChannel(resultChannel)
+	em.RegisterEventHandler(testHandler, ReplicationCaughtUp)
+
+	err := em.RaiseReplicationCaughtUpEvent("db", "conn1", "alice", "session1", SequenceID{Seq: 10})
+	assert.NoError(t, err)
+	assertChannelLengthWithTimeout(t, resultChannel, 1, 10*time.Second)
+
+	doc := (<-resultChannel).(Body)
+	assert.Equal(t, "db", doc["dbname"])
+	assert.Equal(t, "conn1", doc["connection"])
+	assert.Equal(t, "alice", doc["username"])
+	assert.Equal(t, "session1", doc["session"])
+	assert.Equal(t, "10", doc["seq"])
+	_, err = time.Parse(base.ISO8601Format, doc["localtime"].(string))
+	assert.NoError(t, err)
+}
+
 // Test sending many events with slow-running execution to validate they get dropped after hitting
 // the max concurrent goroutines
 func TestSlowExecutionProcessing(t *testing.T) {
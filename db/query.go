@@ -331,9 +331,19 @@ func (context *DatabaseContext) buildRoleAccessQuery(username string) string {
 // Query to compute the set of documents assigned to the specified channel within the sequence range
 func (context *DatabaseContext) QueryChannels(channelName string, startSeq uint64, endSeq uint64, limit int,
 	activeOnly bool) (sgbucket.QueryResultIterator, error) {
+	return context.queryChannels(channelName, startSeq, endSeq, limit, activeOnly, false)
+}
+
+// queryChannels is QueryChannels, optionally querying the view or index as it stands rather than waiting for it to
+// index recent mutations.
+func (context *DatabaseContext) queryChannels(channelName string, startSeq uint64, endSeq uint64, limit int,
+	activeOnly bool, stale bool) (sgbucket.QueryResultIterator, error) {
 
 	if context.Options.UseViews {
 		opts := changesViewOptions(channelName, startSeq, endSeq, limit)
+		if stale {
+			opts[base.ViewQueryParamStale] = "ok"
+		}
 		return context.ViewQueryWithStats(DesignDocSyncGateway(), ViewChannels, opts)
 	}
 
@@ -343,7 +353,11 @@ func (context *DatabaseContext) QueryChannels(channelName string, startSeq uint6
 	// QueryChannels result schema (removal handling isn't needed for the star channel).
 	channelQueryStatement, params := context.buildChannelsQuery(channelName, startSeq, endSeq, limit, activeOnly)
 
-	return context.N1QLQueryWithStats(QueryChannels.name, channelQueryStatement, params, gocb.RequestPlus, QueryChannels.adhoc)
+	consistency := gocb.RequestPlus
+	if stale {
+		consistency = gocb.NotBounded
+	}
+	return context.N1QLQueryWithStats(QueryChannels.name, channelQueryStatement, params, consistency, QueryChannels.adhoc)
 }
 
 // Query to retrieve keys for the specified sequences.  View query uses star channel, N1QL query uses IndexAllDocs
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// healthSampleInterval is how often the handler error rate and bucket operation latency are re-evaluated
+	healthSampleInterval = 10 * time.Second
+
+	// Replication health verdicts
+	ReplicationReady     = "ready"     // Replication is healthy
+	ReplicationDegraded  = "degraded"  // Replication is working, but approaching its limits
+	ReplicationUnhealthy = "unhealthy" // Replication is overwhelmed, and new clients should be sent elsewhere
+
+	// healthDegradedSaturation is the fraction of the active feed and in-flight request caps, and of the bucket latency
+	// threshold, beyond which replication is degraded.  It's unhealthy once a cap or the threshold is reached.
+	healthDegradedSaturation = 0.8
+
+	// Handler error rates beyond which replication is degraded, and unhealthy
+	healthDegradedErrorRate  = 0.05
+	healthUnhealthyErrorRate = 0.25
+)
+
+// ReplicationHealth is a readiness signal for BLIP replication, derived from the handler-level stats, for load
+// balancers and orchestrators.  Replication is unhealthy once the active feeds or in-flight requests reach their caps
+// (BlipSyncOptions.HealthMaxActiveFeeds and HealthMaxInFlight), once a quarter of recent requests fail with server
+// errors, or once recent bucket operation latency reaches the admission control threshold.  It's degraded once any of
+// those is 80% of the way there, or for an error rate above 5%.  Signals without a cap or threshold are reported but
+// don't affect the verdict.
+type ReplicationHealth struct {
+	Status           string   `json:"status"`                           // ReplicationReady, ReplicationDegraded or ReplicationUnhealthy
+	Reasons          []string `json:"reasons,omitempty"`                // Why replication isn't ready
+	ActiveFeeds      int64    `json:"active_feeds"`                     // Active one-shot and continuous pull feeds
+	MaxActiveFeeds   int      `json:"max_active_feeds,omitempty"`       // Active feeds at which replication is unhealthy
+	InFlightRequests int64    `json:"in_flight_requests"`               // BLIP requests currently being handled
+	MaxInFlight      int      `json:"max_in_flight_requests,omitempty"` // In-flight requests at which replication is unhealthy
+	ErrorRate        float64  `json:"error_rate"`                       // Fraction of recently handled requests that failed with a server error
+	BucketLatencyMs  float64  `json:"bucket_latency_ms"`                // Recent average bucket operation latency, or 0 when unknown
+	MaxLatencyMs     float64  `json:"max_bucket_latency_ms,omitempty"`  // Bucket operation latency at which replication is unhealthy
+}
+
+// healthMonitor samples the handler error rate and bucket operation latency over the last sample interval, for the
+// database's replication health.
+type healthMonitor struct {
+	maxActiveFeeds int
+	maxInFlight    int
+	maxLatency     time.Duration
+	dbStats        *DatabaseStats
+
+	lock         sync.Mutex
+	lastSample   time.Time
+	lastRequests int64 // Cumulative requests handled at the last sample
+	lastErrors   int64 // Cumulative requests failed at the last sample
+	lastOpTime   int64 // Cumulative bucket operation time (ns) at the last sample
+	lastOpCount  int64 // Cumulative bucket operation count at the last sample
+	errorRate    float64
+	latency      time.Duration
+}
+
+func newHealthMonitor(options BlipSyncOptions, dbStats *DatabaseStats) *healthMonitor {
+	monitor := &healthMonitor{
+		maxActiveFeeds: options.HealthMaxActiveFeeds,
+		maxInFlight:    options.HealthMaxInFlight,
+		maxLatency:     options.AdmissionLatencyThreshold,
+		dbStats:        dbStats,
+		lastSample:     time.Now(),
+	}
+	monitor.lastRequests, monitor.lastErrors = monitor.cumulativeRequests()
+	monitor.lastOpTime, monitor.lastOpCount = bucketOpLatency(dbStats)
+	return monitor
+}
+
+// ReplicationHealth returns the current health of the database's BLIP replication.
+func (context *DatabaseContext) ReplicationHealth() ReplicationHealth {
+	return context.health.check()
+}
+
+// check samples the handler stats if the sample interval has elapsed, and returns the resulting health.
+func (m *healthMonitor) check() ReplicationHealth {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if now := time.Now(); now.Sub(m.lastSample) >= healthSampleInterval {
+		requests, errors := m.cumulativeRequests()
+		opTime, opCount := bucketOpLatency(m.dbStats)
+		m.errorRate, m.latency = 0, 0
+		if requests > m.lastRequests {
+			m.errorRate = float64(errors-m.lastErrors) / float64(requests-m.lastRequests)
+		}
+		if opCount > m.lastOpCount {
+			m.latency = time.Duration((opTime - m.lastOpTime) / (opCount - m.lastOpCount))
+		}
+		m.lastSample, m.lastRequests, m.lastErrors, m.lastOpTime, m.lastOpCount = now, requests, errors, opTime, opCount
+	}
+
+	pull := m.dbStats.StatsCblReplicationPull()
+	health := ReplicationHealth{
+		Status:           ReplicationReady,
+		ActiveFeeds:      base.ExpvarVar2Int(pull.Get(base.StatKeyPullReplicationsActiveOneShot)) + base.ExpvarVar2Int(pull.Get(base.StatKeyPullReplicationsActiveContinuous)),
+		MaxActiveFeeds:   m.maxActiveFeeds,
+		InFlightRequests: base.ExpvarVar2Int(m.dbStats.StatsDatabase().Get(base.StatKeyBlipInFlight)),
+		MaxInFlight:      m.maxInFlight,
+		ErrorRate:        m.errorRate,
+		BucketLatencyMs:  float64(m.latency) / float64(time.Millisecond),
+		MaxLatencyMs:     float64(m.maxLatency) / float64(time.Millisecond),
+	}
+	health.checkSaturation("active feeds", float64(health.ActiveFeeds), float64(m.maxActiveFeeds))
+	health.checkSaturation("in-flight requests", float64(health.InFlightRequests), float64(m.maxInFlight))
+	health.checkSaturation("bucket latency (ms)", health.BucketLatencyMs, health.MaxLatencyMs)
+	if m.errorRate >= healthUnhealthyErrorRate {
+		health.addReason(ReplicationUnhealthy, fmt.Sprintf("error rate %.2f", m.errorRate))
+	} else if m.errorRate >= healthDegradedErrorRate {
+		health.addReason(ReplicationDegraded, fmt.Sprintf("error rate %.2f", m.errorRate))
+	}
+	return health
+}
+
+// checkSaturation degrades the health when a signal nears its cap, and makes it unhealthy once the cap is reached.  A
+// zero cap is ignored.
+func (h *ReplicationHealth) checkSaturation(signal string, value, max float64) {
+	if max <= 0 {
+		return
+	}
+	if value >= max {
+		h.addReason(ReplicationUnhealthy, fmt.Sprintf("%s %.0f of %.0f", signal, value, max))
+	} else if value >= max*healthDegradedSaturation {
+		h.addReason(ReplicationDegraded, fmt.Sprintf("%s %.0f of %.0f", signal, value, max))
+	}
+}
+
+// addReason records why replication isn't ready, lowering the status to the given one if it's worse.
+func (h *ReplicationHealth) addReason(status, reason string) {
+	h.Reasons = append(h.Reasons, reason)
+	if status == ReplicationUnhealthy || h.Status == ReplicationReady {
+		h.Status = status
+	}
+}
+
+// cumulativeRequests returns the number of BLIP requests handled, and the number that failed with a server error.
+func (m *healthMonitor) cumulativeRequests() (requests, errors int64) {
+	stats := m.dbStats.StatsDatabase()
+	return base.ExpvarVar2Int(stats.Get(base.StatKeyBlipRequestCount)), base.ExpvarVar2Int(stats.Get(base.StatKeyBlipRequestErrors))
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationHealth(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	assert.Equal(t, ReplicationReady, db.ReplicationHealth().Status)
+
+	db.health = newHealthMonitor(BlipSyncOptions{HealthMaxActiveFeeds: 10, HealthMaxInFlight: 100}, db.DbStats)
+	pull := db.DbStats.StatsCblReplicationPull()
+	dbStats := db.DbStats.StatsDatabase()
+
+	// Nearing the active feed cap degrades replication, and reaching it makes it unhealthy
+	pull.Add(base.StatKeyPullReplicationsActiveContinuous, 8)
+	health := db.ReplicationHealth()
+	assert.Equal(t, ReplicationDegraded, health.Status)
+	assert.Equal(t, int64(8), health.ActiveFeeds)
+	assert.Len(t, health.Reasons, 1)
+
+	pull.Add(base.StatKeyPullReplicationsActiveOneShot, 2)
+	assert.Equal(t, ReplicationUnhealthy, db.ReplicationHealth().Status)
+	pull.Add(base.StatKeyPullReplicationsActiveContinuous, -8)
+	pull.Add(base.StatKeyPullReplicationsActiveOneShot, -2)
+
+	// The error rate is sampled over the last interval
+	dbStats.Add(base.StatKeyBlipRequestCount, 10)
+	dbStats.Add(base.StatKeyBlipRequestErrors, 1)
+	assert.Equal(t, ReplicationReady, db.ReplicationHealth().Status, "The error rate shouldn't change until the interval elapses")
+	db.health.lastSample = time.Now().Add(-healthSampleInterval)
+	health = db.ReplicationHealth()
+	assert.Equal(t, ReplicationDegraded, health.Status)
+	assert.InDelta(t, 0.1, health.ErrorRate, 0.001)
+
+	dbStats.Add(base.StatKeyBlipRequestCount, 4)
+	dbStats.Add(base.StatKeyBlipRequestErrors, 2)
+	dbStats.Add(base.StatKeyBlipInFlight, 100)
+	db.health.lastSample = time.Now().Add(-healthSampleInterval)
+	health = db.ReplicationHealth()
+	assert.Equal(t, ReplicationUnhealthy, health.Status)
+	assert.Len(t, health.Reasons, 2)
+	dbStats.Add(base.StatKeyBlipInFlight, -100)
+
+	// No requests over the interval resets the error rate
+	db.health.lastSample = time.Now().Add(-healthSampleInterval)
+	assert.Equal(t, ReplicationReady, db.ReplicationHealth().Status)
+}
@@ -250,11 +250,13 @@ func (db *DatabaseContext) getOldRevisionJSON(docid string, revid string) ([]byt
 //      - new revision stored (as duplicate), with expiry rev_max_age_seconds
 //   delta=true && shared_bucket_access=false
 //      - old revision stored, with expiry rev_max_age_seconds
-func (db *Database) backupRevisionJSON(docId, newRevId, oldRevId string, newBody []byte, oldBody []byte, newAtts AttachmentsMeta) {
+//   new revision is a tombstone
+//      - old revision kept for at least tombstone_retention_secs, so the deleted doc's last body is recoverable
+func (db *Database) backupRevisionJSON(docId, newRevId, oldRevId string, newBody []byte, oldBody []byte, newAtts AttachmentsMeta, newDeleted bool) {
 
 	// Without delta sync, store the old rev for in-flight replication purposes
 	if !db.DeltaSyncEnabled() || db.Options.DeltaSyncOptions.RevMaxAgeSeconds == 0 {
-		_ = db.setOldRevisionJSON(docId, oldRevId, oldBody, db.Options.OldRevExpirySeconds)
+		_ = db.setOldRevisionJSON(docId, oldRevId, oldBody, db.oldRevExpiry(db.Options.OldRevExpirySeconds, newDeleted))
 		return
 	}
 
@@ -278,12 +280,21 @@ func (db *Database) backupRevisionJSON(docId, newRevId, oldRevId string, newBody
 		_ = db.setOldRevisionJSON(docId, newRevId, newBodyWithAtts, db.Options.DeltaSyncOptions.RevMaxAgeSeconds)
 
 		// Refresh the expiry on the previous revision backup
-		_ = db.refreshPreviousRevisionBackup(docId, oldRevId, oldBody, db.Options.DeltaSyncOptions.RevMaxAgeSeconds)
+		_ = db.refreshPreviousRevisionBackup(docId, oldRevId, oldBody, db.oldRevExpiry(db.Options.DeltaSyncOptions.RevMaxAgeSeconds, newDeleted))
 		return
 	}
 
 	// Non-xattr only need to store the previous revision, as all writes come through SG
-	_ = db.setOldRevisionJSON(docId, oldRevId, oldBody, db.Options.DeltaSyncOptions.RevMaxAgeSeconds)
+	_ = db.setOldRevisionJSON(docId, oldRevId, oldBody, db.oldRevExpiry(db.Options.DeltaSyncOptions.RevMaxAgeSeconds, newDeleted))
+}
+
+// oldRevExpiry returns the expiry for a backup of the revision replaced by a new revision, extended to the tombstone
+// retention window when the new revision is a tombstone.
+func (db *Database) oldRevExpiry(expiry uint32, newDeleted bool) uint32 {
+	if newDeleted && db.Options.TombstoneRetentionSecs > expiry {
+		return db.Options.TombstoneRetentionSecs
+	}
+	return expiry
 }
 
 func (db *Database) setOldRevisionJSON(docid string, revid string, body []byte, expiry uint32) error {
@@ -83,3 +83,8 @@ func (rc *BypassRevisionCache) Put(docRev DocumentRevision) {
 func (rc *BypassRevisionCache) UpdateDelta(docID, revID string, toDelta RevisionDelta) {
 	// no-op
 }
+
+// Remove is a no-op for a BypassRevisionCache
+func (rc *BypassRevisionCache) Remove(docID, revID string) {
+	// no-op
+}
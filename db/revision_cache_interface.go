@@ -35,6 +35,9 @@ type RevisionCache interface {
 
 	// UpdateDelta stores the given toDelta value in the given rev if cached
 	UpdateDelta(docID, revID string, toDelta RevisionDelta)
+
+	// Remove evicts the given revision from the cache, if present
+	Remove(docID, revID string)
 }
 
 const (
@@ -207,6 +210,7 @@ type RevisionDelta struct {
 	ToChannels        base.Set // Full list of channels for the to revision
 	RevisionHistory   []string // Revision history from parent of ToRevID to source revID, in descending order
 	ToDeleted         bool     // Flag if ToRevID is a tombstone
+	ToBodySize        int      // Size of ToRevID's body, to weigh the delta against
 }
 
 func newRevCacheDelta(deltaBytes []byte, fromRevID string, toRevision DocumentRevision, deleted bool) RevisionDelta {
@@ -217,7 +221,20 @@ func newRevCacheDelta(deltaBytes []byte, fromRevID string, toRevision DocumentRe
 		ToChannels:        toRevision.Channels,
 		RevisionHistory:   toRevision.History.parseAncestorRevisions(fromRevID),
 		ToDeleted:         deleted,
+		ToBodySize:        revisionBodySize(toRevision),
+	}
+}
+
+// revisionBodySize returns the approximate size of a revision's body as sent to a client, including its attachment
+// metadata.
+func revisionBodySize(revision DocumentRevision) int {
+	size := len(revision.BodyBytes)
+	if len(revision.Attachments) > 0 {
+		if attachmentsBytes, err := base.JSONMarshal(revision.Attachments); err == nil {
+			size += len(attachmentsBytes)
+		}
 	}
+	return size
 }
 
 // This is the RevisionCacheLoaderFunc callback for the context's RevisionCache.
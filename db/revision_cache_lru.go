@@ -55,6 +55,10 @@ func (sc *ShardedLRURevisionCache) Put(docRev DocumentRevision) {
 	sc.getShard(docRev.DocID).Put(docRev)
 }
 
+func (sc *ShardedLRURevisionCache) Remove(docID, revID string) {
+	sc.getShard(docID).Remove(docID, revID)
+}
+
 // An LRU cache of document revision bodies, together with their channel access.
 type LRURevisionCache struct {
 	cache        map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
@@ -181,6 +185,17 @@ func (rc *LRURevisionCache) Put(docRev DocumentRevision) {
 	value.store(docRev)
 }
 
+// Removes a revision from the cache, if present.  Only affects the in-memory cache, not the stored revision.
+func (rc *LRURevisionCache) Remove(docID, revID string) {
+	key := IDAndRev{DocID: docID, RevID: revID}
+	rc.lock.Lock()
+	if element := rc.cache[key]; element != nil {
+		rc.lruList.Remove(element)
+		delete(rc.cache, key)
+	}
+	rc.lock.Unlock()
+}
+
 func (rc *LRURevisionCache) getValue(docID, revID string, create bool) (value *revCacheValue) {
 	if docID == "" || revID == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
@@ -118,6 +118,27 @@ func TestLRURevisionCacheEviction(t *testing.T) {
 	}
 }
 
+// Tests removal of revisions from the LRURevisionCache
+func TestLRURevisionCacheRemove(t *testing.T) {
+	cacheHitCounter, cacheMissCounter := expvar.Int{}, expvar.Int{}
+	cache := NewLRURevisionCache(10, &noopBackingStore{}, &cacheHitCounter, &cacheMissCounter)
+
+	cache.Put(DocumentRevision{BodyBytes: []byte(`{}`), DocID: "doc1", RevID: "1-abc", History: Revisions{"start": 1}})
+	cache.Put(DocumentRevision{BodyBytes: []byte(`{}`), DocID: "doc1", RevID: "2-def", History: Revisions{"start": 2}})
+
+	cache.Remove("doc1", "1-abc")
+	_, ok := cache.Peek("doc1", "1-abc")
+	assert.False(t, ok)
+	_, ok = cache.Peek("doc1", "2-def")
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(cache.cache))
+	assert.Equal(t, 1, cache.lruList.Len())
+
+	// Removing a revision that isn't cached is a no-op
+	cache.Remove("doc2", "1-abc")
+	assert.Equal(t, 1, len(cache.cache))
+}
+
 func TestBackingStore(t *testing.T) {
 
 	cacheHitCounter, cacheMissCounter, getDocumentCounter, getRevisionCounter := expvar.Int{}, expvar.Int{}, expvar.Int{}, expvar.Int{}
@@ -10,6 +10,7 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 
@@ -41,6 +42,40 @@ func (db *Database) GetSpecial(doctype string, docid string) (Body, error) {
 	return body, nil
 }
 
+// GetSpecialBytes is GetSpecial for callers that don't need the document unmarshalled.  It returns the document's
+// raw JSON without its _rev property, and the rev separately.  A missing document is a not found error, as is one
+// stored as JSON null.
+func (db *Database) GetSpecialBytes(doctype string, docid string) (rawBody []byte, rev string, err error) {
+	key := db.realSpecialDocID(doctype, docid)
+	if key == "" {
+		return nil, "", base.HTTPErrorf(400, "Invalid doc ID")
+	}
+
+	var rawDocBytes []byte
+	if doctype == "local" && db.DatabaseContext.Options.LocalDocExpirySecs > 0 {
+		rawDocBytes, _, err = db.Bucket.GetAndTouchRaw(key, base.SecondsToCbsExpiry(int(db.DatabaseContext.Options.LocalDocExpirySecs)))
+	} else {
+		rawDocBytes, _, err = db.Bucket.GetRaw(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if string(bytes.TrimSpace(rawDocBytes)) == "null" {
+		return nil, "", base.HTTPErrorf(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	rawBody, properties, err := base.StripJSONProperties(rawDocBytes, BodyRev)
+	if err != nil {
+		return nil, "", err
+	}
+	if rawRev, ok := properties[BodyRev]; ok {
+		if err := base.JSONUnmarshal(rawRev, &rev); err != nil {
+			return nil, "", err
+		}
+	}
+	return rawBody, rev, nil
+}
+
 // Updates or deletes a special document.
 func (db *Database) putSpecial(doctype string, docid string, matchRev string, body Body) (string, error) {
 	key := db.realSpecialDocID(doctype, docid)
@@ -67,8 +102,10 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 			if err := prevBody.Unmarshal(value); err != nil {
 				return nil, nil, err
 			}
+			// Checked within the CAS update, so that concurrent writers with the same matchRev can't both succeed
 			if matchRev != prevBody[BodyRev] {
-				return nil, nil, base.HTTPErrorf(http.StatusConflict, "Document update conflict")
+				currentRev, _ := prevBody[BodyRev].(string)
+				return nil, nil, &ErrRevisionMismatch{ExpectedRevID: matchRev, CurrentRevID: currentRev}
 			}
 		}
 
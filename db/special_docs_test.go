@@ -0,0 +1,116 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSpecialBytes(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev, err := db.PutSpecial("local", "checkpoint/client", Body{"seq": "123", "nested": map[string]interface{}{"_rev": "x"}})
+	require.NoError(t, err)
+
+	rawBody, gotRev, err := db.GetSpecialBytes("local", "checkpoint/client")
+	require.NoError(t, err)
+	assert.Equal(t, rev, gotRev)
+	var body Body
+	require.NoError(t, base.JSONUnmarshal(rawBody, &body))
+	assert.Equal(t, Body{"seq": "123", "nested": map[string]interface{}{"_rev": "x"}}, body)
+
+	// Missing docs, and those stored as null, are not found
+	_, _, err = db.GetSpecialBytes("local", "checkpoint/missing")
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	require.NoError(t, db.Bucket.SetRaw(db.realSpecialDocID("local", "checkpoint/null"), 0, []byte("null")))
+	_, _, err = db.GetSpecialBytes("local", "checkpoint/null")
+	status, _ = base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+// BenchmarkGetCheckpointBody compares returning a checkpoint's body by unmarshalling and re-marshalling it with
+// returning its raw bytes.
+func BenchmarkGetCheckpointBody(b *testing.B) {
+	defer base.SetUpBenchmarkLogging(base.LevelWarn, base.KeyHTTP)()
+	db, testBucket := setupTestDB(b)
+	defer testBucket.Close()
+	defer db.Close()
+
+	checkpoint := Body{"remote": "1234", "local": "5678", checkpointOwner: "alice"}
+	for i := 0; i < 50; i++ {
+		checkpoint[fmt.Sprintf("channel%d", i)] = "sequence-12345"
+	}
+	_, err := db.PutSpecial("local", "checkpoint/client", checkpoint)
+	require.NoError(b, err)
+
+	b.Run("Marshal", func(bb *testing.B) {
+		for i := 0; i < bb.N; i++ {
+			value, _ := db.GetSpecial("local", "checkpoint/client")
+			delete(value, BodyRev)
+			delete(value, BodyId)
+			delete(value, checkpointOwner)
+			_, _ = base.JSONMarshal(value)
+		}
+	})
+	b.Run("RawBytes", func(bb *testing.B) {
+		for i := 0; i < bb.N; i++ {
+			rawBody, _, _ := db.GetSpecialBytes("local", "checkpoint/client")
+			_, _, _ = base.StripJSONProperties(rawBody, BodyId, checkpointOwner, checkpointOpaque)
+		}
+	})
+}
+
+// TestPutSpecialConcurrentStaleRev verifies only one of several concurrent updates of a special doc from the same
+// rev succeeds, and the others are told the current rev.
+func TestPutSpecialConcurrentStaleRev(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer db.Close()
+
+	rev, err := db.putSpecial("local", "checkpoint/client", "", Body{"remote": 1})
+	require.NoError(t, err)
+
+	const writers = 5
+	var wg sync.WaitGroup
+	revs := make([]string, writers)
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			revs[i], errs[i] = db.putSpecial("local", "checkpoint/client", rev, Body{"remote": i + 2})
+		}(i)
+	}
+	wg.Wait()
+
+	var winningRev string
+	for i, err := range errs {
+		if err == nil {
+			assert.Empty(t, winningRev, "Only one writer should succeed")
+			winningRev = revs[i]
+		}
+	}
+	require.NotEmpty(t, winningRev)
+	for _, err := range errs {
+		if err != nil {
+			mismatchErr, ok := err.(*ErrRevisionMismatch)
+			require.True(t, ok, "Unexpected error %v", err)
+			assert.Equal(t, winningRev, mismatchErr.CurrentRevID)
+			status, _ := base.ErrorAsHTTPStatus(err)
+			assert.Equal(t, http.StatusConflict, status)
+		}
+	}
+
+	// Retrying from the current rev succeeds
+	_, err = db.putSpecial("local", "checkpoint/client", winningRev, Body{"remote": 10})
+	assert.NoError(t, err)
+}
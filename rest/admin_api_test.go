@@ -2135,3 +2135,26 @@ func TestUserAndRoleResponseContentType(t *testing.T) {
 	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
 	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &responseBody))
 }
+
+func TestReplicationHealthEndpoint(t *testing.T) {
+	maxFeeds := uint32(1)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{HealthMaxActiveFeeds: &maxFeeds}}})
+	defer rt.Close()
+
+	var health db.ReplicationHealth
+	response := rt.SendAdminRequest(http.MethodGet, "/db/_replication_health", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &health))
+	assert.Equal(t, db.ReplicationReady, health.Status)
+	assert.Equal(t, 1, health.MaxActiveFeeds)
+
+	// Load balancers are told to stop sending clients once replication is unhealthy
+	pull := rt.GetDatabase().DbStats.StatsCblReplicationPull()
+	pull.Add(base.StatKeyPullReplicationsActiveContinuous, 1)
+	defer pull.Add(base.StatKeyPullReplicationsActiveContinuous, -1)
+	response = rt.SendAdminRequest(http.MethodGet, "/db/_replication_health", "")
+	assertStatus(t, response, http.StatusServiceUnavailable)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &health))
+	assert.Equal(t, db.ReplicationUnhealthy, health.Status)
+	assert.Equal(t, int64(1), health.ActiveFeeds)
+}
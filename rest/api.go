@@ -78,6 +78,18 @@ func (h *handler) handleVacuum() error {
 	return nil
 }
 
+// Returns the health of the database's BLIP replication, with a 503 status when it's unhealthy, so that load
+// balancers can stop sending new clients to this node.
+func (h *handler) handleGetReplicationHealth() error {
+	health := h.db.ReplicationHealth()
+	status := http.StatusOK
+	if health.Status == db.ReplicationUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	h.writeJSONStatus(status, health)
+	return nil
+}
+
 func (h *handler) handleFlush() error {
 
 	// If it can be flushed, then flush it
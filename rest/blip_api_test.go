@@ -1,8 +1,13 @@
 package rest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
@@ -626,6 +631,41 @@ func TestProposedChangesNoConflictsMode(t *testing.T) {
 
 }
 
+// TestProposedChangesMixedStatuses verifies the response to a proposeChanges message whose changes are checked against
+// existing, missing and conflicting docs in one batch.
+func TestProposedChangesMixedStatuses(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		noConflictsMode: true,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"greeting": "hello"}`)
+	assertStatus(t, response, http.StatusCreated)
+	doc1RevID := respRevID(t, response)
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc2", `{"greeting": "hello"}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	proposeChangesRequest := blip.NewRequest()
+	proposeChangesRequest.SetProfile(db.MessageProposeChanges)
+	proposeChangesRequest.SetCompressed(true)
+	proposeChangesRequest.SetBody([]byte(`[
+["new1", "1-abc"],
+["doc1", "` + doc1RevID + `"],
+["doc1", "2-abc", "` + doc1RevID + `"],
+["doc2", "2-abc", "1-def"],
+["new2", "1-abc"]]`))
+	require.True(t, bt.sender.Send(proposeChangesRequest))
+	body, err := proposeChangesRequest.Response().Body()
+	require.NoError(t, err)
+
+	// The status of the trailing new doc is a zero, so it's left out
+	assert.Equal(t, "[0,304,0,409]", string(body))
+}
+
 // Connect to public port with authentication
 func TestPublicPortAuthentication(t *testing.T) {
 
@@ -2474,21 +2514,21 @@ func TestBlipDeltaSyncPush(t *testing.T) {
 	deltaPushDocCountStart := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsDeltaSync().Get(base.StatKeyDeltaPushDocCount))
 	revID, err := client.PushRev("doc1", "3-f3be6c85e0362153005dae6f08fc68bb", []byte(`{"undelete":true}`))
 
+	// In EE the client pushes a delta that has the tombstone as its parent, which resurrects the doc.  In CE pushing a
+	// full body revision on top of a tombstone is valid.
+	assert.NoError(t, err)
+	assert.Equal(t, "4-abcxyz", revID)
+
+	resp = rt.SendAdminRequest(http.MethodGet, "/db/doc1?rev="+revID, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"undelete":true`)
+
+	deltaPushDocCountEnd := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsDeltaSync().Get(base.StatKeyDeltaPushDocCount))
 	if base.IsEnterpriseEdition() {
-		// Now make the client push up a delta that has the parent of the tombstone.
-		// This is not a valid scenario, and is actively prevented on the CBL side.
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "Found tombstone for deltaSrc")
-		assert.Equal(t, "", revID)
+		assert.Equal(t, deltaPushDocCountStart+1, deltaPushDocCountEnd)
 	} else {
-		// Pushing a full body revision on top of a tombstone is valid.
-		// CBL clients should fall back to this. The test client doesn't.
-		assert.NoError(t, err)
-		assert.Equal(t, "4-abcxyz", revID)
+		assert.Equal(t, deltaPushDocCountStart, deltaPushDocCountEnd)
 	}
-
-	deltaPushDocCountEnd := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsDeltaSync().Get(base.StatKeyDeltaPushDocCount))
-	assert.Equal(t, deltaPushDocCountStart, deltaPushDocCountEnd)
 }
 
 // TestBlipNonDeltaSyncPush tests that a client that doesn't support deltas can push to a SG that supports deltas (either CE or EE)
@@ -2827,3 +2867,3405 @@ func TestBlipDeltaSyncPushPullNewAttachment(t *testing.T) {
 	assert.Equal(t, float64(2), world["revpos"])
 	assert.Equal(t, true, world["stub"])
 }
+
+// TestBlipStagedSync verifies that with stagedSync, revisions are only sent for the docs the client selects
+// after receiving each changes batch.
+func TestBlipStagedSync(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for _, docID := range []string{"doc1", "doc2", "doc3"} {
+		sent, _, resp, err := bt.SendRev(docID, "1-abc", []byte(`{"key": "val"}`), blip.Properties{})
+		require.True(t, sent)
+		require.NoError(t, err)
+		require.Equal(t, "", resp.Properties["Error-Code"])
+	}
+
+	var revsLock sync.Mutex
+	receivedRevs := make(map[string]string)
+	revsWg := sync.WaitGroup{}
+	changesWg := sync.WaitGroup{}
+
+	bt.blipContext.HandlerForProfile["changes"] = func(request *blip.Message) {
+		defer changesWg.Done()
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" {
+			return
+		}
+
+		var changesBatch [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changesBatch))
+
+		// Respond asking for all revisions, but only select doc2 and doc3
+		responseVal := make([][]interface{}, 0, len(changesBatch))
+		for range changesBatch {
+			responseVal = append(responseVal, []interface{}{})
+		}
+		responseValBytes, err := base.JSONMarshal(responseVal)
+		require.NoError(t, err)
+		request.Response().SetBody(responseValBytes)
+
+		revsWg.Add(2)
+		selectRequest := blip.NewRequest()
+		selectRequest.SetProfile(db.MessageSelectChanges)
+		require.NoError(t, selectRequest.SetJSONBody([]string{"doc2", "doc3"}))
+		require.True(t, bt.sender.Send(selectRequest))
+		assert.Equal(t, "", selectRequest.Response().Properties["Error-Code"])
+	}
+
+	bt.blipContext.HandlerForProfile["rev"] = func(request *blip.Message) {
+		defer revsWg.Done()
+		revsLock.Lock()
+		receivedRevs[request.Properties[db.RevMessageId]] = request.Properties[db.RevMessageRev]
+		revsLock.Unlock()
+	}
+
+	// One batch of changes, followed by the empty caught up batch
+	changesWg.Add(2)
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesStagedSync] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	require.NoError(t, WaitWithTimeout(&changesWg, 5*time.Second))
+	require.NoError(t, WaitWithTimeout(&revsWg, 5*time.Second))
+
+	revsLock.Lock()
+	defer revsLock.Unlock()
+	assert.Equal(t, map[string]string{"doc2": "1-abc", "doc3": "1-abc"}, receivedRevs)
+
+	// A selection is rejected when no changes batch is awaiting one
+	selectRequest := blip.NewRequest()
+	selectRequest.SetProfile(db.MessageSelectChanges)
+	require.NoError(t, selectRequest.SetJSONBody([]string{"doc1"}))
+	require.True(t, bt.sender.Send(selectRequest))
+	assert.Equal(t, "409", selectRequest.Response().Properties["Error-Code"])
+}
+
+// TestBlipRevRetry verifies that with revRetry, a rev the client reports a temporary failure for is re-sent, and
+// that a rev the client rejects isn't.
+func TestBlipRevRetry(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for _, docID := range []string{"retried", "rejected"} {
+		sent, _, resp, err := bt.SendRev(docID, "1-abc", []byte(`{"key": "val"}`), blip.Properties{})
+		require.True(t, sent)
+		require.NoError(t, err)
+		require.Equal(t, "", resp.Properties["Error-Code"])
+	}
+
+	var revsLock sync.Mutex
+	revCounts := make(map[string]int)
+	revsWg := sync.WaitGroup{}
+	// retried is received twice, rejected once
+	revsWg.Add(3)
+
+	bt.blipContext.HandlerForProfile["changes"] = func(request *blip.Message) {
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" || request.NoReply() {
+			return
+		}
+		var changesBatch [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changesBatch))
+		responseVal := make([][]interface{}, 0, len(changesBatch))
+		for range changesBatch {
+			responseVal = append(responseVal, []interface{}{})
+		}
+		responseValBytes, err := base.JSONMarshal(responseVal)
+		require.NoError(t, err)
+		request.Response().SetBody(responseValBytes)
+	}
+
+	bt.blipContext.HandlerForProfile["rev"] = func(request *blip.Message) {
+		defer revsWg.Done()
+		docID := request.Properties[db.RevMessageId]
+		revsLock.Lock()
+		revCounts[docID]++
+		count := revCounts[docID]
+		revsLock.Unlock()
+
+		if docID == "rejected" {
+			request.Response().SetError("HTTP", http.StatusForbidden, "rejected")
+		} else if count == 1 {
+			request.Response().SetError("HTTP", http.StatusServiceUnavailable, "try again")
+		}
+	}
+
+	resendCountStart := base.ExpvarVar2Int(bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyRevResendCount))
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesRevRetry] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	require.NoError(t, WaitWithTimeout(&revsWg, 5*time.Second))
+
+	// Allow time for any unexpected re-send of the rejected rev
+	time.Sleep(100 * time.Millisecond)
+	revsLock.Lock()
+	defer revsLock.Unlock()
+	assert.Equal(t, map[string]int{"retried": 2, "rejected": 1}, revCounts)
+	assert.Equal(t, resendCountStart+1, base.ExpvarVar2Int(bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyRevResendCount)))
+}
+
+// TestBlipBodyChecksum verifies revs carry a checksum of their body when requested, and that a rev the client
+// reports as failing its checksum is re-sent.
+func TestBlipBodyChecksum(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	sent, _, resp, err := bt.SendRev("doc1", "1-abc", []byte(`{"key": "val"}`), blip.Properties{})
+	require.True(t, sent)
+	require.NoError(t, err)
+	require.Equal(t, "", resp.Properties["Error-Code"])
+
+	var revsLock sync.Mutex
+	revCount := 0
+	revsWg := sync.WaitGroup{}
+	// Received twice, as the first is reported as corrupt
+	revsWg.Add(2)
+
+	bt.blipContext.HandlerForProfile["changes"] = func(request *blip.Message) {
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" || request.NoReply() {
+			return
+		}
+		var changesBatch [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changesBatch))
+		responseVal := make([][]interface{}, 0, len(changesBatch))
+		for range changesBatch {
+			responseVal = append(responseVal, []interface{}{})
+		}
+		responseValBytes, err := base.JSONMarshal(responseVal)
+		require.NoError(t, err)
+		request.Response().SetBody(responseValBytes)
+	}
+
+	bt.blipContext.HandlerForProfile["rev"] = func(request *blip.Message) {
+		defer revsWg.Done()
+		body, err := request.Body()
+		require.NoError(t, err)
+		assert.Equal(t, base.Crc32cHashString(body), request.Properties[db.RevMessageChecksum])
+
+		revsLock.Lock()
+		revCount++
+		count := revCount
+		revsLock.Unlock()
+		if count == 1 {
+			request.Response().SetError("HTTP", http.StatusUnprocessableEntity, "checksum mismatch")
+		}
+	}
+
+	mismatchCountStart := base.ExpvarVar2Int(bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyRevChecksumMismatchCount))
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesChecksum] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	require.NoError(t, WaitWithTimeout(&revsWg, 5*time.Second))
+	assert.Equal(t, mismatchCountStart+1, base.ExpvarVar2Int(bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyRevChecksumMismatchCount)))
+}
+
+// TestBlipCompactionRequiresAdmin verifies compaction profiles are rejected on a non-admin connection.
+func TestBlipCompactionRequiresAdmin(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for _, profile := range []string{db.MessageCompactStatus, db.MessageStartCompact} {
+		request := blip.NewRequest()
+		request.SetProfile(profile)
+		require.True(t, bt.sender.Send(request))
+		response := request.Response()
+		assert.Equal(t, "403", response.Properties["Error-Code"], "profile %s", profile)
+		assert.Equal(t, "", response.Properties[db.StartCompactionJobID])
+	}
+	assert.Equal(t, db.DBCompactNotRunning, atomic.LoadUint32(&bt.restTester.GetDatabase().CompactState))
+}
+
+// TestBlipAttachmentUploadDisconnect verifies that when a client disconnects while Sync Gateway is waiting for an
+// attachment it requested, handleRev returns instead of waiting indefinitely, and the rev isn't written.
+func TestBlipAttachmentUploadDisconnect(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.restTester.Close()
+
+	getAttachmentReceived := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = func(request *blip.Message) {
+		// Disconnect before the attachment's been sent
+		bt.sender.Close()
+		close(getAttachmentReceived)
+	}
+
+	pushStats := bt.restTester.GetDatabase().DbStats.CblReplicationPush()
+	writeTimeStart := base.ExpvarVar2Int(pushStats.Get(base.StatKeyWriteProcessingTime))
+
+	digest := db.Sha1DigestKey([]byte("attachment"))
+	revRequest := blip.NewRequest()
+	revRequest.SetProfile(db.MessageRev)
+	revRequest.Properties[db.RevMessageId] = "doc1"
+	revRequest.Properties[db.RevMessageRev] = "1-abc"
+	revRequest.SetBody([]byte(`{"_attachments": {"att": {"stub": true, "digest": "` + digest + `", "length": 10, "revpos": 1}}}`))
+	require.True(t, bt.sender.Send(revRequest))
+
+	select {
+	case <-getAttachmentReceived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for getAttachment request")
+	}
+
+	// handleRev records its processing time once it's returned
+	err, _ = base.RetryLoop("wait for handleRev to return", func() (bool, error, interface{}) {
+		return base.ExpvarVar2Int(pushStats.Get(base.StatKeyWriteProcessingTime)) == writeTimeStart, nil, nil
+	}, base.CreateSleeperFunc(200, 50))
+	require.NoError(t, err)
+
+	response := bt.restTester.SendAdminRequest(http.MethodGet, "/db/doc1", "")
+	assertStatus(t, response, http.StatusNotFound)
+}
+
+// TestBlipProposeChangesMaxChanges verifies a proposeChanges message listing more changes than the configured
+// maximum is rejected with a 413, while one within the limit is handled.
+func TestBlipProposeChangesMaxChanges(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxChanges := uint32(2)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxChangesPerMessage: &maxChanges}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	proposeChanges := func(body string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageProposeChanges)
+		request.SetBody([]byte(body))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	response := proposeChanges(`[["doc1", "1-a"], ["doc2", "1-a"]]`)
+	assert.Equal(t, "", response.Properties["Error-Code"])
+
+	response = proposeChanges(`[["doc1", "1-a"], ["doc2", "1-a"], ["doc3", "1-a"]]`)
+	assert.Equal(t, "413", response.Properties["Error-Code"])
+}
+
+// TestBlipMaxRevGeneration verifies pushed revs beyond the configured maximum generation are rejected and counted,
+// and that the limit is advertised via getCapabilities.
+func TestBlipMaxRevGeneration(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxGeneration := uint32(2)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxRevGeneration: &maxGeneration}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	request := blip.NewRequest()
+	request.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(request))
+	var capabilities db.CapabilitiesBody
+	require.NoError(t, request.Response().ReadJSONBody(&capabilities))
+	assert.Equal(t, 2, capabilities.MaxRevGeneration)
+
+	_, _, _, err = bt.SendRevWithHistory("doc1", "2-b", []string{"1-a"}, []byte(`{"key": "val"}`), blip.Properties{})
+	assert.NoError(t, err)
+
+	_, _, response, err := bt.SendRevWithHistory("doc1", "3-c", []string{"2-b"}, []byte(`{"key": "val"}`), blip.Properties{})
+	assert.Error(t, err)
+	assert.Equal(t, "400", response.Properties["Error-Code"])
+
+	pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyRevGenRejected)))
+}
+
+// TestBlipBatchedAttachmentProofs verifies that a client pushing a rev with several attachments the server already
+// has is asked to prove them all in a single proveAttachments request.
+func TestBlipBatchedAttachmentProofs(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"_attachments": {"a.txt": {"data": "aGVsbG8="}, "b.txt": {"data": "d29ybGQ="}}}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	attachments := map[string][]byte{
+		db.Sha1DigestKey([]byte("hello")): []byte("hello"),
+		db.Sha1DigestKey([]byte("world")): []byte("world"),
+	}
+	bt.blipContext.HandlerForProfile[db.MessageProveAttachment] = func(request *blip.Message) {
+		assert.Fail(t, "Unexpected proveAttachment request")
+		request.Response().SetError("HTTP", http.StatusBadRequest, "unexpected")
+	}
+	var batches int
+	bt.blipContext.HandlerForProfile[db.MessageProveBatch] = func(request *blip.Message) {
+		batches++
+		var nonces map[string][]byte
+		require.NoError(t, request.ReadJSONBody(&nonces))
+		assert.Len(t, nonces, 2)
+		proofs := make(map[string]string, len(nonces))
+		for digest, nonce := range nonces {
+			proofs[digest] = db.ProveAttachment(attachments[digest], nonce)
+		}
+		require.NoError(t, request.Response().SetJSONBody(proofs))
+	}
+
+	body := fmt.Sprintf(`{"_attachments": {"a.txt": {"stub": true, "digest": %q, "revpos": 1, "length": 5}, "b.txt": {"stub": true, "digest": %q, "revpos": 1, "length": 5}}}`,
+		db.Sha1DigestKey([]byte("hello")), db.Sha1DigestKey([]byte("world")))
+	_, _, _, err = bt.SendRev("doc2", "1-a", []byte(body), blip.Properties{db.RevMessageBatchProofs: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, batches)
+
+	pushStats := bt.restTester.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyProofBatchCount)))
+}
+
+// TestBlipCompressedAttachmentUpload verifies an attachment the client sends gzip-compressed is decompressed and
+// verified against its uncompressed digest and length.
+func TestBlipCompressedAttachmentUpload(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	attData := []byte(strings.Repeat("compressible attachment data ", 100))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(attData)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = func(request *blip.Message) {
+		assert.Contains(t, request.Properties[db.GetAttachmentAccept], db.AttachmentEncodingGzip)
+		response := request.Response()
+		response.Properties[db.GetAttachmentEncoding] = db.AttachmentEncodingGzip
+		response.SetBody(compressed.Bytes())
+	}
+
+	digest := db.Sha1DigestKey(attData)
+	revRequest := blip.NewRequest()
+	revRequest.SetProfile(db.MessageRev)
+	revRequest.Properties[db.RevMessageId] = "doc1"
+	revRequest.Properties[db.RevMessageRev] = "1-abc"
+	revRequest.SetBody([]byte(fmt.Sprintf(`{"_attachments": {"att": {"stub": true, "digest": "%s", "length": %d, "revpos": 1}}}`, digest, len(attData))))
+	require.True(t, bt.sender.Send(revRequest))
+	revResponse := revRequest.Response()
+	assert.Equal(t, "", revResponse.Properties["Error-Code"])
+
+	response := bt.restTester.SendAdminRequest(http.MethodGet, "/db/doc1/att", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, attData, response.Body.Bytes())
+
+	pushStats := bt.restTester.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyAttCompressedPush)))
+	assert.Equal(t, int64(len(attData)-compressed.Len()), base.ExpvarVar2Int(pushStats.Get(base.StatKeyAttUploadBytesSaved)))
+}
+
+// TestBlipRevChannelAssignment verifies a pushed rev's assigned channels are returned when asked for, and that a rev
+// is rejected when the sync function assigns channels other than those the client expects.
+func TestBlipRevChannelAssignment(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	channelAssignment := true
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:         `function(doc) {channel(doc.channels);}`,
+		DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{RevChannelAssignment: &channelAssignment}},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	sendRev := func(docID string, properties map[string]string) *blip.Message {
+		revRequest := blip.NewRequest()
+		revRequest.SetProfile(db.MessageRev)
+		revRequest.Properties[db.RevMessageId] = docID
+		revRequest.Properties[db.RevMessageRev] = "1-abc"
+		for name, value := range properties {
+			revRequest.Properties[name] = value
+		}
+		revRequest.SetBody([]byte(`{"channels": ["b", "a"]}`))
+		require.True(t, bt.sender.Send(revRequest))
+		return revRequest.Response()
+	}
+
+	response := sendRev("doc1", map[string]string{db.RevMessageRetChannels: "true", db.RevMessageExpChannels: "a, b"})
+	assert.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "a,b", response.Properties[db.RevResponseChannels])
+
+	response = sendRev("doc2", map[string]string{db.RevMessageExpChannels: "a"})
+	assert.Equal(t, "412", response.Properties["Error-Code"])
+	assert.Equal(t, "a,b", response.Properties[db.RevResponseChannels])
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc2", ""), http.StatusNotFound)
+
+	pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyRevChannelMismatch)))
+}
+
+// TestBlipAttachmentDownloadRetry verifies a getAttachment request the client fails with a 503 is retried, so the
+// rev is written once the client sends the attachment.
+func TestBlipAttachmentDownloadRetry(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	retries, backoffMs := uint32(2), uint32(10)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{AttachmentRetries: &retries, AttachmentRetryBackoffMs: &backoffMs}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	attData := []byte("attachment")
+	var getAttachmentCount int32
+	bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = func(request *blip.Message) {
+		if atomic.AddInt32(&getAttachmentCount, 1) == 1 {
+			request.Response().SetError("HTTP", http.StatusServiceUnavailable, "Temporarily unavailable")
+			return
+		}
+		request.Response().SetBody(attData)
+	}
+
+	revRequest := blip.NewRequest()
+	revRequest.SetProfile(db.MessageRev)
+	revRequest.Properties[db.RevMessageId] = "doc1"
+	revRequest.Properties[db.RevMessageRev] = "1-abc"
+	revRequest.SetBody([]byte(fmt.Sprintf(`{"_attachments": {"att": {"stub": true, "digest": "%s", "length": %d, "revpos": 1}}}`, db.Sha1DigestKey(attData), len(attData))))
+	require.True(t, bt.sender.Send(revRequest))
+	assert.Equal(t, "", revRequest.Response().Properties["Error-Code"])
+	assert.Equal(t, int32(2), atomic.LoadInt32(&getAttachmentCount))
+
+	pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyAttDownloadRetries)))
+}
+
+// TestBlipVerifyCheckpoint verifies a client can check the remote sequence in its stored checkpoint, and can't verify
+// another user's checkpoint.
+func TestBlipVerifyCheckpoint(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	btUser1, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		noAdminParty:       true,
+		connectingUsername: "user1",
+		connectingPassword: "1234",
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer btUser1.Close()
+
+	setCheckpoint := blip.NewRequest()
+	setCheckpoint.SetProfile(db.MessageSetCheckpoint)
+	setCheckpoint.Properties[db.SetCheckpointClient] = "client1"
+	require.NoError(t, setCheckpoint.SetJSONBody(db.Body{"local": 10, "remote": 25}))
+	require.True(t, btUser1.sender.Send(setCheckpoint))
+	assert.Equal(t, "", setCheckpoint.Response().Properties["Error-Code"])
+
+	verifyCheckpoint := func(bt *BlipTester, sequence string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageVerifyCheckpt)
+		request.Properties[db.VerifyCheckpointClient] = "client1"
+		request.Properties[db.VerifyCheckpointSeq] = sequence
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	response := verifyCheckpoint(btUser1, "25")
+	assert.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "true", response.Properties[db.VerifyCheckpointMatch])
+
+	response = verifyCheckpoint(btUser1, "20")
+	assert.Equal(t, "false", response.Properties[db.VerifyCheckpointMatch])
+	assert.Equal(t, "25", response.Properties[db.VerifyCheckpointSeq])
+	pullStats := btUser1.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyCheckpointMismatchCount)))
+
+	btUser2, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		noAdminParty:       true,
+		connectingUsername: "user2",
+		connectingPassword: "1234",
+		restTester:         btUser1.restTester,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer btUser2.Close()
+
+	response = verifyCheckpoint(btUser2, "25")
+	assert.Equal(t, "403", response.Properties["Error-Code"])
+}
+
+// TestBlipMaxConnectionLifetime verifies a connection is closed once it reaches its maximum lifetime, after the
+// client's been told why.
+func TestBlipMaxConnectionLifetime(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	lifetimeSecs := uint32(1)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxConnectionLifetimeSecs: &lifetimeSecs}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	closingReasons := make(chan string, 1)
+	bt.blipContext.HandlerForProfile[db.MessageClosing] = func(request *blip.Message) {
+		closingReasons <- request.Properties[db.ClosingReason]
+	}
+
+	// The closing message is sent to the sender of the connection's first request
+	getCheckpoint := blip.NewRequest()
+	getCheckpoint.SetProfile(db.MessageGetCheckpoint)
+	getCheckpoint.Properties[db.GetCheckpointClient] = "client1"
+	require.True(t, bt.sender.Send(getCheckpoint))
+	assert.Equal(t, "404", getCheckpoint.Response().Properties["Error-Code"])
+
+	select {
+	case reason := <-closingReasons:
+		assert.Equal(t, db.ClosingReasonMaxLifetime, reason)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for closing message")
+	}
+
+	dbStats := rt.GetDatabase().DbStats.StatsDatabase()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(dbStats.Get(base.StatKeyMaxLifetimeCloseCount)))
+}
+
+// TestBlipProposeChangesConflictPolicy verifies the status of a conflicting proposed rev follows the requested
+// conflict policy, and that client-wins is refused in no-conflicts mode.
+func TestBlipProposeChangesConflictPolicy(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{noConflictsMode: true})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	proposeChanges := func(conflictPolicy string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageProposeChanges)
+		if conflictPolicy != "" {
+			request.Properties[db.ProposeChangesConflictPolicy] = conflictPolicy
+		}
+		request.SetBody([]byte(`[["doc1", "1-abc"], ["doc2", "1-abc"]]`))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	for _, test := range []struct {
+		conflictPolicy string
+		expectedBody   string
+	}{
+		{"", "[409]"},
+		{db.ConflictPolicyReject, "[409]"},
+		{db.ConflictPolicyServerWins, "[304]"},
+	} {
+		blipResponse := proposeChanges(test.conflictPolicy)
+		assert.Equal(t, "", blipResponse.Properties["Error-Code"])
+		body, err := blipResponse.Body()
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedBody, string(body))
+	}
+
+	assert.Equal(t, "400", proposeChanges(db.ConflictPolicyClientWins).Properties["Error-Code"])
+	assert.Equal(t, "400", proposeChanges("last-write-wins").Properties["Error-Code"])
+
+	pushStats := bt.restTester.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(pushStats.Get(base.StatKeyConflictRejectCount)))
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyConflictServerWins)))
+}
+
+// TestBlipSubChangesWithAttachmentsOnly verifies a withAttachmentsOnly pull skips docs without attachments, but still
+// sends tombstones.
+func TestBlipSubChangesWithAttachmentsOnly(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/withAtt", `{"_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/withoutAtt", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/deleted", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodDelete, "/db/deleted?rev="+respRevID(t, response), "")
+	assertStatus(t, response, http.StatusOK)
+
+	var docIDs []string
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" {
+			close(caughtUp)
+			return
+		}
+		var changes [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		for _, change := range changes {
+			docIDs = append(docIDs, change[1].(string))
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesAttOnly] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for changes")
+	}
+	assert.Equal(t, []string{"withAtt", "deleted"}, docIDs)
+
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyNoAttachmentsSkipped)))
+}
+
+// TestBlipStreamedProposeChanges verifies the statuses of a large proposeChanges message are streamed in
+// proposeChangesStatus messages when the client asks for it, omitting chunks with no non-zero statuses.
+func TestBlipStreamedProposeChanges(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{noConflictsMode: true})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for _, docID := range []string{"doc0", "doc2500"} {
+		response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/"+docID, `{}`)
+		assertStatus(t, response, http.StatusCreated)
+	}
+
+	var statusLock sync.Mutex
+	statusesByOffset := make(map[string][]int)
+	bt.blipContext.HandlerForProfile[db.MessageProposeStatus] = func(request *blip.Message) {
+		var statuses []int
+		require.NoError(t, request.ReadJSONBody(&statuses))
+		statusLock.Lock()
+		statusesByOffset[request.Properties[db.ProposeStatusOffset]] = statuses
+		statusLock.Unlock()
+		request.Response().SetBody([]byte{})
+	}
+
+	changes := make([][]interface{}, 3000)
+	for i := range changes {
+		changes[i] = []interface{}{fmt.Sprintf("doc%d", i), "1-abc"}
+	}
+	request := blip.NewRequest()
+	request.SetProfile(db.MessageProposeChanges)
+	request.Properties[db.ProposeChangesStream] = "true"
+	require.NoError(t, request.SetJSONBody(changes))
+	require.True(t, bt.sender.Send(request))
+	response := request.Response()
+	assert.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "true", response.Properties[db.ProposeChangesResponseStream])
+	body, err := response.Body()
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(body))
+
+	expectedChunk := make([]int, 501)
+	expectedChunk[500] = 409
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	assert.Equal(t, map[string][]int{"0": {409}, "2000": expectedChunk}, statusesByOffset)
+}
+
+// caughtUpEventRecorder is an event handler recording replication caught up events.
+type caughtUpEventRecorder struct {
+	events chan db.Body
+}
+
+func (r *caughtUpEventRecorder) HandleEvent(event db.Event) bool {
+	if caughtUpEvent, ok := event.(*db.ReplicationCaughtUpEvent); ok {
+		r.events <- caughtUpEvent.Doc
+	}
+	return true
+}
+
+func (r *caughtUpEventRecorder) String() string {
+	return "caughtUpEventRecorder"
+}
+
+// TestBlipReplicationCaughtUpEvent verifies a replication caught up event is raised once when a continuous feed first
+// catches up, and that the connection is counted as caught up.
+func TestBlipReplicationCaughtUpEvent(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg, base.KeyEvents)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	recorder := &caughtUpEventRecorder{events: make(chan db.Body, 10)}
+	eventMgr := bt.restTester.GetDatabase().EventMgr
+	eventMgr.RegisterEventHandler(recorder, db.ReplicationCaughtUp)
+	eventMgr.Start(0, -1)
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	changesReceived := make(chan []interface{}, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		for _, change := range changes {
+			changesReceived <- change
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+	subChangesRequest.Properties[db.SubChangesSession] = "session1"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case event := <-recorder.events:
+		assert.Equal(t, "db", event["dbname"])
+		assert.Equal(t, "session1", event["session"])
+		assert.Equal(t, "1", event["seq"])
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for caught up event")
+	}
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyCaughtUpConnections)))
+
+	// A change sent after the feed caught up doesn't raise another event
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc2", `{}`)
+	assertStatus(t, response, http.StatusCreated)
+	timeout := time.After(10 * time.Second)
+	for doc2Received := false; !doc2Received; {
+		select {
+		case change := <-changesReceived:
+			doc2Received = change[1] == "doc2"
+		case <-timeout:
+			t.Fatal("Timed out waiting for change")
+		}
+	}
+	select {
+	case event := <-recorder.events:
+		t.Fatalf("Unexpected caught up event: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestBlipRevIfMatch verifies an ifMatch rev is rejected when the server's current revision changes between
+// proposeChanges and rev, even though its history would otherwise be accepted as a conflicting branch.
+func TestBlipRevIfMatch(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+	rev1 := respRevID(t, response)
+
+	proposeRequest := blip.NewRequest()
+	proposeRequest.SetProfile(db.MessageProposeChanges)
+	proposeRequest.SetBody([]byte(`[["doc1", "2-abc", "` + rev1 + `"]]`))
+	require.True(t, bt.sender.Send(proposeRequest))
+	body, err := proposeRequest.Response().Body()
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(body))
+
+	// The server's revision changes before the client pushes the rev it proposed
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1?rev="+rev1, `{"value": 2}`)
+	assertStatus(t, response, http.StatusCreated)
+	rev2 := respRevID(t, response)
+
+	sendRev := func(revID string, history string, ifMatch string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageRev)
+		request.Properties[db.RevMessageId] = "doc1"
+		request.Properties[db.RevMessageRev] = revID
+		request.Properties[db.RevMessageHistory] = history
+		request.Properties[db.RevMessageIfMatch] = ifMatch
+		request.SetBody([]byte(`{"value": 3}`))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	revResponse := sendRev("2-abc", rev1, rev1)
+	assert.Equal(t, "409", revResponse.Properties["Error-Code"])
+	assert.Equal(t, rev2, revResponse.Properties[db.RevResponseExistingRev])
+
+	revResponse = sendRev("3-abc", rev2, rev2)
+	assert.Equal(t, "", revResponse.Properties["Error-Code"])
+
+	// Retrying a rev that's already current succeeds
+	revResponse = sendRev("3-abc", rev2, rev2)
+	assert.Equal(t, "", revResponse.Properties["Error-Code"])
+
+	response = bt.restTester.SendAdminRequest(http.MethodGet, "/db/doc1", "")
+	assertStatus(t, response, http.StatusOK)
+	var doc db.Body
+	require.NoError(t, base.JSONUnmarshal(response.BodyBytes(), &doc))
+	assert.Equal(t, "3-abc", doc[db.BodyRev])
+
+	request := blip.NewRequest()
+	request.SetProfile(db.MessageRev)
+	request.Properties[db.RevMessageId] = "doc1"
+	request.Properties[db.RevMessageRev] = "4-abc"
+	request.Properties[db.RevMessageHistory] = "3-abc"
+	request.Properties[db.RevMessageIfMatch] = "3-abc"
+	request.Properties[db.RevMessageIfAbsent] = "true"
+	request.SetBody([]byte(`{}`))
+	require.True(t, bt.sender.Send(request))
+	assert.Equal(t, "400", request.Response().Properties["Error-Code"])
+}
+
+// Reconcile a client's manifest against the server's docs, and verify each kind of discrepancy is reported.
+func TestBlipReconcile(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	revIDs := make(map[string]string)
+	for _, docID := range []string{"docA", "docB", "docC", "docD"} {
+		response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/"+docID, `{"value":1}`)
+		assertStatus(t, response, http.StatusCreated)
+		revIDs[docID] = respRevID(t, response)
+	}
+	bodyHash := base.Crc32cHashString([]byte(`{"value":1}`))
+
+	sendReconcile := func(after, through string, manifest string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageReconcile)
+		if after != "" {
+			request.Properties[db.ReconcileAfter] = after
+		}
+		if through != "" {
+			request.Properties[db.ReconcileThrough] = through
+		}
+		request.SetBody([]byte(manifest))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	manifest := `[["docZ", "1-abc"],
+		["docA", "` + revIDs["docA"] + `", "` + bodyHash + `"],
+		["docB", "1-abc"],
+		["docD", "` + revIDs["docD"] + `", "0xbad"]]`
+	response := sendReconcile("", "", manifest)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "", response.Properties[db.ReconcileResumeAfter])
+	var discrepancies []db.ReconcileDiscrepancy
+	require.NoError(t, response.ReadJSONBody(&discrepancies))
+	assert.Equal(t, []db.ReconcileDiscrepancy{
+		{DocID: "docB", Kind: db.ReconcileRevMismatch, ServerRev: revIDs["docB"], ClientRev: "1-abc"},
+		{DocID: "docC", Kind: db.ReconcileServerOnly, ServerRev: revIDs["docC"]},
+		{DocID: "docD", Kind: db.ReconcileBodyMismatch, ServerRev: revIDs["docD"], ClientRev: revIDs["docD"]},
+		{DocID: "docZ", Kind: db.ReconcileClientOnly, ClientRev: "1-abc"},
+	}, discrepancies)
+
+	// Only the docs in the range are reconciled
+	response = sendReconcile("docA", "docC", `[["docB", "`+revIDs["docB"]+`"]]`)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	discrepancies = nil
+	require.NoError(t, response.ReadJSONBody(&discrepancies))
+	assert.Equal(t, []db.ReconcileDiscrepancy{
+		{DocID: "docC", Kind: db.ReconcileServerOnly, ServerRev: revIDs["docC"]},
+	}, discrepancies)
+
+	response = sendReconcile("docA", "docC", `[["docD", "`+revIDs["docD"]+`"]]`)
+	assert.Equal(t, "400", response.Properties["Error-Code"])
+
+	dbStats := bt.restTester.GetDatabase().DbStats.StatsDatabase()
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(dbStats.Get(base.StatKeyReconcileCount)))
+	assert.Equal(t, int64(5), base.ExpvarVar2Int(dbStats.Get(base.StatKeyReconcileDiscrepancies)))
+}
+
+// Set and get an opaque checkpoint, whose body is stored and returned as-is rather than as JSON.
+func TestBlipOpaqueCheckpoint(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	getCheckpoint := func(opaque bool) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageGetCheckpoint)
+		request.Properties[db.GetCheckpointClient] = "testclient"
+		if opaque {
+			request.Properties[db.GetCheckpointOpaque] = "true"
+		}
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	checkpointBody := []byte{0x08, 0x96, 0x01, 0x00, 0xff}
+	setCheckpoint := db.NewSetCheckpointMessage()
+	setCheckpoint.SetClient("testclient")
+	setCheckpoint.SetOpaque(true)
+	setCheckpoint.SetBody(checkpointBody)
+	require.True(t, bt.sender.Send(setCheckpoint.Message))
+	setResponse := db.SetCheckpointResponse{Message: setCheckpoint.Response()}
+	require.Equal(t, "", setResponse.Properties["Error-Code"])
+	assert.Equal(t, "0-1", setResponse.Rev())
+
+	response := getCheckpoint(true)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "0-1", response.Properties[db.GetCheckpointResponseRev])
+	assert.Equal(t, "true", response.Properties[db.GetCheckpointOpaque])
+	body, err := response.Body()
+	require.NoError(t, err)
+	assert.Equal(t, checkpointBody, body)
+
+	// An opaque checkpoint can't be returned as JSON
+	response = getCheckpoint(false)
+	assert.Equal(t, "406", response.Properties["Error-Code"])
+
+	// Replacing it with a JSON checkpoint still tracks the rev, and it can then be returned either way
+	setCheckpoint = db.NewSetCheckpointMessage()
+	setCheckpoint.SetClient("testclient")
+	setCheckpoint.SetRev("0-1")
+	setCheckpoint.SetBody([]byte(`{"remote":10}`))
+	require.True(t, bt.sender.Send(setCheckpoint.Message))
+	setResponse = db.SetCheckpointResponse{Message: setCheckpoint.Response()}
+	require.Equal(t, "", setResponse.Properties["Error-Code"])
+	assert.Equal(t, "0-2", setResponse.Rev())
+
+	response = getCheckpoint(false)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	body, err = response.Body()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"remote":10}`, string(body))
+
+	response = getCheckpoint(true)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	assert.Equal(t, "0-2", response.Properties[db.GetCheckpointResponseRev])
+	body, err = response.Body()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"remote":10}`, string(body))
+}
+
+// TestBlipRevocations verifies a client that asks for revocations is sent the docs its user can no longer see after
+// losing access to a channel, but not those still visible through another channel.
+func TestBlipRevocations(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxRevocations := uint32(10)
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:         `function(doc) {channel(doc.channels);}`,
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxRevocations: &maxRevocations}},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a", "b"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"channels": ["a"]}`)
+	assertStatus(t, response, http.StatusCreated)
+	doc1Rev := respRevID(t, response)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc2", `{"channels": ["a", "b"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc3", `{"channels": ["b"]}`), http.StatusCreated)
+
+	revoked := make(chan *blip.Message, 10)
+	bt.blipContext.HandlerForProfile[db.MessageRevoked] = func(request *blip.Message) {
+		revoked <- request
+	}
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		if !request.NoReply() {
+			request.Response().SetBody([]byte("[]"))
+		}
+	}
+
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	var capabilities db.CapabilitiesBody
+	require.NoError(t, capabilitiesRequest.Response().ReadJSONBody(&capabilities))
+	assert.True(t, capabilities.Revocations)
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+	subChangesRequest.Properties[db.SubChangesRevokes] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_user/user1", `{"admin_channels": ["b"]}`), http.StatusOK)
+
+	// The user is refreshed by the next request that checks for access changes
+	var revokedRequest *blip.Message
+	timeout := time.After(10 * time.Second)
+	for revokedRequest == nil {
+		reconcileRequest := blip.NewRequest()
+		reconcileRequest.SetProfile(db.MessageReconcile)
+		reconcileRequest.SetBody([]byte("[]"))
+		require.True(t, bt.sender.Send(reconcileRequest))
+		reconcileRequest.Response()
+		select {
+		case revokedRequest = <-revoked:
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Timed out waiting for revoked message")
+		}
+	}
+	assert.Equal(t, "", revokedRequest.Properties[db.RevokedTruncated])
+	var revocations [][]string
+	require.NoError(t, revokedRequest.ReadJSONBody(&revocations))
+	assert.Equal(t, [][]string{{"doc1", doc1Rev}}, revocations)
+
+	pullStats := rt.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyRevokedDocsSent)))
+}
+
+// TestBlipRevMaxJSONDepth verifies a pushed rev whose body is nested deeper than the configured maximum is rejected.
+func TestBlipRevMaxJSONDepth(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxDepth := uint32(3)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxJSONDepth: &maxDepth}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	sendRev := func(docID string, body string) *blip.Message {
+		revRequest := blip.NewRequest()
+		revRequest.SetProfile(db.MessageRev)
+		revRequest.Properties[db.RevMessageId] = docID
+		revRequest.Properties[db.RevMessageRev] = "1-abc"
+		revRequest.SetBody([]byte(body))
+		require.True(t, bt.sender.Send(revRequest))
+		return revRequest.Response()
+	}
+
+	response := sendRev("doc1", `{"a": {"b": [1, 2]}, "c": "{[{[{["}`)
+	assert.Equal(t, "", response.Properties["Error-Code"])
+
+	response = sendRev("doc2", `{"a": {"b": [1, {"c": 2}]}}`)
+	assert.Equal(t, "400", response.Properties["Error-Code"])
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc2", ""), http.StatusNotFound)
+
+	pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyRevDepthRejected)))
+}
+
+// TestBlipSubChangesExcludeChannels verifies a wildcard subscription doesn't send docs only in its excluded channels,
+// and that only accessible channels may be excluded.
+func TestBlipSubChangesExcludeChannels(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:       `function(doc) {channel(doc.channels);}`,
+		noAdminParty: true,
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a", "b"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/docA", `{"channels": ["a"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/docB", `{"channels": ["b"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/docAB", `{"channels": ["a", "b"]}`), http.StatusCreated)
+
+	docIDs := make(chan string, 10)
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if len(changes) == 0 {
+			close(caughtUp)
+			return
+		}
+		for _, change := range changes {
+			docIDs <- change[1].(string)
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChanges := func(exclude string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		subChangesRequest.Properties[db.SubChangesExclude] = exclude
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest.Response()
+	}
+
+	assert.Equal(t, "400", subChanges("b,c").Properties["Error-Code"])
+
+	require.Equal(t, "", subChanges("b").Properties["Error-Code"])
+	var received []string
+	timeout := time.After(10 * time.Second)
+	for len(received) < 2 {
+		select {
+		case docID := <-docIDs:
+			received = append(received, docID)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for changes, received %v", received)
+		}
+	}
+	select {
+	case <-caughtUp:
+	case <-timeout:
+		t.Fatal("Timed out waiting for caught up")
+	}
+	assert.ElementsMatch(t, []string{"docA", "docAB"}, received)
+	assert.Len(t, docIDs, 0)
+
+	pullStats := rt.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyExcludedChannelChanges)))
+}
+
+// Test that a subChanges request with a named/<name> filter sends only the changes matching the named filter's
+// channels and expression, and that unknown names are rejected.
+func TestBlipSubChangesNamedFilter(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:       `function(doc) {channel(doc.channels);}`,
+		noAdminParty: true,
+		DatabaseConfig: &DbConfig{
+			NamedFilters: db.NamedFilters{
+				"urgent": {Channels: []string{"a"}, Expression: "doc.priority > 5"},
+			},
+		},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a", "b"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/urgentA", `{"channels": ["a"], "priority": 9}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/routineA", `{"channels": ["a"], "priority": 1}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/urgentB", `{"channels": ["b"], "priority": 9}`), http.StatusCreated)
+
+	docIDs := make(chan string, 10)
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if len(changes) == 0 {
+			close(caughtUp)
+			return
+		}
+		for _, change := range changes {
+			docIDs <- change[1].(string)
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChanges := func(filter string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		subChangesRequest.Properties[db.SubChangesFilter] = filter
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest.Response()
+	}
+
+	assert.Equal(t, "400", subChanges(db.NamedFilterPrefix + "missing").Properties["Error-Code"])
+
+	require.Equal(t, "", subChanges(db.NamedFilterPrefix + "urgent").Properties["Error-Code"])
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for caught up")
+	}
+	require.Len(t, docIDs, 1)
+	assert.Equal(t, "urgentA", <-docIDs)
+
+	namedFilterUses := rt.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyNamedFilterUses).(*expvar.Map)
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(namedFilterUses.Get("urgent")))
+	assert.Nil(t, namedFilterUses.Get("missing"))
+}
+
+// TestBlipChannelMembership verifies that revs sent to a subscription asking for channel membership list the channels
+// their doc entered and left relative to the parent revision, without revealing channels the user can't see.
+func TestBlipChannelMembership(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:       `function(doc) {channel(doc.channels);}`,
+		noAdminParty: true,
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a", "b"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db/moved", `{"channels": ["a", "c"]}`)
+	assertStatus(t, response, http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/moved?rev="+respRevID(t, response), `{"channels": ["b"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/created", `{"channels": ["a"]}`), http.StatusCreated)
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+
+	revs := make(chan blip.Properties, 10)
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		revs <- request.Properties
+	}
+
+	var capabilities db.CapabilitiesBody
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	require.NoError(t, capabilitiesRequest.Response().ReadJSONBody(&capabilities))
+	assert.True(t, capabilities.ChannelMembership)
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesMembership] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	received := make(map[string]blip.Properties)
+	timeout := time.After(10 * time.Second)
+	for len(received) < 2 {
+		select {
+		case properties := <-revs:
+			received[properties[db.RevMessageId]] = properties
+		case <-timeout:
+			t.Fatalf("Timed out waiting for revs, received %v", received)
+		}
+	}
+
+	// Channel c isn't visible to the user, so isn't listed as left
+	assert.Equal(t, "b", received["moved"][db.RevMessageEntered])
+	assert.Equal(t, "a", received["moved"][db.RevMessageLeft])
+	assert.Equal(t, "a", received["created"][db.RevMessageEntered])
+	assert.NotContains(t, received["created"], db.RevMessageLeft)
+}
+
+// TestBlipGetAttachmentRangeCompressed verifies that a ranged getAttachment sends the requested range, compressed
+// when the client accepts gzip and compression is worthwhile, and uncompressed for a small tail range.
+func TestBlipGetAttachmentRangeCompressed(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	attachment := []byte(strings.Repeat("All work and no play makes Jack a dull boy. ", 100))
+	attachmentJSON := fmt.Sprintf(`{"_attachments": {"att.txt": {"data": %q}}}`, base64.StdEncoding.EncodeToString(attachment))
+	assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", attachmentJSON), http.StatusCreated)
+	digest := db.Sha1DigestKey(attachment)
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+
+	getRange := func(offset, length int) *blip.Message {
+		getAttachmentRequest := blip.NewRequest()
+		getAttachmentRequest.SetProfile(db.MessageGetAttachment)
+		getAttachmentRequest.Properties[db.GetAttachmentDigest] = digest
+		getAttachmentRequest.Properties[db.GetAttachmentAccept] = db.AttachmentEncodingGzip
+		getAttachmentRequest.Properties[db.GetAttachmentOffset] = strconv.Itoa(offset)
+		if length > 0 {
+			getAttachmentRequest.Properties[db.GetAttachmentLength] = strconv.Itoa(length)
+		}
+		require.True(t, bt.sender.Send(getAttachmentRequest))
+		return getAttachmentRequest.Response()
+	}
+
+	// Attachments may only be fetched while the rev referencing them is being sent
+	revReceived := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		defer close(revReceived)
+
+		response := getRange(1000, 2000)
+		require.Equal(t, "", response.Properties["Error-Code"])
+		assert.Equal(t, db.AttachmentEncodingGzip, response.Properties[db.GetAttachmentEncoding])
+		assert.Equal(t, "1000", response.Properties[db.GetAttachmentRangeOffset])
+		assert.Equal(t, "2000", response.Properties[db.GetAttachmentRangeLength])
+		assert.Equal(t, strconv.Itoa(len(attachment)), response.Properties[db.GetAttachmentTotalLength])
+		body, err := response.Body()
+		require.NoError(t, err)
+		assert.Less(t, len(body), 2000)
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		decoded, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, attachment[1000:3000], decoded)
+
+		// A tail too small to be worth compressing is sent as is
+		response = getRange(len(attachment)-10, 0)
+		require.Equal(t, "", response.Properties["Error-Code"])
+		assert.Equal(t, "", response.Properties[db.GetAttachmentEncoding])
+		assert.Equal(t, "10", response.Properties[db.GetAttachmentRangeLength])
+		body, err = response.Body()
+		require.NoError(t, err)
+		assert.Equal(t, attachment[len(attachment)-10:], body)
+
+		assert.Equal(t, "416", getRange(len(attachment)+1, 0).Properties["Error-Code"])
+
+		request.Response().SetBody([]byte{})
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-revReceived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for rev")
+	}
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyAttCompressedPull)))
+}
+
+// TestBlipGetAttachmentStartEndRange verifies that a getAttachment range given by start and end sends just that part
+// of the attachment, and that ranges outside the attachment are rejected.
+func TestBlipGetAttachmentStartEndRange(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	attachment := []byte(strings.Repeat("0123456789", 10))
+	attachmentJSON := fmt.Sprintf(`{"_attachments": {"att.txt": {"data": %q}}}`, base64.StdEncoding.EncodeToString(attachment))
+	assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", attachmentJSON), http.StatusCreated)
+	digest := db.Sha1DigestKey(attachment)
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+
+	getRange := func(properties blip.Properties) *blip.Message {
+		getAttachmentRequest := blip.NewRequest()
+		getAttachmentRequest.SetProfile(db.MessageGetAttachment)
+		getAttachmentRequest.Properties[db.GetAttachmentDigest] = digest
+		for name, value := range properties {
+			getAttachmentRequest.Properties[name] = value
+		}
+		require.True(t, bt.sender.Send(getAttachmentRequest))
+		return getAttachmentRequest.Response()
+	}
+
+	// Attachments may only be fetched while the rev referencing them is being sent
+	revReceived := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		defer close(revReceived)
+
+		response := getRange(blip.Properties{db.GetAttachmentStart: "20", db.GetAttachmentEnd: "35"})
+		require.Equal(t, "", response.Properties["Error-Code"])
+		assert.Equal(t, "20", response.Properties[db.GetAttachmentRangeOffset])
+		assert.Equal(t, "15", response.Properties[db.GetAttachmentRangeLength])
+		assert.Equal(t, strconv.Itoa(len(attachment)), response.Properties[db.GetAttachmentTotalLength])
+		body, err := response.Body()
+		require.NoError(t, err)
+		assert.Equal(t, attachment[20:35], body)
+
+		// Without an end, the rest of the attachment is sent
+		response = getRange(blip.Properties{db.GetAttachmentStart: "90"})
+		require.Equal(t, "", response.Properties["Error-Code"])
+		body, err = response.Body()
+		require.NoError(t, err)
+		assert.Equal(t, attachment[90:], body)
+
+		outOfBounds := strconv.Itoa(len(attachment) + 1)
+		for _, properties := range []blip.Properties{
+			{db.GetAttachmentStart: outOfBounds},
+			{db.GetAttachmentStart: "10", db.GetAttachmentEnd: outOfBounds},
+			{db.GetAttachmentStart: "30", db.GetAttachmentEnd: "20"},
+			{db.GetAttachmentStart: "10", db.GetAttachmentOffset: "10"},
+		} {
+			assert.Equal(t, "400", getRange(properties).Properties["Error-Code"], "%v", properties)
+		}
+
+		request.Response().SetBody([]byte{})
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-revReceived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for rev")
+	}
+}
+
+// TestBlipSubChangesPacing verifies that changes are spread at the rate a subChanges request's maxChangesPerSecond
+// asks for.
+func TestBlipSubChangesPacing(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for i := 0; i < 4; i++ {
+		assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, fmt.Sprintf("/db/doc%d", i), `{}`), http.StatusCreated)
+	}
+
+	batchSizes := make(chan int, 10)
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if len(changes) == 0 {
+			close(caughtUp)
+			return
+		}
+		batchSizes <- len(changes)
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	start := time.Now()
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesPacing] = "2"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for caught up")
+	}
+
+	// Batches are kept to a second's worth of changes, and the second waits for the first's second to pass
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(900*time.Millisecond))
+	for i := len(batchSizes); i > 0; i-- {
+		assert.LessOrEqual(t, <-batchSizes, 2)
+	}
+	pacingDelay := base.ExpvarVar2Int(bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyChangesPacingDelay))
+	assert.Greater(t, pacingDelay, int64(0))
+}
+
+// TestBlipPurgeBatch verifies a user allowed to purge may only purge docs whose every channel they can access, and
+// can fetch a finished job's statuses again with its token.
+func TestBlipPurgeBatch(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg, base.KeyCRUD)()
+
+	allowUserPurge := true
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:         `function(doc) {channel(doc.channels);}`,
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{AllowUserPurge: &allowUserPurge}},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"channels": ["a"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc2", `{"channels": ["a", "b"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc3", `{"channels": []}`), http.StatusCreated)
+
+	sendPurgeBatch := func(token, since, body string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessagePurgeBatch)
+		if token != "" {
+			request.Properties[db.PurgeBatchToken] = token
+		}
+		if since != "" {
+			request.Properties[db.PurgeBatchSince] = since
+		}
+		request.SetBody([]byte(body))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	response := sendPurgeBatch("", "", `[]`)
+	assert.Equal(t, "400", response.Properties["Error-Code"])
+
+	response = sendPurgeBatch("", "", `["doc1", "doc2", "doc3", "missing"]`)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	token := response.Properties[db.PurgeBatchToken]
+	assert.NotEqual(t, "", token)
+	assert.Equal(t, "4", response.Properties[db.PurgeBatchCursor])
+	assert.Equal(t, "true", response.Properties[db.PurgeBatchDone])
+	var statuses [][]interface{}
+	require.NoError(t, response.ReadJSONBody(&statuses))
+	expected := [][]interface{}{{"doc1", 200.0}, {"doc2", 403.0}, {"doc3", 403.0}, {"missing", 404.0}}
+	assert.Equal(t, expected, statuses)
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc1", ""), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc2", ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc3", ""), http.StatusOK)
+
+	// A client that missed the response resumes the job to fetch the statuses it hasn't seen
+	response = sendPurgeBatch(token, "2", "")
+	require.Equal(t, "", response.Properties["Error-Code"])
+	require.NoError(t, response.ReadJSONBody(&statuses))
+	assert.Equal(t, expected[2:], statuses)
+	response = sendPurgeBatch(token, "5", "")
+	assert.Equal(t, "400", response.Properties["Error-Code"])
+	response = sendPurgeBatch("unknown", "", "")
+	assert.Equal(t, "404", response.Properties["Error-Code"])
+
+	purged := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsDatabase().Get(base.StatKeyPurgeBatchDocs))
+	assert.Equal(t, int64(1), purged)
+}
+
+// TestBlipConnectionSecurityPolicy verifies a connection below the security policy may not replicate, but may still
+// ask for the server's capabilities.
+func TestBlipConnectionSecurityPolicy(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	requireClientCert := true
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{RequireClientCert: &requireClientCert}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	assert.Equal(t, "", capabilitiesRequest.Response().Properties["Error-Code"])
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "403", subChangesRequest.Response().Properties["Error-Code"])
+
+	revRequest := blip.NewRequest()
+	revRequest.SetProfile(db.MessageRev)
+	revRequest.Properties[db.RevMessageId] = "doc1"
+	revRequest.Properties[db.RevMessageRev] = "1-abc"
+	revRequest.SetBody([]byte(`{}`))
+	require.True(t, bt.sender.Send(revRequest))
+	assert.Equal(t, "403", revRequest.Response().Properties["Error-Code"])
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/doc1", ""), http.StatusNotFound)
+
+	// Bodies can't be fetched with getRev either
+	response := rt.SendAdminRequest(http.MethodPut, "/db/doc2", `{"secret": true}`)
+	assertStatus(t, response, http.StatusCreated)
+	getRevRequest := blip.NewRequest()
+	getRevRequest.SetProfile(db.MessageGetRev)
+	getRevRequest.Properties[db.GetRevMessageId] = "doc2"
+	getRevRequest.Properties[db.GetRevMessageRev] = respRevID(t, response)
+	require.True(t, bt.sender.Send(getRevRequest))
+	assert.Equal(t, "403", getRevRequest.Response().Properties["Error-Code"])
+
+	// The connection is counted once, however many of its messages are refused
+	rejected := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsDatabase().Get(base.StatKeySecurityRejected))
+	assert.Equal(t, int64(1), rejected)
+}
+
+// TestBlipRevChunks verifies a rev body larger than the client's chunk size is sent in chunks that reassemble into
+// the body, verified by the final chunk's checksum, while smaller bodies are sent whole.
+func TestBlipRevChunks(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	largeValue := strings.Repeat("x", 3*db.MinRevChunkSize)
+	assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, "/db/large", `{"value": "`+largeValue+`"}`), http.StatusCreated)
+	assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, "/db/small", `{"value": "x"}`), http.StatusCreated)
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+	revs := make(chan *blip.Message, 10)
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		revs <- request
+	}
+	chunks := make(chan *blip.Message, 10)
+	bt.blipContext.HandlerForProfile[db.MessageRevChunk] = func(request *blip.Message) {
+		chunks <- request
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesChunkSize] = "100" // Raised to the minimum
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	received := make(map[string]*blip.Message)
+	timeout := time.After(10 * time.Second)
+	for len(received) < 2 {
+		select {
+		case rev := <-revs:
+			received[rev.Properties[db.RevMessageId]] = rev
+		case <-timeout:
+			t.Fatalf("Timed out waiting for revs, received %v", received)
+		}
+	}
+
+	assert.NotContains(t, received["small"].Properties, db.RevMessageChunks)
+	smallBody, err := received["small"].Body()
+	require.NoError(t, err)
+	assert.Contains(t, string(smallBody), `"value":"x"`)
+
+	large := received["large"]
+	require.Equal(t, "4", large.Properties[db.RevMessageChunks])
+	body, err := large.Body()
+	require.NoError(t, err)
+	assert.Len(t, body, db.MinRevChunkSize)
+	pieces := make([][]byte, 4)
+	pieces[0] = body
+	var checksum string
+	for i := 1; i < 4; i++ {
+		select {
+		case chunk := <-chunks:
+			assert.Equal(t, "large", chunk.Properties[db.RevChunkId])
+			index, err := strconv.Atoi(chunk.Properties[db.RevChunkIndex])
+			require.NoError(t, err)
+			pieces[index], err = chunk.Body()
+			require.NoError(t, err)
+			if index == 3 {
+				checksum = chunk.Properties[db.RevChunkChecksum]
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for rev chunks")
+		}
+	}
+	reassembled := bytes.Join(pieces, nil)
+	assert.Equal(t, large.Properties[db.RevMessageBodyLength], strconv.Itoa(len(reassembled)))
+	assert.Equal(t, base.Crc32cHashString(reassembled), checksum)
+	var doc db.Body
+	require.NoError(t, base.JSONUnmarshal(reassembled, &doc))
+	assert.Equal(t, largeValue, doc["value"])
+
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyRevChunkedCount)))
+	assert.Equal(t, int64(4), base.ExpvarVar2Int(pullStats.Get(base.StatKeyRevChunksSent)))
+}
+
+// TestBlipGetAccess verifies a user can query its current channels and roles, but not another user's, and that an
+// admin connection can query on a user's behalf.
+func TestBlipGetAccess(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"b", "a"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	getAccess := func(sender *blip.Sender, user string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageGetAccess)
+		if user != "" {
+			request.Properties[db.GetAccessUser] = user
+		}
+		require.True(t, sender.Send(request))
+		return request.Response()
+	}
+
+	response := getAccess(bt.sender, "")
+	require.Equal(t, "", response.Properties["Error-Code"])
+	var access db.AccessBody
+	require.NoError(t, response.ReadJSONBody(&access))
+	assert.Equal(t, db.AccessBody{Name: "user1", Channels: []string{"!", "a", "b"}, Roles: []string{}}, access)
+	assert.Equal(t, "403", getAccess(bt.sender, "user2").Properties["Error-Code"])
+
+	// A grant made since the connection authenticated is reflected once the user change is seen
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_role/role1", `{"admin_channels": ["c"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_user/user1", `{"admin_channels": ["a", "b"], "admin_roles": ["role1"]}`), http.StatusOK)
+	timeout := time.After(10 * time.Second)
+	for len(access.Roles) == 0 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			require.NoError(t, getAccess(bt.sender, "user1").ReadJSONBody(&access))
+		case <-timeout:
+			t.Fatal("Timed out waiting for the role grant")
+		}
+	}
+	assert.Equal(t, db.AccessBody{Name: "user1", Channels: []string{"!", "a", "b", "c"}, Roles: []string{"role1"}}, access)
+
+	// Admin connections query on behalf of a named user
+	adminBt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer adminBt.Close()
+	assertStatus(t, adminBt.restTester.SendAdminRequest(http.MethodPut, "/db/_user/user1", `{"password": "1234", "admin_channels": ["a"]}`), http.StatusCreated)
+	assert.Equal(t, "400", getAccess(adminBt.sender, "").Properties["Error-Code"])
+	assert.Equal(t, "404", getAccess(adminBt.sender, "user2").Properties["Error-Code"])
+	require.NoError(t, getAccess(adminBt.sender, "user1").ReadJSONBody(&access))
+	assert.Equal(t, db.AccessBody{Name: "user1", Channels: []string{"!", "a"}, Roles: []string{}}, access)
+}
+
+// TestBlipRevReservedFields verifies pushed revs whose bodies carry forged metadata are rejected or stripped, as
+// configured, while the reserved properties a pushed body may carry are still accepted.
+func TestBlipRevReservedFields(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	crafted := map[string]string{
+		"sync":      `{"value": 1, "_sync": {"rev": "9-forged", "sequence": 1}}`,
+		"rev":       `{"value": 1, "_rev": "9-forged"}`,
+		"revisions": `{"value": 1, "_revisions": {"start": 9, "ids": ["forged"]}}`,
+		"custom":    `{"value": 1, "_private": true}`,
+	}
+
+	for _, policy := range []string{db.ReservedFieldsReject, db.ReservedFieldsStrip} {
+		t.Run(policy, func(t *testing.T) {
+			reservedFields := policy
+			rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{ReservedFields: &reservedFields}}})
+			defer rt.Close()
+
+			bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+			require.NoError(t, err, "Error creating BlipTester")
+			defer bt.Close()
+
+			for name, body := range crafted {
+				_, _, resp, err := bt.SendRev(name, "1-abc", []byte(body), blip.Properties{})
+				if policy == db.ReservedFieldsReject {
+					assert.Error(t, err, name)
+					assert.Equal(t, "400", resp.Properties["Error-Code"], name)
+					assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/"+name, ""), http.StatusNotFound)
+					continue
+				}
+				require.NoError(t, err, name)
+				response := rt.SendAdminRequest(http.MethodGet, "/db/"+name, "")
+				assertStatus(t, response, http.StatusOK)
+				var doc db.Body
+				require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &doc))
+				assert.Equal(t, "1-abc", doc[db.BodyRev], name)
+				assert.NotContains(t, doc, "_sync", name)
+				assert.NotContains(t, doc, "_private", name)
+				assert.NotContains(t, doc, db.BodyRevisions, name)
+			}
+
+			// Expiry is still accepted either way
+			_, _, _, err = bt.SendRev("expiring", "1-abc", []byte(`{"value": 1, "_exp": 3600}`), blip.Properties{})
+			require.NoError(t, err)
+
+			pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+			statKey := base.StatKeyReservedStripped
+			if policy == db.ReservedFieldsReject {
+				statKey = base.StatKeyReservedRejected
+			}
+			assert.Equal(t, int64(len(crafted)), base.ExpvarVar2Int(pushStats.Get(statKey)))
+		})
+	}
+}
+
+// TestBlipDeliveryIndex verifies each rev sent on a subscription that asks for delivery indexes carries the next
+// index, starting from 1.
+func TestBlipDeliveryIndex(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	const numDocs = 5
+	for i := 0; i < numDocs; i++ {
+		assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, fmt.Sprintf("/db/doc%d", i), `{"value": 1}`), http.StatusCreated)
+	}
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+	indexes := make(chan string, numDocs)
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		indexes <- request.Properties[db.RevMessageDelivery]
+	}
+
+	var capabilities db.CapabilitiesBody
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	require.NoError(t, capabilitiesRequest.Response().ReadJSONBody(&capabilities))
+	assert.True(t, capabilities.DeliveryIndex)
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesDelivery] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	received := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(received) < numDocs {
+		select {
+		case index := <-indexes:
+			received[index] = true
+		case <-timeout:
+			t.Fatalf("Timed out waiting for revs, received %v", received)
+		}
+	}
+	assert.Equal(t, map[string]bool{"1": true, "2": true, "3": true, "4": true, "5": true}, received)
+}
+
+// TestBlipFlushChanges verifies a flushChanges request is taken by a running subscription, and reports when there's
+// none.
+func TestBlipFlushChanges(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	flushChanges := func() string {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageFlushChanges)
+		require.True(t, bt.sender.Send(request))
+		response := request.Response()
+		require.Equal(t, "", response.Properties["Error-Code"])
+		return response.Properties[db.FlushChangesActive]
+	}
+	assert.Equal(t, "false", flushChanges())
+
+	caughtUp := make(chan struct{}, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if len(changes) == 0 {
+			caughtUp <- struct{}{}
+		}
+		if !request.NoReply() {
+			require.NoError(t, request.Response().SetJSONBody([]interface{}{}))
+		}
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the feed to catch up")
+	}
+
+	// The feed takes the request the next time it handles changes
+	assert.Equal(t, "true", flushChanges())
+	assertStatus(t, bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"value": 1}`), http.StatusCreated)
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	_, ok := base.WaitForStat(func() int64 {
+		return base.ExpvarVar2Int(pullStats.Get(base.StatKeyChangesFlushCount))
+	}, 1)
+	assert.True(t, ok)
+}
+
+// TestBlipPushDocLimit verifies revs for new docs are rejected with a 429 once a push session has touched the maximum
+// number of distinct docs, while revs for docs it's already pushed are still accepted.
+func TestBlipPushDocLimit(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxPushDocs := uint32(2)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxPushDocs: &maxPushDocs}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	_, _, _, err = bt.SendRev("doc1", "1-abc", []byte(`{"value": 1}`), blip.Properties{})
+	require.NoError(t, err)
+	_, _, _, err = bt.SendRev("doc2", "1-abc", []byte(`{"value": 1}`), blip.Properties{})
+	require.NoError(t, err)
+
+	_, _, response, err := bt.SendRev("doc3", "1-abc", []byte(`{"value": 1}`), blip.Properties{})
+	assert.Error(t, err)
+	assert.Equal(t, "429", response.Properties["Error-Code"])
+	assert.NotEqual(t, "", response.Properties[db.ErrorRetryAfter])
+
+	_, _, _, err = bt.SendRevWithHistory("doc1", "2-def", []string{"1-abc"}, []byte(`{"value": 2}`), blip.Properties{})
+	require.NoError(t, err)
+
+	pushStats := rt.GetDatabase().DbStats.CblReplicationPush()
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(pushStats.Get(base.StatKeyPushDocsTracked)))
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pushStats.Get(base.StatKeyPushDocsRejected)))
+}
+
+// TestBlipDocSummaries verifies a subscription that asks for summaries is sent each rev's summary, flagged as such, in
+// place of its full body, and that summaries can't be asked for unless they're configured.
+func TestBlipDocSummaries(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	unconfigured, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer unconfigured.Close()
+	request := blip.NewRequest()
+	request.SetProfile(db.MessageSubChanges)
+	request.Properties[db.SubChangesSummaries] = "true"
+	require.True(t, unconfigured.sender.Send(request))
+	assert.Equal(t, "400", request.Response().Properties["Error-Code"])
+
+	summaries := &db.DocSummaries{Fields: map[string][]string{"task": {"title"}, db.DocSummaryAnyType: {"name"}}}
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{DocSummaries: summaries}})
+	defer rt.Close()
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/task", `{"type": "task", "title": "Buy milk", "notes": "Semi-skimmed"}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/contact", `{"type": "contact", "name": "Alice", "phone": "555-0100"}`), http.StatusCreated)
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		response := make([][]interface{}, 0, len(changes))
+		for range changes {
+			response = append(response, []interface{}{})
+		}
+		require.NoError(t, request.Response().SetJSONBody(response))
+	}
+	revs := make(chan *blip.Message, 2)
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		revs <- request
+	}
+
+	var capabilities db.CapabilitiesBody
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	require.NoError(t, capabilitiesRequest.Response().ReadJSONBody(&capabilities))
+	assert.True(t, capabilities.Summaries)
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesSummaries] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	bodies := make(map[string]db.Body)
+	timeout := time.After(10 * time.Second)
+	for len(bodies) < 2 {
+		select {
+		case rev := <-revs:
+			assert.Equal(t, "true", rev.Properties[db.RevMessageSummary])
+			var body db.Body
+			require.NoError(t, rev.ReadJSONBody(&body))
+			bodies[rev.Properties[db.RevMessageId]] = body
+		case <-timeout:
+			t.Fatalf("Timed out waiting for revs, received %v", bodies)
+		}
+	}
+	assert.Equal(t, "Buy milk", bodies["task"]["title"])
+	assert.NotContains(t, bodies["task"], "notes")
+	assert.Equal(t, "Alice", bodies["contact"]["name"])
+	assert.NotContains(t, bodies["contact"], "phone")
+	for _, body := range bodies {
+		assert.Contains(t, body, db.BodySummary)
+	}
+	assert.Equal(t, int64(2), base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyRevSummariesSent)))
+}
+
+// TestBlipAttachmentRepeats verifies repeated getAttachment requests for a digest are served from the connection's
+// cache, or rejected beyond the limit, as configured.
+func TestBlipAttachmentRepeats(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	for _, policy := range []string{db.AttachmentRepeatCache, db.AttachmentRepeatLimit} {
+		t.Run(policy, func(t *testing.T) {
+			repeatPolicy, repeatLimit := policy, uint32(2)
+			rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{
+				AttachmentRepeatPolicy: &repeatPolicy,
+				AttachmentRepeatLimit:  &repeatLimit,
+			}}})
+			defer rt.Close()
+			bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+			require.NoError(t, err, "Error creating BlipTester")
+			defer bt.Close()
+
+			attachment := []byte("attachment data")
+			attachmentJSON := fmt.Sprintf(`{"_attachments": {"att.txt": {"data": %q}}}`, base64.StdEncoding.EncodeToString(attachment))
+			assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc1", attachmentJSON), http.StatusCreated)
+			digest := db.Sha1DigestKey(attachment)
+
+			bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+				var changes [][]interface{}
+				require.NoError(t, request.ReadJSONBody(&changes))
+				if request.NoReply() {
+					return
+				}
+				response := make([][]interface{}, 0, len(changes))
+				for range changes {
+					response = append(response, []interface{}{})
+				}
+				require.NoError(t, request.Response().SetJSONBody(response))
+			}
+
+			// Attachments may only be fetched while the rev referencing them is being sent
+			responses := make(chan *blip.Message, 3)
+			bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+				for i := 0; i < 3; i++ {
+					getAttachmentRequest := blip.NewRequest()
+					getAttachmentRequest.SetProfile(db.MessageGetAttachment)
+					getAttachmentRequest.Properties[db.GetAttachmentDigest] = digest
+					require.True(t, bt.sender.Send(getAttachmentRequest))
+					responses <- getAttachmentRequest.Response()
+				}
+				request.Response().SetBody([]byte{})
+			}
+
+			subChangesRequest := blip.NewRequest()
+			subChangesRequest.SetProfile(db.MessageSubChanges)
+			require.True(t, bt.sender.Send(subChangesRequest))
+			require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+			for i := 0; i < 3; i++ {
+				var response *blip.Message
+				select {
+				case response = <-responses:
+				case <-time.After(10 * time.Second):
+					t.Fatal("Timed out waiting for getAttachment response")
+				}
+				if policy == db.AttachmentRepeatLimit && i == 2 {
+					assert.Equal(t, "429", response.Properties["Error-Code"])
+					assert.NotEqual(t, "", response.Properties[db.ErrorRetryAfter])
+					continue
+				}
+				require.Equal(t, "", response.Properties["Error-Code"])
+				body, err := response.Body()
+				require.NoError(t, err)
+				assert.Equal(t, attachment, body)
+			}
+
+			pullStats := rt.GetDatabase().DbStats.StatsCblReplicationPull()
+			assert.Equal(t, int64(2), base.ExpvarVar2Int(pullStats.Get(base.StatKeyAttRepeatCount)))
+			if policy == db.AttachmentRepeatCache {
+				assert.Equal(t, int64(2), base.ExpvarVar2Int(pullStats.Get(base.StatKeyAttRepeatCacheHits)))
+				assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyAttRepeatCacheMisses)))
+			} else {
+				assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyAttRepeatRejected)))
+			}
+		})
+	}
+}
+
+// TestBlipProgressMilestones verifies a pull reaches a progress milestone when it's completed its initial sync.
+func TestBlipProgressMilestones(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	milestonePercent := uint32(100)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{ProgressMilestonePercent: &milestonePercent}}})
+	defer rt.Close()
+
+	const numDocs = 5
+	for i := 0; i < numDocs; i++ {
+		assertStatus(t, rt.SendAdminRequest(http.MethodPut, fmt.Sprintf("/db/doc%d", i), `{"value": 1}`), http.StatusCreated)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if request.NoReply() {
+			return
+		}
+		require.NoError(t, request.Response().SetJSONBody(make([]interface{}, len(changes))))
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	pullStats := rt.GetDatabase().DbStats.StatsCblReplicationPull()
+	_, ok := base.WaitForStat(func() int64 {
+		return base.ExpvarVar2Int(pullStats.Get(base.StatKeyProgressMilestones))
+	}, 1)
+	assert.True(t, ok)
+}
+
+// TestBlipSubChangesDocSize verifies a pull with a size range skips docs whose bodies are outside it, but still sends
+// tombstones, and that a range whose minimum exceeds its maximum is rejected.
+func TestBlipSubChangesDocSize(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/small", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/large", `{"value": "`+strings.Repeat("x", 500)+`"}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodPut, "/db/deleted", `{"value": "`+strings.Repeat("x", 500)+`"}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = bt.restTester.SendAdminRequest(http.MethodDelete, "/db/deleted?rev="+respRevID(t, response), "")
+	assertStatus(t, response, http.StatusOK)
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesMinSize] = "200"
+	subChangesRequest.Properties[db.SubChangesMaxSize] = "100"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "400", subChangesRequest.Response().Properties["Error-Code"])
+
+	var docIDs []string
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" {
+			close(caughtUp)
+			return
+		}
+		var changes [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		for _, change := range changes {
+			docIDs = append(docIDs, change[1].(string))
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChangesRequest = blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesMaxSize] = "100"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for changes")
+	}
+	assert.Equal(t, []string{"small", "deleted"}, docIDs)
+
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeyDocSizeSkipped)))
+}
+
+// TestBlipMultiplexedDatabases verifies a client can replicate a second database over its connection when it lists
+// it at handshake, and that requests for databases it didn't list are rejected.
+func TestBlipMultiplexedDatabases(t *testing.T) {
+	if !base.UnitTestUrlIsWalrus() {
+		t.Skip("Skip this test under integration testing")
+	}
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{
+		BlipSync: &BlipSyncConfig{MaxMultiplexedDatabases: base.Uint32Ptr(1)},
+	}})
+	defer rt.Close()
+
+	_, err := rt.ServerContext().AddDatabaseFromConfig(&DbConfig{
+		Name:         "db2",
+		BucketConfig: BucketConfig{Server: base.StringPtr("walrus:"), Bucket: base.StringPtr("db2")},
+		Users: map[string]*db.PrincipalConfig{
+			base.GuestUsername: {Disabled: false, ExplicitChannels: base.SetOf("*")},
+		},
+	})
+	require.NoError(t, err)
+	db2 := rt.ServerContext().Database("db2")
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db2/doc1", `{"value": 1}`)
+	assertStatus(t, response, http.StatusCreated)
+	require.NoError(t, db2.WaitForPendingChanges(context.TODO()))
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		restTester:       rt,
+		handshakeHeaders: map[string]string{db.BlipMultiplexHeader: "db2, db"},
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	capabilitiesBody, err := capabilitiesRequest.Response().Body()
+	require.NoError(t, err)
+	var capabilities db.CapabilitiesBody
+	require.NoError(t, base.JSONUnmarshal(capabilitiesBody, &capabilities))
+	assert.Equal(t, []string{"db2"}, capabilities.Databases)
+
+	var docIDs []string
+	caughtUp := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		assert.Equal(t, "db2", request.Properties[db.BlipDatabase])
+		body, err := request.Body()
+		require.NoError(t, err)
+		if string(body) == "null" {
+			close(caughtUp)
+			return
+		}
+		var changes [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		for _, change := range changes {
+			docIDs = append(docIDs, change[1].(string))
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.BlipDatabase] = "db2"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for changes")
+	}
+	assert.Equal(t, []string{"doc1"}, docIDs)
+
+	unknownRequest := blip.NewRequest()
+	unknownRequest.SetProfile(db.MessageSubChanges)
+	unknownRequest.Properties[db.BlipDatabase] = "db3"
+	require.True(t, bt.sender.Send(unknownRequest))
+	assert.Equal(t, "404", unknownRequest.Response().Properties["Error-Code"])
+
+	dbStats := db2.DbStats.StatsDatabase()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(dbStats.Get(base.StatKeyMultiplexedConnections)))
+	assert.True(t, base.ExpvarVar2Int(dbStats.Get(base.StatKeyMultiplexedMessages)) >= 1)
+}
+
+// TestBlipSubscriptionTTL verifies a continuous subscription with a TTL is ended once it elapses, that the client is
+// told so, and that it can then renew the subscription on the same connection.
+func TestBlipSubscriptionTTL(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		request.Response().SetBody([]byte("[]"))
+	}
+	expired := make(chan struct{}, 1)
+	bt.blipContext.HandlerForProfile[db.MessageSubExpired] = func(request *blip.Message) {
+		expired <- struct{}{}
+	}
+
+	subChanges := func(properties map[string]string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		for k, v := range properties {
+			subChangesRequest.Properties[k] = v
+		}
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest
+	}
+
+	oneShot := subChanges(map[string]string{db.SubChangesTTL: "1"})
+	assert.Equal(t, "400", oneShot.Response().Properties["Error-Code"])
+
+	continuous := subChanges(map[string]string{db.SubChangesContinuous: "true", db.SubChangesTTL: "1"})
+	assert.Equal(t, "", continuous.Response().Properties["Error-Code"])
+
+	select {
+	case <-expired:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for subscription to expire")
+	}
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.Equal(t, int64(1), base.ExpvarVar2Int(pullStats.Get(base.StatKeySubscriptionsExpired)))
+	assert.Equal(t, int64(0), base.ExpvarVar2Int(pullStats.Get(base.StatKeyPullReplicationsActiveContinuous)))
+
+	renewed := subChanges(map[string]string{db.SubChangesContinuous: "true"})
+	assert.Equal(t, "", renewed.Response().Properties["Error-Code"])
+}
+
+// TestBlipGetCheckpoints verifies several clients' checkpoints can be fetched in one message, in the order requested,
+// skipping clients without one.
+func TestBlipGetCheckpoints(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	revs := map[string]string{}
+	for _, client := range []string{"client1", "client2"} {
+		setCheckpoint := blip.NewRequest()
+		setCheckpoint.SetProfile(db.MessageSetCheckpoint)
+		setCheckpoint.Properties[db.SetCheckpointClient] = client
+		require.NoError(t, setCheckpoint.SetJSONBody(db.Body{"remote": client}))
+		require.True(t, bt.sender.Send(setCheckpoint))
+		require.Equal(t, "", setCheckpoint.Response().Properties["Error-Code"])
+		revs[client] = setCheckpoint.Response().Properties[db.SetCheckpointResponseRev]
+	}
+
+	getCheckpoints := blip.NewRequest()
+	getCheckpoints.SetProfile(db.MessageGetCheckpoints)
+	require.NoError(t, getCheckpoints.SetJSONBody([]string{"client2", "missing", "client1"}))
+	require.True(t, bt.sender.Send(getCheckpoints))
+	response := getCheckpoints.Response()
+	require.Equal(t, "", response.Properties["Error-Code"])
+
+	var checkpoints []db.BatchedCheckpoint
+	require.NoError(t, response.ReadJSONBody(&checkpoints))
+	require.Len(t, checkpoints, 2)
+	for i, client := range []string{"client2", "client1"} {
+		assert.Equal(t, client, checkpoints[i].Client)
+		assert.Equal(t, revs[client], checkpoints[i].Rev)
+		assert.JSONEq(t, `{"remote":"`+client+`"}`, string(checkpoints[i].Body))
+	}
+
+	badRequest := blip.NewRequest()
+	badRequest.SetProfile(db.MessageGetCheckpoints)
+	require.NoError(t, badRequest.SetJSONBody(map[string]string{"client": "client1"}))
+	require.True(t, bt.sender.Send(badRequest))
+	assert.Equal(t, "400", badRequest.Response().Properties["Error-Code"])
+}
+
+// TestBlipSetCheckpointStaleRev verifies a setCheckpoint with a stale rev is rejected, with the current rev, rather than
+// overwriting another replicator's checkpoint.
+func TestBlipSetCheckpointStaleRev(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	setCheckpoint := func(rev string, remote int) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageSetCheckpoint)
+		request.Properties[db.SetCheckpointClient] = "client1"
+		if rev != "" {
+			request.Properties[db.SetCheckpointRev] = rev
+		}
+		require.NoError(t, request.SetJSONBody(db.Body{"remote": remote}))
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	response := setCheckpoint("", 1)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	firstRev := response.Properties[db.SetCheckpointResponseRev]
+
+	// Two replicators sharing the client ID both update from the first rev
+	response = setCheckpoint(firstRev, 2)
+	require.Equal(t, "", response.Properties["Error-Code"])
+	currentRev := response.Properties[db.SetCheckpointResponseRev]
+
+	response = setCheckpoint(firstRev, 3)
+	assert.Equal(t, "409", response.Properties["Error-Code"])
+	assert.Equal(t, currentRev, response.Properties[db.RevResponseExistingRev])
+
+	response = setCheckpoint(currentRev, 3)
+	assert.Equal(t, "", response.Properties["Error-Code"])
+}
+
+// TestBlipDeleteCheckpoint verifies a client can delete its checkpoint from its current rev, and not another user's.
+func TestBlipDeleteCheckpoint(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	btUser1, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		noAdminParty:       true,
+		connectingUsername: "user1",
+		connectingPassword: "1234",
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer btUser1.Close()
+
+	setCheckpoint := blip.NewRequest()
+	setCheckpoint.SetProfile(db.MessageSetCheckpoint)
+	setCheckpoint.Properties[db.SetCheckpointClient] = "client1"
+	require.NoError(t, setCheckpoint.SetJSONBody(db.Body{"remote": 25}))
+	require.True(t, btUser1.sender.Send(setCheckpoint))
+	require.Equal(t, "", setCheckpoint.Response().Properties["Error-Code"])
+	rev := setCheckpoint.Response().Properties[db.SetCheckpointResponseRev]
+
+	deleteCheckpoint := func(bt *BlipTester, rev string) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageDelCheckpoint)
+		request.Properties[db.DeleteCheckpointClient] = "client1"
+		request.Properties[db.DeleteCheckpointRev] = rev
+		require.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	btUser2, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		noAdminParty:       true,
+		connectingUsername: "user2",
+		connectingPassword: "1234",
+		restTester:         btUser1.restTester,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer btUser2.Close()
+	assert.Equal(t, "403", deleteCheckpoint(btUser2, rev).Properties["Error-Code"])
+
+	response := deleteCheckpoint(btUser1, "0-5")
+	assert.Equal(t, "409", response.Properties["Error-Code"])
+	assert.Equal(t, rev, response.Properties[db.RevResponseExistingRev])
+
+	assert.Equal(t, "", deleteCheckpoint(btUser1, rev).Properties["Error-Code"])
+
+	getCheckpoint := blip.NewRequest()
+	getCheckpoint.SetProfile(db.MessageGetCheckpoint)
+	getCheckpoint.Properties[db.BlipClient] = "client1"
+	require.True(t, btUser1.sender.Send(getCheckpoint))
+	assert.Equal(t, "404", getCheckpoint.Response().Properties["Error-Code"])
+
+	assert.Equal(t, "404", deleteCheckpoint(btUser1, rev).Properties["Error-Code"])
+}
+
+// TestBlipContinuousDocIDsFilter verifies a continuous subChanges can be filtered by doc ID, catching up with the
+// docs' current revisions and then sending only the changes for docs in the set.
+func TestBlipContinuousDocIDsFilter(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+	rt := bt.restTester
+
+	for _, docID := range []string{"doc1", "doc2", "doc3"} {
+		assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/"+docID, `{}`), http.StatusCreated)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	docIDs := make(chan string, 10)
+	caughtUp := make(chan struct{})
+	var caughtUpOnce sync.Once
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		if len(changes) == 0 {
+			caughtUpOnce.Do(func() { close(caughtUp) })
+			return
+		}
+		for _, change := range changes {
+			docIDs <- change[1].(string)
+		}
+		request.Response().SetBody([]byte("[]"))
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+	require.NoError(t, subChangesRequest.SetJSONBody(db.SubChangesBody{DocIDs: []string{"doc1", "doc3"}}))
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	receive := func(n int) (received []string) {
+		timeout := time.After(10 * time.Second)
+		for len(received) < n {
+			select {
+			case docID := <-docIDs:
+				received = append(received, docID)
+			case <-timeout:
+				t.Fatalf("Timed out waiting for changes, received %v", received)
+			}
+		}
+		return received
+	}
+	assert.ElementsMatch(t, []string{"doc1", "doc3"}, receive(2))
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for caught up")
+	}
+
+	// Only changes to docs in the set are sent as they arrive
+	response := rt.SendAdminRequest(http.MethodGet, "/db/doc3", "")
+	var doc3 db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &doc3))
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc4", `{}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc3?rev="+doc3[db.BodyRev].(string), `{"updated": true}`), http.StatusCreated)
+	assert.Equal(t, []string{"doc3"}, receive(1))
+	require.NoError(t, rt.WaitForPendingChanges())
+	assert.Len(t, docIDs, 0)
+}
+
+// TestBlipChannelPatterns verifies a subscription's channel patterns follow the user's grants mid-replication.
+func TestBlipChannelPatterns(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:       `function(doc) {channel(doc.channels);}`,
+		noAdminParty: true,
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"device-1", "device-2", "other"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"channels": ["device-1"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc2", `{"channels": ["device-2"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/other1", `{"channels": ["other"]}`), http.StatusCreated)
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	docIDs := make(chan string, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		require.NoError(t, request.ReadJSONBody(&changes))
+		for _, change := range changes {
+			docIDs <- change[1].(string)
+		}
+		if !request.NoReply() {
+			request.Response().SetBody([]byte("[]"))
+		}
+	}
+
+	subChanges := func(patterns string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+		subChangesRequest.Properties[db.SubChangesFilter] = "sync_gateway/bychannel"
+		subChangesRequest.Properties[db.SubChangesPatterns] = patterns
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest.Response()
+	}
+
+	// Patterns matching every channel aren't accepted
+	assert.Equal(t, "400", subChanges("*").Properties["Error-Code"])
+
+	receive := func(n int) (received []string) {
+		timeout := time.After(10 * time.Second)
+		for len(received) < n {
+			select {
+			case docID := <-docIDs:
+				received = append(received, docID)
+			case <-timeout:
+				t.Fatalf("Timed out waiting for changes, received %v", received)
+			}
+		}
+		return received
+	}
+	require.Equal(t, "", subChanges("device-*").Properties["Error-Code"])
+	assert.ElementsMatch(t, []string{"doc1", "doc2"}, receive(2))
+
+	// Revoke device-2 and grant device-3 mid-replication
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_user/user1", `{"admin_channels": ["device-1", "device-3", "other"]}`), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc3", `{"channels": ["device-3"]}`), http.StatusCreated)
+	assert.Equal(t, []string{"doc3"}, receive(1))
+
+	// Changes in the revoked channel, or in channels not matching the patterns, aren't sent
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc4", `{"channels": ["device-2"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/other2", `{"channels": ["other"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc5", `{"channels": ["device-1"]}`), http.StatusCreated)
+	assert.Equal(t, []string{"doc5"}, receive(1))
+	require.NoError(t, rt.WaitForPendingChanges())
+	assert.Len(t, docIDs, 0)
+}
+
+// TestBlipChannelPatternsDenied verifies patterns matching a channel that can't be replicated are rejected.
+func TestBlipChannelPatternsDenied(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{DeniedChannels: []string{"device-secret"}}},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"device-1", "device-secret"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesFilter] = "sync_gateway/bychannel"
+	subChangesRequest.Properties[db.SubChangesPatterns] = "device-*"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "403", subChangesRequest.Response().Properties["Error-Code"])
+}
+
+// TestBlipMixedDigestAttachments verifies a client that negotiated sha256 digests can push a doc with both sha1 and
+// sha256 attachments, which keep their digests, while a client that didn't can't push sha256 digests.
+func TestBlipMixedDigestAttachments(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	sha256Attachments := true
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{SHA256Attachments: &sha256Attachments}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		restTester:       rt,
+		handshakeHeaders: map[string]string{db.BlipAttachmentDigestsHeader: "sha256,sha1"},
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	capabilitiesRequest := blip.NewRequest()
+	capabilitiesRequest.SetProfile(db.MessageCapabilities)
+	require.True(t, bt.sender.Send(capabilitiesRequest))
+	var capabilities db.CapabilitiesBody
+	require.NoError(t, capabilitiesRequest.Response().ReadJSONBody(&capabilities))
+	assert.Equal(t, []string{db.DigestAlgorithmSHA256, db.DigestAlgorithmSHA1}, capabilities.AttachmentDigests)
+
+	sha1Data, sha256Data := []byte("sha1 attachment"), []byte("sha256 attachment")
+	attachments := map[string][]byte{db.Sha1DigestKey(sha1Data): sha1Data, db.Sha256DigestKey(sha256Data): sha256Data}
+	serveAttachments := func(request *blip.Message) {
+		request.Response().SetBody(attachments[request.Properties[db.GetAttachmentDigest]])
+	}
+	bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = serveAttachments
+
+	revBody := fmt.Sprintf(`{"_attachments": {"old": {"stub": true, "digest": "%s", "length": %d, "revpos": 1}, "new": {"stub": true, "digest": "%s", "length": %d, "revpos": 1}}}`,
+		db.Sha1DigestKey(sha1Data), len(sha1Data), db.Sha256DigestKey(sha256Data), len(sha256Data))
+	sendRev := func(bt *BlipTester, docID string) *blip.Message {
+		revRequest := blip.NewRequest()
+		revRequest.SetProfile(db.MessageRev)
+		revRequest.Properties[db.RevMessageId] = docID
+		revRequest.Properties[db.RevMessageRev] = "1-abc"
+		revRequest.SetBody([]byte(revBody))
+		require.True(t, bt.sender.Send(revRequest))
+		return revRequest.Response()
+	}
+	require.Equal(t, "", sendRev(bt, "doc1").Properties["Error-Code"])
+
+	response := rt.SendAdminRequest(http.MethodGet, "/db/doc1", "")
+	assertStatus(t, response, http.StatusOK)
+	var doc db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &doc))
+	atts := doc[db.BodyAttachments].(map[string]interface{})
+	assert.Equal(t, db.Sha1DigestKey(sha1Data), atts["old"].(map[string]interface{})["digest"])
+	assert.Equal(t, db.Sha256DigestKey(sha256Data), atts["new"].(map[string]interface{})["digest"])
+
+	// A client that didn't negotiate sha256 can't push sha256 digests
+	btSHA1, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer btSHA1.Close()
+	btSHA1.blipContext.HandlerForProfile[db.MessageGetAttachment] = serveAttachments
+	assert.Equal(t, "400", sendRev(btSHA1, "doc2").Properties["Error-Code"])
+}
+
+// TestBlipMaxAttachmentSize verifies a rev declaring an attachment larger than the maximum is rejected without the
+// attachment being requested, and one sending more data than the maximum is rejected once it's received.
+func TestBlipMaxAttachmentSize(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxSize := uint64(10)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxAttachmentSize: &maxSize}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	var getAttachmentCount int32
+	var attData []byte
+	bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = func(request *blip.Message) {
+		atomic.AddInt32(&getAttachmentCount, 1)
+		request.Response().SetBody(attData)
+	}
+	sendRev := func(docID string, declaredData []byte) *blip.Message {
+		revRequest := blip.NewRequest()
+		revRequest.SetProfile(db.MessageRev)
+		revRequest.Properties[db.RevMessageId] = docID
+		revRequest.Properties[db.RevMessageRev] = "1-abc"
+		revRequest.SetBody([]byte(fmt.Sprintf(`{"_attachments": {"att": {"stub": true, "digest": "%s", "length": %d, "revpos": 1}}}`, db.Sha1DigestKey(declaredData), len(declaredData))))
+		require.True(t, bt.sender.Send(revRequest))
+		return revRequest.Response()
+	}
+
+	attData = []byte("far too large an attachment")
+	assert.Equal(t, "413", sendRev("doc1", attData).Properties["Error-Code"])
+	assert.Equal(t, int32(0), atomic.LoadInt32(&getAttachmentCount), "An oversized attachment shouldn't be requested")
+
+	// The data sent is checked too, not just the declared length
+	assert.Equal(t, "413", sendRev("doc2", []byte("small")).Properties["Error-Code"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&getAttachmentCount))
+
+	attData = []byte("small")
+	assert.Equal(t, "", sendRev("doc3", attData).Properties["Error-Code"])
+}
+
+// TestBlipDeltaSyncPullWastedDelta verifies that a rev whose delta would be nearly as large as its body is sent as a
+// full body instead.
+func TestBlipDeltaSyncPullWastedDelta(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyAll)()
+
+	if !base.IsEnterpriseEdition() {
+		t.Skip("Delta sync only supported in EE")
+	}
+
+	sgUseDeltas := true
+	rtConfig := RestTesterConfig{DatabaseConfig: &DbConfig{DeltaSync: &DeltaSyncConfig{Enabled: &sgUseDeltas}}}
+	rt := NewRestTester(t, &rtConfig)
+	defer rt.Close()
+
+	deltaSyncStats := rt.GetDatabase().DbStats.StatsDeltaSync()
+	deltaSentCount := base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltasSent))
+	wastedCount := base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltasWastedFallback))
+
+	client, err := NewBlipTesterClient(t, rt)
+	require.NoError(t, err)
+	defer client.Close()
+
+	client.ClientDeltas = true
+	require.NoError(t, client.StartPull())
+
+	resp := rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"greetings": [{"hello": "world!"}, {"hi": "alice"}]}`)
+	assertStatus(t, resp, http.StatusCreated)
+	rev1ID := respRevID(t, resp)
+	_, ok := client.WaitForRev("doc1", rev1ID)
+	require.True(t, ok)
+
+	// Replace the whole body, so that the delta removing the old properties is larger than the new body
+	resp = rt.SendAdminRequest(http.MethodPut, "/db/doc1?rev="+rev1ID, `{"farewell": "bye"}`)
+	assertStatus(t, resp, http.StatusCreated)
+	rev2ID := respRevID(t, resp)
+	data, ok := client.WaitForRev("doc1", rev2ID)
+	require.True(t, ok)
+	assert.Equal(t, `{"farewell":"bye"}`, string(data))
+
+	msg, ok := client.pullReplication.WaitForMessage(5)
+	require.True(t, ok)
+	assert.Equal(t, "", msg.Properties[db.RevMessageDeltaSrc])
+	msgBody, err := msg.Body()
+	require.NoError(t, err)
+	assert.Equal(t, `{"farewell":"bye"}`, string(msgBody))
+
+	assert.Equal(t, deltaSentCount, base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltasSent)))
+	assert.Equal(t, wastedCount+1, base.ExpvarVar2Int(deltaSyncStats.Get(base.StatKeyDeltasWastedFallback)))
+}
+
+// TestBlipMaxInFlightChangeBatches verifies that no more changes batches are sent while the configured number await
+// the client's response.
+func TestBlipMaxInFlightChangeBatches(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	maxInFlight := uint32(2)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{MaxInFlightChangeBatches: &maxInFlight}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"ABC"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	for i := 0; i < 10; i++ {
+		response := rt.SendAdminRequest(http.MethodPut, fmt.Sprintf("/db/doc%d", i), `{"channels": ["ABC"]}`)
+		assertStatus(t, response, http.StatusCreated)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	// Hold the responses to changes messages until released
+	var batchesReceived int32
+	releaseResponses := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		if body, _ := request.Body(); string(body) != "null" {
+			atomic.AddInt32(&batchesReceived, 1)
+		}
+		if !request.NoReply() {
+			<-releaseResponses
+			request.Response().SetBody([]byte("[]"))
+		}
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties["batch"] = "2"
+	require.True(t, bt.sender.Send(subChangesRequest))
+
+	inFlightStat := func() int64 {
+		return base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyChangesBatchesInFlight))
+	}
+	_, ok := base.WaitForStat(inFlightStat, 2)
+	require.True(t, ok)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&batchesReceived), "More batches were sent than the window allows")
+
+	// Once the client responds, the remaining batches are sent
+	close(releaseResponses)
+	_, ok = base.WaitForStat(func() int64 { return int64(atomic.LoadInt32(&batchesReceived)) }, 5)
+	assert.True(t, ok)
+	_, ok = base.WaitForStat(inFlightStat, 0)
+	assert.True(t, ok)
+}
+
+// TestBlipHeartbeats verifies a continuous subscription asking for heartbeats is sent them at roughly the requested
+// interval while there's no document activity, reporting the feed's last sequence and the database's high sequence.
+func TestBlipHeartbeats(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		request.Response().SetBody([]byte("[]"))
+	}
+	heartbeats := make(chan map[string]string, 10)
+	bt.blipContext.HandlerForProfile[db.MessageHeartbeat] = func(request *blip.Message) {
+		heartbeats <- request.Properties
+	}
+
+	subChanges := func(properties map[string]string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		for k, v := range properties {
+			subChangesRequest.Properties[k] = v
+		}
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest
+	}
+
+	oneShot := subChanges(map[string]string{db.SubChangesHeartbeat: "1"})
+	assert.Equal(t, "400", oneShot.Response().Properties["Error-Code"])
+
+	start := time.Now()
+	continuous := subChanges(map[string]string{db.SubChangesContinuous: "true", db.SubChangesHeartbeat: "1"})
+	assert.Equal(t, "", continuous.Response().Properties["Error-Code"])
+
+	var received []time.Time
+	for len(received) < 3 {
+		select {
+		case properties := <-heartbeats:
+			received = append(received, time.Now())
+			highSeq := bt.restTester.GetDatabase().GetChangeCache().LastSequence()
+			assert.Equal(t, strconv.FormatUint(highSeq, 10), properties[db.HeartbeatHighSeq])
+			lastSentSeq, err := strconv.ParseUint(properties[db.HeartbeatSequence], 10, 64)
+			assert.NoError(t, err)
+			assert.True(t, lastSentSeq <= highSeq)
+			_, err = time.Parse(time.RFC3339Nano, properties[db.HeartbeatTimestamp])
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for heartbeat %d", len(received)+1)
+		}
+	}
+
+	// Three heartbeats at a one second interval arrive after around three seconds
+	elapsed := received[2].Sub(start)
+	assert.True(t, elapsed >= 2500*time.Millisecond && elapsed < 5*time.Second, "Unexpected time for 3 heartbeats: %v", elapsed)
+	pullStats := bt.restTester.GetDatabase().DbStats.StatsCblReplicationPull()
+	assert.True(t, base.ExpvarVar2Int(pullStats.Get(base.StatKeyHeartbeatSentCount)) >= 3)
+}
+
+// TestBlipSubChangesRetryAfterError verifies a subChanges request that's rejected doesn't stop the client subscribing
+// on the same connection.
+func TestBlipSubChangesRetryAfterError(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		request.Response().SetBody([]byte("[]"))
+	}
+	subChanges := func(properties map[string]string) *blip.Message {
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		for k, v := range properties {
+			subChangesRequest.Properties[k] = v
+		}
+		require.True(t, bt.sender.Send(subChangesRequest))
+		return subChangesRequest
+	}
+
+	// Rejected while validating the request, and while applying its filter
+	invalid := subChanges(map[string]string{db.SubChangesSortBy: "name", db.SubChangesContinuous: "true"})
+	assert.Equal(t, "400", invalid.Response().Properties["Error-Code"])
+	emptyChannels := subChanges(map[string]string{db.SubChangesFilter: "sync_gateway/bychannel", db.SubChangesChannels: ""})
+	assert.Equal(t, "400", emptyChannels.Response().Properties["Error-Code"])
+
+	valid := subChanges(map[string]string{})
+	assert.Equal(t, "", valid.Response().Properties["Error-Code"])
+}
+
+// TestBlipDocIDMapperRoundTrip ensures a doc pushed under a delivered ID is stored under its mapped ID, and that a
+// subChanges docIDs filter listing delivered IDs pulls it back under the delivered ID, without docs the mapper doesn't
+// deliver.  The rev send log records the delivered ID, and releaseRevs releases revs by their delivered IDs.
+func TestBlipDocIDMapperRoundTrip(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	prefix := "tenant::"
+	revSendLogSize := uint32(10)
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{
+		DocIDPrefix:    &prefix,
+		RevSendLogSize: &revSendLogSize,
+	}}})
+	defer rt.Close()
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	sent, _, revResponse, err := bt.SendRev("pushed", "1-abc", []byte(`{"key":"val"}`), blip.Properties{})
+	require.True(t, sent)
+	require.NoError(t, err)
+	assert.Equal(t, "", revResponse.Properties["Error-Code"])
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/tenant::pushed", ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/pushed", ""), http.StatusNotFound)
+
+	// Stored without the prefix, so not delivered, even though its stored ID is listed in the filter
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/unmapped", `{"key":"val"}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/tenant::unlisted", `{"key":"val"}`), http.StatusCreated)
+
+	var changesLock sync.Mutex
+	var changedIDs []string
+	caughtUp := make(chan struct{})
+	revIDs := make(chan string, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		body, err := request.Body()
+		require.NoError(t, err)
+		var changes [][]interface{}
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		if len(changes) == 0 {
+			close(caughtUp)
+			return
+		}
+		knownRevs := make([]interface{}, len(changes))
+		changesLock.Lock()
+		for i, change := range changes {
+			changedIDs = append(changedIDs, change[1].(string))
+			knownRevs[i] = []interface{}{}
+		}
+		changesLock.Unlock()
+		require.NoError(t, request.Response().SetJSONBody(knownRevs))
+	}
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		revIDs <- request.Properties[db.RevMessageId]
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.SetBody([]byte(`{"docIDs":["pushed","unmapped"]}`))
+	require.True(t, bt.sender.Send(subChangesRequest))
+	assert.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-caughtUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the changes feed to catch up")
+	}
+	select {
+	case docID := <-revIDs:
+		assert.Equal(t, "pushed", docID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for rev")
+	}
+	changesLock.Lock()
+	assert.Equal(t, []string{"pushed"}, changedIDs)
+	changesLock.Unlock()
+	assert.Len(t, revIDs, 0)
+
+	revSendLogRequest := blip.NewRequest()
+	revSendLogRequest.SetProfile(db.MessageGetRevSendLog)
+	require.True(t, bt.sender.Send(revSendLogRequest))
+	revSendLogBody, err := revSendLogRequest.Response().Body()
+	require.NoError(t, err)
+	var revSendLog []db.RevSendLogEntry
+	require.NoError(t, base.JSONUnmarshal(revSendLogBody, &revSendLog))
+	require.Len(t, revSendLog, 1)
+	assert.Equal(t, "pushed", revSendLog[0].DocID)
+
+	// Replace the pulled rev, so that it's no longer current and can be released under its delivered ID
+	revCache := rt.GetDatabase().GetRevisionCacheForTest()
+	_, err = revCache.Get("tenant::pushed", "1-abc", true, false)
+	require.NoError(t, err)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/tenant::pushed?rev=1-abc", `{"key":"updated"}`), http.StatusCreated)
+	releaseRevsRequest := blip.NewRequest()
+	releaseRevsRequest.SetProfile(db.MessageReleaseRevs)
+	require.NoError(t, releaseRevsRequest.SetJSONBody([][]string{{"pushed", "1-abc"}}))
+	require.True(t, bt.sender.Send(releaseRevsRequest))
+	assert.Equal(t, "", releaseRevsRequest.Response().Properties["Error-Code"])
+	_, found := revCache.Peek("tenant::pushed", "1-abc")
+	assert.False(t, found, "Rev released under its delivered ID should have been evicted")
+}
+
+// TestBlipEmptyChannelSubscriptionGrant verifies a permitted empty channel subscription sends nothing until the user
+// is granted a channel, and then sends that channel's docs.
+func TestBlipEmptyChannelSubscriptionGrant(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	allowEmpty := true
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:         `function(doc) {channel(doc.channels);}`,
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{BlipSync: &BlipSyncConfig{AllowEmptyChannelSubscription: &allowEmpty}},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/docA", `{"channels": ["a"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/docB", `{"channels": ["b"]}`), http.StatusCreated)
+
+	docIDs := make(chan string, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		body, err := request.Body()
+		require.NoError(t, err)
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		for _, change := range changes {
+			docIDs <- change[1].(string)
+		}
+		if !request.NoReply() {
+			request.Response().SetBody([]byte("[]"))
+		}
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "true"
+	subChangesRequest.Properties[db.SubChangesFilter] = "sync_gateway/bychannel"
+	subChangesRequest.Properties[db.SubChangesChannels] = ""
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	// Channels the user already had aren't followed, only those granted later
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_user/user1", `{"admin_channels": ["a", "b"]}`), http.StatusOK)
+	select {
+	case docID := <-docIDs:
+		assert.Equal(t, "docB", docID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for changes in the granted channel")
+	}
+	assert.Len(t, docIDs, 0)
+}
+
+// TestBlipGetRecoverableTombstoneLastRev verifies the last body of a recoverable tombstone, given by its changes row's
+// lastRev, can be fetched with getRev, and that getRev doesn't return revisions the user can't access.
+func TestBlipGetRecoverableTombstoneLastRev(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	retentionSecs := uint32(3600)
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:         `function(doc, oldDoc) {channel(doc._deleted ? oldDoc.channels : doc.channels);}`,
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{TombstoneRetentionSecs: &retentionSecs},
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db/trashed", `{"channels": ["a"], "trash": "me"}`)
+	assertStatus(t, response, http.StatusCreated)
+	rev1ID := respRevID(t, response)
+	assertStatus(t, rt.SendAdminRequest(http.MethodDelete, "/db/trashed?rev="+rev1ID, ""), http.StatusOK)
+	response = rt.SendAdminRequest(http.MethodPut, "/db/private", `{"channels": ["b"]}`)
+	assertStatus(t, response, http.StatusCreated)
+	privateRevID := respRevID(t, response)
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	changeRows := make(chan []interface{}, 10)
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		var changes [][]interface{}
+		body, err := request.Body()
+		require.NoError(t, err)
+		require.NoError(t, base.JSONUnmarshal(body, &changes))
+		for _, change := range changes {
+			changeRows <- change
+		}
+		if !request.NoReply() {
+			request.Response().SetBody([]byte("[]"))
+		}
+	}
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesRecovery] = "true"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	var changeRow []interface{}
+	select {
+	case changeRow = <-changeRows:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for changes")
+	}
+	require.Len(t, changeRow, 5)
+	assert.Equal(t, "trashed", changeRow[1])
+	meta, ok := changeRow[4].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, true, meta[db.ChangesRowRecoverable])
+	assert.Equal(t, rev1ID, meta[db.ChangesRowLastRev])
+
+	getRev := func(docID, revID string) *blip.Message {
+		getRevRequest := blip.NewRequest()
+		getRevRequest.SetProfile(db.MessageGetRev)
+		getRevRequest.Properties[db.GetRevMessageId] = docID
+		getRevRequest.Properties[db.GetRevMessageRev] = revID
+		require.True(t, bt.sender.Send(getRevRequest))
+		return getRevRequest.Response()
+	}
+	lastRevResponse := getRev("trashed", rev1ID)
+	require.Equal(t, "", lastRevResponse.Properties["Error-Code"])
+	assert.Equal(t, "", lastRevResponse.Properties[db.GetRevMessageDeleted])
+	var lastBody db.Body
+	require.NoError(t, lastRevResponse.ReadJSONBody(&lastBody))
+	assert.Equal(t, "me", lastBody["trash"])
+
+	assert.Equal(t, "403", getRev("private", privateRevID).Properties["Error-Code"])
+	assert.Equal(t, "404", getRev("missing", "1-a").Properties["Error-Code"])
+	assert.Equal(t, "400", getRev("trashed", "").Properties["Error-Code"])
+}
+
+// TestBlipReleaseRevs verifies releaseRevs evicts the listed ancestor revs from the rev cache, but not a doc's current
+// rev or revs the user can't access, and rejects malformed or oversized messages.
+func TestBlipReleaseRevs(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn:       `function(doc) {channel(doc.channels);}`,
+		noAdminParty: true,
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		connectingUsername:          "user1",
+		connectingPassword:          "1234",
+		connectingUserChannelGrants: []string{"a"},
+		restTester:                  rt,
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	revCache := rt.GetDatabase().GetRevisionCacheForTest()
+	putDoc := func(docID, query, body string) string {
+		response := rt.SendAdminRequest(http.MethodPut, "/db/"+docID+query, body)
+		assertStatus(t, response, http.StatusCreated)
+		revID := respRevID(t, response)
+		_, err := revCache.Get(docID, revID, true, false)
+		require.NoError(t, err)
+		return revID
+	}
+	rev1ID := putDoc("doc1", "", `{"channels": ["a"]}`)
+	rev2ID := putDoc("doc1", "?rev="+rev1ID, `{"channels": ["a"], "updated": true}`)
+	privateRevID := putDoc("private", "", `{"channels": ["b"]}`)
+
+	releaseRevs := func(body interface{}) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageReleaseRevs)
+		require.NoError(t, request.SetJSONBody(body))
+		require.True(t, bt.sender.Send(request))
+		return request
+	}
+
+	response := releaseRevs([][]string{{"doc1", rev1ID}, {"doc1", rev2ID}, {"private", privateRevID}}).Response()
+	require.Equal(t, "", response.Properties["Error-Code"])
+	_, found := revCache.Peek("doc1", rev1ID)
+	assert.False(t, found, "Released ancestor rev should have been evicted")
+	_, found = revCache.Peek("doc1", rev2ID)
+	assert.True(t, found, "The doc's current rev shouldn't be evicted")
+	_, found = revCache.Peek("private", privateRevID)
+	assert.True(t, found, "A rev the user can't access shouldn't be evicted")
+
+	assert.Equal(t, "400", releaseRevs([][]string{{"doc1"}}).Response().Properties["Error-Code"])
+
+	tooMany := make([][]string, 1001)
+	for i := range tooMany {
+		tooMany[i] = []string{"doc1", rev2ID}
+	}
+	assert.Equal(t, "413", releaseRevs(tooMany).Response().Properties["Error-Code"])
+}
+
+// TestBlipRejectedRevRemovesNewAttachment verifies an attachment downloaded for a pushed rev that isn't written is
+// removed again, as no doc references it.
+func TestBlipRejectedRevRemovesNewAttachment(t *testing.T) {
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn: `function(doc) {if (doc.reject) {throw({forbidden: "rejected"});}}`,
+	})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	attachmentBody := "attach"
+	digest := db.Sha1DigestKey([]byte(attachmentBody))
+	input := SendRevWithAttachmentInput{
+		docId:            "doc",
+		revId:            "1-rev1",
+		attachmentName:   "myAttachment",
+		attachmentLength: len(attachmentBody),
+		attachmentBody:   attachmentBody,
+		attachmentDigest: digest,
+		body:             []byte(`{"reject": true}`),
+	}
+	sent, _, response := bt.SendRevWithAttachment(input)
+	require.True(t, sent)
+	assert.Equal(t, "403", response.Properties["Error-Code"])
+	_, _, err = rt.GetDatabase().Bucket.GetRaw(base.AttPrefix + digest)
+	assert.True(t, base.IsDocNotFoundError(err), "Attachment of the rejected rev should have been removed")
+
+	input.body = nil
+	sent, _, response = bt.SendRevWithAttachment(input)
+	require.True(t, sent)
+	assert.Equal(t, "", response.Properties["Error-Code"])
+	attachment, _, err := rt.GetDatabase().Bucket.GetRaw(base.AttPrefix + digest)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(attachmentBody), attachment)
+}
+
+// TestBlipJSONPatchDeltaPushAttachments verifies a pushed JSON patch delta that changes the deltaSrc's attachments
+// doesn't modify the cached deltaSrc revision, whether or not the patch applies.
+func TestBlipJSONPatchDeltaPushAttachments(t *testing.T) {
+	if !base.IsEnterpriseEdition() {
+		t.Skip("Delta sync only supported in EE")
+	}
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	deltaSync := true
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{DeltaSync: &DeltaSyncConfig{Enabled: &deltaSync}}})
+	defer rt.Close()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{restTester: rt})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"greeting": "hi", "_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, http.StatusCreated)
+	rev1ID := respRevID(t, response)
+	revCache := rt.GetDatabase().GetRevisionCacheForTest()
+	_, err = revCache.Get("doc1", rev1ID, true, false)
+	require.NoError(t, err)
+
+	assertCachedAttachment := func() {
+		cachedRev, found := revCache.Peek("doc1", rev1ID)
+		require.True(t, found)
+		require.Contains(t, cachedRev.Attachments, "hello.txt")
+		meta, ok := cachedRev.Attachments["hello.txt"].(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, "sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=", meta["digest"])
+	}
+	properties := blip.Properties{db.RevMessageDeltaSrc: rev1ID, db.RevMessageDeltaFormat: db.DeltaFormatJSONPatch}
+
+	// A patch whose last operation fails is rejected, without its earlier operations reaching the cached rev
+	_, _, revResponse, _ := bt.SendRevWithHistory("doc1", "2-abc", []string{rev1ID}, []byte(`[
+		{"op": "replace", "path": "/_attachments/hello.txt/digest", "value": "sha1-wrong"},
+		{"op": "remove", "path": "/missing"}]`), properties)
+	assert.Equal(t, "400", revResponse.Properties["Error-Code"])
+	assertCachedAttachment()
+
+	_, _, _, err = bt.SendRevWithHistory("doc1", "2-abc", []string{rev1ID}, []byte(`[{"op": "remove", "path": "/_attachments/hello.txt"}]`), properties)
+	require.NoError(t, err)
+	assertCachedAttachment()
+	response = rt.SendAdminRequest(http.MethodGet, "/db/doc1", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.NotContains(t, response.Body.String(), "hello.txt")
+}
@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// attachMultiplexedDatabases attaches the other databases the client listed in its X-Multiplex-Databases handshake
+// header to the connection, when the database connected to enables multiplexing, authenticating the client to each
+// as it was to the first.  The returned function releases the databases once the connection has closed.  Any database
+// that can't be attached fails the handshake, so that a client never replicates fewer databases than it asked for.
+func (h *handler) attachMultiplexedDatabases(bsc *db.BlipSyncContext) (release func(), err error) {
+	release = func() {}
+	maxDatabases := h.db.Options.BlipSyncOptions.MaxMultiplexedDatabases
+	header := h.rq.Header.Get(db.BlipMultiplexHeader)
+	if maxDatabases <= 0 || header == "" {
+		return release, nil
+	}
+	names := db.ParseMultiplexDatabases(header, h.db.Name)
+	if len(names) > maxDatabases {
+		return release, base.HTTPErrorf(http.StatusBadRequest, "Can't multiplex more than %d databases on a connection", maxDatabases)
+	}
+
+	var releases []func()
+	release = func() {
+		for _, releaseDatabase := range releases {
+			releaseDatabase()
+		}
+	}
+	for _, name := range names {
+		database, releaseDatabase, err := h.getMultiplexedDatabase(name)
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+		releases = append(releases, releaseDatabase)
+		negotiateBlipHandshake(bsc.AttachMultiplexedDatabase(database), h.rq)
+		base.InfofCtx(h.db.Ctx, base.KeyHTTP, "%s: Multiplexing database %s on the connection", h.formatSerialNumber(), base.MD(name))
+	}
+	return release, nil
+}
+
+// getMultiplexedDatabase returns the client's instance of a database to multiplex on its connection, holding the
+// database's access lock until the returned function releases it, as the handler does for the database connected to.
+func (h *handler) getMultiplexedDatabase(name string) (database *db.Database, release func(), err error) {
+	dbContext, err := h.server.GetDatabase(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	dbContext.AccessLock.RLock()
+	if dbState := atomic.LoadUint32(&dbContext.State); dbState != db.DBOnline {
+		dbContext.AccessLock.RUnlock()
+		return nil, nil, base.HTTPErrorf(http.StatusServiceUnavailable, fmt.Sprintf("DB %s is %v - try again later", name, db.RunStateString[dbState]))
+	}
+
+	// Authenticate to the database as the handler did to the one connected to, keeping the handler's own user
+	user := h.user
+	if h.privs != adminPrivs {
+		connectedUser := h.user
+		err = h.checkAuth(dbContext)
+		user, h.user = h.user, connectedUser
+		if err != nil {
+			dbContext.AccessLock.RUnlock()
+			return nil, nil, err
+		}
+	}
+	if database, err = db.GetDatabase(dbContext, user); err != nil {
+		dbContext.AccessLock.RUnlock()
+		return nil, nil, err
+	}
+	database.Ctx = h.db.Ctx
+
+	dbContext.DbStats.StatsDatabase().Add(base.StatKeyNumReplicationsActive, 1)
+	dbContext.DbStats.StatsDatabase().Add(base.StatKeyNumReplicationsTotal, 1)
+	return database, func() {
+		dbContext.DbStats.StatsDatabase().Add(base.StatKeyNumReplicationsActive, -1)
+		dbContext.AccessLock.RUnlock()
+	}, nil
+}
@@ -33,7 +33,18 @@ func (h *handler) handleBLIPSync() error {
 
 	// Create a new BlipSyncContext attached to the given blipContext.
 	ctx := db.NewBlipSyncContext(blipContext, h.db, h.formatSerialNumber())
-	defer ctx.Close()
+	negotiateBlipHandshake(ctx, h.rq)
+
+	// Attach any other databases the client asked to replicate over the same connection, which are released once
+	// they've been closed along with the context
+	releaseMultiplexed, err := h.attachMultiplexedDatabases(ctx)
+	defer func() {
+		ctx.Close()
+		releaseMultiplexed()
+	}()
+	if err != nil {
+		return err
+	}
 
 	// Create a BLIP WebSocket handler and have it handle the request:
 	server := blipContext.WebSocketServer()
@@ -44,9 +55,21 @@ func (h *handler) handleBLIPSync() error {
 			_ = conn.Close() // in case it wasn't closed already
 			base.InfofCtx(h.db.Ctx, base.KeyHTTP, "%s:    --> BLIP+WebSocket connection closed", h.formatSerialNumber())
 		}()
+		ctx.EnforceMaxLifetime(conn)
 		defaultHandler(conn)
 	}
 
 	server.ServeHTTP(h.response, h.rq)
 	return nil
 }
+
+// negotiateBlipHandshake sets what the client negotiated in its handshake request on the context of a database
+// replicating over the connection.
+func negotiateBlipHandshake(ctx *db.BlipSyncContext, rq *http.Request) {
+	ctx.ExtractTraceContext(rq.Header)
+	ctx.NegotiateKeepalive(rq.Header)
+	ctx.SetConnectionSecurity(rq)
+	ctx.NegotiateStrictNumbers(rq.Header)
+	ctx.NegotiateAttachmentDigests(rq.Header)
+	ctx.NegotiateLoopDetection(rq.Header)
+}
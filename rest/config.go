@@ -186,6 +186,7 @@ type DbConfig struct {
 	OldRevExpirySeconds       *uint32                          `json:"old_rev_expiry_seconds,omitempty"`       // The number of seconds before old revs are removed from CBS bucket
 	ViewQueryTimeoutSecs      *uint32                          `json:"view_query_timeout_secs,omitempty"`      // The view query timeout in seconds
 	LocalDocExpirySecs        *uint32                          `json:"local_doc_expiry_secs,omitempty"`        // The _local doc expiry time in seconds
+	TombstoneRetentionSecs    *uint32                          `json:"tombstone_retention_secs,omitempty"`     // How long a deleted doc's last body is kept recoverable (0 to disable)
 	EnableXattrs              *bool                            `json:"enable_shared_bucket_access,omitempty"`  // Whether to use extended attributes to store _sync metadata
 	SecureCookieOverride      *bool                            `json:"session_cookie_secure,omitempty"`        // Override cookie secure flag
 	SessionCookieName         string                           `json:"session_cookie_name"`                    // Custom per-database session cookie name
@@ -199,11 +200,79 @@ type DbConfig struct {
 	CompactIntervalDays       *float32                         `json:"compact_interval_days,omitempty"`        // Interval between scheduled compaction runs (in days) - 0 means don't run
 	SGReplicateEnabled        *bool                            `json:"sgreplicate_enabled,omitempty"`          // When false, node will not be assigned replications
 	Replications              map[string]*db.ReplicationConfig `json:"replications,omitempty"`                 // sg-replicate replication definitions
+	BlipSync                  *BlipSyncConfig                  `json:"blip_sync,omitempty"`                    // Config for BLIP sync (Couchbase Lite replication)
+	SyncFnTimeoutMs           *uint32                          `json:"sync_fn_timeout_ms,omitempty"`           // How long the sync function may run for a single write before it's interrupted and the write rejected with a 422 (0 for unlimited)
+	DocSummaries              *db.DocSummaries                 `json:"doc_summaries,omitempty"`                // Summaries Couchbase Lite clients may pull with subChanges' summaries property in place of full bodies: the top-level fields listed for each doc type, keyed by type or "*" for any other, plus computed metadata (default unset, which disables summaries)
+	NamedFilters              db.NamedFilters                  `json:"named_filters,omitempty"`                // Change filters Couchbase Lite clients may pull by name with a named/<name> filter, keyed by name.  Each gives the channels a doc must be in and/or a byexpression filter expression its body must match
 }
 
 type DeltaSyncConfig struct {
-	Enabled          *bool   `json:"enabled,omitempty"`             // Whether delta sync is enabled (requires EE)
-	RevMaxAgeSeconds *uint32 `json:"rev_max_age_seconds,omitempty"` // The number of seconds deltas for old revs are available for
+	Enabled          *bool              `json:"enabled,omitempty"`             // Whether delta sync is enabled (requires EE)
+	RevMaxAgeSeconds *uint32            `json:"rev_max_age_seconds,omitempty"` // The number of seconds deltas for old revs are available for
+	Templates        map[string]db.Body `json:"templates,omitempty"`           // Per-type base documents that first revs are sent as deltas against, keyed by type
+	TemplateProperty *string            `json:"template_property,omitempty"`   // Top-level body property identifying a doc's type for templates (defaults to "type")
+	CacheSize        *uint32            `json:"cache_size,omitempty"`          // Max computed deltas kept to share between clients pulling the same revs (default 1000, 0 to disable)
+	MaxDeltaRatio    *float64           `json:"max_delta_ratio,omitempty"`     // Max size of a delta sent to a client as a fraction of the full body, which is sent instead of a larger delta (default 0.8, 0 to always send deltas)
+}
+
+type BlipSyncConfig struct {
+	InitialSyncProgressTTLSecs    *uint32  `json:"initial_sync_progress_ttl_secs,omitempty"`   // How long best-effort server-side progress of an interrupted initial pull is kept (0 to disable)
+	DeniedChannels                []string `json:"denied_channels,omitempty"`                  // Channels that can never be replicated to clients over BLIP, even if a user has access
+	MaxRequestDeadlineSecs        *uint32  `json:"max_request_deadline_secs,omitempty"`        // Upper bound for client-supplied request deadlines (0 to ignore client deadlines)
+	AllowEmptyChannelSubscription *bool    `json:"allow_empty_channel_subscription,omitempty"` // Accept a continuous subChanges with an empty channel list as a valid subscription, which stays empty until the user is granted more channels, and then follows them
+	RevSendLogSize                *uint32  `json:"rev_send_log_size,omitempty"`                // Number of recent rev send decisions kept per connection for the getRevSendLog diagnostic (0 to disable)
+	IfAbsentRejectsTombstones     *bool    `json:"if_absent_rejects_tombstones,omitempty"`     // Whether a tombstoned document counts as existing for a rev pushed with ifAbsent (default false)
+	MaxPossibleAncestors          *uint32  `json:"max_possible_ancestors,omitempty"`           // Max possible ancestors returned per change to a pushing client, keeping the most recent (0 for unlimited).  Truncation may occasionally cause the client to send a full body instead of a delta
+	AdmissionLatencyThresholdMs   *uint32  `json:"admission_latency_threshold_ms,omitempty"`   // Average bucket operation latency above which new subChanges and rev requests are rejected with a 503 (0 to disable)
+	AdmissionRetryAfterSecs       *uint32  `json:"admission_retry_after_secs,omitempty"`       // Retry-After hint given to clients rejected by admission control (default 5)
+	RevQueueSize                  *uint32  `json:"rev_queue_size,omitempty"`                   // Max pushed revs queued per connection so that higher-priority revs are written first (0 to write revs as they arrive)
+	MaxSortedChanges              *uint32  `json:"max_sorted_changes,omitempty"`               // Max changes a sortBy pull may buffer in memory before it's rejected (default 10000, 0 to disable sortBy).  Each buffered change also costs a body read to find its sort value
+	IdempotencyKeyTTLSecs         *uint32  `json:"idempotency_key_ttl_secs,omitempty"`         // How long a pushed rev's idempotency key is remembered (default 600, 0 to disable).  A retry after this window, or beyond the most recent 100000 keys, is written again
+	OrphanRevTimeoutMs            *uint32  `json:"orphan_rev_timeout_ms,omitempty"`            // How long a rev pushed before its parent is held waiting for the parent, before it's rejected as a conflict (0 to reject immediately)
+	OrphanRevBufferSize           *uint32  `json:"orphan_rev_buffer_size,omitempty"`           // Max revs held waiting for their parents at once, beyond which they're rejected immediately (default 1000)
+	MaxChangesPerMessage          *uint32  `json:"max_changes_per_message,omitempty"`          // Max changes a client may list in one changes or proposeChanges message, beyond which it's rejected with a 413 (0 for unlimited)
+	MaxRevGeneration              *uint32  `json:"max_rev_generation,omitempty"`               // Max revision generation a client may push, beyond which the rev is rejected with a 400 (0 for unlimited).  Advertised via getCapabilities
+	DeltaFailureThreshold         *uint32  `json:"delta_failure_threshold,omitempty"`          // Consecutive failures to apply one doc's pushed deltas before the connection must send full bodies (0 to disable)
+	DeltaFailureCooldownSecs      *uint32  `json:"delta_failure_cooldown_secs,omitempty"`      // How long a connection must send full bodies once the delta failure threshold is reached (default 300)
+	RevChannelAssignment          *bool    `json:"rev_channel_assignment,omitempty"`           // Whether clients may ask for the channels a pushed rev is assigned, and have it rejected with a 412 unless it's assigned the channels they expect.  Advertised via getCapabilities
+	AttachmentRetries             *uint32  `json:"attachment_download_retries,omitempty"`      // Times an attachment download the client fails with a 5xx error is retried before the rev is rejected (0 to disable)
+	AttachmentRetryBackoffMs      *uint32  `json:"attachment_retry_backoff_ms,omitempty"`      // Wait before the first attachment download retry, doubled for each subsequent retry (default 100)
+	ReferenceField                *string  `json:"reference_field,omitempty"`                  // Top-level doc property holding the doc ID, or array of doc IDs, a doc references.  Lets one-shot pulls ask for referenced docs first with dependencyOrder, buffering up to max_sorted_changes changes
+	CursorTokenSecret             *string  `json:"cursor_token_secret,omitempty"`              // Secret used to sign the cursor tokens clients can resume changes from (unset to disable).  Must match across nodes, and changing it invalidates outstanding tokens
+	MaxConnectionLifetimeSecs     *uint32  `json:"max_connection_lifetime_secs,omitempty"`     // How long a replication connection may stay open before it's gracefully closed, so that the client reconnects and re-authenticates (0 for unlimited)
+	AttachmentCoalesceLimit       *uint32  `json:"attachment_coalesce_limit,omitempty"`        // Max distinct attachments loaded at once on behalf of several concurrent clients, sharing one store read (default 100, 0 to disable).  Beyond this, each client's request loads the attachment itself
+	AttachmentGC                  *bool    `json:"attachment_gc,omitempty"`                    // Whether attachments that pushed revs stop referencing are tracked, so that an admin collectAttachments request can delete those no document references (default false)
+	MaxStalenessSecs              *uint32  `json:"max_staleness_secs,omitempty"`               // Max staleness a pull may ask to tolerate with subChanges' maxStaleness, in exchange for index reads that don't wait for the index to catch up; larger values are clamped (default 0, which always reads consistently)
+	MinKeepaliveIntervalSecs      *uint32  `json:"min_keepalive_interval_secs,omitempty"`      // Shortest interval at which a client may ask, with the X-Keepalive-Interval header of its handshake, for keepalive messages on its caught-up continuous feed; shorter requests are raised to it (default 0, which sends no keepalives)
+	MaxRevocations                *uint32  `json:"max_revocations,omitempty"`                  // Max docs listed in the revoked message sent to a pull that asks for revocations when its user loses access to channels, so the client can purge the docs it can no longer see; beyond this the message is marked truncated (default 0, which sends no revocations)
+	MaxJSONDepth                  *uint32  `json:"max_json_depth,omitempty"`                   // Max nesting depth of objects and arrays in the body of a pushed rev, beyond which the rev is rejected with a 400, protecting the server from pathological documents (0 for unlimited)
+	AllowUserPurge                *bool    `json:"allow_user_purge,omitempty"`                 // Whether users, not just admins, may purge docs over replication with purgeBatch, e.g. to erase their own data.  Users may only purge docs whose every channel they can access (default false)
+	MinTLSVersion                 *string  `json:"min_tls_version,omitempty"`                  // Min TLS version ("tlsv1", "tlsv1.1", "tlsv1.2" or "tlsv1.3") of a connection that may replicate documents; other connections are refused with a 403 (default none, which allows connections without TLS)
+	AllowedCipherSuites           []string `json:"allowed_cipher_suites,omitempty"`            // Names of the TLS cipher suites a connection that may replicate documents must use, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" (default any)
+	RequireClientCert             *bool    `json:"require_client_cert,omitempty"`              // Whether only connections that presented a verified client certificate may replicate documents (default false)
+	ReservedFields                *string  `json:"reserved_fields,omitempty"`                  // How underscore-prefixed properties other than _attachments, _deleted and _exp in a pushed rev's body are handled: "reject" with a 400 before the rev is processed, or "strip" them and write the rev without them (default unset, which leaves them to the write's own validation)
+	MaxPushDocs                   *uint32  `json:"max_push_docs,omitempty"`                    // Max distinct documents a connection may push revs for in a push session; revs for further documents are rejected with a 429 until the session ends (0 for unlimited)
+	PushDocWindowSecs             *uint32  `json:"push_doc_window_secs,omitempty"`             // How long a push session limited by max_push_docs lasts, from the first rev pushed, before its documents are forgotten (default 3600, 0 for the connection's lifetime)
+	AttachmentRepeatPolicy        *string  `json:"attachment_repeat_policy,omitempty"`         // How a connection's repeated requests for an attachment it was served within attachment_repeat_window_secs are handled: "cache" serves them from a small per-connection cache, and "limit" rejects them with a 429 beyond attachment_repeat_limit (default unset, which loads and serves them as usual)
+	AttachmentRepeatWindowSecs    *uint32  `json:"attachment_repeat_window_secs,omitempty"`    // How long an attachment served on a connection counts towards repeated requests for it (default 60)
+	AttachmentRepeatLimit         *uint32  `json:"attachment_repeat_limit,omitempty"`          // Times the limit policy serves an attachment to a connection within the window (default 3)
+	AttachmentRepeatCacheBytes    *uint32  `json:"attachment_repeat_cache_bytes,omitempty"`    // Most attachment data the cache policy keeps per connection; attachments beyond it are loaded each time (default 4194304)
+	ProgressMilestoneDocs         *uint32  `json:"progress_milestone_docs,omitempty"`          // Docs sent to a pull between the progress milestones raised as replication_progress events and counted in stats, e.g. 100000 (0 to disable)
+	ProgressMilestonePercent      *uint32  `json:"progress_milestone_percent,omitempty"`       // Percentage of a pull's initial sync between progress milestones, e.g. 10, estimated from the sequences the feed has sent of those in the database when it subscribed (0 to disable)
+	MaxMultiplexedDatabases       *uint32  `json:"max_multiplexed_databases,omitempty"`        // Max other databases a client connecting to this database may replicate over the same connection, listed in its X-Multiplex-Databases handshake header; each must accept the client's credentials (default 0, which ignores the header)
+	ReplicationNodeID             *string  `json:"replication_node_id,omitempty"`              // Identifies this database to the other Sync Gateways it replicates with, the same on every node sharing its bucket, so that revs replicated back to a Sync Gateway they've already passed through are suppressed (default unset, which disables loop detection)
+	ReplicationNodeRole           *string  `json:"replication_node_role,omitempty"`            // Role granted to the users other Sync Gateways replicate with, allowing them to announce their replication node ID for loop detection (default unset, which only allows admin connections)
+	SequenceBarrierTimeoutSecs    *uint32  `json:"sequence_barrier_timeout_secs,omitempty"`    // Max time a subChanges request waits for the change cache to reach the sequence given as its waitForSequence, e.g. that of a rev the client just pushed, before failing with a 504 (default 10)
+	DeliveryLogRetentionSecs      *uint32  `json:"delivery_log_retention_secs,omitempty"`      // How long the revs a client subscribing with a session acknowledged are remembered after its last delivery, so that a reconnect within the window doesn't announce them again even if its checkpoint hadn't advanced (default 0, which disables the delivery log)
+	DeliveryLogSize               *uint32  `json:"delivery_log_size,omitempty"`                // Docs whose delivered revs are remembered per client; older deliveries fall back to the client's checkpoint (default 1000)
+	DocIDPrefix                   *string  `json:"doc_id_prefix,omitempty"`                    // Namespace prefix of the stored IDs of the docs clients replicate, stripped from the IDs sent to clients and added to those they push; docs without it aren't replicated (default unset, which replicates docs under their stored IDs)
+	HealthMaxActiveFeeds          *uint32  `json:"health_max_active_feeds,omitempty"`          // Active pull feeds at which the database's replication health is unhealthy, and 80% of which it's degraded (default 0, which excludes active feeds from the health)
+	HealthMaxInFlight             *uint32  `json:"health_max_in_flight_requests,omitempty"`    // In-flight BLIP requests at which the database's replication health is unhealthy, and 80% of which it's degraded (default 0, which excludes in-flight requests from the health)
+	MaxChangesBatchSize           *uint32  `json:"max_changes_batch_size,omitempty"`           // Largest batch size a subChanges request may ask for; larger ones are clamped, so that a client can't have huge batches of changes buffered (default 10000)
+	ChannelDocsSentStats          *bool    `json:"channel_docs_sent_stats,omitempty"`          // Whether the docs sent to pulls are counted per channel, for the 100 heaviest channels, in the channel_docs_sent stat (default false)
+	SHA256Attachments             *bool    `json:"sha256_attachments,omitempty"`               // Whether clients that ask for sha256 attachment digests at handshake use them; others keep using sha1 (default false)
+	MaxAttachmentSize             *uint64  `json:"max_attachment_size,omitempty"`              // Max size in bytes of an attachment clients push or fetch; a rev declaring a larger attachment is rejected before it's downloaded (default 0, which is unlimited)
+	MaxInFlightChangeBatches      *uint32  `json:"max_in_flight_change_batches,omitempty"`     // Max changes batches a pull may have awaiting the client's response, beyond which sending changes pauses until a response arrives (default 0, which is unlimited)
 }
 
 type DeprecatedOptions struct {
@@ -230,10 +299,12 @@ type CORSConfig struct {
 }
 
 type EventHandlerConfig struct {
-	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
-	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
-	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document Commit
-	DBStateChanged  []*EventConfig `json:"db_state_changed,omitempty"` // DB state change
+	MaxEventProc        uint           `json:"max_processes,omitempty"`         // Max concurrent event handling goroutines
+	WaitForProcess      string         `json:"wait_for_process,omitempty"`      // Max wait time when event queue is full (ms)
+	DocumentChanged     []*EventConfig `json:"document_changed,omitempty"`      // Document Commit
+	DBStateChanged      []*EventConfig `json:"db_state_changed,omitempty"`      // DB state change
+	ReplicationCaughtUp []*EventConfig `json:"replication_caught_up,omitempty"` // Replication's pull feed caught up
+	ReplicationProgress []*EventConfig `json:"replication_progress,omitempty"`  // Replication's pull feed reached a progress milestone
 }
 
 type EventConfig struct {
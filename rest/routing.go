@@ -291,6 +291,8 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
 	dbr.Handle("/_repair",
 		makeHandler(sc, adminPrivs, (*handler).handleRepair)).Methods("POST")
+	dbr.Handle("/_replication_health",
+		makeHandler(sc, adminPrivs, (*handler).handleGetReplicationHealth)).Methods("GET", "HEAD")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
@@ -25,6 +25,7 @@ import (
 	"github.com/couchbase/go-couchbase"
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	pkgerrors "github.com/pkg/errors"
 )
@@ -322,6 +323,16 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		localDocExpirySecs = *config.LocalDocExpirySecs
 	}
 
+	var tombstoneRetentionSecs uint32
+	if config.TombstoneRetentionSecs != nil {
+		tombstoneRetentionSecs = *config.TombstoneRetentionSecs
+	}
+
+	var syncFnTimeout time.Duration
+	if config.SyncFnTimeoutMs != nil {
+		syncFnTimeout = time.Duration(*config.SyncFnTimeoutMs) * time.Millisecond
+	}
+
 	if sc.databases_[dbName] != nil {
 		if useExisting {
 			return sc.databases_[dbName], nil
@@ -458,6 +469,8 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	deltaSyncOptions := db.DeltaSyncOptions{
 		Enabled:          db.DefaultDeltaSyncEnabled,
 		RevMaxAgeSeconds: db.DefaultDeltaSyncRevMaxAge,
+		CacheSize:        db.DefaultDeltaCacheSize,
+		MaxDeltaRatio:    db.DefaultMaxDeltaRatio,
 	}
 
 	if config.DeltaSync != nil {
@@ -473,9 +486,231 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 			}
 			deltaSyncOptions.RevMaxAgeSeconds = *revMaxAge
 		}
+
+		deltaSyncOptions.Templates = config.DeltaSync.Templates
+		if templateProperty := config.DeltaSync.TemplateProperty; templateProperty != nil {
+			deltaSyncOptions.TemplateProperty = *templateProperty
+		}
+		if cacheSize := config.DeltaSync.CacheSize; cacheSize != nil {
+			deltaSyncOptions.CacheSize = int(*cacheSize)
+		}
+		if maxDeltaRatio := config.DeltaSync.MaxDeltaRatio; maxDeltaRatio != nil {
+			if *maxDeltaRatio < 0 {
+				return nil, fmt.Errorf("delta_sync.max_delta_ratio: %v must not be negative", *maxDeltaRatio)
+			}
+			deltaSyncOptions.MaxDeltaRatio = *maxDeltaRatio
+		}
 	}
 	base.Infof(base.KeyAll, "delta_sync enabled=%t with rev_max_age_seconds=%d for database %s", deltaSyncOptions.Enabled, deltaSyncOptions.RevMaxAgeSeconds, dbName)
 
+	blipSyncOptions := db.BlipSyncOptions{
+		InitialSyncProgressTTL: db.DefaultInitialSyncProgressTTL,
+		MaxRequestDeadline:     db.DefaultMaxRequestDeadline,
+		MaxSortedChanges:       db.DefaultMaxSortedChanges,
+		IdempotencyKeyTTL:      db.DefaultIdempotencyKeyTTL,
+		CoalescedAttachments:   db.DefaultCoalescedAttachments,
+		PushDocWindow:          db.DefaultPushDocWindow,
+	}
+
+	if config.BlipSync != nil {
+		if ttl := config.BlipSync.InitialSyncProgressTTLSecs; ttl != nil {
+			blipSyncOptions.InitialSyncProgressTTL = time.Duration(*ttl) * time.Second
+		}
+		if len(config.BlipSync.DeniedChannels) > 0 {
+			deniedChannels, err := channels.SetFromArray(config.BlipSync.DeniedChannels, channels.RemoveStar)
+			if err != nil {
+				return nil, fmt.Errorf("blip_sync.denied_channels: %v", err)
+			}
+			blipSyncOptions.DeniedChannels = deniedChannels
+		}
+		if maxDeadline := config.BlipSync.MaxRequestDeadlineSecs; maxDeadline != nil {
+			blipSyncOptions.MaxRequestDeadline = time.Duration(*maxDeadline) * time.Second
+		}
+		if allowEmpty := config.BlipSync.AllowEmptyChannelSubscription; allowEmpty != nil {
+			blipSyncOptions.AllowEmptyChannelSubscription = *allowEmpty
+		}
+		if size := config.BlipSync.RevSendLogSize; size != nil {
+			if *size > db.MaxRevSendLogSize {
+				return nil, fmt.Errorf("blip_sync.rev_send_log_size must not exceed %d", db.MaxRevSendLogSize)
+			}
+			blipSyncOptions.RevSendLogSize = int(*size)
+		}
+		if rejectsTombstones := config.BlipSync.IfAbsentRejectsTombstones; rejectsTombstones != nil {
+			blipSyncOptions.IfAbsentRejectsTombstones = *rejectsTombstones
+		}
+		if maxAncestors := config.BlipSync.MaxPossibleAncestors; maxAncestors != nil {
+			blipSyncOptions.MaxPossibleAncestors = int(*maxAncestors)
+		}
+		if threshold := config.BlipSync.AdmissionLatencyThresholdMs; threshold != nil {
+			blipSyncOptions.AdmissionLatencyThreshold = time.Duration(*threshold) * time.Millisecond
+		}
+		if retryAfter := config.BlipSync.AdmissionRetryAfterSecs; retryAfter != nil {
+			blipSyncOptions.AdmissionRetryAfter = time.Duration(*retryAfter) * time.Second
+		}
+		if queueSize := config.BlipSync.RevQueueSize; queueSize != nil {
+			blipSyncOptions.RevQueueSize = int(*queueSize)
+		}
+		if ttl := config.BlipSync.IdempotencyKeyTTLSecs; ttl != nil {
+			blipSyncOptions.IdempotencyKeyTTL = time.Duration(*ttl) * time.Second
+		}
+		if maxSorted := config.BlipSync.MaxSortedChanges; maxSorted != nil {
+			blipSyncOptions.MaxSortedChanges = int(*maxSorted)
+		}
+		if timeout := config.BlipSync.OrphanRevTimeoutMs; timeout != nil {
+			blipSyncOptions.OrphanRevTimeout = time.Duration(*timeout) * time.Millisecond
+		}
+		if size := config.BlipSync.OrphanRevBufferSize; size != nil {
+			blipSyncOptions.OrphanRevBufferSize = int(*size)
+		}
+		if maxChanges := config.BlipSync.MaxChangesPerMessage; maxChanges != nil {
+			blipSyncOptions.MaxChangesPerMessage = int(*maxChanges)
+		}
+		if maxGeneration := config.BlipSync.MaxRevGeneration; maxGeneration != nil {
+			blipSyncOptions.MaxRevGeneration = int(*maxGeneration)
+		}
+		if threshold := config.BlipSync.DeltaFailureThreshold; threshold != nil {
+			blipSyncOptions.DeltaFailureThreshold = int(*threshold)
+		}
+		if cooldown := config.BlipSync.DeltaFailureCooldownSecs; cooldown != nil {
+			blipSyncOptions.DeltaFailureCooldown = time.Duration(*cooldown) * time.Second
+		}
+		if secret := config.BlipSync.CursorTokenSecret; secret != nil {
+			blipSyncOptions.CursorTokenSecret = *secret
+		}
+		if channelAssignment := config.BlipSync.RevChannelAssignment; channelAssignment != nil {
+			blipSyncOptions.RevChannelAssignment = *channelAssignment
+		}
+		if referenceField := config.BlipSync.ReferenceField; referenceField != nil {
+			blipSyncOptions.ReferenceField = *referenceField
+		}
+		if retries := config.BlipSync.AttachmentRetries; retries != nil {
+			blipSyncOptions.AttachmentRetries = int(*retries)
+		}
+		if backoff := config.BlipSync.AttachmentRetryBackoffMs; backoff != nil {
+			blipSyncOptions.AttachmentRetryBackoff = time.Duration(*backoff) * time.Millisecond
+		}
+		if lifetime := config.BlipSync.MaxConnectionLifetimeSecs; lifetime != nil {
+			blipSyncOptions.MaxConnectionLifetime = time.Duration(*lifetime) * time.Second
+		}
+		if coalesceLimit := config.BlipSync.AttachmentCoalesceLimit; coalesceLimit != nil {
+			blipSyncOptions.CoalescedAttachments = int(*coalesceLimit)
+		}
+		if attachmentGC := config.BlipSync.AttachmentGC; attachmentGC != nil {
+			blipSyncOptions.AttachmentGC = *attachmentGC
+		}
+		if maxStaleness := config.BlipSync.MaxStalenessSecs; maxStaleness != nil {
+			blipSyncOptions.MaxStaleness = time.Duration(*maxStaleness) * time.Second
+		}
+		if keepaliveInterval := config.BlipSync.MinKeepaliveIntervalSecs; keepaliveInterval != nil {
+			blipSyncOptions.MinKeepaliveInterval = time.Duration(*keepaliveInterval) * time.Second
+		}
+		if maxRevocations := config.BlipSync.MaxRevocations; maxRevocations != nil {
+			blipSyncOptions.MaxRevocations = int(*maxRevocations)
+		}
+		if maxDepth := config.BlipSync.MaxJSONDepth; maxDepth != nil {
+			blipSyncOptions.MaxJSONDepth = int(*maxDepth)
+		}
+		if allowUserPurge := config.BlipSync.AllowUserPurge; allowUserPurge != nil {
+			blipSyncOptions.AllowUserPurge = *allowUserPurge
+		}
+		if minTLSVersion := config.BlipSync.MinTLSVersion; minTLSVersion != nil {
+			blipSyncOptions.MinTLSVersion = GetTLSVersionFromString(minTLSVersion)
+		}
+		if len(config.BlipSync.AllowedCipherSuites) > 0 {
+			cipherSuites, err := db.ParseCipherSuites(config.BlipSync.AllowedCipherSuites)
+			if err != nil {
+				return nil, fmt.Errorf("blip_sync.allowed_cipher_suites: %v", err)
+			}
+			blipSyncOptions.AllowedCipherSuites = cipherSuites
+		}
+		if requireClientCert := config.BlipSync.RequireClientCert; requireClientCert != nil {
+			blipSyncOptions.RequireClientCert = *requireClientCert
+		}
+		if reservedFields := config.BlipSync.ReservedFields; reservedFields != nil {
+			policy, err := db.ParseReservedFieldsPolicy(*reservedFields)
+			if err != nil {
+				return nil, fmt.Errorf("blip_sync.reserved_fields: %v", err)
+			}
+			blipSyncOptions.ReservedFields = policy
+		}
+		if maxPushDocs := config.BlipSync.MaxPushDocs; maxPushDocs != nil {
+			blipSyncOptions.MaxPushDocs = int(*maxPushDocs)
+		}
+		if window := config.BlipSync.PushDocWindowSecs; window != nil {
+			blipSyncOptions.PushDocWindow = time.Duration(*window) * time.Second
+		}
+		if repeatPolicy := config.BlipSync.AttachmentRepeatPolicy; repeatPolicy != nil {
+			policy, err := db.ParseAttachmentRepeatPolicy(*repeatPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("blip_sync.attachment_repeat_policy: %v", err)
+			}
+			blipSyncOptions.AttachmentRepeatPolicy = policy
+		}
+		if window := config.BlipSync.AttachmentRepeatWindowSecs; window != nil {
+			blipSyncOptions.AttachmentRepeatWindow = time.Duration(*window) * time.Second
+		}
+		if limit := config.BlipSync.AttachmentRepeatLimit; limit != nil {
+			blipSyncOptions.AttachmentRepeatLimit = int(*limit)
+		}
+		if cacheBytes := config.BlipSync.AttachmentRepeatCacheBytes; cacheBytes != nil {
+			blipSyncOptions.AttachmentRepeatCacheBytes = int(*cacheBytes)
+		}
+		if milestoneDocs := config.BlipSync.ProgressMilestoneDocs; milestoneDocs != nil {
+			blipSyncOptions.ProgressMilestoneDocs = int(*milestoneDocs)
+		}
+		if milestonePercent := config.BlipSync.ProgressMilestonePercent; milestonePercent != nil {
+			if *milestonePercent > 100 {
+				return nil, fmt.Errorf("blip_sync.progress_milestone_percent: must be at most 100, got %d", *milestonePercent)
+			}
+			blipSyncOptions.ProgressMilestonePercent = int(*milestonePercent)
+		}
+		if maxMultiplexed := config.BlipSync.MaxMultiplexedDatabases; maxMultiplexed != nil {
+			blipSyncOptions.MaxMultiplexedDatabases = int(*maxMultiplexed)
+		}
+		if nodeID := config.BlipSync.ReplicationNodeID; nodeID != nil {
+			if strings.Contains(*nodeID, ",") {
+				return nil, fmt.Errorf("blip_sync.replication_node_id must not contain commas")
+			}
+			blipSyncOptions.ReplicationNodeID = *nodeID
+		}
+		if nodeRole := config.BlipSync.ReplicationNodeRole; nodeRole != nil {
+			blipSyncOptions.ReplicationNodeRole = *nodeRole
+		}
+		if barrierTimeout := config.BlipSync.SequenceBarrierTimeoutSecs; barrierTimeout != nil {
+			blipSyncOptions.SequenceBarrierTimeout = time.Duration(*barrierTimeout) * time.Second
+		}
+		if retention := config.BlipSync.DeliveryLogRetentionSecs; retention != nil {
+			blipSyncOptions.DeliveryLogRetention = time.Duration(*retention) * time.Second
+		}
+		if logSize := config.BlipSync.DeliveryLogSize; logSize != nil {
+			blipSyncOptions.DeliveryLogSize = int(*logSize)
+		}
+		if prefix := config.BlipSync.DocIDPrefix; prefix != nil && *prefix != "" {
+			blipSyncOptions.DocIDMapper = db.PrefixDocIDMapper{Prefix: *prefix}
+		}
+		if maxFeeds := config.BlipSync.HealthMaxActiveFeeds; maxFeeds != nil {
+			blipSyncOptions.HealthMaxActiveFeeds = int(*maxFeeds)
+		}
+		if maxInFlight := config.BlipSync.HealthMaxInFlight; maxInFlight != nil {
+			blipSyncOptions.HealthMaxInFlight = int(*maxInFlight)
+		}
+		if maxBatchSize := config.BlipSync.MaxChangesBatchSize; maxBatchSize != nil {
+			blipSyncOptions.MaxChangesBatchSize = int(*maxBatchSize)
+		}
+		if channelStats := config.BlipSync.ChannelDocsSentStats; channelStats != nil {
+			blipSyncOptions.ChannelDocsSentStats = *channelStats
+		}
+		if sha256Attachments := config.BlipSync.SHA256Attachments; sha256Attachments != nil {
+			blipSyncOptions.SHA256Attachments = *sha256Attachments
+		}
+		if maxSize := config.BlipSync.MaxAttachmentSize; maxSize != nil {
+			blipSyncOptions.MaxAttachmentSize = int64(*maxSize)
+		}
+		if maxInFlight := config.BlipSync.MaxInFlightChangeBatches; maxInFlight != nil {
+			blipSyncOptions.MaxInFlightChangeBatches = int(*maxInFlight)
+		}
+	}
+
 	if config.Unsupported.WarningThresholds.XattrSize == nil {
 		val := uint32(base.DefaultWarnThresholdXattrSize)
 		config.Unsupported.WarningThresholds.XattrSize = &val
@@ -531,6 +766,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		CacheOptions:              &cacheOptions,
 		RevisionCacheOptions:      revCacheOptions,
 		OldRevExpirySeconds:       oldRevExpirySeconds,
+		TombstoneRetentionSecs:    tombstoneRetentionSecs,
 		LocalDocExpirySecs:        localDocExpirySecs,
 		AdminInterface:            sc.config.AdminInterface,
 		UnsupportedOptions:        config.Unsupported,
@@ -547,6 +783,10 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		DeltaSyncOptions:          deltaSyncOptions,
 		CompactInterval:           compactIntervalSecs,
 		SgReplicateEnabled:        sgReplicateEnabled,
+		BlipSyncOptions:           blipSyncOptions,
+		SyncFnTimeout:             syncFnTimeout,
+		NamedFilters:              config.NamedFilters,
+		DocSummaries:              config.DocSummaries,
 	}
 
 	// Create the DB Context
@@ -687,7 +927,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 
 		// validate event-related keys
 		for k := range eventHandlersMap {
-			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" {
+			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" && k != "replication_caught_up" && k != "replication_progress" {
 				return errors.New(fmt.Sprintf("Unsupported event property '%s' defined for db %s", k, dbcontext.Name))
 			}
 		}
@@ -709,6 +949,16 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 		if err = sc.processEventHandlersForEvent(eventHandlers.DBStateChanged, db.DBStateChange, dbcontext); err != nil {
 			return err
 		}
+
+		// Process replication caught up event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.ReplicationCaughtUp, db.ReplicationCaughtUp, dbcontext); err != nil {
+			return err
+		}
+
+		// Process replication progress event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.ReplicationProgress, db.ReplicationProgress, dbcontext); err != nil {
+			return err
+		}
 		// WaitForProcess uses string, to support both omitempty and zero values
 		customWaitTime := int64(-1)
 		if eventHandlers.WaitForProcess != "" {
@@ -624,6 +624,9 @@ type BlipTesterSpec struct {
 	// those properties only affect the creation of the RestTester.
 	// If nil, a default restTester will be created based on the properties in this spec
 	restTester *RestTester
+
+	// Headers to set on the WebSocket upgrade request, to negotiate optional behaviour at handshake
+	handshakeHeaders map[string]string
 }
 
 // State associated with a BlipTester
@@ -748,6 +751,12 @@ func NewBlipTesterFromSpec(tb testing.TB, spec BlipTesterSpec) (*BlipTester, err
 			"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(spec.connectingUsername+":"+spec.connectingPassword))},
 		}
 	}
+	for k, v := range spec.handshakeHeaders {
+		if config.Header == nil {
+			config.Header = http.Header{}
+		}
+		config.Header.Set(k, v)
+	}
 
 	bt.sender, err = bt.blipContext.DialConfig(config)
 	if err != nil {